@@ -0,0 +1,112 @@
+// Command callhooks places an audio call through the processing hooks of
+// a call session: the microphone goes through a gain before it is
+// encoded, the audio received is written to a file as raw 16 bit
+// little-endian PCM, and the first frame of video the peer adds to the
+// call is saved as a PNG. Answer it with croc audio --listen on the same
+// code:
+//
+//	go run ./examples/callhooks -code 1234-call -gain 2 -out incoming.pcm -frame incoming.png
+//	ffplay -f s16le -ar 48000 -ac 1 incoming.pcm
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/models"
+)
+
+// gain returns a processor that scales the samples by factor, clipping
+// them at full scale.
+func gain(factor float64) call.AudioProcessor {
+	return func(pcm []int16, sampleRate, channels int) []int16 {
+		for i, s := range pcm {
+			pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, float64(s)*factor)))
+		}
+		return pcm
+	}
+}
+
+func main() {
+	options := croc.Options{RelayPassword: models.DEFAULT_PASSPHRASE}
+	flag.StringVar(&options.SharedSecret, "code", "", "call code the peer listens on")
+	flag.StringVar(&options.RelayAddress, "relay", models.DEFAULT_RELAY+":"+models.DEFAULT_PORT, "relay address as host:port")
+	flag.StringVar(&options.RelayPassword, "pass", options.RelayPassword, "relay password")
+	factor := flag.Float64("gain", 2, "gain applied to the microphone")
+	out := flag.String("out", "incoming.pcm", "file the received audio is written to")
+	frameOut := flag.String("frame", "incoming.png", "file the first frame of received video is saved to")
+	flag.Parse()
+	if options.SharedSecret == "" {
+		log.Fatal("-code is required")
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	cs, err := call.Dial(context.Background(), options, call.MediaAudio, call.DirectionSendRecv, call.DefaultCallOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs.SetOutgoingAudioProcessor(gain(*factor))
+	// the tap runs on the media path, so it writes to a buffer rather than
+	// straight to the file
+	var mu sync.Mutex
+	cs.OnIncomingAudio(func(pcm []int16, sampleRate, channels int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := binary.Write(w, binary.LittleEndian, pcm); err != nil {
+			log.Printf("writing %s: %v", *out, err)
+		}
+	})
+	// encoding a PNG takes longer than the budget of the tap, so it is
+	// done off the media path
+	frames := make(chan image.Image, 1)
+	cs.OnIncomingVideo(func(frame image.Image) {
+		select {
+		case frames <- frame:
+			cs.OnIncomingVideo(nil)
+		default:
+		}
+	})
+	hungUp, saved := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(saved)
+		var frame image.Image
+		select {
+		case frame = <-frames:
+		case <-hungUp:
+			return
+		}
+		f, err := os.Create(*frameOut)
+		if err == nil {
+			err = errors.Join(png.Encode(f, frame), f.Close())
+		}
+		if err != nil {
+			log.Printf("saving %s: %v", *frameOut, err)
+		}
+	}()
+	cs.Interact(os.Stdin)
+	cs.OnIncomingAudio(nil)
+	cs.OnIncomingVideo(nil)
+	close(hungUp)
+	<-saved
+	// wait for a frame still being written before flushing
+	mu.Lock()
+	defer mu.Unlock()
+}
@@ -0,0 +1,48 @@
+// Command loadtest puts a croc relay under load and reports how it held
+// up. Without -relay it starts a relay in this process:
+//
+//	go run ./examples/loadtest -clients 1000 -rooms 500 -rate 20
+//	go run ./examples/loadtest -relay relay.example.com:9009 -pass secret
+//
+// With -json the report is printed as JSON, in the form of the baselines
+// in src/tcp/loadtest/testdata.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/schollz/croc/v10/src/tcp/loadtest"
+)
+
+func main() {
+	c := loadtest.DefaultConfig()
+	flag.StringVar(&c.Address, "relay", "", "relay address as host:port; empty starts one in this process")
+	flag.StringVar(&c.Password, "pass", c.Password, "relay password")
+	flag.IntVar(&c.Clients, "clients", c.Clients, "synthetic clients")
+	flag.IntVar(&c.Rooms, "rooms", c.Rooms, "rooms the clients are spread over")
+	flag.IntVar(&c.Concurrency, "concurrency", c.Concurrency, "handshakes in flight at once")
+	flag.Float64Var(&c.Rate, "rate", c.Rate, "frames per second each client sends")
+	flag.IntVar(&c.Size, "size", c.Size, "frame size in bytes")
+	flag.DurationVar(&c.Duration, "duration", c.Duration, "how long the clients send")
+	flag.DurationVar(&c.Timeout, "timeout", c.Timeout, "handshake timeout")
+	asJSON := flag.Bool("json", false, "print the config and report as JSON")
+	flag.Parse()
+
+	r, err := loadtest.Run(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*asJSON {
+		fmt.Println(r)
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(loadtest.Baseline{Config: c, Report: r}); err != nil {
+		log.Fatal(err)
+	}
+}
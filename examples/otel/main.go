@@ -0,0 +1,46 @@
+//go:build otel
+
+// Command otel runs a relay that exports its traces over OTLP/gRPC, to the
+// collector in OTEL_EXPORTER_OTLP_ENDPOINT (localhost:4317 by default).
+// It needs the OTLP exporter, which croc itself does not depend on:
+//
+//	go get go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc
+//	go run -tags otel ./examples/otel
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
+	if err != nil {
+		log.Fatal(err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("croc-relay"))),
+	)
+	defer tp.Shutdown(context.Background())
+
+	go func() {
+		err := tcp.RunWithOptionsAsync("0.0.0.0", "9009", "pass123", tcp.WithTracerProvider(tp))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+}
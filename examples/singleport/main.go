@@ -0,0 +1,70 @@
+// Command singleport places an audio call whose media goes through one
+// UDP port, for deployments where the firewall opens a single port
+// rather than a range. The call runs on a WebRTC stack of its own, with
+// the port shared through a UDP mux. Answer it with croc audio --listen on
+// the same code:
+//
+//	go run ./examples/singleport -code 1234-call -port 50000
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/models"
+)
+
+// singlePortAPI returns a WebRTC API whose ICE runs over conn only.
+func singlePortAPI(conn net.PacketConn) (*webrtc.API, error) {
+	// the codecs croc sends at the payload types it sends them with
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+	var s webrtc.SettingEngine
+	s.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	// a mux carries UDP only
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
+}
+
+func main() {
+	options := croc.Options{RelayPassword: models.DEFAULT_PASSPHRASE}
+	flag.StringVar(&options.SharedSecret, "code", "", "call code the peer listens on")
+	flag.StringVar(&options.RelayAddress, "relay", models.DEFAULT_RELAY+":"+models.DEFAULT_PORT, "relay address as host:port")
+	flag.StringVar(&options.RelayPassword, "pass", options.RelayPassword, "relay password")
+	port := flag.Int("port", 50000, "UDP port all media goes through")
+	flag.Parse()
+	if options.SharedSecret == "" {
+		log.Fatal("-code is required")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *port})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	api, err := singlePortAPI(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	co := call.DefaultCallOptions()
+	co.WebRTC.API = api
+	cs, err := call.Dial(context.Background(), options, call.MediaAudio, call.DirectionSendRecv, co)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cs.Interact(os.Stdin)
+}
@@ -0,0 +1,245 @@
+package call
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeCallDeclined tells a caller that its invite will not be answered,
+// either because the callee is busy with another call, because the
+// callee's policy does not allow the offered media, because it lacks the
+// device to send what the caller asked for or because the two cannot
+// agree on a signaling version. Message holds the reason and ID
+// the id of the declined invite.
+const typeCallDeclined = message.TypeWebRTCDeclined
+
+// Reasons an invite is declined. A version mismatch is declined with the
+// error from negotiateVersion.
+const (
+	declinedBusy         = "busy"
+	declinedPolicy       = "media not allowed"
+	declinedNoCamera     = "no camera"
+	declinedNoMicrophone = "no microphone"
+)
+
+// ErrDeclined is returned to a caller whose invite was declined.
+var ErrDeclined = errors.New("call declined")
+
+// ErrSignalingVersion is returned when the peer's signaling version is one
+// this side cannot speak.
+var ErrSignalingVersion = errors.New("incompatible call signaling version")
+
+// negotiateVersion returns the signaling version to use with a peer that
+// offers the given one: the lower of the two, if this side still speaks
+// it.
+func negotiateVersion(offered int) (int, error) {
+	v := min(offered, message.CurrentSignalingVersion)
+	if v < message.MinSignalingVersion {
+		return 0, fmt.Errorf("%w: the peer speaks version %d, this side needs %d to %d; update croc on the older side",
+			ErrSignalingVersion, offered, message.MinSignalingVersion, message.CurrentSignalingVersion)
+	}
+	return v, nil
+}
+
+// newCallID returns a random id for an invite. The answer and any decline
+// carry it back so a caller never acts on a reply meant for another caller
+// in the same room.
+func newCallID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AnswerPolicy limits which invites a listening callee accepts.
+type AnswerPolicy struct {
+	// SendOnlyVideo accepts only calls in which this side sends video and
+	// nothing else, as for a remote camera.
+	SendOnlyVideo bool
+}
+
+func (p AnswerPolicy) allows(d Directions) bool {
+	if p.SendOnlyVideo {
+		return d.Audio == "" && d.Video == DirectionRecvOnly
+	}
+	return true
+}
+
+// ListenOptions configure Listen.
+type ListenOptions struct {
+	// AutoAnswer takes every invite the policy allows without asking.
+	AutoAnswer bool
+	Policy     AnswerPolicy
+	// Confirm is asked about each invite when AutoAnswer is off.
+	Confirm func(Directions) bool
+	// Audio tunes the Opus encoder of answered calls; start from
+	// DefaultAudioOptions.
+	Audio AudioOptions
+	// Degrade pauses the video answered calls send while the network
+	// cannot carry it.
+	Degrade DegradeOptions
+	// Network marks the traffic of answered calls and pins their ports.
+	Network NetworkOptions
+	// ICE are the STUN and TURN servers of answered calls.
+	ICE ICEOptions
+	// SignalLog, if set, records the signaling of every invite and call.
+	SignalLog *SignalLog
+	// Devices stand in for the microphone, camera and speaker of the
+	// machine in answered calls.
+	Devices Devices
+	// WebRTC customizes the pion stack answered calls are built on. An
+	// API given here needs the codecs of both audio and video calls.
+	WebRTC WebRTCOptions
+	// MaxSendBitrate caps what answered calls send and MaxRecvBitrate
+	// what they ask the caller to send, in bits per second; zero leaves a
+	// direction uncapped.
+	MaxSendBitrate int64
+	MaxRecvBitrate int64
+}
+
+// answerer decides which invites a listening callee takes. It is in at most
+// one call at a time and declines every other invite until that call ends,
+// so a second caller cannot take over a call in progress.
+type answerer struct {
+	sc     *signalCipher
+	policy AnswerPolicy
+	// media returns the devices of the callee, which settle the
+	// directions of each invite; nil stands for all of them.
+	media func() Media
+	// ice are the servers of the calls answered.
+	ice    *iceServers
+	active string
+}
+
+// localMedia returns the devices of the callee.
+func (a *answerer) localMedia() Media {
+	if a.media == nil {
+		return Media{Microphone: true, Camera: true}
+	}
+	return a.media()
+}
+
+// handle opens a frame from the signaling room. If the frame is an invite
+// to accept, it returns the invite and the directions it settles on with
+// ok set, see settle. If the
+// invite is to be turned away, reply is the sealed decline to send back.
+// Frames that cannot be authenticated are dropped without a reply, so
+// anyone without the secret learns nothing.
+func (a *answerer) handle(m message.Message) (inv message.Message, dirs Directions, ok bool, reply *message.Message, err error) {
+	if m.Type != message.TypeWebRTCOffer {
+		return
+	}
+	if inv, err = a.sc.open(m); err != nil {
+		return
+	}
+	body, err := parseInvite(inv)
+	if err != nil {
+		return
+	}
+	dirs = body.Directions
+	if inv.ID == a.active && a.active != "" {
+		// the caller sent its invite again; it already has an answer coming
+		return
+	}
+	reason := ""
+	_, errVersion := negotiateVersion(inv.SignalingVersion)
+	switch {
+	case errVersion != nil:
+		reason = errVersion.Error()
+	case a.active != "":
+		reason = declinedBusy
+	case !a.policy.allows(dirs):
+		reason = declinedPolicy
+	default:
+		dirs, reason = settle(body, a.localMedia())
+	}
+	if reason != "" {
+		decline, errSeal := a.sc.seal(message.Message{Type: typeCallDeclined, ID: inv.ID, Message: reason})
+		if errSeal != nil {
+			err = errSeal
+			return
+		}
+		return inv, dirs, false, &decline, nil
+	}
+	a.active = inv.ID
+	return inv, dirs, true, nil, nil
+}
+
+// end marks the current call as over so the next invite can be accepted.
+func (a *answerer) end() {
+	a.active = ""
+}
+
+// newAnswer builds the answer signal for the invite with the given id,
+// settling on a signaling version no newer than the one offered.
+func newAnswer(sdp []byte, id string, offered int) message.Message {
+	return message.Message{Type: message.TypeWebRTCAnswer, Message: string(sdp), ID: id,
+		SignalingVersion: min(offered, message.CurrentSignalingVersion)}
+}
+
+// checkReply looks at an opened frame a caller received while waiting for
+// its answer. It returns the answer when the frame is one for this call,
+// ErrDeclined when the callee turned the call down, and neither for frames
+// meant for someone else. Answers without an id come from callees that
+// predate call ids and are accepted. An answer settling on a signaling
+// version this side cannot speak is an error.
+func checkReply(m message.Message, id string) (answer *message.Message, err error) {
+	switch m.Type {
+	case message.TypeWebRTCAnswer:
+		if m.ID != "" && m.ID != id {
+			return nil, nil
+		}
+		if m.SignalingVersion > message.CurrentSignalingVersion {
+			return nil, fmt.Errorf("%w: the callee answered with version %d, this side speaks up to %d",
+				ErrSignalingVersion, m.SignalingVersion, message.CurrentSignalingVersion)
+		}
+		if _, err = negotiateVersion(m.SignalingVersion); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	case typeCallDeclined:
+		if m.ID != id {
+			return nil, nil
+		}
+		if m.Message == declinedNoCamera {
+			return nil, fmt.Errorf("%w: %w", ErrDeclined, errPeerNoCamera)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrDeclined, m.Message)
+	default:
+		return nil, nil
+	}
+}
+
+// mirror returns this side's direction for a kind the caller offered in
+// direction d.
+func mirror(d Direction) Direction {
+	switch d {
+	case DirectionSendOnly:
+		return DirectionRecvOnly
+	case DirectionRecvOnly:
+		return DirectionSendOnly
+	default:
+		return d
+	}
+}
+
+// formatEvent renders a listener event as a logfmt line, so service
+// managers and log collectors can parse what an unattended callee did.
+func formatEvent(at time.Time, event string, kv ...any) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s event=%s", at.UTC().Format(time.RFC3339), event)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], v)
+	}
+	return b.String()
+}
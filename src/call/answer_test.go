@@ -0,0 +1,113 @@
+package call
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func sealedInvite(t *testing.T, secret string, dirs Directions) (invite, sealed message.Message) {
+	sc, err := newSignalCipher(secret)
+	assert.Nil(t, err)
+	invite, err = newInvite([]byte(`{"type":"offer","sdp":"v=0"}`), inviteBody{Directions: dirs})
+	assert.Nil(t, err)
+	sealed, err = sc.seal(invite)
+	assert.Nil(t, err)
+	return
+}
+
+func TestAnswererOneCallAtATime(t *testing.T) {
+	secret := "1234-baby-monitor"
+	sc, err := newSignalCipher(secret)
+	assert.Nil(t, err)
+	a := &answerer{sc: sc}
+	video := Directions{Video: DirectionRecvOnly}
+
+	first, sealedFirst := sealedInvite(t, secret, video)
+	inv, dirs, ok, reply, err := a.handle(sealedFirst)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, reply)
+	assert.Equal(t, first.ID, inv.ID)
+	assert.Equal(t, video, dirs)
+
+	// the same invite again is neither answered twice nor declined
+	_, _, ok, reply, err = a.handle(sealedFirst)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, reply)
+
+	// a second caller is turned away while the first call is running
+	second, sealedSecond := sealedInvite(t, secret, video)
+	_, _, ok, reply, err = a.handle(sealedSecond)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	if assert.NotNil(t, reply) {
+		opened, err := sc.open(*reply)
+		assert.Nil(t, err)
+		answer, err := checkReply(opened, second.ID)
+		assert.Nil(t, answer)
+		assert.True(t, errors.Is(err, ErrDeclined))
+		assert.Contains(t, err.Error(), declinedBusy)
+		// the first caller does not mistake it for its own reply
+		answer, err = checkReply(opened, first.ID)
+		assert.Nil(t, answer)
+		assert.Nil(t, err)
+	}
+
+	// invites without the secret get no reply at all
+	_, sealedStranger := sealedInvite(t, "9999-wrong-secret", video)
+	_, _, ok, reply, err = a.handle(sealedStranger)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, reply)
+
+	a.end()
+	_, _, ok, _, err = a.handle(sealedSecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestAnswerPolicy(t *testing.T) {
+	secret := "1234-baby-monitor"
+	sc, _ := newSignalCipher(secret)
+	a := &answerer{sc: sc, policy: AnswerPolicy{SendOnlyVideo: true}}
+
+	_, sealed := sealedInvite(t, secret, Directions{Audio: DirectionSendRecv, Video: DirectionRecvOnly})
+	_, _, ok, reply, err := a.handle(sealed)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.NotNil(t, reply)
+	assert.Empty(t, a.active)
+
+	_, sealed = sealedInvite(t, secret, Directions{Video: DirectionRecvOnly})
+	_, _, ok, _, err = a.handle(sealed)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestCheckReply(t *testing.T) {
+	answer, err := checkReply(newAnswer([]byte("sdp"), "abc", message.CurrentSignalingVersion), "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "sdp", answer.Message)
+	answer, err = checkReply(newAnswer([]byte("sdp"), "other", message.CurrentSignalingVersion), "abc")
+	assert.Nil(t, err)
+	assert.Nil(t, answer)
+	// answers from callees without call ids still count
+	answer, err = checkReply(message.Message{Type: message.TypeWebRTCAnswer, Message: "sdp"}, "abc")
+	assert.Nil(t, err)
+	assert.NotNil(t, answer)
+
+	assert.Equal(t, DirectionSendOnly, mirror(DirectionRecvOnly))
+	assert.Equal(t, DirectionRecvOnly, mirror(DirectionSendOnly))
+	assert.Equal(t, DirectionSendRecv, mirror(DirectionSendRecv))
+}
+
+func TestFormatEvent(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, `time=2024-05-01T12:00:00Z event=invite call=abc media="incoming one-way video" empty=""`,
+		formatEvent(at, "invite", "call", "abc", "media", "incoming one-way video", "empty", ""))
+}
@@ -0,0 +1,49 @@
+package call
+
+import (
+	"fmt"
+
+	"github.com/schollz/croc/v10/src/internal/opus"
+)
+
+// AudioOptions tune the Opus encoder of a call for lossy networks.
+type AudioOptions struct {
+	// FEC sends in-band forward error correction, letting the peer rebuild
+	// a lost packet from the next one, and asks the peer to do the same.
+	FEC bool
+	// ExpectedLossPct is the packet loss, in percent, the encoder prepares
+	// for. FEC only adds anything when it is above zero.
+	ExpectedLossPct int
+	// Complexity is the encoder complexity from 0, cheapest, to 10, best.
+	Complexity int
+	// WarmUp starts the microphone and encoder while the call rings, so
+	// audio flows as soon as the call connects. What they produce before
+	// then is discarded, and the microphone is released if the call is
+	// declined.
+	WarmUp bool
+	// NoTones plays no ring-back tone while a placed call rings, nor the
+	// chime when it connects and the tone when it ends. The tones play on
+	// the speaker of the call, so calls without one have none.
+	NoTones bool
+}
+
+// DefaultAudioOptions turns FEC on for a moderately lossy network.
+func DefaultAudioOptions() AudioOptions {
+	return AudioOptions{FEC: true, ExpectedLossPct: 10, Complexity: 10}
+}
+
+// Validate reports whether the options are in range.
+func (o AudioOptions) Validate() error {
+	if o.ExpectedLossPct < 0 || o.ExpectedLossPct > 100 {
+		return fmt.Errorf("expected packet loss %d%% is not between 0 and 100", o.ExpectedLossPct)
+	}
+	if o.Complexity < 0 || o.Complexity > 10 {
+		return fmt.Errorf("opus complexity %d is not between 0 and 10", o.Complexity)
+	}
+	return nil
+}
+
+// fmtp is the SDP format parameter line advertised for Opus.
+func (o AudioOptions) fmtp() string {
+	return opus.Fmtp(o.FEC)
+}
@@ -0,0 +1,175 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/mediadevices"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/internal/opus"
+	log "github.com/schollz/logger"
+)
+
+// encoder returns the Opus encoder the microphone is captured with, held
+// to the send cap of caps.
+func (o AudioOptions) encoder(caps *bitrateCaps) *opus.Params {
+	return &opus.Params{FEC: o.FEC, ExpectedLossPct: o.ExpectedLossPct, Complexity: o.Complexity,
+		OnEncoder: func(e *opus.Encoder) { caps.addEncoder(e) }}
+}
+
+// newCallAPI returns the WebRTC API for a call, the codecs to capture the
+// microphone with and where the bandwidth estimator of the call arrives.
+// The Opus encoder is registered before the default codecs so that its
+// format parameters, not the stock ones, go in the SDP, and is held to
+// the send cap of caps. The call runs on the network described by
+// network, or on the API of w.
+func newCallAPI(o AudioOptions, caps *bitrateCaps, network NetworkOptions, w WebRTCOptions) (*webrtc.API, *mediadevices.CodecSelector, <-chan cc.BandwidthEstimator, error) {
+	codecs := mediadevices.NewCodecSelector(mediadevices.WithAudioEncoders(o.encoder(caps)))
+	m := webrtc.MediaEngine{}
+	codecs.Populate(&m)
+	api, estimators, err := newAPI(&m, network, w)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return api, codecs, estimators, nil
+}
+
+// newAPI returns the API of w if it has one. Otherwise it registers the
+// default codecs in m, along with what calls need on top of them, and
+// returns an API on m and where its bandwidth estimator arrives.
+func newAPI(m *webrtc.MediaEngine, network NetworkOptions, w WebRTCOptions) (*webrtc.API, <-chan cc.BandwidthEstimator, error) {
+	if w.API != nil {
+		return w.API, nil, nil
+	}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	// to take the layers of callers sending simulcast video
+	if err := registerSimulcast(m); err != nil {
+		return nil, nil, err
+	}
+	i, estimators, err := registerEstimator(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := settingEngine(network)
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.SettingEngine != nil {
+		w.SettingEngine(&s)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), estimators, nil
+}
+
+// audioReceiver decodes the Opus the peer sends through a jitter buffer,
+// which rebuilds lost packets with FEC and counts how many it saved, and
+// plays the frames on the speaker of the call.
+type audioReceiver struct {
+	fec     bool
+	hooks   *mediaHooks
+	speaker Sink
+	mu      sync.Mutex
+	stats   LossStats
+	seen    bool
+	// first times the first packet against the call connecting, which
+	// the caller of receiveMedia marks.
+	first firstMedia
+}
+
+// receiveMedia decodes every Opus track pc receives, handing the frames
+// to the incoming audio tap of hooks if set and to the Speaker of
+// devices. The video goes to the Screen of devices, if there is one, and
+// decoded to the incoming video tap of hooks. Call it before signaling.
+func receiveMedia(pc *webrtc.PeerConnection, o AudioOptions, hooks *mediaHooks, devices Devices) *audioReceiver {
+	r := &audioReceiver{fec: o.FEC, hooks: hooks, speaker: devices.Speaker}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		switch {
+		case strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus):
+			go r.run(track)
+		case track.Kind() == webrtc.RTPCodecTypeVideo && (devices.Screen != nil || hooks != nil):
+			var tap *videoTap
+			if hooks != nil {
+				tap = &videoTap{hooks: hooks, requestKeyFrame: func() {
+					pli := &rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}
+					if err := pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+						log.Debugf("could not ask for a key frame: %v", err)
+					}
+				}}
+			}
+			go playVideo(track, devices.Screen, tap)
+		}
+	})
+	return r
+}
+
+// rtpReader is where audioReceiver reads the packets of a track from,
+// such as a *webrtc.TrackRemote.
+type rtpReader interface {
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+}
+
+func (r *audioReceiver) run(track rtpReader) {
+	dec, err := opus.NewDecoder(opus.SampleRate, 1)
+	if err != nil {
+		log.Debugf("not decoding audio: %v", err)
+		return
+	}
+	defer dec.Close()
+	var play func([]int16)
+	if r.hooks != nil || r.speaker != nil {
+		play = func(pcm []int16) {
+			if r.hooks != nil {
+				r.hooks.tapAudio(pcm, opus.SampleRate, 1)
+			}
+			if r.speaker == nil {
+				return
+			}
+			// the decoder reuses pcm for the next frame
+			f := Frame{Samples: slices.Clone(pcm), SampleRate: opus.SampleRate, Captured: time.Now()}
+			if err := r.speaker.WriteFrame(f); err != nil {
+				log.Debugf("dropping audio frame: %v", err)
+			}
+		}
+	}
+	j := newJitterBuffer(dec, r.fec, play)
+	r.mu.Lock()
+	r.seen = true
+	r.mu.Unlock()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			break
+		}
+		if len(pkt.Payload) == 0 {
+			continue
+		}
+		r.first.markPacket(time.Now())
+		j.push(pkt.SequenceNumber, pkt.Payload)
+		r.mu.Lock()
+		r.stats = j.stats
+		r.mu.Unlock()
+	}
+	j.flush()
+	r.mu.Lock()
+	r.stats = j.stats
+	r.mu.Unlock()
+}
+
+// summary describes the audio received, or is empty if there was none.
+func (r *audioReceiver) summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.seen {
+		return ""
+	}
+	return r.stats.String()
+}
@@ -1,193 +1,564 @@
+//go:build !nomedia
+
 package call
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/mediadevices" // Register camera driver
 	// Register microphone driver
 	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/comm"
 	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
 	"github.com/schollz/croc/v10/src/message"
 	"github.com/schollz/croc/v10/src/tcp"
 	log "github.com/schollz/logger"
 )
 
+// signaling is the relay connection a call was set up on, kept open for
+// renegotiating the call.
+type signaling struct {
+	conn   *comm.Comm
+	sc     *signalCipher
+	callID string
+	// settled are the directions the callee took the call with, as
+	// offered unless it lacked a device, and peer its devices if it said.
+	settled Directions
+	peer    *Media
+}
+
+// renegotiate keeps the call on pc in step with its tracks over the relay
+// connection, as the impolite side, until stop is called, refreshing its
+// TURN credentials from ice. The peer's video pauses and resumes go to
+// onVideo, the receive caps it asks for to onCap and its acknowledgement
+// of a recording to onRecordingAck.
+func (s *signaling) renegotiate(pc *webrtc.PeerConnection, ice *iceServers, onVideo func(VideoEvent), onCap func(int64), onRecordingAck func()) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := renegotiate(ctx, pc, ice, s.callID, false, relaySignals(s.conn, s.sc))
+	go pumpSignals(s.conn, s.sc, r, onVideo, onCap, onRecordingAck)
+	return cancel
+}
+
+// askConsent asks the peer to acknowledge that the call is recorded,
+// naming this side alias.
+func (s *signaling) askConsent(alias string) error {
+	return relaySignals(s.conn, s.sc)(recordingSignal(s.callID, recordingRequest, alias))
+}
+
+// degrade runs degradeVideo on the call cs until ctx is done, recording
+// each pause and resume on cs and telling the peer. camera, if set, is
+// held while the video is paused.
+func (s *signaling) degrade(ctx context.Context, pc *webrtc.PeerConnection, cs *CallSession, estimators <-chan cc.BandwidthEstimator, o DegradeOptions, camera *cameraWatch) {
+	send := relaySignals(s.conn, s.sc)
+	go degradeVideo(ctx, pc, estimators, o, cs.caps, func(e VideoEvent) {
+		camera.pause(e)
+		cs.video.add(e)
+		if err := send(videoStateSignal(s.callID, e)); err != nil {
+			log.Debugf("could not tell the peer about the video: %v", err)
+		}
+	})
+}
+
+// watchCamera runs camera on the call cs until ctx is done, recording
+// each stall and recovery on cs and telling the peer, who knows this
+// side as alias. camera may be nil.
+func (s *signaling) watchCamera(ctx context.Context, cs *CallSession, camera *cameraWatch, alias string) {
+	if camera == nil {
+		return
+	}
+	send := relaySignals(s.conn, s.sc)
+	go camera.run(ctx, func(e CaptureEvent) {
+		cs.capture.add(e)
+		if err := send(captureStateSignal(s.callID, alias, e)); err != nil {
+			log.Debugf("could not tell the peer about the camera: %v", err)
+		}
+	})
+}
+
+// capBitrate runs enforceCaps on the call on pc until ctx is done.
+func (s *signaling) capBitrate(ctx context.Context, pc *webrtc.PeerConnection, caps *bitrateCaps) {
+	go enforceCaps(ctx, pc, caps, s.callID, relaySignals(s.conn, s.sc))
+}
+
+// callerInstance is the relay instance of the calls placed by this
+// process, so a call supersedes the stale connections of earlier ones but
+// not those of other peers on this host.
+var callerInstance = tcp.NewInstance()
+
 // signalSDP exchanges SDP between peers using signaling over the TCP relay.
-func signalSDP(pc *webrtc.PeerConnection, relayAddr, relayPass, roomName string) error {
-	// Connect to the relay server for signaling.
-	conn, _, _, err := tcp.ConnectToTCPServer(relayAddr, relayPass, roomName, 30*time.Second)
+// Offers and answers are encrypted end-to-end with a key derived from the
+// shared secret so the relay cannot tamper with ICE credentials or DTLS
+// fingerprints. The offer also advertises the media directions and the
+// devices of this side, in body, so the callee can tell a one-way call
+// from a regular one and settle on what it can send. The connection to
+// the relay stays open on success; the caller closes it. Cancelling ctx
+// gives up waiting for the answer. The connection is marked as set in
+// network and signals are recorded in slog, if set.
+func signalSDP(ctx context.Context, pc *webrtc.PeerConnection, options croc.Options, body inviteBody, network NetworkOptions, slog *SignalLog) (s *signaling, err error) {
+	sc, err := newSignalCipher(options.SharedSecret)
 	if err != nil {
-		return err
+		return
+	}
+	sc.log = slog
+	// Connect to the relay server for signaling. The room is reused when a
+	// call is retried, so ask the relay to drop our stale connections.
+	conn, _, _, err := options.ConnectToRoom(options.RelayAddress, tcp.RoomRequest{
+		Room:         options.RoomName,
+		Policy:       tcp.RoomPolicyLatestOnly,
+		Mode:         tcp.RoomModeSignal,
+		App:          options.App,
+		Capabilities: []string{tcp.CapabilityControlFrames},
+		Instance:     callerInstance,
+	}, 30*time.Second)
+	if err != nil {
+		return
 	}
-	defer conn.Close()
+	markSignaling(conn, network.SignalingDSCP)
+	stopWaiting := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if !stopWaiting() && err == nil {
+			// cancelled just as the answer came in
+			s, err = nil, ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}
+	}()
 
 	// Create and set the local offer.
 	offer, err := pc.CreateOffer(nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	gathered := webrtc.GatheringCompletePromise(pc)
 	if err = pc.SetLocalDescription(offer); err != nil {
-		return err
+		return nil, err
 	}
-	offerData, err := json.Marshal(offer)
+	// Signaling is a single round trip, so the offer carries all candidates.
+	<-gathered
+	offerData, err := json.Marshal(pc.LocalDescription())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	invite, err := newInvite(offerData, body)
+	if err != nil {
+		return nil, err
 	}
-	sigMsg := message.Message{
-		Type:    "webrtc_offer",
-		Message: string(offerData),
+	sigMsg, err := sc.seal(invite)
+	if err != nil {
+		return nil, err
 	}
 	data, err := json.Marshal(sigMsg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err = conn.Send(data); err != nil {
-		return err
+		return nil, err
+	}
+
+	// Wait for the answer to this invite. Replies to other callers in the
+	// room and frames that fail to authenticate are skipped.
+	for {
+		answerData, err := conn.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if tcp.IsControlFrame(answerData) {
+			if kind, err := tcp.ParseControlFrame(conn, answerData); err == nil && kind == tcp.ControlNobodyJoined {
+				return nil, ErrNobodyJoined
+			}
+			continue
+		}
+		// Debug log raw answerData in case of error.
+		log.Debugf("Received signal: %s", string(answerData))
+		var sig message.Message
+		if err = json.Unmarshal(answerData, &sig); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal SDP answer: %v\nraw data: %s", err, string(answerData))
+		}
+		if sig, err = sc.open(sig); err != nil {
+			log.Debugf("ignoring signal: %v", err)
+			continue
+		}
+		if sig.Type == message.TypeWebRTCOffer {
+			return nil, fmt.Errorf("the peer is calling too; one side has to run 'croc call --listen'")
+		}
+		ansMsg, err := checkReply(sig, invite.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ansMsg == nil {
+			continue
+		}
+		var answer webrtc.SessionDescription
+		if err = json.Unmarshal([]byte(ansMsg.Message), &answer); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal remote SDP: %v\nraw SDP: %s", err, ansMsg.Message)
+		}
+		if err = pc.SetRemoteDescription(answer); err != nil {
+			return nil, err
+		}
+		s = &signaling{conn: conn, sc: sc, callID: invite.ID, settled: body.Directions}
+		if ab, ok := parseAnswerBody(*ansMsg); ok {
+			s.settled, s.peer = ab.Directions, ab.Media
+		}
+		return s, nil
+	}
+}
+
+// addMedia sets up one media kind in the given direction, encoding with
+// codecs, and returns the tracks it captured, from devices where they
+// stand in. Devices are only enumerated and captured when this side
+// sends, so a receive-only call works on a machine without a camera or
+// microphone.
+func addMedia(pc *webrtc.PeerConnection, kind webrtc.RTPCodecType, dir Direction, codecs *mediadevices.CodecSelector, devices Devices) ([]mediadevices.Track, error) {
+	if !dir.Sends() {
+		_, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		return nil, err
+	}
+	transceiverDir := webrtc.RTPTransceiverDirectionSendrecv
+	if !dir.Receives() {
+		transceiverDir = webrtc.RTPTransceiverDirectionSendonly
 	}
 
-	// Wait and read SDP answer.
-	answerData, err := conn.Receive()
+	tracks, err := captureTracks(kind, codecs, devices)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for _, track := range tracks {
+		if _, err = pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: transceiverDir}); err != nil {
+			closeTracks(tracks)
+			return nil, fmt.Errorf("failed to add %s track: %v", kind, err)
+		}
+	}
+	return tracks, nil
+}
+
+// captureTracks opens the microphone or camera for kind, encoding with
+// codecs if set, or reads the source of devices standing in for it.
+func captureTracks(kind webrtc.RTPCodecType, codecs *mediadevices.CodecSelector, devices Devices) ([]mediadevices.Track, error) {
+	if track, ok, err := devices.track(kind, codecs); ok {
+		if err != nil {
+			return nil, fmt.Errorf("failed to capture %s: %v", kind, err)
+		}
+		return []mediadevices.Track{track}, nil
+	}
+	deviceKind, name := mediadevices.AudioInput, "microphone"
+	if kind == webrtc.RTPCodecTypeVideo {
+		deviceKind, name = mediadevices.VideoInput, "webcam"
+	}
+	if !hasDevice(deviceKind) {
+		return nil, fmt.Errorf("no %s detected on this machine", name)
+	}
+
+	constraints := mediadevices.MediaStreamConstraints{Codec: codecs}
+	if kind == webrtc.RTPCodecTypeVideo {
+		constraints.Video = func(c *mediadevices.MediaTrackConstraints) {
+			// Default video constraints; customize camera resolution, etc., if needed.
+		}
+	} else {
+		constraints.Audio = func(c *mediadevices.MediaTrackConstraints) {
+			// Default constraints; you can refine and select device ID as needed.
+		}
+	}
+	stream, err := mediadevices.GetUserMedia(constraints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture %s: %v", kind, err)
+	}
+	return stream.GetTracks(), nil
+}
+
+// hasDevice reports whether a capture device of the given kind exists.
+func hasDevice(kind mediadevices.MediaDeviceType) bool {
+	for _, d := range mediadevices.EnumerateDevices() {
+		if d.Kind == kind {
+			return true
+		}
 	}
-	// Debug log raw answerData in case of error.
-	log.Debugf("Received SDP answer: %s", string(answerData))
-	var ansMsg message.Message
-	if err = json.Unmarshal(answerData, &ansMsg); err != nil {
-		return fmt.Errorf("failed to unmarshal SDP answer: %v\nraw data: %s", err, string(answerData))
+	return false
+}
+
+// Dial places a call of kind to the peer waiting in the room of options,
+// usually with croc call --listen, and returns once the media flows. With
+// DirectionRecvOnly no microphone or camera is needed, and a two-way
+// video call placed without a camera only receives. A video call to a
+// peer without a camera goes on as co.Video.Fallback says. The call's
+// Notices tell how it fell short of what was asked for. A call that
+// cannot reach the peer says what co.Preflight predicted, if set. A call
+// whose TURN credentials cannot be fetched goes on with the servers of
+// co.ICE alone, and says so in its Notices. A call with co.Record set is
+// only recorded once the peer acknowledges it, or the recording is
+// overridden after the peer failed to in time.
+// Cancelling ctx gives up placing the call; it does not end an
+// established one.
+func Dial(ctx context.Context, options croc.Options, kind MediaKind, dir Direction, co CallOptions) (*CallSession, error) {
+	if err := errors.Join(checkBitrateCaps(co.MaxSendBitrate, co.MaxRecvBitrate), co.Captions.Validate(), co.ICE.Validate(), co.Record.Validate()); err != nil {
+		return nil, err
 	}
-	if ansMsg.Type != "webrtc_answer" {
-		return fmt.Errorf("unexpected signaling type: %s", ansMsg.Type)
+	caps := newBitrateCaps(co.MaxSendBitrate, co.MaxRecvBitrate)
+	ice := newICEServers(co.ICE)
+	var cs *CallSession
+	var err error
+	switch kind {
+	case MediaAudio:
+		cs, err = dialAudio(ctx, options, dir, co.Audio, co.Degrade, co.Network, co.SignalLog, co.Devices, co.WebRTC, ice, caps)
+	case MediaVideo:
+		cs, err = dialVideo(ctx, options, dir, co.Video, co.Degrade, co.Network, co.SignalLog, co.Devices, co.WebRTC, ice, caps, co.Alias)
+		if errors.Is(err, errPeerNoCamera) && co.Video.Fallback == FallbackAudio {
+			log.Debugf("the peer has no camera, placing an audio call")
+			if cs, err = dialAudio(ctx, options, dir, co.Audio, co.Degrade, co.Network, co.SignalLog, co.Devices, co.WebRTC, ice, caps); err == nil {
+				cs.notices = append(cs.notices, audioFallbackNotice)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown media kind %q", kind)
 	}
-	var answer webrtc.SessionDescription
-	if err = json.Unmarshal([]byte(ansMsg.Message), &answer); err != nil {
-		return fmt.Errorf("failed to unmarshal remote SDP: %v\nraw SDP: %s", err, ansMsg.Message)
+	if err != nil {
+		return nil, withPreflight(err, co.Preflight)
 	}
-	return pc.SetRemoteDescription(answer)
+	cs.startRecording(co.Summary, co.Captions)
+	cs.askToRecord(co.Record, co.Alias)
+	return cs, nil
 }
 
 // StartAudioCall establishes a robust, real-time audio streaming session using WebRTC and actual microphone capture.
-func StartAudioCall(options croc.Options) error {
-	// Create MediaEngine and register default codecs.
-	m := webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
+// With DirectionRecvOnly no microphone is needed. audio tunes the Opus
+// encoder for packet loss. The call is run from standard input. Calls on
+// a WebRTC stack of the caller's own are placed with Dial.
+func StartAudioCall(options croc.Options, dir Direction, audio AudioOptions) error {
+	cs, err := dialAudio(context.Background(), options, dir, audio, DegradeOptions{}, NetworkOptions{}, nil, Devices{}, WebRTCOptions{}, nil, newBitrateCaps(0, 0))
+	if err != nil {
 		return err
 	}
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&m))
+	cs.Interact(os.Stdin)
+	return nil
+}
+
+// StartVideoCall establishes a robust, real-time video streaming session using WebRTC and actual camera capture.
+// With DirectionRecvOnly no camera is needed. video turns on simulcast.
+// The call is run from standard input. Calls on a WebRTC stack of the
+// caller's own are placed with Dial.
+func StartVideoCall(options croc.Options, dir Direction, video VideoOptions) error {
+	cs, err := dialVideo(context.Background(), options, dir, video, DegradeOptions{}, NetworkOptions{}, nil, Devices{}, WebRTCOptions{}, nil, newBitrateCaps(0, 0), "")
+	if err != nil {
+		return err
+	}
+	cs.Interact(os.Stdin)
+	return nil
+}
+
+// waitConnected waits for connected to be closed, which the ICE state
+// handler does once the peer is reachable.
+func waitConnected(ctx context.Context, connected <-chan struct{}) error {
+	select {
+	case <-connected:
+		log.Debug("Peer connected!")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(30 * time.Second):
+		return errICETimeout
+	}
+}
+
+// endOnFailure hangs cs up once the connection to the peer fails.
+func endOnFailure(pc *webrtc.PeerConnection, cs *CallSession) {
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Debugf("ICE connection state: %s", state.String())
+		if state == webrtc.ICEConnectionStateFailed {
+			go cs.Hangup()
+		}
+	})
+}
+
+func dialAudio(ctx context.Context, options croc.Options, dir Direction, audio AudioOptions, degrade DegradeOptions, network NetworkOptions, slog *SignalLog, devices Devices, w WebRTCOptions, ice *iceServers, caps *bitrateCaps) (cs *CallSession, err error) {
+	if err = errors.Join(audio.Validate(), degrade.Validate(), network.Validate(), w.check(network, webrtc.RTPCodecTypeAudio)); err != nil {
+		return
+	}
+	api, codecs, estimators, err := newCallAPI(audio, caps, network, w)
+	if err != nil {
+		return
+	}
+	consumer := bandwidth.Default.Register("audio call", callWeight)
+	defer func() {
+		if err != nil {
+			consumer.Close()
+		}
+	}()
 	// Configure PeerConnection.
+	servers, _, errICE := ice.get(ctx)
 	config := webrtc.Configuration{
 		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		ICEServers:         servers,
 	}
 	pc, err := api.NewPeerConnection(config)
 	if err != nil {
-		return err
+		return
 	}
+	defer func() {
+		if err != nil {
+			pc.Close()
+		}
+	}()
 
-	// Before capturing, enumerate devices.
-	audioDevices := mediadevices.EnumerateDevices()
-	hasAudio := false
-	for _, d := range audioDevices {
-		if d.Kind == mediadevices.AudioInput {
-			hasAudio = true
-			break
+	media := devices.media()
+	hooks := newMediaHooks()
+	tracks, err := addMedia(pc, webrtc.RTPCodecTypeAudio, dir, codecs, devices)
+	if err != nil {
+		return
+	}
+	hooks.attach(tracks)
+	// the microphone is released if the call is declined or fails
+	defer func() {
+		if err != nil {
+			closeTracks(tracks)
 		}
+	}()
+	if audio.WarmUp {
+		defer warmUp(tracks).stop()
 	}
-	if !hasAudio {
-		return fmt.Errorf("no microphone detected on this machine")
+	path := watchPath(pc)
+	closeSpeaker := func() {}
+	if dir.Receives() {
+		devices, closeSpeaker = devices.withSpeaker()
 	}
-	// Capture real audio using mediadevices.
-	stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
-		Audio: func(c *mediadevices.MediaTrackConstraints) {
-			// Default constraints; you can refine and select device ID as needed.
-		},
-		Video: nil,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to capture audio: %v", err)
+	// the speaker rings back until the peer's audio takes it over
+	tones := newTonePlayer(devices.Speaker, audio)
+	if tones != nil {
+		devices.Speaker = tones
 	}
-	// Add all captured audio tracks to the PeerConnection.
-	for _, track := range stream.GetAudioTracks() {
-		if _, err = pc.AddTrack(track); err != nil {
-			return fmt.Errorf("failed to add audio track: %v", err)
+	defer func() {
+		if err != nil {
+			tones.end()
+			closeSpeaker()
 		}
-	}
+	}()
+	received := receiveMedia(pc, audio, hooks, devices)
 
 	// Wait for ICE connection.
 	connectedChan := make(chan struct{})
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		log.Debugf("ICE connection state: %s", state.String())
 		if state == webrtc.ICEConnectionStateConnected {
+			received.first.markConnected(time.Now())
 			close(connectedChan)
 		}
 	})
 	// Exchange SDP via relay.
-	if err = signalSDP(pc, options.RelayAddress, options.RelayPassword, options.RoomName); err != nil {
-		return err
+	sig, err := signalSDP(ctx, pc, options, inviteBody{Directions: Directions{Audio: dir}, Media: &media}, network, slog)
+	if err != nil {
+		return
 	}
 	log.Debug("SDP exchange complete, waiting for peer connection...")
-	select {
-	case <-connectedChan:
-		log.Debug("Peer connected!")
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("timed out waiting for ICE connection")
+	if err = waitConnected(ctx, connectedChan); err != nil {
+		sig.conn.Close()
+		return
 	}
 	log.Debug("Starting real-time audio streaming...")
+	tones.connected()
+	reportPath(pc, path)
+	// video added to the call is paused too when the network collapses
+	degradeCtx, stopDegrading := context.WithCancel(context.Background())
+	var stop func()
 
-	// Block until user ends the call.
-	fmt.Println("Audio call established. Press Enter to end call.")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
-	pc.Close()
-	fmt.Println("Audio call ended.")
-	return nil
+	cs = newCallSession(MediaAudio, consumer, caps, hooks, func() string {
+		stop()
+		stopDegrading()
+		pc.Close()
+		tones.end()
+		closeSpeaker()
+		closeTracks(tracks)
+		sig.conn.Close()
+		consumer.Close()
+		summary := path.summary()
+		for _, s := range []string{received.summary(), received.first.summary()} {
+			if s != "" {
+				summary += ", " + s
+			}
+		}
+		return summary
+	}, func() error { return addVideo(pc, hooks, devices) })
+	if errICE != nil {
+		cs.notices = append(cs.notices, turnNotice(errICE))
+	}
+	cs.askConsent = sig.askConsent
+	stop = sig.renegotiate(pc, ice, cs.video.add, caps.setPeer, cs.recordingAcked)
+	sig.degrade(degradeCtx, pc, cs, estimators, degrade, nil)
+	sig.capBitrate(degradeCtx, pc, caps)
+	endOnFailure(pc, cs)
+	return cs, nil
 }
 
-// StartVideoCall establishes a robust, real-time video streaming session using WebRTC and actual camera capture.
-func StartVideoCall(options croc.Options) error {
-	m := webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
-		return err
+func dialVideo(ctx context.Context, options croc.Options, dir Direction, video VideoOptions, degrade DegradeOptions, network NetworkOptions, slog *SignalLog, devices Devices, w WebRTCOptions, ice *iceServers, caps *bitrateCaps, alias string) (cs *CallSession, err error) {
+	if err = errors.Join(video.Validate(), degrade.Validate(), network.Validate(), w.check(network, webrtc.RTPCodecTypeVideo)); err != nil {
+		return
+	}
+	api, estimators, err := newAPI(&webrtc.MediaEngine{}, network, w)
+	if err != nil {
+		return
 	}
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&m))
+	consumer := bandwidth.Default.Register("video call", callWeight)
+	// the simulcast layers are encoded until the call ends
+	layersCtx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			cancel()
+			consumer.Close()
+		}
+	}()
+	servers, _, errICE := ice.get(ctx)
 	config := webrtc.Configuration{
 		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		ICEServers:         servers,
 	}
 	pc, err := api.NewPeerConnection(config)
 	if err != nil {
-		return err
+		return
 	}
-
-	// Before capturing video, enumerate devices.
-	videoDevices := mediadevices.EnumerateDevices()
-	hasVideo := false
-	for _, d := range videoDevices {
-		if d.Kind == mediadevices.VideoInput {
-			hasVideo = true
-			break
+	defer func() {
+		if err != nil {
+			pc.Close()
 		}
+	}()
+
+	// without a camera a two-way call only receives
+	media := devices.media()
+	var notices []string
+	if errICE != nil {
+		notices = append(notices, turnNotice(errICE))
 	}
-	if !hasVideo {
-		return fmt.Errorf("no webcam detected on this machine")
-	}
-	// Capture real video using mediadevices.
-	stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
-		Video: func(c *mediadevices.MediaTrackConstraints) {
-			// Default video constraints; customize camera resolution, etc., if needed.
-		},
-		Audio: nil,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to capture video: %v", err)
+	if dir == DirectionSendRecv && !media.Camera {
+		dir = DirectionRecvOnly
+		notices = append(notices, ownCameraNotice)
 	}
-	// Add all captured video tracks to the PeerConnection.
-	for _, track := range stream.GetVideoTracks() {
-		if _, err = pc.AddTrack(track); err != nil {
-			return fmt.Errorf("failed to add video track: %v", err)
+	hooks := newMediaHooks()
+	// the camera is watched for stalls; simulcast encodes it in layers of
+	// its own, which are not
+	var camera *cameraWatch
+	if layers := video.layers(); layers != nil && dir.Sends() {
+		if err = addSimulcast(layersCtx, pc, dir, layers, consumer, caps, hooks, devices); err != nil {
+			return
 		}
+	} else {
+		var tracks []mediadevices.Track
+		if tracks, err = addMedia(pc, webrtc.RTPCodecTypeVideo, dir, nil, devices); err != nil {
+			return
+		}
+		hooks.attach(tracks)
+		camera = newCameraWatch(pc, tracks, video.StallTimeout, hooks, devices)
 	}
+	path := watchPath(pc)
+	receiveMedia(pc, AudioOptions{}, hooks, devices)
 
 	connectedChan := make(chan struct{})
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
@@ -196,22 +567,37 @@ func StartVideoCall(options croc.Options) error {
 			close(connectedChan)
 		}
 	})
-	if err = signalSDP(pc, options.RelayAddress, options.RelayPassword, options.RoomName); err != nil {
-		return err
+	sig, err := signalSDP(ctx, pc, options, inviteBody{Directions: Directions{Video: dir}, Media: &media, Fallback: video.Fallback}, network, slog)
+	if err != nil {
+		return
+	}
+	if n := fallbackNotice(dir, sig.settled.Video); n != "" {
+		notices = append(notices, n)
 	}
 	log.Debug("SDP exchange complete, waiting for peer connection...")
-	select {
-	case <-connectedChan:
-		log.Debug("Peer connected!")
-	case <-time.After(30 * time.Second):
-		return fmt.Errorf("timed out waiting for ICE connection")
+	if err = waitConnected(ctx, connectedChan); err != nil {
+		sig.conn.Close()
+		return
 	}
 	log.Debug("Starting real-time video streaming...")
+	reportPath(pc, path)
+	var stop func()
 
-	// Block until user ends the call.
-	fmt.Println("Video call established. Press Enter to end call.")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
-	pc.Close()
-	fmt.Println("Video call ended.")
-	return nil
+	cs = newCallSession(MediaVideo, consumer, caps, hooks, func() string {
+		stop()
+		cancel()
+		pc.Close()
+		camera.close()
+		sig.conn.Close()
+		consumer.Close()
+		return path.summary()
+	}, nil)
+	cs.notices = notices
+	cs.askConsent = sig.askConsent
+	stop = sig.renegotiate(pc, ice, cs.video.add, caps.setPeer, cs.recordingAcked)
+	sig.degrade(layersCtx, pc, cs, estimators, degrade, camera)
+	sig.watchCamera(layersCtx, cs, camera, alias)
+	sig.capBitrate(layersCtx, pc, caps)
+	endOnFailure(pc, cs)
+	return cs, nil
 }
@@ -0,0 +1,35 @@
+//go:build nomedia
+
+package call
+
+import (
+	"context"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+)
+
+// Dial is unavailable in builds without media support.
+func Dial(ctx context.Context, options croc.Options, kind MediaKind, dir Direction, co CallOptions) (*CallSession, error) {
+	return nil, ErrNoMedia
+}
+
+// StartAudioCall is unavailable in builds without media support.
+func StartAudioCall(options croc.Options, dir Direction, audio AudioOptions) error {
+	return ErrNoMedia
+}
+
+// StartVideoCall is unavailable in builds without media support.
+func StartVideoCall(options croc.Options, dir Direction, video VideoOptions) error {
+	return ErrNoMedia
+}
+
+// StartEchoTest is unavailable in builds without media support.
+func StartEchoTest(duration time.Duration) error {
+	return ErrNoMedia
+}
+
+// Listen is unavailable in builds without media support.
+func Listen(ctx context.Context, options croc.Options, lo ListenOptions) error {
+	return ErrNoMedia
+}
@@ -0,0 +1,23 @@
+//go:build nomedia
+
+package call
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoMedia(t *testing.T) {
+	options := croc.Options{SharedSecret: "1234-no-media"}
+	assert.True(t, errors.Is(StartAudioCall(options, DirectionSendRecv, DefaultAudioOptions()), ErrNoMedia))
+	assert.True(t, errors.Is(StartVideoCall(options, DirectionRecvOnly, DefaultVideoOptions()), ErrNoMedia))
+	_, err := Dial(context.Background(), options, MediaAudio, DirectionSendRecv, DefaultCallOptions())
+	assert.True(t, errors.Is(err, ErrNoMedia))
+	assert.True(t, errors.Is(StartEchoTest(time.Second), ErrNoMedia))
+	assert.Contains(t, ErrNoMedia.Error(), "built without media support")
+}
@@ -0,0 +1,289 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/vnet"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// ticking paces a synthetic source like a device, until it is closed.
+type ticking struct {
+	ticker *time.Ticker
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTicking(period time.Duration) *ticking {
+	return &ticking{ticker: time.NewTicker(period), closed: make(chan struct{})}
+}
+
+func (t *ticking) wait() error {
+	select {
+	case <-t.ticker.C:
+		return nil
+	case <-t.closed:
+		return io.EOF
+	}
+}
+
+func (t *ticking) Close() error {
+	t.once.Do(func() {
+		t.ticker.Stop()
+		close(t.closed)
+	})
+	return nil
+}
+
+// toneSource is a 440 Hz tone in 20ms frames.
+type toneSource struct {
+	*ticking
+	n int
+}
+
+func (s *toneSource) ReadFrame() (Frame, error) {
+	if err := s.wait(); err != nil {
+		return Frame{}, err
+	}
+	f := Frame{Samples: make([]int16, 960), SampleRate: 48000, Captured: time.Now()}
+	for i := range f.Samples {
+		f.Samples[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(s.n)/48000))
+		s.n++
+	}
+	return f, nil
+}
+
+// colorSource is a solid color at 30 frames a second.
+type colorSource struct {
+	*ticking
+	frame *image.YCbCr
+}
+
+func newColorSource(c color.RGBA) *colorSource {
+	frame := image.NewYCbCr(image.Rect(0, 0, 160, 120), image.YCbCrSubsampleRatio420)
+	y, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	for i := range frame.Y {
+		frame.Y[i] = y
+	}
+	for i := range frame.Cb {
+		frame.Cb[i], frame.Cr[i] = cb, cr
+	}
+	return &colorSource{ticking: newTicking(time.Second / 30), frame: frame}
+}
+
+func (s *colorSource) ReadImage() (image.Image, error) {
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	return s.frame, nil
+}
+
+// recorder is the speaker and screen of a test peer.
+type recorder struct {
+	mu        sync.Mutex
+	frames    int
+	peak      int
+	keyFrames int
+}
+
+func (r *recorder) WriteFrame(f Frame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames++
+	for _, s := range f.Samples {
+		r.peak = max(r.peak, int(math.Abs(float64(s))))
+	}
+	return nil
+}
+
+func (r *recorder) WriteVideoFrame(f VideoFrame) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f.KeyFrame {
+		r.keyFrames++
+	}
+	return nil
+}
+
+// heard reports whether the tone came through, well above the noise of
+// the codec.
+func (r *recorder) heard() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frames > 10 && r.peak > 2000
+}
+
+func (r *recorder) saw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keyFrames > 0
+}
+
+// syntheticDevices are a tone and a solid color, recorded into rec.
+func syntheticDevices(c color.RGBA, rec *recorder) Devices {
+	return Devices{
+		Microphone: &toneSource{ticking: newTicking(20 * time.Millisecond)},
+		Camera:     newColorSource(c),
+		Speaker:    rec,
+		Screen:     rec,
+	}
+}
+
+// virtualLAN puts two hosts on a virtual network of their own, so calls
+// between them see the same interfaces whatever the machine has.
+func virtualLAN(t *testing.T) (a, b *vnet.Net) {
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	assert.Nil(t, err)
+	a, err = vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"10.0.0.1"}})
+	assert.Nil(t, err)
+	assert.Nil(t, router.AddNet(a))
+	b, err = vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"10.0.0.2"}})
+	assert.Nil(t, err)
+	assert.Nil(t, router.AddNet(b))
+	assert.Nil(t, router.Start())
+	t.Cleanup(func() { router.Stop() })
+	return
+}
+
+// onNet is a setting engine hook gathering candidates only on n.
+func onNet(n *vnet.Net) func(*webrtc.SettingEngine) {
+	return func(s *webrtc.SettingEngine) {
+		s.SetNet(n)
+		s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	}
+}
+
+// singlePortAPI is a WebRTC stack on n whose calls all share one UDP port.
+func singlePortAPI(t *testing.T, n *vnet.Net) *webrtc.API {
+	ips, err := n.Interfaces()
+	assert.Nil(t, err)
+	var ip net.IP
+	for _, i := range ips {
+		if addrs, _ := i.Addrs(); i.Name == "eth0" && len(addrs) > 0 {
+			ip = addrs[0].(*net.IPNet).IP
+		}
+	}
+	conn, err := n.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	assert.Nil(t, err)
+	mux := webrtc.NewICEUDPMux(nil, conn)
+	t.Cleanup(func() { mux.Close() })
+	var s webrtc.SettingEngine
+	s.SetNet(n)
+	s.SetICEUDPMux(mux)
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	m := &webrtc.MediaEngine{}
+	assert.Nil(t, m.RegisterDefaultCodecs())
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(s))
+}
+
+// TestCallEndToEnd places an audio and then a video call between two
+// peers in this process, signaling through a local relay, and checks that
+// the media of each side reaches the other. The peers connect over a
+// virtual network, and the last call is placed on a WebRTC stack of the
+// caller's own.
+func TestCallEndToEnd(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	relayDone := make(chan error, 1)
+	go func() {
+		relayDone <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithStrictRoomNames(false), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-relayDone
+	})
+	options := croc.Options{
+		RelayAddress:  l.Addr().String(),
+		RelayPassword: "pass123",
+		SharedSecret:  "1234-end-to-end",
+		RoomName:      "end-to-end-call",
+	}
+
+	for _, c := range []struct {
+		name string
+		kind MediaKind
+		// api is the caller's own WebRTC stack on a network, if any
+		api func(t *testing.T, n *vnet.Net) *webrtc.API
+	}{
+		{"audio", MediaAudio, nil},
+		{"video", MediaVideo, nil},
+		{"audio over one port", MediaAudio, singlePortAPI},
+	} {
+		kind := c.kind
+		t.Run(c.name, func(t *testing.T) {
+			callerNet, calleeNet := virtualLAN(t)
+			callee := &recorder{}
+			ctx, cancel := context.WithCancel(context.Background())
+			listening := make(chan error, 1)
+			go func() {
+				listening <- Listen(ctx, options, ListenOptions{
+					AutoAnswer: true,
+					Audio:      DefaultAudioOptions(),
+					Devices:    syntheticDevices(color.RGBA{R: 255, A: 255}, callee),
+					WebRTC:     WebRTCOptions{SettingEngine: onNet(calleeNet)},
+				})
+			}()
+			defer func() {
+				cancel()
+				assert.Nil(t, <-listening)
+			}()
+			// the invite is only seen by a listener already in the room
+			time.Sleep(200 * time.Millisecond)
+
+			caller := &recorder{}
+			co := CallOptions{Audio: DefaultAudioOptions(), Devices: syntheticDevices(color.RGBA{B: 255, A: 255}, caller)}
+			co.WebRTC.SettingEngine = onNet(callerNet)
+			if c.api != nil {
+				co.WebRTC = WebRTCOptions{API: c.api(t, callerNet)}
+			}
+			cs, err := Dial(ctx, options, kind, DirectionSendRecv, co)
+			if !assert.Nil(t, err) {
+				return
+			}
+			received := func() bool { return caller.heard() && callee.heard() }
+			if kind == MediaVideo {
+				// the callee's camera is red
+				decoded := make(chan image.Image, 1)
+				cs.OnIncomingVideo(func(frame image.Image) {
+					select {
+					case decoded <- frame:
+					default:
+					}
+				})
+				received = func() bool { return caller.saw() && callee.saw() }
+				select {
+				case frame := <-decoded:
+					r, g, b, _ := frame.At(frame.Bounds().Dx()/2, frame.Bounds().Dy()/2).RGBA()
+					assert.Greater(t, r, uint32(0xc000))
+					assert.Less(t, max(g, b), uint32(0x4000))
+				case <-time.After(10 * time.Second):
+					t.Error("no video was decoded")
+				}
+			}
+			assert.Eventually(t, received, 10*time.Second, 50*time.Millisecond)
+
+			cs.Hangup()
+			select {
+			case <-cs.Done():
+			case <-time.After(5 * time.Second):
+				t.Error("the call did not end")
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeBitrateCap asks the peer to keep what it sends under a bitrate. ID
+// is the call id and Num the cap in bits per second, zero lifting it.
+const typeBitrateCap = message.TypeWebRTCBitrateCap
+
+// minBitrateCap is the lowest cap a call takes, about what Opus needs for
+// intelligible speech.
+const minBitrateCap = 8_000
+
+// audioBitrate is what the Opus encoder of a call sends when no cap holds
+// it lower.
+const audioBitrate = 32_000
+
+// The peer is taken to ignore the receive cap once what comes in has
+// stayed more than capTolerance percent over it for capGrace. Packet
+// headers, RTCP and key frames put the measured rate somewhat above
+// what the peer's encoder aims for.
+const (
+	capTolerance = 25
+	capGrace     = 10 * time.Second
+)
+
+// checkBitrateCaps reports whether the send and receive caps, in bits per
+// second, are in range.
+func checkBitrateCaps(send, recv int64) error {
+	for _, c := range []struct {
+		name string
+		bps  int64
+	}{{"send", send}, {"receive", recv}} {
+		if c.bps != 0 && c.bps < minBitrateCap {
+			return fmt.Errorf("%s bitrate cap %d bit/s is below the %d bit/s a call needs", c.name, c.bps, minBitrateCap)
+		}
+	}
+	return nil
+}
+
+// lowerCap returns the lower of two caps, where zero stands for none.
+func lowerCap(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// bitrateEncoder is an encoder whose bitrate can change during a call.
+type bitrateEncoder interface {
+	SetBitRate(int) error
+}
+
+// bitrateCaps are the bitrate caps in force on a call. What this side
+// sends is held to the lower of its own send cap and the receive cap the
+// peer asked for; what it receives is held to its receive cap, if the
+// peer goes along.
+type bitrateCaps struct {
+	send, recv int64
+
+	mu   sync.Mutex
+	peer int64
+	// inbound is the rate media last came in at, in bits per second.
+	inbound  int64
+	encoders []bitrateEncoder
+	// warn is told when the peer keeps sending over the receive cap.
+	warn func(inbound, limit int64)
+}
+
+func newBitrateCaps(send, recv int64) *bitrateCaps {
+	return &bitrateCaps{send: send, recv: recv}
+}
+
+// sendCap returns the cap on what this side sends, zero for none.
+func (c *bitrateCaps) sendCap() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return lowerCap(c.send, c.peer)
+}
+
+// setPeer takes the receive cap the peer asked for, zero for none, and
+// holds the encoders to it.
+func (c *bitrateCaps) setPeer(bps int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peer = bps
+	c.applyLocked()
+}
+
+// addEncoder holds e to the send cap for as long as it runs.
+func (c *bitrateCaps) addEncoder(e bitrateEncoder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encoders = append(c.encoders, e)
+	c.applyLocked()
+}
+
+// applyLocked sets the encoders to the audio bitrate the send cap leaves,
+// forgetting those that have been closed.
+func (c *bitrateCaps) applyLocked() {
+	bitrate := lowerCap(audioBitrate, lowerCap(c.send, c.peer))
+	running := c.encoders[:0]
+	for _, e := range c.encoders {
+		if err := e.SetBitRate(int(bitrate)); err == nil {
+			running = append(running, e)
+		}
+	}
+	clear(c.encoders[len(running):])
+	c.encoders = running
+}
+
+// share caps share, the bytes per second the bandwidth budget grants the
+// call with zero for unlimited, to the send cap.
+func (c *bitrateCaps) share(share int64) int64 {
+	if limit := c.sendCap(); limit != 0 {
+		return lowerCap(share, limit/8)
+	}
+	return share
+}
+
+// estimate caps a bandwidth estimate, in bits per second, to the send cap.
+func (c *bitrateCaps) estimate(estimate int64) int64 {
+	if limit := c.sendCap(); limit != 0 && limit < estimate {
+		return limit
+	}
+	return estimate
+}
+
+func (c *bitrateCaps) setInbound(rate int64) {
+	c.mu.Lock()
+	c.inbound = rate
+	c.mu.Unlock()
+}
+
+func (c *bitrateCaps) setWarn(f func(inbound, limit int64)) {
+	c.mu.Lock()
+	c.warn = f
+	c.mu.Unlock()
+}
+
+// ignored tells the warn callback, if one is set, that the peer sends
+// inbound bits per second over the receive cap.
+func (c *bitrateCaps) ignored(inbound int64) {
+	c.mu.Lock()
+	f := c.warn
+	c.mu.Unlock()
+	if f != nil {
+		f(inbound, c.recv)
+	}
+}
+
+// String describes the caps in effect for the stats line, or is empty if
+// neither direction is capped.
+func (c *bitrateCaps) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	send := lowerCap(c.send, c.peer)
+	if send == 0 && c.recv == 0 {
+		return ""
+	}
+	describe := func(bps int64) string {
+		if bps == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("%d kbit/s", bps/1000)
+	}
+	s := fmt.Sprintf("send cap %s, receive cap %s", describe(send), describe(c.recv))
+	if c.recv != 0 {
+		s += fmt.Sprintf(" (receiving %d kbit/s)", c.inbound/1000)
+	}
+	return s
+}
+
+// capWarning is the warning for a peer sending inbound bits per second
+// over the receive cap.
+func capWarning(inbound, limit int64) string {
+	return fmt.Sprintf("The peer sends %d kbit/s, over the %d kbit/s receive cap; it may not support caps.", inbound/1000, limit/1000)
+}
+
+// statsLine describes the bandwidth of a call: the target bitrate share
+// bytes per second leave, zero for unlimited, and the caps in effect.
+func statsLine(share int64, caps *bitrateCaps) string {
+	parts := []string{"Bandwidth unlimited"}
+	if share > 0 {
+		parts[0] = fmt.Sprintf("Target bitrate %d kbit/s", share*8/1000)
+	}
+	if s := caps.String(); s != "" {
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// capWatch tells from the bytes of media received whether the peer keeps
+// to the receive cap asked of it.
+type capWatch struct {
+	limit int64
+	bytes uint64
+	at    time.Time
+	// since is when the rate went over the cap, zero while it is under.
+	since  time.Time
+	warned bool
+}
+
+// update takes the bytes received by now and returns the rate since the
+// last update, in bits per second, and whether the peer ignores the cap:
+// it has been over it, past capTolerance, for capGrace. Each stretch over
+// the cap is reported once.
+func (w *capWatch) update(bytes uint64, now time.Time) (rate int64, ignored bool) {
+	last, lastAt := w.bytes, w.at
+	w.bytes, w.at = bytes, now
+	if lastAt.IsZero() || bytes < last || !now.After(lastAt) {
+		return 0, false
+	}
+	rate = int64(float64(bytes-last) * 8 / now.Sub(lastAt).Seconds())
+	if w.limit == 0 || rate*100 <= w.limit*(100+capTolerance) {
+		w.since, w.warned = time.Time{}, false
+		return rate, false
+	}
+	if w.since.IsZero() {
+		w.since = lastAt
+	}
+	if w.warned || now.Sub(w.since) < capGrace {
+		return rate, false
+	}
+	w.warned = true
+	return rate, true
+}
+
+// bitrateCapSignal asks the peer of the call with callID to keep what it
+// sends under bps bits per second.
+func bitrateCapSignal(callID string, bps int64) message.Message {
+	return message.Message{Type: typeBitrateCap, ID: callID, Num: int(bps)}
+}
+
+// parseBitrateCap returns the receive cap a signal of the call with
+// callID asks for. A cap too low to carry a call is raised to the lowest
+// one that can.
+func parseBitrateCap(m message.Message, callID string) (int64, bool) {
+	if m.Type != typeBitrateCap || m.ID != callID || m.Num < 0 {
+		return 0, false
+	}
+	if m.Num == 0 {
+		return 0, true
+	}
+	return max(int64(m.Num), minBitrateCap), true
+}
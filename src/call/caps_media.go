@@ -0,0 +1,68 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// enforceCaps holds the peer of the call with callID on pc to the receive
+// cap of caps until ctx is done. It asks the peer with send, repeats the
+// ask every estimateInterval as REMB feedback, which stacks that miss the
+// signal go by, and measures what comes in, telling caps when the peer
+// keeps sending over the cap.
+func enforceCaps(ctx context.Context, pc *webrtc.PeerConnection, caps *bitrateCaps, callID string, send func(message.Message) error) {
+	if caps.recv == 0 {
+		return
+	}
+	if err := send(bitrateCapSignal(callID, caps.recv)); err != nil {
+		log.Debugf("could not ask the peer to cap its bitrate: %v", err)
+	}
+	w := capWatch{limit: caps.recv}
+	ticker := time.NewTicker(estimateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if ssrcs := remoteSSRCs(pc); len(ssrcs) > 0 {
+			remb := &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: float32(caps.recv), SSRCs: ssrcs}
+			if err := pc.WriteRTCP([]rtcp.Packet{remb}); err != nil {
+				log.Debugf("could not send REMB: %v", err)
+			}
+		}
+		rate, ignored := w.update(bytesReceived(pc), time.Now())
+		caps.setInbound(rate)
+		if ignored {
+			caps.ignored(rate)
+		}
+	}
+}
+
+// remoteSSRCs returns the SSRCs of the tracks pc receives.
+func remoteSSRCs(pc *webrtc.PeerConnection) []uint32 {
+	var ssrcs []uint32
+	for _, receiver := range pc.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			ssrcs = append(ssrcs, uint32(track.SSRC()))
+		}
+	}
+	return ssrcs
+}
+
+// bytesReceived returns how much pc has received over ICE so far, media
+// and RTCP alike.
+func bytesReceived(pc *webrtc.PeerConnection) uint64 {
+	if s, ok := pc.GetStats()["iceTransport"].(webrtc.TransportStats); ok {
+		return s.BytesReceived
+	}
+	return 0
+}
@@ -0,0 +1,134 @@
+package call
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEncoder records the bitrates it is set to until it is closed.
+type fakeEncoder struct {
+	bitrates []int
+	closed   bool
+}
+
+func (e *fakeEncoder) SetBitRate(bitrate int) error {
+	if e.closed {
+		return io.EOF
+	}
+	e.bitrates = append(e.bitrates, bitrate)
+	return nil
+}
+
+func TestBitrateCaps(t *testing.T) {
+	assert.Nil(t, checkBitrateCaps(0, 0))
+	assert.Nil(t, checkBitrateCaps(minBitrateCap, 500_000))
+	assert.NotNil(t, checkBitrateCaps(minBitrateCap-1, 0))
+	assert.NotNil(t, checkBitrateCaps(0, -1))
+	assert.NotNil(t, CallOptions{MaxRecvBitrate: 1000}.Validate())
+
+	caps := newBitrateCaps(300_000, 100_000)
+	e := &fakeEncoder{}
+	caps.addEncoder(e)
+	assert.Equal(t, int64(300_000), caps.sendCap())
+	assert.Equal(t, int64(300_000/8), caps.share(0))
+	assert.Equal(t, int64(10_000), caps.share(10_000))
+	assert.Equal(t, int64(300_000), caps.estimate(1_500_000))
+	assert.Equal(t, int64(90_000), caps.estimate(90_000))
+
+	// the peer asking for less lowers what is sent, audio included
+	caps.setPeer(24_000)
+	assert.Equal(t, int64(24_000), caps.sendCap())
+	assert.Equal(t, int64(3_000), caps.share(10_000))
+	caps.setPeer(0)
+	assert.Equal(t, int64(300_000), caps.sendCap())
+	assert.Equal(t, []int{audioBitrate, 24_000, audioBitrate}, e.bitrates)
+
+	// closed encoders are dropped
+	e.closed = true
+	other := &fakeEncoder{}
+	caps.addEncoder(other)
+	assert.Len(t, caps.encoders, 1)
+
+	caps.setInbound(95_000)
+	assert.Equal(t, "send cap 300 kbit/s, receive cap 100 kbit/s (receiving 95 kbit/s)", caps.String())
+	assert.Equal(t, "Target bitrate 300 kbit/s, send cap 300 kbit/s, receive cap 100 kbit/s (receiving 95 kbit/s)", statsLine(caps.share(0), caps))
+
+	uncapped := newBitrateCaps(0, 0)
+	assert.Equal(t, int64(0), uncapped.share(0))
+	assert.Equal(t, "Bandwidth unlimited", statsLine(0, uncapped))
+	uncapped.setPeer(64_000)
+	assert.Equal(t, "Target bitrate 64 kbit/s, send cap 64 kbit/s, receive cap none", statsLine(uncapped.share(0), uncapped))
+}
+
+func TestCapWatch(t *testing.T) {
+	w := capWatch{limit: 100_000}
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	var total uint64
+	// feed sends kbps kilobits in the second before s
+	feed := func(s int, kbps uint64) (int64, bool) {
+		total += kbps * 1000 / 8
+		return w.update(total, at(s))
+	}
+
+	rate, ignored := w.update(0, at(0))
+	assert.Equal(t, int64(0), rate)
+	assert.False(t, ignored)
+	// within the tolerance the peer keeps to the cap
+	for s := 1; s <= 20; s++ {
+		rate, ignored = feed(s, 120)
+		assert.Equal(t, int64(120_000), rate)
+		assert.False(t, ignored, s)
+	}
+	// over it for capGrace it does not, which is told once
+	for s := 21; s < 30; s++ {
+		_, ignored = feed(s, 400)
+		assert.False(t, ignored, s)
+	}
+	rate, ignored = feed(30, 400)
+	assert.Equal(t, int64(400_000), rate)
+	assert.True(t, ignored)
+	for s := 31; s < 50; s++ {
+		_, ignored = feed(s, 400)
+		assert.False(t, ignored, s)
+	}
+	// dropping under the cap starts over
+	_, ignored = feed(50, 50)
+	assert.False(t, ignored)
+	for s := 51; s < 60; s++ {
+		_, ignored = feed(s, 400)
+		assert.False(t, ignored, s)
+	}
+	_, ignored = feed(60, 400)
+	assert.True(t, ignored)
+
+	// a counter going back, as when the transport restarts, is no rate
+	rate, ignored = w.update(10, at(61))
+	assert.Equal(t, int64(0), rate)
+	assert.False(t, ignored)
+}
+
+func TestBitrateCapSignal(t *testing.T) {
+	bps, ok := parseBitrateCap(bitrateCapSignal("call-1", 64_000), "call-1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(64_000), bps)
+	bps, ok = parseBitrateCap(bitrateCapSignal("call-1", 0), "call-1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), bps)
+	// too low to carry the call
+	bps, ok = parseBitrateCap(bitrateCapSignal("call-1", 10), "call-1")
+	assert.True(t, ok)
+	assert.Equal(t, int64(minBitrateCap), bps)
+
+	_, ok = parseBitrateCap(bitrateCapSignal("call-2", 64_000), "call-1")
+	assert.False(t, ok)
+	_, ok = parseBitrateCap(message.Message{Type: typeBitrateCap, ID: "call-1", Num: -5}, "call-1")
+	assert.False(t, ok)
+	_, ok = parseBitrateCap(message.Message{Type: typeVideoState, ID: "call-1", Num: 64_000}, "call-1")
+	assert.False(t, ok)
+	assert.True(t, protectedSignals[typeBitrateCap])
+}
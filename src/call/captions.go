@@ -0,0 +1,299 @@
+package call
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// CaptionOptions caption what the peer says with an external program.
+type CaptionOptions struct {
+	// Command is the program to run, followed by its arguments. It reads
+	// the audio received from the peer on standard input, as signed 16
+	// bit little endian mono samples at 48 kHz, and writes a caption per
+	// line of standard output. Empty turns captions off.
+	Command []string
+}
+
+// Validate reports whether the captions command can be found.
+func (o CaptionOptions) Validate() error {
+	if len(o.Command) == 0 {
+		return nil
+	}
+	if _, err := exec.LookPath(o.Command[0]); err != nil {
+		return fmt.Errorf("captions command: %w", err)
+	}
+	return nil
+}
+
+// Caption is a line the captions command wrote.
+type Caption struct {
+	Time time.Time
+	Text string
+}
+
+// captionBuffer is how many frames of audio wait for a captions command
+// that does not keep up, a second of 20ms frames; newer frames are
+// dropped until it catches up, so the call never waits for it.
+const captionBuffer = 50
+
+// A captions command that crashes is restarted after captionRestartDelay,
+// doubling up to captionMaxRestartDelay while it keeps crashing. One that
+// ran for longer than that is restarted after captionRestartDelay again.
+const (
+	captionRestartDelay    = time.Second
+	captionMaxRestartDelay = 30 * time.Second
+)
+
+// captionStopGrace is how long a captions command has to caption the
+// audio it was given once its input is closed, before it is killed.
+const captionStopGrace = 2 * time.Second
+
+// captioner feeds received audio to a captions command and hands each
+// line it writes to onLine, restarting the command when it exits.
+type captioner struct {
+	command []string
+	onLine  func(string)
+	frames  chan []byte
+	dropped atomic.Int64
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// startCaptioner runs command until stop is called, restarting it after
+// restartDelay at first.
+func startCaptioner(command []string, restartDelay time.Duration, onLine func(string)) *captioner {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &captioner{command: command, onLine: onLine, frames: make(chan []byte, captionBuffer), cancel: cancel, done: make(chan struct{})}
+	go c.run(ctx, restartDelay)
+	return c
+}
+
+// tap queues a frame of received audio for the command, mixed down to
+// mono, dropping it if the command is behind.
+func (c *captioner) tap(pcm []int16, sampleRate, channels int) {
+	select {
+	case c.frames <- monoLE(pcm, channels):
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// monoLE mixes interleaved samples of channels channels down to mono, as
+// 16 bit little endian samples.
+func monoLE(pcm []int16, channels int) []byte {
+	channels = max(channels, 1)
+	b := make([]byte, 0, 2*len(pcm)/channels)
+	for i := 0; i+channels <= len(pcm); i += channels {
+		sum := 0
+		for _, v := range pcm[i : i+channels] {
+			sum += int(v)
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(int16(sum/channels)))
+	}
+	return b
+}
+
+// stop closes the input of the command, waits for the captions it still
+// writes and ends it.
+func (c *captioner) stop() {
+	c.cancel()
+	<-c.done
+	if n := c.dropped.Load(); n > 0 {
+		log.Debugf("captions command fell behind, %d frames were not captioned", n)
+	}
+}
+
+func (c *captioner) run(ctx context.Context, restartDelay time.Duration) {
+	defer close(c.done)
+	delay := restartDelay
+	for {
+		started := time.Now()
+		err := c.runCommand(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > captionMaxRestartDelay {
+			delay = restartDelay
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		log.Warnf("captions command %s: %v, restarting it in %s", c.command[0], err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, captionMaxRestartDelay)
+	}
+}
+
+// runCommand runs the command once, until it exits or ctx is done. Once
+// ctx is done the command is given the frames still queued and its input
+// is closed, which lets it caption the end of the call; it is killed if
+// it has not exited captionStopGrace later.
+func (c *captioner) runCommand(ctx context.Context) error {
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for {
+			select {
+			case b := <-c.frames:
+				if _, err := stdin.Write(b); err != nil {
+					return
+				}
+			case <-exited:
+				return
+			case <-ctx.Done():
+				c.flush(stdin)
+				stdin.Close()
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+		select {
+		case <-time.After(captionStopGrace):
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			c.onLine(line)
+		}
+	}
+	if scanner.Err() != nil {
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	close(exited)
+	<-written
+	return err
+}
+
+// flush writes the frames queued for the command to w.
+func (c *captioner) flush(w io.Writer) {
+	for {
+		select {
+		case b := <-c.frames:
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// startRecording records the call to summary and captions it with
+// captions, unless it has ended already.
+func (cs *CallSession) startRecording(summary *CallSummary, captions CaptionOptions) {
+	cs.mu.Lock()
+	if cs.ended {
+		cs.mu.Unlock()
+		return
+	}
+	cs.record, cs.captionOptions = summary, captions
+	cs.mu.Unlock()
+	summary.record(time.Now(), "%s call started", cs.kind)
+	for _, n := range cs.notices {
+		summary.record(time.Now(), "%s", n)
+	}
+	cs.SetCaptions(true)
+}
+
+// stopCaptions stops the captions for good as the call ends.
+func (cs *CallSession) stopCaptions() {
+	cs.SetCaptions(false)
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.ended = true
+	cs.captionOptions = CaptionOptions{}
+}
+
+// SetCaptions turns the captions of the call on or off. Calls placed
+// without a captions command have none to turn on. Turning them off
+// waits for the command to caption the audio it was given.
+func (cs *CallSession) SetCaptions(on bool) {
+	cs.mu.Lock()
+	if on == (cs.captioner != nil) || len(cs.captionOptions.Command) == 0 {
+		cs.mu.Unlock()
+		return
+	}
+	if on {
+		cs.captioner = startCaptioner(cs.captionOptions.Command, captionRestartDelay, cs.caption)
+		tap := AudioTap(cs.captioner.tap)
+		cs.hooks.captions.set(&tap)
+		cs.mu.Unlock()
+		return
+	}
+	c := cs.captioner
+	cs.captioner = nil
+	cs.hooks.captions.set(nil)
+	cs.mu.Unlock()
+	c.stop()
+}
+
+// Captioning reports whether the call is being captioned.
+func (cs *CallSession) Captioning() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.captioner != nil
+}
+
+// CanCaption reports whether the call was placed with a captions command.
+func (cs *CallSession) CanCaption() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.captionOptions.Command) > 0
+}
+
+// OnCaption calls f with every caption of the call, replacing any f set
+// before. f is called from the goroutine reading the captions command.
+func (cs *CallSession) OnCaption(f func(Caption)) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.onCaption = f
+}
+
+// caption records a line of the captions command and hands it on.
+func (cs *CallSession) caption(text string) {
+	c := Caption{Time: time.Now(), Text: text}
+	cs.mu.Lock()
+	record, f := cs.record, cs.onCaption
+	cs.mu.Unlock()
+	record.record(c.Time, "caption: %s", c.Text)
+	if f != nil {
+		f(c)
+	}
+}
@@ -0,0 +1,124 @@
+package call
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captionLines collects the lines of a captioner.
+func captionLines() (chan string, func(string)) {
+	lines := make(chan string, 100)
+	return lines, func(line string) { lines <- line }
+}
+
+func nextCaption(t *testing.T, lines chan string) string {
+	t.Helper()
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("no caption")
+	}
+	return ""
+}
+
+func TestCaptioner(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	lines, onLine := captionLines()
+	c := startCaptioner([]string{"/bin/sh", "-c", "echo ready; wc -c"}, captionRestartDelay, onLine)
+	assert.Equal(t, "ready", nextCaption(t, lines))
+	c.tap([]int16{1, 2, 3}, 48000, 1)
+	c.tap([]int16{2, 4, 6, 8}, 48000, 2)
+	// stopping lets the command caption all it was given
+	c.stop()
+	assert.Equal(t, "10", nextCaption(t, lines))
+	assert.Zero(t, c.dropped.Load())
+}
+
+func TestCaptionerRestart(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	lines, onLine := captionLines()
+	c := startCaptioner([]string{"/bin/sh", "-c", "echo up; exit 1"}, 10*time.Millisecond, onLine)
+	for range 3 {
+		assert.Equal(t, "up", nextCaption(t, lines))
+	}
+	c.stop()
+}
+
+func TestCaptionerBackpressure(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	_, onLine := captionLines()
+	// the command reads nothing, and ignores its input closing
+	c := startCaptioner([]string{"/bin/sh", "-c", "exec sleep 30"}, captionRestartDelay, onLine)
+	frame := make([]int16, 960)
+	start := time.Now()
+	for range 500 {
+		c.tap(frame, 48000, 1)
+	}
+	assert.Less(t, time.Since(start), time.Second, "the tap waited for the command")
+	assert.Positive(t, c.dropped.Load())
+	start = time.Now()
+	c.stop()
+	assert.Less(t, time.Since(start), captionStopGrace+time.Second, "the command was not killed")
+}
+
+func TestCallSessionCaptions(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	assert.Error(t, CaptionOptions{Command: []string{"croc-no-such-captioner"}}.Validate())
+	assert.Nil(t, CaptionOptions{}.Validate())
+
+	var summary bytes.Buffer
+	cs := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "direct" }, nil)
+	captions := make(chan Caption, 10)
+	cs.OnCaption(func(c Caption) { captions <- c })
+	cs.startRecording(NewCallSummary(&summary), CaptionOptions{Command: []string{"/bin/sh", "-c", `[ "$(head -c 2)" = AA ] && echo hello there; cat >/dev/null`}})
+	assert.True(t, cs.CanCaption())
+	assert.True(t, cs.Captioning())
+	cs.hooks.tapAudio([]int16{0x4141}, 48000, 1)
+	select {
+	case c := <-captions:
+		assert.Equal(t, "hello there", c.Text)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no caption")
+	}
+
+	cs.SetCaptions(false)
+	assert.False(t, cs.Captioning())
+	assert.Nil(t, cs.hooks.captions.get())
+	cs.SetCaptions(true)
+	assert.True(t, cs.Captioning())
+
+	assert.Equal(t, "direct", cs.Hangup())
+	assert.False(t, cs.Captioning())
+	cs.SetCaptions(true)
+	assert.False(t, cs.Captioning(), "captions do not outlive the call")
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.True(t, strings.HasSuffix(lines[0], " audio call started"), lines[0])
+		assert.True(t, strings.HasSuffix(lines[1], " caption: hello there"), lines[1])
+		assert.True(t, strings.HasSuffix(lines[2], " audio call ended, direct"), lines[2])
+		_, err := time.Parse(time.RFC3339, strings.Fields(lines[1])[0])
+		assert.Nil(t, err)
+	}
+
+	// calls without a captions command have nothing to turn on
+	plain := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "" }, nil)
+	plain.startRecording(nil, CaptionOptions{})
+	plain.SetCaptions(true)
+	assert.False(t, plain.CanCaption())
+	assert.False(t, plain.Captioning())
+	plain.Hangup()
+}
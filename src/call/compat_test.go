@@ -0,0 +1,156 @@
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// signalVectors are the signals every signaling version has sent, by
+// version, as kept in the message package.
+func signalVectors(t *testing.T) map[int]map[string]message.Message {
+	files, err := filepath.Glob(filepath.Join("..", "message", "testdata", "signaling", "v*", "*.json"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	vectors := make(map[int]map[string]message.Message)
+	for _, file := range files {
+		version, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(file)), "v"))
+		assert.Nil(t, err, file)
+		b, err := os.ReadFile(file)
+		assert.Nil(t, err, file)
+		var m message.Message
+		assert.Nil(t, json.Unmarshal(b, &m), file)
+		if vectors[version] == nil {
+			vectors[version] = make(map[string]message.Message)
+		}
+		vectors[version][strings.TrimSuffix(filepath.Base(file), ".json")] = m
+	}
+	return vectors
+}
+
+// TestSignalVectorsCompatible runs the signals of every version through
+// the code that reads them on the other side of a call.
+func TestSignalVectorsCompatible(t *testing.T) {
+	sc, err := newSignalCipher("1234-compatibility")
+	assert.Nil(t, err)
+	for version, vectors := range signalVectors(t) {
+		for name, m := range vectors {
+			name = fmt.Sprintf("v%d/%s", version, name)
+			// every signal survives sealing, unknown fields aside
+			sealed, err := sc.seal(m)
+			assert.Nil(t, err, name)
+			opened, err := sc.open(sealed)
+			assert.Nil(t, err, name)
+			assert.Equal(t, m, opened, name)
+
+			switch m.Type {
+			case message.TypeWebRTCOffer:
+				_, err := parseInvite(m)
+				assert.Nil(t, err, name)
+				v, err := negotiateVersion(m.SignalingVersion)
+				assert.Nil(t, err, name)
+				assert.LessOrEqual(t, v, message.CurrentSignalingVersion, name)
+			case message.TypeWebRTCAnswer:
+				answer, err := checkReply(m, "2c26b46b68ffc68f")
+				if m.ID != "" && m.ID != "2c26b46b68ffc68f" {
+					answer, err = checkReply(m, m.ID)
+				}
+				assert.Nil(t, err, name)
+				assert.NotNil(t, answer, name)
+			case typeCallDeclined:
+				_, err := checkReply(m, m.ID)
+				assert.ErrorIs(t, err, ErrDeclined, name)
+			case typeRenegotiateOffer, typeRenegotiateAnswer:
+				assert.True(t, isRenegotiation(m.Type), name)
+				assert.Positive(t, m.Num, name)
+			case message.TypeWebRTCCandidate, message.TypeWebRTCHangup:
+				assert.True(t, protectedSignals[m.Type], name)
+			default:
+				t.Errorf("%s: unexpected signal type %s", name, m.Type)
+			}
+		}
+	}
+}
+
+// TestSignalGolden checks that the signals this version sends have the
+// fields of the vectors for the current signaling version, so a renamed
+// or dropped field shows up here rather than as a broken call between
+// versions.
+func TestSignalGolden(t *testing.T) {
+	golden := signalVectors(t)[message.CurrentSignalingVersion]
+	sent := map[string]message.Message{}
+
+	secret := "1234-compatibility"
+	sc, err := newSignalCipher(secret)
+	assert.Nil(t, err)
+	invite, sealed := sealedInvite(t, secret, Directions{Audio: DirectionSendRecv})
+	sent["webrtc_offer"] = invite
+	sent["webrtc_answer"], err = withAnswerBody(newAnswer([]byte(`{"type":"answer","sdp":"v=0"}`), invite.ID, invite.SignalingVersion),
+		Directions{Audio: DirectionSendRecv}, Media{Microphone: true})
+	assert.Nil(t, err)
+
+	a := &answerer{sc: sc, policy: AnswerPolicy{SendOnlyVideo: true}}
+	_, _, _, reply, err := a.handle(sealed)
+	assert.Nil(t, err)
+	if assert.NotNil(t, reply) {
+		declined, err := sc.open(*reply)
+		assert.Nil(t, err)
+		sent["webrtc_declined"] = declined
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan message.Message, 10)
+	peer := &fakePeer{}
+	r := newRenegotiator(ctx, peer, invite.ID, true, func(m message.Message) error {
+		out <- m
+		return nil
+	})
+	peer.onNeeded = r.negotiationNeeded
+	r.deliver(message.Message{Type: typeRenegotiateOffer, ID: invite.ID, Num: 1, Message: string(peer.describe("offer", []string{"video"}))})
+	peer.setTracks("audio")
+	for len(sent) < 5 {
+		select {
+		case m := <-out:
+			sent[string(m.Type)] = m
+		case <-time.After(2 * time.Second):
+			t.Fatal("no renegotiation signals")
+		}
+	}
+
+	for name, m := range sent {
+		want, ok := golden[name]
+		if !assert.True(t, ok, "no vector for %s", name) {
+			continue
+		}
+		assert.Equal(t, message.SignalFields(want), message.SignalFields(m), name)
+		assert.Nil(t, message.CheckSignal(m, message.CurrentSignalingVersion), name)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	v, err := negotiateVersion(message.CurrentSignalingVersion + 3)
+	assert.Nil(t, err)
+	assert.Equal(t, message.CurrentSignalingVersion, v)
+	v, err = negotiateVersion(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, v)
+	_, err = negotiateVersion(message.MinSignalingVersion - 1)
+	assert.ErrorIs(t, err, ErrSignalingVersion)
+
+	// a callee answering with a version this side does not know is refused
+	answer := newAnswer([]byte("sdp"), "abc", message.CurrentSignalingVersion)
+	answer.SignalingVersion++
+	_, err = checkReply(answer, "abc")
+	assert.True(t, errors.Is(err, ErrSignalingVersion))
+}
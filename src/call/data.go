@@ -0,0 +1,288 @@
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// Signals that set up a DataLink. Message is the session description,
+// with all candidates.
+const (
+	typeDataOffer  = message.TypeWebRTCDataOffer
+	typeDataAnswer = message.TypeWebRTCDataAnswer
+)
+
+// dataChunk is the most a single data channel message carries. Longer
+// messages are split, as some WebRTC stacks refuse messages over 64KiB.
+const dataChunk = 16 << 10
+
+// Headers of a chunk: whether more of the message follows.
+const (
+	chunkMore byte = iota
+	chunkLast
+)
+
+// ErrDataClosed is returned by DataLink.Send when the channel is not open,
+// yet or any more.
+var ErrDataClosed = errors.New("the data channel is not open")
+
+// IsDataSignal reports whether messages of type t set up a DataLink, and
+// go to its Signal.
+func IsDataSignal(t message.Type) bool {
+	return t == typeDataOffer || t == typeDataAnswer
+}
+
+// DataOptions set up a DataLink.
+type DataOptions struct {
+	// Secret seals the signals, as the shared secret seals those of a
+	// call, so whoever carries them cannot read or swap the ICE
+	// credentials and DTLS fingerprints.
+	Secret string
+	ICE    ICEOptions
+	// Offer makes this side offer the channel. One side of a link offers
+	// and the other answers.
+	Offer bool
+	// MaxMessage caps the messages put back together from the peer's
+	// chunks; a link that gets a longer one closes. Zero is no cap.
+	MaxMessage int
+	// API, if set, makes the peer connection instead of a default API.
+	API *webrtc.API
+}
+
+// DataLink is an ordered and reliable WebRTC data channel to a single
+// peer, set up with signals the caller carries to the peer, such as the
+// frames of a chat room. Messages of any length are split into chunks on
+// the way and put back together.
+type DataLink struct {
+	o         DataOptions
+	sc        *signalCipher
+	send      func(message.Message) error
+	onMessage func([]byte)
+	pc        *webrtc.PeerConnection
+
+	mu sync.Mutex
+	dc *webrtc.DataChannel
+	// partial is the message the chunks received so far add up to; only
+	// the channel's read loop touches it.
+	partial []byte
+
+	open, closed        chan struct{}
+	openOnce, closeOnce sync.Once
+	answered            sync.Once
+}
+
+// NewDataLink starts setting up a link. send carries its signals to the
+// peer, whose signals are passed to Signal, and onMessage is called with
+// each message from the peer, one at a time. With o.Offer the offer is
+// sent right away.
+func NewDataLink(o DataOptions, send func(message.Message) error, onMessage func([]byte)) (l *DataLink, err error) {
+	sc, err := newSignalCipher(o.Secret)
+	if err != nil {
+		return
+	}
+	servers, _, errICE := newICEServers(o.ICE).get(context.Background())
+	if errICE != nil {
+		log.Debugf("%s", turnNotice(errICE))
+	}
+	api := o.API
+	if api == nil {
+		api = webrtc.NewAPI()
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	if err != nil {
+		return
+	}
+	l = &DataLink{
+		o:         o,
+		sc:        sc,
+		send:      send,
+		onMessage: onMessage,
+		pc:        pc,
+		open:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			go l.Close()
+		}
+	})
+	if !o.Offer {
+		pc.OnDataChannel(l.attach)
+		return
+	}
+	dc, err := pc.CreateDataChannel("croc", nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	l.attach(dc)
+	go l.offer()
+	return
+}
+
+// attach makes dc the channel of the link.
+func (l *DataLink) attach(dc *webrtc.DataChannel) {
+	l.mu.Lock()
+	if l.dc != nil {
+		l.mu.Unlock()
+		log.Debugf("ignoring data channel %s, the link has one", dc.Label())
+		return
+	}
+	l.dc = dc
+	l.mu.Unlock()
+	dc.OnOpen(func() {
+		l.openOnce.Do(func() { close(l.open) })
+	})
+	dc.OnClose(func() {
+		go l.Close()
+	})
+	dc.OnMessage(l.receive)
+}
+
+// offer sends the offer, once all candidates are gathered as signaling is
+// a single round trip.
+func (l *DataLink) offer() {
+	offer, err := l.pc.CreateOffer(nil)
+	if err == nil {
+		gathered := webrtc.GatheringCompletePromise(l.pc)
+		if err = l.pc.SetLocalDescription(offer); err == nil {
+			<-gathered
+			err = l.signal(typeDataOffer, l.pc.LocalDescription())
+		}
+	}
+	if err != nil {
+		log.Debugf("could not offer data channel: %v", err)
+		l.Close()
+	}
+}
+
+// answer answers offer, an offer from the peer.
+func (l *DataLink) answer(offer webrtc.SessionDescription) {
+	err := l.pc.SetRemoteDescription(offer)
+	if err == nil {
+		var answer webrtc.SessionDescription
+		if answer, err = l.pc.CreateAnswer(nil); err == nil {
+			gathered := webrtc.GatheringCompletePromise(l.pc)
+			if err = l.pc.SetLocalDescription(answer); err == nil {
+				<-gathered
+				err = l.signal(typeDataAnswer, l.pc.LocalDescription())
+			}
+		}
+	}
+	if err != nil {
+		log.Debugf("could not answer data channel: %v", err)
+		l.Close()
+	}
+}
+
+// signal seals desc as a signal of type t and sends it.
+func (l *DataLink) signal(t message.Type, desc *webrtc.SessionDescription) error {
+	data, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	sealed, err := l.sc.seal(message.Message{Type: t, Message: string(data)})
+	if err != nil {
+		return err
+	}
+	return l.send(sealed)
+}
+
+// Signal takes a signal from the peer, one that IsDataSignal. An offer is
+// answered in the background, and only the first.
+func (l *DataLink) Signal(m message.Message) error {
+	opened, err := l.sc.open(m)
+	if err != nil {
+		return err
+	}
+	var desc webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(opened.Message), &desc); err != nil {
+		return fmt.Errorf("failed to unmarshal remote SDP: %w", err)
+	}
+	switch {
+	case opened.Type == typeDataOffer && !l.o.Offer:
+		l.answered.Do(func() { go l.answer(desc) })
+		return nil
+	case opened.Type == typeDataAnswer && l.o.Offer:
+		return l.pc.SetRemoteDescription(desc)
+	}
+	return fmt.Errorf("unexpected %s signal", opened.Type)
+}
+
+// receive puts the chunks from the peer back together.
+func (l *DataLink) receive(msg webrtc.DataChannelMessage) {
+	if len(msg.Data) == 0 {
+		return
+	}
+	l.partial = append(l.partial, msg.Data[1:]...)
+	if l.o.MaxMessage > 0 && len(l.partial) > l.o.MaxMessage {
+		log.Debugf("closing data channel: the peer sent a message over %d bytes", l.o.MaxMessage)
+		l.partial = nil
+		go l.Close()
+		return
+	}
+	if msg.Data[0] == chunkLast {
+		b := l.partial
+		l.partial = nil
+		l.onMessage(b)
+	}
+}
+
+// Send sends b to the peer, or returns ErrDataClosed when the channel is
+// not open.
+func (l *DataLink) Send(b []byte) error {
+	select {
+	case <-l.open:
+	default:
+		return ErrDataClosed
+	}
+	select {
+	case <-l.closed:
+		return ErrDataClosed
+	default:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		n := min(len(b), dataChunk)
+		chunk := make([]byte, 1+n)
+		chunk[0] = chunkMore
+		if n == len(b) {
+			chunk[0] = chunkLast
+		}
+		copy(chunk[1:], b[:n])
+		if err := l.dc.Send(chunk); err != nil {
+			return fmt.Errorf("%w: %v", ErrDataClosed, err)
+		}
+		if b = b[n:]; len(b) == 0 {
+			return nil
+		}
+	}
+}
+
+// Open is closed once the channel is open.
+func (l *DataLink) Open() <-chan struct{} {
+	return l.open
+}
+
+// Closed is closed once the link is, by Close or because the channel or
+// the connection to the peer closed or failed.
+func (l *DataLink) Closed() <-chan struct{} {
+	return l.closed
+}
+
+// Close closes the channel and the connection to the peer.
+func (l *DataLink) Close() (err error) {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.pc.Close()
+	})
+	return
+}
@@ -0,0 +1,111 @@
+package call
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// loopbackAPI is a WebRTC stack that finds peers in this process.
+func loopbackAPI() *webrtc.API {
+	var s webrtc.SettingEngine
+	s.SetIncludeLoopbackCandidate(true)
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return webrtc.NewAPI(webrtc.WithSettingEngine(s))
+}
+
+// linkPair sets up two links whose signals are passed straight to each
+// other, with every signal also sent to signals.
+func linkPair(t *testing.T, a, b DataOptions, signals chan<- message.Message) (offerer, answerer *DataLink, got [2]chan []byte) {
+	got = [2]chan []byte{make(chan []byte, 10), make(chan []byte, 10)}
+	peers := make(chan *DataLink, 1)
+	var err error
+	answerer, err = NewDataLink(b, func(m message.Message) error {
+		signals <- m
+		go (<-peers).Signal(m)
+		return nil
+	}, func(m []byte) { got[1] <- m })
+	assert.Nil(t, err)
+	offerer, err = NewDataLink(a, func(m message.Message) error {
+		signals <- m
+		go func() {
+			if err := answerer.Signal(m); err != nil {
+				t.Errorf("answerer refused the offer: %v", err)
+			}
+		}()
+		return nil
+	}, func(m []byte) { got[0] <- m })
+	assert.Nil(t, err)
+	peers <- offerer
+	t.Cleanup(func() {
+		offerer.Close()
+		answerer.Close()
+	})
+	return
+}
+
+func TestDataLink(t *testing.T) {
+	signals := make(chan message.Message, 10)
+	o := DataOptions{Secret: "1234-data", API: loopbackAPI(), MaxMessage: 1 << 20}
+	a := o
+	a.Offer = true
+	offerer, answerer, got := linkPair(t, a, o, signals)
+	assert.ErrorIs(t, offerer.Send([]byte("early")), ErrDataClosed)
+	for _, l := range []*DataLink{offerer, answerer} {
+		select {
+		case <-l.Open():
+		case <-time.After(10 * time.Second):
+			t.Fatal("the data channel did not open")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		m := <-signals
+		assert.True(t, IsDataSignal(m.Type))
+		assert.Empty(t, m.Message, "the description is sealed")
+		assert.NotEmpty(t, m.Bytes)
+	}
+
+	// long messages arrive whole, and in order
+	long := bytes.Repeat([]byte("0123456789"), 5*dataChunk/10+3)
+	assert.Nil(t, offerer.Send([]byte("hello")))
+	assert.Nil(t, offerer.Send(long))
+	assert.Nil(t, answerer.Send([]byte("hi")))
+	assert.Equal(t, []byte("hello"), <-got[1])
+	assert.Equal(t, long, <-got[1])
+	assert.Equal(t, []byte("hi"), <-got[0])
+
+	// closing one side closes the other
+	assert.Nil(t, answerer.Close())
+	select {
+	case <-offerer.Closed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the peer's link did not close")
+	}
+	assert.ErrorIs(t, offerer.Send([]byte("gone")), ErrDataClosed)
+	assert.Nil(t, offerer.Close())
+}
+
+func TestDataLinkSignals(t *testing.T) {
+	l, err := NewDataLink(DataOptions{Secret: "1234-data"}, func(message.Message) error { return nil }, func([]byte) {})
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.False(t, IsDataSignal(message.TypeWebRTCOffer))
+	assert.NotNil(t, l.Signal(message.Message{Type: typeDataOffer, Message: "{}"}), "unsealed")
+
+	other, err := newSignalCipher("1234-other")
+	assert.Nil(t, err)
+	forged, err := other.seal(message.Message{Type: typeDataOffer, Message: "{}"})
+	assert.Nil(t, err)
+	assert.NotNil(t, l.Signal(forged), "sealed with another secret")
+
+	mine, err := newSignalCipher("1234-data")
+	assert.Nil(t, err)
+	answer, err := mine.seal(message.Message{Type: typeDataAnswer, Message: "{}"})
+	assert.Nil(t, err)
+	assert.NotNil(t, l.Signal(answer), "an answer to an offer it did not make")
+}
@@ -0,0 +1,206 @@
+package call
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeVideoState tells the peer that this side paused or resumed the video
+// it sends. ID is the call id, Message videoPaused or videoResumed and Num
+// the bandwidth estimate, in bits per second, that made it so.
+const typeVideoState = message.TypeWebRTCVideoState
+
+const (
+	videoPaused  = "paused"
+	videoResumed = "resumed"
+)
+
+// DegradeOptions set when a call stops sending video so that audio stays
+// usable on a collapsing network, and when it sends video again. Video is
+// paused once the estimated bandwidth has stayed under Floor for After,
+// and resumed once it has stayed at or above Resume for ResumeAfter.
+// Resume is above Floor so the video does not flap. The zero value
+// stands for DefaultDegradeOptions.
+type DegradeOptions struct {
+	// Disabled keeps sending video whatever the estimate.
+	Disabled bool
+	// Floor and Resume are in bits per second.
+	Floor       int64
+	After       time.Duration
+	Resume      int64
+	ResumeAfter time.Duration
+}
+
+// DefaultDegradeOptions pause video under 150 kbit/s, what the lowest
+// simulcast layer takes, and resume it at 400 kbit/s.
+func DefaultDegradeOptions() DegradeOptions {
+	return DegradeOptions{Floor: 150_000, After: 5 * time.Second, Resume: 400_000, ResumeAfter: 10 * time.Second}
+}
+
+// orDefault returns o, or DefaultDegradeOptions for the zero value.
+func (o DegradeOptions) orDefault() DegradeOptions {
+	if o == (DegradeOptions{}) {
+		return DefaultDegradeOptions()
+	}
+	return o
+}
+
+// Validate reports whether the options are in range.
+func (o DegradeOptions) Validate() error {
+	o = o.orDefault()
+	if o.Disabled {
+		return nil
+	}
+	if o.Floor <= 0 || o.Resume <= o.Floor {
+		return fmt.Errorf("video floor %d and resume %d bit/s must be positive, resume above floor", o.Floor, o.Resume)
+	}
+	if o.After <= 0 || o.ResumeAfter <= 0 {
+		return fmt.Errorf("video pause and resume delays must be positive")
+	}
+	return nil
+}
+
+// VideoEvent is video of a call pausing or resuming on its own.
+type VideoEvent struct {
+	At     time.Time
+	Paused bool
+	// Estimate is the bandwidth estimate, in bits per second, that paused
+	// or resumed the video.
+	Estimate int64
+	// Remote is set for the video the peer sends.
+	Remote bool
+}
+
+func (e VideoEvent) String() string {
+	whose := "video"
+	if e.Remote {
+		whose = "peer's video"
+	}
+	if e.Paused {
+		return fmt.Sprintf("%s paused due to poor network (%d kbit/s)", whose, e.Estimate/1000)
+	}
+	return fmt.Sprintf("%s resumed (%d kbit/s)", whose, e.Estimate/1000)
+}
+
+// degrader decides from a stream of bandwidth estimates when to pause and
+// resume the video.
+type degrader struct {
+	o      DegradeOptions
+	paused bool
+	// since is when the estimate crossed the threshold that would change
+	// paused, zero while it is on the side that keeps it.
+	since time.Time
+}
+
+// update takes the estimate at now and returns the event to act on when
+// the video is to pause or resume.
+func (d *degrader) update(estimate int64, now time.Time) (VideoEvent, bool) {
+	if d.o.Disabled {
+		return VideoEvent{}, false
+	}
+	crossed, hold := estimate < d.o.Floor, d.o.After
+	if d.paused {
+		crossed, hold = estimate >= d.o.Resume, d.o.ResumeAfter
+	}
+	if !crossed {
+		d.since = time.Time{}
+		return VideoEvent{}, false
+	}
+	if d.since.IsZero() {
+		d.since = now
+	}
+	if now.Sub(d.since) < hold {
+		return VideoEvent{}, false
+	}
+	d.paused, d.since = !d.paused, time.Time{}
+	return VideoEvent{At: now, Paused: d.paused, Estimate: estimate}, true
+}
+
+// videoStateSignal tells the peer of the call with callID about e.
+func videoStateSignal(callID string, e VideoEvent) message.Message {
+	state := videoResumed
+	if e.Paused {
+		state = videoPaused
+	}
+	return message.Message{Type: typeVideoState, ID: callID, Message: state, Num: int(e.Estimate)}
+}
+
+// parseVideoState returns the event a video state signal of the call with
+// callID reports about the peer's video, received at now.
+func parseVideoState(m message.Message, callID string, now time.Time) (VideoEvent, bool) {
+	if m.Type != typeVideoState || m.ID != callID || (m.Message != videoPaused && m.Message != videoResumed) {
+		return VideoEvent{}, false
+	}
+	return VideoEvent{At: now, Paused: m.Message == videoPaused, Estimate: int64(m.Num), Remote: true}, true
+}
+
+// eventLog records the events of a call of one kind, such as the pauses
+// and resumes of its video.
+type eventLog[E any] struct {
+	mu      sync.Mutex
+	events  []E
+	onEvent func(E)
+}
+
+// videoLog records the pauses and resumes of a call's video.
+type videoLog = eventLog[VideoEvent]
+
+// add records e and tells the onEvent callback, if one is set.
+func (l *eventLog[E]) add(e E) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	f := l.onEvent
+	l.mu.Unlock()
+	if f != nil {
+		f(e)
+	}
+}
+
+func (l *eventLog[E]) setOnEvent(f func(E)) {
+	l.mu.Lock()
+	l.onEvent = f
+	l.mu.Unlock()
+}
+
+func (l *eventLog[E]) list() []E {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.events)
+}
+
+// videoSummary sums up the pauses of this side's video for the summary of
+// a call ending at end, or returns "" if it was never paused.
+func videoSummary(events []VideoEvent, end time.Time) string {
+	var (
+		pauses int
+		paused time.Duration
+		since  time.Time
+	)
+	for _, e := range events {
+		switch {
+		case e.Remote:
+		case e.Paused && since.IsZero():
+			pauses++
+			since = e.At
+		case !e.Paused && !since.IsZero():
+			paused += e.At.Sub(since)
+			since = time.Time{}
+		}
+	}
+	if pauses == 0 {
+		return ""
+	}
+	if !since.IsZero() {
+		paused += end.Sub(since)
+	}
+	times := "once"
+	if pauses > 1 {
+		times = strconv.Itoa(pauses) + " times"
+	}
+	return fmt.Sprintf("video paused %s for %s", times, paused.Round(time.Second))
+}
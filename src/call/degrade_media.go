@@ -0,0 +1,117 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+)
+
+// estimateInterval is how often the bandwidth estimate is checked.
+const estimateInterval = time.Second
+
+// initialEstimate is the bandwidth, in bits per second, the estimate starts
+// from: enough for video, so it is not paused before the estimator has
+// heard from the peer.
+const initialEstimate = 1_500_000
+
+// registerEstimator sets m up for transport-wide congestion control, on
+// what this side sends and what it receives, and returns the interceptors
+// for an API built on m. The bandwidth estimator of the one peer
+// connection the API makes arrives on the channel once it is created.
+// Peers that send no feedback leave the estimate where it started.
+func registerEstimator(m *webrtc.MediaEngine) (*interceptor.Registry, <-chan cc.BandwidthEstimator, error) {
+	i := &interceptor.Registry{}
+	controller, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialEstimate))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	estimators := make(chan cc.BandwidthEstimator, 1)
+	controller.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		select {
+		case estimators <- e:
+		default:
+		}
+	})
+	i.Add(controller)
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, nil, err
+	}
+	if err = webrtc.ConfigureTWCCSender(m, i); err != nil {
+		return nil, nil, err
+	}
+	return i, estimators, nil
+}
+
+// degradeVideo pauses the video pc sends while the bandwidth estimate,
+// held to the send cap of caps, stays too low for it and resumes it once
+// the estimate recovers, as set in o, until ctx is done. notify is told
+// of each pause and resume. Simulcast video is left alone, as its layers
+// already follow the bandwidth.
+func degradeVideo(ctx context.Context, pc *webrtc.PeerConnection, estimators <-chan cc.BandwidthEstimator, o DegradeOptions, caps *bitrateCaps, notify func(VideoEvent)) {
+	o = o.orDefault()
+	if o.Disabled {
+		return
+	}
+	var estimator cc.BandwidthEstimator
+	select {
+	case estimator = <-estimators:
+	case <-ctx.Done():
+		return
+	}
+	d := degrader{o: o}
+	paused := make(map[*webrtc.RTPSender]webrtc.TrackLocal)
+	ticker := time.NewTicker(estimateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		e, ok := d.update(caps.estimate(int64(estimator.GetTargetBitrate())), time.Now())
+		if !ok {
+			continue
+		}
+		if e.Paused {
+			pauseVideo(pc, paused)
+		} else {
+			resumeVideo(paused)
+		}
+		notify(e)
+	}
+}
+
+// pauseVideo stops sending the video tracks of pc, keeping them in paused
+// for resumeVideo.
+func pauseVideo(pc *webrtc.PeerConnection, paused map[*webrtc.RTPSender]webrtc.TrackLocal) {
+	for _, sender := range pc.GetSenders() {
+		track := sender.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo || len(sender.GetParameters().Encodings) > 1 {
+			continue
+		}
+		if err := sender.ReplaceTrack(nil); err != nil {
+			log.Debugf("could not pause video: %v", err)
+			continue
+		}
+		paused[sender] = track
+	}
+}
+
+// resumeVideo sends the tracks pauseVideo stopped again.
+func resumeVideo(paused map[*webrtc.RTPSender]webrtc.TrackLocal) {
+	for sender, track := range paused {
+		if err := sender.ReplaceTrack(track); err != nil {
+			log.Debugf("could not resume video: %v", err)
+		}
+		delete(paused, sender)
+	}
+}
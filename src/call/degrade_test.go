@@ -0,0 +1,100 @@
+package call
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDegrader(t *testing.T) {
+	o := DegradeOptions{Floor: 150_000, After: 5 * time.Second, Resume: 400_000, ResumeAfter: 10 * time.Second}
+	d := degrader{o: o}
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	// a dip shorter than After does not pause the video
+	for s := 0; s < 5; s++ {
+		_, ok := d.update(100_000, at(s))
+		assert.False(t, ok, s)
+	}
+	_, ok := d.update(500_000, at(5))
+	assert.False(t, ok)
+
+	for s := 10; s < 15; s++ {
+		_, ok = d.update(100_000, at(s))
+		assert.False(t, ok, s)
+	}
+	e, ok := d.update(90_000, at(15))
+	assert.True(t, ok)
+	assert.Equal(t, VideoEvent{At: at(15), Paused: true, Estimate: 90_000}, e)
+
+	// between the floor and the resume threshold the video stays paused
+	for s := 16; s < 40; s++ {
+		_, ok = d.update(300_000, at(s))
+		assert.False(t, ok, s)
+	}
+	for s := 40; s < 50; s++ {
+		_, ok = d.update(450_000, at(s))
+		assert.False(t, ok, s)
+	}
+	e, ok = d.update(450_000, at(50))
+	assert.True(t, ok)
+	assert.False(t, e.Paused)
+
+	off := degrader{o: DegradeOptions{Disabled: true}}
+	for s := 0; s < 60; s++ {
+		_, ok = off.update(0, at(s))
+		assert.False(t, ok)
+	}
+}
+
+func TestDegradeOptions(t *testing.T) {
+	assert.Nil(t, DegradeOptions{}.Validate())
+	assert.Equal(t, DefaultDegradeOptions(), DegradeOptions{}.orDefault())
+	assert.Nil(t, DefaultDegradeOptions().Validate())
+	assert.Nil(t, DegradeOptions{Disabled: true}.Validate())
+	assert.True(t, DegradeOptions{Disabled: true}.orDefault().Disabled)
+
+	o := DefaultDegradeOptions()
+	o.Resume = o.Floor
+	assert.NotNil(t, o.Validate())
+	o = DefaultDegradeOptions()
+	o.After = 0
+	assert.NotNil(t, o.Validate())
+}
+
+func TestVideoState(t *testing.T) {
+	now := time.Now()
+	m := videoStateSignal("call-1", VideoEvent{At: now, Paused: true, Estimate: 120_000})
+	e, ok := parseVideoState(m, "call-1", now)
+	assert.True(t, ok)
+	assert.Equal(t, VideoEvent{At: now, Paused: true, Estimate: 120_000, Remote: true}, e)
+	assert.Equal(t, "peer's video paused due to poor network (120 kbit/s)", e.String())
+
+	_, ok = parseVideoState(m, "call-2", now)
+	assert.False(t, ok)
+	m.Message = "sideways"
+	_, ok = parseVideoState(m, "call-1", now)
+	assert.False(t, ok)
+}
+
+func TestVideoSummary(t *testing.T) {
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	assert.Empty(t, videoSummary(nil, at(60)))
+
+	var l videoLog
+	var told []VideoEvent
+	l.setOnEvent(func(e VideoEvent) { told = append(told, e) })
+	l.add(VideoEvent{At: at(10), Paused: true})
+	// the peer's video does not count
+	l.add(VideoEvent{At: at(12), Paused: true, Remote: true})
+	l.add(VideoEvent{At: at(30), Paused: false})
+	assert.Equal(t, "video paused once for 20s", videoSummary(l.list(), at(60)))
+	assert.Len(t, told, 3)
+
+	// a pause still going at the end counts up to the end
+	l.add(VideoEvent{At: at(50), Paused: true})
+	assert.Equal(t, "video paused 2 times for 30s", videoSummary(l.list(), at(60)))
+}
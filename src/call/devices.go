@@ -0,0 +1,43 @@
+package call
+
+import "image"
+
+// VideoSource produces video frames until it returns io.EOF. Like an
+// audio Source, it paces itself: ReadImage returns each frame when it is
+// due.
+type VideoSource interface {
+	ReadImage() (image.Image, error)
+	Close() error
+}
+
+// VideoFrame is a frame of the peer's video, encoded as the peer sent it.
+type VideoFrame struct {
+	// MimeType is the codec, such as video/H264.
+	MimeType string
+	Data     []byte
+	// KeyFrame is set for frames that decode on their own.
+	KeyFrame bool
+}
+
+// VideoSink consumes video frames.
+type VideoSink interface {
+	WriteVideoFrame(VideoFrame) error
+}
+
+// Devices stand in for the microphone, camera and speaker of a call, for
+// calls that send generated or recorded media rather than the devices of
+// the machine, and for tests. Those left nil are the real devices, but
+// for the Screen, as croc does not show video. The call closes the
+// sources when it ends.
+type Devices struct {
+	// Microphone is sent as the call's audio, in mono frames.
+	Microphone Source
+	// Camera is sent as the call's video, encoded with H.264.
+	Camera VideoSource
+	// Speaker receives the peer's audio, decoded to mono. Without one
+	// the audio plays on the default output device, if there is one.
+	Speaker Sink
+	// Screen receives the peer's video. croc does not decode video, so
+	// the frames are still encoded.
+	Screen VideoSink
+}
@@ -0,0 +1,218 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"bytes"
+	"image"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"github.com/schollz/croc/v10/src/internal/h264"
+	log "github.com/schollz/logger"
+)
+
+// defaultFrameRate is assumed for a camera source until its frames say
+// otherwise, as the encoder needs a frame rate from the first frame.
+const defaultFrameRate = 30
+
+// track returns a track fed by the source of d standing in for the device
+// of kind, and false if d has none. The audio is encoded with selector
+// and the video with H.264.
+func (d Devices) track(kind webrtc.RTPCodecType, selector *mediadevices.CodecSelector) (mediadevices.Track, bool, error) {
+	if kind == webrtc.RTPCodecTypeAudio {
+		if d.Microphone == nil {
+			return nil, false, nil
+		}
+		return mediadevices.NewAudioTrack(&audioSource{Source: d.Microphone}, selector), true, nil
+	}
+	if d.Camera == nil {
+		return nil, false, nil
+	}
+	params, err := openh264.NewParams()
+	if err != nil {
+		return nil, true, err
+	}
+	h264 := &h264Params{Params: params}
+	return mediadevices.NewVideoTrack(&videoSource{VideoSource: d.Camera},
+		mediadevices.NewCodecSelector(mediadevices.WithVideoEncoders(h264))), true, nil
+}
+
+// media returns what a call can send: the sources standing in for
+// devices, and the capture devices of the machine for the others.
+func (d Devices) media() Media {
+	return Media{
+		Microphone: d.Microphone != nil || hasDevice(mediadevices.AudioInput),
+		Camera:     d.Camera != nil || hasDevice(mediadevices.VideoInput),
+	}
+}
+
+// h264Params is openh264 with the payload type of the call's media engine
+// and a frame rate for sources that have not shown theirs yet.
+type h264Params struct {
+	openh264.Params
+}
+
+func (p *h264Params) RTPCodec() *codec.RTPCodec {
+	c := p.Params.RTPCodec()
+	c.PayloadType = h264PayloadType
+	return c
+}
+
+func (p *h264Params) BuildVideoEncoder(r video.Reader, property prop.Media) (codec.ReadCloser, error) {
+	if property.FrameRate <= 0 {
+		property.FrameRate = defaultFrameRate
+	}
+	return p.Params.BuildVideoEncoder(r, property)
+}
+
+// audioSource reads a Source as the microphone.
+type audioSource struct {
+	Source
+}
+
+func (s *audioSource) ID() string { return "croc-microphone" }
+
+func (s *audioSource) Read() (wave.Audio, func(), error) {
+	f, err := s.ReadFrame()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	chunk := wave.NewInt16Interleaved(wave.ChunkInfo{Len: len(f.Samples), Channels: 1, SamplingRate: f.SampleRate})
+	copy(chunk.Data, f.Samples)
+	return chunk, func() {}, nil
+}
+
+// videoSource reads a VideoSource as the camera.
+type videoSource struct {
+	VideoSource
+}
+
+func (s *videoSource) ID() string { return "croc-camera" }
+
+func (s *videoSource) Read() (image.Image, func(), error) {
+	img, err := s.ReadImage()
+	return img, func() {}, err
+}
+
+// maxLateVideo is how many packets the frames of the peer's video are
+// reassembled over before a missing one is given up on.
+const maxLateVideo = 256
+
+// playVideo hands the frames of a video track to screen, if set, as they
+// arrive, and decodes them for tap, if set. Only H.264
+// and VP8 are reassembled; other tracks are left unread.
+func playVideo(track *webrtc.TrackRemote, screen VideoSink, tap *videoTap) {
+	mime := track.Codec().MimeType
+	var depacketizer rtp.Depacketizer
+	var keyFrame func([]byte) bool
+	switch {
+	case strings.EqualFold(mime, webrtc.MimeTypeH264):
+		depacketizer, keyFrame = &codecs.H264Packet{}, h264KeyFrame
+	case strings.EqualFold(mime, webrtc.MimeTypeVP8):
+		depacketizer, keyFrame = &codecs.VP8Packet{}, vp8KeyFrame
+	default:
+		log.Debugf("not playing %s video", mime)
+		return
+	}
+	defer tap.close()
+	b := samplebuilder.New(maxLateVideo, depacketizer, track.Codec().ClockRate)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		b.Push(pkt)
+		for s := b.Pop(); s != nil; s = b.Pop() {
+			frame := VideoFrame{MimeType: mime, Data: s.Data, KeyFrame: keyFrame(s.Data)}
+			tap.frame(frame)
+			if screen == nil {
+				continue
+			}
+			if err = screen.WriteVideoFrame(frame); err != nil {
+				log.Debugf("dropping video frame: %v", err)
+			}
+		}
+	}
+}
+
+// keyFrameRetry is how often a key frame is asked for while the incoming
+// video tap waits for one.
+const keyFrameRetry = time.Second
+
+// videoTap decodes the H.264 frames of a received track for the incoming
+// video tap of hooks while one is set. Decoding starts at a key frame,
+// which is asked of the peer with requestKeyFrame when the tap is set.
+type videoTap struct {
+	hooks           *mediaHooks
+	requestKeyFrame func()
+
+	dec       *h264.Decoder
+	requested time.Time
+}
+
+func (v *videoTap) frame(f VideoFrame) {
+	if v == nil || !strings.EqualFold(f.MimeType, webrtc.MimeTypeH264) {
+		return
+	}
+	if v.hooks.incomingVideo.get() == nil {
+		v.close()
+		return
+	}
+	if v.dec == nil {
+		if !f.KeyFrame {
+			if time.Since(v.requested) >= keyFrameRetry {
+				v.requested = time.Now()
+				v.requestKeyFrame()
+			}
+			return
+		}
+		dec, err := h264.NewDecoder()
+		if err != nil {
+			log.Debugf("not decoding video: %v", err)
+			return
+		}
+		v.dec = dec
+	}
+	img, err := v.dec.Decode(f.Data)
+	if err != nil {
+		log.Debugf("dropping incoming video frame: %v", err)
+		return
+	}
+	if img != nil {
+		v.hooks.tapVideo(img)
+	}
+}
+
+func (v *videoTap) close() {
+	if v != nil && v.dec != nil {
+		v.dec.Close()
+		v.dec = nil
+	}
+}
+
+// h264KeyFrame reports whether an Annex B access unit holds an IDR slice.
+func h264KeyFrame(data []byte) bool {
+	for _, nal := range bytes.Split(data, []byte{0, 0, 1}) {
+		if len(nal) > 0 && nal[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// vp8KeyFrame reports whether a VP8 frame is a key frame, which its first
+// bit clears.
+func vp8KeyFrame(data []byte) bool {
+	return len(data) > 0 && data[0]&1 == 0
+}
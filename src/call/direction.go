@@ -0,0 +1,116 @@
+package call
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// Direction says whether a media kind is sent, received or both on this
+// side of a call. The values match the SDP direction attributes.
+type Direction string
+
+const (
+	DirectionSendRecv Direction = "sendrecv"
+	DirectionSendOnly Direction = "sendonly"
+	DirectionRecvOnly Direction = "recvonly"
+)
+
+// ParseDirection parses a direction given on the command line. An empty
+// string means sendrecv.
+func ParseDirection(s string) (Direction, error) {
+	switch d := Direction(strings.ToLower(strings.TrimSpace(s))); d {
+	case "":
+		return DirectionSendRecv, nil
+	case DirectionSendRecv, DirectionSendOnly, DirectionRecvOnly:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown media direction '%s', use sendrecv, sendonly or recvonly", s)
+	}
+}
+
+// Sends reports whether local media has to be captured.
+func (d Direction) Sends() bool {
+	return d == DirectionSendRecv || d == DirectionSendOnly
+}
+
+// Receives reports whether remote media is expected.
+func (d Direction) Receives() bool {
+	return d == DirectionSendRecv || d == DirectionRecvOnly
+}
+
+// Directions are the media kinds a caller offers, as seen from the caller.
+// An empty direction means the kind is not part of the call.
+type Directions struct {
+	Audio Direction `json:"audio,omitempty"`
+	Video Direction `json:"video,omitempty"`
+}
+
+// Describe says what the callee is about to get, e.g. "incoming one-way
+// video".
+func (d Directions) Describe() string {
+	var parts []string
+	for _, kind := range []struct {
+		name string
+		dir  Direction
+	}{{"audio", d.Audio}, {"video", d.Video}} {
+		switch kind.dir {
+		case DirectionSendRecv:
+			parts = append(parts, "two-way "+kind.name)
+		case DirectionSendOnly:
+			parts = append(parts, "incoming one-way "+kind.name)
+		case DirectionRecvOnly:
+			parts = append(parts, "outgoing one-way "+kind.name)
+		}
+	}
+	if len(parts) == 0 {
+		return "call without media"
+	}
+	return strings.Join(parts, " and ")
+}
+
+// newInvite builds the offer signal. The SDP goes in Message as before and
+// the offered directions in Bytes, with the rest of body, so older peers
+// still find the SDP where they expect it. ID is a fresh call id, and the
+// invite offers the current signaling version.
+func newInvite(sdp []byte, body inviteBody) (m message.Message, err error) {
+	dirs, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	m = message.Message{
+		Type:             message.TypeWebRTCOffer,
+		Message:          string(sdp),
+		Bytes:            dirs,
+		ID:               newCallID(),
+		SignalingVersion: message.CurrentSignalingVersion,
+	}
+	return
+}
+
+// parseInvite returns the directions advertised in an offer signal, with
+// the rest of its body. Offers from peers that do not advertise them are
+// two-way.
+func parseInvite(m message.Message) (d inviteBody, err error) {
+	if m.Type != message.TypeWebRTCOffer {
+		err = fmt.Errorf("unexpected signaling type: %s", m.Type)
+		return
+	}
+	if len(m.Bytes) == 0 {
+		return inviteBody{Directions: Directions{Audio: DirectionSendRecv, Video: DirectionSendRecv}}, nil
+	}
+	if err = json.Unmarshal(m.Bytes, &d); err != nil {
+		return
+	}
+	for _, dir := range []Direction{d.Audio, d.Video} {
+		if dir == "" {
+			continue
+		}
+		if _, err = ParseDirection(string(dir)); err != nil {
+			return
+		}
+	}
+	return
+}
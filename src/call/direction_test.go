@@ -0,0 +1,48 @@
+package call
+
+import (
+	"testing"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDirection(t *testing.T) {
+	d, err := ParseDirection("")
+	assert.Nil(t, err)
+	assert.Equal(t, DirectionSendRecv, d)
+	d, err = ParseDirection("RecvOnly")
+	assert.Nil(t, err)
+	assert.Equal(t, DirectionRecvOnly, d)
+	assert.False(t, d.Sends())
+	assert.True(t, d.Receives())
+	_, err = ParseDirection("inactive")
+	assert.NotNil(t, err)
+}
+
+func TestInvite(t *testing.T) {
+	sdp := []byte(`{"type":"offer","sdp":"v=0"}`)
+	invite, err := newInvite(sdp, inviteBody{Directions: Directions{Video: DirectionSendOnly}})
+	assert.Nil(t, err)
+	assert.Equal(t, string(sdp), invite.Message)
+
+	// directions survive sealing with the rest of the offer
+	sc, err := newSignalCipher("1234-shared-secret")
+	assert.Nil(t, err)
+	sealed, err := sc.seal(invite)
+	assert.Nil(t, err)
+	opened, err := sc.open(sealed)
+	assert.Nil(t, err)
+	dirs, err := parseInvite(opened)
+	assert.Nil(t, err)
+	assert.Equal(t, Directions{Video: DirectionSendOnly}, dirs.Directions)
+	assert.Equal(t, "incoming one-way video", dirs.Describe())
+
+	// offers that predate directions are two-way
+	dirs, err = parseInvite(message.Message{Type: message.TypeWebRTCOffer, Message: string(sdp)})
+	assert.Nil(t, err)
+	assert.Equal(t, "two-way audio and two-way video", dirs.Describe())
+
+	_, err = parseInvite(message.Message{Type: message.TypeWebRTCOffer, Bytes: []byte(`{"audio":"sideways"}`)})
+	assert.NotNil(t, err)
+}
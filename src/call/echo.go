@@ -0,0 +1,114 @@
+package call
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Frame is one chunk of mono 16-bit PCM audio.
+type Frame struct {
+	Samples    []int16
+	SampleRate int
+	// Captured is when the frame left the capture device, or for the
+	// audio of a call, when it was decoded.
+	Captured time.Time
+}
+
+// Source produces audio frames until it returns io.EOF.
+type Source interface {
+	ReadFrame() (Frame, error)
+	Close() error
+}
+
+// Sink consumes audio frames.
+type Sink interface {
+	WriteFrame(Frame) error
+}
+
+// discard is a Sink that drops every frame.
+type discard struct{}
+
+func (discard) WriteFrame(Frame) error { return nil }
+
+// EchoReport summarises an echo test.
+type EchoReport struct {
+	// Frames is the number of frames that made it through the delay line.
+	Frames int
+	// Peak is the loudest input sample, 0 to 32768.
+	Peak int
+	// Latency is the average time from a frame being captured to it
+	// being played, on top of the artificial delay.
+	Latency time.Duration
+}
+
+// PeakDBFS returns the peak input level in dBFS, -Inf for silence.
+func (r EchoReport) PeakDBFS() float64 {
+	if r.Peak == 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(float64(r.Peak)/32768)
+}
+
+func (r EchoReport) String() string {
+	level := "silence (check that the microphone is not muted)"
+	if r.Peak > 0 {
+		level = fmt.Sprintf("%.1f dBFS", r.PeakDBFS())
+	}
+	return fmt.Sprintf("%d frames, latency to the speaker %s on top of the delay, peak input %s",
+		r.Frames, r.Latency.Round(100*time.Microsecond), level)
+}
+
+// runEcho pipes src through path, if set, and a delay line into sink,
+// metering the input level and the time each frame spends beyond the delay
+// by the time sink takes it. path may hold frames back, and keeps their
+// capture times. Frames still in the delay line when src runs dry are
+// dropped.
+func runEcho(src Source, path func(Frame) ([]Frame, error), sink Sink, delay time.Duration, now func() time.Time) (report EchoReport, err error) {
+	var (
+		pending []Frame
+		total   time.Duration
+	)
+	for {
+		f, err := src.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		for _, s := range f.Samples {
+			v := int(s)
+			if v < 0 {
+				v = -v
+			}
+			if v > report.Peak {
+				report.Peak = v
+			}
+		}
+		if path == nil {
+			pending = append(pending, f)
+		} else {
+			out, err := path(f)
+			if err != nil {
+				return report, err
+			}
+			pending = append(pending, out...)
+		}
+
+		t := now()
+		for len(pending) > 0 && !t.Before(pending[0].Captured.Add(delay)) {
+			if err = sink.WriteFrame(pending[0]); err != nil {
+				return report, err
+			}
+			total += t.Sub(pending[0].Captured) - delay
+			report.Frames++
+			pending = pending[1:]
+		}
+	}
+	if report.Frames > 0 {
+		report.Latency = total / time.Duration(report.Frames)
+	}
+	return report, nil
+}
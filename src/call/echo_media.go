@@ -0,0 +1,164 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/schollz/croc/v10/src/internal/opus"
+)
+
+// EchoDelay is the artificial delay the echo test holds audio for.
+const EchoDelay = time.Second
+
+// micSource reads frames from a captured microphone track until its
+// deadline passes.
+type micSource struct {
+	track    *mediadevices.AudioTrack
+	reader   audio.Reader
+	deadline time.Time
+}
+
+func (s *micSource) ReadFrame() (Frame, error) {
+	if !time.Now().Before(s.deadline) {
+		return Frame{}, io.EOF
+	}
+	chunk, release, err := s.reader.Read()
+	if err != nil {
+		return Frame{}, err
+	}
+	defer release()
+	info := chunk.ChunkInfo()
+	f := Frame{
+		Samples:    make([]int16, info.Len),
+		SampleRate: info.SamplingRate,
+		Captured:   time.Now(),
+	}
+	// Only the first channel is metered; samples are scaled to 32 bits.
+	for i := range f.Samples {
+		f.Samples[i] = int16(chunk.At(i, 0).Int() >> 16)
+	}
+	return f, nil
+}
+
+func (s *micSource) Close() error {
+	return s.track.Close()
+}
+
+// opusPath carries the audio of the echo test the way a call does:
+// encoded with Opus in 20ms packets and decoded through a jitter buffer.
+type opusPath struct {
+	o   AudioOptions
+	enc *opus.Encoder
+	dec *opus.Decoder
+	// rate is the sample rate of the microphone, which is encoded as is.
+	rate   int
+	buffer []int16
+	seq    uint16
+	jitter *jitterBuffer
+	// decoded are the frames played out by the jitter buffer, captured
+	// when the packet they came from was complete.
+	decoded  []Frame
+	captured time.Time
+}
+
+func newOpusPath(o AudioOptions) (*opusPath, error) {
+	dec, err := opus.NewDecoder(opus.SampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	p := &opusPath{o: o, dec: dec}
+	p.jitter = newJitterBuffer(dec, o.FEC, func(pcm []int16) {
+		// the decoder reuses pcm for the next frame
+		p.decoded = append(p.decoded, Frame{Samples: slices.Clone(pcm), SampleRate: opus.SampleRate, Captured: p.captured})
+	})
+	return p, nil
+}
+
+// carry encodes the packets f completes and returns what the jitter
+// buffer decoded from them.
+func (p *opusPath) carry(f Frame) ([]Frame, error) {
+	if p.enc == nil {
+		enc, err := opus.NewEncoder(f.SampleRate, 1, opus.Params{FEC: p.o.FEC, ExpectedLossPct: p.o.ExpectedLossPct, Complexity: p.o.Complexity})
+		if err != nil {
+			return nil, err
+		}
+		p.enc, p.rate = enc, f.SampleRate
+	} else if f.SampleRate != p.rate {
+		return nil, fmt.Errorf("microphone changed sample rate from %d to %d Hz", p.rate, f.SampleRate)
+	}
+	p.buffer = append(p.buffer, f.Samples...)
+	p.captured = f.Captured
+	packet := p.rate / 50
+	for len(p.buffer) >= packet {
+		data, err := p.enc.Encode(p.buffer[:packet])
+		if err != nil {
+			return nil, err
+		}
+		p.buffer = p.buffer[packet:]
+		p.jitter.push(p.seq, data)
+		p.seq++
+	}
+	decoded := p.decoded
+	p.decoded = nil
+	return decoded, nil
+}
+
+func (p *opusPath) close() {
+	if p.enc != nil {
+		p.enc.Close()
+	}
+	p.dec.Close()
+}
+
+// StartEchoTest captures the microphone for the given duration and plays
+// it back on the speaker after the echo delay, encoded and decoded as in
+// a call, printing the latency from capture to playback and the peak
+// input level. Nothing is sent over the network.
+func StartEchoTest(duration time.Duration) error {
+	if !hasDevice(mediadevices.AudioInput) {
+		return fmt.Errorf("no microphone detected on this machine")
+	}
+	stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
+		Audio: func(c *mediadevices.MediaTrackConstraints) {},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to capture audio: %v", err)
+	}
+	tracks := stream.GetAudioTracks()
+	if len(tracks) == 0 {
+		return fmt.Errorf("failed to capture audio: no audio track")
+	}
+	track, ok := tracks[0].(*mediadevices.AudioTrack)
+	if !ok {
+		return fmt.Errorf("failed to capture audio: unexpected track type %T", tracks[0])
+	}
+	src := &micSource{track: track, reader: track.NewReader(false), deadline: time.Now().Add(duration)}
+	defer src.Close()
+
+	path, err := newOpusPath(DefaultAudioOptions())
+	if err != nil {
+		return err
+	}
+	defer path.close()
+	var sink Sink = discard{}
+	if s, err := openSpeaker(); err != nil {
+		fmt.Printf("Not playing the echo back: %v\n", err)
+	} else {
+		defer s.Close()
+		sink = s
+	}
+
+	fmt.Printf("Echo test running for %s, speak into the microphone...\n", duration)
+	report, err := runEcho(src, path.carry, sink, EchoDelay, time.Now)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Echo test finished: %s\n", report)
+	return nil
+}
@@ -0,0 +1,47 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/opus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEchoThroughOpus(t *testing.T) {
+	// two seconds of a tone captured at 16kHz in 10ms frames
+	now := time.Unix(0, 0)
+	src := &fakeSource{clock: &now, step: 10 * time.Millisecond}
+	for f := 0; f < 200; f++ {
+		pcm := make([]int16, 160)
+		for i := range pcm {
+			pcm[i] = int16(8000 * math.Sin(2*math.Pi*440*float64(f*160+i)/16000))
+		}
+		src.frames = append(src.frames, Frame{Samples: pcm, SampleRate: 16000})
+	}
+	path, err := newOpusPath(DefaultAudioOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer path.close()
+	speaker := newPlaybackBuffer(opus.SampleRate, 2*time.Second)
+	report, err := runEcho(src, path.carry, speaker, time.Second, func() time.Time { return now.Add(3 * time.Millisecond) })
+	assert.Nil(t, err)
+	// a packet is decoded once its second 10ms frame is captured, and the
+	// last second is still in the delay line
+	assert.Equal(t, 50, report.Frames)
+	assert.Equal(t, 3*time.Millisecond, report.Latency)
+	assert.Equal(t, 8000, report.Peak)
+
+	pcm := make([]int16, 50*opus.SampleRate/50)
+	speaker.read(pcm)
+	assert.Zero(t, speaker.silent)
+	peak := 0
+	for _, s := range pcm[len(pcm)/2:] {
+		peak = max(peak, int(s))
+	}
+	assert.InDelta(t, 8000, peak, 1500, "the speaker plays the tone decoded at 48kHz")
+}
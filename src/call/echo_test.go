@@ -0,0 +1,64 @@
+package call
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSource struct {
+	frames []Frame
+	clock  *time.Time
+	step   time.Duration
+}
+
+func (s *fakeSource) ReadFrame() (Frame, error) {
+	if len(s.frames) == 0 {
+		return Frame{}, io.EOF
+	}
+	*s.clock = s.clock.Add(s.step)
+	f := s.frames[0]
+	f.Captured = *s.clock
+	s.frames = s.frames[1:]
+	return f, nil
+}
+
+func (s *fakeSource) Close() error { return nil }
+
+type recordSink struct{ frames []Frame }
+
+func (s *recordSink) WriteFrame(f Frame) error {
+	s.frames = append(s.frames, f)
+	return nil
+}
+
+func TestRunEcho(t *testing.T) {
+	now := time.Unix(0, 0)
+	src := &fakeSource{clock: &now, step: 100 * time.Millisecond}
+	for i := 0; i < 20; i++ {
+		src.frames = append(src.frames, Frame{Samples: []int16{0, int16(i * 100), -int16(i * 200)}, SampleRate: 48000})
+	}
+	sink := &recordSink{}
+	report, err := runEcho(src, nil, sink, time.Second, func() time.Time { return now.Add(2 * time.Millisecond) })
+	assert.Nil(t, err)
+	// The last second of audio is still in the delay line at EOF.
+	assert.Equal(t, 10, report.Frames)
+	assert.Len(t, sink.frames, 10)
+	assert.Equal(t, 2*time.Millisecond, report.Latency)
+	assert.Equal(t, 19*200, report.Peak)
+	assert.InDelta(t, -18.7, report.PeakDBFS(), 0.1)
+	assert.Contains(t, report.String(), "dBFS")
+}
+
+func TestRunEchoSilence(t *testing.T) {
+	now := time.Unix(0, 0)
+	src := &fakeSource{clock: &now, step: 10 * time.Millisecond, frames: []Frame{{Samples: make([]int16, 480)}}}
+	report, err := runEcho(src, nil, discard{}, 0, func() time.Time { return now })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, report.Frames)
+	assert.True(t, math.IsInf(report.PeakDBFS(), -1))
+	assert.Contains(t, report.String(), "silence")
+}
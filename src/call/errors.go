@@ -0,0 +1,13 @@
+package call
+
+import "errors"
+
+// ErrNoMedia is returned by Dial, StartAudioCall, StartVideoCall and StartEchoTest
+// when croc was built with the nomedia tag and has no camera or microphone
+// support.
+var ErrNoMedia = errors.New("built without media support (nomedia build tag); audio and video calls are unavailable")
+
+// ErrNobodyJoined is returned by Dial when the relay closed the call room
+// without anybody else ever joining it, which usually means the peer used
+// a different code or relay.
+var ErrNobodyJoined = errors.New("nobody else joined the call room before the relay closed it; check that the peer used the same code and relay")
@@ -0,0 +1,127 @@
+package call
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// VideoFallback is what a video call does when the callee has no camera
+// to send the video the caller asked for.
+type VideoFallback string
+
+const (
+	// FallbackRecvOnly goes on with the callee only receiving video.
+	FallbackRecvOnly VideoFallback = "recvonly"
+	// FallbackAudio places an audio call instead.
+	FallbackAudio VideoFallback = "audio"
+)
+
+// ParseVideoFallback parses a fallback given on the command line. An
+// empty string means recvonly.
+func ParseVideoFallback(s string) (VideoFallback, error) {
+	switch f := VideoFallback(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return FallbackRecvOnly, nil
+	case FallbackRecvOnly, FallbackAudio:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown video fallback '%s', use recvonly or audio", s)
+	}
+}
+
+// Media are the capture devices one side of a call has, or devices
+// standing in for them. Invites and answers carry them so each side knows
+// what the other can send.
+type Media struct {
+	Microphone bool `json:"microphone"`
+	Camera     bool `json:"camera"`
+}
+
+// errPeerNoCamera is wrapped in the ErrDeclined of a callee that had no
+// camera for the video asked of it.
+var errPeerNoCamera = errors.New("the peer has no camera")
+
+// inviteBody is what an invite carries in Bytes: the offered directions
+// and, from signaling version 2 on, the caller's devices and its wish for
+// a callee without a camera. Older peers read the directions alone.
+type inviteBody struct {
+	Directions
+	Media    *Media        `json:"media,omitempty"`
+	Fallback VideoFallback `json:"fallback,omitempty"`
+}
+
+// answerBody is what an answer carries in Bytes from signaling version 2
+// on: the directions the callee settled on, as the caller sees them, and
+// the callee's devices.
+type answerBody struct {
+	Directions
+	Media *Media `json:"media,omitempty"`
+}
+
+// withAnswerBody returns answer carrying dirs and media.
+func withAnswerBody(answer message.Message, dirs Directions, media Media) (message.Message, error) {
+	b, err := json.Marshal(answerBody{Directions: dirs, Media: &media})
+	if err != nil {
+		return answer, err
+	}
+	answer.Bytes = b
+	return answer, nil
+}
+
+// parseAnswerBody returns what an answer says about the call. Answers from
+// callees before signaling version 2 say nothing, and ok is false.
+func parseAnswerBody(answer message.Message) (body answerBody, ok bool) {
+	if len(answer.Bytes) == 0 || json.Unmarshal(answer.Bytes, &body) != nil {
+		return answerBody{}, false
+	}
+	return body, true
+}
+
+// settle returns the directions, as the caller sees them, that a callee
+// with media takes the invite with, or the reason to decline it. A
+// callee without a camera still receives the caller's video, unless the
+// caller would rather have an audio call or there is nothing left of the
+// call; one without a microphone cannot send the audio asked of it.
+func settle(inv inviteBody, media Media) (Directions, string) {
+	d := inv.Directions
+	if d.Audio != "" && mirror(d.Audio).Sends() && !media.Microphone {
+		return d, declinedNoMicrophone
+	}
+	if d.Video == "" || !mirror(d.Video).Sends() || media.Camera {
+		return d, ""
+	}
+	if inv.Fallback == FallbackAudio || (!d.Video.Sends() && d.Audio == "") {
+		return d, declinedNoCamera
+	}
+	if d.Video.Sends() {
+		d.Video = DirectionSendOnly
+	} else {
+		d.Video = ""
+	}
+	return d, ""
+}
+
+// fallbackNotice tells the caller how the video of a call it offered in
+// direction offered came to be settled, or is empty if nothing changed.
+func fallbackNotice(offered, settled Direction) string {
+	switch {
+	case offered == settled:
+		return ""
+	case settled == DirectionSendOnly:
+		return "The peer has no camera: they see you, but you will not see them."
+	default:
+		return "The peer has no camera, so the call has no video."
+	}
+}
+
+// ownCameraNotice tells the caller of a video call it offered without a
+// camera of its own that it only receives video.
+const ownCameraNotice = "No camera detected: you will see the peer, but they will not see you."
+
+// audioFallbackNotice tells the caller that its video call became an
+// audio call as the peer had no camera.
+const audioFallbackNotice = "The peer has no camera, so this is an audio call instead."
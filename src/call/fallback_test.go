@@ -0,0 +1,92 @@
+package call
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVideoFallback(t *testing.T) {
+	for in, want := range map[string]VideoFallback{"": FallbackRecvOnly, "recvonly": FallbackRecvOnly, " Audio ": FallbackAudio} {
+		got, err := ParseVideoFallback(in)
+		assert.Nil(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, err := ParseVideoFallback("hangup")
+	assert.NotNil(t, err)
+	assert.NotNil(t, VideoOptions{Fallback: "hangup"}.Validate())
+}
+
+func TestSettle(t *testing.T) {
+	all := Media{Microphone: true, Camera: true}
+	noCamera := Media{Microphone: true}
+	for _, tc := range []struct {
+		name    string
+		inv     inviteBody
+		media   Media
+		settled Directions
+		reason  string
+	}{
+		{"devices to spare", inviteBody{Directions: Directions{Video: DirectionSendRecv}}, all, Directions{Video: DirectionSendRecv}, ""},
+		{"the callee only receives video", inviteBody{Directions: Directions{Video: DirectionSendRecv}}, noCamera, Directions{Video: DirectionSendOnly}, ""},
+		{"the callee was to receive only", inviteBody{Directions: Directions{Video: DirectionSendOnly}}, Media{}, Directions{Video: DirectionSendOnly}, ""},
+		{"the caller would rather have audio", inviteBody{Directions: Directions{Video: DirectionSendRecv}, Fallback: FallbackAudio}, noCamera, Directions{Video: DirectionSendRecv}, declinedNoCamera},
+		{"nothing would be left", inviteBody{Directions: Directions{Video: DirectionRecvOnly}}, noCamera, Directions{Video: DirectionRecvOnly}, declinedNoCamera},
+		{"audio goes on without video", inviteBody{Directions: Directions{Audio: DirectionSendRecv, Video: DirectionRecvOnly}}, noCamera, Directions{Audio: DirectionSendRecv}, ""},
+		{"no microphone", inviteBody{Directions: Directions{Audio: DirectionSendRecv}}, Media{Camera: true}, Directions{Audio: DirectionSendRecv}, declinedNoMicrophone},
+		{"no microphone needed", inviteBody{Directions: Directions{Audio: DirectionSendOnly}}, Media{}, Directions{Audio: DirectionSendOnly}, ""},
+	} {
+		settled, reason := settle(tc.inv, tc.media)
+		assert.Equal(t, tc.settled, settled, tc.name)
+		assert.Equal(t, tc.reason, reason, tc.name)
+	}
+}
+
+func TestAnswererWithoutCamera(t *testing.T) {
+	secret := "1234-no-camera"
+	sc, err := newSignalCipher(secret)
+	assert.Nil(t, err)
+	a := &answerer{sc: sc, media: func() Media { return Media{Microphone: true} }}
+
+	_, sealed := sealedInvite(t, secret, Directions{Video: DirectionSendRecv})
+	_, dirs, ok, reply, err := a.handle(sealed)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, reply)
+	assert.Equal(t, Directions{Video: DirectionSendOnly}, dirs)
+	assert.Equal(t, "incoming one-way video", dirs.Describe())
+	a.end()
+
+	invite, err := newInvite([]byte(`{"type":"offer","sdp":"v=0"}`), inviteBody{Directions: Directions{Video: DirectionSendRecv}, Fallback: FallbackAudio})
+	assert.Nil(t, err)
+	sealed, err = sc.seal(invite)
+	assert.Nil(t, err)
+	_, _, ok, reply, err = a.handle(sealed)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	if assert.NotNil(t, reply) {
+		declined, err := sc.open(*reply)
+		assert.Nil(t, err)
+		_, err = checkReply(declined, invite.ID)
+		assert.ErrorIs(t, err, ErrDeclined)
+		assert.True(t, errors.Is(err, errPeerNoCamera), "the caller can fall back to audio")
+	}
+}
+
+func TestAnswerBody(t *testing.T) {
+	answer, err := withAnswerBody(newAnswer([]byte("sdp"), "abc", message.CurrentSignalingVersion), Directions{Video: DirectionSendOnly}, Media{Microphone: true})
+	assert.Nil(t, err)
+	body, ok := parseAnswerBody(answer)
+	assert.True(t, ok)
+	assert.Equal(t, Directions{Video: DirectionSendOnly}, body.Directions)
+	assert.Equal(t, &Media{Microphone: true}, body.Media)
+
+	// callees before version 2 say nothing about the call
+	_, ok = parseAnswerBody(newAnswer([]byte("sdp"), "abc", 1))
+	assert.False(t, ok)
+
+	assert.Empty(t, fallbackNotice(DirectionSendRecv, DirectionSendRecv))
+	assert.Contains(t, fallbackNotice(DirectionSendRecv, DirectionSendOnly), "no camera")
+}
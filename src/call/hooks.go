@@ -0,0 +1,213 @@
+package call
+
+import (
+	"image"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// AudioProcessor processes a frame of captured audio before it is
+// encoded: interleaved 16 bit samples at sampleRate with channels
+// channels. It returns the frame to send, which may be pcm changed in
+// place. A frame of a different length is dropped in favor of pcm.
+type AudioProcessor func(pcm []int16, sampleRate, channels int) []int16
+
+// AudioTap receives a frame of received audio once it is decoded. pcm is
+// reused for the next frame, so a tap that keeps it must copy it.
+type AudioTap func(pcm []int16, sampleRate, channels int)
+
+// VideoProcessor processes a frame from the camera before it is encoded,
+// returning the frame to send. A nil frame sends the original.
+type VideoProcessor func(frame image.Image) image.Image
+
+// VideoTap receives a frame of received video once it is decoded.
+type VideoTap func(frame image.Image)
+
+// Latency budgets of the processing hooks, per frame. Audio frames are
+// 20ms long, and the encoder waits for each; a video frame at 30 frames
+// a second is 33ms long.
+const (
+	audioHookBudget = 10 * time.Millisecond
+	videoHookBudget = 20 * time.Millisecond
+)
+
+// hookStrikes is how many frames in a row a hook may run over its budget
+// before it is bypassed. A single slow frame, say from garbage collection,
+// is no reason to give up on it.
+const hookStrikes = 5
+
+// hook is a processing function of a call, set from the application while
+// media flows through it. Hooks run synchronously on the media path, so
+// one that runs over its budget for hookStrikes frames in a row is
+// bypassed, with a warning, until it is set again.
+type hook[F any] struct {
+	name   string
+	budget time.Duration
+
+	mu   sync.Mutex
+	f    *F
+	over int
+}
+
+// set installs f, or removes the hook if f is nil.
+func (h *hook[F]) set(f *F) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.f, h.over = f, 0
+}
+
+// get returns the hook to run, or nil.
+func (h *hook[F]) get() *F {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f
+}
+
+// took records that f took d on a frame, bypassing it if it keeps running
+// over budget. A hook that was replaced meanwhile is not held against its
+// replacement.
+func (h *hook[F]) took(f *F, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.f != f {
+		return
+	}
+	if d <= h.budget {
+		h.over = 0
+		return
+	}
+	h.over++
+	if h.over >= hookStrikes {
+		h.f, h.over = nil, 0
+		log.Warnf("bypassing the %s: it took %s on each of %d frames in a row, over its budget of %s", h.name, d, hookStrikes, h.budget)
+	}
+}
+
+// mediaHooks are the processing hooks of a call. They are created before
+// the devices are captured, so they see every frame from the first one
+// set on.
+type mediaHooks struct {
+	outgoingAudio hook[AudioProcessor]
+	incomingAudio hook[AudioTap]
+	outgoingVideo hook[VideoProcessor]
+	incomingVideo hook[VideoTap]
+	// captions feeds the captions command of the call, if it has one,
+	// and recorder the file it is recorded to.
+	captions hook[AudioTap]
+	recorder hook[AudioTap]
+}
+
+func newMediaHooks() *mediaHooks {
+	return &mediaHooks{
+		outgoingAudio: hook[AudioProcessor]{name: "outgoing audio processor", budget: audioHookBudget},
+		incomingAudio: hook[AudioTap]{name: "incoming audio tap", budget: audioHookBudget},
+		outgoingVideo: hook[VideoProcessor]{name: "outgoing video processor", budget: videoHookBudget},
+		incomingVideo: hook[VideoTap]{name: "incoming video tap", budget: videoHookBudget},
+		captions:      hook[AudioTap]{name: "captions tap", budget: audioHookBudget},
+		recorder:      hook[AudioTap]{name: "recording tap", budget: audioHookBudget},
+	}
+}
+
+// processAudio runs the outgoing audio processor on a captured frame and
+// returns the frame to encode.
+func (m *mediaHooks) processAudio(pcm []int16, sampleRate, channels int) []int16 {
+	f := m.outgoingAudio.get()
+	if f == nil {
+		return pcm
+	}
+	start := time.Now()
+	out := (*f)(pcm, sampleRate, channels)
+	m.outgoingAudio.took(f, time.Since(start))
+	if len(out) != len(pcm) {
+		return pcm
+	}
+	return out
+}
+
+// tapAudio hands a decoded frame to the incoming audio tap, the captions
+// and the recording.
+func (m *mediaHooks) tapAudio(pcm []int16, sampleRate, channels int) {
+	runTap(&m.incomingAudio, pcm, sampleRate, channels)
+	runTap(&m.captions, pcm, sampleRate, channels)
+	runTap(&m.recorder, pcm, sampleRate, channels)
+}
+
+func runTap(h *hook[AudioTap], pcm []int16, sampleRate, channels int) {
+	f := h.get()
+	if f == nil {
+		return
+	}
+	start := time.Now()
+	(*f)(pcm, sampleRate, channels)
+	h.took(f, time.Since(start))
+}
+
+// processVideo runs the outgoing video processor on a camera frame and
+// returns the frame to encode.
+func (m *mediaHooks) processVideo(frame image.Image) image.Image {
+	f := m.outgoingVideo.get()
+	if f == nil {
+		return frame
+	}
+	start := time.Now()
+	out := (*f)(frame)
+	m.outgoingVideo.took(f, time.Since(start))
+	if out == nil {
+		return frame
+	}
+	return out
+}
+
+// tapVideo hands a decoded frame to the incoming video tap.
+func (m *mediaHooks) tapVideo(frame image.Image) {
+	f := m.incomingVideo.get()
+	if f == nil {
+		return
+	}
+	start := time.Now()
+	(*f)(frame)
+	m.incomingVideo.took(f, time.Since(start))
+}
+
+// setHook sets h to f, removing it if f is nil.
+func setHook[F any](h *hook[F], f F, isNil bool) {
+	if isNil {
+		h.set(nil)
+		return
+	}
+	h.set(&f)
+}
+
+// SetOutgoingAudioProcessor runs f on every frame the microphone captures,
+// between capture and encoding, replacing any processor set before. nil
+// removes it. f runs on the media path and must return within a few
+// milliseconds; one that keeps taking longer is bypassed with a warning
+// until it is set again.
+func (cs *CallSession) SetOutgoingAudioProcessor(f AudioProcessor) {
+	setHook(&cs.hooks.outgoingAudio, f, f == nil)
+}
+
+// OnIncomingAudio calls f with every frame of audio received from the
+// peer, once it is decoded, replacing any tap set before. nil removes it.
+// f is held to the same budget as SetOutgoingAudioProcessor.
+func (cs *CallSession) OnIncomingAudio(f AudioTap) {
+	setHook(&cs.hooks.incomingAudio, f, f == nil)
+}
+
+// SetOutgoingVideoProcessor runs f on every frame the camera captures,
+// before it is encoded, replacing any processor set before. nil removes
+// it. Simulcast layers are scaled from the processed frame.
+func (cs *CallSession) SetOutgoingVideoProcessor(f VideoProcessor) {
+	setHook(&cs.hooks.outgoingVideo, f, f == nil)
+}
+
+// OnIncomingVideo calls f with every frame of video received from the
+// peer, once it is decoded, replacing any tap set before. nil removes it.
+// Only H.264 is decoded, from the first key frame after f is set, which
+// is asked of the peer. f is held to the same budget as
+// SetOutgoingVideoProcessor.
+func (cs *CallSession) OnIncomingVideo(f VideoTap) {
+	setHook(&cs.hooks.incomingVideo, f, f == nil)
+}
@@ -0,0 +1,65 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"image"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// attach runs the outgoing processors of m on the frames tracks capture.
+// Every encoder reading a track, including the simulcast layers, sees
+// the processed frames. m may be nil, for calls without hooks.
+func (m *mediaHooks) attach(tracks []mediadevices.Track) {
+	if m == nil {
+		return
+	}
+	for _, track := range tracks {
+		switch t := track.(type) {
+		case *mediadevices.AudioTrack:
+			t.Transform(m.audioTransform)
+		case *mediadevices.VideoTrack:
+			t.Transform(m.videoTransform)
+		}
+	}
+}
+
+func (m *mediaHooks) audioTransform(r audio.Reader) audio.Reader {
+	return audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		chunk, release, err := r.Read()
+		if err != nil {
+			return chunk, release, err
+		}
+		info := chunk.ChunkInfo()
+		switch c := chunk.(type) {
+		case *wave.Int16Interleaved:
+			copy(c.Data, m.processAudio(c.Data, info.SamplingRate, info.Channels))
+		case *wave.Float32Interleaved:
+			if m.outgoingAudio.get() == nil {
+				break
+			}
+			pcm := make([]int16, len(c.Data))
+			for i, s := range c.Data {
+				pcm[i] = int16(max(-1, min(1, s)) * 32767)
+			}
+			for i, s := range m.processAudio(pcm, info.SamplingRate, info.Channels) {
+				c.Data[i] = float32(s) / 32767
+			}
+		}
+		return chunk, release, nil
+	})
+}
+
+func (m *mediaHooks) videoTransform(r video.Reader) video.Reader {
+	return video.ReaderFunc(func() (image.Image, func(), error) {
+		img, release, err := r.Read()
+		if err != nil {
+			return img, release, err
+		}
+		return m.processVideo(img), release, nil
+	})
+}
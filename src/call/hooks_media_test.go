@@ -0,0 +1,38 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"testing"
+
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudioTransform(t *testing.T) {
+	m := newMediaHooks()
+	setHook(&m.outgoingAudio, func(pcm []int16, sampleRate, channels int) []int16 {
+		out := make([]int16, len(pcm))
+		for i, s := range pcm {
+			out[i] = s / 2
+		}
+		return out
+	}, false)
+	for _, chunk := range []wave.Audio{
+		&wave.Int16Interleaved{Data: []int16{1000, -1000}, Size: wave.ChunkInfo{Len: 1, Channels: 2, SamplingRate: 48000}},
+		&wave.Float32Interleaved{Data: []float32{0.5, -0.5}, Size: wave.ChunkInfo{Len: 1, Channels: 2, SamplingRate: 48000}},
+	} {
+		r := m.audioTransform(audio.ReaderFunc(func() (wave.Audio, func(), error) {
+			return chunk, func() {}, nil
+		}))
+		got, _, err := r.Read()
+		assert.Nil(t, err)
+		switch c := got.(type) {
+		case *wave.Int16Interleaved:
+			assert.Equal(t, []int16{500, -500}, c.Data)
+		case *wave.Float32Interleaved:
+			assert.InDeltaSlice(t, []float32{0.25, -0.25}, c.Data, 0.001)
+		}
+	}
+}
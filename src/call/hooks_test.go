@@ -0,0 +1,100 @@
+package call
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookBypass(t *testing.T) {
+	cs := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "" }, nil)
+	calls := 0
+	cs.SetOutgoingAudioProcessor(func(pcm []int16, sampleRate, channels int) []int16 {
+		calls++
+		return pcm
+	})
+	h := &cs.hooks.outgoingAudio
+	f := h.get()
+	for range hookStrikes - 1 {
+		h.took(f, time.Second)
+	}
+	h.took(f, time.Millisecond)
+	assert.NotNil(t, h.get(), "a frame within budget resets the count")
+	for range hookStrikes - 1 {
+		h.took(f, time.Second)
+	}
+	assert.NotNil(t, h.get())
+	h.took(f, time.Second)
+	assert.Nil(t, h.get(), "bypassed after too many slow frames in a row")
+
+	pcm := []int16{1, 2, 3}
+	assert.Equal(t, pcm, cs.hooks.processAudio(pcm, 48000, 1))
+	assert.Equal(t, 0, calls)
+
+	cs.SetOutgoingAudioProcessor(func(pcm []int16, sampleRate, channels int) []int16 {
+		calls++
+		return pcm
+	})
+	g := h.get()
+	h.took(f, time.Second)
+	h.took(g, time.Second)
+	assert.Equal(t, 1, h.over, "the replaced processor is not held against the new one")
+	cs.hooks.processAudio(pcm, 48000, 1)
+	assert.Equal(t, 1, calls, "setting a processor again brings it back")
+	cs.SetOutgoingAudioProcessor(nil)
+	assert.Nil(t, h.get())
+}
+
+func TestProcessAudio(t *testing.T) {
+	m := newMediaHooks()
+	var got []int
+	setHook(&m.outgoingAudio, func(pcm []int16, sampleRate, channels int) []int16 {
+		got = []int{len(pcm), sampleRate, channels}
+		for i := range pcm {
+			pcm[i] *= 2
+		}
+		return pcm
+	}, false)
+	assert.Equal(t, []int16{2, -4}, m.processAudio([]int16{1, -2}, 48000, 2))
+	assert.Equal(t, []int{2, 48000, 2}, got)
+
+	setHook(&m.outgoingAudio, func(pcm []int16, sampleRate, channels int) []int16 {
+		return pcm[:1]
+	}, false)
+	assert.Equal(t, []int16{1, -2}, m.processAudio([]int16{1, -2}, 48000, 2), "a frame of another length is dropped")
+
+	var tapped []int16
+	m.tapAudio([]int16{5}, 48000, 1)
+	setHook(&m.incomingAudio, func(pcm []int16, sampleRate, channels int) {
+		tapped = append(tapped, pcm...)
+	}, false)
+	m.tapAudio([]int16{5}, 48000, 1)
+	m.tapAudio([]int16{6}, 48000, 1)
+	assert.Equal(t, []int16{5, 6}, tapped)
+}
+
+func TestProcessVideo(t *testing.T) {
+	m := newMediaHooks()
+	frame := image.NewGray(image.Rect(0, 0, 2, 2))
+	assert.Same(t, frame, m.processVideo(frame))
+
+	other := image.NewGray(image.Rect(0, 0, 2, 2))
+	setHook(&m.outgoingVideo, func(image.Image) image.Image { return other }, false)
+	assert.Same(t, other, m.processVideo(frame))
+
+	setHook(&m.outgoingVideo, func(image.Image) image.Image { return nil }, false)
+	assert.Same(t, frame, m.processVideo(frame), "a nil frame sends the original")
+}
+
+func TestTapVideo(t *testing.T) {
+	m := newMediaHooks()
+	frame := image.NewGray(image.Rect(0, 0, 2, 2))
+	m.tapVideo(frame)
+
+	var got image.Image
+	setHook(&m.incomingVideo, func(f image.Image) { got = f }, false)
+	m.tapVideo(frame)
+	assert.Same(t, frame, got)
+}
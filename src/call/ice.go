@@ -0,0 +1,224 @@
+package call
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// turnFetchTimeout bounds fetching TURN credentials when ICEOptions have
+// no client of their own.
+const turnFetchTimeout = 10 * time.Second
+
+// maxTURNResponse caps the response of a TURN credential URL.
+const maxTURNResponse = 64 * 1024
+
+// ICEOptions give a call servers to gather candidates from beyond the
+// addresses of the machine.
+type ICEOptions struct {
+	// Servers are STUN and TURN servers every call uses. They are all a
+	// call has when its TURN credentials cannot be fetched.
+	Servers []webrtc.ICEServer
+	// TURNCredentialURL, if set, is fetched as a call is set up for
+	// short-lived TURN credentials, following the REST API convention of
+	// coturn: a JSON object with the username, the credential (or
+	// password), their ttl in seconds and the uris of the servers they
+	// are for. The request asks for service=turn.
+	TURNCredentialURL string
+	// TURNToken, if set, is sent with the request as a bearer token.
+	// TURNSecret, if set, signs the request instead: it carries the Unix
+	// time as timestamp and, in the X-Signature header, the hex HMAC-SHA256
+	// of that timestamp keyed with the secret.
+	TURNToken  string
+	TURNSecret string
+	// Client fetches the credentials; nil is a client that gives up after
+	// ten seconds.
+	Client *http.Client
+}
+
+// Validate reports whether the options are usable.
+func (o ICEOptions) Validate() error {
+	if o.TURNCredentialURL == "" {
+		if o.TURNToken != "" || o.TURNSecret != "" {
+			return errors.New("a TURN token or secret needs a TURN credential URL")
+		}
+		return nil
+	}
+	u, err := url.Parse(o.TURNCredentialURL)
+	if err != nil {
+		return fmt.Errorf("TURN credential URL: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("TURN credential URL %q is not an http or https URL", o.TURNCredentialURL)
+	}
+	if o.TURNToken != "" && o.TURNSecret != "" {
+		return errors.New("the TURN credential URL takes a token or a secret, not both")
+	}
+	return nil
+}
+
+// ParseICEServers parses a comma separated list of STUN or TURN URLs
+// without credentials, e.g. "stun:stun.l.google.com:19302".
+func ParseICEServers(list string) (servers []webrtc.ICEServer) {
+	for _, server := range strings.Split(list, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, webrtc.ICEServer{URLs: []string{server}})
+		}
+	}
+	return
+}
+
+// turnCredentials are what a TURN credential URL returns.
+type turnCredentials struct {
+	Username   string `json:"username"`
+	Credential string `json:"credential"`
+	// Password is what coturn calls the credential.
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// parseTURNCredentials parses the response of a TURN credential URL into
+// the server it is for and how long the credentials last.
+func parseTURNCredentials(data []byte) (server webrtc.ICEServer, ttl time.Duration, err error) {
+	var c turnCredentials
+	if err = json.Unmarshal(data, &c); err != nil {
+		return server, 0, fmt.Errorf("malformed TURN credentials: %w", err)
+	}
+	if c.Credential == "" {
+		c.Credential = c.Password
+	}
+	switch {
+	case c.Username == "" || c.Credential == "":
+		return server, 0, errors.New("TURN credentials without a username or credential")
+	case c.TTL <= 0:
+		return server, 0, fmt.Errorf("TURN credentials with a ttl of %d", c.TTL)
+	case len(c.URIs) == 0:
+		return server, 0, errors.New("TURN credentials without uris")
+	}
+	for _, uri := range c.URIs {
+		if _, err = stun.ParseURI(uri); err != nil {
+			return server, 0, fmt.Errorf("TURN credentials with uri %q: %w", uri, err)
+		}
+	}
+	server = webrtc.ICEServer{URLs: c.URIs, Username: c.Username, Credential: c.Credential}
+	return server, time.Duration(c.TTL) * time.Second, nil
+}
+
+// fetchTURNCredentials asks the TURN credential URL of o for credentials
+// at now.
+func fetchTURNCredentials(ctx context.Context, o ICEOptions, now time.Time) (webrtc.ICEServer, time.Duration, error) {
+	u, err := url.Parse(o.TURNCredentialURL)
+	if err != nil {
+		return webrtc.ICEServer{}, 0, err
+	}
+	q := u.Query()
+	q.Set("service", "turn")
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	if o.TURNSecret != "" {
+		q.Set("timestamp", timestamp)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return webrtc.ICEServer{}, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case o.TURNToken != "":
+		req.Header.Set("Authorization", "Bearer "+o.TURNToken)
+	case o.TURNSecret != "":
+		mac := hmac.New(sha256.New, []byte(o.TURNSecret))
+		mac.Write([]byte(timestamp))
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: turnFetchTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return webrtc.ICEServer{}, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webrtc.ICEServer{}, 0, fmt.Errorf("TURN credential URL answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTURNResponse+1))
+	if err != nil {
+		return webrtc.ICEServer{}, 0, err
+	}
+	if len(data) > maxTURNResponse {
+		return webrtc.ICEServer{}, 0, fmt.Errorf("TURN credentials larger than %d bytes", maxTURNResponse)
+	}
+	return parseTURNCredentials(data)
+}
+
+// iceServers are the servers of ICEOptions, with the TURN credentials
+// fetched for them kept fresh. Fetched credentials are fetched anew once
+// four fifths of their ttl have passed, so a call that renegotiates late
+// does not do so with credentials about to expire. A nil iceServers has
+// no servers.
+type iceServers struct {
+	o   ICEOptions
+	now func() time.Time
+
+	mu        sync.Mutex
+	turn      *webrtc.ICEServer
+	refreshAt time.Time
+	expires   time.Time
+}
+
+func newICEServers(o ICEOptions) *iceServers {
+	return &iceServers{o: o, now: time.Now}
+}
+
+// get returns the servers to configure a peer connection with, fetching
+// TURN credentials if there are none yet or they are due. fetched reports
+// whether they were. If fetching fails, get returns err with the
+// configured servers and the credentials fetched before, until they
+// expire.
+func (s *iceServers) get(ctx context.Context) (servers []webrtc.ICEServer, fetched bool, err error) {
+	if s == nil {
+		return nil, false, nil
+	}
+	if s.o.TURNCredentialURL == "" {
+		return s.o.Servers, false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.turn == nil || !now.Before(s.refreshAt) {
+		var server webrtc.ICEServer
+		var ttl time.Duration
+		if server, ttl, err = fetchTURNCredentials(ctx, s.o, now); err == nil {
+			s.turn, s.refreshAt, s.expires = &server, now.Add(ttl*4/5), now.Add(ttl)
+			fetched = true
+		} else if s.turn != nil && !now.Before(s.expires) {
+			s.turn = nil
+		}
+	}
+	if s.turn != nil {
+		servers = append(servers, *s.turn)
+	}
+	return append(servers, s.o.Servers...), fetched, err
+}
+
+// turnNotice tells that a call could not fetch its TURN credentials.
+func turnNotice(err error) string {
+	return fmt.Sprintf("Could not fetch TURN credentials (%v), so the call only has the configured ICE servers.", err)
+}
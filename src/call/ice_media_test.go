@@ -0,0 +1,47 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenegotiationRefreshesTURN(t *testing.T) {
+	rest := &turnREST{t: t}
+	ts := httptest.NewServer(rest)
+	defer ts.Close()
+	now := time.Now()
+	ice := newICEServers(ICEOptions{TURNCredentialURL: ts.URL})
+	ice.now = func() time.Time { return now }
+	servers, _, err := ice.get(t.Context())
+	assert.Nil(t, err)
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: servers})
+	assert.Nil(t, err)
+	defer pc.Close()
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	assert.Nil(t, err)
+	user := func() string { return pc.GetConfiguration().ICEServers[0].Username }
+
+	callee, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer callee.Close()
+
+	p := pcPeer{pc, ice}
+	offer, err := p.Offer()
+	assert.Nil(t, err)
+	assert.Equal(t, "user-1", user())
+	answer, err := pcPeer{pc: callee}.Answer(offer)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Accept(answer))
+
+	// a long call renegotiates with fresh credentials
+	now = now.Add(90 * time.Second)
+	_, err = p.Offer()
+	assert.Nil(t, err)
+	assert.Equal(t, "user-2", user())
+}
@@ -0,0 +1,196 @@
+package call
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICEOptionsValidate(t *testing.T) {
+	assert.Nil(t, ICEOptions{}.Validate())
+	assert.Nil(t, ICEOptions{TURNCredentialURL: "https://turn.example.com/creds", TURNToken: "t"}.Validate())
+	assert.Nil(t, ICEOptions{TURNCredentialURL: "http://127.0.0.1:8080/", TURNSecret: "s"}.Validate())
+	for _, o := range []ICEOptions{
+		{TURNToken: "t"},
+		{TURNSecret: "s"},
+		{TURNCredentialURL: "turn:turn.example.com"},
+		{TURNCredentialURL: "https://"},
+		{TURNCredentialURL: "https://turn.example.com", TURNToken: "t", TURNSecret: "s"},
+	} {
+		assert.NotNil(t, o.Validate(), "%+v", o)
+	}
+}
+
+func TestParseTURNCredentials(t *testing.T) {
+	server, ttl, err := parseTURNCredentials([]byte(`{"username":"1700000000:alice","credential":"c2VjcmV0","ttl":600,"uris":["turn:turn.example.com:3478?transport=udp","turns:turn.example.com:5349"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, ttl)
+	assert.Equal(t, webrtc.ICEServer{URLs: []string{"turn:turn.example.com:3478?transport=udp", "turns:turn.example.com:5349"},
+		Username: "1700000000:alice", Credential: "c2VjcmV0"}, server)
+
+	// coturn calls the credential password
+	server, _, err = parseTURNCredentials([]byte(`{"username":"u","password":"p","ttl":60,"uris":["turn:turn.example.com"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "p", server.Credential)
+
+	for name, data := range map[string]string{
+		"not json":      `<html>`,
+		"wrong type":    `{"username":"u","credential":"c","ttl":"600","uris":["turn:turn.example.com"]}`,
+		"no username":   `{"credential":"c","ttl":600,"uris":["turn:turn.example.com"]}`,
+		"no credential": `{"username":"u","ttl":600,"uris":["turn:turn.example.com"]}`,
+		"no ttl":        `{"username":"u","credential":"c","uris":["turn:turn.example.com"]}`,
+		"negative ttl":  `{"username":"u","credential":"c","ttl":-1,"uris":["turn:turn.example.com"]}`,
+		"no uris":       `{"username":"u","credential":"c","ttl":600}`,
+		"bad uri":       `{"username":"u","credential":"c","ttl":600,"uris":["http://turn.example.com"]}`,
+	} {
+		_, _, err = parseTURNCredentials([]byte(data))
+		assert.NotNil(t, err, name)
+	}
+}
+
+// turnREST is a TURN credential endpoint that hands out numbered
+// credentials, or fails while broken.
+type turnREST struct {
+	t      *testing.T
+	token  string
+	secret string
+
+	mu      sync.Mutex
+	issued  int
+	broken  bool
+	respond string
+}
+
+func (s *turnREST) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(s.t, "turn", r.URL.Query().Get("service"))
+	switch {
+	case s.token != "":
+		if r.Header.Get("Authorization") != "Bearer "+s.token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	case s.secret != "":
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write([]byte(r.URL.Query().Get("timestamp")))
+		if r.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if s.respond != "" {
+		fmt.Fprint(w, s.respond)
+		return
+	}
+	s.issued++
+	fmt.Fprintf(w, `{"username":"user-%d","credential":"pass","ttl":100,"uris":["turn:turn.example.com:3478"]}`, s.issued)
+}
+
+func TestICEServers(t *testing.T) {
+	rest := &turnREST{t: t, token: "token"}
+	ts := httptest.NewServer(rest)
+	defer ts.Close()
+	static := webrtc.ICEServer{URLs: []string{"stun:stun.example.com:3478"}}
+	now := time.Now()
+	ice := newICEServers(ICEOptions{Servers: []webrtc.ICEServer{static}, TURNCredentialURL: ts.URL, TURNToken: "token"})
+	ice.now = func() time.Time { return now }
+	get := func(fetched bool) []string {
+		t.Helper()
+		servers, f, err := ice.get(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, fetched, f)
+		var users []string
+		for _, s := range servers {
+			users = append(users, s.Username)
+		}
+		return users
+	}
+
+	assert.Equal(t, []string{"user-1", ""}, get(true))
+	now = now.Add(79 * time.Second)
+	assert.Equal(t, []string{"user-1", ""}, get(false))
+	// refreshed before they expire
+	now = now.Add(time.Second)
+	assert.Equal(t, []string{"user-2", ""}, get(true))
+
+	// while the endpoint is down the credentials are kept until they
+	// expire, and then only the static servers are left
+	rest.mu.Lock()
+	rest.broken = true
+	rest.mu.Unlock()
+	now = now.Add(90 * time.Second)
+	servers, fetched, err := ice.get(context.Background())
+	assert.ErrorContains(t, err, "503")
+	assert.False(t, fetched)
+	assert.Equal(t, []webrtc.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user-2", Credential: "pass"}, static}, servers)
+	now = now.Add(10 * time.Second)
+	servers, _, err = ice.get(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, []webrtc.ICEServer{static}, servers)
+
+	// the endpoint coming back is picked up on the next call
+	rest.mu.Lock()
+	rest.broken = false
+	rest.mu.Unlock()
+	assert.Equal(t, []string{"user-3", ""}, get(true))
+
+	var none *iceServers
+	servers, fetched, err = none.get(context.Background())
+	assert.Nil(t, servers)
+	assert.False(t, fetched)
+	assert.Nil(t, err)
+	servers, _, err = newICEServers(ICEOptions{Servers: []webrtc.ICEServer{static}}).get(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []webrtc.ICEServer{static}, servers)
+}
+
+func TestICEServersFallback(t *testing.T) {
+	static := webrtc.ICEServer{URLs: []string{"stun:stun.example.com:3478"}}
+	for name, setup := range map[string]func(*turnREST, *ICEOptions){
+		"malformed": func(r *turnREST, _ *ICEOptions) { r.respond = `{"username":"u","credential":"c","ttl":100,"uris":[` },
+		"expired": func(r *turnREST, _ *ICEOptions) {
+			r.respond = `{"username":"u","credential":"c","ttl":0,"uris":["turn:x"]}`
+		},
+		"wrong token":  func(r *turnREST, o *ICEOptions) { r.token, o.TURNToken = "token", "other" },
+		"wrong secret": func(r *turnREST, o *ICEOptions) { r.secret, o.TURNSecret = "secret", "other" },
+		"too large": func(r *turnREST, _ *ICEOptions) {
+			r.respond = `{"username":"` + strings.Repeat("u", maxTURNResponse) + `"}`
+		},
+	} {
+		rest := &turnREST{t: t}
+		ts := httptest.NewServer(rest)
+		o := ICEOptions{Servers: []webrtc.ICEServer{static}, TURNCredentialURL: ts.URL}
+		setup(rest, &o)
+		servers, fetched, err := newICEServers(o).get(context.Background())
+		assert.NotNil(t, err, name)
+		assert.False(t, fetched, name)
+		assert.Equal(t, []webrtc.ICEServer{static}, servers, name)
+		ts.Close()
+	}
+
+	// a signed request gets credentials
+	rest := &turnREST{t: t, secret: "secret"}
+	ts := httptest.NewServer(rest)
+	defer ts.Close()
+	servers, _, err := newICEServers(ICEOptions{TURNCredentialURL: ts.URL + "/creds?key=1", TURNSecret: "secret"}).get(context.Background())
+	assert.Nil(t, err)
+	if assert.Len(t, servers, 1) {
+		assert.Equal(t, "user-1", servers[0].Username)
+	}
+}
@@ -0,0 +1,136 @@
+package call
+
+import "fmt"
+
+// defaultJitterDepth is how many packets past a gap the jitter buffer
+// waits for the missing one before giving it up for lost. At 20ms a packet
+// that is 60ms late is no use to a call anyway.
+const defaultJitterDepth = 3
+
+// maxJitterGap is the jump in sequence numbers taken for a restart of the
+// stream rather than for loss.
+const maxJitterGap = 50
+
+// audioDecoder decodes the packets of an audio stream. DecodeFEC rebuilds
+// the packet lost just before next from the redundancy in next; Conceal
+// makes up a packet from the audio before it.
+type audioDecoder interface {
+	Decode(packet []byte) ([]int16, error)
+	DecodeFEC(next []byte) ([]int16, error)
+	Conceal() ([]int16, error)
+}
+
+// LossStats count what became of the packets of an audio stream.
+type LossStats struct {
+	Received int
+	// Lost packets never arrived in time; each was either recovered
+	// with FEC or concealed.
+	Lost      int
+	Recovered int
+	Concealed int
+	// Late packets arrived after they were given up for lost.
+	Late int
+}
+
+func (s LossStats) String() string {
+	if s.Lost == 0 {
+		return fmt.Sprintf("%d audio packets, none lost", s.Received)
+	}
+	return fmt.Sprintf("%d of %d audio packets lost, %d recovered with FEC, %d concealed",
+		s.Lost, s.Received+s.Lost, s.Recovered, s.Concealed)
+}
+
+// jitterBuffer puts RTP packets back in sequence order and decodes them,
+// handing out one frame for every packet whether it arrived or not. A
+// gap is given up for lost once depth packets after it are waiting; the
+// frame is then rebuilt from the next packet when FEC is on and that
+// packet is here, and concealed otherwise.
+type jitterBuffer struct {
+	dec   audioDecoder
+	fec   bool
+	depth int
+	// play takes each decoded frame.
+	play func([]int16)
+
+	started bool
+	next    uint16
+	pending map[uint16][]byte
+	stats   LossStats
+}
+
+func newJitterBuffer(dec audioDecoder, fec bool, play func([]int16)) *jitterBuffer {
+	if play == nil {
+		play = func([]int16) {}
+	}
+	return &jitterBuffer{dec: dec, fec: fec, depth: defaultJitterDepth, play: play, pending: make(map[uint16][]byte)}
+}
+
+// push adds the packet with sequence number seq.
+func (j *jitterBuffer) push(seq uint16, payload []byte) {
+	if !j.started {
+		j.started, j.next = true, seq
+	}
+	// sequence numbers wrap, so compare them by their distance
+	if int16(seq-j.next) < 0 {
+		j.stats.Late++
+		return
+	}
+	if _, ok := j.pending[seq]; ok {
+		return
+	}
+	if int16(seq-j.next) > maxJitterGap {
+		j.flush()
+		j.next = seq
+	}
+	j.pending[seq] = payload
+	j.stats.Received++
+	j.drain(j.depth)
+}
+
+// flush decodes what is still waiting, at the end of the stream.
+func (j *jitterBuffer) flush() {
+	j.drain(0)
+}
+
+// drain decodes packets in order while they are here, giving up the
+// missing ones while more than wait packets are waiting behind them.
+func (j *jitterBuffer) drain(wait int) {
+	for len(j.pending) > 0 {
+		if p, ok := j.pending[j.next]; ok {
+			delete(j.pending, j.next)
+			j.decode(p)
+		} else if len(j.pending) > wait {
+			j.recover()
+		} else {
+			return
+		}
+		j.next++
+	}
+}
+
+func (j *jitterBuffer) decode(p []byte) {
+	pcm, err := j.dec.Decode(p)
+	if err != nil {
+		// a packet that does not decode is as good as lost
+		pcm, err = j.dec.Conceal()
+	}
+	if err == nil {
+		j.play(pcm)
+	}
+}
+
+// recover stands in for the missing packet j.next.
+func (j *jitterBuffer) recover() {
+	j.stats.Lost++
+	if next, ok := j.pending[j.next+1]; ok && j.fec {
+		if pcm, err := j.dec.DecodeFEC(next); err == nil {
+			j.stats.Recovered++
+			j.play(pcm)
+			return
+		}
+	}
+	j.stats.Concealed++
+	if pcm, err := j.dec.Conceal(); err == nil {
+		j.play(pcm)
+	}
+}
@@ -0,0 +1,102 @@
+package call
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDecoder decodes a packet to the one sample it holds. FEC rebuilds
+// the sample before the one in next; concealment gives -1.
+type fakeDecoder struct {
+	fec bool
+}
+
+func (fakeDecoder) Decode(p []byte) ([]int16, error) {
+	if len(p) == 0 {
+		return nil, errors.New("empty")
+	}
+	return []int16{int16(p[0])}, nil
+}
+
+func (d fakeDecoder) DecodeFEC(next []byte) ([]int16, error) {
+	if !d.fec {
+		return nil, errors.New("no FEC data")
+	}
+	return []int16{int16(next[0]) - 1}, nil
+}
+
+func (fakeDecoder) Conceal() ([]int16, error) {
+	return []int16{-1}, nil
+}
+
+func TestOpusFmtp(t *testing.T) {
+	assert.Equal(t, "minptime=10;useinbandfec=1", DefaultAudioOptions().fmtp())
+	assert.Equal(t, "minptime=10;useinbandfec=0", AudioOptions{}.fmtp())
+	assert.Nil(t, DefaultAudioOptions().Validate())
+	assert.NotNil(t, AudioOptions{ExpectedLossPct: 101}.Validate())
+	assert.NotNil(t, AudioOptions{Complexity: -1}.Validate())
+}
+
+func TestJitterReorder(t *testing.T) {
+	var played []int16
+	j := newJitterBuffer(fakeDecoder{}, false, func(pcm []int16) { played = append(played, pcm...) })
+	// starting just before the sequence numbers wrap
+	for _, seq := range []uint16{65534, 0, 65535, 1, 2} {
+		j.push(seq, []byte{byte(seq + 10)})
+	}
+	j.flush()
+	assert.Equal(t, []int16{8, 9, 10, 11, 12}, played)
+	assert.Equal(t, LossStats{Received: 5}, j.stats)
+
+	// a packet after its turn has come is dropped
+	j.push(0, []byte{10})
+	assert.Equal(t, 1, j.stats.Late)
+}
+
+func TestJitterLoss(t *testing.T) {
+	var played []int16
+	j := newJitterBuffer(fakeDecoder{fec: true}, true, func(pcm []int16) { played = append(played, pcm...) })
+	for _, seq := range []uint16{1, 3, 4, 5, 6, 9, 10, 11, 12} {
+		j.push(seq, []byte{byte(seq)})
+	}
+	j.flush()
+	// 2 is rebuilt from 3; 7 is concealed, as 8 is lost too; 8 from 9
+	assert.Equal(t, []int16{1, 2, 3, 4, 5, 6, -1, 8, 9, 10, 11, 12}, played)
+	assert.Equal(t, LossStats{Received: 9, Lost: 3, Recovered: 2, Concealed: 1}, j.stats)
+}
+
+func TestJitterRestart(t *testing.T) {
+	var played []int16
+	j := newJitterBuffer(fakeDecoder{}, false, func(pcm []int16) { played = append(played, pcm...) })
+	j.push(1, []byte{1})
+	j.push(1000, []byte{2})
+	j.push(1001, []byte{3})
+	j.flush()
+	assert.Equal(t, []int16{1, 2, 3}, played)
+	assert.Zero(t, j.stats.Lost)
+}
+
+// TestFECLoss runs a stream through random loss, as on a bad network, and
+// checks that FEC saves most of the lost packets from being concealed.
+func TestFECLoss(t *testing.T) {
+	concealed := func(fec bool) LossStats {
+		rng := rand.New(rand.NewSource(1))
+		j := newJitterBuffer(fakeDecoder{fec: fec}, fec, nil)
+		for seq := 0; seq < 5000; seq++ {
+			if rng.Intn(100) < 10 {
+				continue
+			}
+			j.push(uint16(seq), []byte{byte(seq)})
+		}
+		j.flush()
+		return j.stats
+	}
+	without, with := concealed(false), concealed(true)
+	assert.Equal(t, without.Lost, with.Lost)
+	assert.Equal(t, without.Lost, without.Concealed)
+	assert.Greater(t, with.Recovered, with.Concealed*5)
+	assert.Less(t, with.Concealed, without.Concealed/5)
+}
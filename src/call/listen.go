@@ -0,0 +1,469 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// listenRetryDelay is how long Listen waits before rejoining the room after
+// losing it.
+const listenRetryDelay = 5 * time.Second
+
+func logEvent(event string, kv ...any) {
+	fmt.Fprintln(os.Stderr, formatEvent(time.Now(), event, kv...))
+}
+
+// Listen waits in the call room and answers invites until ctx is done,
+// taking one call at a time and re-arming after each. It returns nil when
+// ctx is cancelled and an error only for problems that retrying cannot
+// fix.
+func Listen(ctx context.Context, options croc.Options, lo ListenOptions) error {
+	if options.SharedSecret == "" {
+		return fmt.Errorf("listening needs a code")
+	}
+	if !lo.AutoAnswer && lo.Confirm == nil {
+		return fmt.Errorf("listening without auto-answer needs a way to confirm calls")
+	}
+	// an invite can ask for either kind of media
+	kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	if err := errors.Join(lo.Audio.Validate(), lo.Degrade.Validate(), lo.Network.Validate(), lo.WebRTC.check(lo.Network, kinds...),
+		lo.ICE.Validate(), checkBitrateCaps(lo.MaxSendBitrate, lo.MaxRecvBitrate)); err != nil {
+		return err
+	}
+	sc, err := newSignalCipher(options.SharedSecret)
+	if err != nil {
+		return err
+	}
+	sc.log = lo.SignalLog
+	a := &answerer{sc: sc, policy: lo.Policy, media: lo.Devices.media, ice: newICEServers(lo.ICE)}
+	// rejoining supersedes the connections of this listener only
+	instance := tcp.NewInstance()
+	for {
+		err := listenOnce(ctx, options, instance, a, lo)
+		if ctx.Err() != nil {
+			logEvent("stopped")
+			return nil
+		}
+		if errors.Is(err, tcp.ErrUpgradeRequired) {
+			return err
+		}
+		logEvent("disconnected", "error", err)
+		select {
+		case <-ctx.Done():
+			logEvent("stopped")
+			return nil
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+// listenOnce joins the room as instance and serves invites until the
+// connection to the relay is lost or ctx is done.
+func listenOnce(ctx context.Context, options croc.Options, instance string, a *answerer, lo ListenOptions) error {
+	conn, _, _, err := options.ConnectToRoom(options.RelayAddress, tcp.RoomRequest{
+		Room:         options.RoomName,
+		Policy:       tcp.RoomPolicyLatestOnly,
+		Mode:         tcp.RoomModeSignal,
+		App:          options.App,
+		Capabilities: []string{tcp.CapabilityControlFrames},
+		Instance:     instance,
+	}, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	markSignaling(conn, lo.Network.SignalingDSCP)
+	logEvent("listening", "relay", options.RelayAddress, "auto_answer", lo.AutoAnswer)
+
+	frames := make(chan message.Message)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			data, err := conn.Receive()
+			if err != nil {
+				errc <- err
+				return
+			}
+			var m message.Message
+			if err = json.Unmarshal(data, &m); err != nil {
+				continue
+			}
+			select {
+			case frames <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// ended is nil, and so never ready, while no call is in progress.
+	var ended <-chan struct{}
+	var call *activeCall
+	defer func() {
+		if call != nil {
+			call.hangup()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			// the call itself does not need the relay, so let it finish
+			// before rejoining
+			if ended != nil {
+				select {
+				case <-ended:
+					logCallEnded(call)
+				case <-ctx.Done():
+				}
+				a.end()
+				ended, call = nil, nil
+			}
+			return err
+		case <-ended:
+			a.end()
+			logCallEnded(call)
+			ended, call = nil, nil
+		case m := <-frames:
+			if call != nil && isRenegotiation(m.Type) {
+				if opened, err := a.sc.open(m); err == nil {
+					call.reneg.deliver(opened)
+				}
+				continue
+			}
+			if call != nil && m.Type == typeVideoState {
+				if opened, err := a.sc.open(m); err == nil {
+					if e, ok := parseVideoState(opened, call.id, time.Now()); ok {
+						call.video.add(e)
+					}
+				}
+				continue
+			}
+			if call != nil && m.Type == typeCaptureState {
+				if opened, err := a.sc.open(m); err == nil {
+					if e, ok := parseCaptureState(opened, call.id, time.Now()); ok {
+						logCaptureEvent(call.id, e)
+					}
+				}
+				continue
+			}
+			if call != nil && m.Type == typeRecording {
+				if opened, err := a.sc.open(m); err == nil {
+					if kind, ok := parseRecording(opened, call.id); ok && kind == recordingRequest {
+						// the listener has nobody to ask, so it tells
+						// whoever watches it and acknowledges
+						logEvent("peer_recording", "call", call.id, "alias", opened.Alias)
+						if err := call.send(recordingSignal(call.id, recordingAck, "")); err != nil {
+							logEvent("recording_ack_failed", "call", call.id, "error", err)
+						}
+					}
+				}
+				continue
+			}
+			if call != nil && m.Type == typeBitrateCap {
+				if opened, err := a.sc.open(m); err == nil {
+					if bps, ok := parseBitrateCap(opened, call.id); ok {
+						call.caps.setPeer(bps)
+						logEvent("peer_cap", "call", call.id, "kbps", bps/1000)
+					}
+				}
+				continue
+			}
+			inv, dirs, ok, reply, err := a.handle(m)
+			if err != nil {
+				logEvent("invite_ignored", "error", err)
+				continue
+			}
+			if reply != nil {
+				if err = sendSignal(conn, *reply); err != nil {
+					return err
+				}
+				reason := ""
+				if declined, err := a.sc.open(*reply); err == nil {
+					reason = declined.Message
+				}
+				logEvent("invite_declined", "call", inv.ID, "media", dirs.Describe(), "reason", reason)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			logEvent("invite", "call", inv.ID, "media", dirs.Describe())
+			if offered, err := parseInvite(inv); err == nil && offered.Directions != dirs {
+				logEvent("invite_fallback", "call", inv.ID, "reason", declinedNoCamera, "offered", offered.Describe())
+			}
+			caps := newBitrateCaps(lo.MaxSendBitrate, lo.MaxRecvBitrate)
+			// the microphone warms up while the user decides
+			var warm *warmCapture
+			if !lo.AutoAnswer && lo.Audio.WarmUp && sendsAudio(dirs) {
+				warm = warmAudio(lo.Audio, caps, lo.Devices)
+			}
+			if !lo.AutoAnswer && !lo.Confirm(dirs) {
+				warm.release()
+				a.end()
+				decline, err := a.sc.seal(message.Message{Type: typeCallDeclined, ID: inv.ID, Message: "declined"})
+				if err == nil {
+					err = sendSignal(conn, decline)
+				}
+				if err != nil {
+					return err
+				}
+				logEvent("invite_declined", "call", inv.ID, "reason", "declined")
+				continue
+			}
+			answered, err := answerCall(conn, a.sc, inv, dirs, lo.Audio, lo.Degrade, lo.Network, lo.Devices, lo.WebRTC, a.ice, warm, caps)
+			if err != nil {
+				a.end()
+				logEvent("answer_failed", "call", inv.ID, "error", err)
+				continue
+			}
+			call, ended = answered, answered.ended
+			logEvent("answered", "call", inv.ID)
+		}
+	}
+}
+
+// logVideoEvent logs video of the call with id pausing or resuming.
+func logVideoEvent(id string, e VideoEvent) {
+	event := "video_"
+	if e.Remote {
+		event = "peer_video_"
+	}
+	if e.Paused {
+		event += videoPaused
+	} else {
+		event += videoResumed
+	}
+	logEvent(event, "call", id, "estimate_kbps", e.Estimate/1000)
+}
+
+// logCaptureEvent logs the peer's camera of the call with id stalling or
+// producing frames again.
+func logCaptureEvent(id string, e CaptureEvent) {
+	event := "peer_camera_" + captureRecovered
+	if e.Stalled {
+		event = "peer_camera_" + captureStalled
+	}
+	logEvent(event, "call", id, "alias", e.Alias)
+}
+
+// logCallEnded logs the end of a call with the media path it last used,
+// the audio packets it lost, how long after connecting audio arrived and
+// how long its video was paused.
+func logCallEnded(call *activeCall) {
+	var kv []any
+	if p, ok := call.path.PathInfo(); ok {
+		kv = append(kv, "path", p.Kind(), "remote", p.Remote.addr())
+	}
+	if loss := call.audio.summary(); loss != "" {
+		kv = append(kv, "audio", loss)
+	}
+	if d, ok := call.audio.first.latency(); ok {
+		kv = append(kv, "first_audio", d.Round(time.Millisecond))
+	}
+	if s := videoSummary(call.video.list(), time.Now()); s != "" {
+		kv = append(kv, "video", s)
+	}
+	logEvent("call_ended", kv...)
+}
+
+// activeCall is a call the listener answered.
+type activeCall struct {
+	id string
+	// ended is closed when the call is over; hangup ends it early.
+	ended  <-chan struct{}
+	hangup func()
+	// path follows the media path once the call connects.
+	path *pathWatcher
+	// audio counts the audio packets the caller's side lost.
+	audio *audioReceiver
+	// reneg takes the caller's renegotiation signals once the call
+	// connects.
+	reneg *renegotiator
+	// video records the pauses and resumes of the video either side
+	// sends.
+	video *videoLog
+	// caps hold the call to the bitrate caps of both sides.
+	caps *bitrateCaps
+	// send seals signals to the caller.
+	send func(message.Message) error
+}
+
+// sendsAudio reports whether an invite for dirs asks this side for audio.
+func sendsAudio(dirs Directions) bool {
+	return dirs.Audio != "" && mirror(dirs.Audio).Sends()
+}
+
+// answerCall answers inv on a new peer connection, sending what the caller
+// asked to receive and this side settled on in dirs, with audio encoded as set in audio and video paused as
+// set in degrade, on the network described by network or the API of w
+// and the servers of ice, with devices standing in for those of the
+// machine, and held to caps.
+// warm, if set, is the microphone warmed up while the call rang, which
+// the call takes over.
+func answerCall(conn *comm.Comm, sc *signalCipher, inv message.Message, dirs Directions, audio AudioOptions, degrade DegradeOptions, network NetworkOptions, devices Devices, w WebRTCOptions, ice *iceServers, warm *warmCapture, caps *bitrateCaps) (call *activeCall, err error) {
+	var tracks []mediadevices.Track
+	if warm != nil {
+		tracks = warm.tracks
+	}
+	var offer webrtc.SessionDescription
+	if err = json.Unmarshal([]byte(inv.Message), &offer); err != nil {
+		warm.release()
+		return nil, fmt.Errorf("failed to unmarshal remote SDP: %v", err)
+	}
+	api, codecs, estimators, err := newCallAPI(audio, caps, network, w)
+	if err != nil {
+		warm.release()
+		return
+	}
+	servers, _, errICE := ice.get(context.Background())
+	if errICE != nil {
+		logEvent("turn_credentials_failed", "call", inv.ID, "error", errICE)
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICETransportPolicy: webrtc.ICETransportPolicyAll, ICEServers: servers})
+	if err != nil {
+		warm.release()
+		return
+	}
+	closeSpeaker := func() {}
+	if dirs.Audio != "" && mirror(dirs.Audio).Receives() {
+		devices, closeSpeaker = devices.withSpeaker()
+	}
+	consumer := bandwidth.Default.Register("answered call", callWeight)
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var once sync.Once
+	hangup := func() {
+		once.Do(func() {
+			cancel()
+			warm.stop()
+			pc.Close()
+			closeTracks(tracks)
+			closeSpeaker()
+			consumer.Close()
+			close(done)
+		})
+	}
+	defer func() {
+		if err != nil {
+			hangup()
+		}
+	}()
+
+	path := watchPath(pc)
+	received := receiveMedia(pc, audio, nil, devices)
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			received.first.markConnected(time.Now())
+			connectedOnce.Do(func() { close(connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go hangup()
+		}
+	})
+	if err = pc.SetRemoteDescription(offer); err != nil {
+		return
+	}
+	// The remote offer created the transceivers; tracks attach to them.
+	for _, kind := range []struct {
+		kind webrtc.RTPCodecType
+		dir  Direction
+	}{{webrtc.RTPCodecTypeAudio, dirs.Audio}, {webrtc.RTPCodecTypeVideo, dirs.Video}} {
+		if kind.dir == "" || !mirror(kind.dir).Sends() {
+			continue
+		}
+		var selector *mediadevices.CodecSelector
+		if kind.kind == webrtc.RTPCodecTypeAudio {
+			if warm != nil {
+				// already captured
+				continue
+			}
+			selector = codecs
+		}
+		captured, errCapture := captureTracks(kind.kind, selector, devices)
+		if errCapture != nil {
+			err = errCapture
+			return
+		}
+		tracks = append(tracks, captured...)
+	}
+	for _, track := range tracks {
+		if _, err = pc.AddTrack(track); err != nil {
+			return
+		}
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err = pc.SetLocalDescription(answer); err != nil {
+		return
+	}
+	<-gathered
+	answerData, err := json.Marshal(pc.LocalDescription())
+	if err != nil {
+		return
+	}
+	answerMsg, err := withAnswerBody(newAnswer(answerData, inv.ID, inv.SignalingVersion), dirs, devices.media())
+	if err != nil {
+		return
+	}
+	sealed, err := sc.seal(answerMsg)
+	if err != nil {
+		return
+	}
+	if err = sendSignal(conn, sealed); err != nil {
+		return
+	}
+	// The caller may only renegotiate once it has the answer, so the
+	// renegotiator can start now; the tracks added above have already
+	// been negotiated.
+	send := relaySignals(conn, sc)
+	video := &videoLog{onEvent: func(e VideoEvent) { logVideoEvent(inv.ID, e) }}
+	call = &activeCall{id: inv.ID, ended: done, hangup: hangup, path: path, audio: received,
+		reneg: renegotiate(ctx, pc, ice, inv.ID, true, send), video: video, caps: caps, send: send}
+	caps.setWarn(func(inbound, limit int64) {
+		logEvent("peer_over_cap", "call", inv.ID, "inbound_kbps", inbound/1000, "cap_kbps", limit/1000)
+	})
+	go degradeVideo(ctx, pc, estimators, degrade, caps, func(e VideoEvent) {
+		video.add(e)
+		if err := send(videoStateSignal(inv.ID, e)); err != nil {
+			logEvent("video_signal_failed", "call", inv.ID, "error", err)
+		}
+	})
+	go func() {
+		select {
+		case <-connected:
+			warm.stop()
+			go enforceCaps(ctx, pc, caps, inv.ID, send)
+			if p, ok := refreshPath(pc, path); ok {
+				logEvent("path", "call", inv.ID, "kind", p.Kind(), "relayed", p.Relayed(),
+					"local", p.Local.addr(), "remote", p.Remote.addr())
+			}
+		case <-done:
+		case <-time.After(30 * time.Second):
+			logEvent("answer_timeout", "call", inv.ID)
+			hangup()
+		}
+	}()
+	return call, nil
+}
@@ -0,0 +1,251 @@
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// Signals that renegotiate a call in progress, sent when a track is added
+// or removed. ID is the call id, Message the session description and Num
+// the number of the offer, which an answer repeats.
+const (
+	typeRenegotiateOffer  = message.TypeWebRTCReoffer
+	typeRenegotiateAnswer = message.TypeWebRTCReanswer
+)
+
+// renegotiateTimeout is how long an offer waits for its answer before it
+// is rolled back, as it would be forever with a peer that predates
+// renegotiation.
+const renegotiateTimeout = 30 * time.Second
+
+// negotiationPeer is the part of a peer connection that renegotiation
+// drives. Descriptions are session descriptions in their JSON form.
+type negotiationPeer interface {
+	// Offer creates an offer, sets it as the local description and returns
+	// it with all candidates.
+	Offer() ([]byte, error)
+	// Answer sets offer as the remote description and returns the answer
+	// it set as the local one.
+	Answer(offer []byte) ([]byte, error)
+	// Accept sets the answer to the local offer.
+	Accept(answer []byte) error
+	// Rollback drops the local offer, returning to the stable state.
+	Rollback() error
+}
+
+// renegotiator exchanges a new offer and answer whenever the tracks of a
+// connected call change, over the signaling channel the call was set up
+// on. Both sides may change tracks at the same time, so it follows the
+// perfect negotiation pattern: when offers collide the impolite side, the
+// caller, ignores the one it receives, and the polite side, the callee,
+// rolls its own back, answers, and offers again afterwards. Existing
+// tracks keep flowing throughout, as a failed offer is rolled back rather
+// than ending the call.
+type renegotiator struct {
+	peer    negotiationPeer
+	callID  string
+	polite  bool
+	send    func(message.Message) error
+	timeout time.Duration
+
+	needed   chan struct{}
+	incoming chan message.Message
+	ctx      context.Context
+}
+
+// newRenegotiator starts renegotiating for the call with the given id
+// until ctx is done. send delivers a signal to the peer.
+func newRenegotiator(ctx context.Context, peer negotiationPeer, callID string, polite bool, send func(message.Message) error) *renegotiator {
+	r := &renegotiator{
+		peer:     peer,
+		callID:   callID,
+		polite:   polite,
+		send:     send,
+		timeout:  renegotiateTimeout,
+		needed:   make(chan struct{}, 1),
+		incoming: make(chan message.Message),
+		ctx:      ctx,
+	}
+	go r.run()
+	return r
+}
+
+// negotiationNeeded asks for a new offer. It never blocks, so it can be
+// called from the peer connection's callback.
+func (r *renegotiator) negotiationNeeded() {
+	select {
+	case r.needed <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands over an opened signal for this call. It reports whether
+// the signal was a renegotiation one.
+func (r *renegotiator) deliver(m message.Message) bool {
+	if !isRenegotiation(m.Type) || m.ID != r.callID {
+		return false
+	}
+	select {
+	case r.incoming <- m:
+	case <-r.ctx.Done():
+	}
+	return true
+}
+
+func isRenegotiation(t message.Type) bool {
+	return t == typeRenegotiateOffer || t == typeRenegotiateAnswer
+}
+
+func (r *renegotiator) run() {
+	var (
+		// offering is the number of the local offer awaiting an answer
+		offering int
+		sent     int
+		// lastRemote is the number of the last offer answered, so a
+		// replayed offer is not applied again
+		lastRemote int
+		pending    bool
+		deadline   <-chan time.Time
+	)
+	rollback := func(reason string) {
+		if err := r.peer.Rollback(); err != nil {
+			log.Warnf("could not roll back offer %d: %v", offering, err)
+		}
+		log.Debugf("rolled back offer %d: %s", offering, reason)
+		offering, deadline = 0, nil
+	}
+	offer := func() {
+		desc, err := r.peer.Offer()
+		if err != nil {
+			log.Warnf("could not renegotiate call: %v", err)
+			return
+		}
+		sent++
+		offering = sent
+		if err = r.send(message.Message{Type: typeRenegotiateOffer, ID: r.callID, Num: offering, Message: string(desc)}); err != nil {
+			log.Warnf("could not send offer: %v", err)
+			rollback("not sent")
+			return
+		}
+		deadline = time.After(r.timeout)
+	}
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.needed:
+			if offering != 0 {
+				pending = true
+				break
+			}
+			offer()
+		case m := <-r.incoming:
+			switch m.Type {
+			case typeRenegotiateOffer:
+				if m.Num <= lastRemote {
+					log.Debugf("ignoring stale offer %d", m.Num)
+					break
+				}
+				if offering != 0 {
+					if !r.polite {
+						log.Debugf("ignoring offer %d colliding with ours", m.Num)
+						break
+					}
+					rollback("collision")
+					pending = true
+				}
+				lastRemote = m.Num
+				answer, err := r.peer.Answer([]byte(m.Message))
+				if err != nil {
+					log.Warnf("could not answer offer %d: %v", m.Num, err)
+					break
+				}
+				if err = r.send(message.Message{Type: typeRenegotiateAnswer, ID: r.callID, Num: m.Num, Message: string(answer)}); err != nil {
+					log.Warnf("could not send answer: %v", err)
+				}
+			case typeRenegotiateAnswer:
+				if offering == 0 || m.Num != offering {
+					log.Debugf("ignoring answer to offer %d", m.Num)
+					break
+				}
+				if err := r.peer.Accept([]byte(m.Message)); err != nil {
+					log.Warnf("could not accept answer: %v", err)
+					rollback("bad answer")
+					break
+				}
+				offering, deadline = 0, nil
+			}
+		case <-deadline:
+			rollback("no answer")
+		}
+		if offering == 0 && pending {
+			pending = false
+			offer()
+		}
+	}
+}
+
+// sendSignal sends m to the signaling room as is.
+func sendSignal(conn *comm.Comm, m message.Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return conn.Send(data)
+}
+
+// relaySignals returns a send function for a renegotiator that seals
+// signals and sends them to the signaling room.
+func relaySignals(conn *comm.Comm, sc *signalCipher) func(message.Message) error {
+	return func(m message.Message) error {
+		sealed, err := sc.seal(m)
+		if err != nil {
+			return err
+		}
+		return sendSignal(conn, sealed)
+	}
+}
+
+// pumpSignals reads the signaling room until it fails, passing
+// renegotiation signals that authenticate to r, the peer's video pauses
+// and resumes to onVideo, the receive caps it asks for to onCap and its
+// acknowledgement of a recording to onRecordingAck.
+func pumpSignals(conn *comm.Comm, sc *signalCipher, r *renegotiator, onVideo func(VideoEvent), onCap func(int64), onRecordingAck func()) error {
+	for {
+		data, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		var m message.Message
+		if err = json.Unmarshal(data, &m); err != nil || (!isRenegotiation(m.Type) && m.Type != typeVideoState && m.Type != typeBitrateCap && m.Type != typeRecording) {
+			continue
+		}
+		if m, err = sc.open(m); err != nil {
+			log.Debugf("ignoring signal: %v", err)
+			continue
+		}
+		if e, ok := parseVideoState(m, r.callID, time.Now()); ok {
+			onVideo(e)
+			continue
+		}
+		if bps, ok := parseBitrateCap(m, r.callID); ok {
+			onCap(bps)
+			continue
+		}
+		if kind, ok := parseRecording(m, r.callID); ok {
+			if kind == recordingAck {
+				onRecordingAck()
+			}
+			continue
+		}
+		r.deliver(m)
+		if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// pcPeer is a peer connection as renegotiation drives it. Its TURN
+// credentials are refreshed from ice before each offer and answer.
+type pcPeer struct {
+	pc  *webrtc.PeerConnection
+	ice *iceServers
+}
+
+func (p pcPeer) Offer() ([]byte, error) {
+	p.refreshICE()
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.setLocal(offer)
+}
+
+func (p pcPeer) Answer(offer []byte) ([]byte, error) {
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(offer, &desc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal remote SDP: %v", err)
+	}
+	if err := p.pc.SetRemoteDescription(desc); err != nil {
+		return nil, err
+	}
+	p.refreshICE()
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.setLocal(answer)
+}
+
+func (p pcPeer) Accept(answer []byte) error {
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(answer, &desc); err != nil {
+		return fmt.Errorf("failed to unmarshal remote SDP: %v", err)
+	}
+	return p.pc.SetRemoteDescription(desc)
+}
+
+func (p pcPeer) Rollback() error {
+	return p.pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback})
+}
+
+// refreshICE configures the peer connection with fresh TURN credentials
+// if the ones it has are due. Pion's ICE agent keeps the servers it was
+// created with, so the fresh ones reach what reads the configuration of
+// the peer connection from then on.
+func (p pcPeer) refreshICE() {
+	servers, fetched, err := p.ice.get(context.Background())
+	if err != nil {
+		log.Warnf("could not refresh the TURN credentials: %v", err)
+	}
+	if !fetched {
+		return
+	}
+	config := p.pc.GetConfiguration()
+	config.ICEServers = servers
+	if err = p.pc.SetConfiguration(config); err != nil {
+		log.Warnf("could not configure the refreshed TURN credentials: %v", err)
+	}
+}
+
+// setLocal sets desc as the local description and returns it once
+// candidates are gathered, since signaling does not trickle them.
+func (p pcPeer) setLocal(desc webrtc.SessionDescription) ([]byte, error) {
+	gathered := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		return nil, err
+	}
+	<-gathered
+	return json.Marshal(p.pc.LocalDescription())
+}
+
+// renegotiate keeps pc's session in step with its tracks until ctx is
+// done, refreshing its TURN credentials from ice. Install it once the call
+// is connected, so the tracks of the initial offer do not trigger a
+// second one.
+func renegotiate(ctx context.Context, pc *webrtc.PeerConnection, ice *iceServers, callID string, polite bool, send func(m message.Message) error) *renegotiator {
+	r := newRenegotiator(ctx, pcPeer{pc, ice}, callID, polite, send)
+	pc.OnNegotiationNeeded(r.negotiationNeeded)
+	return r
+}
+
+// addVideo captures the camera and adds it to a call in progress, which
+// renegotiates the call. Its frames go through the video processor of
+// hooks. The Camera of devices stands in for the camera if set.
+func addVideo(pc *webrtc.PeerConnection, hooks *mediaHooks, devices Devices) error {
+	tracks, err := captureTracks(webrtc.RTPCodecTypeVideo, nil, devices)
+	if err != nil {
+		return err
+	}
+	hooks.attach(tracks)
+	for _, track := range tracks {
+		if _, err = pc.AddTrack(track); err != nil {
+			return fmt.Errorf("failed to add video track: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePeer stands in for a peer connection. Its descriptions list the
+// tracks a side sends. Like a real answer, an answer can only carry tracks
+// that were already negotiated, so a side that added tracks has to offer
+// them itself.
+type fakePeer struct {
+	mu         sync.Mutex
+	tracks     []string
+	negotiated []string
+	offered    []string
+	remote     []string
+	offering   bool
+	onNeeded   func()
+	// send signals the other side, video records what it reports about
+	// its video, caps the receive cap it asks for and recordingAcks how
+	// often it acknowledged a recording.
+	send          func(message.Message) error
+	video         videoLog
+	caps          bitrateCaps
+	recordingAcks atomic.Int32
+}
+
+func (p *fakePeer) describe(t string, tracks []string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": t, "sdp": strings.Join(tracks, ",")})
+	return b
+}
+
+func (p *fakePeer) parse(b []byte) []string {
+	var d map[string]string
+	json.Unmarshal(b, &d)
+	if d["sdp"] == "" {
+		return nil
+	}
+	return strings.Split(d["sdp"], ",")
+}
+
+// changed fires negotiation needed when stable with unnegotiated tracks;
+// p.mu must be held.
+func (p *fakePeer) changed() {
+	if !p.offering && !slices.Equal(p.tracks, p.negotiated) && p.onNeeded != nil {
+		go p.onNeeded()
+	}
+}
+
+func (p *fakePeer) setTracks(tracks ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracks = tracks
+	p.changed()
+}
+
+func (p *fakePeer) Offer() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.offering {
+		return nil, fmt.Errorf("already offering")
+	}
+	p.offering, p.offered = true, slices.Clone(p.tracks)
+	return p.describe("offer", p.offered), nil
+}
+
+func (p *fakePeer) Answer(offer []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.offering {
+		return nil, fmt.Errorf("cannot answer in have-local-offer")
+	}
+	p.remote = p.parse(offer)
+	answer := p.describe("answer", p.negotiated)
+	p.changed()
+	return answer, nil
+}
+
+func (p *fakePeer) Accept(answer []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.offering {
+		return fmt.Errorf("no offer to accept an answer for")
+	}
+	p.offering, p.negotiated, p.remote = false, p.offered, p.parse(answer)
+	p.changed()
+	return nil
+}
+
+func (p *fakePeer) Rollback() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offering = false
+	return nil
+}
+
+func (p *fakePeer) state() (tracks, remote []string, offering bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tracks, p.remote, p.offering
+}
+
+// converged reports whether each side knows the tracks the other sends.
+func converged(a, b *fakePeer) bool {
+	aTracks, aRemote, aOffering := a.state()
+	bTracks, bRemote, bOffering := b.state()
+	return !aOffering && !bOffering && slices.Equal(aTracks, bRemote) && slices.Equal(bTracks, aRemote)
+}
+
+// callOverRelay connects a caller and a callee renegotiating through a
+// signaling room on a local relay.
+func callOverRelay(t *testing.T, ctx context.Context, port string) (caller, callee *fakePeer) {
+	go tcp.RunWithOptionsAsync("127.0.0.1", port, "pass123", tcp.WithStrictRoomNames(false), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	caller, callee = &fakePeer{}, &fakePeer{}
+	for _, side := range []struct {
+		peer   *fakePeer
+		polite bool
+	}{{caller, false}, {callee, true}} {
+		conn, _, _, err := tcp.ConnectToRoom("127.0.0.1:"+port, "pass123", tcp.RoomRequest{
+			Room: "renegotiate",
+			Mode: tcp.RoomModeSignal,
+		}, 5*time.Second)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { conn.Close() })
+		sc, err := newSignalCipher("1234-renegotiate")
+		assert.Nil(t, err)
+		side.peer.send = relaySignals(conn, sc)
+		r := newRenegotiator(ctx, side.peer, "call-1", side.polite, side.peer.send)
+		side.peer.onNeeded = r.negotiationNeeded
+		go func(conn *comm.Comm, peer *fakePeer) {
+			pumpSignals(conn, sc, r, peer.video.add, peer.caps.setPeer, func() { peer.recordingAcks.Add(1) })
+		}(conn, side.peer)
+	}
+	return
+}
+
+func TestRenegotiateOverRelay(t *testing.T) {
+	log.SetLevel("error")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caller, callee := callOverRelay(t, ctx, "8410")
+	isConverged := func() bool { return converged(caller, callee) }
+
+	// an audio call gains video from the caller, then screen share from
+	// the callee
+	caller.setTracks("audio", "video")
+	assert.Eventually(t, isConverged, 5*time.Second, 10*time.Millisecond)
+	callee.setTracks("audio", "screen")
+	assert.Eventually(t, isConverged, 5*time.Second, 10*time.Millisecond)
+	_, remote, _ := caller.state()
+	assert.Equal(t, []string{"audio", "screen"}, remote)
+
+	// both sides change tracks at once; the offers collide
+	for i := 0; i < 5; i++ {
+		caller.setTracks("audio", fmt.Sprintf("camera-%d", i))
+		callee.setTracks(fmt.Sprintf("camera-%d", i))
+		assert.Eventually(t, isConverged, 5*time.Second, 10*time.Millisecond, "round %d", i)
+	}
+	_, remote, _ = callee.state()
+	assert.Equal(t, []string{"audio", "camera-4"}, remote)
+
+	// the caller pausing its video reaches the callee, but not for
+	// another call
+	assert.Nil(t, caller.send(videoStateSignal("call-2", VideoEvent{Paused: true, Estimate: 90_000})))
+	assert.Nil(t, caller.send(videoStateSignal("call-1", VideoEvent{Paused: true, Estimate: 90_000})))
+	assert.Eventually(t, func() bool { return len(callee.video.list()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	events := callee.video.list()
+	if assert.Len(t, events, 1) {
+		assert.True(t, events[0].Paused)
+		assert.True(t, events[0].Remote)
+		assert.Equal(t, int64(90_000), events[0].Estimate)
+	}
+
+	// so does the callee asking the caller to send less
+	assert.Nil(t, callee.send(bitrateCapSignal("call-1", 64_000)))
+	assert.Eventually(t, func() bool { return caller.caps.sendCap() == 64_000 }, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, callee.send(bitrateCapSignal("call-1", 0)))
+	assert.Eventually(t, func() bool { return caller.caps.sendCap() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// and the callee acknowledging a recording of this call, where a
+	// request from it is no acknowledgement
+	assert.Nil(t, callee.send(recordingSignal("call-1", recordingRequest, "")))
+	assert.Nil(t, callee.send(recordingSignal("call-2", recordingAck, "")))
+	assert.Nil(t, callee.send(recordingSignal("call-1", recordingAck, "")))
+	assert.Eventually(t, func() bool { return caller.recordingAcks.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), caller.recordingAcks.Load())
+}
+
+func TestRenegotiatorIgnoresStaleSignals(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan message.Message, 10)
+	peer := &fakePeer{}
+	r := newRenegotiator(ctx, peer, "call-1", true, func(m message.Message) error {
+		sent <- m
+		return nil
+	})
+	offer := message.Message{Type: typeRenegotiateOffer, ID: "call-1", Num: 1, Message: string(peer.describe("offer", []string{"video"}))}
+	assert.False(t, r.deliver(message.Message{Type: message.TypeWebRTCOffer, ID: "call-1"}))
+	assert.True(t, r.deliver(offer))
+	answer := <-sent
+	assert.Equal(t, typeRenegotiateAnswer, answer.Type)
+	assert.Equal(t, 1, answer.Num)
+
+	// a replayed offer and signals for another call are not answered
+	r.deliver(offer)
+	other := offer
+	other.ID, other.Num = "call-2", 2
+	r.deliver(other)
+	// an answer to an offer never made is not applied
+	r.deliver(message.Message{Type: typeRenegotiateAnswer, ID: "call-1", Num: 1, Message: string(peer.describe("answer", []string{"x"}))})
+	select {
+	case m := <-sent:
+		t.Fatalf("unexpected %s", m.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, remote, _ := peer.state()
+	assert.Equal(t, []string{"video"}, remote)
+}
+
+func TestRenegotiatorRollsBackUnanswered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peer := &fakePeer{}
+	r := &renegotiator{peer: peer, callID: "call-1", send: func(message.Message) error { return nil },
+		timeout: 50 * time.Millisecond, needed: make(chan struct{}, 1), incoming: make(chan message.Message), ctx: ctx}
+	go r.run()
+	peer.setTracks("video")
+	r.negotiationNeeded()
+	assert.Eventually(t, func() bool { _, _, offering := peer.state(); return offering }, time.Second, 5*time.Millisecond)
+	// the peer never answers, so the offer is dropped and the call goes on
+	assert.Eventually(t, func() bool { _, _, offering := peer.state(); return !offering }, time.Second, 5*time.Millisecond)
+}
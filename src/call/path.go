@@ -0,0 +1,123 @@
+package call
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ICE candidate types, as pion and the SDP name them.
+const (
+	candidateHost  = "host"
+	candidateSrflx = "srflx"
+	candidatePrflx = "prflx"
+	candidateRelay = "relay"
+)
+
+// Candidate is one end of the ICE candidate pair a call's media flows over.
+type Candidate struct {
+	// Type is host, srflx, prflx or relay.
+	Type     string
+	Protocol string
+	Address  string
+	Port     int
+	// RelatedAddress and RelatedPort are the local address behind a
+	// reflexive or relay candidate.
+	RelatedAddress string
+	RelatedPort    int
+}
+
+func (c Candidate) addr() string {
+	return net.JoinHostPort(c.Address, strconv.Itoa(c.Port))
+}
+
+// PathInfo describes the network path of a call's media, which never goes
+// through the croc relay: the relay only carries the signaling. Media is
+// direct unless ICE had to fall back to a TURN server.
+type PathInfo struct {
+	Local  Candidate
+	Remote Candidate
+}
+
+// Relayed reports whether media goes through a TURN server.
+func (p PathInfo) Relayed() bool {
+	return p.Local.Type == candidateRelay || p.Remote.Type == candidateRelay
+}
+
+// Kind names the least direct end of the pair: relay when a TURN server
+// is in the path, srflx or prflx when a NAT is, and host when the peers
+// reach each other on their own addresses.
+func (p PathInfo) Kind() string {
+	if p.Relayed() {
+		return candidateRelay
+	}
+	for _, t := range []string{candidateSrflx, candidatePrflx} {
+		if p.Local.Type == t || p.Remote.Type == t {
+			return t
+		}
+	}
+	return candidateHost
+}
+
+// Describe says in words how media travels.
+func (p PathInfo) Describe() string {
+	switch p.Kind() {
+	case candidateRelay:
+		turn := p.Local
+		if turn.Type != candidateRelay {
+			turn = p.Remote
+		}
+		return fmt.Sprintf("relayed through the TURN server at %s", turn.addr())
+	case candidateHost:
+		return "direct on the local network"
+	default:
+		return "direct through NAT"
+	}
+}
+
+// String gives the description followed by both ends of the pair, with
+// the public address a NAT showed the other side where there is one.
+func (p PathInfo) String() string {
+	return fmt.Sprintf("%s (%s %s %s <-> %s %s)", p.Describe(),
+		p.Local.Type, p.Local.Protocol, p.Local.addr(), p.Remote.Type, p.Remote.addr())
+}
+
+// Warning is the notice to show when media is relayed, or empty.
+func (p PathInfo) Warning() string {
+	if !p.Relayed() {
+		return ""
+	}
+	return "WARNING: call media is " + p.Describe() + ", not peer to peer. " +
+		"It stays encrypted end to end, but the TURN server sees who is talking and adds latency."
+}
+
+// pathWatcher keeps the candidate pair ICE last selected; the selection can
+// change during a call.
+type pathWatcher struct {
+	mu   sync.Mutex
+	path PathInfo
+	ok   bool
+}
+
+func (w *pathWatcher) set(p PathInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.path, w.ok = p, true
+}
+
+// PathInfo returns the current path, and false if ICE has not selected one.
+func (w *pathWatcher) PathInfo() (PathInfo, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.path, w.ok
+}
+
+// summary is the path as it goes at the end of a call.
+func (w *pathWatcher) summary() string {
+	p, ok := w.PathInfo()
+	if !ok {
+		return "media path unknown"
+	}
+	return "media path: " + p.String()
+}
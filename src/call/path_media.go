@@ -0,0 +1,69 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+)
+
+// watchPath follows the candidate pair ICE selects for pc's media. Call it
+// before signaling so the first selection is not missed.
+func watchPath(pc *webrtc.PeerConnection) *pathWatcher {
+	w := &pathWatcher{}
+	pc.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(func(pair *webrtc.ICECandidatePair) {
+		p := pathFromPair(pair)
+		log.Debugf("selected candidate pair: %s", p)
+		w.set(p)
+	})
+	return w
+}
+
+// refreshPath asks ICE for the selected pair in case the change handler has
+// not run yet, and returns the current path.
+func refreshPath(pc *webrtc.PeerConnection, w *pathWatcher) (PathInfo, bool) {
+	if p, ok := w.PathInfo(); ok {
+		return p, true
+	}
+	pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return PathInfo{}, false
+	}
+	w.set(pathFromPair(pair))
+	return w.PathInfo()
+}
+
+func pathFromPair(pair *webrtc.ICECandidatePair) PathInfo {
+	return PathInfo{Local: candidateFrom(pair.Local), Remote: candidateFrom(pair.Remote)}
+}
+
+func candidateFrom(c *webrtc.ICECandidate) Candidate {
+	if c == nil {
+		return Candidate{}
+	}
+	return Candidate{
+		Type:           c.Typ.String(),
+		Protocol:       c.Protocol.String(),
+		Address:        c.Address,
+		Port:           int(c.Port),
+		RelatedAddress: c.RelatedAddress,
+		RelatedPort:    int(c.RelatedPort),
+	}
+}
+
+// reportPath prints how the call's media travels, warning on stderr when a
+// TURN server is in the path.
+func reportPath(pc *webrtc.PeerConnection, w *pathWatcher) {
+	p, ok := refreshPath(pc, w)
+	if !ok {
+		fmt.Println("Media path unknown.")
+		return
+	}
+	fmt.Printf("Media path: %s\n", p)
+	if warning := p.Warning(); warning != "" {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+}
@@ -0,0 +1,42 @@
+package call
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathInfo(t *testing.T) {
+	host := Candidate{Type: candidateHost, Protocol: "udp", Address: "192.168.1.2", Port: 50000}
+	lan := PathInfo{Local: host, Remote: Candidate{Type: candidateHost, Protocol: "udp", Address: "192.168.1.3", Port: 50001}}
+	assert.Equal(t, candidateHost, lan.Kind())
+	assert.False(t, lan.Relayed())
+	assert.Empty(t, lan.Warning())
+	assert.Equal(t, "direct on the local network (host udp 192.168.1.2:50000 <-> host 192.168.1.3:50001)", lan.String())
+
+	nat := PathInfo{Local: host, Remote: Candidate{Type: candidatePrflx, Protocol: "udp", Address: "203.0.113.7", Port: 4000}}
+	assert.Equal(t, candidatePrflx, nat.Kind())
+	assert.Equal(t, "direct through NAT", nat.Describe())
+
+	turn := PathInfo{Local: Candidate{Type: candidateRelay, Protocol: "udp", Address: "198.51.100.1", Port: 3478}, Remote: nat.Remote}
+	assert.Equal(t, candidateRelay, turn.Kind())
+	assert.True(t, turn.Relayed())
+	assert.Contains(t, turn.Describe(), "198.51.100.1:3478")
+	assert.Contains(t, turn.Warning(), "WARNING")
+
+	v6 := Candidate{Address: "2001:db8::1", Port: 9}
+	assert.Equal(t, "[2001:db8::1]:9", v6.addr())
+}
+
+func TestPathWatcher(t *testing.T) {
+	w := &pathWatcher{}
+	_, ok := w.PathInfo()
+	assert.False(t, ok)
+	assert.Equal(t, "media path unknown", w.summary())
+	p := PathInfo{Local: Candidate{Type: candidateHost, Protocol: "udp", Address: "10.0.0.1", Port: 1}, Remote: Candidate{Type: candidateSrflx, Address: "203.0.113.9", Port: 2}}
+	w.set(p)
+	got, ok := w.PathInfo()
+	assert.True(t, ok)
+	assert.Equal(t, p, got)
+	assert.Equal(t, "media path: "+p.String(), w.summary())
+}
@@ -0,0 +1,94 @@
+package call
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxPlaybackDelay is how much audio waits for the speaker at most. A
+// peer sending faster than the device plays would otherwise drift the
+// call further and further behind.
+const maxPlaybackDelay = 200 * time.Millisecond
+
+// playbackBuffer holds the audio waiting for the speaker: frames are
+// written as they are decoded and read as the device asks for them.
+// Beyond its size the oldest samples are dropped, and a read past what
+// is buffered is filled with silence.
+type playbackBuffer struct {
+	rate int
+
+	mu      sync.Mutex
+	samples []int16
+	// start is where the oldest buffered sample is, n how many there are.
+	start, n int
+	// drained is closed and replaced whenever a read empties the buffer.
+	drained chan struct{}
+	// dropped counts the samples overwritten and silent those made up.
+	dropped, silent int
+}
+
+func newPlaybackBuffer(rate int, size time.Duration) *playbackBuffer {
+	return &playbackBuffer{
+		rate:    rate,
+		samples: make([]int16, int(size*time.Duration(rate)/time.Second)),
+		drained: make(chan struct{}),
+	}
+}
+
+// WriteFrame queues the samples of f to be played.
+func (b *playbackBuffer) WriteFrame(f Frame) error {
+	if f.SampleRate != b.rate {
+		return fmt.Errorf("cannot play %d Hz audio on a %d Hz speaker", f.SampleRate, b.rate)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pcm := f.Samples
+	if over := len(pcm) - len(b.samples); over > 0 {
+		b.dropped += over
+		pcm = pcm[over:]
+	}
+	if over := b.n + len(pcm) - len(b.samples); over > 0 {
+		b.dropped += over
+		b.start = (b.start + over) % len(b.samples)
+		b.n -= over
+	}
+	end := (b.start + b.n) % len(b.samples)
+	copied := copy(b.samples[end:], pcm)
+	copy(b.samples, pcm[copied:])
+	b.n += len(pcm)
+	return nil
+}
+
+// read fills out with the oldest buffered samples, and with silence once
+// they run out.
+func (b *playbackBuffer) read(out []int16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := min(len(out), b.n)
+	copied := copy(out[:n], b.samples[b.start:])
+	copy(out[copied:n], b.samples)
+	clear(out[n:])
+	b.start = (b.start + n) % len(b.samples)
+	b.n -= n
+	b.silent += len(out) - n
+	if b.n == 0 {
+		close(b.drained)
+		b.drained = make(chan struct{})
+	}
+}
+
+// drain waits until what is buffered has been read, or for timeout.
+func (b *playbackBuffer) drain(timeout time.Duration) {
+	b.mu.Lock()
+	if b.n == 0 {
+		b.mu.Unlock()
+		return
+	}
+	drained := b.drained
+	b.mu.Unlock()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+	}
+}
@@ -0,0 +1,94 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/gen2brain/malgo"
+	"github.com/schollz/croc/v10/src/internal/opus"
+	log "github.com/schollz/logger"
+)
+
+var (
+	audioContextOnce sync.Once
+	audioContext     *malgo.AllocatedContext
+	errAudioContext  error
+)
+
+// speaker plays mono audio on the default output device of the machine.
+type speaker struct {
+	*playbackBuffer
+	device *malgo.Device
+	once   sync.Once
+}
+
+// openSpeaker starts the default output device playing the decoded audio
+// of a call.
+func openSpeaker() (*speaker, error) {
+	audioContextOnce.Do(func() {
+		audioContext, errAudioContext = malgo.InitContext(nil, malgo.ContextConfig{}, func(message string) {
+			log.Debugf("audio: %s", message)
+		})
+	})
+	if errAudioContext != nil {
+		return nil, errAudioContext
+	}
+	s := &speaker{playbackBuffer: newPlaybackBuffer(opus.SampleRate, maxPlaybackDelay)}
+	config := malgo.DefaultDeviceConfig(malgo.Playback)
+	config.Playback.Format = malgo.FormatS16
+	config.Playback.Channels = 1
+	config.SampleRate = opus.SampleRate
+	config.PerformanceProfile = malgo.LowLatency
+	var pcm []int16
+	device, err := malgo.InitDevice(audioContext.Context, config, malgo.DeviceCallbacks{
+		Data: func(out, _ []byte, frames uint32) {
+			if cap(pcm) < int(frames) {
+				pcm = make([]int16, frames)
+			}
+			pcm = pcm[:frames]
+			s.read(pcm)
+			for i, v := range pcm {
+				binary.NativeEndian.PutUint16(out[2*i:], uint16(v))
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = device.Start(); err != nil {
+		device.Uninit()
+		return nil, err
+	}
+	s.device = device
+	return s, nil
+}
+
+// Close lets what is buffered play out and releases the device.
+func (s *speaker) Close() error {
+	s.once.Do(func() {
+		s.drain(maxPlaybackDelay)
+		s.device.Uninit()
+		s.mu.Lock()
+		log.Debugf("speaker: %d samples dropped, %d of silence", s.dropped, s.silent)
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// withSpeaker returns d with the speaker of the machine playing the
+// peer's audio if d has no Speaker, and a func releasing it when the call
+// is over. Without an output device the audio is not played.
+func (d Devices) withSpeaker() (Devices, func()) {
+	if d.Speaker != nil {
+		return d, func() {}
+	}
+	s, err := openSpeaker()
+	if err != nil {
+		log.Warnf("not playing call audio: %v", err)
+		return d, func() {}
+	}
+	d.Speaker = s
+	return d, func() { s.Close() }
+}
@@ -0,0 +1,100 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/schollz/croc/v10/src/internal/opus"
+	"github.com/stretchr/testify/assert"
+)
+
+// packetTrack is a received track of packets read in order.
+type packetTrack struct {
+	packets []*rtp.Packet
+}
+
+func (t *packetTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	if len(t.packets) == 0 {
+		return nil, nil, io.EOF
+	}
+	p := t.packets[0]
+	t.packets = t.packets[1:]
+	return p, nil, nil
+}
+
+// played receives the packets with every fifth one lost and returns what
+// reached the speaker, and how many lost packets FEC recovered.
+func played(t *testing.T, packets [][]byte, fec bool) ([]int16, int) {
+	track := &packetTrack{}
+	for i, p := range packets {
+		if i%5 != 2 || i+1 == len(packets) {
+			track.packets = append(track.packets, &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(1000 + i)}, Payload: p})
+		}
+	}
+	speaker := newPlaybackBuffer(opus.SampleRate, 2*time.Second)
+	r := &audioReceiver{fec: fec, speaker: speaker}
+	r.run(track)
+	pcm := make([]int16, len(packets)*opus.SampleRate/50)
+	speaker.read(pcm)
+	assert.Zero(t, speaker.silent, "every frame, lost or not, is played")
+	return pcm, r.stats.Recovered
+}
+
+func TestAudioReceiverPlaysRecoveredAudio(t *testing.T) {
+	e, err := opus.NewEncoder(opus.SampleRate, 1, opus.Params{FEC: true, ExpectedLossPct: 20, Complexity: 10})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer e.Close()
+	const frame = opus.SampleRate / 50
+	var packets [][]byte
+	phase := 0.0
+	for f := 0; f < 50; f++ {
+		pcm := make([]int16, frame)
+		for i := range pcm {
+			n := float64(f*frame + i)
+			phase += 2 * math.Pi * (140 + 60*math.Sin(2*math.Pi*n/opus.SampleRate)) / opus.SampleRate
+			env := 0.6 + 0.4*math.Sin(2*math.Pi*3*n/opus.SampleRate)
+			pcm[i] = int16(6000 * env * (math.Sin(phase) + 0.5*math.Sin(2*phase) + 0.25*math.Sin(3*phase)))
+		}
+		p, err := e.Encode(pcm)
+		if !assert.Nil(t, err) {
+			return
+		}
+		packets = append(packets, append([]byte(nil), p...))
+	}
+
+	dec, err := opus.NewDecoder(opus.SampleRate, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer dec.Close()
+	var clean []int16
+	for _, p := range packets {
+		pcm, err := dec.Decode(p)
+		assert.Nil(t, err)
+		clean = append(clean, pcm...)
+	}
+	// the error of the frames played for the lost packets
+	lossError := func(pcm []int16) (total float64) {
+		for i := 2; i+1 < len(packets); i += 5 {
+			for j := i * frame; j < (i+1)*frame; j++ {
+				d := float64(pcm[j]) - float64(clean[j])
+				total += d * d
+			}
+		}
+		return
+	}
+
+	withFEC, recovered := played(t, packets, true)
+	assert.Equal(t, 10, recovered)
+	concealed, none := played(t, packets, false)
+	assert.Zero(t, none)
+	assert.Less(t, lossError(withFEC), lossError(concealed)*3/4, "the speaker plays the rebuilt frames")
+}
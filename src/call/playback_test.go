@@ -0,0 +1,51 @@
+package call
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlaybackBuffer(t *testing.T) {
+	// room for 8 samples
+	b := newPlaybackBuffer(1000, 8*time.Millisecond)
+	assert.Nil(t, b.WriteFrame(Frame{Samples: []int16{1, 2, 3, 4, 5}, SampleRate: 1000}))
+	out := make([]int16, 3)
+	b.read(out)
+	assert.Equal(t, []int16{1, 2, 3}, out)
+
+	// wraps around the end of the ring, dropping the oldest when full
+	assert.Nil(t, b.WriteFrame(Frame{Samples: []int16{6, 7, 8, 9, 10, 11, 12}, SampleRate: 1000}))
+	assert.Equal(t, 1, b.dropped)
+	out = make([]int16, 10)
+	b.read(out)
+	assert.Equal(t, []int16{5, 6, 7, 8, 9, 10, 11, 12, 0, 0}, out)
+	assert.Equal(t, 2, b.silent)
+
+	// a frame longer than the buffer keeps its end
+	assert.Nil(t, b.WriteFrame(Frame{Samples: []int16{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, SampleRate: 1000}))
+	out = make([]int16, 8)
+	b.read(out)
+	assert.Equal(t, []int16{3, 4, 5, 6, 7, 8, 9, 10}, out)
+
+	assert.NotNil(t, b.WriteFrame(Frame{Samples: []int16{1}, SampleRate: 48000}))
+}
+
+func TestPlaybackBufferDrain(t *testing.T) {
+	b := newPlaybackBuffer(1000, time.Second)
+	b.drain(time.Hour)
+	assert.Nil(t, b.WriteFrame(Frame{Samples: make([]int16, 10), SampleRate: 1000}))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.read(make([]int16, 4))
+		b.read(make([]int16, 6))
+	}()
+	start := time.Now()
+	b.drain(time.Hour)
+	assert.Less(t, time.Since(start), time.Minute)
+
+	// a device that stopped reading does not hold the call up
+	assert.Nil(t, b.WriteFrame(Frame{Samples: make([]int16, 10), SampleRate: 1000}))
+	b.drain(10 * time.Millisecond)
+}
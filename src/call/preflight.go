@@ -0,0 +1,416 @@
+package call
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+)
+
+// DefaultSTUNServers are the STUN servers Preflight asks when none are
+// given. Telling how a NAT maps takes two servers at different addresses.
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun1.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// errICETimeout is returned by calls whose peer could not be reached.
+var errICETimeout = errors.New("timed out waiting for ICE connection")
+
+// NATBehavior is how the NAT in front of this machine maps its sockets to
+// public addresses.
+type NATBehavior string
+
+const (
+	// NATUnknown means there were too few answers to tell.
+	NATUnknown NATBehavior = "unknown"
+	// NATNone means the machine has a public address of its own.
+	NATNone NATBehavior = "none"
+	// NATEndpointIndependent means a socket keeps its public address
+	// whoever it talks to, so peers can reach it at the address a STUN
+	// server saw.
+	NATEndpointIndependent NATBehavior = "endpoint-independent"
+	// NATEndpointDependent means a socket gets a new public address for
+	// every address or port it talks to, so the address a STUN server saw
+	// is of no use to a peer.
+	NATEndpointDependent NATBehavior = "address/port-dependent"
+)
+
+// Prediction is how Preflight expects a call to connect.
+type Prediction string
+
+const (
+	// PredictionDirect means media should flow straight to the peer.
+	PredictionDirect Prediction = "direct"
+	// PredictionTURN means media can only flow through a TURN server,
+	// unless the peer is reachable itself.
+	PredictionTURN Prediction = "turn"
+	// PredictionBlocked means UDP is blocked and no TURN server helped.
+	PredictionBlocked Prediction = "blocked"
+	// PredictionUnknown means there was too little to go on.
+	PredictionUnknown Prediction = "unknown"
+)
+
+// TURNServer is a TURN server and the long-term credentials for it.
+type TURNServer struct {
+	// Address is the host:port of the server.
+	Address  string
+	Username string
+	Password string
+}
+
+// PreflightOptions say what Preflight tries.
+type PreflightOptions struct {
+	// STUNServers are the host:port of the STUN servers every socket
+	// asks for its public address.
+	STUNServers []string
+	// TURN, if set, is a TURN server to allocate a relayed address on.
+	TURN *TURNServer
+	// Sockets is how many local sockets ask the STUN servers.
+	Sockets int
+	// Timeout bounds the wait for STUN answers and, separately, the TURN
+	// allocation.
+	Timeout time.Duration
+}
+
+// DefaultPreflightOptions are the options croc audio and croc video run
+// --preflight with.
+func DefaultPreflightOptions() PreflightOptions {
+	return PreflightOptions{STUNServers: DefaultSTUNServers, Sockets: 3, Timeout: 3 * time.Second}
+}
+
+// Validate reports whether the options are in range.
+func (o PreflightOptions) Validate() error {
+	var errs []error
+	if len(o.STUNServers) == 0 {
+		errs = append(errs, errors.New("preflight needs at least one STUN server"))
+	}
+	if o.Sockets < 1 || o.Sockets > 16 {
+		errs = append(errs, fmt.Errorf("preflight sockets must be between 1 and 16, not %d", o.Sockets))
+	}
+	if o.Timeout <= 0 {
+		errs = append(errs, errors.New("preflight timeout must be positive"))
+	}
+	if o.TURN != nil && o.TURN.Address == "" {
+		errs = append(errs, errors.New("a TURN server needs an address"))
+	}
+	return errors.Join(errs...)
+}
+
+// Binding is the public address a STUN server saw a local socket at.
+type Binding struct {
+	// Socket numbers the local socket, from 0.
+	Socket int
+	Local  string
+	Server string
+	Mapped string
+}
+
+// TURNResult is how allocating on the TURN server went.
+type TURNResult struct {
+	Server string
+	// Relayed is the address the server relays for this machine, if the
+	// allocation worked, and Error why it did not otherwise.
+	Relayed string
+	Error   string
+}
+
+// Report is what Preflight found out about the network.
+type Report struct {
+	Bindings []Binding
+	// Unanswered are the STUN servers no socket heard from.
+	Unanswered []string
+	// UDPBlocked is set when no STUN server answered at all.
+	UDPBlocked bool
+	NAT        NATBehavior
+	TURN       *TURNResult
+	Prediction Prediction
+}
+
+// Preflight checks how this machine can reach a peer: every socket asks
+// every STUN server for its public address, which tells whether UDP gets
+// out at all and how the NAT maps, and a TURN server, if given, is asked
+// for a relayed address. It fails only for options out of range; what
+// could not be reached is part of the report.
+func Preflight(opts PreflightOptions) (Report, error) {
+	if err := opts.Validate(); err != nil {
+		return Report{}, err
+	}
+	bindings, unanswered := probeSTUN(opts.STUNServers, opts.Sockets, opts.Timeout)
+	r := Report{Bindings: bindings, Unanswered: unanswered}
+	if opts.TURN != nil {
+		r.TURN = probeTURN(*opts.TURN, opts.Timeout)
+	}
+	r.UDPBlocked = len(bindings) == 0
+	r.NAT = classifyNAT(bindings, localIPs())
+	r.Prediction = predict(r)
+	return r, nil
+}
+
+// stunRequest is a binding request waiting for its answer.
+type stunRequest struct {
+	server string
+	sent   *stun.Message
+}
+
+// probeSTUN asks servers for the public address of sockets local sockets,
+// waiting up to timeout for the answers.
+func probeSTUN(servers []string, sockets int, timeout time.Duration) (bindings []Binding, unanswered []string) {
+	addrs := make(map[string]*net.UDPAddr)
+	for _, server := range servers {
+		// IPv4 only, as the NAT in question is the one of IPv4
+		if addr, err := net.ResolveUDPAddr("udp4", server); err == nil {
+			addrs[server] = addr
+		}
+	}
+	answered := make(map[string]bool)
+	for i := 0; i < sockets; i++ {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			continue
+		}
+		for _, b := range bindSocket(conn, servers, addrs, timeout) {
+			b.Socket = i
+			answered[b.Server] = true
+			bindings = append(bindings, b)
+		}
+		conn.Close()
+	}
+	for _, server := range servers {
+		if !answered[server] {
+			unanswered = append(unanswered, server)
+		}
+	}
+	return
+}
+
+// bindSocket sends a binding request to every server from conn and
+// collects the answers that come in within timeout.
+func bindSocket(conn *net.UDPConn, servers []string, addrs map[string]*net.UDPAddr, timeout time.Duration) (bindings []Binding) {
+	pending := make(map[[stun.TransactionIDSize]byte]stunRequest)
+	for _, server := range servers {
+		addr, ok := addrs[server]
+		if !ok {
+			continue
+		}
+		req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+		if err != nil {
+			continue
+		}
+		if _, err = conn.WriteToUDP(req.Raw, addr); err == nil {
+			pending[req.TransactionID] = stunRequest{server: server, sent: req}
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for len(pending) > 0 {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// out of time, or the socket was refused
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return
+			}
+			continue
+		}
+		res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if res.Decode() != nil || res.Type != stun.BindingSuccess {
+			continue
+		}
+		req, ok := pending[res.TransactionID]
+		if !ok {
+			continue
+		}
+		delete(pending, res.TransactionID)
+		var xor stun.XORMappedAddress
+		if err = xor.GetFrom(res); err != nil {
+			var mapped stun.MappedAddress
+			if mapped.GetFrom(res) != nil {
+				continue
+			}
+			xor.IP, xor.Port = mapped.IP, mapped.Port
+		}
+		bindings = append(bindings, Binding{Local: conn.LocalAddr().String(), Server: req.server, Mapped: xor.String()})
+	}
+	return
+}
+
+// probeTURN allocates a relayed address on server, giving up after
+// timeout.
+func probeTURN(server TURNServer, timeout time.Duration) *TURNResult {
+	result := &TURNResult{Server: server.Address}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: server.Address,
+		TURNServerAddr: server.Address,
+		Username:       server.Username,
+		Password:       server.Password,
+		Conn:           conn,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer client.Close()
+	if err = client.Listen(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	type allocation struct {
+		relayed net.PacketConn
+		err     error
+	}
+	done := make(chan allocation, 1)
+	go func() {
+		relayed, err := client.Allocate()
+		done <- allocation{relayed, err}
+	}()
+	select {
+	case a := <-done:
+		if a.err != nil {
+			result.Error = a.err.Error()
+			return result
+		}
+		result.Relayed = a.relayed.LocalAddr().String()
+		a.relayed.Close()
+	case <-time.After(timeout):
+		result.Error = "no answer"
+	}
+	return result
+}
+
+// localIPs returns the addresses of this machine's interfaces.
+func localIPs() (ips []string) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return
+}
+
+// classifyNAT tells the NAT behavior from bindings, for a machine whose
+// interfaces have local addresses. A socket that got different public
+// addresses from different servers is behind a NAT that maps by
+// destination; sockets seen at their own address are behind none.
+func classifyNAT(bindings []Binding, local []string) NATBehavior {
+	if len(bindings) == 0 {
+		return NATUnknown
+	}
+	public := true
+	mapped := make(map[int]map[string]bool)
+	servers := make(map[int]int)
+	for _, b := range bindings {
+		host, port, err := net.SplitHostPort(b.Mapped)
+		_, localPort, errLocal := net.SplitHostPort(b.Local)
+		if err != nil || errLocal != nil || port != localPort || !slices.Contains(local, host) {
+			public = false
+		}
+		if mapped[b.Socket] == nil {
+			mapped[b.Socket] = make(map[string]bool)
+		}
+		mapped[b.Socket][b.Mapped] = true
+		servers[b.Socket]++
+	}
+	if public {
+		return NATNone
+	}
+	compared := false
+	for socket, addrs := range mapped {
+		if len(addrs) > 1 {
+			return NATEndpointDependent
+		}
+		if servers[socket] > 1 {
+			compared = true
+		}
+	}
+	if !compared {
+		return NATUnknown
+	}
+	return NATEndpointIndependent
+}
+
+// predict tells how a call is expected to connect on the network of r.
+func predict(r Report) Prediction {
+	turnWorks := r.TURN != nil && r.TURN.Relayed != ""
+	switch {
+	case r.UDPBlocked && turnWorks:
+		return PredictionTURN
+	case r.UDPBlocked:
+		return PredictionBlocked
+	case r.NAT == NATNone || r.NAT == NATEndpointIndependent:
+		return PredictionDirect
+	case r.NAT == NATEndpointDependent:
+		return PredictionTURN
+	}
+	return PredictionUnknown
+}
+
+// Advice tells the user what the prediction of r means for a call.
+func (r Report) Advice() string {
+	switch r.Prediction {
+	case PredictionDirect:
+		return "A direct call should work; if it does not, the network of the peer is in the way."
+	case PredictionTURN:
+		if r.UDPBlocked {
+			return "UDP is blocked on this network, so calls can only go through the TURN server."
+		}
+		return "The NAT of this network gives every destination a new address, so a direct call only works if the peer's network is open; otherwise it needs a TURN server."
+	case PredictionBlocked:
+		return "UDP is blocked on this network, so calls cannot connect; try another network or a TURN server reachable from this one."
+	}
+	return "Too few STUN servers answered to tell whether a direct call will work."
+}
+
+// String renders r for the terminal, a fact a line.
+func (r Report) String() string {
+	var b strings.Builder
+	if r.UDPBlocked {
+		b.WriteString("UDP: blocked, no STUN server answered\n")
+	} else {
+		servers := len(r.Unanswered)
+		answered := make(map[string]bool)
+		public := make(map[string]bool)
+		var addrs []string
+		for _, binding := range r.Bindings {
+			answered[binding.Server] = true
+			if host, _, err := net.SplitHostPort(binding.Mapped); err == nil && !public[host] {
+				public[host] = true
+				addrs = append(addrs, host)
+			}
+		}
+		servers += len(answered)
+		fmt.Fprintf(&b, "UDP: open, %d of %d STUN servers answered\n", len(answered), servers)
+		fmt.Fprintf(&b, "Public address: %s\n", strings.Join(addrs, ", "))
+	}
+	fmt.Fprintf(&b, "NAT: %s\n", r.NAT)
+	if r.TURN != nil {
+		if r.TURN.Relayed != "" {
+			fmt.Fprintf(&b, "TURN %s: relays at %s\n", r.TURN.Server, r.TURN.Relayed)
+		} else {
+			fmt.Fprintf(&b, "TURN %s: failed: %s\n", r.TURN.Server, r.TURN.Error)
+		}
+	}
+	fmt.Fprintf(&b, "Prediction: %s. %s", r.Prediction, r.Advice())
+	return b.String()
+}
+
+// withPreflight adds the advice of report, if any, to err when it is about
+// the peer being out of reach.
+func withPreflight(err error, report *Report) error {
+	if report == nil || !errors.Is(err, errICETimeout) {
+		return err
+	}
+	return fmt.Errorf("%w\npreflight: NAT %s, %s", err, report.NAT, report.Advice())
+}
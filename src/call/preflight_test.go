@@ -0,0 +1,164 @@
+package call
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+	"github.com/pion/turn/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// stunServer answers binding requests on loopback with the address it saw,
+// its port moved by shift to play a NAT that maps by destination.
+func stunServer(t *testing.T, shift int) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if req.Decode() != nil {
+				continue
+			}
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port + shift}, stun.Fingerprint)
+			if err == nil {
+				conn.WriteToUDP(res.Raw, from)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestPreflightOptions(t *testing.T) {
+	assert.Nil(t, DefaultPreflightOptions().Validate())
+	assert.NotNil(t, PreflightOptions{Sockets: 1, Timeout: time.Second}.Validate())
+	assert.NotNil(t, PreflightOptions{STUNServers: DefaultSTUNServers, Sockets: 0, Timeout: time.Second}.Validate())
+	assert.NotNil(t, PreflightOptions{STUNServers: DefaultSTUNServers, Sockets: 1, Timeout: time.Second, TURN: &TURNServer{}}.Validate())
+	_, err := Preflight(PreflightOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestClassifyNAT(t *testing.T) {
+	local := []string{"192.168.1.5"}
+	b := func(socket int, server, localAddr, mapped string) Binding {
+		return Binding{Socket: socket, Server: server, Local: localAddr, Mapped: mapped}
+	}
+	for _, tc := range []struct {
+		name     string
+		bindings []Binding
+		want     NATBehavior
+	}{
+		{"nothing answered", nil, NATUnknown},
+		{"a public address", []Binding{b(0, "a", "0.0.0.0:4000", "192.168.1.5:4000"), b(0, "b", "0.0.0.0:4000", "192.168.1.5:4000")}, NATNone},
+		{"one address for every server", []Binding{
+			b(0, "a", "0.0.0.0:4000", "203.0.113.7:61000"), b(0, "b", "0.0.0.0:4000", "203.0.113.7:61000"),
+			b(1, "a", "0.0.0.0:4001", "203.0.113.7:61001"),
+		}, NATEndpointIndependent},
+		{"an address per server", []Binding{b(0, "a", "0.0.0.0:4000", "203.0.113.7:61000"), b(0, "b", "0.0.0.0:4000", "203.0.113.7:61007")}, NATEndpointDependent},
+		{"one server per socket", []Binding{b(0, "a", "0.0.0.0:4000", "203.0.113.7:61000"), b(1, "b", "0.0.0.0:4001", "203.0.113.7:61002")}, NATUnknown},
+	} {
+		assert.Equal(t, tc.want, classifyNAT(tc.bindings, local), tc.name)
+	}
+}
+
+func TestPredict(t *testing.T) {
+	relayed := &TURNResult{Server: "turn.example.com:3478", Relayed: "198.51.100.1:50000"}
+	failed := &TURNResult{Server: "turn.example.com:3478", Error: "no answer"}
+	for _, tc := range []struct {
+		report Report
+		want   Prediction
+	}{
+		{Report{NAT: NATNone}, PredictionDirect},
+		{Report{NAT: NATEndpointIndependent}, PredictionDirect},
+		{Report{NAT: NATEndpointDependent}, PredictionTURN},
+		{Report{NAT: NATUnknown}, PredictionUnknown},
+		{Report{UDPBlocked: true, NAT: NATUnknown}, PredictionBlocked},
+		{Report{UDPBlocked: true, NAT: NATUnknown, TURN: failed}, PredictionBlocked},
+		{Report{UDPBlocked: true, NAT: NATUnknown, TURN: relayed}, PredictionTURN},
+	} {
+		assert.Equal(t, tc.want, predict(tc.report), "%+v", tc.report)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	a, b := stunServer(t, 0), stunServer(t, 0)
+	r, err := Preflight(PreflightOptions{STUNServers: []string{a, b}, Sockets: 2, Timeout: time.Second})
+	assert.Nil(t, err)
+	assert.Len(t, r.Bindings, 4)
+	assert.Empty(t, r.Unanswered)
+	assert.False(t, r.UDPBlocked)
+	assert.Equal(t, NATNone, r.NAT, "loopback is nobody's NAT")
+	assert.Equal(t, PredictionDirect, r.Prediction)
+	assert.Contains(t, r.String(), "UDP: open, 2 of 2 STUN servers answered")
+
+	r, err = Preflight(PreflightOptions{STUNServers: []string{a, stunServer(t, 1)}, Sockets: 1, Timeout: time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, NATEndpointDependent, r.NAT)
+	assert.Equal(t, PredictionTURN, r.Prediction)
+}
+
+func TestPreflightBlocked(t *testing.T) {
+	// nobody listens there
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	silent := conn.LocalAddr().String()
+	conn.Close()
+	r, err := Preflight(PreflightOptions{STUNServers: []string{silent, "stun.invalid:3478"}, Sockets: 1, Timeout: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.True(t, r.UDPBlocked)
+	assert.Equal(t, []string{silent, "stun.invalid:3478"}, r.Unanswered)
+	assert.Equal(t, PredictionBlocked, r.Prediction)
+	assert.True(t, strings.HasPrefix(r.String(), "UDP: blocked"))
+}
+
+func TestPreflightTURN(t *testing.T) {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: "croc",
+		AuthHandler: func(username, realm string, _ net.Addr) ([]byte, bool) {
+			return turn.GenerateAuthKey(username, realm, "secret"), username == "alice"
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{RelayAddress: net.IPv4(127, 0, 0, 1), Address: "127.0.0.1"},
+		}},
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer server.Close()
+
+	result := probeTURN(TURNServer{Address: udp.LocalAddr().String(), Username: "alice", Password: "secret"}, 2*time.Second)
+	assert.Empty(t, result.Error)
+	assert.True(t, strings.HasPrefix(result.Relayed, "127.0.0.1:"), result.Relayed)
+	result = probeTURN(TURNServer{Address: udp.LocalAddr().String(), Username: "mallory", Password: "guess"}, 2*time.Second)
+	assert.Empty(t, result.Relayed)
+	assert.NotEmpty(t, result.Error)
+}
+
+func TestWithPreflight(t *testing.T) {
+	report := &Report{NAT: NATEndpointDependent, Prediction: PredictionTURN}
+	err := withPreflight(errICETimeout, report)
+	assert.ErrorIs(t, err, errICETimeout)
+	assert.Contains(t, err.Error(), "address/port-dependent")
+	assert.Contains(t, err.Error(), "TURN server")
+
+	other := errors.New("the peer declined")
+	assert.Equal(t, other, withPreflight(other, report))
+	assert.Equal(t, errICETimeout, withPreflight(errICETimeout, nil))
+}
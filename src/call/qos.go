@@ -0,0 +1,105 @@
+package call
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/comm"
+	log "github.com/schollz/logger"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DSCPExpedited is the Expedited Forwarding code point, which managed
+// networks commonly give priority for real-time media.
+const DSCPExpedited = 46
+
+// NetworkOptions mark the traffic of a call for networks that prioritize
+// by DSCP, and pin the UDP ports ICE uses so firewalls can be provisioned
+// for them. The zero value marks nothing and lets ICE use any port.
+type NetworkOptions struct {
+	// MediaDSCP marks the UDP sockets the media flows over, and
+	// SignalingDSCP the connection to the relay. Zero leaves the traffic
+	// unmarked.
+	MediaDSCP     int
+	SignalingDSCP int
+	// PortMin and PortMax bound the local UDP ports of ICE, inclusive.
+	// Both are zero for any port.
+	PortMin uint16
+	PortMax uint16
+}
+
+// Validate reports whether the options are in range.
+func (o NetworkOptions) Validate() error {
+	for _, dscp := range []int{o.MediaDSCP, o.SignalingDSCP} {
+		if dscp < 0 || dscp > 63 {
+			return fmt.Errorf("DSCP %d is not between 0 and 63", dscp)
+		}
+	}
+	if (o.PortMin == 0) != (o.PortMax == 0) || o.PortMin > o.PortMax {
+		return fmt.Errorf("ICE port range %d-%d needs both ends, the lower first", o.PortMin, o.PortMax)
+	}
+	return nil
+}
+
+// ParseDSCP parses a DSCP given as a number from 0 to 63 or by its name:
+// ef, cs0 to cs7, af11 to af43, or default.
+func ParseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case s == "" || s == "default":
+		return 0, nil
+	case s == "ef":
+		return DSCPExpedited, nil
+	case len(s) == 3 && strings.HasPrefix(s, "cs") && s[2] >= '0' && s[2] <= '7':
+		return int(s[2]-'0') * 8, nil
+	case len(s) == 4 && strings.HasPrefix(s, "af") && s[2] >= '1' && s[2] <= '4' && s[3] >= '1' && s[3] <= '3':
+		return int(s[2]-'0')*8 + int(s[3]-'0')*2, nil
+	}
+	dscp, err := strconv.Atoi(s)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("unknown DSCP %q, use a number from 0 to 63 or a name like ef or af41", s)
+	}
+	return dscp, nil
+}
+
+// markConn sets the DSCP of what c sends. Sockets bound to IPv6 take the
+// traffic class, and also the IPv4 TOS for the IPv4 traffic dual-stack
+// sockets carry, which not every system allows.
+func markConn(c net.Conn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	tos := dscp << 2
+	if isIPv4(c.LocalAddr()) {
+		return ipv4.NewConn(c).SetTOS(tos)
+	}
+	err := ipv6.NewConn(c).SetTrafficClass(tos)
+	_ = ipv4.NewConn(c).SetTOS(tos)
+	return err
+}
+
+func isIPv4(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	return ip.To4() != nil
+}
+
+// markSignaling sets the DSCP of the connection to the relay, logging when
+// the system refuses. Connections through a proxy cannot be marked, and
+// those carried by a croc.Session are not sockets of their own.
+func markSignaling(conn *comm.Comm, dscp int) {
+	if _, ok := conn.Connection().LocalAddr().(*net.TCPAddr); !ok {
+		return
+	}
+	if err := markConn(conn.Connection(), dscp); err != nil {
+		log.Warnf("could not mark signaling with DSCP %d: %v", dscp, err)
+	}
+}
@@ -0,0 +1,77 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pion/transport/v3"
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+)
+
+// settingEngine returns the setting engine of a call on the network o
+// describes: ICE bound to its port range and media sockets marked with
+// its DSCP.
+func settingEngine(o NetworkOptions) (s webrtc.SettingEngine, err error) {
+	if o.PortMin != 0 {
+		if err = s.SetEphemeralUDPPortRange(o.PortMin, o.PortMax); err != nil {
+			return
+		}
+	}
+	if o.MediaDSCP == 0 {
+		return
+	}
+	n, err := stdnet.NewNet()
+	if err != nil {
+		return
+	}
+	s.SetNet(&markedNet{Net: n, dscp: o.MediaDSCP})
+	return
+}
+
+// markedNet is the network of the host with every UDP socket marked with
+// dscp. The system refusing is logged once, and the socket used unmarked.
+type markedNet struct {
+	*stdnet.Net
+	dscp    int
+	refused sync.Once
+}
+
+func (n *markedNet) mark(c any) {
+	conn, ok := c.(net.Conn)
+	if !ok {
+		return
+	}
+	if err := markConn(conn, n.dscp); err != nil {
+		n.refused.Do(func() {
+			log.Warnf("could not mark media with DSCP %d: %v", n.dscp, err)
+		})
+	}
+}
+
+func (n *markedNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	c, err := n.Net.ListenPacket(network, address)
+	if err == nil {
+		n.mark(c)
+	}
+	return c, err
+}
+
+func (n *markedNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	c, err := n.Net.ListenUDP(network, locAddr)
+	if err == nil {
+		n.mark(c)
+	}
+	return c, err
+}
+
+func (n *markedNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	c, err := n.Net.DialUDP(network, laddr, raddr)
+	if err == nil {
+		n.mark(c)
+	}
+	return c, err
+}
@@ -0,0 +1,46 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICEPortRange(t *testing.T) {
+	o := NetworkOptions{MediaDSCP: DSCPExpedited, PortMin: 47300, PortMax: 47349}
+	s, err := settingEngine(o)
+	assert.Nil(t, err)
+	// the loopback interface is the one every machine has
+	s.SetIncludeLoopbackCandidate(true)
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(s)).NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer pc.Close()
+	_, err = pc.CreateDataChannel("ports", nil)
+	assert.Nil(t, err)
+
+	// the last candidate is nil
+	var candidates []webrtc.ICECandidate
+	gathered := make(chan struct{})
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			close(gathered)
+			return
+		}
+		candidates = append(candidates, *c)
+	})
+	offer, err := pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, pc.SetLocalDescription(offer))
+	<-gathered
+
+	assert.NotEmpty(t, candidates)
+	for _, c := range candidates {
+		assert.Equal(t, webrtc.ICECandidateTypeHost, c.Typ)
+		assert.GreaterOrEqual(t, c.Port, o.PortMin, c.String())
+		assert.LessOrEqual(t, c.Port, o.PortMax, c.String())
+	}
+}
@@ -0,0 +1,45 @@
+package call
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
+)
+
+func TestNetworkOptions(t *testing.T) {
+	assert.Nil(t, NetworkOptions{}.Validate())
+	assert.Nil(t, NetworkOptions{MediaDSCP: DSCPExpedited, SignalingDSCP: 34, PortMin: 50000, PortMax: 50100}.Validate())
+	assert.Nil(t, NetworkOptions{PortMin: 50000, PortMax: 50000}.Validate())
+	assert.NotNil(t, NetworkOptions{MediaDSCP: 64}.Validate())
+	assert.NotNil(t, NetworkOptions{SignalingDSCP: -1}.Validate())
+	assert.NotNil(t, NetworkOptions{PortMin: 50000}.Validate())
+	assert.NotNil(t, NetworkOptions{PortMax: 50000}.Validate())
+	assert.NotNil(t, NetworkOptions{PortMin: 50100, PortMax: 50000}.Validate())
+}
+
+func TestParseDSCP(t *testing.T) {
+	for s, want := range map[string]int{"": 0, "default": 0, "EF": 46, "cs0": 0, "cs5": 40, "af11": 10, "af41": 34, "af43": 38, "26": 26, "63": 63} {
+		dscp, err := ParseDSCP(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, dscp, s)
+	}
+	for _, s := range []string{"64", "-1", "cs8", "af44", "af51", "fast"} {
+		_, err := ParseDSCP(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestMarkConn(t *testing.T) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer c.Close()
+	if err = markConn(c, DSCPExpedited); err != nil {
+		t.Skipf("system refuses DSCP marking: %v", err)
+	}
+	tos, err := ipv4.NewConn(c).TOS()
+	assert.Nil(t, err)
+	assert.Equal(t, DSCPExpedited<<2, tos)
+	assert.Nil(t, markConn(c, 0))
+}
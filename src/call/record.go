@@ -0,0 +1,437 @@
+package call
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// typeRecording asks the peer to acknowledge that the call is recorded,
+// with Message recordingRequest, and acknowledges it, with recordingAck.
+// ID is the call id and Alias the name of the side sending it, if it has
+// one.
+const typeRecording = message.TypeWebRTCRecording
+
+const (
+	recordingRequest = "request"
+	recordingAck     = "ack"
+)
+
+// DefaultConsentTimeout is how long a recorded call waits for the peer to
+// acknowledge the recording.
+const DefaultConsentTimeout = 10 * time.Second
+
+// recordSampleRate is the sample rate of recordings, that of the audio
+// calls receive.
+const recordSampleRate = 48000
+
+// recordBuffer is how many frames of audio wait for a recording file that
+// does not keep up, five seconds of 20ms frames; newer frames are dropped
+// until it catches up, so the call never waits for the disk.
+const recordBuffer = 250
+
+// errNotRecorded is returned by OverrideRecordingConsent for calls that
+// were not asked to be recorded, and errConsentPending while the peer may
+// still acknowledge.
+var (
+	errNotRecorded    = errors.New("the call is not set to be recorded")
+	errConsentPending = errors.New("still waiting for the peer to acknowledge the recording")
+)
+
+// RecordOptions record the audio received from the peer to a file. The
+// peer is told first, and recording starts once it acknowledges.
+type RecordOptions struct {
+	// File is the WAV file to record to, replaced if it exists. Empty
+	// records nothing.
+	File string
+	// ConsentTimeout is how long to wait for the peer to acknowledge. A
+	// peer that does not, such as one on a version that cannot, is only
+	// recorded once OverrideRecordingConsent is called after that. Zero
+	// is DefaultConsentTimeout.
+	ConsentTimeout time.Duration
+}
+
+// Validate reports whether the recording can be written where asked.
+func (o RecordOptions) Validate() error {
+	if o.ConsentTimeout < 0 {
+		return fmt.Errorf("record consent timeout %s is negative", o.ConsentTimeout)
+	}
+	if o.File == "" {
+		return nil
+	}
+	if info, err := os.Stat(filepath.Dir(o.File)); err != nil || !info.IsDir() {
+		return fmt.Errorf("cannot record to %s: its directory does not exist", o.File)
+	}
+	return nil
+}
+
+func (o RecordOptions) consentTimeout() time.Duration {
+	if o.ConsentTimeout == 0 {
+		return DefaultConsentTimeout
+	}
+	return o.ConsentTimeout
+}
+
+// recordingSignal asks the peer of the call with callID to acknowledge
+// the recording, or acknowledges it, as kind says, naming this side
+// alias.
+func recordingSignal(callID, kind, alias string) message.Message {
+	return message.Message{Type: typeRecording, ID: callID, Message: kind, Alias: alias}
+}
+
+// parseRecording returns what a recording signal of the call with callID
+// is, recordingRequest or recordingAck.
+func parseRecording(m message.Message, callID string) (string, bool) {
+	if m.Type != typeRecording || m.ID != callID || (m.Message != recordingRequest && m.Message != recordingAck) {
+		return "", false
+	}
+	return m.Message, true
+}
+
+// consentState is how far asking the peer to acknowledge a recording got.
+type consentState int
+
+const (
+	consentNone consentState = iota
+	consentAsked
+	consentAcked
+	consentTimedOut
+	consentOverridden
+)
+
+// recordingConsent is the consent of the peer to a recording: asked once,
+// then acknowledged by the peer or timed out, and overridden locally only
+// once it timed out. A late acknowledgement still counts. Recording may
+// start once it is acknowledged or overridden.
+type recordingConsent struct {
+	timeout time.Duration
+	state   consentState
+	asked   time.Time
+}
+
+// ask records asking the peer at now, and reports whether it was not
+// asked before.
+func (c *recordingConsent) ask(now time.Time) bool {
+	if c.state != consentNone {
+		return false
+	}
+	c.state, c.asked = consentAsked, now
+	return true
+}
+
+// ack records the peer acknowledging, and reports whether that lets
+// recording start.
+func (c *recordingConsent) ack() bool {
+	if c.state != consentAsked && c.state != consentTimedOut {
+		return false
+	}
+	c.state = consentAcked
+	return true
+}
+
+// expire reports whether the peer ran out of time to acknowledge at now,
+// the first time it did.
+func (c *recordingConsent) expire(now time.Time) bool {
+	if c.state != consentAsked || now.Sub(c.asked) < c.timeout {
+		return false
+	}
+	c.state = consentTimedOut
+	return true
+}
+
+// override records recording without the peer's acknowledgement, which
+// is only allowed once it timed out, and reports whether it was.
+func (c *recordingConsent) override() bool {
+	if c.state != consentTimedOut {
+		return false
+	}
+	c.state = consentOverridden
+	return true
+}
+
+// recording is the recording of a call, from asking the peer until the
+// call ends.
+type recording struct {
+	file    string
+	consent recordingConsent
+	timer   *time.Timer
+	// wav is set once recording started.
+	wav *wavWriter
+}
+
+// RecordingEvent is a step of the recording of a call, from asking the
+// peer to acknowledge it to the recording stopping.
+type RecordingEvent struct {
+	At   time.Time
+	Text string
+}
+
+func (e RecordingEvent) String() string {
+	return e.Text
+}
+
+// recordingLog records the steps of a call's recording.
+type recordingLog = eventLog[RecordingEvent]
+
+// recordingEvent records a step of the recording in the call summary and
+// on cs.
+func (cs *CallSession) recordingEvent(format string, args ...any) {
+	e := RecordingEvent{At: time.Now(), Text: fmt.Sprintf(format, args...)}
+	cs.mu.Lock()
+	record := cs.record
+	cs.mu.Unlock()
+	record.record(e.At, "%s", e.Text)
+	cs.recordings.add(e)
+}
+
+// askToRecord asks the peer to acknowledge that the call is recorded as
+// o says, naming this side alias, and records the call once it does.
+// Calls without a way to ask are not recorded.
+func (cs *CallSession) askToRecord(o RecordOptions, alias string) {
+	if o.File == "" {
+		return
+	}
+	cs.mu.Lock()
+	if cs.ended || cs.recording != nil || cs.askConsent == nil {
+		cs.mu.Unlock()
+		return
+	}
+	r := &recording{file: o.File, consent: recordingConsent{timeout: o.consentTimeout()}}
+	r.consent.ask(time.Now())
+	r.timer = time.AfterFunc(r.consent.timeout, func() { cs.consentTimedOut(time.Now()) })
+	cs.recording = r
+	ask := cs.askConsent
+	cs.mu.Unlock()
+	cs.recordingEvent("asked the peer to acknowledge recording to %s", o.File)
+	if err := ask(alias); err != nil {
+		cs.recordingEvent("could not ask the peer to acknowledge recording: %v", err)
+	}
+}
+
+// consentTimedOut notes the peer not acknowledging the recording by now.
+func (cs *CallSession) consentTimedOut(now time.Time) {
+	cs.mu.Lock()
+	r := cs.recording
+	expired := r != nil && !cs.ended && r.consent.expire(now)
+	cs.mu.Unlock()
+	if expired {
+		cs.recordingEvent("the peer did not acknowledge recording within %s, not recording", r.consent.timeout)
+	}
+}
+
+// recordingAcked starts the recording the peer acknowledged.
+func (cs *CallSession) recordingAcked() {
+	cs.mu.Lock()
+	r := cs.recording
+	if r == nil || cs.ended || !r.consent.ack() {
+		cs.mu.Unlock()
+		return
+	}
+	r.timer.Stop()
+	err := cs.startWAV(r)
+	cs.mu.Unlock()
+	if err != nil {
+		cs.recordingEvent("the peer acknowledged recording, but it could not start: %v", err)
+		return
+	}
+	cs.recordingEvent("the peer acknowledged recording, recording to %s", r.file)
+}
+
+// OverrideRecordingConsent starts recording a call whose peer did not
+// acknowledge the recording in time. It fails while the peer may still
+// acknowledge, and does nothing once recording started.
+func (cs *CallSession) OverrideRecordingConsent() error {
+	cs.mu.Lock()
+	r := cs.recording
+	switch {
+	case r == nil || cs.ended:
+		cs.mu.Unlock()
+		return errNotRecorded
+	case r.consent.state == consentAsked:
+		cs.mu.Unlock()
+		return errConsentPending
+	case !r.consent.override():
+		cs.mu.Unlock()
+		return nil
+	}
+	err := cs.startWAV(r)
+	cs.mu.Unlock()
+	if err != nil {
+		cs.recordingEvent("recording without the peer's acknowledgement could not start: %v", err)
+		return err
+	}
+	cs.recordingEvent("recording to %s without the peer's acknowledgement, overridden locally", r.file)
+	return nil
+}
+
+// Recorded reports whether the call is set to be recorded, whether or not
+// recording started.
+func (cs *CallSession) Recorded() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.recording != nil
+}
+
+// OnRecordingEvent calls f with every step of the call's recording. f is
+// called from the goroutine that took the step.
+func (cs *CallSession) OnRecordingEvent(f func(RecordingEvent)) {
+	cs.recordings.setOnEvent(f)
+}
+
+// RecordingEvents returns the steps of the call's recording so far.
+func (cs *CallSession) RecordingEvents() []RecordingEvent {
+	return cs.recordings.list()
+}
+
+// startWAV starts writing the audio received from the peer to the file of
+// r. The caller holds cs.mu.
+func (cs *CallSession) startWAV(r *recording) (err error) {
+	if r.wav, err = createWAV(r.file); err != nil {
+		return err
+	}
+	tap := AudioTap(r.wav.tap)
+	cs.hooks.recorder.set(&tap)
+	return nil
+}
+
+// stopRecording stops the recording for good as the call ends.
+func (cs *CallSession) stopRecording() {
+	cs.mu.Lock()
+	r := cs.recording
+	if r == nil {
+		cs.mu.Unlock()
+		return
+	}
+	r.timer.Stop()
+	cs.hooks.recorder.set(nil)
+	state, wav := r.consent.state, r.wav
+	cs.mu.Unlock()
+	if wav == nil {
+		if state == consentAsked {
+			cs.recordingEvent("the call ended before the peer acknowledged recording, nothing was recorded")
+		} else {
+			cs.recordingEvent("recording was not overridden, nothing was recorded")
+		}
+		return
+	}
+	d, err := wav.close()
+	if err != nil {
+		cs.recordingEvent("recording to %s failed: %v", r.file, err)
+		return
+	}
+	cs.recordingEvent("recording stopped, %s written to %s", d.Round(time.Second), r.file)
+}
+
+// wavWriter writes received audio to a WAV file, as 16 bit mono at
+// recordSampleRate, from a goroutine of its own.
+type wavWriter struct {
+	f       *os.File
+	frames  chan []byte
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+	// written and err are what run wrote, once done is closed.
+	written int64
+	err     error
+}
+
+// createWAV creates file and writes received audio to it until close is
+// called.
+func createWAV(file string) (*wavWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not create recording: %w", err)
+	}
+	if _, err = f.Write(wavHeader(0)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not write recording: %w", err)
+	}
+	w := &wavWriter{f: f, frames: make(chan []byte, recordBuffer), stop: make(chan struct{}), done: make(chan struct{})}
+	go w.run()
+	return w, nil
+}
+
+// tap queues a frame of received audio for the file, mixed down to mono,
+// dropping it if writing is behind.
+func (w *wavWriter) tap(pcm []int16, sampleRate, channels int) {
+	select {
+	case w.frames <- monoLE(pcm, channels):
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *wavWriter) run() {
+	defer close(w.done)
+	bw := bufio.NewWriter(w.f)
+	write := func(b []byte) {
+		if w.err == nil {
+			var n int
+			n, w.err = bw.Write(b)
+			w.written += int64(n)
+		}
+	}
+	for {
+		select {
+		case b := <-w.frames:
+			write(b)
+		case <-w.stop:
+			for {
+				select {
+				case b := <-w.frames:
+					write(b)
+				default:
+					if w.err == nil {
+						w.err = bw.Flush()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes the audio still queued, completes the header of the file
+// and closes it, returning how much audio it holds.
+func (w *wavWriter) close() (time.Duration, error) {
+	close(w.stop)
+	<-w.done
+	if n := w.dropped.Load(); n > 0 {
+		log.Debugf("recording fell behind, %d frames were not recorded", n)
+	}
+	err := w.err
+	if err == nil {
+		_, err = w.f.WriteAt(wavHeader(w.written), 0)
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return time.Duration(w.written/2) * time.Second / recordSampleRate, err
+}
+
+// wavHeader returns the header of a WAV file holding size bytes of 16 bit
+// mono audio at recordSampleRate.
+func wavHeader(size int64) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 0, 44)
+	b = append(b, "RIFF"...)
+	b = le.AppendUint32(b, uint32(36+size))
+	b = append(b, "WAVEfmt "...)
+	b = le.AppendUint32(b, 16)
+	b = le.AppendUint16(b, 1) // PCM
+	b = le.AppendUint16(b, 1)
+	b = le.AppendUint32(b, recordSampleRate)
+	b = le.AppendUint32(b, recordSampleRate*2)
+	b = le.AppendUint16(b, 2)
+	b = le.AppendUint16(b, 16)
+	b = append(b, "data"...)
+	return le.AppendUint32(b, uint32(size))
+}
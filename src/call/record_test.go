@@ -0,0 +1,214 @@
+package call
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordOptionsValidate(t *testing.T) {
+	assert.Nil(t, RecordOptions{}.Validate())
+	assert.Nil(t, RecordOptions{File: filepath.Join(t.TempDir(), "call.wav"), ConsentTimeout: time.Second}.Validate())
+	assert.NotNil(t, RecordOptions{File: filepath.Join(t.TempDir(), "missing", "call.wav")}.Validate())
+	assert.NotNil(t, RecordOptions{ConsentTimeout: -time.Second}.Validate())
+	assert.Equal(t, DefaultConsentTimeout, RecordOptions{}.consentTimeout())
+}
+
+func TestRecordingSignal(t *testing.T) {
+	kind, ok := parseRecording(recordingSignal("call-1", recordingRequest, "alice"), "call-1")
+	assert.True(t, ok)
+	assert.Equal(t, recordingRequest, kind)
+	kind, ok = parseRecording(recordingSignal("call-1", recordingAck, ""), "call-1")
+	assert.True(t, ok)
+	assert.Equal(t, recordingAck, kind)
+	_, ok = parseRecording(recordingSignal("call-1", recordingAck, ""), "call-2")
+	assert.False(t, ok)
+	_, ok = parseRecording(message.Message{Type: typeRecording, ID: "call-1", Message: "maybe"}, "call-1")
+	assert.False(t, ok)
+	assert.True(t, protectedSignals[typeRecording])
+}
+
+func TestRecordingConsent(t *testing.T) {
+	now := time.Now()
+	c := recordingConsent{timeout: 10 * time.Second}
+	assert.False(t, c.ack(), "no acknowledgement before asking")
+	assert.False(t, c.expire(now))
+	assert.True(t, c.ask(now))
+	assert.False(t, c.ask(now), "asked once")
+	assert.False(t, c.override(), "no override before the timeout")
+	assert.False(t, c.expire(now.Add(9*time.Second)))
+	assert.True(t, c.ack())
+	assert.False(t, c.ack())
+	assert.False(t, c.expire(now.Add(time.Minute)), "acknowledged in time")
+	assert.False(t, c.override())
+
+	c = recordingConsent{timeout: 10 * time.Second}
+	c.ask(now)
+	assert.True(t, c.expire(now.Add(10*time.Second)))
+	assert.False(t, c.expire(now.Add(11*time.Second)), "times out once")
+	assert.True(t, c.override())
+	assert.False(t, c.override())
+	assert.False(t, c.ack(), "already recording")
+
+	// an acknowledgement after the timeout still counts
+	c = recordingConsent{timeout: 10 * time.Second}
+	c.ask(now)
+	c.expire(now.Add(time.Minute))
+	assert.True(t, c.ack())
+	assert.False(t, c.override())
+}
+
+// recordedCall returns a call that asks for consent to record to a file
+// in a temporary directory, with its summary and the requests it sends.
+func recordedCall(t *testing.T, askErr error) (cs *CallSession, file string, summary *bytes.Buffer, asked *[]string) {
+	t.Helper()
+	summary, asked = &bytes.Buffer{}, &[]string{}
+	cs = newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "direct" }, nil)
+	cs.askConsent = func(alias string) error {
+		*asked = append(*asked, alias)
+		return askErr
+	}
+	cs.startRecording(NewCallSummary(summary), CaptionOptions{})
+	file = filepath.Join(t.TempDir(), "call.wav")
+	// the timeout is taken by hand
+	cs.askToRecord(RecordOptions{File: file, ConsentTimeout: time.Hour}, "alice")
+	return
+}
+
+// summaryLines returns the lines of a call summary without their times.
+func summaryLines(summary *bytes.Buffer) (lines []string) {
+	for _, l := range strings.Split(strings.TrimSpace(summary.String()), "\n") {
+		_, text, _ := strings.Cut(l, " ")
+		lines = append(lines, text)
+	}
+	return
+}
+
+// wavSamples returns the samples of a WAV file written by wavWriter.
+func wavSamples(t *testing.T, file string) []int16 {
+	t.Helper()
+	b, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	if !assert.GreaterOrEqual(t, len(b), 44) {
+		return nil
+	}
+	assert.Equal(t, "RIFF", string(b[:4]))
+	assert.Equal(t, "WAVE", string(b[8:12]))
+	assert.Equal(t, uint32(len(b)-8), binary.LittleEndian.Uint32(b[4:]))
+	assert.Equal(t, uint32(recordSampleRate), binary.LittleEndian.Uint32(b[24:]))
+	assert.Equal(t, uint32(len(b)-44), binary.LittleEndian.Uint32(b[40:]))
+	samples := make([]int16, (len(b)-44)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(b[44+2*i:]))
+	}
+	return samples
+}
+
+func TestRecordingAcked(t *testing.T) {
+	cs, file, summary, asked := recordedCall(t, nil)
+	assert.Equal(t, []string{"alice"}, *asked)
+	assert.True(t, cs.Recorded())
+	// nothing is recorded until the peer acknowledges
+	cs.hooks.tapAudio([]int16{1, 2}, 48000, 1)
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	assert.ErrorIs(t, cs.OverrideRecordingConsent(), errConsentPending)
+
+	cs.recordingAcked()
+	cs.hooks.tapAudio([]int16{100, 200}, 48000, 2)
+	cs.hooks.tapAudio([]int16{-7}, 48000, 1)
+	// a timer that fires late changes nothing
+	cs.consentTimedOut(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, "direct", cs.Hangup())
+	assert.Equal(t, []int16{150, -7}, wavSamples(t, file))
+
+	assert.Equal(t, []string{
+		"audio call started",
+		"asked the peer to acknowledge recording to " + file,
+		"the peer acknowledged recording, recording to " + file,
+		"recording stopped, 0s written to " + file,
+		"audio call ended, direct",
+	}, summaryLines(summary))
+	assert.Len(t, cs.RecordingEvents(), 3)
+	// nothing starts after the call
+	cs.recordingAcked()
+	assert.Nil(t, cs.hooks.recorder.get())
+}
+
+func TestRecordingTimeoutOverride(t *testing.T) {
+	cs, file, summary, _ := recordedCall(t, errors.New("relay gone"))
+	var events []string
+	cs.OnRecordingEvent(func(e RecordingEvent) { events = append(events, e.String()) })
+	cs.consentTimedOut(time.Now().Add(time.Hour))
+	assert.Nil(t, cs.hooks.recorder.get(), "a timeout alone does not record")
+	assert.Nil(t, cs.OverrideRecordingConsent())
+	assert.Nil(t, cs.OverrideRecordingConsent(), "overriding twice is harmless")
+	cs.hooks.tapAudio([]int16{42}, 48000, 1)
+	// an acknowledgement after the override is no second recording
+	cs.recordingAcked()
+	cs.Hangup()
+	assert.Equal(t, []int16{42}, wavSamples(t, file))
+
+	assert.Equal(t, []string{
+		"audio call started",
+		"asked the peer to acknowledge recording to " + file,
+		"could not ask the peer to acknowledge recording: relay gone",
+		"the peer did not acknowledge recording within 1h0m0s, not recording",
+		"recording to " + file + " without the peer's acknowledgement, overridden locally",
+		"recording stopped, 0s written to " + file,
+		"audio call ended, direct",
+	}, summaryLines(summary))
+	assert.Equal(t, summaryLines(summary)[3:6], events)
+}
+
+func TestRecordingNeverAcked(t *testing.T) {
+	// the call ends while the peer may still acknowledge
+	cs, file, summary, _ := recordedCall(t, nil)
+	cs.Hangup()
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, summaryLines(summary), "the call ended before the peer acknowledged recording, nothing was recorded")
+
+	// the peer times out and the recording is not overridden
+	cs, file, summary, _ = recordedCall(t, nil)
+	cs.consentTimedOut(time.Now().Add(time.Hour))
+	cs.Hangup()
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	assert.Contains(t, summaryLines(summary), "recording was not overridden, nothing was recorded")
+	assert.ErrorIs(t, cs.OverrideRecordingConsent(), errNotRecorded)
+
+	// calls that are not recorded, or cannot ask, have nothing to override
+	plain := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "" }, nil)
+	plain.askToRecord(RecordOptions{File: file}, "")
+	assert.False(t, plain.Recorded())
+	assert.ErrorIs(t, plain.OverrideRecordingConsent(), errNotRecorded)
+	plain.Hangup()
+}
+
+func TestRecordingTimer(t *testing.T) {
+	cs := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "" }, nil)
+	cs.askConsent = func(string) error { return nil }
+	timedOut := make(chan RecordingEvent, 1)
+	cs.OnRecordingEvent(func(e RecordingEvent) {
+		if strings.Contains(e.Text, "did not acknowledge") {
+			timedOut <- e
+		}
+	})
+	cs.askToRecord(RecordOptions{File: filepath.Join(t.TempDir(), "call.wav"), ConsentTimeout: 20 * time.Millisecond}, "")
+	select {
+	case <-timedOut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the consent did not time out")
+	}
+	assert.Nil(t, cs.OverrideRecordingConsent())
+	cs.Hangup()
+}
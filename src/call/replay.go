@@ -0,0 +1,213 @@
+package call
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// replayWait is how long a replay waits for a local offer the transcript
+// says was made.
+const replayWait = time.Second
+
+// ReplayStep is what replaying one signal of a transcript did.
+type ReplayStep struct {
+	Entry SignalLogEntry
+	// Sent are the signals this side sent in response.
+	Sent []message.Message
+	// Err is the error the signal made this side fail with.
+	Err error
+}
+
+// ReplaySignaling drives the negotiation state machine from a transcript
+// written with --signal-log, as the side that wrote it, so a failed call
+// can be reproduced in a test without a network or devices. The side is
+// the caller if it sent the first invite and the callee if it received
+// it. There is a step for every received signal and for every
+// renegotiation offer the side made itself; the signals the transcript
+// says were sent in response can be compared with the Sent of the steps.
+// Peer connections are stood in for, so session descriptions, redacted
+// or not, are never parsed.
+func ReplaySignaling(file string) ([]ReplayStep, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := ReadSignalLog(f)
+	if err != nil {
+		return nil, err
+	}
+	// the transcript holds opened signals, which are sealed again for
+	// the answerer under a secret of the replay's own
+	sc, err := newSignalCipher("replay")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rp := &replay{ctx: ctx, peer: &replayPeer{}, a: &answerer{sc: sc}, offered: make(chan struct{}, 1)}
+	var steps []ReplayStep
+	for _, e := range entries {
+		step, ok := rp.step(e)
+		if ok {
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+// replay is the state of one side of a replayed call.
+type replay struct {
+	ctx  context.Context
+	peer *replayPeer
+	// caller is set once the first invite shows which side this is.
+	caller, callee bool
+	// invite is the id of the caller's invite.
+	invite string
+	a      *answerer
+	r      *renegotiator
+
+	mu   sync.Mutex
+	sent []message.Message
+	// offers is the number of the last renegotiation offer sent, and
+	// offered is signalled whenever it grows.
+	offers  int
+	offered chan struct{}
+}
+
+func (rp *replay) send(m message.Message) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.sent = append(rp.sent, m)
+	if m.Type == typeRenegotiateOffer {
+		rp.offers = m.Num
+		select {
+		case rp.offered <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// waitOffer waits until offer num has been sent.
+func (rp *replay) waitOffer(num int) error {
+	timeout := time.After(replayWait)
+	for {
+		rp.mu.Lock()
+		offers := rp.offers
+		rp.mu.Unlock()
+		if offers >= num {
+			return nil
+		}
+		select {
+		case <-rp.offered:
+		case <-timeout:
+			return fmt.Errorf("no offer %d was made", num)
+		}
+	}
+}
+
+// takeSent returns the signals sent since it was last called.
+func (rp *replay) takeSent() []message.Message {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	sent := rp.sent
+	rp.sent = nil
+	return sent
+}
+
+// flush returns once the renegotiator has handled every signal delivered
+// to it, by delivering an answer to no offer, which it ignores.
+func (rp *replay) flush() {
+	if rp.r != nil {
+		rp.r.deliver(message.Message{Type: typeRenegotiateAnswer, ID: rp.r.callID})
+	}
+}
+
+func (rp *replay) step(e SignalLogEntry) (step ReplayStep, ok bool) {
+	m := e.Signal
+	step.Entry = e
+	if e.Dir == signalSent {
+		switch {
+		case m.Type == message.TypeWebRTCOffer && !rp.callee:
+			rp.caller, rp.invite = true, m.ID
+		case m.Type == typeRenegotiateOffer && rp.r != nil:
+			rp.mu.Lock()
+			made := m.Num <= rp.offers
+			rp.mu.Unlock()
+			if made {
+				// the state machine offered again on its own, as after
+				// a collision
+				return step, false
+			}
+			rp.r.negotiationNeeded()
+			step.Err = rp.waitOffer(m.Num)
+			rp.flush()
+			step.Sent = rp.takeSent()
+			return step, true
+		}
+		return step, false
+	}
+
+	switch {
+	case isRenegotiation(m.Type):
+		if rp.r == nil {
+			step.Err = fmt.Errorf("%s signal before the call was set up", m.Type)
+			break
+		}
+		if rp.r.deliver(m) {
+			rp.flush()
+		}
+	case rp.caller:
+		answer, err := checkReply(m, rp.invite)
+		step.Err = err
+		if answer != nil && rp.r == nil {
+			rp.r = newRenegotiator(rp.ctx, rp.peer, rp.invite, false, rp.send)
+		}
+	case m.Type == message.TypeWebRTCOffer:
+		rp.callee = true
+		sealed, err := rp.a.sc.seal(m)
+		if err != nil {
+			step.Err = err
+			break
+		}
+		inv, _, accepted, reply, err := rp.a.handle(sealed)
+		step.Err = err
+		if reply != nil {
+			if decline, err := rp.a.sc.open(*reply); err == nil {
+				rp.send(decline)
+			}
+		}
+		if accepted {
+			rp.send(newAnswer(nil, inv.ID, inv.SignalingVersion))
+			rp.r = newRenegotiator(rp.ctx, rp.peer, inv.ID, true, rp.send)
+		}
+	}
+	step.Sent = rp.takeSent()
+	return step, true
+}
+
+// replayPeer stands in for the peer connection of a replayed call,
+// accepting every description.
+type replayPeer struct{}
+
+func (p *replayPeer) Offer() ([]byte, error) {
+	return []byte(`{"type":"offer","sdp":""}`), nil
+}
+
+func (p *replayPeer) Answer(offer []byte) ([]byte, error) {
+	return []byte(`{"type":"answer","sdp":""}`), nil
+}
+
+func (p *replayPeer) Accept(answer []byte) error {
+	return nil
+}
+
+func (p *replayPeer) Rollback() error {
+	return nil
+}
@@ -0,0 +1,321 @@
+package call
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
+)
+
+// MediaKind is what a call placed with Dial carries at first.
+type MediaKind string
+
+const (
+	MediaAudio MediaKind = "audio"
+	MediaVideo MediaKind = "video"
+)
+
+// CallOptions tune the media of a call placed with Dial. Audio applies to
+// audio calls and Video to video calls.
+type CallOptions struct {
+	Audio AudioOptions
+	Video VideoOptions
+	// Degrade pauses the video a video call sends while the network
+	// cannot carry it.
+	Degrade DegradeOptions
+	// Network marks the traffic of the call and pins its ports.
+	Network NetworkOptions
+	// ICE are the STUN and TURN servers of the call.
+	ICE ICEOptions
+	// SignalLog, if set, records the signaling of the call.
+	SignalLog *SignalLog
+	// Devices stand in for the microphone, camera and speaker of the
+	// machine.
+	Devices Devices
+	// WebRTC customizes the pion stack the call is built on.
+	WebRTC WebRTCOptions
+	// MaxSendBitrate caps what the call sends and MaxRecvBitrate what it
+	// asks the peer to send, in bits per second; zero leaves a direction
+	// uncapped.
+	MaxSendBitrate int64
+	MaxRecvBitrate int64
+	// Captions caption the audio received from the peer.
+	Captions CaptionOptions
+	// Record records the audio received from the peer, once the peer
+	// acknowledges it.
+	Record RecordOptions
+	// Summary, if set, records when the call started and ended, its
+	// captions and how the peer acknowledged its recording.
+	Summary *CallSummary
+	// Alias is the name the peer is given for this side, in what the call
+	// tells it, such as the camera stalling.
+	Alias string
+	// Preflight, if set, is the report of a Preflight run before the
+	// call, whose advice goes into the error of a call that cannot reach
+	// the peer.
+	Preflight *Report
+}
+
+// DefaultCallOptions are the options croc audio and croc video start from.
+func DefaultCallOptions() CallOptions {
+	return CallOptions{Audio: DefaultAudioOptions(), Video: DefaultVideoOptions(), Degrade: DefaultDegradeOptions()}
+}
+
+// Validate reports whether the options are in range.
+func (o CallOptions) Validate() error {
+	return errors.Join(o.Audio.Validate(), o.Video.Validate(), o.Degrade.Validate(), o.Network.Validate(), o.WebRTC.check(o.Network),
+		o.ICE.Validate(), checkBitrateCaps(o.MaxSendBitrate, o.MaxRecvBitrate), o.Captions.Validate(), o.Record.Validate())
+}
+
+// errNoVideo is returned by AddVideo for calls that cannot add video.
+var errNoVideo = errors.New("video cannot be added to this call")
+
+// CallSession is an established call. It lasts until Hangup is called or
+// the connection to the peer fails, whichever comes first; Done is closed
+// then.
+type CallSession struct {
+	kind     MediaKind
+	consumer *bandwidth.Consumer
+	// caps hold the call to the bitrate caps of both sides.
+	caps *bitrateCaps
+	// end closes the call and returns a summary of it, such as the path
+	// the media took. addVideo is nil for calls that cannot add video.
+	end      func() string
+	addVideo func() error
+	// hooks process the media of the call for the application.
+	hooks *mediaHooks
+	// notices say how the call fell short of what was asked for, such as
+	// the peer having no camera. They are set before the call is handed
+	// out.
+	notices []string
+
+	mu      sync.Mutex
+	once    sync.Once
+	done    chan struct{}
+	summary string
+	// video records the pauses and resumes of the call's video, capture
+	// the stalls of its camera and recordings the steps of its
+	// recording.
+	video      videoLog
+	capture    captureLog
+	recordings recordingLog
+	// record is where the call is summarized, and captioner runs the
+	// captions command of captionOptions while captions are on. ended is
+	// set once Hangup stopped them for good.
+	record         *CallSummary
+	captionOptions CaptionOptions
+	captioner      *captioner
+	onCaption      func(Caption)
+	ended          bool
+	// recording is the recording of the call, if it is recorded, and
+	// askConsent asks the peer to acknowledge it, naming this side; it
+	// is nil for calls that cannot.
+	recording  *recording
+	askConsent func(alias string) error
+}
+
+func newCallSession(kind MediaKind, consumer *bandwidth.Consumer, caps *bitrateCaps, hooks *mediaHooks, end func() string, addVideo func() error) *CallSession {
+	return &CallSession{kind: kind, consumer: consumer, caps: caps, hooks: hooks, end: end, addVideo: addVideo, done: make(chan struct{})}
+}
+
+// Kind returns what the call started with.
+func (cs *CallSession) Kind() MediaKind {
+	return cs.kind
+}
+
+// Notices say how the call fell short of what was asked for as it was set
+// up, for want of a device on either side.
+func (cs *CallSession) Notices() []string {
+	return cs.notices
+}
+
+// Done is closed once the call has ended.
+func (cs *CallSession) Done() <-chan struct{} {
+	return cs.done
+}
+
+// Hangup ends the call, if it has not ended yet, and returns a summary of
+// it.
+func (cs *CallSession) Hangup() string {
+	cs.once.Do(func() {
+		cs.stopCaptions()
+		cs.stopRecording()
+		cs.summary = cs.end()
+		if s := videoSummary(cs.video.list(), time.Now()); s != "" {
+			cs.summary += ", " + s
+		}
+		cs.mu.Lock()
+		record := cs.record
+		cs.mu.Unlock()
+		record.record(time.Now(), "%s call ended, %s", cs.kind, cs.summary)
+		close(cs.done)
+	})
+	return cs.summary
+}
+
+// OnVideoEvent calls f whenever video of the call pauses or resumes on
+// its own, this side's for a collapsing network or the peer's as it
+// reports. f is called from the goroutine watching the network.
+func (cs *CallSession) OnVideoEvent(f func(VideoEvent)) {
+	cs.video.setOnEvent(f)
+}
+
+// VideoEvents returns the pauses and resumes of the call's video so far.
+func (cs *CallSession) VideoEvents() []VideoEvent {
+	return cs.video.list()
+}
+
+// OnCaptureEvent calls f whenever the camera of the call stops producing
+// frames, or produces them again. f is called from the goroutine watching
+// the camera.
+func (cs *CallSession) OnCaptureEvent(f func(CaptureEvent)) {
+	cs.capture.setOnEvent(f)
+}
+
+// CaptureEvents returns the stalls and recoveries of the call's camera so
+// far.
+func (cs *CallSession) CaptureEvents() []CaptureEvent {
+	return cs.capture.list()
+}
+
+// AddVideo sends the camera too, turning an audio call into a video call.
+// It can be done once.
+func (cs *CallSession) AddVideo() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.addVideo == nil {
+		return errNoVideo
+	}
+	if err := cs.addVideo(); err != nil {
+		return err
+	}
+	cs.addVideo = nil
+	return nil
+}
+
+// Interact runs the call from the keyboard on r, as croc audio and croc
+// video do, until an empty line hangs up or the call ends on its own.
+func (cs *CallSession) Interact(r io.Reader) {
+	name := "Audio"
+	help := "Press Enter to end call, type v and Enter to add video, or + or - and Enter to raise or lower the bandwidth limit."
+	if cs.kind == MediaVideo {
+		name = "Video"
+		help = "Press Enter to end call, or type + or - and Enter to raise or lower the bandwidth limit."
+	}
+	toggleCaptions := func() {}
+	if cs.CanCaption() {
+		help += " Type c and Enter to turn captions off or on."
+		toggleCaptions = func() {
+			cs.SetCaptions(!cs.Captioning())
+			if cs.Captioning() {
+				fmt.Println("Captions on.")
+			} else {
+				fmt.Println("Captions off.")
+			}
+		}
+	}
+	overrideRecording := func() {}
+	if cs.Recorded() {
+		help += " Type r and Enter to record anyway if the peer does not acknowledge the recording."
+		overrideRecording = func() {
+			if err := cs.OverrideRecordingConsent(); err != nil {
+				fmt.Printf("Not recording: %v\n", err)
+			}
+		}
+	}
+	fmt.Printf("%s call established. %s\n", name, help)
+	for _, n := range cs.notices {
+		fmt.Println(n)
+	}
+	for _, e := range cs.RecordingEvents() {
+		fmt.Println(e)
+	}
+	if cs.caps.String() != "" {
+		fmt.Println(statsLine(cs.caps.share(cs.consumer.Share()), cs.caps))
+	}
+	cs.OnVideoEvent(func(e VideoEvent) { fmt.Println(e) })
+	cs.OnCaptureEvent(func(e CaptureEvent) { fmt.Println(e) })
+	cs.OnRecordingEvent(func(e RecordingEvent) { fmt.Println(e) })
+	cs.caps.setWarn(func(inbound, limit int64) { fmt.Println(capWarning(inbound, limit)) })
+	// captions go under the status lines as the peer speaks
+	cs.OnCaption(func(c Caption) { fmt.Printf("  > %s\n", c.Text) })
+	waitForHangup(r, cs.done, cs.consumer, cs.caps, cs.AddVideo, toggleCaptions, overrideRecording)
+	fmt.Printf("%s call ended, %s.\n", name, cs.Hangup())
+}
+
+// callWeight is a call's weight in the bandwidth budget; calls get the
+// larger share next to chat traffic since they cannot buffer.
+const callWeight = 8
+
+// defaultCallLimit is the budget the - key starts from when none is set.
+const defaultCallLimit = 2 * 1024 * 1024
+
+// waitForHangup blocks until an empty line is read from r or done is
+// closed. The + and - keys double or halve the process-wide bandwidth
+// budget, which shrinks or grows the call's target bitrate, and print it
+// with the caps in effect. The v key calls addVideo to turn the call into
+// a video call, the c key toggleCaptions and the r key
+// overrideRecording.
+func waitForHangup(r io.Reader, done <-chan struct{}, consumer *bandwidth.Consumer, caps *bitrateCaps, addVideo func() error, toggleCaptions, overrideRecording func()) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		var line string
+		select {
+		case <-done:
+			return
+		case l, ok := <-lines:
+			if !ok {
+				return
+			}
+			line = l
+		}
+		limit := bandwidth.Default.Limit()
+		switch strings.TrimSpace(line) {
+		case "":
+			return
+		case "v":
+			if err := addVideo(); errors.Is(err, errNoVideo) {
+				continue
+			} else if err != nil {
+				fmt.Printf("Could not add video: %v\n", err)
+			} else {
+				fmt.Println("Adding video to the call.")
+			}
+			continue
+		case "c":
+			toggleCaptions()
+			continue
+		case "r":
+			overrideRecording()
+			continue
+		case "+":
+			if limit > 0 {
+				bandwidth.Default.SetLimit(limit * 2)
+			}
+		case "-":
+			if limit <= 0 {
+				limit = defaultCallLimit * 2
+			}
+			bandwidth.Default.SetLimit(limit / 2)
+		default:
+			continue
+		}
+		fmt.Println(statsLine(caps.share(consumer.Share()), caps))
+	}
+}
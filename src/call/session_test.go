@@ -0,0 +1,84 @@
+package call
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallSessionHangup(t *testing.T) {
+	ends := 0
+	cs := newCallSession(MediaAudio, bandwidth.New(0).Register("test call", callWeight), nil, newMediaHooks(), func() string {
+		ends++
+		return "direct"
+	}, nil)
+	assert.Equal(t, MediaAudio, cs.Kind())
+	assert.Equal(t, "direct", cs.Hangup())
+	assert.Equal(t, "direct", cs.Hangup())
+	assert.Equal(t, 1, ends)
+	select {
+	case <-cs.Done():
+	default:
+		t.Fatal("Done is not closed after Hangup")
+	}
+	assert.ErrorIs(t, cs.AddVideo(), errNoVideo)
+}
+
+func TestCallSessionAddVideo(t *testing.T) {
+	added := 0
+	fail := errors.New("no camera")
+	cs := newCallSession(MediaAudio, nil, nil, newMediaHooks(), func() string { return "" }, func() error {
+		added++
+		if added == 1 {
+			return fail
+		}
+		return nil
+	})
+	assert.ErrorIs(t, cs.AddVideo(), fail, "a failed attempt can be retried")
+	assert.Nil(t, cs.AddVideo())
+	assert.ErrorIs(t, cs.AddVideo(), errNoVideo)
+	assert.Equal(t, 2, added)
+}
+
+func TestWaitForHangup(t *testing.T) {
+	consumer := bandwidth.New(0).Register("test call", callWeight)
+	noVideo := func() error { return errNoVideo }
+	toggles := 0
+	toggleCaptions := func() { toggles++ }
+
+	r, w := io.Pipe()
+	returned := make(chan struct{})
+	go func() {
+		waitForHangup(r, make(chan struct{}), consumer, newBitrateCaps(0, 0), noVideo, toggleCaptions, func() {})
+		close(returned)
+	}()
+	_, err := w.Write([]byte("v\nc\nc\n\n"))
+	assert.Nil(t, err)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("an empty line did not hang up")
+	}
+	w.Close()
+	assert.Equal(t, 2, toggles)
+
+	// the call ending on its own stops waiting on a quiet keyboard
+	r, w = io.Pipe()
+	defer w.Close()
+	done := make(chan struct{})
+	returned = make(chan struct{})
+	go func() {
+		waitForHangup(r, done, consumer, newBitrateCaps(0, 0), noVideo, toggleCaptions, func() {})
+		close(returned)
+	}()
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("waitForHangup did not return when the call ended")
+	}
+}
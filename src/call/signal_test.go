@@ -0,0 +1,79 @@
+package call
+
+import (
+	"testing"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignalCipher(t *testing.T) {
+	alice, err := newSignalCipher("1234-shared-secret")
+	assert.Nil(t, err)
+	bob, err := newSignalCipher("1234-shared-secret")
+	assert.Nil(t, err)
+
+	offer := message.Message{Type: message.TypeWebRTCOffer, Message: `{"type":"offer","sdp":"a=fingerprint:sha-256 AA:BB"}`}
+	sealed, err := alice.seal(offer)
+	assert.Nil(t, err)
+	assert.Equal(t, message.TypeWebRTCOffer, sealed.Type)
+	assert.Empty(t, sealed.Message)
+	assert.NotContains(t, string(sealed.Bytes), "fingerprint")
+
+	opened, err := bob.open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, offer, opened)
+
+	// unprotected types pass through untouched
+	chat := message.Message{Type: "chat", Message: "hi"}
+	sealedChat, err := alice.seal(chat)
+	assert.Nil(t, err)
+	assert.Equal(t, chat, sealedChat)
+}
+
+func TestSignalCipherRejectsTampering(t *testing.T) {
+	alice, _ := newSignalCipher("1234-shared-secret")
+	bob, _ := newSignalCipher("1234-shared-secret")
+	sealed, err := alice.seal(message.Message{Type: message.TypeWebRTCAnswer, Message: "sdp"})
+	assert.Nil(t, err)
+
+	// relay flips a bit in the ciphertext
+	modified := sealed
+	modified.Bytes = append([]byte{}, sealed.Bytes...)
+	modified.Bytes[len(modified.Bytes)-1] ^= 0x01
+	_, err = bob.open(modified)
+	assert.NotNil(t, err)
+
+	// relay swaps the salt
+	modified = sealed
+	modified.Bytes2 = make([]byte, len(sealed.Bytes2))
+	_, err = bob.open(modified)
+	assert.NotNil(t, err)
+
+	// relay relabels an answer as an offer
+	modified = sealed
+	modified.Type = message.TypeWebRTCOffer
+	_, err = bob.open(modified)
+	assert.NotNil(t, err)
+
+	// relay replaces the payload with its own plaintext
+	_, err = bob.open(message.Message{Type: message.TypeWebRTCAnswer, Message: "evil sdp"})
+	assert.NotNil(t, err)
+
+	// wrong secret
+	mallory, _ := newSignalCipher("9999-other-secret")
+	_, err = mallory.open(sealed)
+	assert.NotNil(t, err)
+}
+
+func TestSignalCipherNoSecret(t *testing.T) {
+	sc, err := newSignalCipher("")
+	assert.Nil(t, err)
+	m := message.Message{Type: message.TypeWebRTCCandidate, Message: "candidate"}
+	sealed, err := sc.seal(m)
+	assert.Nil(t, err)
+	assert.Equal(t, m, sealed)
+	opened, err := sc.open(sealed)
+	assert.Nil(t, err)
+	assert.Equal(t, m, opened)
+}
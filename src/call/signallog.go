@@ -0,0 +1,143 @@
+package call
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// Directions of a signal in a transcript.
+const (
+	signalSent     = "send"
+	signalReceived = "recv"
+)
+
+// redacted replaces credentials in a transcript.
+const redacted = "REDACTED"
+
+// redactedAttributes are the SDP attributes whose values would let anyone
+// holding a transcript impersonate a peer of the call.
+var redactedAttributes = []string{"a=ice-ufrag:", "a=ice-pwd:", "a=fingerprint:"}
+
+// candidateUfrag matches the ufrag extension of an ICE candidate.
+var candidateUfrag = regexp.MustCompile(`(?i)(\bufrag )\S+`)
+
+// SignalLogEntry is one signal in a transcript.
+type SignalLogEntry struct {
+	Time time.Time `json:"time"`
+	// Dir is "send" or "recv".
+	Dir    string          `json:"dir"`
+	Signal message.Message `json:"signal"`
+}
+
+// SignalLog appends every signal of a call, opened and with its
+// credentials redacted, to a transcript of JSON lines, so a failed call
+// can be looked into afterwards. A nil SignalLog records nothing.
+type SignalLog struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// OpenSignalLog appends to the transcript in file, creating it if needed.
+func OpenSignalLog(file string) (*SignalLog, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open signal log: %w", err)
+	}
+	return &SignalLog{w: f, c: f}, nil
+}
+
+// NewSignalLog writes a transcript to w.
+func NewSignalLog(w io.Writer) *SignalLog {
+	return &SignalLog{w: w}
+}
+
+// Close closes the file of a log opened with OpenSignalLog.
+func (l *SignalLog) Close() error {
+	if l == nil || l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
+
+func (l *SignalLog) record(dir string, m message.Message) {
+	if l == nil {
+		return
+	}
+	b, err := json.Marshal(SignalLogEntry{Time: time.Now(), Dir: dir, Signal: redactSignal(m)})
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
+
+// ReadSignalLog reads a transcript written by a SignalLog.
+func ReadSignalLog(r io.Reader) (entries []SignalLogEntry, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e SignalLogEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("signal log line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// redactSignal returns m with the ICE credentials and DTLS fingerprints of
+// its session description or candidate replaced.
+func redactSignal(m message.Message) message.Message {
+	var desc map[string]any
+	if err := json.Unmarshal([]byte(m.Message), &desc); err != nil || desc == nil {
+		m.Message = redactSDP(m.Message)
+		return m
+	}
+	for _, key := range []string{"sdp", "candidate"} {
+		if s, ok := desc[key].(string); ok {
+			desc[key] = redactSDP(s)
+		}
+	}
+	if _, ok := desc["usernameFragment"]; ok {
+		desc["usernameFragment"] = redacted
+	}
+	b, err := json.Marshal(desc)
+	if err != nil {
+		m.Message = redacted
+		return m
+	}
+	m.Message = string(b)
+	return m
+}
+
+// redactSDP replaces the values of the credential attributes of sdp,
+// keeping its line endings.
+func redactSDP(sdp string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	for i, line := range lines {
+		body := strings.TrimRight(line, "\r\n")
+		trimmed := strings.TrimLeft(body, " \t")
+		for _, attr := range redactedAttributes {
+			if len(trimmed) >= len(attr) && strings.EqualFold(trimmed[:len(attr)], attr) {
+				line = body[:len(body)-len(trimmed)] + trimmed[:len(attr)] + redacted + line[len(body):]
+				break
+			}
+		}
+		lines[i] = candidateUfrag.ReplaceAllString(line, "${1}"+redacted)
+	}
+	return strings.Join(lines, "")
+}
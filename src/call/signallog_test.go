@@ -0,0 +1,165 @@
+package call
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSDP = "v=0\r\n" +
+	"o=- 123 2 IN IP4 127.0.0.1\r\n" +
+	"a=fingerprint:sha-256 AA:BB:CC:DD\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"a=ice-ufrag:SecretUfrag\r\n" +
+	"a=ice-pwd:SecretPassword123\r\n" +
+	"  A=ICE-PWD:ShoutedPassword\r\n" +
+	"a=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host ufrag CandidateUfrag\r\n" +
+	"a=sendrecv\r\n"
+
+func TestRedactSignal(t *testing.T) {
+	desc, _ := json.Marshal(map[string]string{"type": "offer", "sdp": testSDP})
+	m := redactSignal(message.Message{Type: message.TypeWebRTCOffer, Message: string(desc), ID: "call-1"})
+	for _, secret := range []string{"SecretUfrag", "SecretPassword123", "ShoutedPassword", "AA:BB:CC:DD", "CandidateUfrag"} {
+		assert.NotContains(t, m.Message, secret)
+	}
+	assert.Equal(t, "call-1", m.ID)
+
+	var redactedDesc map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(m.Message), &redactedDesc))
+	sdp := redactedDesc["sdp"]
+	assert.Contains(t, sdp, "a=ice-ufrag:REDACTED\r\n")
+	assert.Contains(t, sdp, "a=ice-pwd:REDACTED\r\n")
+	assert.Contains(t, sdp, "  A=ICE-PWD:REDACTED\r\n")
+	assert.Contains(t, sdp, "a=fingerprint:REDACTED\r\n")
+	assert.Contains(t, sdp, "typ host ufrag REDACTED\r\n")
+	// everything else is kept as it was
+	assert.Contains(t, sdp, "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=ice-ufrag")
+	assert.Equal(t, strings.Count(testSDP, "\r\n"), strings.Count(sdp, "\r\n"))
+
+	// a trickled candidate
+	cand, _ := json.Marshal(map[string]any{
+		"candidate":        "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host ufrag Trickled",
+		"sdpMid":           "0",
+		"usernameFragment": "Trickled",
+	})
+	m = redactSignal(message.Message{Type: message.TypeWebRTCCandidate, Message: string(cand)})
+	assert.NotContains(t, m.Message, "Trickled")
+
+	// bare SDP outside a description
+	m = redactSignal(message.Message{Type: message.TypeWebRTCAnswer, Message: "a=ice-pwd:bare\na=fingerprint:sha-1 00"})
+	assert.Equal(t, "a=ice-pwd:REDACTED\na=fingerprint:REDACTED", m.Message)
+}
+
+func TestSignalLogRecordsOpenedSignals(t *testing.T) {
+	var buf bytes.Buffer
+	alice, err := newSignalCipher("1234-signal-log")
+	assert.Nil(t, err)
+	alice.log = NewSignalLog(&buf)
+	bob, err := newSignalCipher("1234-signal-log")
+	assert.Nil(t, err)
+	bob.log = NewSignalLog(&buf)
+
+	desc, _ := json.Marshal(map[string]string{"type": "offer", "sdp": testSDP})
+	invite, err := newInvite(desc, inviteBody{Directions: Directions{Audio: DirectionSendRecv}})
+	assert.Nil(t, err)
+	sealed, err := alice.seal(invite)
+	assert.Nil(t, err)
+	_, err = bob.open(sealed)
+	assert.Nil(t, err)
+	// a frame that fails to authenticate is not recorded
+	_, err = bob.open(message.Message{Type: message.TypeWebRTCAnswer, Message: "forged"})
+	assert.NotNil(t, err)
+
+	assert.NotContains(t, buf.String(), "SecretPassword123")
+	entries, err := ReadSignalLog(&buf)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "send", entries[0].Dir)
+		assert.Equal(t, "recv", entries[1].Dir)
+		assert.Equal(t, invite.ID, entries[1].Signal.ID)
+		assert.Contains(t, entries[1].Signal.Message, "ice-pwd:REDACTED")
+		assert.WithinDuration(t, time.Now(), entries[1].Time, time.Minute)
+	}
+}
+
+// writeTranscript writes entries to a transcript file.
+func writeTranscript(t *testing.T, entries ...SignalLogEntry) string {
+	file := filepath.Join(t.TempDir(), "signals.log")
+	l, err := OpenSignalLog(file)
+	assert.Nil(t, err)
+	for _, e := range entries {
+		l.record(e.Dir, e.Signal)
+	}
+	assert.Nil(t, l.Close())
+	return file
+}
+
+func TestReplaySignalingCallee(t *testing.T) {
+	invite, err := newInvite([]byte(`{"type":"offer","sdp":"v=0"}`), inviteBody{Directions: Directions{Audio: DirectionSendRecv}})
+	assert.Nil(t, err)
+	other, err := newInvite([]byte(`{"type":"offer","sdp":"v=0"}`), inviteBody{Directions: Directions{Audio: DirectionSendRecv}})
+	assert.Nil(t, err)
+	file := writeTranscript(t,
+		SignalLogEntry{Dir: "recv", Signal: invite},
+		SignalLogEntry{Dir: "send", Signal: newAnswer(nil, invite.ID, invite.SignalingVersion)},
+		// a second caller while the call is on
+		SignalLogEntry{Dir: "recv", Signal: other},
+		SignalLogEntry{Dir: "recv", Signal: message.Message{Type: typeRenegotiateOffer, ID: invite.ID, Num: 1, Message: `{"type":"offer"}`}},
+		SignalLogEntry{Dir: "send", Signal: message.Message{Type: typeRenegotiateOffer, ID: invite.ID, Num: 1, Message: `{"type":"offer"}`}},
+	)
+
+	steps, err := ReplaySignaling(file)
+	assert.Nil(t, err)
+	if !assert.Len(t, steps, 4) {
+		t.FailNow()
+	}
+	// the invite is answered
+	assert.Nil(t, steps[0].Err)
+	if assert.Len(t, steps[0].Sent, 1) {
+		assert.Equal(t, message.TypeWebRTCAnswer, steps[0].Sent[0].Type)
+		assert.Equal(t, invite.ID, steps[0].Sent[0].ID)
+	}
+	// the second caller is turned away
+	if assert.Len(t, steps[1].Sent, 1) {
+		assert.Equal(t, typeCallDeclined, steps[1].Sent[0].Type)
+		assert.Equal(t, declinedBusy, steps[1].Sent[0].Message)
+	}
+	// the caller's offer is answered
+	if assert.Len(t, steps[2].Sent, 1) {
+		assert.Equal(t, typeRenegotiateAnswer, steps[2].Sent[0].Type)
+		assert.Equal(t, 1, steps[2].Sent[0].Num)
+	}
+	// and this side's own offer is made again
+	assert.Nil(t, steps[3].Err)
+	if assert.Len(t, steps[3].Sent, 1) {
+		assert.Equal(t, typeRenegotiateOffer, steps[3].Sent[0].Type)
+	}
+}
+
+func TestReplaySignalingCaller(t *testing.T) {
+	invite, err := newInvite([]byte(`{"type":"offer","sdp":"v=0"}`), inviteBody{Directions: Directions{Video: DirectionRecvOnly}})
+	assert.Nil(t, err)
+	file := writeTranscript(t,
+		SignalLogEntry{Dir: "send", Signal: invite},
+		// a decline meant for another caller is ignored
+		SignalLogEntry{Dir: "recv", Signal: message.Message{Type: typeCallDeclined, ID: "someone-else", Message: declinedBusy}},
+		SignalLogEntry{Dir: "recv", Signal: message.Message{Type: typeCallDeclined, ID: invite.ID, Message: declinedPolicy}},
+	)
+	steps, err := ReplaySignaling(file)
+	assert.Nil(t, err)
+	if assert.Len(t, steps, 2) {
+		assert.Nil(t, steps[0].Err)
+		assert.True(t, errors.Is(steps[1].Err, ErrDeclined))
+	}
+
+	_, err = ReplaySignaling(filepath.Join(t.TempDir(), "missing.log"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
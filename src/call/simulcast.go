@@ -0,0 +1,107 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// simulcastLayer is one encoding of the camera a simulcast sender sends.
+type simulcastLayer struct {
+	// RID names the layer in the SDP and in RTP headers.
+	RID string
+	// ScaleDown divides the width and height of the camera.
+	ScaleDown int
+	// Bitrate is what the layer takes, in bits per second.
+	Bitrate int64
+}
+
+// simulcastLayers are the layers from the highest resolution down.
+var simulcastLayers = []simulcastLayer{
+	{RID: "f", ScaleDown: 1, Bitrate: 1_500_000},
+	{RID: "h", ScaleDown: 2, Bitrate: 500_000},
+	{RID: "q", ScaleDown: 4, Bitrate: 150_000},
+}
+
+// VideoOptions configure the video a call sends.
+type VideoOptions struct {
+	// Simulcast sends the camera as several layers of decreasing
+	// resolution, so a receiver on a weak link, or a relay forwarding to
+	// several, can take the layer it can carry. Experimental.
+	Simulcast bool
+	// SimulcastLayers is how many layers to send, 2 or 3.
+	SimulcastLayers int
+	// Fallback is what the call does when the peer has no camera; empty
+	// means FallbackRecvOnly.
+	Fallback VideoFallback
+	// StallTimeout is how long the camera may go without producing a
+	// frame once the call connects before the call reopens it; zero is
+	// DefaultStallTimeout and a negative timeout leaves the camera
+	// unwatched.
+	StallTimeout time.Duration
+}
+
+// DefaultVideoOptions sends a single stream, with three layers once
+// simulcast is turned on.
+func DefaultVideoOptions() VideoOptions {
+	return VideoOptions{SimulcastLayers: len(simulcastLayers)}
+}
+
+// Validate reports whether the options are in range.
+func (o VideoOptions) Validate() error {
+	if o.Simulcast && (o.SimulcastLayers < 2 || o.SimulcastLayers > len(simulcastLayers)) {
+		return fmt.Errorf("simulcast layers %d is not between 2 and %d", o.SimulcastLayers, len(simulcastLayers))
+	}
+	_, err := ParseVideoFallback(string(o.Fallback))
+	return err
+}
+
+// layers returns the simulcast layers to send, none without simulcast.
+func (o VideoOptions) layers() []simulcastLayer {
+	if !o.Simulcast {
+		return nil
+	}
+	return simulcastLayers[:o.SimulcastLayers]
+}
+
+// activeLayers returns which layers fit in share bytes per second, the
+// bandwidth the call is granted; zero means unlimited. Layers are dropped
+// from the highest resolution down, but the lowest is always sent.
+func activeLayers(layers []simulcastLayer, share int64) map[string]bool {
+	active := make(map[string]bool, len(layers))
+	budget := share * 8
+	for i := len(layers) - 1; i >= 0; i-- {
+		if share > 0 && layers[i].Bitrate > budget && len(active) > 0 {
+			break
+		}
+		active[layers[i].RID] = true
+		budget -= layers[i].Bitrate
+	}
+	return active
+}
+
+// simulcastRIDs returns the RIDs of the first video section of sdp, in the
+// order of its simulcast attribute, and whether they are sent or received.
+func simulcastRIDs(sdp string) (direction string, rids []string) {
+	inVideo := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			if inVideo {
+				break
+			}
+			inVideo = strings.HasPrefix(line, "m=video ")
+			continue
+		}
+		if !inVideo || !strings.HasPrefix(line, "a=simulcast:") {
+			continue
+		}
+		dir, list, _ := strings.Cut(strings.TrimPrefix(line, "a=simulcast:"), " ")
+		for _, rid := range strings.Split(list, ";") {
+			// paused layers are prefixed with ~
+			rids = append(rids, strings.TrimPrefix(rid, "~"))
+		}
+		return dir, rids
+	}
+	return "", nil
+}
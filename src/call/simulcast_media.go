@@ -0,0 +1,236 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/webrtc/v4"
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
+	log "github.com/schollz/logger"
+)
+
+// simulcastMTU bounds the RTP packets of each layer.
+const simulcastMTU = 1200
+
+// simulcastAdaptInterval is how often the layers sent are matched to the
+// bandwidth the call is granted.
+const simulcastAdaptInterval = 2 * time.Second
+
+// simulcastExtensions are the RTP header extensions that tell the layer of
+// each packet.
+var simulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// registerSimulcast registers the simulcast header extensions. Both sides
+// need them: without them the answer leaves simulcast out and only one
+// layer is received.
+func registerSimulcast(m *webrtc.MediaEngine) error {
+	for _, uri := range simulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return fmt.Errorf("failed to register %s: %v", uri, err)
+		}
+	}
+	return nil
+}
+
+// simulcastSender sends the camera as one track with an encoding per
+// layer. Layers that do not fit the call's bandwidth are paused: they are
+// still encoded but nothing is sent until they fit again.
+type simulcastSender struct {
+	layers []simulcastLayer
+	tracks []*webrtc.TrackLocalStaticRTP
+
+	mu     sync.Mutex
+	active map[string]bool
+	// resumed are the layers to send a key frame on, as the receiver has
+	// nothing to decode from after a pause.
+	resumed map[string]bool
+}
+
+// addSimulcastVideo adds a video transceiver with an encoding per layer to
+// pc, which puts the layers in the SDP as RIDs. The camera is attached
+// with start.
+func addSimulcastVideo(pc *webrtc.PeerConnection, dir Direction, layers []simulcastLayer) (*simulcastSender, error) {
+	s := &simulcastSender{layers: layers, resumed: make(map[string]bool)}
+	s.active = activeLayers(layers, 0)
+	for _, layer := range layers {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+			"video", "croc", webrtc.WithRTPStreamID(layer.RID))
+		if err != nil {
+			return nil, err
+		}
+		s.tracks = append(s.tracks, track)
+	}
+	transceiverDir := webrtc.RTPTransceiverDirectionSendrecv
+	if !dir.Receives() {
+		transceiverDir = webrtc.RTPTransceiverDirectionSendonly
+	}
+	transceiver, err := pc.AddTransceiverFromTrack(s.tracks[0], webrtc.RTPTransceiverInit{Direction: transceiverDir})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add video track: %v", err)
+	}
+	for _, track := range s.tracks[1:] {
+		if err = transceiver.Sender().AddEncoding(track); err != nil {
+			return nil, fmt.Errorf("failed to add simulcast layer %s: %v", track.RID(), err)
+		}
+	}
+	return s, nil
+}
+
+// start encodes camera into each layer, with the video encoders of codecs,
+// until ctx is done.
+func (s *simulcastSender) start(ctx context.Context, camera mediadevices.Track, codecs *mediadevices.CodecSelector) error {
+	cam, ok := camera.(*mediadevices.VideoTrack)
+	if !ok {
+		return fmt.Errorf("simulcast needs a video track")
+	}
+	for i, layer := range s.layers {
+		source := layerSource{Reader: scaleDown(layer.ScaleDown)(cam.NewReader(true)), id: camera.ID() + "-" + layer.RID}
+		reader, err := mediadevices.NewVideoTrack(source, codecs).NewRTPReader(webrtc.MimeTypeVP8, 0, simulcastMTU)
+		if err != nil {
+			return fmt.Errorf("failed to encode simulcast layer %s: %v", layer.RID, err)
+		}
+		go s.pump(ctx, layer.RID, reader, s.tracks[i])
+	}
+	return nil
+}
+
+// pump sends the packets of one layer while it is active.
+func (s *simulcastSender) pump(ctx context.Context, rid string, reader mediadevices.RTPReadCloser, track *webrtc.TrackLocalStaticRTP) {
+	defer reader.Close()
+	for ctx.Err() == nil {
+		pkts, release, err := reader.Read()
+		if err != nil {
+			log.Debugf("simulcast layer %s stopped: %v", rid, err)
+			return
+		}
+		send, keyFrame := s.sending(rid)
+		if keyFrame {
+			if kf, ok := reader.Controller().(codec.KeyFrameController); ok {
+				_ = kf.ForceKeyFrame()
+			}
+		}
+		if send {
+			for _, pkt := range pkts {
+				if err = track.WriteRTP(pkt); err != nil {
+					log.Debugf("simulcast layer %s: %v", rid, err)
+				}
+			}
+		}
+		release()
+	}
+}
+
+// sending reports whether a layer is sent, and whether it just resumed.
+func (s *simulcastSender) sending(rid string) (active, resumed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resumed = s.resumed[rid]
+	delete(s.resumed, rid)
+	return s.active[rid], resumed
+}
+
+// setActive pauses and resumes layers.
+func (s *simulcastSender) setActive(active map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rid := range active {
+		if !s.active[rid] {
+			s.resumed[rid] = true
+			log.Debugf("resuming simulcast layer %s", rid)
+		}
+	}
+	for rid := range s.active {
+		if !active[rid] {
+			log.Debugf("pausing simulcast layer %s", rid)
+		}
+	}
+	s.active = active
+}
+
+// adapt matches the layers sent to the share of consumer, held to the
+// send cap of caps, until ctx is done.
+func (s *simulcastSender) adapt(ctx context.Context, consumer *bandwidth.Consumer, caps *bitrateCaps) {
+	ticker := time.NewTicker(simulcastAdaptInterval)
+	defer ticker.Stop()
+	for {
+		s.setActive(activeLayers(s.layers, caps.share(consumer.Share())))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addSimulcast captures the camera and sends it on pc in layers, as many as
+// the share of consumer and the send cap of caps allow, until ctx is
+// done. The layers are scaled from the frames the video processor of
+// hooks returns. The Camera of devices stands in for the camera if set.
+func addSimulcast(ctx context.Context, pc *webrtc.PeerConnection, dir Direction, layers []simulcastLayer, consumer *bandwidth.Consumer, caps *bitrateCaps, hooks *mediaHooks, devices Devices) error {
+	s, err := addSimulcastVideo(pc, dir, layers)
+	if err != nil {
+		return err
+	}
+	// the layers are encoded here rather than by the track, which only
+	// knows a single encoding
+	tracks, err := captureTracks(webrtc.RTPCodecTypeVideo, nil, devices)
+	if err != nil {
+		return err
+	}
+	hooks.attach(tracks)
+	if err = s.start(ctx, tracks[0], mediadevices.NewCodecSelector()); err != nil {
+		return err
+	}
+	go s.adapt(ctx, consumer, caps)
+	return nil
+}
+
+// layerSource is the camera scaled down for one layer.
+type layerSource struct {
+	video.Reader
+	id string
+}
+
+func (l layerSource) ID() string   { return l.id }
+func (l layerSource) Close() error { return nil }
+
+// scaleDown divides the width and height of the frames by factor, sized
+// from the first frame.
+func scaleDown(factor int) video.TransformFunc {
+	return func(r video.Reader) video.Reader {
+		if factor <= 1 {
+			return r
+		}
+		var scaled video.Reader
+		return video.ReaderFunc(func() (image.Image, func(), error) {
+			if scaled == nil {
+				img, release, err := r.Read()
+				if err != nil {
+					return nil, func() {}, err
+				}
+				b := img.Bounds()
+				first := true
+				scaled = video.Scale(max(1, b.Dx()/factor), max(1, b.Dy()/factor), nil)(video.ReaderFunc(func() (image.Image, func(), error) {
+					if first {
+						first = false
+						return img, release, nil
+					}
+					return r.Read()
+				}))
+			}
+			return scaled.Read()
+		})
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulcastSDP(t *testing.T) {
+	for _, n := range []int{2, 3} {
+		layers := VideoOptions{Simulcast: true, SimulcastLayers: n}.layers()
+		m := webrtc.MediaEngine{}
+		assert.Nil(t, m.RegisterDefaultCodecs())
+		assert.Nil(t, registerSimulcast(&m))
+		caller, err := webrtc.NewAPI(webrtc.WithMediaEngine(&m)).NewPeerConnection(webrtc.Configuration{})
+		assert.Nil(t, err)
+		defer caller.Close()
+		_, err = addSimulcastVideo(caller, DirectionSendOnly, layers)
+		assert.Nil(t, err)
+
+		offer, err := caller.CreateOffer(nil)
+		assert.Nil(t, err)
+		var rids []string
+		for _, layer := range layers {
+			assert.Contains(t, offer.SDP, fmt.Sprintf("a=rid:%s send\r\n", layer.RID))
+			rids = append(rids, layer.RID)
+		}
+		dir, offered := simulcastRIDs(offer.SDP)
+		assert.Equal(t, "send", dir)
+		assert.Equal(t, rids, offered)
+		for _, uri := range simulcastExtensions {
+			assert.Contains(t, offer.SDP, uri)
+		}
+
+		// a callee takes every layer
+		api, _, _, err := newCallAPI(DefaultAudioOptions(), newBitrateCaps(0, 0), NetworkOptions{}, WebRTCOptions{})
+		assert.Nil(t, err)
+		callee, err := api.NewPeerConnection(webrtc.Configuration{})
+		assert.Nil(t, err)
+		defer callee.Close()
+		assert.Nil(t, caller.SetLocalDescription(offer))
+		assert.Nil(t, callee.SetRemoteDescription(offer))
+		answer, err := callee.CreateAnswer(nil)
+		assert.Nil(t, err)
+		for _, rid := range rids {
+			assert.Contains(t, answer.SDP, fmt.Sprintf("a=rid:%s recv\r\n", rid))
+		}
+		dir, answered := simulcastRIDs(answer.SDP)
+		assert.Equal(t, "recv", dir)
+		assert.Equal(t, rids, answered)
+		assert.Nil(t, caller.SetRemoteDescription(answer))
+	}
+
+	// without simulcast there is a single stream
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer pc.Close()
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	assert.Nil(t, err)
+	offer, err := pc.CreateOffer(nil)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(offer.SDP, "a=rid:"))
+}
@@ -0,0 +1,46 @@
+package call
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVideoOptions(t *testing.T) {
+	assert.Nil(t, DefaultVideoOptions().Validate())
+	assert.Nil(t, DefaultVideoOptions().layers())
+	o := VideoOptions{Simulcast: true, SimulcastLayers: 2}
+	assert.Nil(t, o.Validate())
+	assert.Equal(t, []simulcastLayer{simulcastLayers[0], simulcastLayers[1]}, o.layers())
+	for _, n := range []int{0, 1, 4} {
+		assert.NotNil(t, VideoOptions{Simulcast: true, SimulcastLayers: n}.Validate(), n)
+	}
+}
+
+func TestActiveLayers(t *testing.T) {
+	for _, tc := range []struct {
+		share int64
+		want  map[string]bool
+	}{
+		{0, map[string]bool{"f": true, "h": true, "q": true}},
+		{1_000_000, map[string]bool{"f": true, "h": true, "q": true}},
+		// 650 kbit/s carries the two lower layers
+		{650_000 / 8, map[string]bool{"h": true, "q": true}},
+		{200_000 / 8, map[string]bool{"q": true}},
+		// the lowest layer is sent however tight the budget
+		{1_000, map[string]bool{"q": true}},
+	} {
+		assert.Equal(t, tc.want, activeLayers(simulcastLayers, tc.share), "share %d", tc.share)
+	}
+}
+
+func TestSimulcastRIDs(t *testing.T) {
+	sdp := "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=simulcast:send x;y\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=rid:f send\r\na=rid:h send\r\na=simulcast:send f;~h\r\n"
+	dir, rids := simulcastRIDs(sdp)
+	assert.Equal(t, "send", dir)
+	assert.Equal(t, []string{"f", "h"}, rids)
+	dir, rids = simulcastRIDs("v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n")
+	assert.Empty(t, dir)
+	assert.Nil(t, rids)
+}
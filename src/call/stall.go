@@ -0,0 +1,134 @@
+package call
+
+import (
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeCaptureState tells the peer that the camera of this side stopped
+// producing frames, or produces them again. ID is the call id, Message
+// captureStalled or captureRecovered and Alias the name of this side, if
+// it has one.
+const typeCaptureState = message.TypeWebRTCCaptureState
+
+const (
+	captureStalled   = "stalled"
+	captureRecovered = "recovered"
+)
+
+// DefaultStallTimeout is how long the camera of a call may go without a
+// frame once the call connects before it is taken for stalled.
+const DefaultStallTimeout = 5 * time.Second
+
+// CaptureEvent is the camera of a call stalling, opened fine but
+// producing no frames as happens with some drivers, or producing frames
+// again.
+type CaptureEvent struct {
+	At      time.Time
+	Stalled bool
+	// Remote is set for the peer's camera, and Alias is then the name
+	// the peer goes by, if it gave one.
+	Remote bool
+	Alias  string
+}
+
+func (e CaptureEvent) String() string {
+	whose := "camera"
+	if e.Remote {
+		name := e.Alias
+		if name == "" {
+			name = "peer"
+		}
+		whose = name + "'s camera"
+	}
+	if e.Stalled {
+		return whose + " is not producing frames"
+	}
+	return whose + " is producing frames again"
+}
+
+// captureStateSignal tells the peer of the call with callID about e,
+// naming this side alias.
+func captureStateSignal(callID, alias string, e CaptureEvent) message.Message {
+	state := captureRecovered
+	if e.Stalled {
+		state = captureStalled
+	}
+	return message.Message{Type: typeCaptureState, ID: callID, Message: state, Alias: alias}
+}
+
+// parseCaptureState returns the event a capture state signal of the call
+// with callID reports about the peer's camera, received at now.
+func parseCaptureState(m message.Message, callID string, now time.Time) (CaptureEvent, bool) {
+	if m.Type != typeCaptureState || m.ID != callID || (m.Message != captureStalled && m.Message != captureRecovered) {
+		return CaptureEvent{}, false
+	}
+	return CaptureEvent{At: now, Stalled: m.Message == captureStalled, Remote: true, Alias: m.Alias}, true
+}
+
+// captureLog records the stalls and recoveries of a call's camera.
+type captureLog = eventLog[CaptureEvent]
+
+// stallWatch decides from the frames the camera captures when it has
+// stalled: no frame for timeout while the call is connected and its
+// video is not held, paused on purpose, as degradeVideo does.
+type stallWatch struct {
+	timeout time.Duration
+
+	mu sync.Mutex
+	// since is when the last frame was captured, or when watching started
+	// or the video was last resumed if that was later; zero until start.
+	since   time.Time
+	held    bool
+	stalled bool
+}
+
+// start starts watching at now, when the call connected. Later calls are
+// ignored.
+func (w *stallWatch) start(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() {
+		w.since = now
+	}
+}
+
+// frame records a frame captured at now and reports whether it ended a
+// stall.
+func (w *stallWatch) frame(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() {
+		return false
+	}
+	w.since = now
+	stalled := w.stalled
+	w.stalled = false
+	return stalled
+}
+
+// hold stops watching while held is set, as no frames are read from a
+// camera whose video is paused, and watches again from now once it is
+// cleared.
+func (w *stallWatch) hold(held bool, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.held = held
+	if !held && !w.since.IsZero() {
+		w.since = now
+	}
+}
+
+// check reports whether the camera stalled by now. A stall is reported
+// once, until a frame ends it.
+func (w *stallWatch) check(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.since.IsZero() || w.held || w.stalled || now.Sub(w.since) < w.timeout {
+		return false
+	}
+	w.stalled = true
+	return true
+}
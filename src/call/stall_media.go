@@ -0,0 +1,167 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+)
+
+// stallCheckInterval is how often a call checks whether its camera
+// stalled.
+const stallCheckInterval = time.Second
+
+// cameraWatch is the watchdog on the camera a call sends. The first time
+// the camera stalls it is closed and opened again, which gets some
+// drivers going; later stalls are only reported.
+type cameraWatch struct {
+	stallWatch
+	pc    *webrtc.PeerConnection
+	hooks *mediaHooks
+	// open captures the camera again, nil for sources standing in for it,
+	// which cannot be.
+	open func() ([]mediadevices.Track, error)
+
+	mu       sync.Mutex
+	track    mediadevices.Track
+	notify   func(CaptureEvent)
+	reopened bool
+}
+
+// newCameraWatch watches the video track among tracks, sent on pc, for
+// going timeout without a frame, zero being DefaultStallTimeout. It
+// returns nil, which watches nothing, for a negative timeout or tracks
+// without video. A reopened camera goes through the video processor of
+// hooks, and devices say whether a source stands in for the camera.
+func newCameraWatch(pc *webrtc.PeerConnection, tracks []mediadevices.Track, timeout time.Duration, hooks *mediaHooks, devices Devices) *cameraWatch {
+	if timeout < 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = DefaultStallTimeout
+	}
+	for _, track := range tracks {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		w := &cameraWatch{stallWatch: stallWatch{timeout: timeout}, pc: pc, hooks: hooks}
+		if devices.Camera == nil {
+			w.open = func() ([]mediadevices.Track, error) {
+				return captureTracks(webrtc.RTPCodecTypeVideo, nil, Devices{})
+			}
+		}
+		w.attach(track)
+		return w
+	}
+	return nil
+}
+
+// attach watches the frames track captures.
+func (w *cameraWatch) attach(track mediadevices.Track) {
+	w.track = track
+	t, ok := track.(*mediadevices.VideoTrack)
+	if !ok {
+		return
+	}
+	t.Transform(func(r video.Reader) video.Reader {
+		return video.ReaderFunc(func() (image.Image, func(), error) {
+			img, release, err := r.Read()
+			if err == nil {
+				if now := time.Now(); w.frame(now) {
+					log.Infof("camera is producing frames again")
+					w.mu.Lock()
+					notify := w.notify
+					w.mu.Unlock()
+					notify(CaptureEvent{At: now})
+				}
+			}
+			return img, release, err
+		})
+	})
+}
+
+// run watches the camera from now, as the call connected, until ctx is
+// done, telling notify of each stall and recovery.
+func (w *cameraWatch) run(ctx context.Context, notify func(CaptureEvent)) {
+	w.mu.Lock()
+	w.notify = notify
+	w.mu.Unlock()
+	w.start(time.Now())
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if !w.check(now) {
+			continue
+		}
+		log.Warnf("camera is not producing frames after %s", w.timeout)
+		notify(CaptureEvent{At: now, Stalled: true})
+		w.reopen()
+	}
+}
+
+// pause holds the watch while degradeVideo has the video paused, as
+// e says. It may be called on nil.
+func (w *cameraWatch) pause(e VideoEvent) {
+	if w == nil || e.Remote {
+		return
+	}
+	w.hold(e.Paused, e.At)
+}
+
+// reopen closes the camera and sends it anew, the first time it is
+// called.
+func (w *cameraWatch) reopen() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reopened || w.open == nil {
+		return
+	}
+	w.reopened = true
+	var sender *webrtc.RTPSender
+	for _, s := range w.pc.GetSenders() {
+		if s.Track() == w.track {
+			sender = s
+		}
+	}
+	if sender == nil {
+		return
+	}
+	// the device is released first, as it may not open twice
+	w.track.Close()
+	tracks, err := w.open()
+	if err != nil {
+		log.Warnf("could not reopen the camera: %v", err)
+		return
+	}
+	w.hooks.attach(tracks)
+	w.attach(tracks[0])
+	if err = sender.ReplaceTrack(tracks[0]); err != nil {
+		log.Warnf("could not send the reopened camera: %v", err)
+		return
+	}
+	log.Debugf("reopened the camera")
+}
+
+// close stops capturing the camera, releasing the device. It may be
+// called on nil.
+func (w *cameraWatch) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.track.Close()
+}
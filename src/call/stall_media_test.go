@@ -0,0 +1,112 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// stallingSource is a camera that opens fine but stops producing frames
+// after a few, as some drivers do.
+type stallingSource struct {
+	*colorSource
+	frames int
+}
+
+func newStallingSource(frames int) *stallingSource {
+	return &stallingSource{colorSource: newColorSource(color.RGBA{G: 255, A: 255}), frames: frames}
+}
+
+func (s *stallingSource) ReadImage() (image.Image, error) {
+	if s.frames == 0 {
+		<-s.closed
+		return nil, io.EOF
+	}
+	s.frames--
+	return s.colorSource.ReadImage()
+}
+
+// readFrames reads the frames of a video track, as the encoder of a call
+// does, until the track is closed.
+func readFrames(track mediadevices.Track) {
+	r := track.(*mediadevices.VideoTrack).NewReader(false)
+	go func() {
+		for {
+			if _, _, err := r.Read(); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestCameraWatch(t *testing.T) {
+	devices := Devices{Camera: newStallingSource(3)}
+	track, _, err := devices.track(webrtc.RTPCodecTypeVideo, nil)
+	assert.Nil(t, err)
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	assert.Nil(t, err)
+	defer pc.Close()
+	_, err = pc.AddTrack(track)
+	assert.Nil(t, err)
+
+	assert.Nil(t, newCameraWatch(pc, []mediadevices.Track{track}, -1, nil, devices))
+	w := newCameraWatch(pc, []mediadevices.Track{track}, 300*time.Millisecond, nil, devices)
+	defer w.close()
+	assert.Nil(t, w.open, "sources standing in for the camera are not reopened")
+	reopened := make(chan mediadevices.Track, 2)
+	w.open = func() ([]mediadevices.Track, error) {
+		// the camera comes back for a while, then stalls again
+		track, _, err := Devices{Camera: newStallingSource(10)}.track(webrtc.RTPCodecTypeVideo, nil)
+		if err != nil {
+			return nil, err
+		}
+		reopened <- track
+		return []mediadevices.Track{track}, nil
+	}
+	readFrames(track)
+
+	events := make(chan CaptureEvent, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the video is paused on purpose as the call connects
+	w.pause(VideoEvent{At: time.Now(), Paused: true})
+	go w.run(ctx, func(e CaptureEvent) { events <- e })
+	select {
+	case e := <-events:
+		t.Fatalf("%s while the video is paused", e)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	w.pause(VideoEvent{At: time.Now(), Paused: false})
+	next := func() CaptureEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("the camera was not reported")
+			return CaptureEvent{}
+		}
+	}
+	assert.True(t, next().Stalled)
+	select {
+	case track := <-reopened:
+		assert.Eventually(t, func() bool { return pc.GetSenders()[0].Track() == track }, time.Second, 10*time.Millisecond)
+		readFrames(track)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the camera was not reopened")
+	}
+	assert.False(t, next().Stalled, "the reopened camera produces frames")
+	// it is only reopened once
+	assert.True(t, next().Stalled)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, reopened)
+}
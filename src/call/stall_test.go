@@ -0,0 +1,57 @@
+package call
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStallWatch(t *testing.T) {
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	w := stallWatch{timeout: 5 * time.Second}
+
+	// nothing is watched before the call connects
+	assert.False(t, w.frame(at(0)))
+	assert.False(t, w.check(at(60)))
+
+	w.start(at(60))
+	assert.False(t, w.check(at(64)))
+	assert.True(t, w.check(at(65)))
+	// a stall is reported once
+	assert.False(t, w.check(at(70)))
+	assert.True(t, w.frame(at(71)))
+	assert.False(t, w.frame(at(72)))
+	assert.False(t, w.check(at(76)))
+	assert.True(t, w.check(at(77)))
+
+	// video paused on purpose captures nothing and is no stall
+	w.frame(at(80))
+	w.hold(true, at(81))
+	assert.False(t, w.check(at(120)))
+	// resuming gives the camera the whole timeout again
+	w.hold(false, at(120))
+	assert.False(t, w.check(at(124)))
+	assert.True(t, w.check(at(125)))
+}
+
+func TestCaptureState(t *testing.T) {
+	now := time.Now()
+	m := captureStateSignal("call-1", "alice", CaptureEvent{At: now, Stalled: true})
+	e, ok := parseCaptureState(m, "call-1", now)
+	assert.True(t, ok)
+	assert.Equal(t, CaptureEvent{At: now, Stalled: true, Remote: true, Alias: "alice"}, e)
+	assert.Equal(t, "alice's camera is not producing frames", e.String())
+
+	e, ok = parseCaptureState(captureStateSignal("call-1", "", CaptureEvent{}), "call-1", now)
+	assert.True(t, ok)
+	assert.Equal(t, "peer's camera is producing frames again", e.String())
+	assert.Equal(t, "camera is not producing frames", CaptureEvent{Stalled: true}.String())
+
+	_, ok = parseCaptureState(m, "call-2", now)
+	assert.False(t, ok)
+	m.Message = "sideways"
+	_, ok = parseCaptureState(m, "call-1", now)
+	assert.False(t, ok)
+}
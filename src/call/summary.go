@@ -0,0 +1,49 @@
+package call
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// CallSummary appends a line of text to a file for each start and end of
+// a call, with the summary Hangup returns, and for each caption of it,
+// each stamped with the time. A nil CallSummary records nothing.
+type CallSummary struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// OpenCallSummary appends to the summary in file, creating it if needed.
+func OpenCallSummary(file string) (*CallSummary, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open call summary: %w", err)
+	}
+	return &CallSummary{w: f, c: f}, nil
+}
+
+// NewCallSummary writes a summary to w.
+func NewCallSummary(w io.Writer) *CallSummary {
+	return &CallSummary{w: w}
+}
+
+// Close closes the file of a summary opened with OpenCallSummary.
+func (l *CallSummary) Close() error {
+	if l == nil || l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
+
+func (l *CallSummary) record(at time.Time, format string, args ...any) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%s %s\n", at.Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
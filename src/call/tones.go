@@ -0,0 +1,192 @@
+package call
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// Tones are synthesized at 48kHz in 20ms frames, like the call audio the
+// Speaker receives.
+const (
+	toneSampleRate = 48000
+	toneFrame      = toneSampleRate / 50
+	toneInterval   = 20 * time.Millisecond
+)
+
+// The ring-back tone is 440Hz and 480Hz together, on for 2s and off for
+// 4s, as phones ring back in North America.
+const (
+	ringOn     = 2 * toneSampleRate
+	ringPeriod = 6 * toneSampleRate
+	// toneLevel is the peak of each sine, well below full scale so the
+	// tones do not startle.
+	toneLevel = 0.1 * math.MaxInt16
+	// toneNote is how long each note of a cue lasts, and toneFade how long
+	// it fades in and out so it does not click.
+	toneNote = toneSampleRate * 120 / 1000
+	toneFade = toneSampleRate * 5 / 1000
+)
+
+// The connect chime rises and the disconnect tone falls, so the two are
+// told apart without looking.
+var (
+	connectChime   = notes(660, 880)
+	disconnectTone = notes(880, 660, 440)
+)
+
+// ringBack returns n samples of the ring-back tone, starting at sample at.
+func ringBack(at, n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		t := at + i
+		if t%ringPeriod >= ringOn {
+			continue
+		}
+		s := float64(t) / toneSampleRate
+		pcm[i] = int16(toneLevel * (math.Sin(2*math.Pi*440*s) + math.Sin(2*math.Pi*480*s)) / 2)
+	}
+	return pcm
+}
+
+// notes returns the sines of freqs, one note each, faded in and out.
+func notes(freqs ...float64) []int16 {
+	pcm := make([]int16, 0, len(freqs)*toneNote)
+	for _, f := range freqs {
+		for i := 0; i < toneNote; i++ {
+			fade := min(1, float64(min(i, toneNote-1-i))/toneFade)
+			pcm = append(pcm, int16(fade*toneLevel*math.Sin(2*math.Pi*f*float64(i)/toneSampleRate)))
+		}
+	}
+	return pcm
+}
+
+// tonePlayer stands in for the Speaker of a call while it is placed: it
+// plays the ring-back tone until the call connects, a chime when it does
+// and a disconnect tone when it ends or fails. Once the peer's audio
+// flows the player hands the speaker to it, mixing in what is left of a
+// cue, and stops writing frames of its own.
+type tonePlayer struct {
+	speaker Sink
+
+	mu      sync.Mutex
+	ringing bool
+	// rang is how many samples of the ring-back tone were played.
+	rang int
+	// cue is what is left of the chime or disconnect tone.
+	cue []int16
+	// chimed is set once the call connected, remote once the peer's audio
+	// flows, and ended once the call is over and only the disconnect tone
+	// is left to play.
+	chimed, remote, ended bool
+
+	done chan struct{}
+}
+
+// newTonePlayer starts ringing back on speaker, or returns nil when
+// there is no speaker to play on or tones are off.
+func newTonePlayer(speaker Sink, o AudioOptions) *tonePlayer {
+	if speaker == nil || o.NoTones {
+		return nil
+	}
+	p := &tonePlayer{speaker: speaker, ringing: true, done: make(chan struct{})}
+	go p.run(time.NewTicker(toneInterval))
+	return p
+}
+
+// run writes a frame of tones every tick until the call has ended and
+// the disconnect tone is played.
+func (p *tonePlayer) run(tick *time.Ticker) {
+	defer close(p.done)
+	defer tick.Stop()
+	for range tick.C {
+		if !p.play() {
+			return
+		}
+	}
+}
+
+// play writes the next frame of tones, if the peer's audio is not
+// playing, and reports whether there may be more.
+func (p *tonePlayer) play() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pcm := p.next()
+	if pcm == nil {
+		return !p.ended
+	}
+	if err := p.speaker.WriteFrame(Frame{Samples: pcm, SampleRate: toneSampleRate, Captured: time.Now()}); err != nil {
+		log.Debugf("dropping tone frame: %v", err)
+	}
+	return true
+}
+
+// next returns the next frame of tones, or nil if there is none to play.
+// The caller holds mu.
+func (p *tonePlayer) next() []int16 {
+	switch {
+	case p.remote && !p.ended:
+		return nil
+	case p.ringing:
+		pcm := ringBack(p.rang, toneFrame)
+		p.rang += toneFrame
+		return pcm
+	case len(p.cue) > 0:
+		pcm := make([]int16, toneFrame)
+		p.cue = p.cue[copy(pcm, p.cue):]
+		return pcm
+	}
+	return nil
+}
+
+// WriteFrame plays a frame of the peer's audio, which ends the ring-back
+// tone and takes over from the player. What is left of a cue is mixed
+// in. Frames that come after the call ended are dropped.
+func (p *tonePlayer) WriteFrame(f Frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ended {
+		return nil
+	}
+	p.ringing, p.remote = false, true
+	if len(p.cue) > 0 && f.SampleRate == toneSampleRate {
+		n := min(len(p.cue), len(f.Samples))
+		for i, s := range p.cue[:n] {
+			f.Samples[i] = int16(max(math.MinInt16, min(math.MaxInt16, int(f.Samples[i])+int(s))))
+		}
+		p.cue = p.cue[n:]
+	}
+	return p.speaker.WriteFrame(f)
+}
+
+// connected stops the ring-back tone and plays the connect chime, mixed
+// into the peer's audio if that beat it.
+func (p *tonePlayer) connected() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ended || p.chimed {
+		return
+	}
+	p.ringing, p.chimed = false, true
+	p.cue = connectChime
+}
+
+// end stops the ring-back tone and the peer's audio, plays the
+// disconnect tone and returns once it has played.
+func (p *tonePlayer) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if !p.ended {
+		p.ended, p.ringing = true, false
+		p.cue = disconnectTone
+	}
+	p.mu.Unlock()
+	<-p.done
+}
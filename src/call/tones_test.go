@@ -0,0 +1,106 @@
+package call
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// silent reports whether pcm holds nothing but silence.
+func silent(pcm []int16) bool {
+	return !slices.ContainsFunc(pcm, func(s int16) bool { return s != 0 })
+}
+
+func TestTones(t *testing.T) {
+	ring := ringBack(0, ringPeriod)
+	assert.False(t, silent(ring[:ringOn]))
+	assert.True(t, silent(ring[ringOn:]), "the ring-back tone pauses")
+	assert.Equal(t, ring[toneFrame:2*toneFrame], ringBack(toneFrame, toneFrame), "frames join up")
+	for _, cue := range [][]int16{connectChime, disconnectTone} {
+		assert.False(t, silent(cue))
+		assert.Equal(t, int16(0), cue[0], "fades in")
+		assert.Less(t, max(cue[len(cue)-1], -cue[len(cue)-1]), int16(100), "fades out")
+	}
+	assert.NotEqual(t, len(connectChime), len(disconnectTone))
+	assert.Nil(t, newTonePlayer(nil, AudioOptions{}), "nothing to play on")
+	assert.Nil(t, newTonePlayer(&recordSink{}, AudioOptions{NoTones: true}))
+}
+
+func TestTonePlayer(t *testing.T) {
+	speaker := &recordSink{}
+	p := &tonePlayer{speaker: speaker, ringing: true, done: make(chan struct{})}
+	assert.True(t, p.play())
+	assert.True(t, p.play())
+	if assert.Len(t, speaker.frames, 2) {
+		assert.Equal(t, ringBack(toneFrame, toneFrame), speaker.frames[1].Samples)
+		assert.Equal(t, toneSampleRate, speaker.frames[1].SampleRate)
+	}
+
+	// the call connects: the chime plays, then nothing
+	p.connected()
+	for len(p.cue) > 0 {
+		assert.True(t, p.play())
+	}
+	assert.Len(t, speaker.frames, 2+(len(connectChime)+toneFrame-1)/toneFrame)
+	n := len(speaker.frames)
+	assert.True(t, p.play(), "waits for the peer")
+	assert.Len(t, speaker.frames, n)
+
+	// the peer's audio takes over
+	assert.Nil(t, p.WriteFrame(Frame{Samples: []int16{7, 8}, SampleRate: toneSampleRate}))
+	assert.True(t, p.play())
+	assert.Equal(t, []int16{7, 8}, speaker.frames[n].Samples)
+	assert.Len(t, speaker.frames, n+1)
+
+	// hanging up drops the peer's audio and plays the disconnect tone
+	p.mu.Lock()
+	p.ended, p.cue = true, disconnectTone
+	p.mu.Unlock()
+	assert.Nil(t, p.WriteFrame(Frame{Samples: []int16{9}, SampleRate: toneSampleRate}))
+	for len(p.cue) > 0 {
+		assert.True(t, p.play())
+	}
+	assert.False(t, p.play(), "done once the tone played")
+	assert.Len(t, speaker.frames, n+1+(len(disconnectTone)+toneFrame-1)/toneFrame)
+	assert.Equal(t, disconnectTone[:toneFrame], speaker.frames[n+1].Samples)
+}
+
+func TestTonePlayerMixesCue(t *testing.T) {
+	speaker := &recordSink{}
+	p := &tonePlayer{speaker: speaker, ringing: true, done: make(chan struct{})}
+	// the peer's audio beats the connected state
+	assert.Nil(t, p.WriteFrame(Frame{Samples: make([]int16, toneFrame), SampleRate: toneSampleRate}))
+	p.connected()
+	p.connected()
+	assert.True(t, p.play())
+	assert.Len(t, speaker.frames, 1, "the chime is mixed into the peer's audio")
+	loud := make([]int16, toneFrame)
+	for i := range loud {
+		loud[i] = 32000
+	}
+	assert.Nil(t, p.WriteFrame(Frame{Samples: loud, SampleRate: toneSampleRate}))
+	for i, s := range speaker.frames[1].Samples {
+		assert.Equal(t, int16(min(32767, 32000+int(connectChime[i]))), s)
+	}
+}
+
+func TestTonePlayerEnd(t *testing.T) {
+	speaker := &recordSink{}
+	p := newTonePlayer(speaker, AudioOptions{})
+	done := make(chan struct{})
+	go func() {
+		p.end()
+		p.end()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the disconnect tone did not end")
+	}
+	var nilPlayer *tonePlayer
+	nilPlayer.connected()
+	nilPlayer.end()
+}
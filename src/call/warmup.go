@@ -0,0 +1,54 @@
+package call
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// firstMedia measures how long after a call connects its first media
+// packet arrives, which is what warming up the microphone cuts.
+type firstMedia struct {
+	mu               sync.Mutex
+	connected, first time.Time
+}
+
+// markConnected records when the call connected. Later calls are ignored.
+func (f *firstMedia) markConnected(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connected.IsZero() {
+		f.connected = t
+	}
+}
+
+// markPacket records when a media packet arrived. Only the first counts.
+func (f *firstMedia) markPacket(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.first.IsZero() {
+		f.first = t
+	}
+}
+
+// latency returns the time from connecting to the first packet, and false
+// until both have happened. A packet that beat the connected state, as
+// the two are seen on different goroutines, counts as no delay.
+func (f *firstMedia) latency() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connected.IsZero() || f.first.IsZero() {
+		return 0, false
+	}
+	return max(f.first.Sub(f.connected), 0), true
+}
+
+// summary describes the latency for the end of a call, or is empty if it
+// is not known.
+func (f *firstMedia) summary() string {
+	d, ok := f.latency()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("first audio %s after connecting", d.Round(time.Millisecond))
+}
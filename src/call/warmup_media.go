@@ -0,0 +1,94 @@
+//go:build !nomedia
+
+package call
+
+import (
+	"sync"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+)
+
+// warmCapture is a microphone kept running while a call rings. Its
+// encoded frames are read and thrown away, so the device and encoder are
+// past their start-up by the time the call connects; nothing is sent
+// until the peer connection binds the tracks, which it only does once the
+// call is accepted and DTLS is up.
+type warmCapture struct {
+	tracks  []mediadevices.Track
+	readers []mediadevices.EncodedReadCloser
+	once    sync.Once
+}
+
+// warmUp starts reading and discarding the Opus the audio tracks among
+// tracks encode. A track that cannot be read is left cold.
+func warmUp(tracks []mediadevices.Track) *warmCapture {
+	w := &warmCapture{tracks: tracks}
+	for _, track := range tracks {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		r, err := track.NewEncodedReader(webrtc.MimeTypeOpus)
+		if err != nil {
+			log.Debugf("not warming up %s: %v", track.ID(), err)
+			continue
+		}
+		w.readers = append(w.readers, r)
+		go func() {
+			for {
+				_, release, err := r.Read()
+				if err != nil {
+					return
+				}
+				release()
+			}
+		}()
+	}
+	return w
+}
+
+// warmAudio captures the microphone for an invite, encoding as set in
+// audio and held to the send cap of caps, and warms it up. The Microphone
+// of devices stands in for it if set. It returns nil if the microphone
+// cannot be captured; answering captures it again and reports the error
+// then.
+func warmAudio(audio AudioOptions, caps *bitrateCaps, devices Devices) *warmCapture {
+	codecs := mediadevices.NewCodecSelector(mediadevices.WithAudioEncoders(audio.encoder(caps)))
+	tracks, err := captureTracks(webrtc.RTPCodecTypeAudio, codecs, devices)
+	if err != nil {
+		log.Debugf("not warming up the microphone: %v", err)
+		return nil
+	}
+	return warmUp(tracks)
+}
+
+// stop stops discarding frames, leaving the tracks open for the call. It
+// may be called more than once, and on nil.
+func (w *warmCapture) stop() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		for _, r := range w.readers {
+			r.Close()
+		}
+	})
+}
+
+// release stops w and closes its tracks, giving up the microphone when
+// the call is not answered.
+func (w *warmCapture) release() {
+	if w == nil {
+		return
+	}
+	w.stop()
+	closeTracks(w.tracks)
+}
+
+// closeTracks stops capturing tracks, releasing their devices.
+func closeTracks(tracks []mediadevices.Track) {
+	for _, track := range tracks {
+		track.Close()
+	}
+}
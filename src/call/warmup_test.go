@@ -0,0 +1,35 @@
+package call
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirstMedia(t *testing.T) {
+	var f firstMedia
+	start := time.Now()
+	assert.Empty(t, f.summary())
+
+	f.markConnected(start)
+	_, ok := f.latency()
+	assert.False(t, ok)
+
+	f.markPacket(start.Add(42 * time.Millisecond))
+	// only the first of each counts
+	f.markConnected(start.Add(time.Second))
+	f.markPacket(start.Add(time.Second))
+	d, ok := f.latency()
+	assert.True(t, ok)
+	assert.Equal(t, 42*time.Millisecond, d)
+	assert.Equal(t, "first audio 42ms after connecting", f.summary())
+
+	// a packet seen just before the connected state is no delay
+	var early firstMedia
+	early.markPacket(start)
+	early.markConnected(start.Add(time.Millisecond))
+	d, ok = early.latency()
+	assert.True(t, ok)
+	assert.Zero(t, d)
+}
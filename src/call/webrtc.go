@@ -0,0 +1,111 @@
+package call
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Payload types croc's encoders stamp their packets with, which are the
+// ones RegisterDefaultCodecs gives Opus and H.264 in the profile openh264
+// encodes. A call has to negotiate them, as the encoders do not follow the
+// SDP.
+const (
+	opusPayloadType = 111
+	h264PayloadType = 106
+)
+
+// requiredCodecs are the codecs the media engine of a call must have for
+// each kind of media it carries. A zero payload type takes any.
+var requiredCodecs = map[webrtc.RTPCodecType][]webrtc.RTPCodecParameters{
+	webrtc.RTPCodecTypeAudio: {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: opusPayloadType},
+	},
+	webrtc.RTPCodecTypeVideo: {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: h264PayloadType},
+		// simulcast layers
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}},
+	},
+}
+
+// WebRTCOptions customize the pion stack a call is built on, for what the
+// other options do not expose: interceptors, network types, mDNS, or one
+// UDP port shared by every call.
+//
+// An API given here needs the codecs croc sends: Opus at payload type 111
+// for audio, and for video H.264 with profile-level-id=42e01f and
+// packetization-mode=1 at payload type 106 and VP8 at any.
+// RegisterDefaultCodecs registers all of them. The Opus format parameters
+// of AudioOptions, such as FEC, are only advertised by the engine croc
+// builds, and without croc's congestion control interceptor Degrade never
+// pauses the video.
+type WebRTCOptions struct {
+	// API, if set, makes the peer connection of each call instead of an
+	// API croc builds. Its setting engine takes the place of the ports and
+	// DSCP of NetworkOptions, which cannot be set with it.
+	API *webrtc.API
+	// SettingEngine, if set, adjusts the setting engine of the API croc
+	// builds, after NetworkOptions have been applied to it.
+	SettingEngine func(*webrtc.SettingEngine)
+}
+
+// check reports whether o can be used on network for calls carrying kinds,
+// which the API of o, if any, needs the codecs of.
+func (o WebRTCOptions) check(network NetworkOptions, kinds ...webrtc.RTPCodecType) error {
+	if o.API == nil {
+		return nil
+	}
+	if o.SettingEngine != nil {
+		return errors.New("a WebRTC API comes with its own setting engine")
+	}
+	if network.PortMin != 0 || network.MediaDSCP != 0 {
+		return errors.New("the ICE ports and media DSCP of a WebRTC API are set on its setting engine")
+	}
+	if len(kinds) == 0 {
+		return nil
+	}
+	// the peer connection gets a copy of the media engine, so looking
+	// changes nothing
+	pc, err := o.API.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	var missing []string
+	for _, kind := range kinds {
+		t, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			return err
+		}
+		have := t.Receiver().GetParameters().Codecs
+		for _, want := range requiredCodecs[kind] {
+			if !hasCodec(have, want) {
+				missing = append(missing, describeCodec(want))
+			}
+		}
+	}
+	if missing != nil {
+		return fmt.Errorf("the WebRTC API is missing %s, which RegisterDefaultCodecs registers", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func hasCodec(have []webrtc.RTPCodecParameters, want webrtc.RTPCodecParameters) bool {
+	for _, c := range have {
+		if strings.EqualFold(c.MimeType, want.MimeType) && c.ClockRate == want.ClockRate &&
+			(want.Channels == 0 || c.Channels == want.Channels) &&
+			(want.PayloadType == 0 || c.PayloadType == want.PayloadType) {
+			return true
+		}
+	}
+	return false
+}
+
+func describeCodec(c webrtc.RTPCodecParameters) string {
+	if c.PayloadType == 0 {
+		return c.MimeType
+	}
+	return fmt.Sprintf("%s at payload type %d", c.MimeType, c.PayloadType)
+}
@@ -0,0 +1,44 @@
+package call
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebRTCOptionsCheck(t *testing.T) {
+	both := []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+	assert.Nil(t, WebRTCOptions{}.check(NetworkOptions{PortMin: 5000, PortMax: 5010}, both...))
+	assert.Nil(t, WebRTCOptions{SettingEngine: func(*webrtc.SettingEngine) {}}.check(NetworkOptions{}, both...))
+
+	m := &webrtc.MediaEngine{}
+	assert.Nil(t, m.RegisterDefaultCodecs())
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	o := WebRTCOptions{API: api}
+	assert.Nil(t, o.check(NetworkOptions{SignalingDSCP: DSCPExpedited}, both...))
+	assert.Nil(t, o.check(NetworkOptions{}))
+	assert.NotNil(t, WebRTCOptions{API: api, SettingEngine: func(*webrtc.SettingEngine) {}}.check(NetworkOptions{}))
+	assert.NotNil(t, o.check(NetworkOptions{PortMin: 5000, PortMax: 5010}))
+	assert.NotNil(t, o.check(NetworkOptions{MediaDSCP: DSCPExpedited}))
+	// checking leaves the engine as it was
+	assert.Nil(t, o.check(NetworkOptions{}, both...))
+
+	// VP8 alone carries neither audio nor the video croc encodes
+	m = &webrtc.MediaEngine{}
+	assert.Nil(t, m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo))
+	o = WebRTCOptions{API: webrtc.NewAPI(webrtc.WithMediaEngine(m))}
+	assert.EqualError(t, o.check(NetworkOptions{}, both...),
+		"the WebRTC API is missing audio/opus at payload type 111, video/H264 at payload type 106, which RegisterDefaultCodecs registers")
+
+	// H.264 has to be where the encoder puts it
+	assert.Nil(t, m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		PayloadType:        102,
+	}, webrtc.RTPCodecTypeVideo))
+	o = WebRTCOptions{API: webrtc.NewAPI(webrtc.WithMediaEngine(m))}
+	assert.ErrorContains(t, o.check(NetworkOptions{}, webrtc.RTPCodecTypeVideo), "video/H264 at payload type 106")
+}
@@ -0,0 +1,536 @@
+package chat
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// typeChatArchive offers a directory sent with /sendfile. Its description,
+// an archiveInfo, travels in Message, and the archive itself through
+// croc's transfer engine, like /transfer, with the nonce of its code in
+// Bytes.
+const typeChatArchive message.Type = "chatarchive"
+
+// maxArchiveEntries caps the entries of any kind extracting an archive
+// goes through, as its offer only declares the regular files.
+const maxArchiveEntries = 1 << 20
+
+// errArchiveLimit is returned when extracting an archive that holds more
+// than the limits of its offer.
+var errArchiveLimit = errors.New("archive holds more than its offer declared")
+
+// Archive formats for directories sent with /sendfile.
+const (
+	archiveTar = "tar"
+	archiveZip = "zip"
+)
+
+// archiveInfo describes an archive offer.
+type archiveInfo struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	Files  int    `json:"files"`
+	Size   int64  `json:"size"`
+	// SHA256 is the hex digest of the archive, checked before anything is
+	// saved.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// archiveLimits bound what extracting an archive writes: its regular
+// files and their bytes, as its offer declared them, and its entries.
+type archiveLimits struct {
+	files   int
+	size    int64
+	entries int
+}
+
+// limits are the limits of extracting the archive info describes.
+func (info archiveInfo) limits() archiveLimits {
+	return archiveLimits{files: info.Files, size: info.Size, entries: maxArchiveEntries}
+}
+
+// writeArchive walks dir and streams its regular files to w as a tar or zip
+// archive rooted at the directory's name. Symlinks and other special files
+// are skipped and reported through warn.
+func writeArchive(w io.Writer, dir, format string, warn func(string)) (info archiveInfo, err error) {
+	dir = filepath.Clean(dir)
+	info = archiveInfo{Name: filepath.Base(dir), Format: format}
+	var add func(name string, fi fs.FileInfo, r io.Reader) (int64, error)
+	var closeArchive func() error
+	switch format {
+	case archiveTar:
+		tw := tar.NewWriter(w)
+		add = func(name string, fi fs.FileInfo, r io.Reader) (n int64, err error) {
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return
+			}
+			hdr.Name = name
+			if err = tw.WriteHeader(hdr); err != nil {
+				return
+			}
+			if r != nil {
+				n, err = io.Copy(tw, r)
+			}
+			return
+		}
+		closeArchive = tw.Close
+	case archiveZip:
+		zw := zip.NewWriter(w)
+		add = func(name string, fi fs.FileInfo, r io.Reader) (n int64, err error) {
+			hdr, err := zip.FileInfoHeader(fi)
+			if err != nil {
+				return
+			}
+			hdr.Name = name
+			if fi.IsDir() {
+				hdr.Name += "/"
+			} else {
+				hdr.Method = zip.Deflate
+			}
+			zf, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return
+			}
+			if r != nil {
+				n, err = io.Copy(zf, r)
+			}
+			return
+		}
+		closeArchive = zw.Close
+	default:
+		err = fmt.Errorf("unknown archive format '%s'", format)
+		return
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(dir), path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			_, err = add(name, fi, nil)
+			return err
+		case fi.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			// a file that grows meanwhile is counted as it was archived
+			n, err := add(name, fi, f)
+			info.Files++
+			info.Size += n
+			return err
+		default:
+			warn(localize(msgSkipping, name))
+			return nil
+		}
+	})
+	if err != nil {
+		return
+	}
+	err = closeArchive()
+	return
+}
+
+// archiveEntryPath resolves an archive entry inside dest, rejecting any
+// name that is not valid or would land outside of it.
+func archiveEntryPath(dest, name string) (string, error) {
+	name = filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if err := utils.ValidFileName(name); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dest, name)
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry '%s' escapes the target directory", name)
+	}
+	return target, nil
+}
+
+// extractArchive unpacks the archive of size bytes in r into dest, within
+// limits. Every entry goes through the same checks as single received
+// files, and gets its mode and modification time as the policy allows;
+// links and special files are skipped.
+func extractArchive(r io.ReaderAt, size int64, format, dest string, limits archiveLimits, policy metaPolicy, warn func(string)) (files int, err error) {
+	dest = filepath.Clean(dest)
+	if err = os.MkdirAll(dest, 0o755); err != nil {
+		return
+	}
+	// directories get their times last, as writing into them changes them
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTime
+	defer func() {
+		if err != nil || !policy.apply {
+			return
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			if errTime := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); errTime != nil {
+				warn(localize(msgMetadataFailed, dirs[i].path, errTime))
+			}
+		}
+	}()
+	// entry counts the entries and written the bytes extracted so far,
+	// whatever the headers claim
+	entries := 0
+	var written int64
+	entry := func() error {
+		if entries++; entries > limits.entries {
+			return fmt.Errorf("%w: more than %d entries", errArchiveLimit, limits.entries)
+		}
+		return nil
+	}
+	writeFile := func(name string, mode fs.FileMode, modTime time.Time, r io.Reader) error {
+		if files == limits.files {
+			return fmt.Errorf("%w: more than %d files", errArchiveLimit, limits.files)
+		}
+		target, err := archiveEntryPath(dest, name)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, policy.mode(mode)|0o600)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, io.LimitReader(r, limits.size-written+1))
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		if written += n; err == nil && written > limits.size {
+			os.Remove(target)
+			err = fmt.Errorf("%w: more than %s", errArchiveLimit, utils.ByteCountDecimal(limits.size))
+		}
+		if err != nil {
+			return err
+		}
+		files++
+		if err = policy.applyMeta(target, mode, modTime); err != nil {
+			warn(localize(msgMetadataFailed, name, err))
+		}
+		return nil
+	}
+	makeDir := func(name string, modTime time.Time) error {
+		target, err := archiveEntryPath(dest, name)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, dirTime{target, modTime})
+		return os.MkdirAll(target, 0o755)
+	}
+
+	switch format {
+	case archiveTar:
+		tr := tar.NewReader(io.NewSectionReader(r, 0, size))
+		for {
+			hdr, errNext := tr.Next()
+			if errNext == io.EOF {
+				return
+			}
+			if errNext != nil {
+				return files, errNext
+			}
+			if err = entry(); err != nil {
+				return
+			}
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				err = makeDir(hdr.Name, hdr.ModTime)
+			case tar.TypeReg:
+				err = writeFile(hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime, tr)
+			default:
+				warn(localize(msgSkipping, hdr.Name))
+			}
+			if err != nil {
+				return
+			}
+		}
+	case archiveZip:
+		var zr *zip.Reader
+		zr, err = zip.NewReader(r, size)
+		if err != nil {
+			return
+		}
+		for _, zf := range zr.File {
+			if err = entry(); err != nil {
+				return
+			}
+			mode := zf.Mode()
+			switch {
+			case mode.IsDir():
+				err = makeDir(zf.Name, zf.Modified)
+			case mode.IsRegular():
+				var r io.ReadCloser
+				if r, err = zf.Open(); err != nil {
+					return
+				}
+				err = writeFile(zf.Name, mode, zf.Modified, r)
+				r.Close()
+			default:
+				warn(localize(msgSkipping, zf.Name))
+			}
+			if err != nil {
+				return
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown archive format '%s'", format)
+	}
+	return
+}
+
+// extractArchiveFile unpacks the archive at path, described by info, into
+// dest.
+func extractArchiveFile(path string, info archiveInfo, dest string, policy metaPolicy, warn func(string)) (files int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	return extractArchive(f, fi.Size(), info.Format, dest, info.limits(), policy, warn)
+}
+
+// newArchiveFile archives dir into a directory of its own, where it waits
+// to be offered; removeArchiveFile removes it if it is not.
+func newArchiveFile(dir, format string, warn func(string)) (path string, info archiveInfo, err error) {
+	tmp, err := os.MkdirTemp("", "croc-chat-archive-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+	path = filepath.Join(tmp, filepath.Base(filepath.Clean(dir))+"."+format)
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	info, err = writeArchive(io.MultiWriter(f, h), dir, format, warn)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	info.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// removeArchiveFile removes an archive made by newArchiveFile.
+func removeArchiveFile(path string) error {
+	return os.RemoveAll(filepath.Dir(path))
+}
+
+// offerArchive starts sending the archive at path, made by newArchiveFile
+// and described by info, and returns the message offering it to the room.
+// The archive is removed once the transfer is over.
+func (t *transfers) offerArchive(path string, info archiveInfo) (m message.Message, err error) {
+	desc, err := json.Marshal(info)
+	if err != nil {
+		removeArchiveFile(path)
+		return
+	}
+	nonce, _, err := t.start(path, info.Name, func(error) { removeArchiveFile(path) })
+	if err != nil {
+		removeArchiveFile(path)
+		return
+	}
+	m = message.Message{
+		Type:    typeChatArchive,
+		ID:      newMessageID(),
+		Message: string(desc),
+		Bytes:   nonce,
+	}
+	return
+}
+
+// archiveOffers keeps received archives until they are accepted.
+type archiveOffers struct {
+	mu     sync.Mutex
+	offers map[string]message.Message
+}
+
+func newArchiveOffers() *archiveOffers {
+	return &archiveOffers{offers: make(map[string]message.Message)}
+}
+
+// received records an archive offer and returns its description.
+func (a *archiveOffers) received(m message.Message) (info archiveInfo, err error) {
+	if m.ID == "" {
+		err = fmt.Errorf("archive offer without an id")
+		return
+	}
+	if len(m.Bytes) != transferNonceSize {
+		err = fmt.Errorf("archive offer without a transfer")
+		return
+	}
+	if err = json.Unmarshal([]byte(m.Message), &info); err != nil {
+		return
+	}
+	if info.Format != archiveTar && info.Format != archiveZip {
+		err = fmt.Errorf("unknown archive format '%s'", info.Format)
+		return
+	}
+	if len(info.SHA256) != sha256.Size*2 {
+		err = fmt.Errorf("archive offer without a digest")
+		return
+	}
+	if err = utils.ValidFileName(info.Name); err != nil {
+		return
+	}
+	if info.Name != filepath.Base(info.Name) || info.Name == "." {
+		err = fmt.Errorf("invalid archive name '%s'", info.Name)
+		return
+	}
+	a.mu.Lock()
+	a.offers[m.ID] = m
+	a.mu.Unlock()
+	return
+}
+
+// take removes and returns the offer whose id starts with prefix.
+func (a *archiveOffers) take(prefix string) (m message.Message, info archiveInfo, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var matches []string
+	for id := range a.offers {
+		if strings.HasPrefix(id, prefix) {
+			matches = append(matches, id)
+		}
+	}
+	switch {
+	case prefix == "" || len(matches) == 0:
+		err = fmt.Errorf("no archive offer with id '%s'", prefix)
+		return
+	case len(matches) > 1:
+		err = fmt.Errorf("id '%s' matches more than one offer", prefix)
+		return
+	}
+	m = a.offers[matches[0]]
+	delete(a.offers, matches[0])
+	err = json.Unmarshal([]byte(m.Message), &info)
+	return
+}
+
+// fetch takes the offer whose id starts with prefix and fetches its
+// archive through t into a directory of its own in dir. done is called
+// with the archive once it is there and matches the digest of its offer,
+// and the archive is removed after done returns. fetch returns the
+// description of the offer, and an error if there was no such offer or
+// the fetch could not start, in which case done is not called.
+func (a *archiveOffers) fetch(t *transfers, prefix, dir string, done func(archive string, info archiveInfo, err error)) (info archiveInfo, err error) {
+	m, info, err := a.take(prefix)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	tmp, err := os.MkdirTemp(dir, ".croc-archive-")
+	if err != nil {
+		return
+	}
+	offered := info
+	err = t.fetch(m.Bytes, tmp, info.Name, func(err error) {
+		defer os.RemoveAll(tmp)
+		var archive string
+		if err == nil {
+			archive, err = receivedArchive(tmp, offered)
+		}
+		done(archive, offered, err)
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return
+}
+
+// receivedArchive returns the archive a transfer left in dir, failing for
+// one that does not match the digest of its offer.
+func receivedArchive(dir string, info archiveInfo) (path string, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	if len(entries) != 1 || !entries[0].Type().IsRegular() {
+		return "", fmt.Errorf("the transfer did not bring a single archive")
+	}
+	path = filepath.Join(dir, entries[0].Name())
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	err = matchOffer(h.Sum(nil), info)
+	return
+}
+
+// matchOffer fails for an archive whose sha256 digest is not the one its
+// offer gave.
+func matchOffer(digest []byte, info archiveInfo) error {
+	if got := hex.EncodeToString(digest); got != info.SHA256 {
+		return fmt.Errorf("archive does not match the offer: sha256 %s, want %s", got, info.SHA256)
+	}
+	return nil
+}
+
+// accept fetches an archive offer through t and saves it into dir,
+// unpacking it if extract is set. done is called with where the archive
+// or its contents were written; like fetch, accept returns the
+// description of the offer and an error if the fetch did not start.
+func (a *archiveOffers) accept(t *transfers, prefix, dir string, extract bool, policy metaPolicy, warn func(string), done func(path string, files int, info archiveInfo, err error)) (archiveInfo, error) {
+	return a.fetch(t, prefix, dir, func(archive string, info archiveInfo, err error) {
+		var path string
+		var files int
+		switch {
+		case err != nil:
+		case extract:
+			// entries are rooted at the archive name already
+			path = filepath.Join(dir, info.Name)
+			files, err = extractArchiveFile(archive, info, dir, policy, warn)
+		default:
+			path = filepath.Join(dir, info.Name+"."+info.Format)
+			files = info.Files
+			err = os.Rename(archive, path)
+		}
+		done(path, files, info, err)
+	})
+}
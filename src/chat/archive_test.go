@@ -0,0 +1,249 @@
+package chat
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// testTransfers returns the transfers of two peers of a chat, on a relay
+// of their own.
+func testTransfers(t *testing.T) (sender, receiver *transfers) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	// the relay takes the data connections of transfers as well
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithBanner(port), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	options := croc.Options{SharedSecret: "1234-archive", RelayAddress: l.Addr().String(), RelayPassword: "pass123"}
+	return newTransfers(options, func(string) {}), newTransfers(options, func(string) {})
+}
+
+// offerTestArchive archives dir and offers it through t.
+func offerTestArchive(t *testing.T, tr *transfers, dir, format string, warn func(string)) (m message.Message, info archiveInfo) {
+	archive, info, err := newArchiveFile(dir, format, warn)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	m, err = offerTestFile(tr, archive, info)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return
+}
+
+// offerTestFile offers the archive at path through t and gives the sender
+// time to join the relay, as a receiver that comes first gives up.
+func offerTestFile(tr *transfers, path string, info archiveInfo) (m message.Message, err error) {
+	m, err = tr.offerArchive(path, info)
+	time.Sleep(500 * time.Millisecond)
+	return
+}
+
+// acceptResult is what archiveOffers.accept calls back with.
+type acceptResult struct {
+	path  string
+	files int
+	info  archiveInfo
+	err   error
+}
+
+// acceptTestArchive accepts an offer and waits for it to be saved.
+func acceptTestArchive(t *testing.T, offers *archiveOffers, tr *transfers, prefix, dir string, extract bool, policy metaPolicy, warn func(string)) acceptResult {
+	result := make(chan acceptResult, 1)
+	_, err := offers.accept(tr, prefix, dir, extract, policy, warn, func(path string, files int, info archiveInfo, err error) {
+		result <- acceptResult{path, files, info, err}
+	})
+	if err != nil {
+		return acceptResult{err: err}
+	}
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(30 * time.Second):
+		t.Fatal("the archive did not arrive")
+	}
+	return acceptResult{}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	sender, receiver := testTransfers(t)
+	src := filepath.Join(t.TempDir(), "photos")
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "2024", "summer"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "2024", "summer", "b.txt"), []byte("world!"), 0o644))
+	assert.Nil(t, os.Symlink("/etc/passwd", filepath.Join(src, "link")))
+
+	for _, format := range []string{archiveTar, archiveZip} {
+		var warnings []string
+		warn := func(s string) { warnings = append(warnings, s) }
+		m, info := offerTestArchive(t, sender, src, format, warn)
+		assert.Len(t, info.SHA256, 64)
+		assert.Equal(t, archiveInfo{Name: "photos", Format: format, Files: 2, Size: 11, SHA256: info.SHA256}, info)
+		assert.Len(t, warnings, 1)
+		assert.Contains(t, warnings[0], "link")
+		// the frame only carries the offer
+		assert.Len(t, m.Bytes, transferNonceSize)
+
+		offers := newArchiveOffers()
+		received, err := offers.received(m)
+		assert.Nil(t, err)
+		assert.Equal(t, info, received)
+
+		dest := t.TempDir()
+		r := acceptTestArchive(t, offers, receiver, shortID(m.ID), dest, true, metaPolicy{apply: true}, warn)
+		assert.Nil(t, r.err)
+		assert.Equal(t, 2, r.files)
+		assert.Equal(t, info, r.info)
+		assert.Equal(t, filepath.Join(dest, "photos"), r.path)
+		data, err := os.ReadFile(filepath.Join(dest, "photos", "2024", "summer", "b.txt"))
+		assert.Nil(t, err)
+		assert.Equal(t, "world!", string(data))
+		_, err = os.Lstat(filepath.Join(dest, "photos", "link"))
+		assert.True(t, os.IsNotExist(err))
+		// nothing is left of the transfer
+		entries, err := os.ReadDir(dest)
+		assert.Nil(t, err)
+		assert.Len(t, entries, 1)
+
+		// an accepted offer is gone
+		r = acceptTestArchive(t, offers, receiver, shortID(m.ID), dest, true, metaPolicy{apply: true}, warn)
+		assert.NotNil(t, r.err)
+
+		// saving keeps the archive as is
+		m, _ = offerTestArchive(t, sender, src, format, warn)
+		_, err = offers.received(m)
+		assert.Nil(t, err)
+		r = acceptTestArchive(t, offers, receiver, m.ID, dest, false, metaPolicy{apply: true}, warn)
+		assert.Nil(t, r.err)
+		assert.Equal(t, filepath.Join(dest, "photos."+format), r.path)
+		fi, err := os.Stat(r.path)
+		if assert.Nil(t, err) {
+			assert.True(t, fi.Mode().IsRegular())
+		}
+	}
+}
+
+func TestExtractArchiveRejectsEscapes(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "photos/../../evil.txt", "/etc/evil.txt"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 4, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte("evil"))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.Close())
+
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "dest")
+		_, err = extractArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), archiveTar, dest, archiveLimits{files: 1, size: 4, entries: 1}, metaPolicy{}, func(string) {})
+		assert.NotNil(t, err, name)
+		_, err = os.Stat(filepath.Join(parent, "evil.txt"))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// links are skipped rather than created
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "photos/link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}))
+	assert.Nil(t, tw.Close())
+	var warnings []string
+	files, err := extractArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()), archiveTar, t.TempDir(), archiveLimits{entries: 1}, metaPolicy{}, func(s string) { warnings = append(warnings, s) })
+	assert.Nil(t, err)
+	assert.Equal(t, 0, files)
+	assert.Len(t, warnings, 1)
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	tarball := func(files map[string]int) *bytes.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			assert.Nil(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(files[name]), Typeflag: tar.TypeReg}))
+			_, err := tw.Write(make([]byte, files[name]))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, tw.Close())
+		return bytes.NewReader(buf.Bytes())
+	}
+	extract := func(r *bytes.Reader, format string, limits archiveLimits) (string, int, error) {
+		dest := t.TempDir()
+		files, err := extractArchive(r, r.Size(), format, dest, limits, metaPolicy{}, func(string) {})
+		return dest, files, err
+	}
+
+	r := tarball(map[string]int{"d/a": 3, "d/b": 4})
+	_, files, err := extract(r, archiveTar, archiveLimits{files: 2, size: 7, entries: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, files)
+	for _, limits := range []archiveLimits{
+		{files: 1, size: 7, entries: 2},
+		{files: 2, size: 6, entries: 2},
+		{files: 2, size: 7, entries: 1},
+	} {
+		_, _, err = extract(r, archiveTar, limits)
+		assert.ErrorIs(t, err, errArchiveLimit, "%+v", limits)
+	}
+
+	// a small zip that unpacks to far more than its offer declared stops
+	// at the limit, whatever its headers claim
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("d/bomb")
+	assert.Nil(t, err)
+	_, err = w.Write(make([]byte, 32<<20))
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+	assert.Less(t, buf.Len(), 1<<20)
+	dest, _, err := extract(bytes.NewReader(buf.Bytes()), archiveZip, archiveLimits{files: 1, size: 1 << 10, entries: 1})
+	assert.ErrorIs(t, err, errArchiveLimit)
+	_, err = os.Stat(filepath.Join(dest, "d", "bomb"))
+	assert.True(t, os.IsNotExist(err), "the partial file is removed")
+}
+
+func TestArchiveOfferValidation(t *testing.T) {
+	digest := strings.Repeat("ab", 32)
+	offers := newArchiveOffers()
+	_, err := offers.received(archiveOfferMessage("id0", `{"name":"ok","format":"tar","sha256":"`+digest+`"}`))
+	assert.Nil(t, err)
+	_, err = offers.received(archiveOfferMessage("id1", `{"name":"../up","format":"tar","sha256":"`+digest+`"}`))
+	assert.NotNil(t, err)
+	_, err = offers.received(archiveOfferMessage("id2", `{"name":"ok","format":"rar","sha256":"`+digest+`"}`))
+	assert.NotNil(t, err)
+	_, err = offers.received(archiveOfferMessage("", `{"name":"ok","format":"tar","sha256":"`+digest+`"}`))
+	assert.NotNil(t, err)
+	_, err = offers.received(archiveOfferMessage("id3", `{"name":"ok","format":"tar"}`))
+	assert.NotNil(t, err)
+	// archives sent whole, as older peers do, are not taken
+	m := archiveOfferMessage("id4", `{"name":"ok","format":"tar","sha256":"`+digest+`"}`)
+	m.Bytes = make([]byte, 1024)
+	_, err = offers.received(m)
+	assert.NotNil(t, err)
+}
+
+func archiveOfferMessage(id, desc string) message.Message {
+	return message.Message{Type: typeChatArchive, ID: id, Message: desc, Bytes: make([]byte, transferNonceSize)}
+}
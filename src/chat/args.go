@@ -0,0 +1,338 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// errUnterminatedQuote is returned for arguments with a quote that is not
+// closed.
+var errUnterminatedQuote = errors.New("unterminated quote")
+
+// errUsage is what every argument error of a built-in command is, so
+// callers can tell them from a command that failed.
+var errUsage = errors.New("wrong arguments")
+
+// argKind is what an argument of a built-in command holds.
+type argKind int
+
+const (
+	// argWord is one word, quoted if it holds white space.
+	argWord argKind = iota
+	// argText is the rest of the line as it was typed, quotes and
+	// backslashes included, for the text of a message or a pattern. It
+	// can only be the last argument.
+	argText
+	// argDuration is a positive duration such as 2h.
+	argDuration
+	// argSwitch is an option that takes no value.
+	argSwitch
+)
+
+// commandSpec says which arguments a built-in command takes.
+type commandSpec struct {
+	// min and max bound the number of arguments; a negative max is no
+	// bound. Options are not counted.
+	min, max int
+	// args are the kinds of the arguments in order. Arguments past them
+	// are words.
+	args []argKind
+	// options are the --options the command takes, with the kind of their
+	// value. They go before an argText argument and anywhere otherwise.
+	options map[string]argKind
+	// usage is shown with an argument error; without one the command
+	// takes no arguments.
+	usage msgID
+}
+
+// commandSpecs are the built-in commands, by name without the slash.
+var commandSpecs = map[string]commandSpec{
+	"quit":       {},
+	"setalias":   {min: 1, max: -1, usage: msgSetAliasUsage},
+	"ping":       {},
+	"limit":      {max: 1, usage: msgLimitUsage},
+	"relay":      {},
+	"who":        {},
+	"links":      {},
+	"schedule":   {min: 2, max: 2, args: []argKind{argWord, argText}, usage: msgScheduleUsage},
+	"scheduled":  {},
+	"unschedule": {min: 1, max: 1, usage: msgUnscheduleUsage},
+	"edit":       {min: 2, max: 2, args: []argKind{argWord, argText}, usage: msgEditUsage},
+	"delete":     {min: 1, max: 1, usage: msgDeleteUsage},
+	"react":      {min: 2, max: 2, usage: msgReactUsage},
+	"mine":       {},
+	"find": {min: 1, max: 1, args: []argKind{argText},
+		options: map[string]argKind{"--since": argDuration, "--case": argSwitch}, usage: msgFindUsage},
+	"rules":     {},
+	"quiet":     {max: 2, usage: msgQuietUsage},
+	"layout":    {max: 1, usage: msgLayoutUsage},
+	"stats":     {},
+	"transfers": {options: map[string]argKind{"--json": argSwitch}, usage: msgLedgerUsage},
+	"security":  {options: map[string]argKind{"--json": argSwitch}, usage: msgSecurityUsage},
+	"dnd":       {max: 1, usage: msgDNDUsage},
+	"confirm":   {},
+	"integrity": {},
+	"save":      {min: 1, max: 1, options: map[string]argKind{"--signed": argSwitch}, usage: msgSaveUsage},
+	"bookmark":  {min: 1, max: 1, usage: msgBookmarkUsage},
+	"bookmarks": {},
+	"me":        {min: 1, max: 1, args: []argKind{argText}, usage: msgEmoteUsage},
+	"encrypt":   {min: 2, max: 2, args: []argKind{argWord, argText}, usage: msgEncryptUsage},
+	"ephemeral": {min: 2, max: 2, args: []argKind{argWord, argText}, usage: msgEphemeralUsage},
+	"sendfile":  {min: 1, max: 1, options: map[string]argKind{"--zip": argSwitch}, usage: msgSendFileUsage},
+	"accept": {min: 1, max: 2,
+		options: map[string]argKind{"--extract": argSwitch, "--stdout": argSwitch, "--exec": argWord}, usage: msgAcceptUsage},
+	"transfer": {min: 1, max: 1, usage: msgTransferUsage},
+	"get":      {min: 1, max: 2, usage: msgGetUsage},
+}
+
+// commandArgs is a parsed built-in command.
+type commandArgs struct {
+	// name is the command without the slash, or empty for a line that is
+	// not a built-in command.
+	name    string
+	args    []string
+	options map[string]string
+}
+
+// arg returns argument i, or an empty string if there are fewer.
+func (c commandArgs) arg(i int) string {
+	if i < len(c.args) {
+		return c.args[i]
+	}
+	return ""
+}
+
+// option returns the value of an option and whether it was given.
+func (c commandArgs) option(name string) (string, bool) {
+	value, ok := c.options[name]
+	return value, ok
+}
+
+// has reports whether an option was given.
+func (c commandArgs) has(name string) bool {
+	_, ok := c.options[name]
+	return ok
+}
+
+// usageError is an argument error of a built-in command.
+type usageError struct {
+	name  string
+	usage msgID
+	// err says what is wrong beyond the usage, if anything.
+	err error
+}
+
+// usageErr returns an argument error of the built-in command name.
+func usageErr(name string, err error) error {
+	return &usageError{name: name, usage: commandSpecs[name].usage, err: err}
+}
+
+func (e *usageError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("/%s: %v", e.name, e.err)
+	}
+	return fmt.Sprintf("wrong arguments for /%s", e.name)
+}
+
+func (e *usageError) Is(target error) bool { return target == errUsage }
+
+func (e *usageError) Unwrap() error { return e.err }
+
+// usageText returns what the user is shown for err: the usage of the
+// command, after what is wrong with its arguments, for an argument error,
+// and the error itself otherwise.
+func usageText(err error) string {
+	var u *usageError
+	if !errors.As(err, &u) {
+		return err.Error()
+	}
+	usage := localize(msgNoArguments, u.name)
+	if u.usage != "" {
+		usage = localize(u.usage)
+	}
+	if u.err != nil {
+		return localize(msgBadArguments, u.err) + "\n" + usage
+	}
+	return usage
+}
+
+// commandName splits a line into the name of the command it starts with,
+// without the slash, and the text of its arguments. A line that does not
+// start with a slash has no name.
+func commandName(line string) (name, args string) {
+	if !strings.HasPrefix(line, "/") {
+		return "", ""
+	}
+	name = line[1:]
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], name[i:]
+	}
+	return name, args
+}
+
+// parseCommand parses line if it is a built-in command, and checks its
+// arguments against the spec of the command. A line that is not one comes
+// back with no name. Argument errors come back with the name and are
+// usageErrors.
+func parseCommand(line string) (c commandArgs, err error) {
+	name, args := commandName(line)
+	spec, ok := commandSpecs[name]
+	if !ok {
+		return c, nil
+	}
+	c, err = spec.parse(args)
+	c.name = name
+	if errors.Is(err, errWrongCount) {
+		return c, &usageError{name: name, usage: spec.usage}
+	}
+	if err != nil {
+		return c, &usageError{name: name, usage: spec.usage, err: err}
+	}
+	return c, nil
+}
+
+// kind returns the kind of argument i.
+func (spec commandSpec) kind(i int) argKind {
+	if i < len(spec.args) {
+		return spec.args[i]
+	}
+	return argWord
+}
+
+// parse parses the arguments of a command. A "--" ends the options.
+// Errors are wrapped in a usageError by the caller.
+func (spec commandSpec) parse(s string) (c commandArgs, err error) {
+	options := len(spec.options) > 0
+	i := 0
+	for {
+		if spec.kind(len(c.args)) == argText {
+			rest := strings.TrimSpace(s[i:])
+			if rest != "" && !(options && strings.HasPrefix(rest, "--")) {
+				c.args = append(c.args, rest)
+				break
+			}
+		}
+		var word string
+		var start int
+		var ok bool
+		if word, start, i, ok, err = nextWord(s, i); err != nil {
+			return c, err
+		}
+		if !ok {
+			break
+		}
+		if options && s[start:i] == "--" {
+			options = false
+			continue
+		}
+		if options && strings.HasPrefix(word, "--") {
+			name, value, hasValue := strings.Cut(word, "=")
+			kind, known := spec.options[name]
+			switch {
+			case !known:
+				return c, fmt.Errorf("unknown option %s", name)
+			case kind == argSwitch && hasValue:
+				return c, fmt.Errorf("%s takes no value", name)
+			case kind != argSwitch && !hasValue:
+				if value, _, i, ok, err = nextWord(s, i); err != nil {
+					return c, err
+				}
+				if !ok {
+					return c, fmt.Errorf("%s needs a value", name)
+				}
+			}
+			if err = checkArg(kind, value); err != nil {
+				return c, fmt.Errorf("%s: %w", name, err)
+			}
+			if c.options == nil {
+				c.options = make(map[string]string)
+			}
+			c.options[name] = value
+			continue
+		}
+		if err = checkArg(spec.kind(len(c.args)), word); err != nil {
+			return c, err
+		}
+		c.args = append(c.args, word)
+	}
+	if len(c.args) < spec.min || (spec.max >= 0 && len(c.args) > spec.max) {
+		return c, errWrongCount
+	}
+	return c, nil
+}
+
+// errWrongCount is a wrong number of arguments. It is not shown, only the
+// usage is.
+var errWrongCount = errors.New("wrong number of arguments")
+
+// checkArg checks a value against the kind of argument it is for.
+func checkArg(kind argKind, value string) error {
+	if kind == argDuration {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return fmt.Errorf("%q is not a duration such as 2h", value)
+		}
+	}
+	return nil
+}
+
+// splitArgs splits s into words at white space, as unicode defines it.
+// Double quotes keep white space in a word, and a backslash takes a quote,
+// backslash or white space after it as it is. Other backslashes are kept,
+// so Windows paths need no escaping.
+func splitArgs(s string) (words []string, err error) {
+	for i := 0; ; {
+		var word string
+		var ok bool
+		if word, _, i, ok, err = nextWord(s, i); err != nil || !ok {
+			return words, err
+		}
+		words = append(words, word)
+	}
+}
+
+// nextWord reads the word of s that starts at or after byte i, as
+// splitArgs splits them. start and end are where it starts and ends in s.
+// ok is false if only white space is left.
+func nextWord(s string, i int) (word string, start, end int, ok bool, err error) {
+	for i < len(s) {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += n
+	}
+	if i == len(s) {
+		return "", i, i, false, nil
+	}
+	start = i
+	var b strings.Builder
+	quoted := false
+	for i < len(s) {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '\\' && i+n < len(s):
+			next, m := utf8.DecodeRuneInString(s[i+n:])
+			if next == '"' || next == '\\' || unicode.IsSpace(next) {
+				b.WriteString(s[i+n : i+n+m])
+				i += n + m
+				continue
+			}
+			b.WriteString(s[i : i+n])
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			return b.String(), start, i, true, nil
+		default:
+			b.WriteString(s[i : i+n])
+		}
+		i += n
+	}
+	if quoted {
+		return "", start, i, false, errUnterminatedQuote
+	}
+	return b.String(), start, i, true, nil
+}
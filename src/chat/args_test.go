@@ -0,0 +1,231 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mustParseCommand parses line as a built-in command that has to be valid.
+func mustParseCommand(t *testing.T, line string) commandArgs {
+	t.Helper()
+	c, err := parseCommand(line)
+	assert.Nil(t, err, line)
+	return c
+}
+
+func TestSplitArgs(t *testing.T) {
+	for s, want := range map[string][]string{
+		"":                                {},
+		"   ":                             {},
+		"a":                               {"a"},
+		"  a  b\tc\n":                     {"a", "b", "c"},
+		`"My Report Final (2).pdf"`:       {"My Report Final (2).pdf"},
+		`"a b" c`:                         {"a b", "c"},
+		`a"b c"d`:                         {"ab cd"},
+		`""`:                              {""},
+		`"" x ""`:                         {"", "x", ""},
+		`say \"hi\"`:                      {"say", `"hi"`},
+		`"say \"hi\""`:                    {`say "hi"`},
+		`a\ b`:                            {"a b"},
+		`a\\ b`:                           {`a\`, "b"},
+		`"a\\"`:                           {`a\`},
+		`C:\Users\me\report.pdf`:          {`C:\Users\me\report.pdf`},
+		`"C:\Program Files\app" --zip`:    {`C:\Program Files\app`, "--zip"},
+		`trailing\`:                       {`trailing\`},
+		`it's`:                            {"it's"},
+		`'single quotes' are plain`:       {"'single", "quotes'", "are", "plain"},
+		"résumé ünïcode 日本語":              {"résumé", "ünïcode", "日本語"},
+		"a\u00a0b":                        {"a", "b"},
+		"a\u3000b\u2003c\u2028d":          {"a", "b", "c", "d"},
+		"\u00a0\u00a0a\u00a0":             {"a"},
+		"\"a\u00a0b\"":                    {"a\u00a0b"},
+		"a\\\u00a0b":                      {"a\u00a0b"},
+		"a\u200bb":                        {"a\u200bb"},
+		"\xff\xfe x":                      {"\xff\xfe", "x"},
+		`"quoted"tail "x"y`:               {"quotedtail", "xy"},
+		`emoji 🎉 "🎉 🎉"`:                   {"emoji", "🎉", "🎉 🎉"},
+		`--exec "sh -c 'exit 3'" ab12`:    {"--exec", "sh -c 'exit 3'", "ab12"},
+		`"line one\nline two"`:            {`line one\nline two`},
+		"\"tab\tinside\"":                 {"tab\tinside"},
+		`\"unbalanced`:                    {`"unbalanced`},
+		`"escaped quote \" inside" after`: {`escaped quote " inside`, "after"},
+	} {
+		got, err := splitArgs(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, len(want), len(got), s)
+		if len(want) > 0 {
+			assert.Equal(t, want, got, s)
+		}
+	}
+	for _, s := range []string{`"open`, `a "b`, `"a" "b`, `"a\"`, "\"\u00a0", `x "y \" z`} {
+		_, err := splitArgs(s)
+		assert.ErrorIs(t, err, errUnterminatedQuote, s)
+	}
+}
+
+func TestNextWord(t *testing.T) {
+	s := ` ab "c d"  e`
+	word, start, end, ok, err := nextWord(s, 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ab", word)
+	assert.Equal(t, "ab", s[start:end])
+	word, start, end, _, _ = nextWord(s, end)
+	assert.Equal(t, "c d", word)
+	assert.Equal(t, `"c d"`, s[start:end])
+	word, _, end, _, _ = nextWord(s, end)
+	assert.Equal(t, "e", word)
+	_, _, _, ok, err = nextWord(s, end)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
+
+func TestCommandName(t *testing.T) {
+	for line, want := range map[string][2]string{
+		"/sendfile a b":    {"sendfile", " a b"},
+		"/quit":            {"quit", ""},
+		"/find\u00a0x":     {"find", "\u00a0x"},
+		"/":                {"", ""},
+		"hello /sendfile":  {"", ""},
+		"/weather  Berlin": {"weather", "  Berlin"},
+	} {
+		name, args := commandName(line)
+		assert.Equal(t, want, [2]string{name, args}, line)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	c := mustParseCommand(t, `/sendfile "My Report Final (2).pdf"`)
+	assert.Equal(t, "sendfile", c.name)
+	assert.Equal(t, []string{"My Report Final (2).pdf"}, c.args)
+	assert.False(t, c.has("--zip"))
+
+	c = mustParseCommand(t, `/sendfile --zip "my folder"`)
+	assert.Equal(t, "my folder", c.arg(0))
+	assert.True(t, c.has("--zip"))
+	c = mustParseCommand(t, `/sendfile "my folder" --zip`)
+	assert.Equal(t, "my folder", c.arg(0))
+	assert.True(t, c.has("--zip"))
+	// after -- a name that starts like an option is a name
+	c = mustParseCommand(t, `/sendfile -- --zip`)
+	assert.Equal(t, "--zip", c.arg(0))
+	assert.False(t, c.has("--zip"))
+
+	// text is kept as it was typed
+	c = mustParseCommand(t, `/edit last she said "hi  there\" C:\tmp`)
+	assert.Equal(t, []string{"last", `she said "hi  there\" C:\tmp`}, c.args)
+	c = mustParseCommand(t, `/me   waves  `)
+	assert.Equal(t, []string{"waves"}, c.args)
+	c = mustParseCommand(t, `/encrypt "pass phrase" --not an option`)
+	assert.Equal(t, []string{"pass phrase", "--not an option"}, c.args)
+	c = mustParseCommand(t, "/find --since=2h --case -- --since")
+	assert.Equal(t, []string{"--since"}, c.args)
+	v, ok := c.option("--since")
+	assert.True(t, ok)
+	assert.Equal(t, "2h", v)
+	assert.True(t, c.has("--case"))
+
+	c = mustParseCommand(t, `/setalias Jane "Q." Doe`)
+	assert.Equal(t, []string{"Jane", "Q.", "Doe"}, c.args)
+	c = mustParseCommand(t, `/get ab12 "My Downloads"`)
+	assert.Equal(t, "My Downloads", c.arg(1))
+	assert.Equal(t, "", c.arg(2))
+	c = mustParseCommand(t, "/transfers --json")
+	assert.True(t, c.has("--json"))
+	c = mustParseCommand(t, "/security --json")
+	assert.True(t, c.has("--json"))
+
+	// lines that are not built-in commands have no name
+	for _, line := range []string{"hello", "/weather x", "/saved", "/", `say "hi`} {
+		c, err := parseCommand(line)
+		assert.Nil(t, err, line)
+		assert.Equal(t, "", c.name, line)
+	}
+
+	for line, cause := range map[string]error{
+		"/sendfile":                      nil,
+		"/sendfile a b":                  nil,
+		`/sendfile "My Report.pdf`:       errUnterminatedQuote,
+		"/sendfile a --tar":              errors.New("unknown option --tar"),
+		"/sendfile a --zip=yes":          errors.New("--zip takes no value"),
+		"/ping now":                      nil,
+		"/quit later":                    nil,
+		"/edit last":                     nil,
+		"/react last":                    nil,
+		"/react last like now":           nil,
+		"/find --since":                  errors.New("--since needs a value"),
+		"/find --since 0s x":             errors.New(`--since: "0s" is not a duration such as 2h`),
+		"/accept ab12 --exec":            errors.New("--exec needs a value"),
+		`/accept ab12 --exec "tar xz`:    errUnterminatedQuote,
+		"/get":                           nil,
+		"/get a b c":                     nil,
+		"/setalias":                      nil,
+		"/dnd on off":                    nil,
+		"/transfers --json extra":        nil,
+		"/schedule 10m":                  nil,
+		`/unschedule "ab12`:              errUnterminatedQuote,
+		"/me":                            nil,
+		"/encrypt key":                   nil,
+		"/ephemeral 60":                  nil,
+		"/save":                          nil,
+		"/quiet 22:00-07:00 UTC extra":   nil,
+		"/limit 1M 2M":                   nil,
+		"/bookmark two words":            nil,
+		"/transfer":                      nil,
+		"/delete":                        nil,
+		"/layout split inline":           nil,
+		"/save x --signed --signed=true": errors.New("--signed takes no value"),
+	} {
+		c, err := parseCommand(line)
+		assert.ErrorIs(t, err, errUsage, line)
+		name, _ := commandName(line)
+		assert.Equal(t, name, c.name, line)
+		var u *usageError
+		if assert.True(t, errors.As(err, &u), line) {
+			if cause == nil {
+				assert.Nil(t, u.err, line)
+			} else if errors.Is(cause, errUnterminatedQuote) {
+				assert.ErrorIs(t, u.err, errUnterminatedQuote, line)
+			} else if assert.NotNil(t, u.err, line) {
+				assert.Equal(t, cause.Error(), u.err.Error(), line)
+			}
+		}
+	}
+}
+
+func TestCommandSpecs(t *testing.T) {
+	for name, spec := range commandSpecs {
+		assert.Equal(t, strings.ToLower(name), name)
+		for i, kind := range spec.args {
+			if kind == argText {
+				assert.Equal(t, len(spec.args)-1, i, "text is the last argument of /%s", name)
+			}
+			assert.NotEqual(t, argSwitch, kind, name)
+		}
+		if spec.max != 0 || len(spec.options) > 0 {
+			assert.NotEmpty(t, spec.usage, "/%s takes arguments and needs a usage", name)
+		}
+		for option := range spec.options {
+			assert.True(t, strings.HasPrefix(option, "--"), option)
+		}
+	}
+}
+
+func TestUsageText(t *testing.T) {
+	setLanguage("en")
+	_, err := parseCommand("/sendfile")
+	assert.Equal(t, "Usage: /sendfile <path> [--zip], with a path that has spaces in double quotes", usageText(err))
+	_, err = parseCommand(`/get "ab12`)
+	assert.Equal(t, "Cannot read the arguments: unterminated quote\nUsage: /get <offerID> [dir]", usageText(err))
+	_, err = parseCommand("/ping now")
+	assert.Equal(t, "Usage: /ping (takes no arguments)", usageText(err))
+	assert.Equal(t, "boom", usageText(errors.New("boom")))
+
+	setLanguage("de")
+	defer setLanguage("en")
+	_, err = parseCommand("/ping now")
+	assert.Equal(t, "Verwendung: /ping (ohne Argumente)", usageText(err))
+}
@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/crypt"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// bookmarksFileName is the bookmark store inside croc's config directory.
+const bookmarksFileName = "chat_bookmarks.json"
+
+// ErrNoBookmark is returned when a bookmark name is not in the store.
+var ErrNoBookmark = errors.New("no such bookmark")
+
+// Bookmark is a saved chat room. The shared code is only ever stored
+// encrypted with a key derived from a local passphrase.
+type Bookmark struct {
+	Name     string    `json:"name"`
+	Salt     []byte    `json:"salt"`
+	Code     []byte    `json:"code"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// Bookmarks is a file-backed store of saved chat rooms.
+type Bookmarks struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewBookmarks returns a store kept in the file at path.
+func NewBookmarks(path string) *Bookmarks {
+	return &Bookmarks{path: path}
+}
+
+// DefaultBookmarks returns the store in croc's config directory.
+func DefaultBookmarks() (*Bookmarks, error) {
+	configDir, err := utils.GetConfigDir(true)
+	if err != nil {
+		return nil, err
+	}
+	return NewBookmarks(filepath.Join(configDir, bookmarksFileName)), nil
+}
+
+// List returns the saved bookmarks sorted by name.
+func (b *Bookmarks) List() (bookmarks []Bookmark, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all, err := b.read()
+	if err != nil {
+		return
+	}
+	for _, bm := range all {
+		bookmarks = append(bookmarks, bm)
+	}
+	sort.Slice(bookmarks, func(i, j int) bool { return bookmarks[i].Name < bookmarks[j].Name })
+	return
+}
+
+// Save stores code under name, encrypted with passphrase, replacing any
+// bookmark with the same name.
+func (b *Bookmarks) Save(name, code, passphrase string) (err error) {
+	if name == "" {
+		return fmt.Errorf("bookmark name cannot be empty")
+	}
+	aead, salt, err := crypt.NewArgon2([]byte(passphrase), nil)
+	if err != nil {
+		return
+	}
+	enc, err := crypt.EncryptChaCha([]byte(code), aead)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all, err := b.read()
+	if err != nil {
+		return
+	}
+	all[name] = Bookmark{
+		Name:    name,
+		Salt:    salt,
+		Code:    enc,
+		Created: time.Now(),
+	}
+	return b.write(all)
+}
+
+// Load decrypts the code saved under name and marks the bookmark as used.
+func (b *Bookmarks) Load(name, passphrase string) (code string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all, err := b.read()
+	if err != nil {
+		return
+	}
+	bm, ok := all[name]
+	if !ok {
+		err = fmt.Errorf("%w: '%s'", ErrNoBookmark, name)
+		return
+	}
+	aead, _, err := crypt.NewArgon2([]byte(passphrase), bm.Salt)
+	if err != nil {
+		return
+	}
+	plain, err := crypt.DecryptChaCha(bm.Code, aead)
+	if err != nil {
+		err = fmt.Errorf("could not decrypt bookmark '%s': wrong passphrase?", name)
+		return
+	}
+	bm.LastUsed = time.Now()
+	all[name] = bm
+	if err = b.write(all); err != nil {
+		return
+	}
+	code = string(plain)
+	return
+}
+
+// Delete removes the bookmark saved under name.
+func (b *Bookmarks) Delete(name string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all, err := b.read()
+	if err != nil {
+		return
+	}
+	if _, ok := all[name]; !ok {
+		return fmt.Errorf("%w: '%s'", ErrNoBookmark, name)
+	}
+	delete(all, name)
+	return b.write(all)
+}
+
+func (b *Bookmarks) read() (all map[string]Bookmark, err error) {
+	all = make(map[string]Bookmark)
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(data, &all)
+	return
+}
+
+// write replaces the store atomically so an interrupted write never loses
+// existing bookmarks.
+func (b *Bookmarks) write(all map[string]Bookmark) (err error) {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := b.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// PrintBookmarks writes the saved bookmarks with their last-used times.
+func PrintBookmarks(w io.Writer) error {
+	b, err := DefaultBookmarks()
+	if err != nil {
+		return err
+	}
+	bookmarks, err := b.List()
+	if err != nil {
+		return err
+	}
+	if len(bookmarks) == 0 {
+		fmt.Fprintln(w, "No bookmarks saved")
+		return nil
+	}
+	for _, bm := range bookmarks {
+		lastUsed := "never"
+		if !bm.LastUsed.IsZero() {
+			lastUsed = bm.LastUsed.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%-20s last used %s\n", bm.Name, lastUsed)
+	}
+	return nil
+}
+
+// saveBookmark asks for a passphrase twice and saves code under name.
+func saveBookmark(rl console, name, code string) error {
+	if name == "" {
+		return fmt.Errorf("usage: /bookmark <name>")
+	}
+	b, err := DefaultBookmarks()
+	if err != nil {
+		return err
+	}
+	passphrase, err := rl.ReadPassword("Passphrase for the bookmark: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := rl.ReadPassword("Repeat passphrase: ")
+	if err != nil {
+		return err
+	}
+	if string(passphrase) != string(confirm) {
+		return fmt.Errorf("passphrases do not match")
+	}
+	return b.Save(name, code, string(passphrase))
+}
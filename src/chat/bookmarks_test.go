@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBookmarks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), bookmarksFileName)
+	b := NewBookmarks(path)
+
+	bookmarks, err := b.List()
+	assert.Nil(t, err)
+	assert.Empty(t, bookmarks)
+
+	assert.Nil(t, b.Save("team", "1234-standup-secret", "hunter2"))
+	assert.Nil(t, b.Save("family", "5678-family-secret", "hunter3"))
+
+	// the code never touches the disk in plaintext
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "standup-secret")
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	_, err = b.Load("team", "wrong")
+	assert.NotNil(t, err)
+
+	code, err := b.Load("team", "hunter2")
+	assert.Nil(t, err)
+	assert.Equal(t, "1234-standup-secret", code)
+
+	bookmarks, err = b.List()
+	assert.Nil(t, err)
+	assert.Len(t, bookmarks, 2)
+	assert.Equal(t, "family", bookmarks[0].Name)
+	assert.True(t, bookmarks[0].LastUsed.IsZero())
+	assert.Equal(t, "team", bookmarks[1].Name)
+	assert.False(t, bookmarks[1].LastUsed.IsZero())
+
+	assert.Nil(t, b.Delete("team"))
+	_, err = b.Load("team", "hunter2")
+	assert.True(t, errors.Is(err, ErrNoBookmark))
+	assert.True(t, errors.Is(b.Delete("team"), ErrNoBookmark))
+}
@@ -2,24 +2,30 @@ package chat
 
 import (
 	"bufio"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/chzyer/readline"
 	"github.com/schollz/cli/v2"
+	"github.com/schollz/croc/v10/src/call"
 	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
 	"github.com/schollz/croc/v10/src/message"
 	"github.com/schollz/croc/v10/src/tcp"
+	"github.com/schollz/croc/v10/src/utils"
 	log "github.com/schollz/logger"
 )
 
@@ -77,21 +83,31 @@ const (
 	YellowColor  = "\033[33m"
 	MagentaColor = "\033[35m"
 	CyanColor    = "\033[36m"
+	StrikeStyle  = "\033[9m"
 )
 
-// Helper to wrap text in color.
+// Helper to wrap text in color. Without color, escape sequences already in
+// text are stripped too.
 func colorText(text, color string) string {
+	if !colorEnabled.Load() {
+		return stripANSI(text)
+	}
 	return fmt.Sprintf("%s%s%s", color, text, ResetColor)
 }
 
 // Helper to get current timestamp.
 func timestamp() string {
-	return colorText(time.Now().Format("15:04:05"), YellowColor)
+	return timestampAt(time.Now())
+}
+
+func timestampAt(t time.Time) string {
+	return colorText(t.Format("15:04:05"), YellowColor)
 }
 
 // StartChat initiates a chat session using the given shared code.
 // It uses a relay connection (configured via the croc options) and creates a room
-// based solely on the shared code.
+// based solely on the shared code. It returns once the user types /quit,
+// closes input or interrupts the session.
 func StartChat(cCtx *cli.Context, code string) error {
 	// For chat sessions, build options with IsChat true.
 	options := croc.Options{
@@ -101,217 +117,1114 @@ func StartChat(cCtx *cli.Context, code string) error {
 		RelayAddress6: cCtx.String("relay6"),
 		RelayPassword: cCtx.String("pass"),
 		IsChat:        true,
+		App:           tcp.ClientApp("croc-chat", cCtx.App.Version),
+		Observe:       cCtx.Bool("observe"),
+		DenyObservers: cCtx.Bool("no-observers"),
+		LowBandwidth:  cCtx.Bool("low-bandwidth"),
+	}
+	settings, configured, err := roomSettingsFlags(cCtx)
+	if err != nil {
+		return err
 	}
-	// Validate secret.
-	if len(options.SharedSecret) < 4 {
-		return fmt.Errorf("code is too short")
+	// Image offers carry a small preview unless the user opted out or
+	// saves bytes.
+	thumbnails := !cCtx.Bool("no-thumbnails") && !options.LowBandwidth
+	// Received files keep the sender's mode and times unless the room is
+	// not trusted with them.
+	metadata := metaPolicy{apply: !cCtx.Bool("no-file-metadata"), keepExec: cCtx.Bool("keep-exec-bit")}
+	setLanguage(detectLanguage(cCtx.String("lang")))
+	if err := requireE2E(cCtx.Bool("require-e2e")); err != nil {
+		return err
+	}
+	tty := detectTerminal(cCtx.Bool("no-color"), os.Stdin, os.Stdout, isTTY)
+	colorEnabled.Store(tty.color)
+	// Fetching titles contacts the linked sites, so it is opt-in.
+	linkPreviews := cCtx.Bool("link-previews")
+	alerts := &alerter{bell: cCtx.Bool("bell"), urgentMentions: cCtx.Bool("urgent-mentions"), now: time.Now}
+	// reactions are quiet unless asked for
+	reactionAlerts := cCtx.Bool("reaction-alerts")
+	if path, err := defaultQuietPath(); err == nil {
+		if quiet, err := loadQuietHours(path); err != nil {
+			fmt.Println(localize(msgQuietFailed, err))
+		} else {
+			alerts.setQuiet(quiet)
+		}
+	}
+	// Rules for received files: where to save them, or to decline them.
+	var fileRules []fileRule
+	rulesPath, err := defaultRulesPath()
+	if err == nil {
+		if fileRules, err = loadFileRules(rulesPath); err != nil {
+			fmt.Println(localize(msgRulesFailed, err))
+		}
 	}
-	// Compute room name using the full shared secret.
-	hashExtra := "croc"
-	roomNameBytes := sha256.Sum256([]byte(options.SharedSecret + hashExtra))
-	options.RoomName = hex.EncodeToString(roomNameBytes[:])
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Connect to the relay using the room name.
-	// Here we assume the relay is already running.
-	conn, banner, ip, err := tcp.ConnectToTCPServer(options.RelayAddress, options.RelayPassword, options.RoomName, 30*time.Second)
+	if !cCtx.Bool("no-preflight") {
+		address, err := preflight(options, preflightTimeout)
+		if err != nil {
+			return err
+		}
+		if address != "" {
+			options.RelayAddress = address
+		}
+	}
+	// One connection to the relay carries the chat and the transfers
+	// offered in it.
+	relay, err := croc.NewSession(options)
 	if err != nil {
 		return err
 	}
-	log.Debugf("chat connection established: banner='%s', externalIP=%s", banner, ip)
-	fmt.Printf("Joined chat room '%s'. Type your messages and press enter to send.\n", options.RoomName)
-	fmt.Println("To send a file, type '/sendfile <filepath>'")
+	defer relay.Close()
+	session, err := NewSession(ctx, relay.Options())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if cCtx.Bool("keep-identity") {
+		dir, err := defaultIdentityDir()
+		if err == nil {
+			err = session.KeepIdentity(dir)
+		}
+		if err != nil {
+			fmt.Println(localize(msgIdentityFailed, err))
+		}
+	}
+	if cCtx.Bool("direct") {
+		session.GoDirect(call.DataOptions{ICE: call.ICEOptions{Servers: call.ParseICEServers(cCtx.String("ice-servers"))}})
+	}
+	if configured {
+		if err := session.SetRoomSettings(settings); err != nil {
+			return err
+		}
+	}
+	// Someone may have guessed a weak code, so peers confirm each other
+	// before chatting.
+	if _, err := croc.ValidateCode(code); err != nil && !cCtx.Bool("no-confirm") {
+		session.RequireConfirmation()
+	}
+	if err := registerExternalCommands(session, cCtx.String("commands")); err != nil {
+		fmt.Println(localize(msgCommandsFailed, err))
+	}
+	fmt.Println(localize(msgJoined, session.RoomName()))
+	fmt.Println(session.Security().summary())
+	helps := []msgID{msgHelpSendFile, msgHelpTransfer, msgHelpPing, msgHelpLimit, msgHelpBookmark,
+		msgHelpSchedule, msgHelpIntegrity, msgHelpLinks, msgHelpEdit, msgHelpReact, msgHelpEmote, msgHelpEphemeral, msgHelpFind, msgHelpQuiet, msgHelpDND, msgHelpLayout, msgHelpTransfers, msgHelpRules, msgHelpStats, msgHelpSecurity, msgHelpQuit}
+	if session.ReadOnly() {
+		helps = []msgID{msgObserving}
+	} else if session.ConfirmationRequired() {
+		helps = append(helps, msgHelpConfirm, msgConfirmNeeded)
+	}
+	for _, help := range helps {
+		fmt.Println(localize(help))
+	}
+	if session.LowBandwidth() {
+		fmt.Println(localize(msgLowBandwidthOn))
+	}
 
 	// Prompt for alias at start.
 	var myAlias string
-	fmt.Print("Enter your alias: ")
+	fmt.Print(localize(msgEnterAlias))
 	fmt.Scanln(&myAlias)
-	fmt.Printf("Your alias is set to '%s'\n", colorText(myAlias, GreenColor))
+	fmt.Println(localize(msgAliasSet, colorText(myAlias, GreenColor)))
+	session.SetAlias(myAlias)
 
-	// Setup readline with a fancy dynamic prompt.
-	rlPrompt := fmt.Sprintf("%s %s> ", timestamp(), colorText(myAlias, GreenColor))
-	rl, err := readline.NewEx(&readline.Config{
-		Prompt: rlPrompt,
-	})
+	// Setup readline with a fancy dynamic prompt, or plain line input when
+	// not on a terminal. During do not disturb the prompt counts the
+	// messages held back.
+	dnd := &dndBuffer{}
+	prompt := func() string {
+		p := fmt.Sprintf("%s %s> ", timestamp(), colorText(session.Alias(), GreenColor))
+		if n := dnd.unread(); n > 0 {
+			p = colorText(localize(msgUnread, n), MagentaColor) + " " + p
+		}
+		return p
+	}
+	// Messages that arrive while the keyboard has been idle for a while are
+	// unread: a divider goes before the first, and on a terminal the title
+	// counts them, until the next keystroke.
+	unread := newUnreadTracker(time.Now)
+	var rl console
+	active := func() {
+		if unread.keystroke() {
+			if seq := unread.clearTitle(); seq != "" {
+				// called from readline's input loop, which Write waits on
+				go rl.Write([]byte(seq))
+			}
+		}
+	}
+	base, err := newConsole(tty, prompt(), active)
 	if err != nil {
 		return err
 	}
+	// consecutive messages from one sender share a header, except in
+	// output that scripts read
+	out := newRenderer(base)
+	if tty.interactive {
+		out.width = readline.GetScreenWidth
+	}
+	grouped := newGroupedConsole(out, !tty.interactive)
+	rl = grouped
 	defer rl.Close()
-
-	// Start a goroutine to receive chat messages and files with reconnection
+	defer func() {
+		if seq := unread.clearTitle(); seq != "" {
+			rl.Write([]byte(seq))
+		}
+	}()
+	// Closing readline unblocks the input loop when the session is
+	// interrupted from outside it.
 	go func() {
-		for {
-			data, err := conn.Receive()
-			if err != nil {
-				log.Errorf("error receiving message: %v", err)
-				rl.Write([]byte("\nPeer disconnected. Waiting for new connection...\n"))
-				rl.Refresh()
-				// reconnect loop
-				for {
-					newConn, newBanner, newIp, errReconnect := tcp.ConnectToTCPServer(options.RelayAddress, options.RelayPassword, options.RoomName, 30*time.Second)
-					if errReconnect != nil {
-						log.Errorf("reconnect failed: %v", errReconnect)
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					banner = newBanner
-					conn = newConn
-					rl.Write([]byte(fmt.Sprintf("\nReconnected to chat room '%s' at %s.\n", options.RoomName, newIp)))
-					rl.Refresh()
-					break
-				}
-				continue
+		<-ctx.Done()
+		rl.Close()
+	}()
+
+	transfers := newTransfers(session.options, func(line string) {
+		grouped.line(lineTransfer, fmt.Sprintf("%s %s", timestamp(), line))
+		rl.Refresh()
+	})
+
+	rtt := newRTTTracker()
+	links := &linkLog{}
+	var previews *previewer
+	if linkPreviews {
+		previews = newPreviewer(func(u, title string) {
+			grouped.line(linePreview, fmt.Sprintf("%s   %s: %s", timestamp(), u, colorText(title, MagentaColor)))
+			rl.Refresh()
+		})
+		defer previews.Close()
+	}
+	archives := newArchiveOffers()
+	alert := func(text string) {
+		if alerts.shouldAlert(text, session.Alias()) {
+			rl.Write([]byte(bell))
+		}
+	}
+	// markUnread is only called for messages the user reads; the divider
+	// is not a message, so it never makes it into the scrollback.
+	markUnread := func() {
+		count, divider := unread.arrived()
+		if divider {
+			rl.Write([]byte("\n" + colorText(localize(msgNewMessages), MagentaColor)))
+		}
+		if count > 0 && tty.interactive {
+			rl.Write([]byte(unread.title(count)))
+		}
+	}
+	warn := func(line string) {
+		grouped.line(lineWarning, fmt.Sprintf("%s %s", timestamp(), localize(msgWarning, line)))
+		rl.Refresh()
+	}
+	// Files sent and received with /sendfile go into the room's ledger,
+	// which is only written to disk while the room allows history.
+	ledgerPath, err := defaultLedgerPath(session.RoomName())
+	if err != nil {
+		fmt.Println(localize(msgLedgerFailed, err))
+	}
+	ledger, err := loadTransferLedger(ledgerPath)
+	if err != nil {
+		fmt.Println(localize(msgLedgerFailed, err))
+		ledger, _ = loadTransferLedger("")
+	}
+	ledger.persist = func() bool { return session.RoomSettings().History }
+	record := func(e ledgerEntry, result transferResult, err error) {
+		e.Time, e.Result = time.Now(), result
+		if err != nil {
+			e.Result, e.Error = transferFailed, err.Error()
+		}
+		if err := ledger.record(e); err != nil {
+			warn(localize(msgLedgerFailed, err))
+		}
+	}
+	// ask asks a question in the input loop; the next prompt replaces it
+	ask := func(question string) string {
+		if tty.interactive {
+			rl.SetPrompt(question)
+		} else {
+			rl.Write([]byte(question))
+		}
+		answer, _ := rl.Readline()
+		return answer
+	}
+
+	// show renders a received message. Messages replayed after do not
+	// disturb do not ring the bell again.
+	show := func(m message.Message, replay bool) {
+		alias := m.Alias
+		if alias == "" {
+			alias = "Peer"
+		}
+		if chained[m.Type] && session.Unverified(m) {
+			alias += " " + localize(msgUnverified)
+		}
+		ring := func(text string) {
+			if !replay {
+				markUnread()
+				alert(text)
 			}
-			var m message.Message
-			err = json.Unmarshal(data, &m)
-			if err != nil {
-				log.Debugf("failed to unmarshal message: %v", err)
-				continue
+		}
+		switch m.Type {
+		case typePing, typePresence:
+		case typePong:
+			if d, ok := rtt.pong(alias, m.Message); ok {
+				grouped.line(linePong, fmt.Sprintf("%s %s", timestamp(), localize(msgPong, colorText(alias, BlueColor), d.Round(time.Millisecond))))
+				rl.Refresh()
 			}
-			alias := m.Alias
-			if alias == "" {
-				alias = "Peer"
+		case typeAck:
+			for _, id := range ackIDs(m) {
+				rtt.ack(alias, id)
 			}
-			switch m.Type {
-			case "chat":
-				msg := fmt.Sprintf("%s [%s]: %s", timestamp(), colorText(alias, BlueColor), m.Message)
-				rl.Write([]byte("\n" + msg + "\n"))
+		case typeChatEdit:
+			grouped.line(lineEdit, fmt.Sprintf("%s [%s]: %s", timestamp(), colorText(alias, BlueColor), localize(msgEdited, highlightURLs(m.Message))))
+			rl.Refresh()
+		case typeChatDelete:
+			if e, ok := session.scrollback.get(m.ID); ok {
+				grouped.line(lineDelete, fmt.Sprintf("%s [%s]: %s", timestamp(), colorText(alias, BlueColor), localize(msgDeleted, colorText(e.Text, StrikeStyle))))
 				rl.Refresh()
-			case "chatfile":
-				// Using bufio to prompt for file acceptance and save location.
-				reader := bufio.NewReader(os.Stdin)
-				rl.Write([]byte(fmt.Sprintf("\n%s [%s] wants to send file '%s'. Accept file? (yes/no): ", timestamp(), colorText(alias, BlueColor), m.Message)))
+			}
+		case typeReaction:
+			e, ok := session.scrollback.get(m.ID)
+			if !ok {
+				return
+			}
+			if reactionAlerts && e.Own {
+				ring("")
+			}
+			summary := reactionSummary(e.Reactions)
+			if !grouped.react(m.ID, summary) {
+				grouped.line(lineReaction, fmt.Sprintf("%s %s", timestamp(), localize(msgReacted, colorText(alias, BlueColor), m.Message, excerpt(e.Text), summary)))
+			}
+			rl.Refresh()
+		case "chat":
+			if isEphemeral(m) {
+				// an ephemeral message is shown and nothing more: its
+				// text is kept out of alerts and the link log
+				text := session.scrollback.showEphemeral(m, highlightURLs(m.Message))
+				ring("")
+				grouped.writeChat(m.ID, alias, text, time.Now())
 				rl.Refresh()
-				resp, _ := reader.ReadString('\n')
-				resp = strings.TrimSpace(resp)
-				if strings.ToLower(resp) != "yes" {
-					rl.Write([]byte("File transfer declined.\n"))
-					rl.Refresh()
-					continue
+				return
+			}
+			ring(m.Message)
+			grouped.writeChat(m.ID, alias, highlightURLs(m.Message), time.Now())
+			rl.Refresh()
+			urls := findURLs(m.Message)
+			links.add(alias, urls, time.Now())
+			if previews != nil {
+				for _, u := range urls {
+					previews.queue(u)
 				}
-				rl.Write([]byte("Enter directory to save file: "))
+			}
+		case typeEmote:
+			text := renderEmote(m, alias)
+			if isEphemeral(m) {
+				text = session.scrollback.showEphemeral(m, text)
+				ring("")
+			} else {
+				ring(m.Message)
+			}
+			grouped.line(lineEmote, fmt.Sprintf("%s %s", timestamp(), text))
+			rl.Refresh()
+		case "chatfile":
+			ring(m.Message)
+			showThumbnail(rl, m)
+			if session.ReadOnly() {
+				grouped.line(lineFile, fmt.Sprintf("%s %s", timestamp(), localize(msgObserverNoFiles, colorText(alias, BlueColor), m.Message)))
 				rl.Refresh()
-				saveDir, _ := reader.ReadString('\n')
-				saveDir = strings.TrimSpace(saveDir)
-				if saveDir == "" {
-					saveDir = "chat_received_files"
-				}
-				os.MkdirAll(saveDir, 0755)
-				filePath := filepath.Join(saveDir, m.Message)
-				err = os.WriteFile(filePath, m.Bytes, 0644)
-				if err != nil {
-					rl.Write([]byte(fmt.Sprintf("Failed to save file '%s': %v\n", m.Message, err)))
-				} else {
-					rl.Write([]byte(fmt.Sprintf("%s [%s] sent file '%s'. Saved to %s\n", timestamp(), colorText(alias, BlueColor), m.Message, filePath)))
+				return
+			}
+			received := ledgerEntry{Direction: transferReceived, Name: m.Message, Size: int64(len(m.Bytes)), SHA256: fileDigest(m.Bytes)}
+			decision := decideFile(fileRules, m)
+			if decision.action == ruleSaveTo && session.LowBandwidth() {
+				// every file is confirmed by hand
+				decision.action = ""
+			}
+			rule := ""
+			if decision.rule > 0 {
+				rule = " " + localize(msgFileRule, decision.rule, fileRules[decision.rule-1])
+			}
+			switch decision.action {
+			case ruleDecline:
+				if decision.err != nil {
+					rule = " (" + decision.err.Error() + ")"
 				}
+				grouped.line(lineFile, fmt.Sprintf("%s %s%s", timestamp(), localize(msgFileRuleDecline, colorText(alias, BlueColor), m.Message), rule))
 				rl.Refresh()
-			case "encrypted":
-				reader := bufio.NewReader(os.Stdin)
-				rl.Write([]byte(fmt.Sprintf("\n%s Encrypted message from [%s]. Enter decryption key: ", timestamp(), colorText(alias, BlueColor))))
-				rl.Refresh()
-				key, _ := reader.ReadString('\n')
-				key = strings.TrimSpace(key)
-				plain, err := decrypt(m.Message, key)
+				record(received, transferDeclined, nil)
+				return
+			case ruleSaveTo:
+				filePath, err := metadata.saveFile(decision.dir, m)
+				received.Path = filePath
+				record(received, transferDone, err)
 				if err != nil {
-					rl.Write([]byte(fmt.Sprintf("Failed to decrypt message: %v\n", err)))
+					grouped.line(lineFile, localize(msgFileSaveFailed, m.Message, err)+rule)
 				} else {
-					rl.Write([]byte(fmt.Sprintf("%s [%s]: %s\n", timestamp(), colorText(alias, BlueColor), plain)))
+					grouped.line(lineFile, fmt.Sprintf("%s %s%s", timestamp(), localize(msgFileSaved, colorText(alias, BlueColor), m.Message, filePath), rule))
 				}
 				rl.Refresh()
-			default:
-				msg := fmt.Sprintf("%s [%s unknown]: %s", timestamp(), colorText(alias, BlueColor), m.Message)
-				rl.Write([]byte("\n" + msg + "\n"))
+				return
+			}
+			// Using bufio to prompt for file acceptance and save location.
+			reader := bufio.NewReader(os.Stdin)
+			offer := localize(msgFileOffer, colorText(alias, BlueColor), m.Message, yesNo())
+			if session.LowBandwidth() {
+				offer = localize(msgFileOfferSize, colorText(alias, BlueColor), m.Message, offerSize(received.Size, true), yesNo())
+			}
+			rl.Write([]byte(fmt.Sprintf("\n%s%s %s", timestamp(), rule, offer)))
+			rl.Refresh()
+			resp, _ := reader.ReadString('\n')
+			if !isYes(resp) {
+				rl.Write([]byte(localize(msgFileDeclined) + "\n"))
 				rl.Refresh()
+				record(received, transferDeclined, nil)
+				return
+			}
+			rl.Write([]byte(localize(msgFileSaveDir)))
+			rl.Refresh()
+			saveDir, _ := reader.ReadString('\n')
+			saveDir = strings.TrimSpace(saveDir)
+			if saveDir == "" {
+				saveDir = "chat_received_files"
+			}
+			filePath, err := metadata.saveFile(saveDir, m)
+			received.Path = filePath
+			record(received, transferDone, err)
+			if err != nil {
+				rl.Write([]byte(localize(msgFileSaveFailed, m.Message, err) + "\n"))
+			} else {
+				rl.Write([]byte(fmt.Sprintf("%s %s\n", timestamp(), localize(msgFileSaved, colorText(alias, BlueColor), m.Message, filePath))))
+			}
+			rl.Refresh()
+		case typeChatArchive:
+			info, err := archives.received(m)
+			if err != nil {
+				log.Debugf("ignoring archive offer: %v", err)
+				return
+			}
+			ring(info.Name)
+			grouped.line(lineFile, fmt.Sprintf("%s %s", timestamp(),
+				localize(msgFolderOffer, colorText(alias, BlueColor), info.Name, info.Files, offerSize(info.Size, session.LowBandwidth()), shortID(m.ID))))
+			rl.Refresh()
+		case typeTransferOffer:
+			offer, err := transfers.received(m)
+			if err != nil {
+				log.Debugf("ignoring transfer offer: %v", err)
+				return
+			}
+			ring(offer.Name)
+			grouped.line(lineFile, fmt.Sprintf("%s %s", timestamp(),
+				localize(msgTransferOffer, colorText(alias, BlueColor), offer.Name, offerSize(offer.Size, session.LowBandwidth()), offer.ID)))
+			showThumbnail(rl, m)
+			rl.Refresh()
+		case "encrypted":
+			reader := bufio.NewReader(os.Stdin)
+			rl.Write([]byte(fmt.Sprintf("\n%s %s", timestamp(), localize(msgEncryptedFrom, colorText(alias, BlueColor)))))
+			rl.Refresh()
+			key, _ := reader.ReadString('\n')
+			key = strings.TrimSpace(key)
+			plain, err := decrypt(m.Message, key)
+			if ttl, _ := ephemeralTTL(m); err == nil && ttl > 0 {
+				plain += " " + localize(msgEphemeralMarker, ttl)
+			}
+			if err != nil {
+				rl.Write([]byte(localize(msgDecryptFailed, err) + "\n"))
+			} else {
+				rl.Write([]byte(fmt.Sprintf("%s [%s]: %s\n", timestamp(), colorText(alias, BlueColor), plain)))
 			}
+			rl.Refresh()
+		default:
+			// the content of a type this version does not know is not shown
+			grouped.line(lineUnknown, fmt.Sprintf("%s %s", timestamp(), localize(msgUnknownType, colorText(alias, BlueColor), m.Type)))
+			rl.Refresh()
 		}
-	}()
+	}
 
-	// Chat input loop with dynamic prompt update.
+	// Receive chat messages and files; the session reconnects on its own.
+	// Messages held for do not disturb are acked and recorded right away,
+	// only the prompt shows they are there.
+	session.Start(func(m message.Message) {
+		alias := m.Alias
+		if alias == "" {
+			alias = "Peer"
+		}
+		rtt.seen(alias)
+		if presenceHas(m, presenceObserver) {
+			rtt.observing(alias)
+		}
+		if presenceHas(m, presenceLowBandwidth) && rtt.lowBandwidth(alias) {
+			grouped.line(lineSession, localize(msgPeerLowBandwidth, colorText(alias, BlueColor)))
+			rl.Refresh()
+		}
+		session.Answer(m)
+		if dnd.hold(m) {
+			rl.SetPrompt(prompt())
+			rl.Refresh()
+			return
+		}
+		show(m, false)
+	}, func(status string) {
+		grouped.line(lineSession, status)
+		rl.Refresh()
+	})
+
+	// Chat input loop with dynamic prompt update. Readline reports Ctrl-C
+	// as ErrInterrupt and Ctrl-D as io.EOF; both end the session like /quit.
 	for {
-		rl.SetPrompt(fmt.Sprintf("%s %s> ", timestamp(), colorText(myAlias, GreenColor)))
+		rl.SetPrompt(prompt())
 		line, err := rl.Readline()
 		if err != nil {
 			break
 		}
+		// piped input has no keystrokes, only lines
+		active()
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
+		if session.ReadOnly() && !observerAllows(line) {
+			fmt.Println(localize(msgObserverOnly))
+			continue
+		}
+		line, _ = expandShortcut(line)
+		cmd, err := parseCommand(line)
+		if err != nil {
+			fmt.Println(usageText(err))
+			continue
+		}
+		if cmd.name == "quit" {
+			break
+		}
 		// Allow updating alias.
-		if strings.HasPrefix(line, "/setalias ") {
-			myAlias = strings.TrimSpace(strings.TrimPrefix(line, "/setalias "))
-			fmt.Printf("Alias updated to '%s'\n", colorText(myAlias, GreenColor))
+		if cmd.name == "setalias" {
+			myAlias = strings.Join(cmd.args, " ")
+			session.SetAlias(myAlias)
+			fmt.Println(localize(msgAliasUpdated, colorText(myAlias, GreenColor)))
 			continue
 		}
-		// Send encrypted message.
-		if strings.HasPrefix(line, "/encrypt ") {
-			parts := strings.SplitN(line, " ", 3)
-			if len(parts) < 3 {
-				fmt.Println("Usage: /encrypt <secret> <message>")
+		// Measure the round trip to every peer through the relay.
+		if cmd.name == "ping" {
+			nonce := newMessageID()
+			rtt.sent(nonce)
+			if err := session.Send(message.Message{Type: typePing, Message: nonce}); err != nil {
+				log.Errorf("error sending ping: %v", err)
+				continue
+			}
+			time.AfterFunc(probeTimeout, func() {
+				if rtt.answered(nonce) == 0 {
+					grouped.line(linePong, fmt.Sprintf("%s %s", timestamp(), localize(msgNoPong, probeTimeout)))
+					rl.Refresh()
+				}
+			})
+			continue
+		}
+		// Change the process-wide outbound bandwidth budget.
+		if cmd.name == "limit" {
+			arg := cmd.arg(0)
+			if arg == "" {
+				fmt.Println(localize(msgLimitShow, formatLimit(bandwidth.Default.Limit())))
+				continue
+			}
+			limit, err := bandwidth.ParseLimit(arg)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			bandwidth.Default.SetLimit(limit)
+			fmt.Println(localize(msgLimitSet, formatLimit(limit)))
+			continue
+		}
+		// Time the relay on a connection of its own, leaving the room alone.
+		if cmd.name == "relay" {
+			timing, err := tcp.MeasureRelay(options.RelayAddress, options.RelayPassword)
+			if err != nil {
+				fmt.Println(localize(msgRelayError, options.RelayAddress, err))
+				continue
+			}
+			fmt.Println(localize(msgRelayTiming, options.RelayAddress,
+				formatRTT(timing.Ping), formatRTT(timing.Handshake()), formatRTT(timing.Dial), formatRTT(timing.PAKE), formatRTT(timing.Auth)))
+			continue
+		}
+		// List peers with their latency.
+		if cmd.name == "who" {
+			peers := rtt.list()
+			if len(peers) == 0 {
+				fmt.Println(localize(msgNoPeers))
+			}
+			for _, p := range peers {
+				alias := colorText(p.Alias, BlueColor)
+				if p.Observer {
+					alias += " " + localize(msgObserverTag)
+				}
+				if p.LowBandwidth {
+					alias += " " + localize(msgLowBandwidthTag)
+				}
+				fmt.Println(localize(msgPeer, alias,
+					time.Since(p.LastSeen).Round(time.Second), formatRTT(p.Ping), formatRTT(p.Passive)))
+			}
+			continue
+		}
+		// List recent links with indexes for copying.
+		if cmd.name == "links" {
+			recent := links.list()
+			if len(recent) == 0 {
+				fmt.Println(localize(msgNoLinks))
+			}
+			for i, l := range recent {
+				fmt.Printf("[%d] %s  %s  %s\n", i+1, l.At.Format("15:04:05"), colorText(l.Alias, BlueColor), l.URL)
+			}
+			continue
+		}
+		// Queue a message to be sent later.
+		if cmd.name == "schedule" {
+			at, err := parseSchedule(cmd.arg(0), time.Now())
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			item := session.Schedule(at, cmd.arg(1))
+			fmt.Println(localize(msgScheduled, shortID(item.ID), at.Format("2006-01-02 15:04:05")))
+			continue
+		}
+		if cmd.name == "scheduled" {
+			items := session.Scheduled()
+			if len(items) == 0 {
+				fmt.Println(localize(msgNoScheduled))
+			}
+			for _, item := range items {
+				fmt.Printf("%s  %s  %s\n", shortID(item.ID), item.At.Format("2006-01-02 15:04:05"), item.Text)
+			}
+			continue
+		}
+		if cmd.name == "unschedule" {
+			item, err := session.Unschedule(cmd.arg(0))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(localize(msgUnscheduled, shortID(item.ID)))
+			continue
+		}
+		// Change or withdraw a message this session sent.
+		if cmd.name == "edit" {
+			text := cmd.arg(1)
+			if _, err := session.Edit(cmd.arg(0), text); err != nil {
+				fmt.Println(localize(msgChangeFailed, err))
+				continue
+			}
+			fmt.Println(localize(msgEdited, text))
+			continue
+		}
+		if cmd.name == "delete" {
+			id, err := session.Delete(cmd.arg(0))
+			if err != nil {
+				fmt.Println(localize(msgChangeFailed, err))
+				continue
+			}
+			e, _ := session.scrollback.get(id)
+			fmt.Println(localize(msgDeleted, colorText(e.Text, StrikeStyle)))
+			continue
+		}
+		if cmd.name == "react" {
+			e, err := session.React(cmd.arg(0), cmd.arg(1))
+			if errors.Is(err, ErrUnconfirmed) {
+				fmt.Println(localize(msgConfirmFirst))
+				continue
+			}
+			if err != nil {
+				fmt.Println(localize(msgReactFailed, err))
 				continue
 			}
-			secret := parts[1]
-			plaintext := parts[2]
-			cipherText, err := encrypt(plaintext, secret)
+			fmt.Println(localize(msgReactedOwn, excerpt(e.Text), reactionSummary(e.Reactions)))
+			continue
+		}
+		if cmd.name == "mine" {
+			mine := session.scrollback.own()
+			if len(mine) == 0 {
+				fmt.Println(localize(msgNoOwnMessages))
+			}
+			for _, e := range mine {
+				text := e.Text
+				if e.Edited {
+					text = localize(msgEdited, text)
+				}
+				if summary := reactionSummary(e.Reactions); summary != "" {
+					text += " " + summary
+				}
+				fmt.Printf("%s  %s  %s\n", shortID(e.ID), e.At.Format("15:04:05"), text)
+			}
+			continue
+		}
+		// Search the recent messages. Results are only printed, so they
+		// neither ring the bell nor send acks.
+		if cmd.name == "find" {
+			q, err := parseFind(cmd, time.Now())
 			if err != nil {
-				fmt.Printf("Encryption error: %v\n", err)
+				fmt.Println(usageText(err))
 				continue
 			}
-			encMsg := message.Message{
-				Type:    "encrypted",
-				Message: cipherText,
-				Alias:   myAlias,
+			found, more, err := session.scrollback.find(q, findLimit, time.Now().Add(findTimeout))
+			if len(found) == 0 && err == nil {
+				fmt.Println(localize(msgFindNone))
+			}
+			for _, e := range found {
+				alias, text := e.Alias, e.Text
+				if alias == "" {
+					alias = "Peer"
+				}
+				if e.Edited {
+					text = localize(msgEdited, text)
+				}
+				if summary := reactionSummary(e.Reactions); summary != "" {
+					text += " " + summary
+				}
+				fmt.Printf("%s  %s  [%s]: %s\n", shortID(e.ID), e.At.Format("2006-01-02 15:04:05"), colorText(alias, BlueColor), text)
+			}
+			if more {
+				fmt.Println(localize(msgFindMore, findLimit))
 			}
-			data, err := json.Marshal(encMsg)
 			if err != nil {
-				log.Errorf("error marshaling encrypted message: %v", err)
+				fmt.Println(localize(msgFindTimeout, findTimeout))
+			}
+			continue
+		}
+		// List the rules for received files.
+		if cmd.name == "rules" {
+			if len(fileRules) == 0 {
+				fmt.Println(localize(msgRulesNone))
+				continue
+			}
+			fmt.Println(localize(msgRulesList, rulesPath))
+			for i, r := range fileRules {
+				fmt.Printf("  %d. %s\n", i+1, r)
+			}
+			continue
+		}
+		// Mute the bell at night, or show or end the quiet hours.
+		if cmd.name == "quiet" {
+			switch arg := strings.Join(cmd.args, " "); arg {
+			case "":
+				if quiet := alerts.quietHours(); quiet != nil {
+					fmt.Println(localize(msgQuietShow, quiet))
+				} else {
+					fmt.Println(localize(msgQuietNone))
+				}
+			case "off":
+				alerts.setQuiet(nil)
+				fmt.Println(localize(msgQuietOff))
+			default:
+				quiet, err := parseQuietHours(arg)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				alerts.setQuiet(&quiet)
+				fmt.Println(localize(msgQuietSet, quiet))
+			}
+			continue
+		}
+		// Keep status lines apart from the conversation, or inline again.
+		if cmd.name == "layout" {
+			arg := cmd.arg(0)
+			if arg == "" {
+				fmt.Println(localize(msgLayoutShow, out.currentLayout()))
+				continue
+			}
+			l, ok := parseLayout(arg)
+			if !ok {
+				fmt.Println(localize(msgLayoutUsage))
+				continue
+			}
+			if !out.setLayout(l) {
+				fmt.Println(localize(msgLayoutNoTerminal))
+				continue
+			}
+			fmt.Println(localize(msgLayoutShow, l))
+			continue
+		}
+		// Show the bytes the session sent and received.
+		if cmd.name == "stats" {
+			sent, received := session.Traffic()
+			printTraffic(os.Stdout, sent, received, session.LowBandwidth())
+			continue
+		}
+		// Show what protects the session.
+		if cmd.name == "security" {
+			printSecurity(os.Stdout, session.Security(), cmd.has("--json"))
+			continue
+		}
+		// List the files the room exchanged.
+		if cmd.name == "transfers" {
+			printTransfers(os.Stdout, ledger.list(), cmd.has("--json"))
+			continue
+		}
+		// Hold back incoming messages, or show the ones that came in.
+		if cmd.name == "dnd" {
+			switch cmd.arg(0) {
+			case "":
+				if dnd.enabled() {
+					fmt.Println(localize(msgDNDOn))
+				} else {
+					fmt.Println(localize(msgDNDOff))
+				}
+			case "on":
+				dnd.enable()
+				fmt.Println(localize(msgDNDOn))
+			case "off":
+				dnd.release(func(messages []message.Message, dropped int) {
+					if len(messages)+dropped == 0 {
+						fmt.Println(localize(msgDNDNothing))
+						return
+					}
+					rl.Write([]byte(colorText(localize(msgDNDDivider, len(messages)+dropped), MagentaColor) + "\n"))
+					if dropped > 0 {
+						rl.Write([]byte(localize(msgDNDDropped, dropped) + "\n"))
+					}
+					for _, m := range messages {
+						show(m, true)
+					}
+				})
+			default:
+				fmt.Println(localize(msgDNDUsage))
+			}
+			continue
+		}
+		// Confirm the fingerprints shown for new peers.
+		if cmd.name == "confirm" {
+			if !session.ConfirmationRequired() {
+				fmt.Println(localize(msgConfirmOff))
 				continue
 			}
-			if err = conn.Send(data); err != nil {
+			confirmed := session.Confirm()
+			if len(confirmed) == 0 {
+				fmt.Println(localize(msgConfirmNone))
+			}
+			for _, p := range confirmed {
+				fmt.Println(localize(msgConfirmed, colorText(p.Alias, BlueColor), p.Fingerprint))
+			}
+			continue
+		}
+		// Print the integrity chain head for peers to compare.
+		if cmd.name == "integrity" {
+			head, n := session.Integrity()
+			fmt.Println(localize(msgChainHead, head, n))
+			continue
+		}
+		// Export the conversation, optionally with its integrity chain.
+		if cmd.name == "save" {
+			path := cmd.arg(0)
+			if err := session.SaveTranscript(path, cmd.has("--signed")); errors.Is(err, ErrHistoryDisabled) {
+				fmt.Println(localize(msgHistoryDisabled))
+				continue
+			} else if err != nil {
+				fmt.Println(localize(msgSaveFailed, err))
+				continue
+			}
+			fmt.Println(localize(msgSaved, path))
+			continue
+		}
+		// Save the room's code, encrypted with a local passphrase.
+		if cmd.name == "bookmark" {
+			name := cmd.arg(0)
+			if err := saveBookmark(rl, name, options.SharedSecret); err != nil {
+				fmt.Println(localize(msgBookmarkFailed, err))
+				continue
+			}
+			fmt.Println(localize(msgBookmarkSaved, name, name))
+			continue
+		}
+		if cmd.name == "bookmarks" {
+			if err := PrintBookmarks(os.Stdout); err != nil {
+				fmt.Println(localize(msgBookmarksFailed, err))
+			}
+			continue
+		}
+		// Send an action, shown as "* alias action".
+		if cmd.name == "me" {
+			m, ok := emoteMessage(session.Alias(), cmd.arg(0))
+			if !ok {
+				fmt.Println(localize(msgEmoteUsage))
+				continue
+			}
+			rtt.sent(m.ID)
+			if err := session.Send(m); err != nil {
+				log.Errorf("error sending emote: %v", err)
+			}
+			continue
+		}
+		// Send encrypted message.
+		if cmd.name == "encrypt" {
+			encMsg, ok := encryptedMessage(cmd)
+			if !ok {
+				continue
+			}
+			if err := session.Send(encMsg); err != nil {
 				log.Errorf("error sending encrypted message: %v", err)
 			}
 			continue
 		}
+		// Send a message everyone forgets after a while, encrypted too
+		// if it is an /encrypt command.
+		if cmd.name == "ephemeral" {
+			ttl, err := parseEphemeral(cmd.arg(0))
+			if err != nil {
+				fmt.Println(usageText(err))
+				continue
+			}
+			text, _ := expandShortcut(cmd.arg(1))
+			m := message.Message{Type: "chat", Message: text, ID: newMessageID()}
+			inner, err := parseCommand(text)
+			if err != nil && (inner.name == "encrypt" || inner.name == "me") {
+				fmt.Println(usageText(err))
+				continue
+			}
+			if inner.name == "encrypt" {
+				var ok bool
+				if m, ok = encryptedMessage(inner); !ok {
+					continue
+				}
+			} else {
+				if inner.name == "me" {
+					m, _ = emoteMessage(session.Alias(), inner.arg(0))
+				}
+				rtt.sent(m.ID)
+			}
+			makeEphemeral(&m, ttl)
+			if err := session.Send(m); err != nil {
+				log.Errorf("error sending ephemeral message: %v", err)
+				continue
+			}
+			fmt.Println(localize(msgEphemeralSent, ttl))
+			continue
+		}
 		// Send file command.
-		if strings.HasPrefix(line, "/sendfile ") {
-			filePath := strings.TrimSpace(strings.TrimPrefix(line, "/sendfile "))
+		if cmd.name == "sendfile" {
+			filePath := cmd.arg(0)
+			format := archiveTar
+			if cmd.has("--zip") {
+				format = archiveZip
+			}
+			if fi, err := os.Stat(filePath); err == nil && fi.IsDir() {
+				archive, info, err := newArchiveFile(filePath, format, warn)
+				if err != nil {
+					fmt.Println(localize(msgArchiveFailed, filePath, err))
+					continue
+				}
+				sent := ledgerEntry{Direction: transferSent, Name: info.Name, Size: info.Size, SHA256: info.SHA256}
+				if !ledger.confirmResend(info.Name, info.SHA256, ask) {
+					removeArchiveFile(archive)
+					fmt.Println(localize(msgLedgerSkipped, info.Name))
+					record(sent, transferCancelled, nil)
+					continue
+				}
+				archiveMsg, err := transfers.offerArchive(archive, info)
+				if err != nil {
+					fmt.Println(localize(msgArchiveFailed, filePath, err))
+					continue
+				}
+				err = session.Send(archiveMsg)
+				record(sent, transferDone, err)
+				if err != nil {
+					log.Errorf("error sending folder: %v", err)
+					continue
+				}
+				fmt.Println(localize(msgFolderSent, info.Name, info.Files, utils.ByteCountDecimal(info.Size)))
+				continue
+			}
 			content, err := os.ReadFile(filePath)
 			if err != nil {
-				fmt.Printf("Error reading file %s: %v\n", filePath, err)
+				fmt.Println(localize(msgReadFailed, filePath, err))
+				continue
+			}
+			fi, err := os.Stat(filePath)
+			if err != nil {
+				fmt.Println(localize(msgReadFailed, filePath, err))
 				continue
 			}
 			_, fname := filepath.Split(filePath)
+			sent := ledgerEntry{Direction: transferSent, Name: fname, Size: int64(len(content)), SHA256: fileDigest(content)}
+			if !ledger.confirmResend(fname, sent.SHA256, ask) {
+				fmt.Println(localize(msgLedgerSkipped, fname))
+				record(sent, transferCancelled, nil)
+				continue
+			}
 			chatFileMsg := message.Message{
 				Type:    "chatfile",
 				Message: fname,
 				Bytes:   content,
-				Alias:   myAlias,
+				ID:      newMessageID(),
+			}
+			attachFileMeta(&chatFileMsg, fi, content)
+			if thumbnails {
+				attachThumbnail(&chatFileMsg, filePath, warn)
 			}
-			data, err := json.Marshal(chatFileMsg)
+			rtt.sent(chatFileMsg.ID)
+			err = session.Send(chatFileMsg)
+			record(sent, transferDone, err)
 			if err != nil {
-				log.Errorf("error marshaling file message: %v", err)
+				log.Errorf("error sending file message: %v", err)
 				continue
 			}
-			if err = conn.Send(data); err != nil {
-				log.Errorf("error sending file message: %v", err)
+			fmt.Println(localize(msgFileSent, fname))
+			continue
+		}
+		// Save or unpack a folder sent with /sendfile, or pipe it elsewhere.
+		if cmd.name == "accept" {
+			r, err := parseAccept(cmd)
+			if errors.Is(err, errUsage) {
+				fmt.Println(usageText(err))
+				continue
+			}
+			if err != nil {
+				fmt.Println(localize(msgAcceptFailed, err))
+				continue
+			}
+			if r.stdout || r.command != nil {
+				acceptPiped(ctx, transfers, archives, r, tty.interactive)
+				continue
+			}
+			dir := "chat_received_files"
+			if r.dir != "" {
+				dir = r.dir
+			}
+			info, err := archives.accept(transfers, r.id, dir, r.extract, metadata, warn, func(path string, files int, info archiveInfo, err error) {
+				record(ledgerEntry{Direction: transferReceived, Name: info.Name, Size: info.Size, SHA256: info.SHA256, Path: path}, transferDone, err)
+				if err != nil {
+					fmt.Println(localize(msgAcceptFailed, err))
+					return
+				}
+				fmt.Println(localize(msgAccepted, files, path))
+			})
+			if err != nil {
+				if info.Name != "" {
+					record(ledgerEntry{Direction: transferReceived, Name: info.Name, Size: info.Size, SHA256: info.SHA256}, transferDone, err)
+				}
+				fmt.Println(localize(msgAcceptFailed, err))
+			}
+			continue
+		}
+		// Send a file or folder through croc's transfer engine.
+		if cmd.name == "transfer" {
+			fpath := cmd.arg(0)
+			offer, err := transfers.send(fpath, myAlias)
+			if err != nil {
+				fmt.Println(localize(msgTransferFailed, fpath, err))
+				continue
+			}
+			if thumbnails {
+				attachThumbnail(&offer, fpath, warn)
+			}
+			if err := session.Send(offer); err != nil {
+				log.Errorf("error sending transfer offer: %v", err)
+				continue
+			}
+			fmt.Println(localize(msgTransferOffered, offer.Message, utils.ByteCountDecimal(int64(offer.Num))))
+			continue
+		}
+		// Receive a file offered with /transfer.
+		if cmd.name == "get" {
+			dir := "."
+			if len(cmd.args) == 2 {
+				dir = cmd.arg(1)
+			}
+			if err := transfers.get(cmd.arg(0), dir); err != nil {
+				fmt.Println(localize(msgGetFailed, err))
+			}
+			continue
+		}
+		// Commands the chat does not know go to the plugins.
+		if handled, err := session.runCommand(line); handled {
+			if err != nil {
+				name, _ := commandName(line)
+				fmt.Println(localize(msgCommandFailed, name, err))
 			}
-			fmt.Printf("Sent file '%s'\n", fname)
 			continue
 		}
 		// Otherwise, send standard chat message.
 		chatMsg := message.Message{
 			Type:    "chat",
 			Message: line,
-			Alias:   myAlias,
+			ID:      newMessageID(),
 		}
-		data, err := json.Marshal(chatMsg)
-		if err != nil {
-			log.Errorf("error marshaling chat message: %v", err)
+		rtt.sent(chatMsg.ID)
+		if err := session.Send(chatMsg); errors.Is(err, ErrUnconfirmed) {
+			fmt.Println(localize(msgConfirmFirst))
 			continue
-		}
-		if err = conn.Send(data); err != nil {
+		} else if err != nil {
 			log.Errorf("error sending chat message: %v", err)
 			continue
 		}
 	}
 	return nil
 }
+
+// encryptedMessage builds the message of an /encrypt command, or prints
+// why it cannot.
+func encryptedMessage(c commandArgs) (message.Message, bool) {
+	cipherText, err := encrypt(c.arg(1), c.arg(0))
+	if err != nil {
+		fmt.Println(localize(msgEncryptFailed, err))
+		return message.Message{}, false
+	}
+	return message.Message{
+		Type:    "encrypted",
+		Message: cipherText,
+	}, true
+}
+
+// registerExternalCommands adds the commands configured in the file at
+// path, or in croc's config directory when path is empty.
+func registerExternalCommands(session *Session, path string) (err error) {
+	if path == "" {
+		if path, err = DefaultCommandsPath(); err != nil {
+			return
+		}
+	}
+	commands, err := LoadCommands(path)
+	if err != nil {
+		return
+	}
+	var errs []error
+	for name, c := range commands {
+		errs = append(errs, session.RegisterCommand(name, c.Handler()))
+	}
+	return errors.Join(errs...)
+}
+
+// showThumbnail prints the preview carried by an offer, if any.
+func showThumbnail(rl console, m message.Message) {
+	t, err := thumbnailFrom(m)
+	if err != nil {
+		log.Debugf("ignoring thumbnail: %v", err)
+		return
+	}
+	if t == nil {
+		return
+	}
+	if !colorEnabled.Load() {
+		// the preview is made of escape sequences, so only describe it
+		rl.Write([]byte(fmt.Sprintf("\n%s\n", describeThumbnail(t))))
+		return
+	}
+	preview, err := renderThumbnail(t)
+	if err != nil {
+		log.Debugf("could not render thumbnail: %v", err)
+		return
+	}
+	rl.Write([]byte(fmt.Sprintf("\n%s\n%s", describeThumbnail(t), preview)))
+}
+
+// formatLimit renders a bandwidth budget for /limit.
+func formatLimit(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return utils.ByteCountDecimal(limit) + "/s"
+}
+
+// formatRTT renders a round trip for /who.
+func formatRTT(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,238 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// typeConfirm carries the peer confirmation of rooms with weak codes.
+// Message is the kind of confirmation message. A hello only makes the
+// session id it is signed with known; a confirmation says the sender
+// confirmed the fingerprint in Meta with the session whose id is ID.
+//
+// Each pair of sessions derives a fingerprint from the code and both
+// session keys and shows it to its user, who compares it with the peer
+// over another channel and types /confirm. Until then the session sends
+// nothing of the conversation, and messages from peers it has not
+// confirmed are marked unverified. Someone who guessed a weak code and
+// sits between the peers has a key of its own, so each side sees a
+// different fingerprint.
+const typeConfirm message.Type = "chat_confirm"
+
+// Kinds of confirmation messages.
+const (
+	confirmHello = "hello"
+	confirmDone  = "confirmed"
+)
+
+// ErrUnconfirmed is returned by Send for conversation messages while a
+// session that requires confirmation has peers the user did not confirm.
+var ErrUnconfirmed = errors.New("confirm the peer fingerprints with /confirm first")
+
+// PeerFingerprint is the fingerprint a session shares with a peer.
+type PeerFingerprint struct {
+	Alias       string
+	Session     string
+	Fingerprint string
+}
+
+// fingerprint derives the fingerprint of the sessions a and b in the room
+// of secret. It does not depend on the order of the two, so both peers
+// see the same one.
+func fingerprint(secret, a, b string) string {
+	ids := []string{a, b}
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, field := range []string{"croc chat confirmation", secret, ids[0], ids[1]} {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(field))))
+		h.Write([]byte(field))
+	}
+	n := binary.BigEndian.Uint64(h.Sum(nil)) % 1_000_000_000_000
+	return fmt.Sprintf("%04d %04d %04d", n/100_000_000, n/10_000%10_000, n%10_000)
+}
+
+// confirmPeer is a peer session as far as confirmation goes.
+type confirmPeer struct {
+	alias     string
+	confirmed bool
+}
+
+// peerConfirm is the confirmation state of a session. It lives as long
+// as the session, so confirmed peers stay confirmed across reconnects; a
+// peer that comes back with another key is a new peer to confirm.
+type peerConfirm struct {
+	mu       sync.Mutex
+	required bool
+	secret   string
+	peers    map[string]*confirmPeer
+}
+
+func (pc *peerConfirm) require(secret string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.required, pc.secret = true, secret
+	pc.peers = make(map[string]*confirmPeer)
+}
+
+func (pc *peerConfirm) isRequired() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.required
+}
+
+// seen records that the peer with session id heard as alias, and returns
+// its fingerprint with own if it was not heard before.
+func (pc *peerConfirm) seen(own, id, alias string) (fp string, isNew bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.required || id == "" || id == own {
+		return "", false
+	}
+	if p, ok := pc.peers[id]; ok {
+		if alias != "" {
+			p.alias = alias
+		}
+		return "", false
+	}
+	pc.peers[id] = &confirmPeer{alias: alias}
+	return fingerprint(pc.secret, own, id), true
+}
+
+// ready reports whether conversation messages can be sent: confirmation
+// is not required, or at least one peer was confirmed and none is
+// waiting.
+func (pc *peerConfirm) ready() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.required {
+		return true
+	}
+	confirmed := false
+	for _, p := range pc.peers {
+		if !p.confirmed {
+			return false
+		}
+		confirmed = true
+	}
+	return confirmed
+}
+
+// verified reports whether the session id belongs to a confirmed peer.
+func (pc *peerConfirm) verified(id string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	p, ok := pc.peers[id]
+	return ok && p.confirmed
+}
+
+// confirm marks the peers waiting for confirmation as confirmed and
+// returns them, ordered by alias.
+func (pc *peerConfirm) confirm(own string) (confirmed []PeerFingerprint) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for id, p := range pc.peers {
+		if p.confirmed {
+			continue
+		}
+		p.confirmed = true
+		confirmed = append(confirmed, PeerFingerprint{Alias: p.alias, Session: id, Fingerprint: fingerprint(pc.secret, own, id)})
+	}
+	sort.Slice(confirmed, func(i, j int) bool {
+		if confirmed[i].Alias != confirmed[j].Alias {
+			return confirmed[i].Alias < confirmed[j].Alias
+		}
+		return confirmed[i].Session < confirmed[j].Session
+	})
+	return
+}
+
+// RequireConfirmation makes the session show each peer's fingerprint and
+// hold back the conversation until the user confirmed them with Confirm.
+// It must be called before Start. Read-only sessions send nothing to
+// confirm, so it does nothing for them.
+func (s *Session) RequireConfirmation() {
+	if s.ReadOnly() {
+		return
+	}
+	s.confirm.require(s.options.SharedSecret)
+}
+
+// ConfirmationRequired reports whether the session requires peers to be
+// confirmed.
+func (s *Session) ConfirmationRequired() bool {
+	return s.confirm.isRequired()
+}
+
+// Confirm confirms the fingerprints of the peers waiting for it, tells
+// each of them and returns them.
+func (s *Session) Confirm() []PeerFingerprint {
+	confirmed := s.confirm.confirm(sessionID(s.key))
+	for _, p := range confirmed {
+		m := message.Message{Type: typeConfirm, Message: confirmDone, ID: p.Session, Meta: []byte(p.Fingerprint)}
+		if err := s.Send(m); err != nil {
+			log.Debugf("error sending confirmation: %v", err)
+		}
+	}
+	return confirmed
+}
+
+// Unverified reports whether m comes from a peer the user has not
+// confirmed in a session that requires confirmation.
+func (s *Session) Unverified(m message.Message) bool {
+	if !s.confirm.isRequired() {
+		return false
+	}
+	return len(m.Signature) == 0 || !s.confirm.verified(m.Session)
+}
+
+// confirmHello makes the session id known to peers that require
+// confirmation, if this session does.
+func (s *Session) confirmHello() {
+	if !s.confirm.isRequired() {
+		return
+	}
+	if err := s.Send(message.Message{Type: typeConfirm, Message: confirmHello}); err != nil {
+		log.Debugf("error sending confirmation hello: %v", err)
+	}
+}
+
+// confirmSeen shows the fingerprint of a peer heard with m for the first
+// time and says hello to it, in case it missed the hello this session
+// sent on joining. Only signed messages, which identities checked, tell
+// whose they are.
+func (s *Session) confirmSeen(m message.Message, onStatus func(string)) {
+	if !signed[m.Type] || len(m.Signature) == 0 {
+		return
+	}
+	fp, isNew := s.confirm.seen(sessionID(s.key), m.Session, m.Alias)
+	if !isNew {
+		return
+	}
+	alias := m.Alias
+	if alias == "" {
+		alias = "Peer"
+	}
+	onStatus(localize(msgConfirmPeer, alias, fp))
+	s.confirmHello()
+}
+
+// confirmReceived tells the user when a peer confirmed the fingerprint it
+// shares with this session, or confirmed another one.
+func (s *Session) confirmReceived(m message.Message, onStatus func(string)) {
+	own := sessionID(s.key)
+	if m.Message != confirmDone || m.ID != own || !s.confirm.isRequired() {
+		return
+	}
+	if string(m.Meta) != fingerprint(s.options.SharedSecret, own, m.Session) {
+		onStatus(localize(msgConfirmMismatch, m.Alias))
+		return
+	}
+	onStatus(localize(msgConfirmByPeer, m.Alias))
+}
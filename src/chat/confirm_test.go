@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	a, b, c := sessionID(newSessionKey()), sessionID(newSessionKey()), sessionID(newSessionKey())
+	fp := fingerprint("1234", a, b)
+	assert.Regexp(t, `^\d{4} \d{4} \d{4}$`, fp)
+	assert.Equal(t, fp, fingerprint("1234", b, a))
+	assert.NotEqual(t, fp, fingerprint("1235", a, b))
+	assert.NotEqual(t, fp, fingerprint("1234", a, c))
+}
+
+func TestPeerConfirm(t *testing.T) {
+	var pc peerConfirm
+	assert.True(t, pc.ready())
+	_, isNew := pc.seen("own", "bob", "bob")
+	assert.False(t, isNew, "nothing is tracked unless required")
+
+	pc.require("1234")
+	assert.False(t, pc.ready(), "nobody to talk to yet")
+	fp, isNew := pc.seen("own", "bob", "bob")
+	assert.True(t, isNew)
+	assert.Equal(t, fingerprint("1234", "own", "bob"), fp)
+	_, isNew = pc.seen("own", "bob", "bobby")
+	assert.False(t, isNew)
+	_, isNew = pc.seen("own", "own", "me")
+	assert.False(t, isNew)
+	assert.False(t, pc.ready())
+	assert.False(t, pc.verified("bob"))
+
+	confirmed := pc.confirm("own")
+	assert.Equal(t, []PeerFingerprint{{Alias: "bobby", Session: "bob", Fingerprint: fp}}, confirmed)
+	assert.True(t, pc.ready())
+	assert.True(t, pc.verified("bob"))
+	assert.Empty(t, pc.confirm("own"))
+
+	// a peer coming back with another key has to be confirmed again
+	pc.seen("own", "bob-2", "bobby")
+	assert.False(t, pc.ready())
+	assert.False(t, pc.verified("bob-2"))
+	assert.True(t, pc.verified("bob"))
+}
+
+func TestConfirmSession(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8440", "pass123", tcp.WithBanner("8441"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-confirm", RelayAddress: "127.0.0.1:8440", RelayPassword: "pass123"}
+	fingerprintIn := regexp.MustCompile(`\d{4} \d{4} \d{4}`)
+
+	type peer struct {
+		s        *Session
+		messages chan message.Message
+		status   chan string
+	}
+	join := func(alias string) peer {
+		s, err := NewSession(context.Background(), options)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { s.Close() })
+		s.SetAlias(alias)
+		s.RequireConfirmation()
+		p := peer{s, make(chan message.Message, 10), make(chan string, 10)}
+		s.Start(func(m message.Message) { p.messages <- m }, func(line string) { p.status <- line })
+		return p
+	}
+	// waitStatus returns the first status line containing want.
+	waitStatus := func(p peer, want string) string {
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case line := <-p.status:
+				if strings.Contains(line, want) {
+					return line
+				}
+			case <-deadline:
+				t.Fatalf("no status with %q", want)
+			}
+		}
+	}
+	receive := func(p peer) message.Message {
+		select {
+		case m := <-p.messages:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+		return message.Message{}
+	}
+
+	alice := join("alice")
+	bob := join("bob")
+	aliceFP := fingerprintIn.FindString(waitStatus(alice, "Fingerprint with bob"))
+	bobFP := fingerprintIn.FindString(waitStatus(bob, "Fingerprint with alice"))
+	assert.NotEmpty(t, aliceFP)
+	assert.Equal(t, aliceFP, bobFP)
+
+	// nothing of the conversation goes out before confirming
+	assert.ErrorIs(t, alice.s.Send(message.Message{Type: "chat", Message: "too early"}), ErrUnconfirmed)
+	confirmed := alice.s.Confirm()
+	if assert.Len(t, confirmed, 1) {
+		assert.Equal(t, "bob", confirmed[0].Alias)
+		assert.Equal(t, aliceFP, confirmed[0].Fingerprint)
+	}
+	waitStatus(bob, localize(msgConfirmByPeer, "alice"))
+
+	// bob has not confirmed alice, so her message is unverified to him
+	assert.Nil(t, alice.s.Send(message.Message{Type: "chat", Message: "hello"}))
+	m := receive(bob)
+	assert.Equal(t, "hello", m.Message)
+	assert.True(t, bob.s.Unverified(m))
+	assert.Len(t, bob.s.Confirm(), 1)
+	assert.False(t, bob.s.Unverified(m))
+
+	// confirmation outlives a reconnect
+	alice.s.mu.Lock()
+	alice.s.conn.Close()
+	alice.s.mu.Unlock()
+	waitStatus(alice, "Reconnected")
+	assert.Eventually(t, func() bool {
+		return alice.s.Send(message.Message{Type: "chat", Message: "back"}) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	for m = receive(bob); m.Message != "back"; m = receive(bob) {
+	}
+	assert.False(t, bob.s.Unverified(m))
+
+	// a session that does not require confirmation marks nothing
+	plain, err := NewSession(context.Background(), croc.Options{SharedSecret: "1234-confirm-plain", RelayAddress: "127.0.0.1:8440", RelayPassword: "pass123"})
+	if assert.Nil(t, err) {
+		defer plain.Close()
+		assert.False(t, plain.ConfirmationRequired())
+		assert.False(t, plain.Unverified(message.Message{Type: "chat"}))
+		assert.Empty(t, plain.Confirm())
+	}
+}
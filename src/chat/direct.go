@@ -0,0 +1,453 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// Frames of direct mode. Peers say hello with the id of their run, and the
+// one with the lower id offers a data channel. Once it is open a session
+// sends a switch on the relay, then its frames on the channel, numbered,
+// until the channel closes; the frames the peer did not ack by then are
+// resent on the relay.
+const (
+	typeDirectHello  message.Type = "direct_hello"
+	typeDirectSwitch message.Type = "direct_switch"
+	typeDirectResend message.Type = "direct_resend"
+	// frames and their acks only cross the data channel
+	typeDirectFrame message.Type = "direct_frame"
+	typeDirectAck   message.Type = "direct_ack"
+)
+
+// directFrames are the types of the frames of direct mode, which never
+// reach onMessage.
+var directFrames = map[message.Type]bool{
+	typeDirectHello:  true,
+	typeDirectSwitch: true,
+	typeDirectResend: true,
+	typeDirectFrame:  true,
+	typeDirectAck:    true,
+}
+
+// Transports a session carries its messages on, see Session.Transport.
+const (
+	TransportRelay  = "relay"
+	TransportDirect = "direct"
+)
+
+// sentFrame is a frame sent on the data channel that the peer has not
+// acked yet.
+type sentFrame struct {
+	seq  uint64
+	data []byte
+}
+
+// direct carries the frames of a session on a WebRTC data channel to its
+// one peer, the relay carrying only the signals that set it up, and back
+// on the relay when the channel closes. Frames are numbered so that none
+// is lost or passed on twice as they change transports.
+type direct struct {
+	s *Session
+	o call.DataOptions
+	// id names this run of the session.
+	id        string
+	onMessage func(message.Message)
+	onStatus  func(string)
+
+	// mu guards the link and sending. Frames are sent under it, so the
+	// frames resent on the relay go before those sent there after them.
+	mu     sync.Mutex
+	link   *call.DataLink
+	peer   string
+	active bool
+	// crowded is set once a third session was heard, as direct mode is
+	// for rooms of two.
+	crowded bool
+	seq     uint64
+	unacked []sentFrame
+
+	// rmu guards receiving. Frames from the channel are held until the
+	// peer's switch arrives on the relay, so they go after what the peer
+	// sent there before. delivered is the number of the last frame passed
+	// on.
+	rmu       sync.Mutex
+	switched  bool
+	held      []message.Message
+	delivered uint64
+}
+
+// GoDirect makes the session carry its messages on a WebRTC data channel
+// to its peer, set up through the relay, and on the relay again should
+// the channel close. Both peers need it, and rooms of more than two stay
+// on the relay, as do observers. Call it before Start.
+func (s *Session) GoDirect(o call.DataOptions) {
+	if s.ReadOnly() {
+		return
+	}
+	o.Secret = s.options.SharedSecret
+	o.MaxMessage = maxFrameSize
+	s.direct = &direct{s: s, o: o, id: newMessageID()}
+}
+
+// Transport returns what carries the messages of the session at the
+// moment: TransportDirect or TransportRelay.
+func (s *Session) Transport() string {
+	if d := s.direct; d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.active {
+			return TransportDirect
+		}
+	}
+	return TransportRelay
+}
+
+// sendRelay sends m on the relay as it is, for the frames of direct mode.
+func (s *Session) sendRelay(m message.Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("chat session is closed")
+	}
+	if err = conn.Send(data); err != nil {
+		return err
+	}
+	s.traffic.add(true, trafficOverhead, len(data))
+	return nil
+}
+
+// transmit sends a frame on the data channel in direct mode, once it is
+// open, and on the relay otherwise.
+func (s *Session) transmit(conn *comm.Comm, data []byte) error {
+	d := s.direct
+	if d == nil {
+		return conn.Send(data)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active {
+		d.seq++
+		d.unacked = append(d.unacked, sentFrame{seq: d.seq, data: data})
+		frame, err := json.Marshal(message.Message{Type: typeDirectFrame, ID: strconv.FormatUint(d.seq, 10), Bytes: data})
+		if err == nil {
+			if err = d.link.Send(frame); err == nil {
+				return nil
+			}
+		}
+		// the frame goes on the relay with the others not acked, and so
+		// must all that follow
+		log.Debugf("leaving the data channel: %v", err)
+		d.active = false
+		go d.link.Close()
+		return d.flush()
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	return conn.Send(data)
+}
+
+// helloDirect tells the peer this session would go direct.
+func (s *Session) helloDirect() {
+	if s.direct == nil {
+		return
+	}
+	if err := s.sendRelay(message.Message{Type: typeDirectHello, ID: s.direct.id}); err != nil {
+		log.Debugf("error saying hello for direct mode: %v", err)
+	}
+}
+
+// directReceived takes the frames of direct mode and their signals off
+// the relay, and reports whether m was one. Sessions not in direct mode
+// drop them.
+func (s *Session) directReceived(m message.Message) bool {
+	if !directFrames[m.Type] && !call.IsDataSignal(m.Type) {
+		return false
+	}
+	d := s.direct
+	if d == nil {
+		return true
+	}
+	switch m.Type {
+	case typeDirectHello:
+		d.hello(m)
+	case typeDirectSwitch:
+		d.switchReceived()
+	case typeDirectResend:
+		d.rmu.Lock()
+		d.deliver(m, false)
+		d.rmu.Unlock()
+	case message.TypeWebRTCDataOffer:
+		d.answer(m)
+	case message.TypeWebRTCDataAnswer:
+		d.mu.Lock()
+		link := d.link
+		d.mu.Unlock()
+		if link == nil {
+			return true
+		}
+		if err := link.Signal(m); err != nil {
+			log.Debugf("ignoring signal: %v", err)
+		}
+	}
+	return true
+}
+
+// hello takes the hello of a peer, answers it unless it was an answer
+// and, if this session is the one to, offers a data channel.
+func (d *direct) hello(m message.Message) {
+	if m.ID == "" || m.ID == d.id {
+		return
+	}
+	d.mu.Lock()
+	if d.crowded {
+		d.mu.Unlock()
+		return
+	}
+	if d.peer != "" && d.peer != m.ID && d.link != nil {
+		d.crowded = true
+		link := d.link
+		d.mu.Unlock()
+		d.onStatus(localize(msgDirectCrowded))
+		link.Close()
+		return
+	}
+	// a peer that rejoined under a new id numbers its frames anew
+	newPeer := d.peer != m.ID
+	d.peer = m.ID
+	if d.link == nil && d.id < m.ID {
+		o := d.o
+		o.Offer = true
+		if link, err := call.NewDataLink(o, d.s.sendRelay, d.received); err != nil {
+			log.Debugf("could not offer a data channel: %v", err)
+		} else {
+			d.use(link)
+		}
+	}
+	d.mu.Unlock()
+	if newPeer {
+		d.rmu.Lock()
+		d.switched, d.held, d.delivered = false, nil, 0
+		d.rmu.Unlock()
+	}
+	if m.Num == 0 {
+		if err := d.s.sendRelay(message.Message{Type: typeDirectHello, ID: d.id, Num: 1}); err != nil {
+			log.Debugf("error answering hello for direct mode: %v", err)
+		}
+	}
+}
+
+// answer answers an offer of the peer's with a new data channel, in
+// place of the one it had, which the peer let go of.
+func (d *direct) answer(offer message.Message) {
+	d.mu.Lock()
+	if d.crowded {
+		d.mu.Unlock()
+		return
+	}
+	o := d.o
+	o.Offer = false
+	link, err := call.NewDataLink(o, d.s.sendRelay, d.received)
+	if err == nil {
+		if err = link.Signal(offer); err != nil {
+			link.Close()
+		}
+	}
+	if err != nil {
+		d.mu.Unlock()
+		log.Debugf("could not answer a data channel: %v", err)
+		return
+	}
+	old := d.link
+	if old != nil {
+		d.drop(old)
+		go old.Close()
+	}
+	d.use(link)
+	d.mu.Unlock()
+	if old != nil {
+		d.rmu.Lock()
+		d.switched, d.held = false, nil
+		d.rmu.Unlock()
+	}
+}
+
+// use makes link the data channel to the peer, once it is open, until it
+// closes or the session does. The caller holds mu.
+func (d *direct) use(link *call.DataLink) {
+	d.link = link
+	d.s.wg.Add(1)
+	go func() {
+		defer d.s.wg.Done()
+		select {
+		case <-link.Open():
+			d.opened(link)
+		case <-link.Closed():
+		case <-d.s.ctx.Done():
+		}
+		select {
+		case <-link.Closed():
+		case <-d.s.ctx.Done():
+			link.Close()
+		}
+		d.closed(link)
+	}()
+}
+
+// opened switches to link, once the frames the peer did not ack on an
+// earlier one were resent.
+func (d *direct) opened(link *call.DataLink) {
+	d.mu.Lock()
+	if d.link != link {
+		d.mu.Unlock()
+		return
+	}
+	err := d.flush()
+	if err == nil {
+		err = d.s.sendRelay(message.Message{Type: typeDirectSwitch, ID: d.id})
+	}
+	if err != nil {
+		d.mu.Unlock()
+		log.Debugf("could not switch to the data channel: %v", err)
+		link.Close()
+		return
+	}
+	d.active = true
+	d.mu.Unlock()
+	d.onStatus(localize(msgDirectOn))
+}
+
+// closed falls back to the relay as link closed.
+func (d *direct) closed(link *call.DataLink) {
+	d.mu.Lock()
+	current := d.link == link
+	if current {
+		d.drop(link)
+	}
+	d.mu.Unlock()
+	if !current {
+		return
+	}
+	d.rmu.Lock()
+	d.switched, d.held = false, nil
+	d.rmu.Unlock()
+	select {
+	case <-link.Open():
+		if d.s.ctx.Err() == nil {
+			d.onStatus(localize(msgDirectOff))
+		}
+	default:
+	}
+}
+
+// drop lets go of link, resending the frames the peer did not ack on the
+// relay. The caller holds mu.
+func (d *direct) drop(link *call.DataLink) {
+	d.link, d.active = nil, false
+	if err := d.flush(); err != nil {
+		log.Debugf("could not resend %d frames on the relay yet: %v", len(d.unacked), err)
+	}
+}
+
+// flush resends the frames the peer did not ack on the relay, in order.
+// The caller holds mu.
+func (d *direct) flush() error {
+	for len(d.unacked) > 0 {
+		f := d.unacked[0]
+		if err := d.s.sendRelay(message.Message{Type: typeDirectResend, ID: strconv.FormatUint(f.seq, 10), Bytes: f.data}); err != nil {
+			return err
+		}
+		d.unacked = d.unacked[1:]
+	}
+	return nil
+}
+
+// received takes a frame or an ack from the data channel.
+func (d *direct) received(b []byte) {
+	var m message.Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Debugf("dropping data channel frame: %v", err)
+		return
+	}
+	switch m.Type {
+	case typeDirectAck:
+		seq, err := strconv.ParseUint(m.ID, 10, 64)
+		if err != nil {
+			return
+		}
+		d.mu.Lock()
+		n := 0
+		for n < len(d.unacked) && d.unacked[n].seq <= seq {
+			n++
+		}
+		d.unacked = d.unacked[n:]
+		d.mu.Unlock()
+	case typeDirectFrame:
+		d.rmu.Lock()
+		defer d.rmu.Unlock()
+		if !d.switched {
+			d.held = append(d.held, m)
+			return
+		}
+		d.deliver(m, true)
+	}
+}
+
+// switchReceived passes on the frames held until the peer switched to
+// the data channel.
+func (d *direct) switchReceived() {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	d.switched = true
+	held := d.held
+	d.held = nil
+	for _, m := range held {
+		d.deliver(m, true)
+	}
+}
+
+// deliver passes on the frame in m unless it was before, and acks it on
+// the data channel if it came through one. The caller holds rmu.
+func (d *direct) deliver(m message.Message, ack bool) {
+	seq, err := strconv.ParseUint(m.ID, 10, 64)
+	if err != nil || seq <= d.delivered {
+		return
+	}
+	d.delivered = seq
+	inner, err := decodeFrame(m.Bytes)
+	switch {
+	case err != nil:
+		log.Debugf("dropping direct frame: %v", err)
+	case directFrames[inner.Type] || call.IsDataSignal(inner.Type):
+		log.Debugf("dropping %s inside a direct frame", inner.Type)
+	default:
+		d.s.traffic.add(false, trafficCategory(inner), len(m.Bytes))
+		d.s.handle(inner, d.onMessage, d.onStatus)
+	}
+	if !ack {
+		return
+	}
+	d.mu.Lock()
+	link := d.link
+	d.mu.Unlock()
+	if link == nil {
+		return
+	}
+	if b, err := json.Marshal(message.Message{Type: typeDirectAck, ID: m.ID}); err == nil {
+		if err = link.Send(b); err != nil {
+			log.Debugf("could not ack direct frame: %v", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// waitTransport waits for s to carry its messages on transport.
+func waitTransport(t *testing.T, s *Session, transport string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Transport() != transport {
+		if time.Now().After(deadline) {
+			t.Fatalf("the session did not go %s", transport)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDirect(t *testing.T) {
+	log.SetLevel("error")
+	setLanguage("en")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	// peers in this process find each other on the loopback interface
+	var engine webrtc.SettingEngine
+	engine.SetIncludeLoopbackCandidate(true)
+	engine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	direct := call.DataOptions{API: webrtc.NewAPI(webrtc.WithSettingEngine(engine))}
+
+	options := croc.Options{SharedSecret: "1234-direct", RelayAddress: l.Addr().String(), RelayPassword: "pass123"}
+	alice, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	bob, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+	alice.GoDirect(direct)
+	bob.GoDirect(direct)
+	assert.Equal(t, TransportRelay, alice.Transport())
+
+	status := make(chan string, 10)
+	onStatus := func(s string) {
+		if s == localize(msgDirectOn) || s == localize(msgDirectOff) {
+			status <- s
+		}
+	}
+	received := make(chan string, 100)
+	alice.Start(func(message.Message) {}, onStatus)
+	bob.Start(func(m message.Message) {
+		if m.Type == "chat" {
+			received <- m.Message
+		}
+	}, func(string) {})
+	waitTransport(t, alice, TransportDirect)
+	waitTransport(t, bob, TransportDirect)
+	assert.Equal(t, localize(msgDirectOn), <-status)
+
+	var sent []string
+	say := func(n int) {
+		for i := 0; i < n; i++ {
+			sent = append(sent, fmt.Sprintf("message %d", len(sent)))
+			assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: sent[len(sent)-1]}))
+		}
+	}
+	say(20)
+	// the channel dies mid-conversation, with frames on the way
+	bob.direct.mu.Lock()
+	link := bob.direct.link
+	bob.direct.mu.Unlock()
+	assert.Nil(t, link.Close())
+	say(20)
+	waitTransport(t, alice, TransportRelay)
+	assert.Equal(t, TransportRelay, bob.Transport())
+	assert.Equal(t, localize(msgDirectOff), <-status)
+	say(10)
+
+	var got []string
+	for len(got) < len(sent) {
+		select {
+		case m := <-received:
+			got = append(got, m)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d of %d messages arrived", len(got), len(sent))
+		}
+	}
+	assert.Equal(t, sent, got, "every message arrived once, in order")
+	select {
+	case m := <-received:
+		t.Errorf("%q arrived again", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDirectFramesDropped(t *testing.T) {
+	// sessions not in direct mode keep the frames of peers that are to
+	// themselves
+	s := &Session{}
+	for _, m := range []message.Message{
+		{Type: typeDirectHello, ID: "peer"},
+		{Type: typeDirectResend, ID: "1", Bytes: []byte(`{"t":"chat","m":"hi"}`)},
+		{Type: message.TypeWebRTCDataOffer, Bytes: []byte("sealed")},
+	} {
+		assert.True(t, s.directReceived(m))
+	}
+	assert.False(t, s.directReceived(message.Message{Type: "chat", Message: "hi"}))
+	assert.Equal(t, TransportRelay, s.Transport())
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// Limits on a frame received from the room, which anyone with the room
+// name can send. Files larger than maxFrameSize go through /transfer.
+const (
+	maxFrameSize   = 64 << 20
+	maxFrameDepth  = 16
+	maxFrameTokens = 4096
+	// maxFieldLength caps the type, alias, id and session of a message.
+	maxFieldLength = 256
+	maxAliasLength = 64
+)
+
+var (
+	errFrameTooLarge = errors.New("frame too large")
+	errFrameTooDeep  = errors.New("frame nested too deeply")
+)
+
+// decodeFrame parses a frame received from the room into a message,
+// inflating it if it was compressed and checking its size and shape before
+// and its fields after, and strips the terminal control sequences it may
+// carry. Frames that fail are dropped by the caller.
+func decodeFrame(data []byte) (m message.Message, err error) {
+	if len(data) > maxFrameSize {
+		return m, fmt.Errorf("%w: %d bytes", errFrameTooLarge, len(data))
+	}
+	if data, err = inflateFrame(data); err != nil {
+		return
+	}
+	if err = checkShape(data); err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return
+	}
+	m = sanitizeMessage(m)
+	err = checkMessage(m)
+	return
+}
+
+// checkShape walks the JSON tokens of data, refusing documents nested
+// deeper than maxFrameDepth or made of more than maxFrameTokens tokens.
+// A message is a flat object, so only junk comes close to either.
+func checkShape(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for tokens := 0; ; tokens++ {
+		if tokens > maxFrameTokens {
+			return fmt.Errorf("frame has more than %d tokens", maxFrameTokens)
+		}
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxFrameDepth {
+				return errFrameTooDeep
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// checkMessage reports whether m has the fields its type needs. Unknown
+// types pass, so peers can add new ones; they are shown without content.
+func checkMessage(m message.Message) error {
+	for name, v := range map[string]string{"type": string(m.Type), "id": m.ID, "session": m.Session} {
+		if len(v) > maxFieldLength {
+			return fmt.Errorf("%s is longer than %d bytes", name, maxFieldLength)
+		}
+	}
+	need := func(fields ...string) error {
+		for _, f := range fields {
+			if f == "id" && m.ID == "" || f == "message" && m.Message == "" {
+				return fmt.Errorf("%s message without %s", m.Type, f)
+			}
+		}
+		return nil
+	}
+	switch m.Type {
+	case "":
+		return fmt.Errorf("message without a type")
+	case "chat", "encrypted", typeEmote:
+		if err := need("message"); err != nil {
+			return err
+		}
+		_, err := ephemeralTTL(m)
+		return err
+	case typePing, typePong, typeTransferOffer:
+		return need("message")
+	case "chatfile":
+		return checkFileName(m.Message)
+	case typeChatEdit, typeChatArchive, typeReaction:
+		return need("id", "message")
+	case typeChatDelete, typeAck:
+		return need("id")
+	}
+	return nil
+}
+
+// checkFileName reports whether name, from a file offer, is a plain file
+// name that cannot point outside the directory it is saved to.
+func checkFileName(name string) error {
+	if err := utils.ValidFileName(name); err != nil {
+		return err
+	}
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name '%s'", name)
+	}
+	return nil
+}
+
+// sanitizeMessage strips what a terminal would act on from the fields of
+// m that get printed: escape sequences and other control characters, and
+// the bidirectional overrides that disguise text. Only the text keeps its
+// newlines and tabs.
+func sanitizeMessage(m message.Message) message.Message {
+	m.Type = message.Type(sanitizeText(string(m.Type), false))
+	m.Alias = truncateRunes(sanitizeText(m.Alias, false), maxAliasLength)
+	m.ID = sanitizeText(m.ID, false)
+	m.Session = sanitizeText(m.Session, false)
+	m.Message = sanitizeText(m.Message, true)
+	return m
+}
+
+// sanitizeText drops control characters from s, except newlines and tabs
+// when multiline is set, along with bidirectional formatting characters.
+// Invalid UTF-8 is dropped too.
+func sanitizeText(s string, multiline bool) string {
+	clean := true
+	for _, r := range s {
+		if !keepRune(r, multiline) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if keepRune(r, multiline) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func keepRune(r rune, multiline bool) bool {
+	switch {
+	case r == utf8.RuneError:
+		return false
+	case r == '\n' || r == '\t':
+		return multiline
+	case unicode.IsControl(r):
+		return false
+	case unicode.Is(unicode.Bidi_Control, r):
+		return false
+	}
+	return true
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func frame(t testing.TB, m message.Message) []byte {
+	b, err := json.Marshal(m)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestDecodeFrame(t *testing.T) {
+	m, err := decodeFrame(frame(t, message.Message{Type: "chat", Message: "hi\tthere\nfriend", Alias: "alice", ID: "abc"}))
+	assert.Nil(t, err)
+	assert.Equal(t, "hi\tthere\nfriend", m.Message)
+
+	// escape sequences and bidi overrides are stripped wherever they are
+	// printed
+	m, err = decodeFrame(frame(t, message.Message{Type: "chat", Message: "\x1b]0;pwned\x07evil‮txt.exe", Alias: "bob\x1b[2J\n" + strings.Repeat("b", 100)}))
+	assert.Nil(t, err)
+	assert.Equal(t, "]0;pwnedeviltxt.exe", m.Message)
+	assert.Equal(t, "bob[2J"+strings.Repeat("b", maxAliasLength-len("bob[2J")), m.Alias)
+
+	for name, data := range map[string][]byte{
+		"not json":       []byte("\x01"),
+		"no type":        frame(t, message.Message{Message: "hi"}),
+		"empty chat":     frame(t, message.Message{Type: "chat"}),
+		"edit no id":     frame(t, message.Message{Type: typeChatEdit, Message: "fixed"}),
+		"ack no id":      frame(t, message.Message{Type: typeAck}),
+		"traversal":      frame(t, message.Message{Type: "chatfile", Message: "../../.bashrc", Bytes: []byte("x")}),
+		"absolute":       frame(t, message.Message{Type: "chatfile", Message: "/etc/passwd", Bytes: []byte("x")}),
+		"dot dot":        frame(t, message.Message{Type: "chatfile", Message: ".."}),
+		"long type":      frame(t, message.Message{Type: message.Type(strings.Repeat("t", 300))}),
+		"deep":           []byte(`{"t":"chat","m":"hi","x":` + strings.Repeat("[", 100) + strings.Repeat("]", 100) + `}`),
+		"many tokens":    []byte(`{"t":"chat","m":"hi","x":[` + strings.Repeat("1,", maxFrameTokens) + `1]}`),
+		"trailing junk":  []byte(`{"t":"chat","m":"hi"} {"t":"chat"}`),
+		"wrong type":     []byte(`{"t":"chat","m":5}`),
+		"invalid base64": []byte(`{"t":"chatfile","m":"a.txt","b":"***"}`),
+	} {
+		_, err = decodeFrame(data)
+		assert.NotNil(t, err, name)
+	}
+
+	_, err = decodeFrame(make([]byte, maxFrameSize+1))
+	assert.True(t, errors.Is(err, errFrameTooLarge))
+
+	// unknown types pass, for newer peers
+	m, err = decodeFrame([]byte(`{"t":"sticker","m":"\u001b[31mred","future":{"a":[1,2]}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, message.Type("sticker"), m.Type)
+}
+
+func TestSaveFileRefusesTraversal(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"../escape.txt", "sub/../../escape.txt", "/tmp/escape.txt", "..", ""} {
+		_, err := metaPolicy{}.saveFile(filepath.Join(dir, "in"), message.Message{Type: "chatfile", Message: name, Bytes: []byte("x")})
+		assert.NotNil(t, err, name)
+	}
+	_, err := os.Stat(filepath.Join(dir, "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, m := range []message.Message{
+		{Type: "chat", Message: "hello", Alias: "alice", ID: "0011223344556677"},
+		{Type: "chatfile", Message: "notes.txt", Bytes: []byte("content"), Meta: []byte(`{"mode":420}`)},
+		{Type: typeChatEdit, ID: "0011223344556677", Message: "fixed"},
+		{Type: typeAck, ID: "0011223344556677"},
+		{Type: typeTransferOffer, Message: "big.iso", Bytes: []byte{1, 2, 3, 4}, Num: 1 << 30},
+		{Type: typeChatArchive, ID: "aa", Message: `{"name":"dir","format":"tar"}`},
+	} {
+		f.Add(frame(f, m))
+	}
+	f.Add([]byte(`{"t":"chat","m":"\u001b[2J"}`))
+	f.Add([]byte(`[[[[[[[[[[`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := decodeFrame(data)
+		if err != nil {
+			return
+		}
+		assert.NotEmpty(t, m.Type)
+		for _, s := range []string{string(m.Type), m.Alias, m.ID, m.Session, m.Message} {
+			assert.NotContains(t, s, "\x1b")
+			assert.NotContains(t, s, "‮")
+		}
+		assert.NotContains(t, m.Alias, "\n")
+		if m.Type == "chatfile" {
+			assert.Equal(t, filepath.Base(m.Message), m.Message)
+		}
+	})
+}
+
+func FuzzSaveFile(f *testing.F) {
+	f.Add("notes.txt", []byte("content"), []byte(nil))
+	f.Add("../escape", []byte("x"), []byte(nil))
+	f.Add("a.sh", []byte("#!/bin/sh"), []byte(`{"mode":2541,"sha256":"x"}`))
+	f.Fuzz(func(t *testing.T, name string, content, meta []byte) {
+		root := t.TempDir()
+		dir := filepath.Join(root, "received")
+		path, err := metaPolicy{apply: true}.saveFile(dir, message.Message{Type: "chatfile", Message: name, Bytes: content, Meta: meta})
+		if err != nil {
+			return
+		}
+		rel, err := filepath.Rel(dir, path)
+		assert.Nil(t, err)
+		assert.Equal(t, filepath.Base(name), rel)
+		entries, err := os.ReadDir(root)
+		assert.Nil(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
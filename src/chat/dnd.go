@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"sync"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// dndMaxHeld bounds the messages held back during do not disturb. Past it
+// the oldest are dropped from the buffer; they stay in the transcript.
+const dndMaxHeld = 500
+
+// held are the message types do not disturb holds back. Offers of small
+// files and encrypted messages ask the user something right away, so they
+// are shown as they come, as are pings, pongs and acks, which show nothing
+// anyway.
+var held = map[message.Type]bool{
+	"chat":            true,
+	typeEmote:         true,
+	typeChatEdit:      true,
+	typeChatDelete:    true,
+	typeReaction:      true,
+	typeChatArchive:   true,
+	typeTransferOffer: true,
+}
+
+// dndBuffer holds back incoming messages while do not disturb is on. The
+// messages are acked and recorded as they arrive; only showing them waits.
+// A change to a message that is still held is folded into it: an edit
+// takes its place, shown as edited, and a delete removes it, so the user
+// does not read something that was already withdrawn. A reaction replaces
+// the one held from the same session to the same message.
+type dndBuffer struct {
+	mu      sync.Mutex
+	on      bool
+	held    []message.Message
+	dropped int
+}
+
+// hold keeps m for later and reports whether it did, which it does for
+// the types in held while do not disturb is on.
+func (d *dndBuffer) hold(m message.Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.on || !held[m.Type] {
+		return false
+	}
+	if m.Type == typeChatEdit || m.Type == typeChatDelete {
+		for i, h := range d.held {
+			if h.ID != m.ID || (h.Type != "chat" && h.Type != typeEmote && h.Type != typeChatEdit) {
+				continue
+			}
+			if m.Type == typeChatDelete {
+				d.held = append(d.held[:i], d.held[i+1:]...)
+			} else {
+				d.held[i] = m
+			}
+			return true
+		}
+	}
+	if m.Type == typeReaction {
+		for i, h := range d.held {
+			if h.Type == typeReaction && h.ID == m.ID && reactor(h) == reactor(m) {
+				d.held = append(d.held[:i], d.held[i+1:]...)
+				break
+			}
+		}
+	}
+	d.held = append(d.held, m)
+	if len(d.held) > dndMaxHeld {
+		d.held = d.held[1:]
+		d.dropped++
+	}
+	return true
+}
+
+// enable turns do not disturb on.
+func (d *dndBuffer) enable() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.on = true
+}
+
+// release turns do not disturb off and passes replay the held messages in
+// the order they arrived, and how many did not fit. A message arriving
+// meanwhile waits in hold until replay returns, so it is shown after the
+// ones held before it.
+func (d *dndBuffer) release(replay func(messages []message.Message, dropped int)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	replay(d.held, d.dropped)
+	d.on, d.held, d.dropped = false, nil, 0
+}
+
+// enabled reports whether do not disturb is on.
+func (d *dndBuffer) enabled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.on
+}
+
+// unread returns how many messages are waiting, counting those dropped.
+func (d *dndBuffer) unread() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.held) + d.dropped
+}
@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNDHold(t *testing.T) {
+	d := &dndBuffer{}
+	chat := func(id, text string) message.Message {
+		return message.Message{Type: "chat", ID: id, Message: text}
+	}
+	assert.False(t, d.hold(chat("a", "before")), "nothing is held while off")
+
+	d.enable()
+	assert.True(t, d.hold(chat("a", "one")))
+	assert.True(t, d.hold(chat("b", "two")))
+	assert.True(t, d.hold(chat("c", "three")))
+	for _, typ := range []message.Type{"chatfile", "encrypted", typePing, typeAck} {
+		assert.False(t, d.hold(message.Message{Type: typ, ID: "x"}), typ)
+	}
+	// changes to held messages are folded into them
+	assert.True(t, d.hold(message.Message{Type: typeChatEdit, ID: "a", Message: "one, fixed"}))
+	assert.True(t, d.hold(message.Message{Type: typeChatDelete, ID: "b"}))
+	// changes to messages shown before are kept as they are
+	assert.True(t, d.hold(message.Message{Type: typeChatEdit, ID: "old", Message: "changed"}))
+	assert.Equal(t, 3, d.unread())
+
+	var got []string
+	d.release(func(messages []message.Message, dropped int) {
+		assert.Zero(t, dropped)
+		for _, m := range messages {
+			got = append(got, fmt.Sprintf("%s %s %s", m.Type, m.ID, m.Message))
+		}
+	})
+	assert.Equal(t, []string{"chat_edit a one, fixed", "chat c three", "chat_edit old changed"}, got)
+	assert.False(t, d.enabled())
+	assert.Zero(t, d.unread())
+	assert.False(t, d.hold(chat("d", "after")))
+}
+
+func TestDNDBounded(t *testing.T) {
+	d := &dndBuffer{}
+	d.enable()
+	for i := 0; i < dndMaxHeld+20; i++ {
+		d.hold(message.Message{Type: "chat", ID: fmt.Sprint(i)})
+	}
+	assert.Equal(t, dndMaxHeld+20, d.unread())
+	d.release(func(messages []message.Message, dropped int) {
+		assert.Equal(t, 20, dropped)
+		if assert.Len(t, messages, dndMaxHeld) {
+			assert.Equal(t, "20", messages[0].ID)
+			assert.Equal(t, fmt.Sprint(dndMaxHeld+19), messages[dndMaxHeld-1].ID)
+		}
+	})
+}
+
+func TestDNDReleaseOrder(t *testing.T) {
+	d := &dndBuffer{}
+	d.enable()
+	d.hold(message.Message{Type: "chat", ID: "held"})
+
+	var shown []string
+	arrived := make(chan bool)
+	d.release(func(messages []message.Message, dropped int) {
+		for _, m := range messages {
+			shown = append(shown, m.ID)
+		}
+		// a message arriving during the replay waits for it
+		go func() { arrived <- d.hold(message.Message{Type: "chat", ID: "late"}) }()
+		select {
+		case <-arrived:
+			t.Error("hold returned during the replay")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+	assert.False(t, <-arrived, "a message after the replay is shown, not held")
+	assert.Equal(t, []string{"held"}, shown)
+}
@@ -0,0 +1,252 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// Control messages that change an earlier chat message. ID is the id of
+// that message, Message the new text of an edit, Session the public key of
+// the sender and Bytes its signature over editPayload.
+const (
+	typeChatEdit   message.Type = "chat_edit"
+	typeChatDelete message.Type = "chat_delete"
+)
+
+// scrollbackSize is how many recent chat messages can still be edited or
+// deleted.
+const scrollbackSize = 200
+
+// lastMessage stands for the newest own message in /edit and /delete.
+const lastMessage = "last"
+
+var (
+	errNotInScrollback = errors.New("message is not among the recent ones")
+	errNotSender       = errors.New("message was sent by another session")
+	errEphemeralEdit   = errors.New("ephemeral messages cannot be edited")
+)
+
+// newSessionKey returns the key a session signs its edits with. Its public
+// half is the session id carried in the messages the session sends.
+func newSessionKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// sessionID renders the public half of key as carried in messages.
+func sessionID(key ed25519.PrivateKey) string {
+	if key == nil {
+		return ""
+	}
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// editPayload is what the sender of an edit or delete signs: the kind of
+// change, the message it applies to and the new text, length-prefixed so
+// a signature cannot be moved to another message or text.
+func editPayload(t message.Type, id, text string) []byte {
+	var b []byte
+	for _, field := range []string{string(t), id, text} {
+		b = binary.BigEndian.AppendUint64(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	return b
+}
+
+// signChange builds a signed edit or delete of the message with the given
+// id.
+func signChange(key ed25519.PrivateKey, t message.Type, id, text string) message.Message {
+	return message.Message{
+		Type:    t,
+		ID:      id,
+		Message: text,
+		Session: sessionID(key),
+		Bytes:   ed25519.Sign(key, editPayload(t, id, text)),
+	}
+}
+
+// scrollEntry is a chat message as it may still be changed.
+type scrollEntry struct {
+	ID      string
+	Session string
+	Alias   string
+	Text    string
+	At      time.Time
+	Own     bool
+	Edited  bool
+	Deleted bool
+	// Expires is when an ephemeral message is redacted, and Expired is
+	// set once it has been. Expires is zero for messages that stay.
+	Expires time.Time
+	Expired bool
+	// Reactions are the latest reaction of each session, oldest first.
+	Reactions []reaction
+}
+
+// scrollback keeps the most recent chat messages, oldest first, so edits
+// and deletes can be checked against the message they change. A nil
+// scrollback keeps nothing.
+type scrollback struct {
+	mu      sync.Mutex
+	entries []scrollEntry
+}
+
+func (sb *scrollback) add(e scrollEntry) {
+	if sb == nil || e.ID == "" {
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.entries = append(sb.entries, e)
+	if len(sb.entries) > scrollbackSize {
+		sb.entries = append([]scrollEntry(nil), sb.entries[len(sb.entries)-scrollbackSize:]...)
+	}
+}
+
+// get returns the entry with exactly the given id.
+func (sb *scrollback) get(id string) (scrollEntry, bool) {
+	if sb == nil {
+		return scrollEntry{}, false
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	for i := len(sb.entries) - 1; i >= 0; i-- {
+		if sb.entries[i].ID == id {
+			return sb.entries[i], true
+		}
+	}
+	return scrollEntry{}, false
+}
+
+// own returns this session's messages that can still be changed.
+func (sb *scrollback) own() (entries []scrollEntry) {
+	if sb == nil {
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	for _, e := range sb.entries {
+		if e.Own && !e.Deleted {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// findOwn resolves an id prefix, or lastMessage, to one of this session's
+// messages.
+func (sb *scrollback) findOwn(ref string) (scrollEntry, error) {
+	return pickEntry(sb.own(), ref)
+}
+
+// pickEntry resolves an id prefix, or lastMessage, to one of entries.
+func pickEntry(entries []scrollEntry, ref string) (scrollEntry, error) {
+	if ref == lastMessage {
+		if len(entries) == 0 {
+			return scrollEntry{}, errNotInScrollback
+		}
+		return entries[len(entries)-1], nil
+	}
+	var found []scrollEntry
+	for _, e := range entries {
+		if strings.HasPrefix(e.ID, ref) {
+			found = append(found, e)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return scrollEntry{}, errNotInScrollback
+	case 1:
+		return found[0], nil
+	default:
+		return scrollEntry{}, fmt.Errorf("%q matches %d messages", ref, len(found))
+	}
+}
+
+// apply checks an edit or delete against the message it changes and, if
+// the change is genuine, records it. Only the session that sent a message
+// can change it: the change must carry that session's id and a signature
+// made with its key. Changes to messages never seen are refused as well.
+func (sb *scrollback) apply(m message.Message) error {
+	if sb == nil {
+		return errNotInScrollback
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	i := len(sb.entries) - 1
+	for ; i >= 0 && sb.entries[i].ID != m.ID; i-- {
+	}
+	if i < 0 {
+		return errNotInScrollback
+	}
+	e := &sb.entries[i]
+	if e.Session == "" || e.Session != m.Session {
+		return errNotSender
+	}
+	pub, err := hex.DecodeString(m.Session)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errNotSender
+	}
+	if !ed25519.Verify(pub, editPayload(m.Type, m.ID, m.Message), m.Bytes) {
+		return fmt.Errorf("bad signature on %s", m.Type)
+	}
+	if e.Deleted {
+		return fmt.Errorf("message was deleted")
+	}
+	switch m.Type {
+	case typeChatEdit:
+		// the new text would outlive the message in the history
+		if !e.Expires.IsZero() {
+			return errEphemeralEdit
+		}
+		e.Text = m.Message
+		e.Edited = true
+	case typeChatDelete:
+		e.Deleted = true
+	default:
+		return fmt.Errorf("%s does not change a message", m.Type)
+	}
+	return nil
+}
+
+// Edit replaces the text of one of the session's recent messages, given
+// by an id prefix or "last", for everyone in the room.
+func (s *Session) Edit(ref, text string) (id string, err error) {
+	return s.change(typeChatEdit, ref, text)
+}
+
+// Delete withdraws one of the session's recent messages, given by an id
+// prefix or "last".
+func (s *Session) Delete(ref string) (id string, err error) {
+	return s.change(typeChatDelete, ref, "")
+}
+
+func (s *Session) change(t message.Type, ref, text string) (id string, err error) {
+	if s.key == nil {
+		return "", fmt.Errorf("session cannot sign changes")
+	}
+	e, err := s.scrollback.findOwn(ref)
+	if err != nil {
+		return
+	}
+	if t == typeChatEdit && !e.Expires.IsZero() {
+		return "", errEphemeralEdit
+	}
+	m := signChange(s.key, t, e.ID, text)
+	if err = s.Send(m); err != nil {
+		return
+	}
+	return e.ID, s.scrollback.apply(m)
+}
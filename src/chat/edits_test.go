@@ -0,0 +1,148 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestScrollbackChanges(t *testing.T) {
+	alice, mallory := newSessionKey(), newSessionKey()
+	sb := &scrollback{}
+	sb.add(scrollEntry{ID: "a1", Session: sessionID(alice), Text: "helo"})
+	sb.add(scrollEntry{ID: "a2", Session: sessionID(alice), Text: "second"})
+	sb.add(scrollEntry{ID: "old", Text: "from a client without sessions"})
+
+	// someone else's session, or alice's id without alice's key
+	assert.ErrorIs(t, sb.apply(signChange(mallory, typeChatEdit, "a1", "pwned")), errNotSender)
+	forged := signChange(mallory, typeChatEdit, "a1", "pwned")
+	forged.Session = sessionID(alice)
+	assert.NotNil(t, sb.apply(forged))
+
+	edit := signChange(alice, typeChatEdit, "a1", "hello")
+	// a genuine signature does not carry over to other text or messages
+	moved := edit
+	moved.ID = "a2"
+	assert.NotNil(t, sb.apply(moved))
+	changed := edit
+	changed.Message = "goodbye"
+	assert.NotNil(t, sb.apply(changed))
+	asDelete := edit
+	asDelete.Type = typeChatDelete
+	assert.NotNil(t, sb.apply(asDelete))
+
+	assert.ErrorIs(t, sb.apply(signChange(alice, typeChatEdit, "never-seen", "x")), errNotInScrollback)
+	assert.ErrorIs(t, sb.apply(signChange(alice, typeChatEdit, "old", "x")), errNotSender)
+	e, _ := sb.get("a2")
+	assert.Equal(t, "second", e.Text)
+
+	assert.Nil(t, sb.apply(edit))
+	e, _ = sb.get("a1")
+	assert.Equal(t, "hello", e.Text)
+	assert.True(t, e.Edited)
+
+	assert.Nil(t, sb.apply(signChange(alice, typeChatDelete, "a1", "")))
+	e, _ = sb.get("a1")
+	assert.True(t, e.Deleted)
+	assert.Equal(t, "hello", e.Text)
+	assert.NotNil(t, sb.apply(signChange(alice, typeChatEdit, "a1", "back")))
+
+	var none *scrollback
+	none.add(scrollEntry{ID: "x"})
+	assert.ErrorIs(t, none.apply(edit), errNotInScrollback)
+}
+
+func TestFindOwn(t *testing.T) {
+	sb := &scrollback{}
+	_, err := sb.findOwn(lastMessage)
+	assert.ErrorIs(t, err, errNotInScrollback)
+	for i := 0; i < scrollbackSize+5; i++ {
+		sb.add(scrollEntry{ID: fmt.Sprintf("%03d", i), Own: i%2 == 0})
+	}
+	_, ok := sb.get("000")
+	assert.False(t, ok, "oldest entries fall out of the ring")
+	e, err := sb.findOwn(lastMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, "204", e.ID)
+	e, err = sb.findOwn("19")
+	assert.NotNil(t, err, "ambiguous prefix")
+	e, err = sb.findOwn("198")
+	assert.Nil(t, err)
+	assert.Equal(t, "198", e.ID)
+	_, err = sb.findOwn("199")
+	assert.ErrorIs(t, err, errNotInScrollback, "not our message")
+}
+
+func TestSessionEdit(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8427", "pass123", tcp.WithBanner("8428"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-session-edit", RelayAddress: "127.0.0.1:8427", RelayPassword: "pass123"}
+	var sessions []*Session
+	for i := 0; i < 3; i++ {
+		s, err := NewSession(context.Background(), options)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer s.Close()
+		sessions = append(sessions, s)
+	}
+	alice, bob, mallory := sessions[0], sessions[1], sessions[2]
+	received := make(chan message.Message, 10)
+	alice.Start(func(message.Message) {}, func(string) {})
+	bob.Start(func(m message.Message) { received <- m }, func(string) {})
+	mallory.Start(func(message.Message) {}, func(string) {})
+	next := func() message.Message {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+		return message.Message{}
+	}
+
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "helo", Alias: "alice"}))
+	original := next()
+	assert.Equal(t, alice.scrollback.own()[0].ID, original.ID)
+
+	// mallory cannot change alice's message, whatever session she claims
+	_, err := mallory.Edit(original.ID, "pwned")
+	assert.ErrorIs(t, err, errNotInScrollback)
+	forged := signChange(mallory.key, typeChatEdit, original.ID, "pwned")
+	forged.Session = original.Session
+	assert.Nil(t, mallory.Send(forged))
+
+	id, err := alice.Edit(lastMessage, "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, original.ID, id)
+	m := next()
+	assert.Equal(t, typeChatEdit, m.Type, "the forged edit never reaches bob")
+	assert.Equal(t, "hello", m.Message)
+	e, _ := bob.scrollback.get(original.ID)
+	assert.Equal(t, "hello", e.Text)
+
+	_, err = alice.Delete(id[:6])
+	assert.Nil(t, err)
+	assert.Equal(t, typeChatDelete, next().Type)
+	e, _ = bob.scrollback.get(original.ID)
+	assert.True(t, e.Deleted)
+	assert.Empty(t, alice.scrollback.own())
+
+	var buf bytes.Buffer
+	assert.Nil(t, bob.transcript.write(&buf, false))
+	assert.Contains(t, buf.String(), "hello (edited "+shortID(id)+")")
+	assert.Contains(t, buf.String(), "(deleted "+shortID(id)+")")
+	aliceHead, _ := alice.Integrity()
+	bobHead, _ := bob.Integrity()
+	assert.Equal(t, aliceHead, bobHead)
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"strings"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeEmote is an action, sent with /me. Message is the action already
+// written out with the sender's alias, as in "* bob waves", so clients
+// that do not know the type still have readable text, while those that do
+// render the action with the alias the message came with.
+const typeEmote message.Type = "emote"
+
+// emotePrefix starts the text of an emote.
+const emotePrefix = "* "
+
+// shortcut is a command that stands for a piece of text, appended to
+// whatever follows the command.
+type shortcut struct {
+	command string
+	text    string
+}
+
+// shortcuts are expanded before a line is sent. They are the same in every
+// language.
+var shortcuts = []shortcut{
+	{"/shrug", `¯\_(ツ)_/¯`},
+	{"/tableflip", "(╯°□°)╯︵ ┻━┻"},
+	{"/unflip", "┬─┬ノ( º _ ºノ)"},
+	{"/lenny", "( ͡° ͜ʖ ͡°)"},
+}
+
+// expandShortcut returns line with a leading shortcut expanded, and
+// whether it had one.
+func expandShortcut(line string) (string, bool) {
+	command, rest, _ := strings.Cut(line, " ")
+	for _, s := range shortcuts {
+		if s.command == command {
+			return strings.TrimSpace(strings.TrimSpace(rest) + " " + s.text), true
+		}
+	}
+	return line, false
+}
+
+// newEmote returns the emote of alias doing action.
+func newEmote(alias, action string) message.Message {
+	return message.Message{Type: typeEmote, Message: emotePrefix + alias + " " + action, Alias: alias, ID: newMessageID()}
+}
+
+// emoteMessage returns the emote of alias doing action, the argument of
+// /me, with a shortcut the action starts with expanded, and false if the
+// action is missing.
+func emoteMessage(alias, action string) (message.Message, bool) {
+	action = strings.TrimSpace(action)
+	if action == "" {
+		return message.Message{}, false
+	}
+	action, _ = expandShortcut(action)
+	return newEmote(alias, action), true
+}
+
+// emoteAction returns the action of an emote, and false if its text does
+// not start with the alias it came with.
+func emoteAction(m message.Message) (string, bool) {
+	action, ok := strings.CutPrefix(m.Message, emotePrefix+m.Alias+" ")
+	return action, ok && m.Alias != ""
+}
+
+// renderEmote renders an emote as "* alias action", the alias in color.
+// An emote whose text does not match its alias is shown as its sender
+// wrote it, next to the alias, so it cannot pass for someone else's.
+func renderEmote(m message.Message, alias string) string {
+	action, ok := emoteAction(m)
+	if !ok {
+		return "[" + colorText(alias, BlueColor) + "]: " + highlightURLs(m.Message)
+	}
+	return emotePrefix + colorText(alias, BlueColor) + " " + highlightURLs(action)
+}
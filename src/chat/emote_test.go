@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestExpandShortcut(t *testing.T) {
+	for line, want := range map[string]string{
+		"/shrug":               `¯\_(ツ)_/¯`,
+		"/shrug no idea":       `no idea ¯\_(ツ)_/¯`,
+		"/tableflip  mondays ": "mondays (╯°□°)╯︵ ┻━┻",
+	} {
+		got, ok := expandShortcut(line)
+		assert.True(t, ok, line)
+		assert.Equal(t, want, got, line)
+	}
+	for _, line := range []string{"hello /shrug", "/shrugs", "/me waves"} {
+		got, ok := expandShortcut(line)
+		assert.False(t, ok, line)
+		assert.Equal(t, line, got)
+	}
+}
+
+func TestEmote(t *testing.T) {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(false)
+	m, ok := emoteMessage("bob", "waves")
+	assert.True(t, ok)
+	assert.Equal(t, typeEmote, m.Type)
+	// the text reads well where the type is not known
+	assert.Equal(t, "* bob waves", m.Message)
+	assert.NotEmpty(t, m.ID)
+	assert.Nil(t, checkMessage(m))
+	action, ok := emoteAction(m)
+	assert.True(t, ok)
+	assert.Equal(t, "waves", action)
+	assert.Equal(t, "* bob waves", renderEmote(m, "bob"))
+
+	m, ok = emoteMessage("bob", "/shrug")
+	assert.True(t, ok)
+	assert.Equal(t, `* bob ¯\_(ツ)_/¯`, m.Message)
+	_, ok = emoteMessage("bob", "  ")
+	assert.False(t, ok)
+
+	// an emote written for another alias is not rendered as theirs
+	m.Alias = "mallory"
+	_, ok = emoteAction(m)
+	assert.False(t, ok)
+	assert.Equal(t, `[mallory]: * bob ¯\_(ツ)_/¯`, renderEmote(m, "mallory"))
+}
+
+func TestEmoteSession(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8438", "pass123", tcp.WithBanner("8439"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-emote-session", RelayAddress: "127.0.0.1:8438", RelayPassword: "pass123"}
+
+	start := func() (*Session, chan message.Message) {
+		s, err := NewSession(context.Background(), options)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { s.Close() })
+		got := make(chan message.Message, 10)
+		s.Start(func(m message.Message) {
+			s.Answer(m)
+			got <- m
+		}, func(string) {})
+		return s, got
+	}
+	alice, toAlice := start()
+	bob, toBob := start()
+	alice.SetAlias("alice")
+	time.Sleep(200 * time.Millisecond)
+
+	m, _ := emoteMessage(alice.Alias(), "waves")
+	assert.Nil(t, alice.Send(m))
+	wait := func(ch chan message.Message, typ message.Type) message.Message {
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-ch:
+				if got.Type == typ {
+					return got
+				}
+			case <-deadline:
+				t.Fatalf("no %s arrived", typ)
+			}
+		}
+	}
+	got := wait(toBob, typeEmote)
+	assert.Equal(t, "* alice waves", got.Message)
+	assert.Equal(t, "alice", got.Alias)
+	// it is acked, searchable and in the transcript like any chat message
+	assert.Equal(t, m.ID, wait(toAlice, typeAck).ID)
+	q, err := parseFind(mustParseCommand(t, "/find waves"), time.Now())
+	assert.Nil(t, err)
+	found, _, err := bob.scrollback.find(q, findLimit, time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, m.ID, found[0].ID)
+	}
+	_, n := bob.Integrity()
+	assert.Equal(t, 1, n)
+}
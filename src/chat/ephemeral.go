@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// maxEphemeralTTL is the longest an ephemeral message may live.
+const maxEphemeralTTL = 24 * time.Hour
+
+// ephemeralMeta is the Meta of an ephemeral chat, emote or encrypted
+// message. It sits beside the text, not in it, so a message wrapped with
+// /encrypt keeps it.
+type ephemeralMeta struct {
+	// TTL is how many seconds the message lives after it arrives.
+	TTL int `json:"ttl"`
+}
+
+// makeEphemeral flags m to be forgotten ttl after it arrives.
+func makeEphemeral(m *message.Message, ttl time.Duration) {
+	m.Meta, _ = json.Marshal(ephemeralMeta{TTL: int(ttl / time.Second)})
+}
+
+// ephemeralTTL returns how long m lives, or zero for a message that stays.
+// Chat, emote and encrypted messages with a Meta that is not a valid TTL
+// are refused rather than kept.
+func ephemeralTTL(m message.Message) (time.Duration, error) {
+	if len(m.Meta) == 0 || (m.Type != "chat" && m.Type != typeEmote && m.Type != "encrypted") {
+		return 0, nil
+	}
+	var meta ephemeralMeta
+	if err := json.Unmarshal(m.Meta, &meta); err != nil {
+		return 0, fmt.Errorf("invalid ephemeral message: %w", err)
+	}
+	ttl := time.Duration(meta.TTL) * time.Second
+	if ttl <= 0 || ttl > maxEphemeralTTL {
+		return 0, fmt.Errorf("ephemeral message lives %ds, not between 1s and %s", meta.TTL, maxEphemeralTTL)
+	}
+	return ttl, nil
+}
+
+// isEphemeral reports whether m is an ephemeral message.
+func isEphemeral(m message.Message) bool {
+	ttl, err := ephemeralTTL(m)
+	return err == nil && ttl > 0
+}
+
+// parseEphemeral reads the lifetime /ephemeral is given, in seconds or
+// as a duration like 5m.
+func parseEphemeral(lifetime string) (ttl time.Duration, err error) {
+	if seconds, errAtoi := strconv.Atoi(lifetime); errAtoi == nil {
+		ttl = time.Duration(seconds) * time.Second
+	} else if ttl, err = time.ParseDuration(lifetime); err != nil {
+		return 0, usageErr("ephemeral", fmt.Errorf("%q is not a number of seconds or a duration", lifetime))
+	}
+	if ttl < time.Second || ttl > maxEphemeralTTL {
+		return 0, fmt.Errorf("an ephemeral message lives between 1s and %s", maxEphemeralTTL)
+	}
+	return ttl.Truncate(time.Second), nil
+}
+
+// expire replaces the text of the ephemeral entries due by now with a
+// marker and returns their ids.
+func (sb *scrollback) expire(now time.Time) (ids []string) {
+	if sb == nil {
+		return
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	for i := range sb.entries {
+		e := &sb.entries[i]
+		if e.Expires.IsZero() || e.Expired || now.Before(e.Expires) {
+			continue
+		}
+		e.Text = localize(msgEphemeralExpired)
+		e.Expired = true
+		ids = append(ids, e.ID)
+	}
+	return
+}
+
+// addChat adds a chat message to the scrollback, arranging for it to be
+// redacted once its time is up if it is ephemeral.
+func (s *Session) addChat(m message.Message, own bool) {
+	now := time.Now()
+	e := scrollEntry{ID: m.ID, Session: m.Session, Alias: m.Alias, Text: m.Message, At: now, Own: own}
+	if ttl, _ := ephemeralTTL(m); ttl > 0 {
+		e.Expires = now.Add(ttl)
+		time.AfterFunc(ttl, func() { s.scrollback.expire(time.Now()) })
+	}
+	s.scrollback.add(e)
+}
+
+// showEphemeral renders text, the text of the ephemeral chat message m,
+// with a countdown to its expiry, or as expired once its time is up or it
+// has left the scrollback.
+func (sb *scrollback) showEphemeral(m message.Message, text string) string {
+	e, ok := sb.get(m.ID)
+	if !ok || e.Expired {
+		return localize(msgEphemeralExpired)
+	}
+	left := time.Until(e.Expires).Round(time.Second)
+	if left <= 0 {
+		return localize(msgEphemeralExpired)
+	}
+	return text + " " + localize(msgEphemeralMarker, left)
+}
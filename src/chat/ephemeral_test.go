@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/crypt"
+	"github.com/schollz/croc/v10/src/message"
+)
+
+func TestParseEphemeral(t *testing.T) {
+	c := mustParseCommand(t, "/ephemeral  60 here is the temp password")
+	ttl, err := parseEphemeral(c.arg(0))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	assert.Equal(t, "here is the temp password", c.arg(1))
+
+	c = mustParseCommand(t, "/ephemeral 5m /encrypt key secret")
+	ttl, err = parseEphemeral(c.arg(0))
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Minute, ttl)
+	assert.Equal(t, "/encrypt key secret", c.arg(1))
+
+	for _, line := range []string{"/ephemeral", "/ephemeral 60"} {
+		_, err = parseCommand(line)
+		assert.True(t, errors.Is(err, errUsage), line)
+	}
+	_, err = parseEphemeral("soon")
+	assert.True(t, errors.Is(err, errUsage))
+	for _, lifetime := range []string{"0", "-5", "25h"} {
+		_, err = parseEphemeral(lifetime)
+		if assert.NotNil(t, err, lifetime) {
+			assert.False(t, errors.Is(err, errUsage), lifetime)
+		}
+	}
+}
+
+func TestEphemeralSurvivesEncryption(t *testing.T) {
+	m, ok := encryptedMessage(mustParseCommand(t, "/encrypt key the temp password"))
+	assert.True(t, ok)
+	makeEphemeral(&m, time.Minute)
+
+	key, _, err := crypt.New([]byte("room secret"), nil)
+	assert.Nil(t, err)
+	b, err := message.Encode(key, m)
+	assert.Nil(t, err)
+	got, err := message.Decode(key, b)
+	assert.Nil(t, err)
+	ttl, err := ephemeralTTL(got)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, ttl)
+
+	decoded, err := decodeFrame(frame(t, got))
+	assert.Nil(t, err)
+	assert.True(t, isEphemeral(decoded))
+	// a lifetime out of range is refused rather than kept
+	got.Meta = []byte(`{"ttl":0}`)
+	_, err = decodeFrame(frame(t, got))
+	assert.NotNil(t, err)
+	got.Meta = []byte(`{"ttl":"forever"}`)
+	_, err = decodeFrame(frame(t, got))
+	assert.NotNil(t, err)
+}
+
+func TestScrollbackExpiresEphemeral(t *testing.T) {
+	alice := newSessionKey()
+	now := time.Now()
+	sb := &scrollback{}
+	sb.add(scrollEntry{ID: "stays", Session: sessionID(alice), Text: "hello", At: now})
+	sb.add(scrollEntry{ID: "short", Session: sessionID(alice), Text: "password1", At: now, Expires: now.Add(time.Second)})
+	sb.add(scrollEntry{ID: "long", Session: sessionID(alice), Text: "password2", At: now, Expires: now.Add(time.Hour)})
+
+	// an ephemeral message cannot be edited, as the edit would be kept
+	assert.ErrorIs(t, sb.apply(signChange(alice, typeChatEdit, "long", "changed")), errEphemeralEdit)
+
+	assert.Empty(t, sb.expire(now))
+	assert.Equal(t, []string{"short"}, sb.expire(now.Add(time.Second)))
+	assert.Empty(t, sb.expire(now.Add(time.Second)))
+	e, _ := sb.get("short")
+	assert.True(t, e.Expired)
+	assert.Equal(t, "(expired ephemeral message)", e.Text)
+	e, _ = sb.get("stays")
+	assert.Equal(t, "hello", e.Text)
+
+	found, _, err := sb.find(findQuery{re: regexp.MustCompile("password")}, findLimit, now.Add(time.Minute))
+	assert.Nil(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "long", found[0].ID)
+	}
+	assert.Equal(t, "(expired ephemeral message)", sb.showEphemeral(message.Message{ID: "short"}, "password1"))
+	assert.Contains(t, sb.showEphemeral(message.Message{ID: "long"}, "password2"), "password2 (disappears in ")
+	assert.Equal(t, "(expired ephemeral message)", sb.showEphemeral(message.Message{ID: "gone"}, "password3"))
+
+	// the sender redacts its own copy the same way
+	s := &Session{scrollback: &scrollback{}}
+	m := message.Message{Type: "chat", ID: "own", Message: "password4"}
+	makeEphemeral(&m, time.Second)
+	s.addChat(m, true)
+	assert.Eventually(t, func() bool {
+		e, _ := s.scrollback.get("own")
+		return e.Expired && e.Text == "(expired ephemeral message)"
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestTranscriptLeavesOutEphemeral(t *testing.T) {
+	tr := &transcript{}
+	assert.True(t, tr.record(message.Message{Type: "chat", ID: "1", Message: "hello"}, false, time.Now()))
+	m := message.Message{Type: "chat", ID: "2", Message: "the temp password"}
+	makeEphemeral(&m, time.Minute)
+	assert.False(t, tr.record(m, false, time.Now()))
+	_, n := tr.Head()
+	assert.Equal(t, 1, n)
+
+	var buf bytes.Buffer
+	assert.Nil(t, tr.write(&buf, true))
+	assert.Contains(t, buf.String(), "hello")
+	assert.NotContains(t, buf.String(), "temp password")
+}
@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// fileMeta is what a file offer says about the file besides its name and
+// contents. It travels in the offer's Meta.
+type fileMeta struct {
+	// Mode holds the permission bits.
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	// SHA256 is the hex digest of the contents, which have to match before
+	// the rest is applied.
+	SHA256 string `json:"sha256"`
+}
+
+// metaPolicy is what a receiver takes from the metadata of received files.
+type metaPolicy struct {
+	// apply sets received files to the sender's mode and modification
+	// time; without it they get 0644 and the time they were written.
+	apply bool
+	// keepExec also keeps executable bits, which are dropped otherwise.
+	keepExec bool
+}
+
+// defaultFileMode is the mode of received files without metadata.
+const defaultFileMode fs.FileMode = 0o644
+
+func fileDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// attachFileMeta adds the metadata of fi and the digest of content to an
+// offer.
+func attachFileMeta(m *message.Message, fi fs.FileInfo, content []byte) {
+	meta := fileMeta{Mode: fi.Mode().Perm(), ModTime: fi.ModTime(), SHA256: fileDigest(content)}
+	var err error
+	if m.Meta, err = json.Marshal(meta); err != nil {
+		m.Meta = nil
+	}
+}
+
+// fileMetaFrom returns the metadata of an offer, nil for offers from peers
+// that send none.
+func fileMetaFrom(m message.Message) (meta *fileMeta, err error) {
+	if len(m.Meta) == 0 {
+		return
+	}
+	meta = new(fileMeta)
+	if err = json.Unmarshal(m.Meta, meta); err != nil {
+		return nil, fmt.Errorf("bad file metadata: %w", err)
+	}
+	return
+}
+
+// verify checks content against the digest in the metadata.
+func (meta *fileMeta) verify(content []byte) error {
+	if meta == nil {
+		return nil
+	}
+	if got := fileDigest(content); got != meta.SHA256 {
+		return fmt.Errorf("contents do not match the offer: sha256 %s, want %s", got, meta.SHA256)
+	}
+	return nil
+}
+
+// mode returns the permission bits to give a received file. Setuid, setgid
+// and sticky bits never survive, and executable bits only with keepExec.
+func (p metaPolicy) mode(mode fs.FileMode) fs.FileMode {
+	if !p.apply {
+		return defaultFileMode
+	}
+	mode = mode.Perm()
+	if !p.keepExec {
+		mode &^= 0o111
+	}
+	return mode
+}
+
+// applyMeta gives path the mode and modification time of a received file.
+// On Windows only the owner write bit means anything; it becomes the read
+// only attribute.
+func (p metaPolicy) applyMeta(path string, mode fs.FileMode, modTime time.Time) error {
+	if !p.apply {
+		return nil
+	}
+	mode = p.mode(mode)
+	if runtime.GOOS == "windows" {
+		mode &= 0o200
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// saveFile writes a received file offer into dir. Offers that carry
+// metadata are only written if their contents match it, and then get the
+// mode and modification time it gives.
+func (p metaPolicy) saveFile(dir string, m message.Message) (path string, err error) {
+	if err = checkFileName(m.Message); err != nil {
+		return
+	}
+	meta, err := fileMetaFrom(m)
+	if err != nil {
+		return
+	}
+	if err = meta.verify(m.Bytes); err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	path = filepath.Join(dir, m.Message)
+	if err = os.WriteFile(path, m.Bytes, defaultFileMode); err != nil {
+		return
+	}
+	if meta != nil {
+		err = p.applyMeta(path, meta.Mode, meta.ModTime)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveFileMeta(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mode bits are limited on windows")
+	}
+	modTime := time.Unix(1_700_000_000, 0)
+	src := filepath.Join(t.TempDir(), "run.sh")
+	assert.Nil(t, os.WriteFile(src, []byte("#!/bin/sh\n"), 0o600))
+	assert.Nil(t, os.Chmod(src, 0o750|fs.ModeSetuid))
+	assert.Nil(t, os.Chtimes(src, modTime, modTime))
+	fi, err := os.Stat(src)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(src)
+	assert.Nil(t, err)
+	m := message.Message{Type: "chatfile", Message: "run.sh", Bytes: content}
+	attachFileMeta(&m, fi, content)
+
+	for _, tc := range []struct {
+		policy  metaPolicy
+		mode    fs.FileMode
+		keepsMT bool
+	}{
+		{metaPolicy{apply: true}, 0o640, true},
+		{metaPolicy{apply: true, keepExec: true}, 0o750, true},
+		// the umask applies without metadata
+		{metaPolicy{}, 0, false},
+	} {
+		path, err := tc.policy.saveFile(t.TempDir(), m)
+		assert.Nil(t, err)
+		got, err := os.Stat(path)
+		assert.Nil(t, err)
+		if tc.mode == 0 {
+			assert.Zero(t, got.Mode()&^defaultFileMode, "%+v", tc.policy)
+		} else {
+			assert.Equal(t, tc.mode, got.Mode(), "%+v", tc.policy)
+		}
+		assert.Equal(t, tc.keepsMT, got.ModTime().Equal(modTime), "%+v", tc.policy)
+	}
+
+	// contents that do not match the offer are not saved
+	tampered := m
+	tampered.Bytes = []byte("rm -rf /\n")
+	dir := t.TempDir()
+	_, err = metaPolicy{apply: true}.saveFile(dir, tampered)
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "run.sh"))
+	assert.True(t, os.IsNotExist(err))
+
+	// offers from peers without metadata are saved as before
+	old := m
+	old.Meta = nil
+	path, err := metaPolicy{apply: true}.saveFile(t.TempDir(), old)
+	assert.Nil(t, err)
+	got, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Zero(t, got.Mode()&^defaultFileMode)
+}
+
+func TestArchiveMeta(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mode bits are limited on windows")
+	}
+	modTime := time.Unix(1_700_000_000, 0)
+	src := filepath.Join(t.TempDir(), "tools")
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "bin"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "bin", "build"), []byte("#!/bin/sh\n"), 0o750))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "notes.txt"), []byte("notes"), 0o600))
+	for _, path := range []string{filepath.Join(src, "bin", "build"), filepath.Join(src, "notes.txt"), filepath.Join(src, "bin"), src} {
+		assert.Nil(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	sender, receiver := testTransfers(t)
+	for _, format := range []string{archiveTar, archiveZip} {
+		m, _ := offerTestArchive(t, sender, src, format, func(string) {})
+		offers := newArchiveOffers()
+		_, err := offers.received(m)
+		assert.Nil(t, err)
+		dest := t.TempDir()
+		r := acceptTestArchive(t, offers, receiver, m.ID, dest, true, metaPolicy{apply: true, keepExec: true}, func(string) {})
+		assert.Nil(t, r.err, format)
+		for name, mode := range map[string]fs.FileMode{"bin/build": 0o750, "notes.txt": 0o600} {
+			fi, err := os.Stat(filepath.Join(dest, "tools", filepath.FromSlash(name)))
+			if assert.Nil(t, err, format) {
+				assert.Equal(t, mode, fi.Mode(), "%s %s", format, name)
+				assert.True(t, fi.ModTime().Equal(modTime), "%s %s", format, name)
+			}
+		}
+		fi, err := os.Stat(filepath.Join(dest, "tools", "bin"))
+		if assert.Nil(t, err, format) {
+			assert.True(t, fi.ModTime().Equal(modTime), format)
+		}
+
+		// an archive that does not match its offer is not saved
+		m, info := offerTestArchive(t, sender, src, format, func(string) {})
+		info.SHA256 = strings.Repeat("0", 64)
+		desc, err := json.Marshal(info)
+		assert.Nil(t, err)
+		m.Message = string(desc)
+		_, err = offers.received(m)
+		assert.Nil(t, err)
+		dest = t.TempDir()
+		r = acceptTestArchive(t, offers, receiver, m.ID, dest, true, metaPolicy{apply: true}, func(string) {})
+		assert.ErrorContains(t, r.err, "does not match", format)
+		_, err = os.Stat(filepath.Join(dest, "tools"))
+		assert.True(t, os.IsNotExist(err), format)
+	}
+}
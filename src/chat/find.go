@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// findLimit is how many matches /find prints, the most recent ones.
+const findLimit = 20
+
+// findTimeout bounds one search. Go's regexps run in linear time, so a
+// pattern cannot blow up on a single message, but a slow pattern over the
+// whole scrollback is still cut short.
+const findTimeout = 500 * time.Millisecond
+
+// maxFindPattern bounds the length of a /find pattern.
+const maxFindPattern = 256
+
+var errFindTimeout = errors.New("search took too long")
+
+// findQuery is a parsed /find: a pattern and how far back to look.
+type findQuery struct {
+	re    *regexp.Regexp
+	since time.Time
+}
+
+// parseFind reads the arguments of /find. Matching ignores case unless
+// --case is given; --since 2h only looks at messages from the last two
+// hours. The text after the options, as typed, is the pattern.
+func parseFind(c commandArgs, now time.Time) (q findQuery, err error) {
+	if since, ok := c.option("--since"); ok {
+		d, err := time.ParseDuration(since)
+		if err != nil {
+			return q, usageErr("find", err)
+		}
+		q.since = now.Add(-d)
+	}
+	pattern := c.arg(0)
+	if len(pattern) > maxFindPattern {
+		return q, fmt.Errorf("pattern is longer than %d bytes", maxFindPattern)
+	}
+	if !c.has("--case") {
+		pattern = "(?i)" + pattern
+	}
+	if q.re, err = regexp.Compile(pattern); err != nil {
+		return q, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return q, nil
+}
+
+// find returns up to limit of the most recent messages matching q, oldest
+// first, and whether there were more. Deleted messages are skipped. It
+// gives up once deadline passes, returning what it found so far with
+// errFindTimeout.
+func (sb *scrollback) find(q findQuery, limit int, deadline time.Time) (found []scrollEntry, more bool, err error) {
+	if sb == nil {
+		return
+	}
+	sb.mu.Lock()
+	entries := append([]scrollEntry(nil), sb.entries...)
+	sb.mu.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.At.Before(q.since) {
+			break
+		}
+		if time.Now().After(deadline) {
+			err = errFindTimeout
+			break
+		}
+		if e.Deleted || !q.re.MatchString(e.Text) {
+			continue
+		}
+		if len(found) == limit {
+			more = true
+			break
+		}
+		found = append(found, e)
+	}
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return
+}
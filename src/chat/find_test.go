@@ -0,0 +1,83 @@
+package chat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFind(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	q, err := parseFind(mustParseCommand(t, "/find  --since 2h  lunch at noon "), now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-2*time.Hour), q.since)
+	assert.True(t, q.re.MatchString("LUNCH at noon?"))
+
+	q, err = parseFind(mustParseCommand(t, "/find --case --since=30m Lunch"), now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(-30*time.Minute), q.since)
+	assert.False(t, q.re.MatchString("lunch"))
+	assert.True(t, q.re.MatchString("Lunch"))
+
+	// the pattern is taken as typed, backslashes and quotes included
+	q, err = parseFind(mustParseCommand(t, `/find \d+ "items"`), now)
+	assert.Nil(t, err)
+	assert.True(t, q.re.MatchString(`42 "items"`))
+	assert.False(t, q.re.MatchString("42 items"))
+
+	for _, line := range []string{"/find", "/find --since 2h", "/find --since", "/find --since soon x", "/find --since -1h x", "/find --loud x"} {
+		_, err = parseCommand(line)
+		assert.ErrorIs(t, err, errUsage, line)
+	}
+	for _, line := range []string{"/find (unclosed", "/find " + fmt.Sprintf("%0300d", 0)} {
+		_, err = parseFind(mustParseCommand(t, line), now)
+		if assert.NotNil(t, err, line) {
+			assert.NotErrorIs(t, err, errUsage, line)
+		}
+	}
+}
+
+func TestScrollbackFind(t *testing.T) {
+	now := time.Now()
+	sb := &scrollback{}
+	for i := 0; i < 30; i++ {
+		sb.add(scrollEntry{ID: fmt.Sprintf("id%02d", i), Alias: "ann", Text: fmt.Sprintf("note %d", i), At: now.Add(time.Duration(i-30) * time.Hour)})
+	}
+	sb.add(scrollEntry{ID: "gone", Text: "note deleted", At: now, Deleted: true})
+	sb.add(scrollEntry{ID: "other", Text: "something else", At: now})
+	ids := func(entries []scrollEntry) (ids []string) {
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return
+	}
+
+	q, err := parseFind(mustParseCommand(t, "/find NOTE"), now)
+	assert.Nil(t, err)
+	found, more, err := sb.find(q, findLimit, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, more)
+	if assert.Len(t, found, findLimit) {
+		// the most recent matches, oldest first, without the deleted one
+		assert.Equal(t, "id10", found[0].ID)
+		assert.Equal(t, "id29", found[findLimit-1].ID)
+	}
+
+	q, err = parseFind(mustParseCommand(t, "/find --since 3h30m note [0-9]+$"), now)
+	assert.Nil(t, err)
+	found, more, err = sb.find(q, findLimit, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, more)
+	assert.Equal(t, []string{"id27", "id28", "id29"}, ids(found))
+
+	// a search past its deadline stops and says so
+	_, _, err = sb.find(q, findLimit, now.Add(-time.Second))
+	assert.ErrorIs(t, err, errFindTimeout)
+
+	var none *scrollback
+	found, _, err = none.find(q, findLimit, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, found)
+}
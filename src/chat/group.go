@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chzyer/readline"
+)
+
+// groupWindow is how soon after a chat message from the same sender the
+// next one goes under the same header.
+const groupWindow = 30 * time.Second
+
+// groupedConsole shows consecutive chat messages from one sender under a
+// single "[alias]:" header, with the messages after the first indented
+// below it. Anything else shown in the conversation, and every line the
+// user enters, ends the group, so a message after a system line gets its
+// own header. Writes that show nothing, like title updates and the bell,
+// do not, and neither do lines the split layout keeps in its status row.
+// Grouping is display only: each message stays its own entry in the
+// scrollback, with its own id. Reactions are shown in place when the
+// renderer has the width of a terminal.
+type groupedConsole struct {
+	*renderer
+	// disabled shows a header on every message, for output read by
+	// scripts rather than people.
+	disabled bool
+
+	mu    sync.Mutex
+	alias string
+	last  time.Time
+	// lastID and lastLine are the chat message shown last, as long as
+	// nothing was written after it.
+	lastID   string
+	lastLine string
+}
+
+func newGroupedConsole(r *renderer, disabled bool) *groupedConsole {
+	return &groupedConsole{renderer: r, disabled: disabled}
+}
+
+// Readline reads a line, which the terminal shows, so the group ends.
+func (c *groupedConsole) Readline() (string, error) {
+	line, err := c.renderer.Readline()
+	c.mu.Lock()
+	c.alias, c.lastID = "", ""
+	c.mu.Unlock()
+	return line, err
+}
+
+func (c *groupedConsole) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if visible(b) {
+		c.alias, c.lastID = "", ""
+	}
+	return c.renderer.Write(b)
+}
+
+// line shows text, a line of the given kind other than a chat message.
+func (c *groupedConsole) line(kind lineKind, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.renderer.inMain(kind) {
+		c.alias, c.lastID = "", ""
+	}
+	c.renderer.line(kind, text)
+}
+
+// writeChat shows text, the chat message with the given id alias sent, as
+// received at at.
+func (c *groupedConsole) writeChat(id, alias, text string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := fmt.Sprintf("%s [%s]: ", timestampAt(at), colorText(alias, BlueColor))
+	line := header + text
+	if c.continues(alias, at) {
+		line = strings.Repeat(" ", utf8.RuneCountInString(stripANSI(header))) + text
+	}
+	c.alias, c.last = alias, at
+	c.lastID, c.lastLine = id, line
+	c.renderer.line(lineChat, line)
+}
+
+// react shows summary, the reactions to the chat message with the given
+// id, at the end of its line and reports whether it could. That takes a
+// terminal, the message being the last thing shown, and the line still
+// fitting on one row of the screen.
+func (c *groupedConsole) react(id, summary string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disabled || c.width == nil || id == "" || id != c.lastID {
+		return false
+	}
+	line := c.lastLine + " " + summary
+	width := readline.Runes{}.WidthAll([]rune(stripANSI(line)))
+	if strings.Contains(line, "\n") || width >= c.width() {
+		return false
+	}
+	c.renderer.rewrite(line)
+	return true
+}
+
+// continues reports whether a message from alias at at goes under the
+// header of the one shown before it.
+func (c *groupedConsole) continues(alias string, at time.Time) bool {
+	if c.disabled || c.alias == "" || c.alias != alias {
+		return false
+	}
+	since := at.Sub(c.last)
+	return since >= 0 && since <= groupWindow
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// renderGrouped plays a conversation through a grouped console and
+// returns what it shows.
+func renderGrouped(t *testing.T, disabled bool) string {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(false)
+	var out bytes.Buffer
+	plain := newPlainConsole(strings.NewReader("and me\n"), &out)
+	defer plain.Close()
+	c := newGroupedConsole(newRenderer(plain), disabled)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+
+	c.writeChat("", "bob", "so I was thinking", at(0))
+	c.writeChat("", "bob", "we could move the meeting", at(5))
+	c.writeChat("", "bob", "to thursday", at(34))
+	c.writeChat("", "alice", "works for me", at(35))
+	// a pause longer than the window starts a new group
+	c.writeChat("", "alice", "actually, not before noon", at(70))
+	// as does a system line in between
+	c.Write([]byte("\n09:01:11 alice sent notes.txt (2 kB)\n"))
+	c.writeChat("", "alice", "notes are in there", at(72))
+	c.writeChat("", "alice", "page two too", at(73))
+	// and so does what the user types
+	_, err := c.Readline()
+	assert.Nil(t, err)
+	c.writeChat("", "alice", "anyone else?", at(74))
+	c.writeChat("", "zoë", "names of any script", at(75))
+	c.writeChat("", "zoë", "line up under the header", at(76))
+	return out.String()
+}
+
+func TestGroupedConsole(t *testing.T) {
+	for name, disabled := range map[string]bool{"grouped": false, "ungrouped": true} {
+		t.Run(name, func(t *testing.T) {
+			got := renderGrouped(t, disabled)
+			path := filepath.Join("testdata", name+".golden")
+			if *update {
+				assert.Nil(t, os.WriteFile(path, []byte(got), 0o644))
+			}
+			want, err := os.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Equal(t, string(want), got)
+		})
+	}
+}
+
+func TestGroupedConsoleInvisibleWrites(t *testing.T) {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(false)
+	var out bytes.Buffer
+	c := newGroupedConsole(newRenderer(newPlainConsole(strings.NewReader(""), &out)), false)
+	now := time.Now()
+	c.writeChat("", "alice", "one", now)
+	// the unread count in the title and the bell show nothing
+	c.Write([]byte("\x1b]0;croc chat (3)\a"))
+	c.Write([]byte(bell))
+	c.writeChat("", "alice", "two", now)
+	assert.Equal(t, 1, strings.Count(out.String(), "[alice]"))
+	c.Write([]byte("\nalice left\n"))
+	c.writeChat("", "alice", "three", now)
+	assert.Equal(t, 2, strings.Count(out.String(), "[alice]"))
+}
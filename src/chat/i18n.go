@@ -0,0 +1,771 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// msgID identifies a user-facing string in the message catalogs. Log lines
+// and protocol messages are not translated.
+type msgID string
+
+const (
+	msgJoined           msgID = "joined"
+	msgHelpSendFile     msgID = "help.sendfile"
+	msgHelpTransfer     msgID = "help.transfer"
+	msgHelpPing         msgID = "help.ping"
+	msgHelpLimit        msgID = "help.limit"
+	msgHelpBookmark     msgID = "help.bookmark"
+	msgHelpSchedule     msgID = "help.schedule"
+	msgHelpIntegrity    msgID = "help.integrity"
+	msgHelpLinks        msgID = "help.links"
+	msgHelpEdit         msgID = "help.edit"
+	msgHelpEmote        msgID = "help.emote"
+	msgHelpEphemeral    msgID = "help.ephemeral"
+	msgHelpQuiet        msgID = "help.quiet"
+	msgHelpDND          msgID = "help.dnd"
+	msgHelpLayout       msgID = "help.layout"
+	msgHelpTransfers    msgID = "help.transfers"
+	msgHelpFind         msgID = "help.find"
+	msgHelpRules        msgID = "help.rules"
+	msgHelpQuit         msgID = "help.quit"
+	msgEnterAlias       msgID = "alias.enter"
+	msgAliasSet         msgID = "alias.set"
+	msgAliasUpdated     msgID = "alias.updated"
+	msgWarning          msgID = "warning"
+	msgPong             msgID = "ping.pong"
+	msgNoPong           msgID = "ping.none"
+	msgFileOffer        msgID = "file.offer"
+	msgFileDeclined     msgID = "file.declined"
+	msgFileSaveDir      msgID = "file.savedir"
+	msgFileSaveFailed   msgID = "file.savefailed"
+	msgFileSaved        msgID = "file.saved"
+	msgFileRule         msgID = "file.rule"
+	msgFileRuleDecline  msgID = "file.ruledecline"
+	msgFolderOffer      msgID = "folder.offer"
+	msgTransferOffer    msgID = "transfer.offer"
+	msgEncryptedFrom    msgID = "encrypted.from"
+	msgDecryptFailed    msgID = "encrypted.failed"
+	msgUnknownType      msgID = "unknown"
+	msgLimitShow        msgID = "limit.show"
+	msgLimitSet         msgID = "limit.set"
+	msgRelayError       msgID = "relay.error"
+	msgRelayTiming      msgID = "relay.timing"
+	msgNoPeers          msgID = "who.none"
+	msgPeer             msgID = "who.peer"
+	msgNoLinks          msgID = "links.none"
+	msgCommandFailed    msgID = "command.failed"
+	msgCommandsFailed   msgID = "commands.failed"
+	msgEditUsage        msgID = "edit.usage"
+	msgDeleteUsage      msgID = "delete.usage"
+	msgChangeFailed     msgID = "edit.failed"
+	msgEdited           msgID = "edit.marker"
+	msgHelpReact        msgID = "help.react"
+	msgReactUsage       msgID = "react.usage"
+	msgReactFailed      msgID = "react.failed"
+	msgReacted          msgID = "react.received"
+	msgReactedOwn       msgID = "react.sent"
+	msgDeleted          msgID = "delete.marker"
+	msgNoOwnMessages    msgID = "mine.none"
+	msgQuietSet         msgID = "quiet.set"
+	msgQuietShow        msgID = "quiet.show"
+	msgQuietNone        msgID = "quiet.none"
+	msgQuietOff         msgID = "quiet.off"
+	msgQuietFailed      msgID = "quiet.failed"
+	msgRulesFailed      msgID = "rules.failed"
+	msgRulesNone        msgID = "rules.none"
+	msgRulesList        msgID = "rules.list"
+	msgDNDOn            msgID = "dnd.on"
+	msgDNDOff           msgID = "dnd.off"
+	msgDNDNothing       msgID = "dnd.nothing"
+	msgDNDDivider       msgID = "dnd.divider"
+	msgDNDDropped       msgID = "dnd.dropped"
+	msgDNDUsage         msgID = "dnd.usage"
+	msgLayoutShow       msgID = "layout.show"
+	msgLayoutUsage      msgID = "layout.usage"
+	msgLayoutNoTerminal msgID = "layout.no_terminal"
+	msgLedgerEmpty      msgID = "transfers.empty"
+	msgLedgerEntry      msgID = "transfers.entry"
+	msgLedgerSent       msgID = "transfers.sent"
+	msgLedgerReceived   msgID = "transfers.received"
+	msgLedgerDuplicate  msgID = "transfers.duplicate"
+	msgLedgerSkipped    msgID = "transfers.skipped"
+	msgLedgerFailed     msgID = "transfers.failed"
+	msgLedgerUsage      msgID = "transfers.usage"
+	msgResultDone       msgID = "transfers.result.done"
+	msgResultFailed     msgID = "transfers.result.failed"
+	msgResultDeclined   msgID = "transfers.result.declined"
+	msgResultCancelled  msgID = "transfers.result.cancelled"
+	msgUnread           msgID = "dnd.unread"
+	msgFindUsage        msgID = "find.usage"
+	msgFindNone         msgID = "find.none"
+	msgFindMore         msgID = "find.more"
+	msgFindTimeout      msgID = "find.timeout"
+	msgScheduled        msgID = "schedule.added"
+	msgNoScheduled      msgID = "schedule.none"
+	msgUnscheduled      msgID = "schedule.cancelled"
+	msgScheduledSent    msgID = "schedule.sent"
+	msgScheduledRetry   msgID = "schedule.retry"
+	msgChainHead        msgID = "integrity.head"
+	msgSaveUsage        msgID = "save.usage"
+	msgSaveFailed       msgID = "save.failed"
+	msgSaved            msgID = "save.done"
+	msgBookmarkFailed   msgID = "bookmark.failed"
+	msgBookmarkSaved    msgID = "bookmark.saved"
+	msgBookmarksFailed  msgID = "bookmarks.failed"
+	msgEncryptUsage     msgID = "encrypt.usage"
+	msgEncryptFailed    msgID = "encrypt.failed"
+	msgArchiveFailed    msgID = "sendfile.archivefailed"
+	msgFolderSent       msgID = "sendfile.foldersent"
+	msgReadFailed       msgID = "sendfile.readfailed"
+	msgFileSent         msgID = "sendfile.sent"
+	msgAcceptUsage      msgID = "accept.usage"
+	msgAcceptFailed     msgID = "accept.failed"
+	msgAccepted         msgID = "accept.done"
+	msgAcceptNeedsPipe  msgID = "accept.needspipe"
+	msgAcceptPiped      msgID = "accept.piped"
+	msgAcceptExited     msgID = "accept.exited"
+	msgAcceptExecFailed msgID = "accept.execfailed"
+	msgTransferFailed   msgID = "transfer.startfailed"
+	msgTransferOffered  msgID = "transfer.offered"
+	msgGetUsage         msgID = "get.usage"
+	msgGetFailed        msgID = "get.failed"
+	msgTransferLabel    msgID = "transfer.label"
+	msgTransferProgress msgID = "transfer.progress"
+	msgTransferDone     msgID = "transfer.done"
+	msgTransferError    msgID = "transfer.error"
+	msgPeerDisconnected msgID = "session.disconnected"
+	msgReconnected      msgID = "session.reconnected"
+	msgUpgradeRequired  msgID = "session.upgrade_required"
+	msgSkipping         msgID = "archive.skipping"
+	msgNoThumbnail      msgID = "thumbnail.none"
+	msgMetadataFailed   msgID = "file.metadata_failed"
+	msgNewMessages      msgID = "unread.divider"
+	msgTitle            msgID = "unread.title"
+	msgTitleUnread      msgID = "unread.title_count"
+	msgObserving        msgID = "observer.help"
+	msgObserverOnly     msgID = "observer.only"
+	msgObserverTag      msgID = "observer.tag"
+	msgObserverNoFiles  msgID = "observer.no_files"
+	msgEmoteUsage       msgID = "emote.usage"
+	msgEphemeralUsage   msgID = "ephemeral.usage"
+	msgEphemeralSent    msgID = "ephemeral.sent"
+	msgEphemeralMarker  msgID = "ephemeral.marker"
+	msgEphemeralExpired msgID = "ephemeral.expired"
+	msgIdentityChanged  msgID = "identity.changed"
+	msgIdentityFailed   msgID = "identity.failed"
+	msgHelpConfirm      msgID = "help.confirm"
+	msgConfirmNeeded    msgID = "confirm.needed"
+	msgConfirmPeer      msgID = "confirm.peer"
+	msgConfirmFirst     msgID = "confirm.first"
+	msgConfirmed        msgID = "confirm.done"
+	msgConfirmNone      msgID = "confirm.none"
+	msgConfirmOff       msgID = "confirm.off"
+	msgConfirmByPeer    msgID = "confirm.by_peer"
+	msgConfirmMismatch  msgID = "confirm.mismatch"
+	msgUnverified       msgID = "confirm.unverified"
+	msgRoomSettings     msgID = "settings.room"
+	msgRoomStricter     msgID = "settings.stricter"
+	msgSettingOn        msgID = "settings.on"
+	msgSettingOff       msgID = "settings.off"
+	msgSettingReceipts  msgID = "settings.receipts"
+	msgSettingHistory   msgID = "settings.history"
+	msgSettingObservers msgID = "settings.observers"
+	msgSettingEphemeral msgID = "settings.ephemeral"
+	msgHistoryDisabled  msgID = "settings.no_history"
+	msgObserverDenied   msgID = "observer.denied"
+	msgRelayUnreachable msgID = "preflight.unreachable"
+	msgRelayHandshake   msgID = "preflight.handshake"
+	msgHelpStats        msgID = "help.stats"
+	msgFileOfferSize    msgID = "file.offer_size"
+	msgLowBandwidthOn   msgID = "lowbandwidth.on"
+	msgLowBandwidthTag  msgID = "lowbandwidth.tag"
+	msgPeerLowBandwidth msgID = "lowbandwidth.peer"
+	msgStatsHeader      msgID = "stats.header"
+	msgStatsLine        msgID = "stats.line"
+	msgStatsMessages    msgID = "stats.messages"
+	msgStatsPresence    msgID = "stats.presence"
+	msgStatsFiles       msgID = "stats.files"
+	msgStatsOverhead    msgID = "stats.overhead"
+	msgStatsTotal       msgID = "stats.total"
+	msgRoomExpiring     msgID = "relay.expiring"
+	msgRoomQuota        msgID = "relay.quota"
+	msgRoomNobodyJoined msgID = "relay.nobody"
+	msgBadArguments     msgID = "args.bad"
+	msgNoArguments      msgID = "args.none"
+	msgSetAliasUsage    msgID = "alias.usage"
+	msgLimitUsage       msgID = "limit.usage"
+	msgScheduleUsage    msgID = "schedule.usage"
+	msgUnscheduleUsage  msgID = "unschedule.usage"
+	msgQuietUsage       msgID = "quiet.usage"
+	msgBookmarkUsage    msgID = "bookmark.usage"
+	msgSendFileUsage    msgID = "sendfile.usage"
+	msgTransferUsage    msgID = "transfer.usage"
+	msgSecurityUsage    msgID = "security.usage"
+	msgHelpSecurity     msgID = "help.security"
+	msgSecuritySummary  msgID = "security.summary"
+	msgSecurityHeader   msgID = "security.header"
+	msgSecurityTCP      msgID = "security.tcp"
+	msgSecurityRelay    msgID = "security.relay"
+	msgSecurityDefault  msgID = "security.default"
+	msgSecurityPass     msgID = "security.pass"
+	msgSecurityOpenPass msgID = "security.openpass"
+	msgSecurityE2E      msgID = "security.e2e"
+	msgSecurityNoE2E    msgID = "security.noe2e"
+	msgSecurityE2EOn    msgID = "security.e2e.on"
+	msgSecurityE2EOff   msgID = "security.e2e.off"
+	msgSecuritySigning  msgID = "security.signing"
+	msgSecuritySigned   msgID = "security.signed"
+	msgSecurityUnsigned msgID = "security.unsigned"
+	msgSecurityNoPeers  msgID = "security.nopeers"
+	msgSecuritySigner   msgID = "security.signer"
+	msgSecurityNoSigner msgID = "security.nosigner"
+	msgPeerUnsigned     msgID = "peer.unsigned"
+	msgDirectOn         msgID = "direct.on"
+	msgDirectOff        msgID = "direct.off"
+	msgDirectCrowded    msgID = "direct.crowded"
+)
+
+// catalog holds one locale's strings, which are fmt formats. yes and no
+// are the answers its yes/no prompts accept besides y/yes and n/no.
+type catalog struct {
+	strings map[msgID]string
+	yes     []string
+	no      []string
+}
+
+// english is the fallback for every locale and every missing string.
+var english = catalog{strings: map[msgID]string{
+	msgJoined:           "Joined chat room '%s'. Type your messages and press enter to send.",
+	msgHelpSendFile:     "To send a file, type '/sendfile <filepath>', in double quotes if it has spaces; folders are sent as a tar, or a zip with '--zip'",
+	msgHelpTransfer:     "To send a large file or folder with croc, type '/transfer <path>'",
+	msgHelpPing:         "To measure latency to peers, type '/ping'; '/who' lists them; '/relay' checks the relay",
+	msgHelpLimit:        "To cap outgoing bandwidth shared by chat and calls, type '/limit <500k|2M|off>'",
+	msgHelpBookmark:     "To save this room for 'croc chat --room-name', type '/bookmark <name>'",
+	msgHelpSchedule:     "To send later, type '/schedule <10m|@15:04> <message>'; '/scheduled' lists, '/unschedule <id>' cancels",
+	msgHelpIntegrity:    "To compare the conversation with peers, type '/integrity'; '/save <file> [--signed]' exports it",
+	msgHelpLinks:        "To list links posted in the room, type '/links'",
+	msgHelpEdit:         "To change a message you sent, type '/edit <id|last> <text>' or '/delete <id|last>'; '/mine' lists their ids",
+	msgHelpEmote:        "To send an action, type '/me <action>'; shortcuts like /shrug or /tableflip add their faces to a message",
+	msgHelpEphemeral:    "To send a message that is forgotten after a while, type '/ephemeral <seconds> <message>'",
+	msgHelpQuiet:        "To silence the bell at night, type '/quiet 22:00-07:00 [time zone]'; '/quiet off' ends quiet hours",
+	msgHelpDND:          "To hold back incoming messages, type '/dnd on'; '/dnd off' shows what came in",
+	msgHelpLayout:       "To keep joins, transfers and other notices in a status row above the prompt, type '/layout split'; '/layout inline' mixes them in again",
+	msgHelpTransfers:    "To list the files sent and received in this room, type '/transfers'; '/transfers --json' prints them for scripts",
+	msgHelpFind:         "To search recent messages, type '/find [--since 2h] [--case] <regexp>'",
+	msgHelpRules:        "To list the rules for received files, type '/rules'",
+	msgHelpQuit:         "To leave the chat, type '/quit'",
+	msgEnterAlias:       "Enter your alias: ",
+	msgAliasSet:         "Your alias is set to '%s'",
+	msgAliasUpdated:     "Alias updated to '%s'",
+	msgWarning:          "warning: %s",
+	msgPong:             "pong from [%s]: %s",
+	msgNoPong:           "no pong within %s",
+	msgFileOffer:        "[%s] wants to send file '%s'. Accept file? (%s): ",
+	msgFileDeclined:     "File transfer declined.",
+	msgFileSaveDir:      "Enter directory to save file: ",
+	msgFileSaveFailed:   "Failed to save file '%s': %v",
+	msgFileSaved:        "[%s] sent file '%s'. Saved to %s",
+	msgFileRule:         "(rule %d: %s)",
+	msgFileRuleDecline:  "[%s] sent file '%s'. Declined",
+	msgFolderOffer:      "[%s] sent folder '%s' (%d files, %s). Type '/accept %s [--extract] [dir]' to save it.",
+	msgTransferOffer:    "[%s] offers '%s' (%s). Type '/get %s [dir]' to receive it.",
+	msgEncryptedFrom:    "Encrypted message from [%s]. Enter decryption key: ",
+	msgDecryptFailed:    "Failed to decrypt message: %v",
+	msgUnknownType:      "[%s unknown]: %s",
+	msgLimitShow:        "Bandwidth limit: %s",
+	msgLimitSet:         "Bandwidth limit set to %s",
+	msgRelayError:       "Relay %s: %v",
+	msgRelayTiming:      "Relay %s: ping %s, handshake %s (dial %s, PAKE %s, auth %s)",
+	msgNoPeers:          "No peers seen yet",
+	msgPeer:             "%s  last seen %s ago  ping %s  passive %s",
+	msgNoLinks:          "No links yet",
+	msgCommandFailed:    "/%s failed: %v",
+	msgCommandsFailed:   "Could not load commands: %v",
+	msgEditUsage:        "Usage: /edit <id|last> <new text>",
+	msgDeleteUsage:      "Usage: /delete <id|last>",
+	msgChangeFailed:     "Could not change message: %v",
+	msgEdited:           "%s (edited)",
+	msgHelpReact:        "To react to a message, type '/react <id|last> <emoji>'; like, dislike, love, laugh, wow, sad and party name emoji",
+	msgReactUsage:       "Usage: /react <id|last> <emoji|like|dislike|love|laugh|wow|sad|party>",
+	msgReactFailed:      "Could not react: %v",
+	msgReacted:          "%s reacted %s to '%s' %s",
+	msgReactedOwn:       "Reacted to '%s' %s",
+	msgDeleted:          "%s (deleted)",
+	msgNoOwnMessages:    "No messages of yours to change",
+	msgQuietSet:         "Quiet hours set to %s; messages still show, but the bell stays silent",
+	msgQuietShow:        "Quiet hours are %s",
+	msgQuietNone:        "No quiet hours set",
+	msgQuietOff:         "Quiet hours off",
+	msgQuietFailed:      "Could not load quiet hours: %v",
+	msgRulesFailed:      "Could not load file rules: %v",
+	msgRulesNone:        "No file rules set",
+	msgRulesList:        "File rules from %s, the first match applies:",
+	msgDNDOn:            "Do not disturb is on: incoming messages are held until '/dnd off'",
+	msgDNDOff:           "Do not disturb is off",
+	msgDNDNothing:       "Do not disturb is off, no messages came in",
+	msgDNDDivider:       "──── %d unread ────",
+	msgDNDDropped:       "%d older messages did not fit and are not shown; '/save' has the whole conversation",
+	msgDNDUsage:         "Usage: /dnd on|off",
+	msgLayoutShow:       "Layout: %s",
+	msgLayoutUsage:      "Usage: /layout split|inline",
+	msgLayoutNoTerminal: "The split layout needs a terminal",
+	msgLedgerEmpty:      "No files sent or received in this room yet",
+	msgLedgerEntry:      "%s  %s '%s' (%s), %s",
+	msgLedgerSent:       "sent",
+	msgLedgerReceived:   "received",
+	msgLedgerDuplicate:  "Peer already received '%s' on %s. Send anyway? (%s): ",
+	msgLedgerSkipped:    "Not sending '%s'",
+	msgLedgerFailed:     "Could not update the transfers ledger: %v",
+	msgLedgerUsage:      "Usage: /transfers [--json]",
+	msgResultDone:       "done",
+	msgResultFailed:     "failed",
+	msgResultDeclined:   "declined",
+	msgResultCancelled:  "cancelled",
+	msgUnread:           "[%d unread]",
+	msgFindUsage:        "Usage: /find [--since <duration>] [--case] <regexp>",
+	msgFindNone:         "No recent messages match",
+	msgFindMore:         "Only the %d most recent matches are shown",
+	msgFindTimeout:      "Search stopped after %s, the results are incomplete",
+	msgScheduled:        "Scheduled %s for %s",
+	msgNoScheduled:      "No scheduled messages",
+	msgUnscheduled:      "Cancelled %s",
+	msgScheduledSent:    "Sent scheduled message %s: %s",
+	msgScheduledRetry:   "Could not send scheduled message %s, retrying: %v",
+	msgChainHead:        "Chain head %s over %d messages",
+	msgSaveUsage:        "Usage: /save <file> [--signed]",
+	msgSaveFailed:       "Error saving transcript: %v",
+	msgSaved:            "Saved transcript to %s",
+	msgBookmarkFailed:   "Error saving bookmark: %v",
+	msgBookmarkSaved:    "Saved bookmark '%s'; rejoin with 'croc chat --room-name %s'",
+	msgBookmarksFailed:  "Error listing bookmarks: %v",
+	msgEncryptUsage:     "Usage: /encrypt <secret> <message>",
+	msgEncryptFailed:    "Encryption error: %v",
+	msgArchiveFailed:    "Error archiving folder %s: %v",
+	msgFolderSent:       "Sent folder '%s' (%d files, %s)",
+	msgReadFailed:       "Error reading file %s: %v",
+	msgFileSent:         "Sent file '%s'",
+	msgAcceptUsage:      "Usage: /accept <id> [--extract] [dir] | /accept <id> --stdout | /accept <id> --exec \"<command>\"",
+	msgAcceptFailed:     "Error accepting folder: %v",
+	msgAccepted:         "Saved %d files to %s",
+	msgAcceptNeedsPipe:  "--stdout writes the archive to a pipe or file; stdout is a terminal",
+	msgAcceptPiped:      "Wrote '%s' (%s) to stdout",
+	msgAcceptExited:     "'%s' exited with status %d",
+	msgAcceptExecFailed: "Error running '%s': %v",
+	msgTransferFailed:   "Error starting transfer of %s: %v",
+	msgTransferOffered:  "Offered '%s' (%s); waiting for peer to accept",
+	msgGetUsage:         "Usage: /get <offerID> [dir]",
+	msgGetFailed:        "Error receiving transfer: %v",
+	msgTransferLabel:    "transfer %s (%s)",
+	msgTransferProgress: "%s: file %d/%d, %s of %s (%d%%), %s of %s in all (%d%%)",
+	msgTransferDone:     "%s complete",
+	msgTransferError:    "%s failed: %v",
+	msgPeerDisconnected: "Peer disconnected. Waiting for new connection...",
+	msgReconnected:      "Reconnected to chat room '%s' at %s.",
+	msgUpgradeRequired:  "The relay no longer accepts this version of croc. Please upgrade and rejoin.",
+	msgSkipping:         "skipping '%s': not a regular file",
+	msgNoThumbnail:      "no thumbnail for '%s': %v",
+	msgMetadataFailed:   "could not keep the mode and time of '%s': %v",
+	msgNewMessages:      "── new messages ──",
+	msgTitle:            "croc chat",
+	msgTitleUnread:      "(%d) croc chat",
+	msgObserving:        "You are observing: you can read along but not send. '/who', '/find', '/save' and '/quit' work",
+	msgObserverOnly:     "Observers can only use '/who', '/find', '/save' and '/quit'.",
+	msgObserverTag:      "(observer)",
+	msgObserverNoFiles:  "%s offered '%s'; observers do not accept files.",
+	msgEmoteUsage:       "Usage: /me <action>",
+	msgEphemeralUsage:   "Usage: /ephemeral <seconds> <message>",
+	msgEphemeralSent:    "Sent; it disappears in %s and is never saved",
+	msgEphemeralMarker:  "(disappears in %s)",
+	msgEphemeralExpired: "(expired ephemeral message)",
+	msgIdentityChanged:  "Identity changed: %s now signs with a different key than before and may not be the same person",
+	msgIdentityFailed:   "Could not keep your identity, using a new one: %v",
+	msgHelpConfirm:      "To confirm the fingerprints of new peers, type '/confirm'",
+	msgConfirmNeeded:    "The code is easy to guess: compare each peer's fingerprint with them over another channel and type '/confirm' before chatting.",
+	msgConfirmPeer:      "Fingerprint with %s: %s. Compare it with them over another channel, then type '/confirm'.",
+	msgConfirmFirst:     "Not sent: confirm the fingerprints of your peers with '/confirm' first.",
+	msgConfirmed:        "Confirmed %s (%s).",
+	msgConfirmNone:      "No fingerprints are waiting to be confirmed.",
+	msgConfirmOff:       "This room does not require confirming peers.",
+	msgConfirmByPeer:    "%s confirmed your fingerprint.",
+	msgConfirmMismatch:  "%s confirmed a different fingerprint than yours; someone may be listening in between you.",
+	msgUnverified:       "(unverified)",
+	msgRoomSettings:     "Room settings: %s",
+	msgRoomStricter:     "The room's settings are stricter than the ones you set; the stricter ones apply",
+	msgSettingOn:        "on",
+	msgSettingOff:       "off",
+	msgSettingReceipts:  "receipts %s",
+	msgSettingHistory:   "history %s",
+	msgSettingObservers: "observers %s",
+	msgSettingEphemeral: "messages disappear after %s",
+	msgHistoryDisabled:  "This room's settings do not allow saving its history.",
+	msgObserverDenied:   "%s is observing although this room's settings do not allow observers",
+	msgRelayUnreachable: "relay %s unreachable — check firewall or use --relay",
+	msgRelayHandshake:   "relay %s reachable but handshake failed — likely wrong --pass",
+	msgHelpStats:        "To see how many bytes this session sent and received, type '/stats'",
+	msgFileOfferSize:    "[%s] wants to send file '%s' of %s. Accept file? (%s): ",
+	msgLowBandwidthOn:   "Low-bandwidth mode is on: receipts go out in batches, offers carry no previews and every file is confirmed",
+	msgLowBandwidthTag:  "(low-bandwidth)",
+	msgPeerLowBandwidth: "%s is in low-bandwidth mode: their receipts come in batches and their offers carry no previews",
+	msgStatsHeader:      "Bytes this session, sent / received:",
+	msgStatsLine:        "  %-11s %s / %s",
+	msgStatsMessages:    "messages",
+	msgStatsPresence:    "presence",
+	msgStatsFiles:       "files",
+	msgStatsOverhead:    "overhead",
+	msgStatsTotal:       "total",
+	msgRoomExpiring:     "The relay closes this room in %s; join again with the same code to keep chatting",
+	msgRoomQuota:        "This room is close to what the relay lets it transfer (%d%%); the relay closes it once the limit is reached",
+	msgRoomNobodyJoined: "Nobody else joined this room before the relay closed it; check that your peer used the same code and relay",
+	msgBadArguments:     "Cannot read the arguments: %v",
+	msgNoArguments:      "Usage: /%s (takes no arguments)",
+	msgSetAliasUsage:    "Usage: /setalias <name>",
+	msgLimitUsage:       "Usage: /limit [500k|2M|off]",
+	msgScheduleUsage:    "Usage: /schedule <10m|@15:04> <message>",
+	msgUnscheduleUsage:  "Usage: /unschedule <id>",
+	msgQuietUsage:       "Usage: /quiet [off|22:00-07:00 [time zone]]",
+	msgBookmarkUsage:    "Usage: /bookmark <name>",
+	msgSendFileUsage:    "Usage: /sendfile <path> [--zip], with a path that has spaces in double quotes",
+	msgTransferUsage:    "Usage: /transfer <path>",
+	msgSecurityUsage:    "Usage: /security [--json]",
+	msgHelpSecurity:     "To see what protects this session, type '/security'; '/security --json' prints it for scripts",
+	msgSecuritySummary:  "Security: plain TCP to the relay, %s, %s, %s; '/security' tells more",
+	msgSecurityHeader:   "What protects this session:",
+	msgSecurityTCP:      "  transport: plain TCP to the relay %s, without TLS or QUIC",
+	msgSecurityRelay:    "  relay: joined with its password, checked with PAKE",
+	msgSecurityDefault:  "  relay: joined with the default password, which anyone can use",
+	msgSecurityPass:     "relay password",
+	msgSecurityOpenPass: "default relay password",
+	msgSecurityE2E:      "  end-to-end encryption: %s",
+	msgSecurityNoE2E:    "  end-to-end encryption: none, the relay could read the messages; /encrypt protects single messages",
+	msgSecurityE2EOn:    "end-to-end encrypted with %s",
+	msgSecurityE2EOff:   "not end-to-end encrypted",
+	msgSecuritySigning:  "  signatures: this session signs its messages",
+	msgSecuritySigned:   "messages signed",
+	msgSecurityUnsigned: "messages not signed",
+	msgSecurityNoPeers:  "  peers: none heard yet",
+	msgSecuritySigner:   "  %s signs its messages",
+	msgSecurityNoSigner: "  %s does NOT sign its messages",
+	msgPeerUnsigned:     "WARNING: %s does not sign its messages, so anyone in the room could write under that alias",
+	msgDirectOn:         "Messages now go straight to the peer, not through the relay",
+	msgDirectOff:        "The direct connection to the peer closed, messages go through the relay again",
+	msgDirectCrowded:    "More than two are in the room, so messages keep going through the relay",
+}}
+
+// catalogs are the available locales by language code.
+var catalogs = map[string]catalog{
+	"en": english,
+	"de": {
+		yes: []string{"j", "ja"},
+		no:  []string{"nein"},
+		strings: map[msgID]string{
+			msgJoined:           "Chatraum '%s' beigetreten. Nachricht eingeben und mit Enter senden.",
+			msgHelpSendFile:     "Datei senden: '/sendfile <Pfad>', mit Leerzeichen in doppelten Anführungszeichen; Ordner werden als tar gesendet, mit '--zip' als zip",
+			msgHelpTransfer:     "Große Datei oder Ordner mit croc senden: '/transfer <Pfad>'",
+			msgHelpPing:         "Latenz zu Teilnehmern messen: '/ping'; '/who' listet sie auf; '/relay' prüft das Relay",
+			msgHelpLimit:        "Ausgehende Bandbreite für Chat und Anrufe begrenzen: '/limit <500k|2M|off>'",
+			msgHelpBookmark:     "Diesen Raum für 'croc chat --room-name' speichern: '/bookmark <Name>'",
+			msgHelpSchedule:     "Später senden: '/schedule <10m|@15:04> <Nachricht>'; '/scheduled' listet, '/unschedule <ID>' bricht ab",
+			msgHelpIntegrity:    "Unterhaltung mit Teilnehmern abgleichen: '/integrity'; '/save <Datei> [--signed]' exportiert sie",
+			msgHelpLinks:        "Im Raum gepostete Links auflisten: '/links'",
+			msgHelpEdit:         "Eigene Nachricht ändern: '/edit <ID|last> <Text>' oder '/delete <ID|last>'; '/mine' listet die IDs",
+			msgHelpEmote:        "Aktion senden: '/me <Aktion>'; Kürzel wie /shrug oder /tableflip hängen ihr Gesicht an eine Nachricht an",
+			msgHelpEphemeral:    "Nachricht senden, die nach einer Weile vergessen wird: '/ephemeral <Sekunden> <Nachricht>'",
+			msgHelpQuiet:        "Glocke nachts stummschalten: '/quiet 22:00-07:00 [Zeitzone]'; '/quiet off' beendet die Ruhezeit",
+			msgHelpDND:          "Eingehende Nachrichten zurückhalten: '/dnd on'; '/dnd off' zeigt, was ankam",
+			msgHelpLayout:       "Beitritte, Übertragungen und andere Hinweise in einer Statuszeile über der Eingabe sammeln: '/layout split'; '/layout inline' mischt sie wieder ein",
+			msgHelpTransfers:    "Gesendete und empfangene Dateien dieses Raums auflisten: '/transfers'; '/transfers --json' gibt sie für Skripte aus",
+			msgHelpFind:         "Letzte Nachrichten durchsuchen: '/find [--since 2h] [--case] <Regexp>'",
+			msgHelpRules:        "Regeln für empfangene Dateien anzeigen: '/rules'",
+			msgHelpQuit:         "Chat verlassen: '/quit'",
+			msgEnterAlias:       "Anzeigename eingeben: ",
+			msgAliasSet:         "Dein Anzeigename ist '%s'",
+			msgAliasUpdated:     "Anzeigename geändert zu '%s'",
+			msgWarning:          "Warnung: %s",
+			msgPong:             "Pong von [%s]: %s",
+			msgNoPong:           "kein Pong innerhalb von %s",
+			msgFileOffer:        "[%s] möchte die Datei '%s' senden. Annehmen? (%s): ",
+			msgFileDeclined:     "Dateiübertragung abgelehnt.",
+			msgFileSaveDir:      "Zielordner eingeben: ",
+			msgFileSaveFailed:   "Datei '%s' konnte nicht gespeichert werden: %v",
+			msgFileSaved:        "[%s] hat die Datei '%s' gesendet. Gespeichert unter %s",
+			msgFileRule:         "(Regel %d: %s)",
+			msgFileRuleDecline:  "[%s] hat die Datei '%s' gesendet. Abgelehnt",
+			msgFolderOffer:      "[%s] hat den Ordner '%s' gesendet (%d Dateien, %s). Mit '/accept %s [--extract] [Ordner]' speichern.",
+			msgTransferOffer:    "[%s] bietet '%s' an (%s). Mit '/get %s [Ordner]' empfangen.",
+			msgEncryptedFrom:    "Verschlüsselte Nachricht von [%s]. Schlüssel eingeben: ",
+			msgDecryptFailed:    "Nachricht konnte nicht entschlüsselt werden: %v",
+			msgUnknownType:      "[%s unbekannt]: %s",
+			msgLimitShow:        "Bandbreitenlimit: %s",
+			msgLimitSet:         "Bandbreitenlimit auf %s gesetzt",
+			msgRelayError:       "Relay %s: %v",
+			msgRelayTiming:      "Relay %s: Ping %s, Handshake %s (Verbindung %s, PAKE %s, Anmeldung %s)",
+			msgNoPeers:          "Noch keine Teilnehmer gesehen",
+			msgPeer:             "%s  zuletzt vor %s gesehen  Ping %s  passiv %s",
+			msgNoLinks:          "Noch keine Links",
+			msgCommandFailed:    "/%s fehlgeschlagen: %v",
+			msgCommandsFailed:   "Befehle konnten nicht geladen werden: %v",
+			msgEditUsage:        "Verwendung: /edit <ID|last> <neuer Text>",
+			msgDeleteUsage:      "Verwendung: /delete <ID|last>",
+			msgChangeFailed:     "Nachricht konnte nicht geändert werden: %v",
+			msgEdited:           "%s (bearbeitet)",
+			msgHelpReact:        "Auf eine Nachricht reagieren: '/react <ID|last> <Emoji>'; like, dislike, love, laugh, wow, sad und party stehen für Emoji",
+			msgReactUsage:       "Verwendung: /react <ID|last> <Emoji|like|dislike|love|laugh|wow|sad|party>",
+			msgReactFailed:      "Reaktion fehlgeschlagen: %v",
+			msgReacted:          "%s hat mit %s auf '%s' reagiert %s",
+			msgReactedOwn:       "Auf '%s' reagiert %s",
+			msgDeleted:          "%s (gelöscht)",
+			msgNoOwnMessages:    "Keine eigenen Nachrichten zum Ändern",
+			msgQuietSet:         "Ruhezeit auf %s gesetzt; Nachrichten erscheinen weiter, aber die Glocke bleibt stumm",
+			msgQuietShow:        "Ruhezeit ist %s",
+			msgQuietNone:        "Keine Ruhezeit gesetzt",
+			msgQuietOff:         "Ruhezeit aus",
+			msgQuietFailed:      "Ruhezeit konnte nicht geladen werden: %v",
+			msgRulesFailed:      "Dateiregeln konnten nicht geladen werden: %v",
+			msgRulesNone:        "Keine Dateiregeln gesetzt",
+			msgRulesList:        "Dateiregeln aus %s, die erste passende gilt:",
+			msgDNDOn:            "Nicht stören ist an: eingehende Nachrichten werden bis '/dnd off' zurückgehalten",
+			msgDNDOff:           "Nicht stören ist aus",
+			msgDNDNothing:       "Nicht stören ist aus, es kamen keine Nachrichten",
+			msgDNDDivider:       "──── %d ungelesen ────",
+			msgDNDDropped:       "%d ältere Nachrichten passten nicht in den Puffer und werden nicht gezeigt; '/save' enthält das ganze Gespräch",
+			msgDNDUsage:         "Verwendung: /dnd on|off",
+			msgLayoutShow:       "Layout: %s",
+			msgLayoutUsage:      "Verwendung: /layout split|inline",
+			msgLayoutNoTerminal: "Das geteilte Layout braucht ein Terminal",
+			msgLedgerEmpty:      "In diesem Raum wurden noch keine Dateien gesendet oder empfangen",
+			msgLedgerEntry:      "%s  %s '%s' (%s), %s",
+			msgLedgerSent:       "gesendet",
+			msgLedgerReceived:   "empfangen",
+			msgLedgerDuplicate:  "Der Peer hat '%s' schon am %s erhalten. Trotzdem senden? (%s): ",
+			msgLedgerSkipped:    "'%s' wird nicht gesendet",
+			msgLedgerFailed:     "Das Übertragungsprotokoll konnte nicht aktualisiert werden: %v",
+			msgLedgerUsage:      "Verwendung: /transfers [--json]",
+			msgResultDone:       "erledigt",
+			msgResultFailed:     "fehlgeschlagen",
+			msgResultDeclined:   "abgelehnt",
+			msgResultCancelled:  "abgebrochen",
+			msgUnread:           "[%d ungelesen]",
+			msgFindUsage:        "Verwendung: /find [--since <Dauer>] [--case] <Regexp>",
+			msgFindNone:         "Keine der letzten Nachrichten passt",
+			msgFindMore:         "Nur die %d neuesten Treffer werden gezeigt",
+			msgFindTimeout:      "Suche nach %s abgebrochen, die Ergebnisse sind unvollständig",
+			msgScheduled:        "%s für %s geplant",
+			msgNoScheduled:      "Keine geplanten Nachrichten",
+			msgUnscheduled:      "%s abgebrochen",
+			msgScheduledSent:    "Geplante Nachricht %s gesendet: %s",
+			msgScheduledRetry:   "Geplante Nachricht %s konnte nicht gesendet werden, neuer Versuch: %v",
+			msgChainHead:        "Kettenkopf %s über %d Nachrichten",
+			msgSaveUsage:        "Verwendung: /save <Datei> [--signed]",
+			msgSaveFailed:       "Fehler beim Speichern des Protokolls: %v",
+			msgSaved:            "Protokoll gespeichert unter %s",
+			msgBookmarkFailed:   "Fehler beim Speichern des Lesezeichens: %v",
+			msgBookmarkSaved:    "Lesezeichen '%s' gespeichert; erneut beitreten mit 'croc chat --room-name %s'",
+			msgBookmarksFailed:  "Fehler beim Auflisten der Lesezeichen: %v",
+			msgEncryptUsage:     "Verwendung: /encrypt <Geheimnis> <Nachricht>",
+			msgEncryptFailed:    "Verschlüsselungsfehler: %v",
+			msgArchiveFailed:    "Fehler beim Archivieren von %s: %v",
+			msgFolderSent:       "Ordner '%s' gesendet (%d Dateien, %s)",
+			msgReadFailed:       "Fehler beim Lesen von %s: %v",
+			msgFileSent:         "Datei '%s' gesendet",
+			msgAcceptUsage:      "Verwendung: /accept <ID> [--extract] [Ordner] | /accept <ID> --stdout | /accept <ID> --exec \"<Befehl>\"",
+			msgAcceptFailed:     "Fehler beim Annehmen des Ordners: %v",
+			msgAccepted:         "%d Dateien unter %s gespeichert",
+			msgAcceptNeedsPipe:  "--stdout schreibt das Archiv in eine Pipe oder Datei; stdout ist ein Terminal",
+			msgAcceptPiped:      "'%s' (%s) nach stdout geschrieben",
+			msgAcceptExited:     "'%s' mit Status %d beendet",
+			msgAcceptExecFailed: "Fehler beim Ausführen von '%s': %v",
+			msgTransferFailed:   "Fehler beim Starten der Übertragung von %s: %v",
+			msgTransferOffered:  "'%s' (%s) angeboten; warte auf Annahme",
+			msgGetUsage:         "Verwendung: /get <Angebots-ID> [Ordner]",
+			msgGetFailed:        "Fehler beim Empfangen: %v",
+			msgTransferLabel:    "Übertragung %s (%s)",
+			msgTransferProgress: "%s: Datei %d/%d, %s von %s (%d%%), %s von %s insgesamt (%d%%)",
+			msgTransferDone:     "%s abgeschlossen",
+			msgTransferError:    "%s fehlgeschlagen: %v",
+			msgPeerDisconnected: "Verbindung zum Teilnehmer verloren. Warte auf neue Verbindung...",
+			msgReconnected:      "Wieder mit Chatraum '%s' verbunden über %s.",
+			msgUpgradeRequired:  "Das Relay nimmt diese croc-Version nicht mehr an. Bitte aktualisieren und erneut beitreten.",
+			msgSkipping:         "'%s' übersprungen: keine reguläre Datei",
+			msgNoThumbnail:      "keine Vorschau für '%s': %v",
+			msgMetadataFailed:   "Modus und Zeit von '%s' konnten nicht übernommen werden: %v",
+			msgNewMessages:      "── neue Nachrichten ──",
+			msgTitle:            "croc chat",
+			msgTitleUnread:      "(%d) croc chat",
+			msgObserving:        "Sie beobachten: Sie können mitlesen, aber nichts senden. '/who', '/find', '/save' und '/quit' funktionieren",
+			msgObserverOnly:     "Beobachter können nur '/who', '/find', '/save' und '/quit' verwenden.",
+			msgObserverTag:      "(Beobachter)",
+			msgObserverNoFiles:  "%s bietet '%s' an; Beobachter nehmen keine Dateien an.",
+			msgEmoteUsage:       "Verwendung: /me <Aktion>",
+			msgEphemeralUsage:   "Verwendung: /ephemeral <Sekunden> <Nachricht>",
+			msgEphemeralSent:    "Gesendet; verschwindet in %s und wird nie gespeichert",
+			msgEphemeralMarker:  "(verschwindet in %s)",
+			msgEphemeralExpired: "(abgelaufene flüchtige Nachricht)",
+			msgIdentityChanged:  "Identität geändert: %s signiert mit einem anderen Schlüssel als zuvor und ist vielleicht nicht dieselbe Person",
+			msgIdentityFailed:   "Ihre Identität konnte nicht beibehalten werden, eine neue wird verwendet: %v",
+			msgHelpConfirm:      "Fingerabdrücke neuer Teilnehmer bestätigen: '/confirm'",
+			msgConfirmNeeded:    "Der Code ist leicht zu erraten: Vergleichen Sie den Fingerabdruck jedes Teilnehmers über einen anderen Kanal und geben Sie '/confirm' ein, bevor Sie chatten.",
+			msgConfirmPeer:      "Fingerabdruck mit %s: %s. Vergleichen Sie ihn über einen anderen Kanal und geben Sie dann '/confirm' ein.",
+			msgConfirmFirst:     "Nicht gesendet: Bestätigen Sie zuerst die Fingerabdrücke Ihrer Teilnehmer mit '/confirm'.",
+			msgConfirmed:        "%s bestätigt (%s).",
+			msgConfirmNone:      "Keine Fingerabdrücke warten auf Bestätigung.",
+			msgConfirmOff:       "In diesem Raum müssen Teilnehmer nicht bestätigt werden.",
+			msgConfirmByPeer:    "%s hat Ihren Fingerabdruck bestätigt.",
+			msgConfirmMismatch:  "%s hat einen anderen Fingerabdruck als Ihren bestätigt; vielleicht hört jemand dazwischen mit.",
+			msgUnverified:       "(unbestätigt)",
+			msgRoomSettings:     "Raumeinstellungen: %s",
+			msgRoomStricter:     "Die Einstellungen des Raums sind strenger als Ihre; es gelten die strengeren",
+			msgSettingOn:        "an",
+			msgSettingOff:       "aus",
+			msgSettingReceipts:  "Empfangsbestätigungen %s",
+			msgSettingHistory:   "Verlauf %s",
+			msgSettingObservers: "Beobachter %s",
+			msgSettingEphemeral: "Nachrichten verschwinden nach %s",
+			msgHistoryDisabled:  "Die Einstellungen dieses Raums erlauben nicht, den Verlauf zu speichern.",
+			msgObserverDenied:   "%s beobachtet, obwohl die Einstellungen dieses Raums keine Beobachter erlauben",
+			msgRelayUnreachable: "Relay %s nicht erreichbar — Firewall prüfen oder --relay verwenden",
+			msgRelayHandshake:   "Relay %s erreichbar, aber der Handshake schlug fehl — vermutlich falsches --pass",
+			msgHelpStats:        "Wie viele Bytes diese Sitzung gesendet und empfangen hat: '/stats'",
+			msgFileOfferSize:    "[%s] möchte die Datei '%s' mit %s senden. Annehmen? (%s): ",
+			msgLowBandwidthOn:   "Der Sparmodus ist an: Empfangsbestätigungen gehen gesammelt raus, Angebote haben keine Vorschau und jede Datei wird bestätigt",
+			msgLowBandwidthTag:  "(Sparmodus)",
+			msgPeerLowBandwidth: "%s ist im Sparmodus: Empfangsbestätigungen kommen gesammelt und Angebote haben keine Vorschau",
+			msgStatsHeader:      "Bytes dieser Sitzung, gesendet / empfangen:",
+			msgStatsLine:        "  %-11s %s / %s",
+			msgStatsMessages:    "Nachrichten",
+			msgStatsPresence:    "Präsenz",
+			msgStatsFiles:       "Dateien",
+			msgStatsOverhead:    "Overhead",
+			msgStatsTotal:       "gesamt",
+			msgRoomExpiring:     "Das Relay schließt diesen Raum in %s; mit demselben Code erneut beitreten, um weiterzuchatten",
+			msgRoomQuota:        "Dieser Raum hat fast so viel übertragen, wie das Relay erlaubt (%d%%); das Relay schließt ihn, sobald die Grenze erreicht ist",
+			msgRoomNobodyJoined: "Niemand sonst ist diesem Raum beigetreten, bevor das Relay ihn geschlossen hat; prüfe, ob dein Gegenüber denselben Code und dasselbe Relay verwendet",
+			msgBadArguments:     "Argumente nicht lesbar: %v",
+			msgNoArguments:      "Verwendung: /%s (ohne Argumente)",
+			msgSetAliasUsage:    "Verwendung: /setalias <Name>",
+			msgLimitUsage:       "Verwendung: /limit [500k|2M|off]",
+			msgScheduleUsage:    "Verwendung: /schedule <10m|@15:04> <Nachricht>",
+			msgUnscheduleUsage:  "Verwendung: /unschedule <ID>",
+			msgQuietUsage:       "Verwendung: /quiet [off|22:00-07:00 [Zeitzone]]",
+			msgBookmarkUsage:    "Verwendung: /bookmark <Name>",
+			msgSendFileUsage:    "Verwendung: /sendfile <Pfad> [--zip], einen Pfad mit Leerzeichen in doppelten Anführungszeichen",
+			msgTransferUsage:    "Verwendung: /transfer <Pfad>",
+			msgSecurityUsage:    "Verwendung: /security [--json]",
+			msgHelpSecurity:     "Was diese Sitzung schützt: '/security'; '/security --json' gibt es für Skripte aus",
+			msgSecuritySummary:  "Sicherheit: unverschlüsseltes TCP zum Relay, %s, %s, %s; mehr mit '/security'",
+			msgSecurityHeader:   "Was diese Sitzung schützt:",
+			msgSecurityTCP:      "  Verbindung: unverschlüsseltes TCP zum Relay %s, ohne TLS oder QUIC",
+			msgSecurityRelay:    "  Relay: mit seinem Passwort beigetreten, per PAKE geprüft",
+			msgSecurityDefault:  "  Relay: mit dem Standardpasswort beigetreten, das jeder verwenden kann",
+			msgSecurityPass:     "Relay-Passwort",
+			msgSecurityOpenPass: "Standardpasswort des Relays",
+			msgSecurityE2E:      "  Ende-zu-Ende-Verschlüsselung: %s",
+			msgSecurityNoE2E:    "  Ende-zu-Ende-Verschlüsselung: keine, das Relay könnte die Nachrichten lesen; /encrypt schützt einzelne Nachrichten",
+			msgSecurityE2EOn:    "Ende-zu-Ende-verschlüsselt mit %s",
+			msgSecurityE2EOff:   "nicht Ende-zu-Ende-verschlüsselt",
+			msgSecuritySigning:  "  Signaturen: diese Sitzung signiert ihre Nachrichten",
+			msgSecuritySigned:   "Nachrichten signiert",
+			msgSecurityUnsigned: "Nachrichten nicht signiert",
+			msgSecurityNoPeers:  "  Teilnehmer: noch keiner gehört",
+			msgSecuritySigner:   "  %s signiert seine Nachrichten",
+			msgSecurityNoSigner: "  %s signiert seine Nachrichten NICHT",
+			msgPeerUnsigned:     "WARNUNG: %s signiert seine Nachrichten nicht, jeder im Raum könnte unter diesem Alias schreiben",
+			msgDirectOn:         "Nachrichten gehen jetzt direkt zum Teilnehmer, nicht über das Relay",
+			msgDirectOff:        "Die direkte Verbindung zum Teilnehmer wurde geschlossen, Nachrichten gehen wieder über das Relay",
+			msgDirectCrowded:    "Mehr als zwei sind im Raum, daher gehen Nachrichten weiter über das Relay",
+		},
+	},
+}
+
+// active is the locale in use; it is set once when the chat starts.
+var active atomic.Pointer[catalog]
+
+// Languages returns the language codes with a catalog.
+func Languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// languageOf extracts the language code from a locale name such as
+// de_DE.UTF-8.
+func languageOf(locale string) string {
+	lang, _, _ := strings.Cut(locale, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	lang, _, _ = strings.Cut(lang, "_")
+	lang, _, _ = strings.Cut(lang, "-")
+	return strings.ToLower(lang)
+}
+
+// detectLanguage picks the language from the --lang flag, then the usual
+// locale variables. It falls back to English.
+func detectLanguage(flag string) string {
+	for _, locale := range []string{flag, os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")} {
+		if locale == "" {
+			continue
+		}
+		if lang := languageOf(locale); lang != "" {
+			if _, ok := catalogs[lang]; ok {
+				return lang
+			}
+		}
+		// the first locale that is set wins, even if it has no catalog
+		return "en"
+	}
+	return "en"
+}
+
+// setLanguage makes lang the active locale, falling back to English.
+func setLanguage(lang string) {
+	c, ok := catalogs[lang]
+	if !ok {
+		c = english
+	}
+	active.Store(&c)
+}
+
+func current() *catalog {
+	if c := active.Load(); c != nil {
+		return c
+	}
+	return &english
+}
+
+// localize formats the string id in the active locale.
+func localize(id msgID, args ...any) string {
+	format, ok := current().strings[id]
+	if !ok {
+		format = english.strings[id]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// yesNo is the answer hint shown with yes/no prompts.
+func yesNo() string {
+	c := current()
+	if len(c.yes) == 0 {
+		return "yes/no"
+	}
+	return c.yes[len(c.yes)-1] + "/" + c.no[len(c.no)-1]
+}
+
+// isYes reports whether answer accepts a yes/no prompt. y and yes always
+// do, whatever the locale.
+func isYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer == "y" || answer == "yes" {
+		return true
+	}
+	for _, yes := range current().yes {
+		if answer == yes {
+			return true
+		}
+	}
+	return false
+}
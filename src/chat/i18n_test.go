@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var verbPattern = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z]`)
+
+func TestCatalogsComplete(t *testing.T) {
+	for _, lang := range Languages() {
+		c := catalogs[lang]
+		for id, format := range english.strings {
+			translated, ok := c.strings[id]
+			if !assert.True(t, ok, "%s is missing %s", lang, id) {
+				continue
+			}
+			// translations must take the same arguments in the same order
+			assert.Equal(t, verbPattern.FindAllString(format, -1), verbPattern.FindAllString(translated, -1), "%s: %s", lang, id)
+		}
+		assert.Equal(t, len(english.strings), len(c.strings), lang)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "")
+	t.Setenv("LANG", "de_DE.UTF-8")
+	assert.Equal(t, "de", detectLanguage(""))
+	assert.Equal(t, "en", detectLanguage("en"))
+	assert.Equal(t, "de", detectLanguage("DE"))
+	// an unknown language falls back to English rather than to LANG
+	assert.Equal(t, "en", detectLanguage("fr"))
+	t.Setenv("LC_ALL", "C")
+	assert.Equal(t, "en", detectLanguage(""))
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LANG", "")
+	assert.Equal(t, "en", detectLanguage(""))
+}
+
+func TestLocalize(t *testing.T) {
+	defer setLanguage("en")
+	setLanguage("de")
+	assert.Equal(t, "Datei 'a.txt' gesendet", localize(msgFileSent, "a.txt"))
+	assert.Equal(t, "ja/nein", yesNo())
+	for _, answer := range []string{"j", "Ja", "y", "YES"} {
+		assert.True(t, isYes(answer), answer)
+	}
+	for _, answer := range []string{"n", "nein", "no", "", "jein"} {
+		assert.False(t, isYes(answer), answer)
+	}
+
+	setLanguage("xx")
+	assert.Equal(t, "Sent file 'a.txt'", localize(msgFileSent, "a.txt"))
+	assert.Equal(t, "yes/no", yesNo())
+	assert.False(t, isYes("ja"))
+}
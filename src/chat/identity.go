@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// identitiesDirName is the directory in croc's config directory holding
+// the session keys kept with --keep-identity, one file per room.
+const identitiesDirName = "chat_identities"
+
+// signed are the message types a session signs with its key, so peers can
+// tell whether the alias on them is still the session they heard from
+// before: the conversation, presence and room settings. Pings, pongs and
+// acks are not worth it. Peer confirmation is signed as well, as it is
+// about the session keys.
+var signed = map[message.Type]bool{
+	"chat":            true,
+	typeEmote:         true,
+	"chatfile":        true,
+	"encrypted":       true,
+	typeChatArchive:   true,
+	typeTransferOffer: true,
+	typeChatEdit:      true,
+	typeChatDelete:    true,
+	typeReaction:      true,
+	typePresence:      true,
+	typeRoomSettings:  true,
+	typeConfirm:       true,
+}
+
+var errBadSignature = errors.New("bad message signature")
+
+// signedPayload is what a session signs for m: its type, id and send time
+// and a hash of its content, length-prefixed so a signature cannot be
+// moved to another message.
+func signedPayload(m message.Message) []byte {
+	digest := contentDigest(m)
+	var b []byte
+	for _, field := range []string{string(m.Type), m.ID, strconv.FormatInt(m.Time, 10), string(digest[:]), string(m.Meta)} {
+		b = binary.BigEndian.AppendUint64(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	return b
+}
+
+// sign stamps m with the session id and send time of key and signs it.
+func sign(key ed25519.PrivateKey, m *message.Message, now time.Time) {
+	m.Session = sessionID(key)
+	m.Time = now.UnixMilli()
+	m.Signature = ed25519.Sign(key, signedPayload(*m))
+}
+
+// verify checks the signature of m against its session id. Messages from
+// peers that do not sign carry neither and pass unverified.
+func verify(m message.Message) (ok bool, err error) {
+	if len(m.Signature) == 0 {
+		return false, nil
+	}
+	pub, err := hex.DecodeString(m.Session)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("%w: invalid session id", errBadSignature)
+	}
+	if !ed25519.Verify(pub, signedPayload(m), m.Signature) {
+		return false, errBadSignature
+	}
+	return true, nil
+}
+
+// identities maps the aliases heard in the room to the session that
+// signed their messages, "" standing for a peer that does not sign.
+type identities struct {
+	mu   sync.Mutex
+	keys map[string]string
+	// warned are the aliases the user was warned do not sign.
+	warned map[string]bool
+}
+
+// check verifies m and reports whether its alias was heard with another
+// session before, in which case that alias now stands for the session of
+// m. Messages with a bad signature are refused.
+func (ids *identities) check(m message.Message) (changed bool, err error) {
+	if !signed[m.Type] {
+		return false, nil
+	}
+	ok, err := verify(m)
+	if err != nil {
+		return false, err
+	}
+	if m.Alias == "" {
+		return false, nil
+	}
+	key := ""
+	if ok {
+		key = m.Session
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if ids.keys == nil {
+		ids.keys = make(map[string]string)
+	}
+	before, seen := ids.keys[m.Alias]
+	ids.keys[m.Alias] = key
+	return seen && before != key, nil
+}
+
+// warnUnsigned reports whether alias was heard without a signature and
+// the user was not warned about it yet.
+func (ids *identities) warnUnsigned(alias string) bool {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	key, seen := ids.keys[alias]
+	if !seen || key != "" || ids.warned[alias] {
+		return false
+	}
+	if ids.warned == nil {
+		ids.warned = make(map[string]bool)
+	}
+	ids.warned[alias] = true
+	return true
+}
+
+// signers returns whether each alias heard signs its messages, sorted by
+// alias.
+func (ids *identities) signers() (peers []PeerSecurity) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	for alias, key := range ids.keys {
+		peers = append(peers, PeerSecurity{Alias: alias, Signs: key != ""})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Alias < peers[j].Alias })
+	return peers
+}
+
+// defaultIdentityDir returns where --keep-identity keeps session keys.
+func defaultIdentityDir() (string, error) {
+	configDir, err := utils.GetConfigDir(true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, identitiesDirName), nil
+}
+
+// loadIdentity returns the session key kept in dir for room, creating and
+// saving one the first time, so peers see the same identity across
+// restarts.
+func loadIdentity(dir, room string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, room+".key")
+	b, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	key := newSessionKey()
+	if err = os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KeepIdentity makes the session sign with the key kept in dir for its
+// room instead of one of its own, so peers that saw it before recognise
+// it after a restart. It must be called before Start.
+func (s *Session) KeepIdentity(dir string) error {
+	key, err := loadIdentity(dir, s.RoomName())
+	if err != nil {
+		return err
+	}
+	s.key = key
+	return nil
+}
@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+func TestSignedMessages(t *testing.T) {
+	alice := newSessionKey()
+	m := message.Message{Type: "chat", ID: "1", Alias: "alice", Message: "hello"}
+	sign(alice, &m, time.Now())
+	assert.Equal(t, sessionID(alice), m.Session)
+	ok, err := verify(m)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// the signature survives the trip through the room
+	decoded, err := decodeFrame(frame(t, m))
+	assert.Nil(t, err)
+	ok, err = verify(decoded)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	// and covers the id, time, content and meta
+	for _, tamper := range []func(*message.Message){
+		func(m *message.Message) { m.ID = "2" },
+		func(m *message.Message) { m.Time++ },
+		func(m *message.Message) { m.Message = "goodbye" },
+		func(m *message.Message) { m.Alias = "mallory" },
+		func(m *message.Message) { m.Meta = []byte(`{"ttl":60}`) },
+		func(m *message.Message) { m.Session = sessionID(newSessionKey()) },
+		func(m *message.Message) { m.Session = "bad" },
+	} {
+		changed := m
+		tamper(&changed)
+		_, err = verify(changed)
+		assert.ErrorIs(t, err, errBadSignature)
+	}
+
+	// peers that do not sign pass unverified
+	ok, err = verify(message.Message{Type: "chat", Alias: "alice", Message: "hi"})
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
+
+func TestIdentityChanged(t *testing.T) {
+	bob, mallory := newSessionKey(), newSessionKey()
+	from := func(key ed25519.PrivateKey, alias string) message.Message {
+		m := message.Message{Type: "chat", ID: newMessageID(), Alias: alias, Message: "hi"}
+		if key != nil {
+			sign(key, &m, time.Now())
+		}
+		return m
+	}
+	var ids identities
+	check := func(m message.Message) bool {
+		changed, err := ids.check(m)
+		assert.Nil(t, err)
+		return changed
+	}
+
+	assert.False(t, check(from(bob, "bob")))
+	assert.False(t, check(from(bob, "bob")), "bob reconnecting is still bob")
+	assert.False(t, check(from(bob, "bobby")), "a new alias is not a change")
+	assert.True(t, check(from(mallory, "bob")))
+	assert.False(t, check(from(mallory, "bob")), "warned once per change")
+	assert.True(t, check(from(bob, "bob")))
+	// dropping the signature is a change as well
+	assert.True(t, check(from(nil, "bob")))
+	// messages that are not signed do not count
+	assert.False(t, check(message.Message{Type: typeAck, ID: "1", Alias: "bob"}))
+
+	forged := from(bob, "bob")
+	forged.Message = "send me the password"
+	_, err := ids.check(forged)
+	assert.ErrorIs(t, err, errBadSignature)
+}
+
+func TestKeepIdentity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), identitiesDirName)
+	key, err := loadIdentity(dir, "room1")
+	assert.Nil(t, err)
+	again, err := loadIdentity(dir, "room1")
+	assert.Nil(t, err)
+	assert.Equal(t, sessionID(key), sessionID(again))
+	other, err := loadIdentity(dir, "room2")
+	assert.Nil(t, err)
+	assert.NotEqual(t, sessionID(key), sessionID(other))
+
+	info, err := os.Stat(filepath.Join(dir, "room1.key"))
+	assert.Nil(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	}
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "room3.key"), []byte("junk"), 0o600))
+	_, err = loadIdentity(dir, "room3")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// chained are the message types covered by the integrity chain. Pings,
+// pongs and acks are left out: they are per-peer chatter, not conversation,
+// and each side sees a different set of them.
+var chained = map[message.Type]bool{
+	"chat":            true,
+	typeEmote:         true,
+	"chatfile":        true,
+	"encrypted":       true,
+	typeChatArchive:   true,
+	typeTransferOffer: true,
+	typeChatEdit:      true,
+	typeChatDelete:    true,
+}
+
+// transcriptEntry is one message in the integrity chain.
+type transcriptEntry struct {
+	At     time.Time
+	Sent   bool
+	ID     string
+	Type   message.Type
+	Alias  string
+	Text   string
+	Digest [sha256.Size]byte
+	Head   [sha256.Size]byte
+	// Reactions to the message are attached as they arrive, see react.
+	Reactions []reaction
+}
+
+// transcript keeps a running hash chain over the room's messages:
+// head_n = sha256(head_{n-1} || id || sha256(content)). Two members who saw
+// the same messages in the same order end up with the same head, so
+// comparing heads shows whether anything was dropped or injected.
+type transcript struct {
+	mu      sync.Mutex
+	head    [sha256.Size]byte
+	entries []transcriptEntry
+}
+
+// contentDigest hashes everything a message carries apart from its id.
+// Fields are length-prefixed so they cannot run into each other.
+func contentDigest(m message.Message) [sha256.Size]byte {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(m.Type), []byte(m.Alias), []byte(m.Message), m.Bytes, m.Bytes2} {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(field)))
+		h.Write(n[:])
+		h.Write(field)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// record appends m to the chain if its type is covered and reports whether
+// it did. Ephemeral messages are left out, so they are never saved.
+func (t *transcript) record(m message.Message, sent bool, at time.Time) bool {
+	if !chained[m.Type] || isEphemeral(m) {
+		return false
+	}
+	digest := contentDigest(m)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := sha256.New()
+	h.Write(t.head[:])
+	h.Write([]byte(m.ID))
+	h.Write(digest[:])
+	copy(t.head[:], h.Sum(nil))
+	t.entries = append(t.entries, transcriptEntry{
+		At:     at,
+		Sent:   sent,
+		ID:     m.ID,
+		Type:   m.Type,
+		Alias:  m.Alias,
+		Text:   m.Message,
+		Digest: digest,
+		Head:   t.head,
+	})
+	return true
+}
+
+// Head returns the current chain head in hex and the number of messages
+// it covers.
+func (t *transcript) Head() (head string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return hex.EncodeToString(t.head[:]), len(t.entries)
+}
+
+// write exports the transcript as text, one line per message. A signed
+// export adds each message's id, content digest and chain head, and ends
+// with the final head so a reader can replay the chain.
+func (t *transcript) write(w io.Writer, signed bool) error {
+	t.mu.Lock()
+	entries := append([]transcriptEntry(nil), t.entries...)
+	head := t.head
+	t.mu.Unlock()
+	for _, e := range entries {
+		text := e.Text
+		switch e.Type {
+		case "chat", typeEmote:
+		case typeChatEdit:
+			text = fmt.Sprintf("%s (edited %s)", e.Text, shortID(e.ID))
+		case typeChatDelete:
+			text = fmt.Sprintf("(deleted %s)", shortID(e.ID))
+		default:
+			text = fmt.Sprintf("<%s> %s", e.Type, e.Text)
+		}
+		if summary := reactionSummary(e.Reactions); summary != "" {
+			text += " " + summary
+		}
+		if _, err := fmt.Fprintf(w, "%s [%s]: %s\n", e.At.Format("2006-01-02 15:04:05"), e.Alias, text); err != nil {
+			return err
+		}
+		if signed {
+			if _, err := fmt.Fprintf(w, "  id=%s digest=%x head=%x\n", e.ID, e.Digest, e.Head); err != nil {
+				return err
+			}
+		}
+	}
+	if signed {
+		_, err := fmt.Fprintf(w, "chain head %x over %d messages\n", head, len(entries))
+		return err
+	}
+	return nil
+}
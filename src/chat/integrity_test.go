@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+func TestTranscriptChain(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []message.Message{
+		{Type: "chat", ID: "a1", Alias: "alice", Message: "hello"},
+		{Type: typePing, Message: "nonce"},
+		{Type: "chat", ID: "b1", Alias: "bob", Message: "hi"},
+		{Type: "chatfile", ID: "a2", Alias: "alice", Message: "notes.txt", Bytes: []byte("notes")},
+	}
+	alice, bob, lossy := &transcript{}, &transcript{}, &transcript{}
+	for i, m := range msgs {
+		alice.record(m, m.Alias == "alice", at)
+		bob.record(m, m.Alias == "bob", at)
+		if i != 2 {
+			lossy.record(m, false, at)
+		}
+	}
+	head, n := alice.Head()
+	assert.Equal(t, 3, n)
+	bobHead, _ := bob.Head()
+	assert.Equal(t, head, bobHead)
+	lossyHead, _ := lossy.Head()
+	assert.NotEqual(t, head, lossyHead)
+
+	// same id, different content
+	tampered := &transcript{}
+	for _, m := range msgs {
+		if m.ID == "a2" {
+			m.Bytes = []byte("n0tes")
+		}
+		tampered.record(m, false, at)
+	}
+	tamperedHead, _ := tampered.Head()
+	assert.NotEqual(t, head, tamperedHead)
+
+	// fields are length-prefixed, so moving bytes between them changes the digest
+	assert.NotEqual(t, contentDigest(message.Message{Type: "chat", Alias: "ab", Message: "c"}),
+		contentDigest(message.Message{Type: "chat", Alias: "a", Message: "bc"}))
+}
+
+func TestTranscriptWrite(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr := &transcript{}
+	tr.record(message.Message{Type: "chat", ID: "a1", Alias: "alice", Message: "hello"}, true, at)
+	tr.record(message.Message{Type: "chatfile", ID: "b1", Alias: "bob", Message: "notes.txt"}, false, at)
+	head, _ := tr.Head()
+
+	var plain bytes.Buffer
+	assert.Nil(t, tr.write(&plain, false))
+	assert.Equal(t, "2024-05-01 12:00:00 [alice]: hello\n2024-05-01 12:00:00 [bob]: <chatfile> notes.txt\n", plain.String())
+
+	var signed bytes.Buffer
+	assert.Nil(t, tr.write(&signed, true))
+	assert.Contains(t, signed.String(), "id=a1 digest=")
+	assert.Contains(t, signed.String(), "chain head "+head+" over 2 messages\n")
+}
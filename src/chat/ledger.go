@@ -0,0 +1,215 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// ledgerDirName is the directory in croc's config directory holding the
+// transfers ledger of each room, one file per room.
+const ledgerDirName = "chat_transfers"
+
+// maxLedgerEntries is how many entries a ledger keeps; the oldest go
+// first.
+const maxLedgerEntries = 1000
+
+// transferDirection says whether a ledger entry was sent or received.
+type transferDirection string
+
+const (
+	transferSent     transferDirection = "sent"
+	transferReceived transferDirection = "received"
+)
+
+// transferResult is how a transfer in the ledger ended.
+type transferResult string
+
+const (
+	transferDone      transferResult = "done"
+	transferFailed    transferResult = "failed"
+	transferDeclined  transferResult = "declined"
+	transferCancelled transferResult = "cancelled"
+)
+
+// resultWords are the words /transfers shows for each result.
+var resultWords = map[transferResult]msgID{
+	transferDone:      msgResultDone,
+	transferFailed:    msgResultFailed,
+	transferDeclined:  msgResultDeclined,
+	transferCancelled: msgResultCancelled,
+}
+
+// ledgerEntry is a file or folder sent or received with /sendfile.
+type ledgerEntry struct {
+	Direction transferDirection `json:"direction"`
+	Name      string            `json:"name"`
+	Size      int64             `json:"size"`
+	// SHA256 is the hex digest of the file, or of the archive of a
+	// folder; offers from peers that send none leave it out.
+	SHA256 string `json:"sha256,omitempty"`
+	// Path is where a received file was saved.
+	Path   string         `json:"path,omitempty"`
+	Time   time.Time      `json:"time"`
+	Result transferResult `json:"result"`
+	Error  string         `json:"error,omitempty"`
+}
+
+// String formats the entry for /transfers.
+func (e ledgerEntry) String() string {
+	direction := localize(msgLedgerSent)
+	if e.Direction == transferReceived {
+		direction = localize(msgLedgerReceived)
+	}
+	s := localize(msgLedgerEntry, e.Time.Format("2006-01-02 15:04"), direction, e.Name, utils.ByteCountDecimal(e.Size), localize(resultWords[e.Result]))
+	if e.Path != "" {
+		s += " → " + e.Path
+	}
+	if e.Error != "" {
+		s += ": " + e.Error
+	}
+	return s
+}
+
+// transferLedger is the list of files a room exchanged, kept in a file
+// when it has a path.
+type transferLedger struct {
+	path string
+	// persist says whether entries may be written to the file; rooms
+	// that do not allow history keep the ledger in memory only.
+	persist func() bool
+
+	mu      sync.Mutex
+	entries []ledgerEntry
+}
+
+// defaultLedgerPath returns where the ledger of room is kept.
+func defaultLedgerPath(room string) (string, error) {
+	configDir, err := utils.GetConfigDir(true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, ledgerDirName, room+".json"), nil
+}
+
+// loadTransferLedger returns the ledger kept at path, which is empty if
+// the file does not exist yet. An empty path keeps it in memory.
+func loadTransferLedger(path string) (*transferLedger, error) {
+	l := &transferLedger{path: path}
+	if path == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &l.entries); err != nil {
+		return nil, fmt.Errorf("invalid transfers ledger %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// record adds e to the ledger and writes it out. The file is replaced
+// atomically, and a failed write leaves both it and the ledger as they
+// were.
+func (l *transferLedger) record(e ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := append(l.entries[:len(l.entries):len(l.entries)], e)
+	if len(entries) > maxLedgerEntries {
+		entries = entries[len(entries)-maxLedgerEntries:]
+	}
+	if err := l.write(entries); err != nil {
+		return err
+	}
+	l.entries = entries
+	return nil
+}
+
+func (l *transferLedger) write(entries []ledgerEntry) error {
+	if l.path == "" || (l.persist != nil && !l.persist()) {
+		return nil
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// list returns the entries, oldest first.
+func (l *transferLedger) list() []ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ledgerEntry(nil), l.entries...)
+}
+
+// delivered returns the latest entry of the room receiving a file with
+// digest, and false if it never did.
+func (l *transferLedger) delivered(digest string) (ledgerEntry, bool) {
+	if digest == "" {
+		return ledgerEntry{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if e := l.entries[i]; e.Direction == transferSent && e.Result == transferDone && e.SHA256 == digest {
+			return e, true
+		}
+	}
+	return ledgerEntry{}, false
+}
+
+// confirmResend asks, through ask, whether to send name again if the
+// ledger shows the room received a file with digest before, and reports
+// whether to send it. A file the room never received is sent without
+// asking.
+func (l *transferLedger) confirmResend(name, digest string, ask func(question string) string) bool {
+	e, ok := l.delivered(digest)
+	if !ok {
+		return true
+	}
+	return isYes(ask(localize(msgLedgerDuplicate, name, e.Time.Format("2006-01-02 15:04"), yesNo())))
+}
+
+// printTransfers writes the entries for /transfers, one per line or as
+// a JSON array for scripts.
+func printTransfers(w io.Writer, entries []ledgerEntry, asJSON bool) error {
+	if asJSON {
+		if entries == nil {
+			entries = []ledgerEntry{}
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, localize(msgLedgerEmpty))
+		return err
+	}
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ledgerDirName, "room.json")
+	l, err := loadTransferLedger(path)
+	assert.Nil(t, err)
+	assert.Empty(t, l.list())
+
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	sent := ledgerEntry{Direction: transferSent, Name: "notes.txt", Size: 5, SHA256: fileDigest([]byte("notes")), Time: at, Result: transferDone}
+	received := ledgerEntry{Direction: transferReceived, Name: "photo.jpg", Size: 3, Path: "chat_received_files/photo.jpg", Time: at.Add(time.Minute), Result: transferDeclined}
+	assert.Nil(t, l.record(sent))
+	assert.Nil(t, l.record(received))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the file is replaced, not written in place")
+
+	reloaded, err := loadTransferLedger(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []ledgerEntry{sent, received}, reloaded.list())
+
+	// a failed write changes nothing
+	blocked := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(blocked, nil, 0o600))
+	l.path = filepath.Join(blocked, "room.json")
+	assert.NotNil(t, l.record(sent))
+	assert.Len(t, l.list(), 2)
+
+	// rooms without history keep the ledger in memory
+	l.path = path
+	l.persist = func() bool { return false }
+	assert.Nil(t, l.record(sent))
+	assert.Len(t, l.list(), 3)
+	reloaded, err = loadTransferLedger(path)
+	assert.Nil(t, err)
+	assert.Len(t, reloaded.list(), 2)
+
+	// only the latest entries are kept
+	l.persist = nil
+	for i := 0; i < maxLedgerEntries; i++ {
+		assert.Nil(t, l.record(received))
+	}
+	assert.Len(t, l.list(), maxLedgerEntries)
+	assert.Equal(t, received, l.list()[0])
+
+	assert.Nil(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err = loadTransferLedger(path)
+	assert.NotNil(t, err)
+}
+
+func TestLedgerDuplicate(t *testing.T) {
+	l, err := loadTransferLedger("")
+	assert.Nil(t, err)
+	digest := fileDigest([]byte("report"))
+	var asked []string
+	ask := func(answer string) func(string) string {
+		return func(question string) string {
+			asked = append(asked, question)
+			return answer
+		}
+	}
+
+	// nothing to ask about a file the room never got
+	assert.True(t, l.confirmResend("report.pdf", digest, ask("no")))
+	for _, e := range []ledgerEntry{
+		{Direction: transferReceived, Name: "report.pdf", SHA256: digest, Result: transferDone},
+		{Direction: transferSent, Name: "report.pdf", SHA256: digest, Result: transferFailed},
+		{Direction: transferSent, Name: "report.pdf", SHA256: digest, Result: transferCancelled},
+		{Direction: transferSent, Name: "other.pdf", SHA256: fileDigest([]byte("other")), Result: transferDone},
+	} {
+		assert.Nil(t, l.record(e))
+	}
+	assert.True(t, l.confirmResend("report.pdf", digest, ask("no")))
+	assert.True(t, l.confirmResend("unhashed.pdf", "", ask("no")))
+	assert.Empty(t, asked)
+
+	// once it was delivered, sending it again takes a yes, whatever the
+	// file is called now
+	first := time.Date(2024, 5, 1, 9, 0, 0, 0, time.Local)
+	assert.Nil(t, l.record(ledgerEntry{Direction: transferSent, Name: "report.pdf", SHA256: digest, Time: first, Result: transferDone}))
+	assert.Nil(t, l.record(ledgerEntry{Direction: transferSent, Name: "report.pdf", SHA256: digest, Time: first.AddDate(0, 0, 1), Result: transferDone}))
+	assert.False(t, l.confirmResend("report-final.pdf", digest, ask("no")))
+	assert.True(t, l.confirmResend("report-final.pdf", digest, ask("y")))
+	if assert.Len(t, asked, 2) {
+		assert.Equal(t, "Peer already received 'report-final.pdf' on 2024-05-02 09:00. Send anyway? (yes/no): ", asked[0])
+	}
+}
+
+func TestPrintTransfers(t *testing.T) {
+	var out bytes.Buffer
+	assert.Nil(t, printTransfers(&out, nil, false))
+	assert.Equal(t, localize(msgLedgerEmpty)+"\n", out.String())
+	out.Reset()
+	assert.Nil(t, printTransfers(&out, nil, true))
+	assert.Equal(t, "[]\n", out.String())
+
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	entries := []ledgerEntry{
+		{Direction: transferSent, Name: "notes.txt", Size: 1200, Time: at, Result: transferDone},
+		{Direction: transferReceived, Name: "photo.jpg", Size: 3, Path: "in/photo.jpg", Time: at, Result: transferFailed, Error: "disk full"},
+	}
+	out.Reset()
+	assert.Nil(t, printTransfers(&out, entries, false))
+	assert.Equal(t, []string{
+		"2024-05-01 09:00  sent 'notes.txt' (1.2 kB), done",
+		"2024-05-01 09:00  received 'photo.jpg' (3 B), failed → in/photo.jpg: disk full",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+
+	out.Reset()
+	assert.Nil(t, printTransfers(&out, entries, true))
+	var got []ledgerEntry
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &got))
+	assert.Equal(t, entries, got)
+	assert.Contains(t, out.String(), `"direction": "received"`)
+}
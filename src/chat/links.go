@@ -0,0 +1,195 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Limits of the link preview fetcher.
+const (
+	previewTimeout      = 2 * time.Second
+	previewMaxBody      = 64 * 1024
+	previewMaxRedirects = 3
+	previewWorkers      = 2
+	previewQueue        = 16
+	previewMaxTitle     = 120
+	// maxLinks is how many recent URLs /links remembers.
+	maxLinks = 50
+)
+
+// urlPattern finds URLs of any scheme; previews are limited to http(s).
+var urlPattern = regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s<>"]+`)
+
+// titlePattern finds the page title in the start of an HTML document.
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// findURLs returns the URLs in text, without trailing punctuation that
+// usually belongs to the sentence.
+func findURLs(text string) (urls []string) {
+	for _, loc := range urlPattern.FindAllStringIndex(text, -1) {
+		urls = append(urls, trimURL(text[loc[0]:loc[1]]))
+	}
+	return
+}
+
+func trimURL(u string) string {
+	return strings.TrimRight(u, ".,;:!?)]}'")
+}
+
+// highlightURLs underlines and colors the URLs in text.
+func highlightURLs(text string) string {
+	return urlPattern.ReplaceAllStringFunc(text, func(match string) string {
+		u := trimURL(match)
+		return colorText("\033[4m"+u, CyanColor) + match[len(u):]
+	})
+}
+
+// link is a URL seen in the chat, listed by /links.
+type link struct {
+	URL   string
+	Alias string
+	At    time.Time
+}
+
+// linkLog keeps the most recent URLs, oldest first.
+type linkLog struct {
+	mu    sync.Mutex
+	links []link
+}
+
+func (l *linkLog) add(alias string, urls []string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, u := range urls {
+		l.links = append(l.links, link{URL: u, Alias: alias, At: at})
+	}
+	if len(l.links) > maxLinks {
+		l.links = append([]link(nil), l.links[len(l.links)-maxLinks:]...)
+	}
+}
+
+func (l *linkLog) list() []link {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]link(nil), l.links...)
+}
+
+// errNotHTTP is returned for URLs the previewer will not fetch.
+var errNotHTTP = errors.New("only http and https links are previewed")
+
+// previewer fetches page titles in a bounded pool of workers. Requests
+// beyond the queue are dropped rather than piling up.
+type previewer struct {
+	client *http.Client
+	jobs   chan string
+	show   func(u, title string)
+	wg     sync.WaitGroup
+}
+
+// newPreviewer starts the workers; show is called from them with each
+// title found.
+func newPreviewer(show func(u, title string)) *previewer {
+	p := &previewer{
+		client: &http.Client{
+			Timeout: previewTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > previewMaxRedirects {
+					return fmt.Errorf("stopped after %d redirects", previewMaxRedirects)
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return errNotHTTP
+				}
+				return nil
+			},
+		},
+		jobs: make(chan string, previewQueue),
+		show: show,
+	}
+	for i := 0; i < previewWorkers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for u := range p.jobs {
+				title, err := p.fetchTitle(context.Background(), u)
+				if err != nil || title == "" {
+					continue
+				}
+				p.show(u, title)
+			}
+		}()
+	}
+	return p
+}
+
+// queue asks for a preview of u, dropping it if the workers are busy.
+func (p *previewer) queue(u string) {
+	select {
+	case p.jobs <- u:
+	default:
+	}
+}
+
+// Close stops the workers once the queued previews are done.
+func (p *previewer) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// fetchTitle returns the title of the HTML page at u, reading at most
+// previewMaxBody bytes of it.
+func (p *previewer) fetchTitle(ctx context.Context, u string) (title string, err error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", errNotHTTP
+	}
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return "", fmt.Errorf("not a page: %s", ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, previewMaxBody))
+	if err != nil {
+		return
+	}
+	m := titlePattern.FindSubmatch(body)
+	if m == nil {
+		return
+	}
+	// the title ends up on the terminal, so control characters are dropped
+	title = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, html.UnescapeString(string(m[1])))
+	title = strings.Join(strings.Fields(title), " ")
+	if r := []rune(title); len(r) > previewMaxTitle {
+		title = string(r[:previewMaxTitle]) + "…"
+	}
+	return
+}
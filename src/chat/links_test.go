@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindURLs(t *testing.T) {
+	assert.Equal(t, []string{"https://example.com/a?b=c", "ftp://files.example.com"},
+		findURLs("see https://example.com/a?b=c, or (ftp://files.example.com)."))
+	assert.Empty(t, findURLs("no links here: example.com"))
+	assert.Equal(t, "see "+colorText("\033[4mhttp://x.y/z", CyanColor)+".", highlightURLs("see http://x.y/z."))
+}
+
+func TestLinkLog(t *testing.T) {
+	l := &linkLog{}
+	for i := 0; i < maxLinks+5; i++ {
+		l.add("alice", []string{fmt.Sprintf("https://example.com/%d", i)}, time.Now())
+	}
+	links := l.list()
+	assert.Len(t, links, maxLinks)
+	assert.Equal(t, "https://example.com/5", links[0].URL)
+	assert.Equal(t, fmt.Sprintf("https://example.com/%d", maxLinks+4), links[maxLinks-1].URL)
+}
+
+func TestFetchTitle(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><head><title>\n  Tom &amp; Jerry\x1b[31m </title></head></html>")
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/redirect/"), "%d", &n)
+		if n == 0 {
+			http.Redirect(w, r, "/page", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/huge", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, strings.Repeat(" ", previewMaxBody)+"<title>too late</title>")
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "<title>not a page</title>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := newPreviewer(func(string, string) {})
+	defer p.Close()
+	ctx := context.Background()
+
+	title, err := p.fetchTitle(ctx, srv.URL+"/page")
+	assert.Nil(t, err)
+	assert.Equal(t, "Tom & Jerry [31m", title)
+
+	// /redirect/2 redirects three times in all
+	title, err = p.fetchTitle(ctx, srv.URL+"/redirect/2")
+	assert.Nil(t, err)
+	assert.Equal(t, "Tom & Jerry [31m", title)
+	_, err = p.fetchTitle(ctx, srv.URL+"/redirect/3")
+	assert.NotNil(t, err)
+
+	title, err = p.fetchTitle(ctx, srv.URL+"/huge")
+	assert.Nil(t, err)
+	assert.Empty(t, title)
+	_, err = p.fetchTitle(ctx, srv.URL+"/image")
+	assert.NotNil(t, err)
+	_, err = p.fetchTitle(ctx, "file:///etc/passwd")
+	assert.ErrorIs(t, err, errNotHTTP)
+}
+
+func TestPreviewerQueue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<title>%s</title>", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	titles := make(chan string, previewQueue)
+	p := newPreviewer(func(u, title string) { titles <- title })
+	p.queue(srv.URL + "/one")
+	p.queue("gopher://example.com")
+	p.Close()
+	close(titles)
+	var got []string
+	for title := range titles {
+		got = append(got, title)
+	}
+	assert.Equal(t, []string{"/one"}, got)
+}
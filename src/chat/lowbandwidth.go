@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/compress"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+	log "github.com/schollz/logger"
+)
+
+// presenceLowBandwidth is the presence of a session in low-bandwidth mode,
+// so peers know why its receipts come late and its offers have no
+// preview. A presence lists the session's values separated by spaces.
+const presenceLowBandwidth = "low-bandwidth"
+
+// Acks of a low-bandwidth session wait up to ackBatchInterval and go out
+// together, at most maxAckBatch in a message.
+const (
+	ackBatchInterval = 3 * time.Second
+	maxAckBatch      = 32
+)
+
+// compressedFrame starts a frame deflated by a low-bandwidth session. A
+// plain frame is a JSON object and starts with '{'.
+var compressedFrame = []byte("z")
+
+// LowBandwidth reports whether the session saves bytes wherever it can:
+// it batches its acks, compresses what it sends and announces itself so
+// peers know. The chat turns off previews and asks before saving any
+// file for it, too.
+func (s *Session) LowBandwidth() bool {
+	return s.options.LowBandwidth
+}
+
+// presence returns what the session announces about itself, "" if
+// nothing.
+func (s *Session) presence() string {
+	var p []string
+	if s.ReadOnly() {
+		p = append(p, presenceObserver)
+	}
+	if s.LowBandwidth() {
+		p = append(p, presenceLowBandwidth)
+	}
+	return strings.Join(p, " ")
+}
+
+// presenceHas reports whether the presence m lists value.
+func presenceHas(m message.Message, value string) bool {
+	if m.Type != typePresence {
+		return false
+	}
+	for _, v := range strings.Fields(m.Message) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ackBatch holds the acks a low-bandwidth session has yet to send.
+type ackBatch struct {
+	mu      sync.Mutex
+	ids     []string
+	pending bool
+}
+
+// add queues id and reports whether it is the first of a batch, whose
+// sender should flush it in ackBatchInterval.
+func (b *ackBatch) add(id string) (first bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ids = append(b.ids, id)
+	first = !b.pending
+	b.pending = true
+	return
+}
+
+// take empties the batch and returns its acks, at most maxAckBatch to a
+// message. The first id of each goes in ID, where peers that do not know
+// batches look for it, and the rest in Message.
+func (b *ackBatch) take() (acks []message.Message) {
+	b.mu.Lock()
+	ids := b.ids
+	b.ids = nil
+	b.pending = false
+	b.mu.Unlock()
+	for len(ids) > 0 {
+		n := min(len(ids), maxAckBatch)
+		acks = append(acks, message.Message{Type: typeAck, ID: ids[0], Message: strings.Join(ids[1:n], " ")})
+		ids = ids[n:]
+	}
+	return
+}
+
+// ackIDs returns the ids of the messages an ack acknowledges.
+func ackIDs(m message.Message) []string {
+	return append([]string{m.ID}, strings.Fields(m.Message)...)
+}
+
+// queueAck batches an ack of id with the others due in the next
+// ackBatchInterval.
+func (s *Session) queueAck(id string) {
+	if !s.acks.add(id) {
+		return
+	}
+	time.AfterFunc(ackBatchInterval, func() {
+		for _, ack := range s.acks.take() {
+			if s.ctx.Err() != nil {
+				return
+			}
+			if err := s.Send(ack); err != nil {
+				log.Debugf("error sending acks: %v", err)
+			}
+		}
+	})
+}
+
+// compressFrame deflates a frame, keeping it as it is if that does not
+// make it smaller.
+func compressFrame(data []byte) []byte {
+	z := append(append([]byte{}, compressedFrame...), compress.CompressWithOption(data, flate.BestCompression)...)
+	if len(z) >= len(data) {
+		return data
+	}
+	return z
+}
+
+// inflateFrame undoes compressFrame, refusing frames that inflate past
+// maxFrameSize.
+func inflateFrame(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressedFrame) {
+		return data, nil
+	}
+	r := flate.NewReader(bytes.NewReader(data[len(compressedFrame):]))
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, maxFrameSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("inflating frame: %w", err)
+	}
+	if len(b) > maxFrameSize {
+		return nil, fmt.Errorf("%w: inflates past %d bytes", errFrameTooLarge, maxFrameSize)
+	}
+	return b, nil
+}
+
+// TrafficStats are the bytes of a session by what they carried.
+type TrafficStats struct {
+	// Messages are the conversation: chat messages, emotes, edits,
+	// deletes and reactions.
+	Messages int64
+	// Presence is what sessions announce about themselves.
+	Presence int64
+	// Files are files and the offers of files and folders.
+	Files int64
+	// Overhead is everything else: pings, acks, room settings and
+	// confirmations, relay control frames, frames that were dropped and
+	// the framing of every frame.
+	Overhead int64
+}
+
+// Total returns the bytes of all categories.
+func (t TrafficStats) Total() int64 {
+	return t.Messages + t.Presence + t.Files + t.Overhead
+}
+
+// frameHeader is what the connection adds to every frame: the magic bytes
+// and the length.
+var frameHeader = int64(len(comm.MAGIC_BYTES) + 4)
+
+// overheadTypes are the message types counted as overhead.
+var overheadTypes = map[message.Type]bool{
+	typePing:         true,
+	typePong:         true,
+	typeAck:          true,
+	typeRoomSettings: true,
+	typeConfirm:      true,
+}
+
+// trafficCounter counts the bytes a session sent and received.
+type trafficCounter struct {
+	sent, received [4]atomic.Int64
+}
+
+// Indexes of the categories in trafficCounter.
+const (
+	trafficMessages = iota
+	trafficPresence
+	trafficFiles
+	trafficOverhead
+)
+
+// trafficCategory returns the category of a frame carrying m.
+func trafficCategory(m message.Message) int {
+	switch {
+	case m.Type == typePresence:
+		return trafficPresence
+	case m.Type == "chatfile" || m.Type == typeChatArchive || m.Type == typeTransferOffer:
+		return trafficFiles
+	case overheadTypes[m.Type]:
+		return trafficOverhead
+	}
+	return trafficMessages
+}
+
+// add counts a frame of n bytes in category, and its framing as overhead.
+func (c *trafficCounter) add(sent bool, category int, n int) {
+	counts := &c.received
+	if sent {
+		counts = &c.sent
+	}
+	counts[category].Add(int64(n))
+	counts[trafficOverhead].Add(frameHeader)
+}
+
+// stats returns the counts so far.
+func (c *trafficCounter) stats() (sent, received TrafficStats) {
+	get := func(counts *[4]atomic.Int64) TrafficStats {
+		return TrafficStats{
+			Messages: counts[trafficMessages].Load(),
+			Presence: counts[trafficPresence].Load(),
+			Files:    counts[trafficFiles].Load(),
+			Overhead: counts[trafficOverhead].Load(),
+		}
+	}
+	return get(&c.sent), get(&c.received)
+}
+
+// Traffic returns the bytes the session sent and received so far, over
+// every connection it had to the relay.
+func (s *Session) Traffic() (sent, received TrafficStats) {
+	return s.traffic.stats()
+}
+
+// printTraffic writes what /stats shows: the bytes sent and received by
+// category, and whether low-bandwidth mode is on.
+func printTraffic(w io.Writer, sent, received TrafficStats, lowBandwidth bool) error {
+	lines := []string{localize(msgStatsHeader)}
+	for _, c := range []struct {
+		name           msgID
+		sent, received int64
+	}{
+		{msgStatsMessages, sent.Messages, received.Messages},
+		{msgStatsPresence, sent.Presence, received.Presence},
+		{msgStatsFiles, sent.Files, received.Files},
+		{msgStatsOverhead, sent.Overhead, received.Overhead},
+		{msgStatsTotal, sent.Total(), received.Total()},
+	} {
+		lines = append(lines, localize(msgStatsLine, localize(c.name), utils.ByteCountDecimal(c.sent), utils.ByteCountDecimal(c.received)))
+	}
+	if lowBandwidth {
+		lines = append(lines, localize(msgLowBandwidthOn))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// offerSize formats the size of an offered file, standing out when
+// prominent, as it does for low-bandwidth sessions.
+func offerSize(size int64, prominent bool) string {
+	s := utils.ByteCountDecimal(size)
+	if prominent {
+		s = colorText(s, MagentaColor)
+	}
+	return s
+}
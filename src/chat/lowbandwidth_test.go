@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/compress"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressFrame(t *testing.T) {
+	data := frame(t, message.Message{Type: "chat", Message: strings.Repeat("all work and no play ", 20), ID: "abc"})
+	z := compressFrame(data)
+	assert.Less(t, len(z), len(data))
+	m, err := decodeFrame(z)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("all work and no play ", 20), m.Message)
+
+	// frames that do not shrink go as they are
+	small := frame(t, message.Message{Type: typeAck, ID: "1"})
+	assert.Equal(t, small, compressFrame(small))
+
+	bomb := append([]byte("z"), compress.CompressWithOption(make([]byte, maxFrameSize+1), flate.BestCompression)...)
+	_, err = decodeFrame(bomb)
+	assert.True(t, errors.Is(err, errFrameTooLarge))
+	_, err = decodeFrame([]byte("z junk"))
+	assert.NotNil(t, err)
+}
+
+func TestAckBatch(t *testing.T) {
+	var b ackBatch
+	assert.Nil(t, b.take())
+	assert.True(t, b.add("0"))
+	for i := 1; i < maxAckBatch+2; i++ {
+		assert.False(t, b.add(fmt.Sprint(i)))
+	}
+	acks := b.take()
+	if assert.Len(t, acks, 2) {
+		assert.Equal(t, "0", acks[0].ID)
+		ids := ackIDs(acks[0])
+		assert.Len(t, ids, maxAckBatch)
+		assert.Equal(t, fmt.Sprint(maxAckBatch-1), ids[maxAckBatch-1])
+		assert.Equal(t, []string{fmt.Sprint(maxAckBatch), fmt.Sprint(maxAckBatch + 1)}, ackIDs(acks[1]))
+	}
+	assert.True(t, b.add("next"), "a new batch starts")
+	assert.Equal(t, []string{"1"}, ackIDs(message.Message{Type: typeAck, ID: "1"}))
+}
+
+func TestPresenceHas(t *testing.T) {
+	m := message.Message{Type: typePresence, Message: "observer low-bandwidth"}
+	assert.True(t, presenceHas(m, presenceObserver))
+	assert.True(t, presenceHas(m, presenceLowBandwidth))
+	assert.False(t, presenceHas(message.Message{Type: typePresence, Message: "observer"}, presenceLowBandwidth))
+	assert.False(t, presenceHas(message.Message{Type: "chat", Message: "observer"}, presenceObserver))
+}
+
+func TestPrintTraffic(t *testing.T) {
+	setLanguage("en")
+	var buf bytes.Buffer
+	sent := TrafficStats{Messages: 1500, Presence: 20, Files: 2 << 20, Overhead: 300}
+	assert.Nil(t, printTraffic(&buf, sent, TrafficStats{Messages: 10}, true))
+	assert.Equal(t, `Bytes this session, sent / received:
+  messages    1.5 kB / 10 B
+  presence    20 B / 0 B
+  files       2.0 MB / 0 B
+  overhead    300 B / 0 B
+  total       2.0 MB / 10 B
+Low-bandwidth mode is on: receipts go out in batches, offers carry no previews and every file is confirmed
+`, buf.String())
+}
+
+func TestLowBandwidthSession(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	options := croc.Options{SharedSecret: "1234-low-bandwidth", RelayAddress: l.Addr().String(), RelayPassword: "pass123"}
+	alice, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	options.LowBandwidth = true
+	bob, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+	assert.False(t, alice.LowBandwidth())
+	assert.True(t, bob.LowBandwidth())
+
+	toAlice := make(chan message.Message, 10)
+	toBob := make(chan message.Message, 10)
+	alice.SetAlias("alice")
+	alice.Start(func(m message.Message) {
+		alice.Answer(m)
+		toAlice <- m
+	}, func(string) {})
+	bob.SetAlias("bob")
+	bob.Start(func(m message.Message) {
+		bob.Answer(m)
+		toBob <- m
+	}, func(string) {})
+	next := func(c chan message.Message) message.Message {
+		select {
+		case m := <-c:
+			return m
+		case <-time.After(10 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+		return message.Message{}
+	}
+
+	// bob tells the room he saves bytes
+	m := next(toAlice)
+	assert.Equal(t, typePresence, m.Type)
+	assert.True(t, presenceHas(m, presenceLowBandwidth))
+	assert.False(t, presenceHas(m, presenceObserver))
+
+	// his acks come together, in one frame
+	text := strings.Repeat("all work and no play ", 20)
+	for _, id := range []string{"1", "2", "3"} {
+		assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: text, ID: id}))
+	}
+	for range 3 {
+		assert.Equal(t, text, next(toBob).Message)
+	}
+	// bob announces himself to alice, whom he hears from for the first
+	// time
+	assert.Equal(t, typePresence, next(toAlice).Type)
+	m = next(toAlice)
+	assert.Equal(t, typeAck, m.Type)
+	assert.Equal(t, []string{"1", "2", "3"}, ackIDs(m))
+
+	// what bob sends is compressed, and alice reads it all the same
+	assert.Nil(t, bob.Send(message.Message{Type: "chat", Message: text, ID: "4"}))
+	assert.Equal(t, text, next(toAlice).Message)
+	aliceSent, aliceReceived := alice.Traffic()
+	bobSent, bobReceived := bob.Traffic()
+	assert.Less(t, bobSent.Messages, int64(len(text)))
+	assert.Equal(t, bobSent.Messages, aliceReceived.Messages)
+	assert.Greater(t, aliceSent.Messages, int64(3*len(text)))
+	assert.Equal(t, aliceSent.Messages, bobReceived.Messages)
+	assert.Greater(t, bobSent.Presence, int64(0))
+	assert.Greater(t, aliceReceived.Overhead, int64(0))
+	assert.Zero(t, aliceSent.Files)
+}
@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"errors"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typePresence tells peers how a session takes part in the room. Observers
+// and low-bandwidth sessions send it when they join and to every peer they
+// hear from for the first time, so peers that joined later learn about
+// them too.
+const typePresence message.Type = "presence"
+
+// presenceObserver is the presence of a session that only watches.
+const presenceObserver = "observer"
+
+// ErrReadOnly is returned by Send for messages an observing session does
+// not send.
+var ErrReadOnly = errors.New("observers cannot send messages")
+
+// observerSends are the message types an observer still sends: its
+// presence, the answers that let peers see it is there and its part in
+// the room settings negotiation.
+var observerSends = map[message.Type]bool{
+	typePresence:     true,
+	typePong:         true,
+	typeAck:          true,
+	typeRoomSettings: true,
+}
+
+// observerCommands are the commands that work while observing. They only
+// read what the session already has.
+var observerCommands = map[string]bool{
+	"quit":      true,
+	"who":       true,
+	"find":      true,
+	"save":      true,
+	"transfers": true,
+	"stats":     true,
+	"security":  true,
+}
+
+// observerAllows reports whether an observer can run the input line.
+func observerAllows(line string) bool {
+	name, _ := commandName(line)
+	return observerCommands[name]
+}
+
+// announce sends the session's presence to alias, or to the room when
+// alias is empty, unless it was sent to it already.
+func (s *Session) announce(alias string) {
+	s.mu.Lock()
+	if s.announced[alias] {
+		s.mu.Unlock()
+		return
+	}
+	s.announced[alias] = true
+	s.mu.Unlock()
+	if err := s.Send(message.Message{Type: typePresence, Message: s.presence()}); err != nil {
+		s.mu.Lock()
+		delete(s.announced, alias)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserverAllows(t *testing.T) {
+	for _, line := range []string{"/quit", "/who", "/find hello", "/save chat.txt --signed", "/find\u00a0hello"} {
+		assert.True(t, observerAllows(line), line)
+	}
+	for _, line := range []string{"hello", "/sendfile x", "/ping", "/setalias eve", "/saved", "/edit 1 x"} {
+		assert.False(t, observerAllows(line), line)
+	}
+}
+
+func TestObserverSession(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8431", "pass123", tcp.WithBanner("8432"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-observer", RelayAddress: "127.0.0.1:8431", RelayPassword: "pass123"}
+	alice, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	options.Observe = true
+	eve, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer eve.Close()
+	assert.False(t, alice.ReadOnly())
+	assert.True(t, eve.ReadOnly())
+
+	toAlice := make(chan message.Message, 10)
+	toEve := make(chan message.Message, 10)
+	alice.Start(func(m message.Message) {
+		alice.Answer(m)
+		toAlice <- m
+	}, func(string) {})
+	eve.SetAlias("eve")
+	eve.Start(func(m message.Message) {
+		eve.Answer(m)
+		toEve <- m
+	}, func(string) {})
+	next := func(c chan message.Message) message.Message {
+		select {
+		case m := <-c:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+		return message.Message{}
+	}
+
+	// eve announces herself and then only answers
+	m := next(toAlice)
+	assert.Equal(t, typePresence, m.Type)
+	assert.Equal(t, presenceObserver, m.Message)
+	assert.Equal(t, "eve", m.Alias)
+	// presence carries eve's key, signed
+	assert.Equal(t, sessionID(eve.key), m.Session)
+	ok, err := verify(m)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, eve.Send(message.Message{Type: "chat", Message: "hi"}), ErrReadOnly)
+	_, err = eve.Edit(lastMessage, "hi")
+	assert.ErrorIs(t, err, errNotInScrollback)
+
+	alice.SetAlias("alice")
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "hello", ID: "1"}))
+	assert.Equal(t, "hello", next(toEve).Message)
+	// eve tells alice, whom she hears from for the first time, and acks
+	assert.Equal(t, typePresence, next(toAlice).Type)
+	m = next(toAlice)
+	assert.Equal(t, message.Message{Type: typeAck, ID: "1", Alias: "eve"}, m)
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "again", ID: "2"}))
+	next(toEve)
+	assert.Equal(t, typeAck, next(toAlice).Type, "eve announces herself once")
+
+	// a room that keeps observers out refuses eve
+	options.SharedSecret = "1234-no-observers"
+	options.Observe = false
+	options.DenyObservers = true
+	bob, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+	options.Observe = true
+	_, err = NewSession(context.Background(), options)
+	assert.ErrorIs(t, err, tcp.ErrObserversDenied)
+}
@@ -0,0 +1,188 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/schollz/cli/v2"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// Defaults for SendOnce.
+const (
+	DefaultOneShotThreshold   = 4 * 1024
+	DefaultOneShotPeerTimeout = 60 * time.Second
+	DefaultOneShotAckTimeout  = 30 * time.Second
+)
+
+// oneShotProbeInterval is how often SendOnce pings the room while it waits
+// for a peer.
+const oneShotProbeInterval = 2 * time.Second
+
+var (
+	// ErrNoPeer is returned by SendOnce when nobody answered in the room.
+	ErrNoPeer = errors.New("no peer joined the chat room")
+	// ErrNotDelivered is returned by SendOnce when no peer acknowledged the
+	// message.
+	ErrNotDelivered = errors.New("message was not acknowledged by any peer")
+)
+
+// OneShot configures SendOnce.
+type OneShot struct {
+	// Alias is attached to the message.
+	Alias string
+	// Threshold is the size above which the input is sent as a file rather
+	// than as a chat message. Zero means DefaultOneShotThreshold.
+	Threshold int
+	// FileName names the file when the input is sent as one. Defaults to
+	// a name derived from the current time.
+	FileName string
+	// PeerTimeout bounds the wait for a peer to be present.
+	PeerTimeout time.Duration
+	// AckTimeout bounds the wait for delivery once the message is sent.
+	AckTimeout time.Duration
+}
+
+// SendOnce joins the room, waits for a peer, delivers everything read from
+// r as a chat message or, past the size threshold, as a file, and returns
+// once a peer acknowledged it, or once it is sent in a room whose settings
+// turn receipts off. It never prompts, so it is safe to use from scripts.
+func SendOnce(ctx context.Context, options croc.Options, r io.Reader, o OneShot) (err error) {
+	if o.Threshold <= 0 {
+		o.Threshold = DefaultOneShotThreshold
+	}
+	if o.PeerTimeout <= 0 {
+		o.PeerTimeout = DefaultOneShotPeerTimeout
+	}
+	if o.AckTimeout <= 0 {
+		o.AckTimeout = DefaultOneShotAckTimeout
+	}
+	if o.FileName == "" {
+		o.FileName = fmt.Sprintf("stdin-%s.txt", time.Now().Format("20060102-150405"))
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("nothing to send")
+	}
+
+	session, err := NewSession(ctx, options)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	session.SetAlias(o.Alias)
+
+	pongs := make(chan string, 16)
+	acks := make(chan string, 16)
+	session.Start(func(m message.Message) {
+		session.Answer(m)
+		switch m.Type {
+		case typePong:
+			select {
+			case pongs <- m.Message:
+			default:
+			}
+		case typeAck:
+			for _, id := range ackIDs(m) {
+				select {
+				case acks <- id:
+				default:
+				}
+			}
+		}
+	}, func(string) {})
+
+	if err = waitForPeer(ctx, session, pongs, o.PeerTimeout); err != nil {
+		return
+	}
+
+	m := message.Message{Type: "chat", Message: string(data), ID: newMessageID()}
+	if len(data) > o.Threshold {
+		m = message.Message{Type: "chatfile", Message: o.FileName, Bytes: data, ID: m.ID}
+	}
+	if err = session.Send(m); err != nil {
+		return
+	}
+	if !session.RoomSettings().Receipts {
+		// nobody acks in this room, so delivery cannot be confirmed
+		return nil
+	}
+	timeout := time.NewTimer(o.AckTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case id := <-acks:
+			if id == m.ID {
+				return nil
+			}
+		case <-timeout.C:
+			return ErrNotDelivered
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SendStdin is the croc chat --send-stdin command: it sends standard input
+// to the room with SendOnce, taking the alias and peer timeout from flags.
+func SendStdin(cCtx *cli.Context, code string) error {
+	if err := requireE2E(cCtx.Bool("require-e2e")); err != nil {
+		return err
+	}
+	options := croc.Options{
+		SharedSecret:  code,
+		Debug:         cCtx.Bool("debug"),
+		RelayAddress:  cCtx.String("relay"),
+		RelayAddress6: cCtx.String("relay6"),
+		RelayPassword: cCtx.String("pass"),
+		IsChat:        true,
+		App:           tcp.ClientApp("croc-chat", cCtx.App.Version),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return SendOnce(ctx, options, os.Stdin, OneShot{
+		Alias:       cCtx.String("alias"),
+		PeerTimeout: cCtx.Duration("timeout"),
+	})
+}
+
+// waitForPeer pings the room until somebody answers.
+func waitForPeer(ctx context.Context, session *Session, pongs <-chan string, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	probe := time.NewTicker(oneShotProbeInterval)
+	defer probe.Stop()
+	nonces := make(map[string]bool)
+	for {
+		nonce := newMessageID()
+		nonces[nonce] = true
+		if err := session.Send(message.Message{Type: typePing, Message: nonce}); err != nil {
+			return err
+		}
+		for waiting := true; waiting; {
+			select {
+			case got := <-pongs:
+				if nonces[got] {
+					return nil
+				}
+			case <-probe.C:
+				waiting = false
+			case <-deadline.C:
+				return ErrNoPeer
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestSendOnce(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8423", "pass123", tcp.WithBanner("8424"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	options := croc.Options{
+		SharedSecret:  "1234-send-once",
+		RelayAddress:  "127.0.0.1:8423",
+		RelayPassword: "pass123",
+	}
+
+	// nobody in the room
+	err := SendOnce(context.Background(), options, strings.NewReader("hello"), OneShot{PeerTimeout: 500 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrNoPeer)
+
+	receiver, err := NewSession(context.Background(), options)
+	assert.Nil(t, err)
+	defer receiver.Close()
+	received := make(chan message.Message, 4)
+	receiver.Start(func(m message.Message) {
+		receiver.Answer(m)
+		if m.Type == "chat" || m.Type == "chatfile" {
+			received <- m
+		}
+	}, func(string) {})
+
+	err = SendOnce(context.Background(), options, strings.NewReader("hello"), OneShot{Alias: "bot"})
+	assert.Nil(t, err)
+	m := <-received
+	assert.Equal(t, message.Type("chat"), m.Type)
+	assert.Equal(t, "hello", m.Message)
+	assert.Equal(t, "bot", m.Alias)
+
+	// past the threshold the input arrives as a file
+	err = SendOnce(context.Background(), options, strings.NewReader("a longer line"), OneShot{Threshold: 4, FileName: "log.txt"})
+	assert.Nil(t, err)
+	m = <-received
+	assert.Equal(t, message.Type("chatfile"), m.Type)
+	assert.Equal(t, "log.txt", m.Message)
+	assert.Equal(t, []byte("a longer line"), m.Bytes)
+
+	err = SendOnce(context.Background(), options, strings.NewReader(""), OneShot{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// acceptRequest is a parsed /accept: which offer, and whether it is saved
+// to dir, written to stdout or piped into command.
+type acceptRequest struct {
+	id      string
+	dir     string
+	extract bool
+	stdout  bool
+	command []string
+}
+
+// parseAccept reads the arguments of /accept. The command given to
+// --exec is split into words like a shell would, so it has to be quoted
+// to hold spaces.
+func parseAccept(c commandArgs) (r acceptRequest, err error) {
+	r.extract = c.has("--extract")
+	r.stdout = c.has("--stdout")
+	if command, ok := c.option("--exec"); ok {
+		if r.command, err = shellWords(command); err != nil {
+			return r, usageErr("accept", fmt.Errorf("--exec: %w", err))
+		}
+		if len(r.command) == 0 {
+			return r, usageErr("accept", errors.New("--exec needs a command"))
+		}
+	}
+	piped := r.stdout || r.command != nil
+	switch {
+	case r.stdout && r.command != nil:
+		return r, errors.New("--stdout and --exec cannot be used together")
+	case piped && (r.extract || len(c.args) > 1):
+		return r, errors.New("a piped archive is not saved, so it takes no --extract or dir")
+	}
+	r.id = c.arg(0)
+	r.dir = c.arg(1)
+	return r, nil
+}
+
+// shellWords splits s into words at unquoted spaces. Single quotes keep
+// everything up to the next one; within double quotes and outside quotes
+// a backslash escapes the next character.
+func shellWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// countingWriter counts what is written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// pipe fetches an archive offer through t and writes it to w as it
+// arrives instead of saving it, calling done with how many bytes were
+// written. The sender goes no faster than w takes the archive. Its digest
+// can only be checked at the end, so done reports an archive that does not
+// match its offer after w has had it. Like fetch, pipe returns an error if
+// the fetch did not start.
+func (a *archiveOffers) pipe(t *transfers, prefix string, w io.Writer, done func(info archiveInfo, n int64, err error)) error {
+	m, info, err := a.take(prefix)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	counted := &countingWriter{w: io.MultiWriter(w, h)}
+	return t.fetchTo(m.Bytes, counted, info.Name, func(err error) {
+		if err == nil {
+			err = matchOffer(h.Sum(nil), info)
+		}
+		done(info, counted.n, err)
+	})
+}
+
+// pipeCommand runs argv with data on its stdin and returns its exit status.
+// The error is for a command that could not be run or was killed, not for
+// one that exited with a non-zero status.
+func pipeCommand(ctx context.Context, argv []string, data io.Reader, stdout, stderr io.Writer) (status int, err error) {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = data
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// children of a killed command can hold its output open
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// acceptPiped carries out an /accept with --stdout or --exec, fetching the
+// archive through t in the background. Stdout is only written when it is
+// not the terminal, and then the result goes to stderr so the stream stays
+// clean. The command reads the archive through a pipe as it arrives, at its
+// own pace, and its exit status is printed when it is done. A command that
+// exits without reading it all has the rest dropped.
+func acceptPiped(ctx context.Context, t *transfers, archives *archiveOffers, r acceptRequest, interactive bool) {
+	if r.stdout {
+		if interactive {
+			fmt.Println(localize(msgAcceptNeedsPipe))
+			return
+		}
+		err := archives.pipe(t, r.id, os.Stdout, func(info archiveInfo, n int64, err error) {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, localize(msgAcceptFailed, err))
+				return
+			}
+			fmt.Fprintln(os.Stderr, localize(msgAcceptPiped, info.Name, utils.ByteCountDecimal(n)))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, localize(msgAcceptFailed, err))
+		}
+		return
+	}
+	name := strings.Join(r.command, " ")
+	pr, pw := io.Pipe()
+	err := archives.pipe(t, r.id, pw, func(_ archiveInfo, _ int64, err error) {
+		// the command reads to the end of the archive, or to the error
+		pw.CloseWithError(err)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			fmt.Println(localize(msgAcceptFailed, err))
+		}
+	})
+	if err != nil {
+		fmt.Println(localize(msgAcceptFailed, err))
+		return
+	}
+	go func() {
+		status, err := pipeCommand(ctx, r.command, pr, os.Stdout, os.Stderr)
+		// what the command left unread fails to write rather than waiting
+		pr.Close()
+		if err != nil {
+			fmt.Println(localize(msgAcceptExecFailed, name, err))
+			return
+		}
+		fmt.Println(localize(msgAcceptExited, name, status))
+	}()
+}
@@ -0,0 +1,160 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellWords(t *testing.T) {
+	for s, want := range map[string][]string{
+		"tar xz -C /tmp":       {"tar", "xz", "-C", "/tmp"},
+		`  sh -c 'exit 3'  `:   {"sh", "-c", "exit 3"},
+		`a "b \"c\" d" e\ f`:   {"a", `b "c" d`, "e f"},
+		`'it''s' ""`:           {"its", ""},
+		`"tar xz -C /tmp" --x`: {"tar xz -C /tmp", "--x"},
+		"":                     nil,
+	} {
+		got, err := shellWords(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{`"open`, `'open`, `trailing\`} {
+		_, err := shellWords(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	r, err := parseAccept(mustParseCommand(t, `/accept ab12 --exec "tar xz -C /tmp"`))
+	assert.Nil(t, err)
+	assert.Equal(t, acceptRequest{id: "ab12", command: []string{"tar", "xz", "-C", "/tmp"}}, r)
+
+	r, err = parseAccept(mustParseCommand(t, `/accept ab12 --exec "sh -c 'exit 3'"`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sh", "-c", "exit 3"}, r.command)
+
+	r, err = parseAccept(mustParseCommand(t, "/accept --stdout ab12"))
+	assert.Nil(t, err)
+	assert.Equal(t, acceptRequest{id: "ab12", stdout: true}, r)
+
+	r, err = parseAccept(mustParseCommand(t, `/accept ab12 --extract "my files"`))
+	assert.Nil(t, err)
+	assert.Equal(t, acceptRequest{id: "ab12", dir: "my files", extract: true}, r)
+
+	for _, line := range []string{"/accept", "/accept --exec", "/accept a b c", "/accept ab12 --force"} {
+		_, err = parseCommand(line)
+		assert.ErrorIs(t, err, errUsage, line)
+	}
+	for _, line := range []string{`/accept ab12 --exec ""`, `/accept ab12 --exec "sh -c 'open"`} {
+		_, err = parseAccept(mustParseCommand(t, line))
+		assert.ErrorIs(t, err, errUsage, line)
+	}
+	for _, line := range []string{"/accept ab12 --stdout --exec cat", "/accept ab12 --stdout out", "/accept ab12 --exec cat --extract"} {
+		_, err = parseAccept(mustParseCommand(t, line))
+		if assert.NotNil(t, err, line) {
+			assert.NotErrorIs(t, err, errUsage, line)
+		}
+	}
+}
+
+func TestArchivePipe(t *testing.T) {
+	sender, receiver := testTransfers(t)
+	src := filepath.Join(t.TempDir(), "docs")
+	assert.Nil(t, os.MkdirAll(src, 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0o644))
+	offer := func(digest string) (m message.Message, archive []byte) {
+		path, info, err := newArchiveFile(src, archiveTar, func(string) {})
+		assert.Nil(t, err)
+		archive, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		if digest != "" {
+			info.SHA256 = digest
+		}
+		m, err = offerTestFile(sender, path, info)
+		assert.Nil(t, err)
+		m.ID = "abcdef"
+		return
+	}
+	type piped struct {
+		info archiveInfo
+		n    int64
+		err  error
+	}
+	offers := newArchiveOffers()
+	pipe := func(w io.Writer) piped {
+		result := make(chan piped, 1)
+		err := offers.pipe(receiver, "abc", w, func(info archiveInfo, n int64, err error) {
+			result <- piped{info, n, err}
+		})
+		if err != nil {
+			return piped{err: err}
+		}
+		select {
+		case p := <-result:
+			return p
+		case <-time.After(30 * time.Second):
+			t.Fatal("the archive did not arrive")
+		}
+		return piped{}
+	}
+
+	m, archive := offer("")
+	_, err := offers.received(m)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	p := pipe(&out)
+	assert.Nil(t, p.err)
+	assert.Equal(t, "docs", p.info.Name)
+	assert.Equal(t, int64(len(archive)), p.n)
+	assert.Equal(t, archive, out.Bytes())
+	// piping takes the offer like saving it does
+	assert.NotNil(t, pipe(&out).err)
+
+	m, _ = offer(strings.Repeat("0", 64))
+	_, err = offers.received(m)
+	assert.Nil(t, err)
+	out.Reset()
+	p = pipe(&out)
+	assert.ErrorContains(t, p.err, "does not match")
+	// the archive is only checked once it went through
+	assert.Equal(t, archive, out.Bytes())
+
+	// a reader that goes away fails the accept rather than holding it up
+	m, _ = offer("")
+	_, err = offers.received(m)
+	assert.Nil(t, err)
+	pr, pw := io.Pipe()
+	pr.Close()
+	p = pipe(pw)
+	assert.ErrorIs(t, p.err, io.ErrClosedPipe)
+	assert.Zero(t, p.n)
+}
+
+func TestPipeCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	var stdout, stderr bytes.Buffer
+	status, err := pipeCommand(context.Background(), []string{"/bin/sh", "-c", "wc -c; echo oops >&2"}, strings.NewReader("hello"), &stdout, &stderr)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "5", strings.TrimSpace(stdout.String()))
+	assert.Equal(t, "oops\n", stderr.String())
+
+	// a command that stops reading early still reports its status
+	status, err = pipeCommand(context.Background(), []string{"/bin/sh", "-c", "exit 3"}, bytes.NewReader(make([]byte, 1<<20)), &stdout, &stderr)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, status)
+
+	_, err = pipeCommand(context.Background(), []string{filepath.Join(t.TempDir(), "missing")}, strings.NewReader(""), &stdout, &stderr)
+	assert.NotNil(t, err)
+}
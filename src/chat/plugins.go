@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// commandsFileName is the external command config inside croc's config
+// directory.
+const commandsFileName = "chat_commands.json"
+
+// Limits of external commands.
+const (
+	// commandTimeout is how long an external command may run unless its
+	// config says otherwise.
+	commandTimeout = 10 * time.Second
+	// commandMaxOutput caps what an external command can send to the room.
+	commandMaxOutput = 4 * 1024
+)
+
+// CommandHandler runs a plugin slash command. args are the words typed
+// after the command, split like the arguments of built-in commands. An error is shown to the local user only; a handler
+// that wants to say something to the room sends it through s.
+type CommandHandler func(args []string, s *Session) error
+
+// RegisterCommand adds the slash command /name to the session. Built-in
+// commands always take precedence, so their names are refused, as is a
+// name that is already registered.
+func (s *Session) RegisterCommand(name string, handler CommandHandler) error {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || strings.ContainsAny(name, " \t/") {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	if handler == nil {
+		return fmt.Errorf("command /%s has no handler", name)
+	}
+	if _, ok := commandSpecs[name]; ok {
+		return fmt.Errorf("/%s is a built-in command", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.commands[name]; ok {
+		return fmt.Errorf("/%s is already registered", name)
+	}
+	if s.commands == nil {
+		s.commands = make(map[string]CommandHandler)
+	}
+	s.commands[name] = handler
+	return nil
+}
+
+// Commands returns the names of the registered plugin commands.
+func (s *Session) Commands() (names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	return
+}
+
+// runCommand runs the plugin command line starts with, if there is one.
+// It reports whether a plugin handled the line.
+func (s *Session) runCommand(line string) (handled bool, err error) {
+	name, args := commandName(line)
+	if name == "" {
+		return false, nil
+	}
+	s.mu.Lock()
+	handler, ok := s.commands[name]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	words, err := splitArgs(args)
+	if err != nil {
+		return true, err
+	}
+	return true, handler(words, s)
+}
+
+// ExternalCommand is a slash command backed by an executable. It is run
+// directly, without a shell, with Args followed by the words typed after
+// the command, and what it prints on stdout is sent to the room.
+type ExternalCommand struct {
+	Exec string   `json:"exec"`
+	Args []string `json:"args,omitempty"`
+	// Timeout is a duration such as "5s"; empty means commandTimeout.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// LoadCommands reads external commands from the JSON file at path, a map
+// from command name to ExternalCommand. A missing file means no commands.
+func LoadCommands(path string) (map[string]ExternalCommand, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var commands map[string]ExternalCommand
+	if err = json.Unmarshal(b, &commands); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	for name, c := range commands {
+		if c.Exec == "" {
+			return nil, fmt.Errorf("command /%s in %s has no exec", name, path)
+		}
+		if c.Timeout != "" {
+			if _, err = time.ParseDuration(c.Timeout); err != nil {
+				return nil, fmt.Errorf("command /%s in %s: %w", name, path, err)
+			}
+		}
+	}
+	return commands, nil
+}
+
+// DefaultCommandsPath returns the external command config in croc's config
+// directory.
+func DefaultCommandsPath() (string, error) {
+	configDir, err := utils.GetConfigDir(false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, commandsFileName), nil
+}
+
+// Handler returns a CommandHandler that runs c and sends its output to the
+// room as a chat message.
+func (c ExternalCommand) Handler() CommandHandler {
+	return func(args []string, s *Session) error {
+		out, err := c.run(s.ctx, args)
+		if err != nil {
+			return err
+		}
+		if out == "" {
+			return fmt.Errorf("%s printed nothing", c.Exec)
+		}
+		return s.Send(message.Message{Type: "chat", Message: out, ID: newMessageID()})
+	}
+}
+
+// run executes the command and returns its trimmed stdout. Output beyond
+// commandMaxOutput fails the command rather than being cut off mid-way.
+func (c ExternalCommand) run(ctx context.Context, args []string) (string, error) {
+	timeout := commandTimeout
+	if c.Timeout != "" {
+		timeout, _ = time.ParseDuration(c.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Exec, append(append([]string(nil), c.Args...), args...)...)
+	stdout := &cappedBuffer{limit: commandMaxOutput}
+	stderr := &cappedBuffer{limit: 256}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// children of a killed command can hold its output open
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s did not finish within %s", c.Exec, timeout)
+	}
+	if stdout.overflow {
+		return "", fmt.Errorf("%s printed more than %d bytes", c.Exec, commandMaxOutput)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", c.Exec, err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", c.Exec, err)
+	}
+	return strings.TrimSpace(stdout.buf.String()), nil
+}
+
+// cappedBuffer keeps the first limit bytes written to it and notes whether
+// there were more. It never fails a write, so the command is not killed by
+// a broken pipe before its exit status is known.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.overflow = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	s := &Session{}
+	var got []string
+	assert.Nil(t, s.RegisterCommand("/ticket", func(args []string, _ *Session) error {
+		got = args
+		return nil
+	}))
+	assert.NotNil(t, s.RegisterCommand("ticket", func([]string, *Session) error { return nil }))
+	assert.NotNil(t, s.RegisterCommand("sendfile", func([]string, *Session) error { return nil }))
+	assert.NotNil(t, s.RegisterCommand("two words", func([]string, *Session) error { return nil }))
+	assert.NotNil(t, s.RegisterCommand("nohandler", nil))
+	assert.Nil(t, s.RegisterCommand("fail", func([]string, *Session) error { return errors.New("boom") }))
+	assert.ElementsMatch(t, []string{"ticket", "fail"}, s.Commands())
+
+	handled, err := s.runCommand("/ticket  1234 urgent")
+	assert.True(t, handled)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1234", "urgent"}, got)
+	handled, err = s.runCommand("/fail")
+	assert.True(t, handled)
+	assert.EqualError(t, err, "boom")
+	for _, line := range []string{"/weather", "ticket 1", "hello"} {
+		handled, _ = s.runCommand(line)
+		assert.False(t, handled, line)
+	}
+}
+
+func TestLoadCommands(t *testing.T) {
+	dir := t.TempDir()
+	commands, err := LoadCommands(filepath.Join(dir, "missing.json"))
+	assert.Nil(t, err)
+	assert.Empty(t, commands)
+
+	path := filepath.Join(dir, "commands.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"weather": {"exec": "curl", "args": ["wttr.in"], "timeout": "5s"}}`), 0o644))
+	commands, err = LoadCommands(path)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]ExternalCommand{"weather": {Exec: "curl", Args: []string{"wttr.in"}, Timeout: "5s"}}, commands)
+
+	for _, bad := range []string{`{"x": {}}`, `{"x": {"exec": "a", "timeout": "soon"}}`, `[]`} {
+		assert.Nil(t, os.WriteFile(path, []byte(bad), 0o644))
+		_, err = LoadCommands(path)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestExternalCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	ctx := context.Background()
+	out, err := ExternalCommand{Exec: "sh", Args: []string{"-c", `echo "ticket $0"`}}.run(ctx, []string{"1234"})
+	assert.Nil(t, err)
+	assert.Equal(t, "ticket 1234", out)
+
+	_, err = ExternalCommand{Exec: "sh", Args: []string{"-c", "echo oops >&2; exit 3"}}.run(ctx, nil)
+	assert.ErrorContains(t, err, "oops")
+
+	_, err = ExternalCommand{Exec: "sh", Args: []string{"-c", "head -c 5000 /dev/zero"}}.run(ctx, nil)
+	assert.ErrorContains(t, err, "more than")
+
+	_, err = ExternalCommand{Exec: "sh", Args: []string{"-c", "sleep 5"}, Timeout: "100ms"}.run(ctx, nil)
+	assert.ErrorContains(t, err, "did not finish")
+}
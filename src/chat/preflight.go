@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/models"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+)
+
+// preflightTimeout bounds each probe of a relay before joining. A relay
+// slower than that to answer a ping is as good as down for a chat.
+const preflightTimeout = 5 * time.Second
+
+// PreflightError is returned by StartChat when no relay passed the check
+// run before joining. Its message says what to do about it.
+type PreflightError struct {
+	Address string
+	// Reachable is set when the relay answered a ping, so it is the
+	// handshake that failed.
+	Reachable bool
+	Err       error
+}
+
+func (e *PreflightError) Error() string {
+	if e.Reachable {
+		return localize(msgRelayHandshake, e.Address)
+	}
+	return localize(msgRelayUnreachable, e.Address)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// relayAddress returns address with the default relay port if it has
+// none.
+func relayAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, models.DEFAULT_PORT)
+}
+
+// preflight checks the relays of options before the session joins, so a
+// relay that is down or refuses the password is reported within seconds
+// rather than when the join times out. It tries RelayAddress, then
+// RelayAddress6, and returns the first that answers a ping and accepts
+// the password. When none does, the failure of a relay that answered is
+// reported over that of one that did not, as it is the more telling.
+func preflight(options croc.Options, timeout time.Duration) (string, error) {
+	var failed *PreflightError
+	for _, address := range []string{options.RelayAddress, options.RelayAddress6} {
+		if address == "" {
+			continue
+		}
+		address = relayAddress(address)
+		err := checkRelay(address, options.RelayPassword, timeout)
+		if err == nil {
+			return address, nil
+		}
+		log.Debugf("preflight of %s failed: %v", address, err.Err)
+		if failed == nil || (err.Reachable && !failed.Reachable) {
+			failed = err
+		}
+	}
+	if failed == nil {
+		return "", nil
+	}
+	return "", failed
+}
+
+// checkRelay pings the relay at address and runs a handshake with
+// password, each within timeout.
+func checkRelay(address, password string, timeout time.Duration) *PreflightError {
+	if err := within(timeout, func() error { return tcp.PingServer(address) }); err != nil {
+		return &PreflightError{Address: address, Err: err}
+	}
+	err := within(timeout, func() error {
+		_, err := tcp.MeasureRelay(address, password)
+		return err
+	})
+	if err != nil {
+		return &PreflightError{Address: address, Reachable: true, Err: err}
+	}
+	return nil
+}
+
+// within runs f, giving up on it after timeout. A probe given up on
+// finishes in the background; its connection is left to its own
+// deadline.
+func within(timeout time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no answer within %s", timeout)
+	}
+}
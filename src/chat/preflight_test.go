@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayAddress(t *testing.T) {
+	assert.Equal(t, "croc.schollz.com:9009", relayAddress("croc.schollz.com"))
+	assert.Equal(t, "1.2.3.4:9010", relayAddress("1.2.3.4:9010"))
+	assert.Equal(t, "[::1]:9009", relayAddress("::1"))
+}
+
+func TestPreflight(t *testing.T) {
+	log.SetLevel("error")
+	setLanguage("en")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	relay := l.Addr().String()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	down := closed.Addr().String()
+	closed.Close()
+
+	address, err := preflight(croc.Options{RelayAddress: relay, RelayPassword: "pass123"}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, relay, address)
+
+	var pe *PreflightError
+	_, err = preflight(croc.Options{RelayAddress: down, RelayPassword: "pass123"}, time.Second)
+	if assert.True(t, errors.As(err, &pe)) {
+		assert.False(t, pe.Reachable)
+		assert.Equal(t, "relay "+down+" unreachable — check firewall or use --relay", err.Error())
+	}
+
+	_, err = preflight(croc.Options{RelayAddress: relay, RelayPassword: "wrong"}, time.Second)
+	if assert.True(t, errors.As(err, &pe)) {
+		assert.True(t, pe.Reachable)
+		assert.Equal(t, "relay "+relay+" reachable but handshake failed — likely wrong --pass", err.Error())
+	}
+
+	// the second relay stands in for the first
+	address, err = preflight(croc.Options{RelayAddress: down, RelayAddress6: relay, RelayPassword: "pass123"}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, relay, address)
+
+	// a relay that answered says more than one that did not
+	_, err = preflight(croc.Options{RelayAddress: down, RelayAddress6: relay, RelayPassword: "wrong"}, time.Second)
+	if assert.True(t, errors.As(err, &pe)) {
+		assert.True(t, pe.Reachable)
+		assert.Equal(t, relay, pe.Address)
+	}
+}
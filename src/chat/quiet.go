@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// quietFileName is the quiet hours config inside croc's config directory.
+const quietFileName = "chat_quiet.json"
+
+// bell is written to the terminal to alert the user to a message.
+const bell = "\a"
+
+// quietHours is a daily range of wall-clock time during which alerts are
+// muted. The range may cross midnight, as in 22:00-07:00, and is read on
+// the clock of its time zone, so it follows daylight saving time.
+type quietHours struct {
+	// start and end are minutes after midnight; end is excluded.
+	start, end int
+	loc        *time.Location
+}
+
+// parseQuietHours parses "HH:MM-HH:MM" optionally followed by an IANA time
+// zone such as Europe/Berlin. Without one the local time zone applies.
+func parseQuietHours(s string) (q quietHours, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return q, fmt.Errorf("usage: /quiet HH:MM-HH:MM [time zone]")
+	}
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return q, fmt.Errorf("invalid quiet hours '%s', use HH:MM-HH:MM", fields[0])
+	}
+	for _, part := range []struct {
+		s   string
+		min *int
+	}{{from, &q.start}, {to, &q.end}} {
+		t, errParse := time.Parse("15:04", part.s)
+		if errParse != nil {
+			return q, fmt.Errorf("invalid time '%s', use HH:MM", part.s)
+		}
+		*part.min = t.Hour()*60 + t.Minute()
+	}
+	if q.start == q.end {
+		return q, fmt.Errorf("quiet hours %s start and end at the same time", fields[0])
+	}
+	q.loc = time.Local
+	if len(fields) == 2 {
+		if q.loc, err = time.LoadLocation(fields[1]); err != nil {
+			return q, fmt.Errorf("unknown time zone '%s'", fields[1])
+		}
+	}
+	return q, nil
+}
+
+// contains reports whether t falls within the quiet hours.
+func (q quietHours) contains(t time.Time) bool {
+	t = t.In(q.loc)
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+func (q quietHours) String() string {
+	s := fmt.Sprintf("%02d:%02d-%02d:%02d", q.start/60, q.start%60, q.end/60, q.end%60)
+	if q.loc != time.Local {
+		s += " " + q.loc.String()
+	}
+	return s
+}
+
+// quietConfig is the quiet hours config file, for example
+// {"hours": "22:00-07:00", "timezone": "Europe/Berlin"}.
+type quietConfig struct {
+	Hours    string `json:"hours"`
+	TimeZone string `json:"timezone,omitempty"`
+}
+
+// loadQuietHours reads quiet hours from the config file at path. A missing
+// file or empty hours mean there are none.
+func loadQuietHours(path string) (*quietHours, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config quietConfig
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if config.Hours == "" {
+		return nil, nil
+	}
+	q, err := parseQuietHours(strings.TrimSpace(config.Hours + " " + config.TimeZone))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &q, nil
+}
+
+// defaultQuietPath returns the quiet hours config in croc's config
+// directory.
+func defaultQuietPath() (string, error) {
+	configDir, err := utils.GetConfigDir(false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, quietFileName), nil
+}
+
+// alerter decides which incoming messages ring the bell. During quiet
+// hours messages are still shown and recorded, only the bell is muted;
+// with urgentMentions a message naming the local alias rings anyway.
+type alerter struct {
+	mu             sync.Mutex
+	bell           bool
+	urgentMentions bool
+	quiet          *quietHours
+	now            func() time.Time
+}
+
+// shouldAlert reports whether a message with the given text should ring
+// the bell for a user going by alias.
+func (a *alerter) shouldAlert(text, alias string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.bell {
+		return false
+	}
+	if a.quiet == nil || !a.quiet.contains(a.now()) {
+		return true
+	}
+	return a.urgentMentions && mentions(text, alias)
+}
+
+// setQuiet replaces the quiet hours; nil turns them off.
+func (a *alerter) setQuiet(q *quietHours) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.quiet = q
+}
+
+func (a *alerter) quietHours() *quietHours {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.quiet
+}
+
+// mentions reports whether text names alias as a word of its own, with or
+// without a leading @, ignoring case.
+func mentions(text, alias string) bool {
+	if alias == "" {
+		return false
+	}
+	text, alias = strings.ToLower(text), strings.ToLower(alias)
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for i := 0; ; {
+		j := strings.Index(text[i:], alias)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(alias)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !isWord(before) && !isWord(after) {
+			return true
+		}
+		i = start + 1
+	}
+}
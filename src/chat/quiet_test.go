@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuietHoursAcrossMidnight(t *testing.T) {
+	utc, err := parseQuietHours("22:00-07:00 UTC")
+	assert.Nil(t, err)
+	assert.Equal(t, "22:00-07:00 UTC", utc.String())
+	day := time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		at    string
+		quiet bool
+	}{
+		{"21:59", false}, {"22:00", true}, {"23:59", true}, {"00:00", true},
+		{"03:00", true}, {"06:59", true}, {"07:00", false}, {"12:00", false},
+	} {
+		clock, _ := time.Parse("15:04", tc.at)
+		at := day.Add(time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute)
+		assert.Equal(t, tc.quiet, utc.contains(at), tc.at)
+	}
+
+	// a range within one day
+	lunch, err := parseQuietHours("12:00-13:30 UTC")
+	assert.Nil(t, err)
+	assert.False(t, lunch.contains(day.Add(11*time.Hour+59*time.Minute)))
+	assert.True(t, lunch.contains(day.Add(13*time.Hour+29*time.Minute)))
+	assert.False(t, lunch.contains(day.Add(13*time.Hour+30*time.Minute)))
+	assert.False(t, lunch.contains(day.Add(-time.Minute)))
+}
+
+func TestQuietHoursTimeZone(t *testing.T) {
+	q, err := parseQuietHours("22:00-07:00 America/New_York")
+	assert.Nil(t, err)
+	// 03:00 UTC is 22:00 the evening before in New York (EST)
+	assert.True(t, q.contains(time.Date(2026, 1, 15, 3, 0, 0, 0, time.UTC)))
+	assert.False(t, q.contains(time.Date(2026, 1, 15, 2, 59, 0, 0, time.UTC)))
+	// in summer (EDT) the same wall clock range is an hour earlier in UTC
+	assert.True(t, q.contains(time.Date(2026, 7, 15, 2, 0, 0, 0, time.UTC)))
+	assert.False(t, q.contains(time.Date(2026, 7, 15, 11, 0, 0, 0, time.UTC)))
+	// on the night clocks go forward, 01:59 EST is followed by 03:00 EDT
+	assert.True(t, q.contains(time.Date(2026, 3, 8, 6, 59, 0, 0, time.UTC)))
+	assert.True(t, q.contains(time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC)))
+	assert.False(t, q.contains(time.Date(2026, 3, 8, 11, 0, 0, 0, time.UTC)))
+
+	local, err := parseQuietHours("22:00-07:00")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Local, local.loc)
+	assert.Equal(t, "22:00-07:00", local.String())
+
+	for _, bad := range []string{"", "22:00", "22-07", "25:00-07:00", "22:00-07:00 Mars/Olympus", "08:00-08:00", "1:00-2:00 UTC extra"} {
+		_, err := parseQuietHours(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestLoadQuietHours(t *testing.T) {
+	dir := t.TempDir()
+	q, err := loadQuietHours(filepath.Join(dir, "missing.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, q)
+
+	path := filepath.Join(dir, quietFileName)
+	assert.Nil(t, os.WriteFile(path, []byte(`{"hours": "23:30-06:15", "timezone": "Europe/Berlin"}`), 0o600))
+	q, err = loadQuietHours(path)
+	assert.Nil(t, err)
+	if assert.NotNil(t, q) {
+		assert.Equal(t, "23:30-06:15 Europe/Berlin", q.String())
+	}
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"hours": ""}`), 0o600))
+	q, err = loadQuietHours(path)
+	assert.Nil(t, err)
+	assert.Nil(t, q)
+
+	assert.Nil(t, os.WriteFile(path, []byte(`{"hours": "23:30-06:15", "timezone": "Nowhere/Special"}`), 0o600))
+	_, err = loadQuietHours(path)
+	assert.NotNil(t, err)
+}
+
+func TestAlerter(t *testing.T) {
+	q, _ := parseQuietHours("22:00-07:00 UTC")
+	now := time.Date(2026, 3, 14, 3, 0, 0, 0, time.UTC)
+	a := &alerter{bell: true, quiet: &q, now: func() time.Time { return now }}
+
+	assert.False(t, a.shouldAlert("hi", "bob"), "quiet at 3am")
+	assert.False(t, a.shouldAlert("@bob wake up", "bob"), "mentions only ring with urgent mentions")
+	a.urgentMentions = true
+	assert.True(t, a.shouldAlert("@bob wake up", "bob"))
+	assert.False(t, a.shouldAlert("bobcat spotted", "bob"))
+
+	now = now.Add(5 * time.Hour)
+	assert.True(t, a.shouldAlert("good morning", "bob"))
+	a.setQuiet(nil)
+	now = now.Add(-5 * time.Hour)
+	assert.True(t, a.shouldAlert("hi", "bob"))
+
+	// without the bell nothing rings, quiet hours or not
+	a.bell = false
+	assert.False(t, a.shouldAlert("@bob", "bob"))
+}
+
+func TestMentions(t *testing.T) {
+	for _, tc := range []struct {
+		text, alias string
+		want        bool
+	}{
+		{"hey @Bob, look", "bob", true},
+		{"Bob?", "Bob", true},
+		{"ask bob", "bob", true},
+		{"bobcat and kabob", "bob", false},
+		{"kabob, then bob", "bob", true},
+		{"Jürgen!", "jürgen", true},
+		{"Jürgens", "jürgen", false},
+		{"anything", "", false},
+	} {
+		assert.Equal(t, tc.want, mentions(tc.text, tc.alias), tc.text)
+	}
+}
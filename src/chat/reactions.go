@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// typeReaction reacts to an earlier chat message. ID is the id of that
+// message and Message the reaction, an emoji. A session has one reaction
+// per message, so a newer one replaces the one it sent before.
+const typeReaction message.Type = "chat_reaction"
+
+// maxReactionLength bounds a reaction in runes, enough for emoji made of
+// several code points such as flags and skin tones.
+const maxReactionLength = 8
+
+// reactionExcerpt is how much of a message a reaction shown on its own
+// line quotes.
+const reactionExcerpt = 30
+
+// namedReactions stand in for emoji on terminals that cannot type them.
+var namedReactions = map[string]string{
+	"like":    "👍",
+	"dislike": "👎",
+	"love":    "❤",
+	"laugh":   "😂",
+	"wow":     "😮",
+	"sad":     "😢",
+	"party":   "🎉",
+}
+
+var errDeletedReaction = errors.New("message was deleted")
+
+// reaction is the reaction of one session to a message.
+type reaction struct {
+	Session string
+	Alias   string
+	Emoji   string
+}
+
+// reactor tells apart the sessions reacting to a message by their session
+// id, or by alias for peers that do not sign.
+func reactor(m message.Message) string {
+	if m.Session != "" {
+		return m.Session
+	}
+	return "alias:" + m.Alias
+}
+
+// validReaction reports whether r looks like an emoji: short, and made of
+// neither ASCII, spaces nor control characters, so that reactions cannot
+// carry text.
+func validReaction(r string) bool {
+	if r == "" || utf8.RuneCountInString(r) > maxReactionLength {
+		return false
+	}
+	return strings.IndexFunc(r, func(c rune) bool {
+		return c < utf8.RuneSelf || unicode.IsSpace(c) || unicode.IsControl(c)
+	}) < 0
+}
+
+// parseReaction returns the emoji of a named reaction, or r itself if it
+// is an emoji.
+func parseReaction(r string) (string, error) {
+	if emoji, ok := namedReactions[strings.ToLower(r)]; ok {
+		return emoji, nil
+	}
+	if !validReaction(r) {
+		names := make([]string, 0, len(namedReactions))
+		for name := range namedReactions {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return "", fmt.Errorf("unknown reaction %q, use an emoji or one of %s", r, strings.Join(names, ", "))
+	}
+	return r, nil
+}
+
+// addReaction returns rs with r in place of the earlier reaction of the
+// same session. rs is left as it is, so entries handed out keep theirs.
+func addReaction(rs []reaction, r reaction) []reaction {
+	out := make([]reaction, 0, len(rs)+1)
+	for _, old := range rs {
+		if old.Session != r.Session {
+			out = append(out, old)
+		}
+	}
+	return append(out, r)
+}
+
+// reactionSummary counts the reactions by emoji, in the order the emoji
+// were first used, as in "[👍2 ❤1]". It is empty without reactions.
+func reactionSummary(rs []reaction) string {
+	if len(rs) == 0 {
+		return ""
+	}
+	var order []string
+	counts := make(map[string]int)
+	for _, r := range rs {
+		if counts[r.Emoji] == 0 {
+			order = append(order, r.Emoji)
+		}
+		counts[r.Emoji]++
+	}
+	parts := make([]string, len(order))
+	for i, emoji := range order {
+		parts[i] = fmt.Sprintf("%s%d", emoji, counts[emoji])
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// excerpt shortens text to quote it after a reaction.
+func excerpt(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= reactionExcerpt {
+		return text
+	}
+	return truncateRunes(text, reactionExcerpt) + "…"
+}
+
+// react records m, a reaction, on the message it refers to and returns
+// that message with its reactions. Reactions to messages never seen or
+// already withdrawn are refused.
+func (sb *scrollback) react(m message.Message) (scrollEntry, error) {
+	if sb == nil {
+		return scrollEntry{}, errNotInScrollback
+	}
+	if !validReaction(m.Message) {
+		return scrollEntry{}, fmt.Errorf("invalid reaction %q", m.Message)
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	i := len(sb.entries) - 1
+	for ; i >= 0 && sb.entries[i].ID != m.ID; i-- {
+	}
+	if i < 0 {
+		return scrollEntry{}, errNotInScrollback
+	}
+	e := &sb.entries[i]
+	if e.Deleted || e.Expired {
+		return scrollEntry{}, errDeletedReaction
+	}
+	e.Reactions = addReaction(e.Reactions, reaction{Session: reactor(m), Alias: m.Alias, Emoji: m.Message})
+	return *e, nil
+}
+
+// findAny resolves an id prefix to any message that can still be reacted
+// to, or lastMessage to the newest one a peer sent.
+func (sb *scrollback) findAny(ref string) (scrollEntry, error) {
+	var entries []scrollEntry
+	if sb != nil {
+		sb.mu.Lock()
+		for _, e := range sb.entries {
+			if !e.Deleted && !e.Expired && (ref != lastMessage || !e.Own) {
+				entries = append(entries, e)
+			}
+		}
+		sb.mu.Unlock()
+	}
+	return pickEntry(entries, ref)
+}
+
+// react attaches a reaction to the message with the given id in the
+// transcript, replacing the earlier one of the same session. Reactions are
+// kept out of the integrity chain, since a later one replaces them, and so
+// are not covered by a signed export.
+func (t *transcript) react(m message.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		if e := &t.entries[i]; e.ID == m.ID && (e.Type == "chat" || e.Type == typeEmote) {
+			e.Reactions = addReaction(e.Reactions, reaction{Session: reactor(m), Alias: m.Alias, Emoji: m.Message})
+			return
+		}
+	}
+}
+
+// React reacts to a recent message, given by an id prefix or "last" for
+// the newest one a peer sent, with an emoji or one of the named
+// reactions. It returns the message with its reactions.
+func (s *Session) React(ref, r string) (e scrollEntry, err error) {
+	emoji, err := parseReaction(r)
+	if err != nil {
+		return
+	}
+	if e, err = s.scrollback.findAny(ref); err != nil {
+		return
+	}
+	m := message.Message{Type: typeReaction, ID: e.ID, Message: emoji, Alias: s.Alias(), Session: sessionID(s.key)}
+	if err = s.Send(m); err != nil {
+		return
+	}
+	s.transcript.react(m)
+	return s.scrollback.react(m)
+}
@@ -0,0 +1,168 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestParseReaction(t *testing.T) {
+	for in, want := range map[string]string{"like": "👍", "Love": "❤", "🎉": "🎉", "👍🏽": "👍🏽", "🇩🇪": "🇩🇪"} {
+		got, err := parseReaction(in)
+		assert.Nil(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range []string{"", "lol", "👍 ok", "👍\n", "🎉🎉🎉🎉🎉🎉🎉🎉🎉"} {
+		_, err := parseReaction(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestScrollbackReact(t *testing.T) {
+	sb := &scrollback{}
+	sb.add(scrollEntry{ID: "a1", Text: "hello"})
+	sb.add(scrollEntry{ID: "a2", Text: "gone", Deleted: true})
+	react := func(session, alias, emoji string) (scrollEntry, error) {
+		return sb.react(message.Message{Type: typeReaction, ID: "a1", Message: emoji, Session: session, Alias: alias})
+	}
+
+	_, err := react("bob", "bob", "👍")
+	assert.Nil(t, err)
+	_, err = react("carol", "carol", "❤")
+	assert.Nil(t, err)
+	before, _ := sb.get("a1")
+	e, err := react("dave", "dave", "👍")
+	assert.Nil(t, err)
+	assert.Equal(t, "[👍2 ❤1]", reactionSummary(e.Reactions))
+	// a newer reaction replaces the earlier one of the same session
+	e, err = react("bob", "bob", "❤")
+	assert.Nil(t, err)
+	assert.Equal(t, "[❤2 👍1]", reactionSummary(e.Reactions))
+	assert.Len(t, before.Reactions, 2, "entries handed out keep their reactions")
+	// peers that do not sign are told apart by alias
+	_, err = react("", "eve", "🎉")
+	assert.Nil(t, err)
+	e, err = react("", "eve", "😮")
+	assert.Nil(t, err)
+	assert.Equal(t, "[❤2 👍1 😮1]", reactionSummary(e.Reactions))
+
+	_, err = react("bob", "bob", "spam")
+	assert.Error(t, err)
+	_, err = sb.react(message.Message{Type: typeReaction, ID: "a2", Message: "👍", Session: "bob"})
+	assert.ErrorIs(t, err, errDeletedReaction)
+	_, err = sb.react(message.Message{Type: typeReaction, ID: "nope", Message: "👍", Session: "bob"})
+	assert.ErrorIs(t, err, errNotInScrollback)
+	assert.Empty(t, reactionSummary(nil))
+}
+
+func TestFindAny(t *testing.T) {
+	sb := &scrollback{}
+	sb.add(scrollEntry{ID: "b1", Text: "from bob"})
+	sb.add(scrollEntry{ID: "a1", Text: "mine", Own: true})
+	e, err := sb.findAny(lastMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", e.ID, "last is the newest message of a peer")
+	e, err = sb.findAny("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "a1", e.ID)
+	_, err = sb.findAny("c")
+	assert.ErrorIs(t, err, errNotInScrollback)
+}
+
+func TestGroupedConsoleReact(t *testing.T) {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(false)
+	var out bytes.Buffer
+	c := newGroupedConsole(newRenderer(newPlainConsole(strings.NewReader(""), &out)), false)
+	now := time.Now()
+	c.writeChat("m1", "alice", "hello", now)
+	assert.False(t, c.react("m1", "[👍1]"), "no width, no terminal")
+
+	c.width = func() int { return 80 }
+	assert.True(t, c.react("m1", "[👍1]"))
+	assert.True(t, strings.HasSuffix(out.String(), "\x1b[1A\r\x1b[2K"+c.lastLine+" [👍1]\n"))
+	assert.False(t, c.react("m0", "[👍1]"), "not the last message")
+	c.width = func() int { return 10 }
+	assert.False(t, c.react("m1", "[👍1]"), "does not fit")
+
+	c.width = func() int { return 80 }
+	c.Write([]byte("\nalice left\n"))
+	assert.False(t, c.react("m1", "[👍1]"), "written over")
+}
+
+func TestDNDFoldsReactions(t *testing.T) {
+	d := &dndBuffer{}
+	d.enable()
+	assert.True(t, d.hold(message.Message{Type: typeReaction, ID: "m1", Message: "👍", Session: "bob"}))
+	assert.True(t, d.hold(message.Message{Type: typeReaction, ID: "m1", Message: "❤", Session: "carol"}))
+	assert.True(t, d.hold(message.Message{Type: typeReaction, ID: "m1", Message: "😂", Session: "bob"}))
+	d.release(func(messages []message.Message, dropped int) {
+		if assert.Len(t, messages, 2) {
+			assert.Equal(t, "❤", messages[0].Message)
+			assert.Equal(t, "😂", messages[1].Message)
+		}
+	})
+}
+
+func TestSessionReact(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8442", "pass123", tcp.WithBanner("8443"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-session-react", RelayAddress: "127.0.0.1:8442", RelayPassword: "pass123"}
+	var sessions []*Session
+	for i := 0; i < 2; i++ {
+		s, err := NewSession(context.Background(), options)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer s.Close()
+		sessions = append(sessions, s)
+	}
+	alice, bob := sessions[0], sessions[1]
+	received := make(chan message.Message, 10)
+	alice.Start(func(m message.Message) { received <- m }, func(string) {})
+	bob.Start(func(message.Message) {}, func(string) {})
+	next := func() message.Message {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not delivered")
+		}
+		return message.Message{}
+	}
+
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "lunch?", Alias: "alice"}))
+	assert.Eventually(t, func() bool {
+		_, err := bob.scrollback.findAny(lastMessage)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err := bob.React(lastMessage, "like")
+	assert.Nil(t, err)
+	m := next()
+	assert.Equal(t, typeReaction, m.Type)
+	e, err := bob.React(lastMessage, "party")
+	assert.Nil(t, err)
+	assert.Equal(t, "[🎉1]", reactionSummary(e.Reactions))
+	next()
+	e, _ = alice.scrollback.get(m.ID)
+	assert.Equal(t, "[🎉1]", reactionSummary(e.Reactions), "bob's second reaction replaces his first")
+
+	var buf bytes.Buffer
+	assert.Nil(t, alice.transcript.write(&buf, false))
+	assert.Contains(t, buf.String(), "lunch? [🎉1]")
+	aliceHead, n := alice.Integrity()
+	bobHead, _ := bob.Integrity()
+	assert.Equal(t, aliceHead, bobHead)
+	assert.Equal(t, 1, n, "reactions stay out of the chain")
+}
@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/chzyer/readline"
+)
+
+// layout is how the chat arranges the lines it shows.
+type layout string
+
+const (
+	// layoutInline shows every line in the order it arrives.
+	layoutInline layout = "inline"
+	// layoutSplit scrolls only the conversation and keeps the latest
+	// status lines in a single row above the prompt.
+	layoutSplit layout = "split"
+)
+
+// parseLayout parses the argument of /layout.
+func parseLayout(s string) (layout, bool) {
+	switch l := layout(strings.ToLower(strings.TrimSpace(s))); l {
+	case layoutInline, layoutSplit:
+		return l, true
+	}
+	return "", false
+}
+
+// statusLines is how many of the latest status lines the status row of
+// the split layout shows.
+const statusLines = 3
+
+// lineKind is what a line the chat shows is about.
+type lineKind string
+
+const (
+	lineChat     lineKind = "chat"
+	lineEmote    lineKind = "emote"
+	lineEdit     lineKind = "edit"
+	lineDelete   lineKind = "delete"
+	lineFile     lineKind = "file"
+	lineReaction lineKind = "reaction"
+	// lineSession is what the session reports: peers joining and
+	// leaving, reconnects and the like.
+	lineSession  lineKind = "session"
+	lineTransfer lineKind = "transfer"
+	lineWarning  lineKind = "warning"
+	linePong     lineKind = "pong"
+	linePreview  lineKind = "preview"
+	lineUnknown  lineKind = "unknown"
+)
+
+// lineClass is where the split layout shows a line.
+type lineClass int
+
+const (
+	// classConversation lines scroll in the main area.
+	classConversation lineClass = iota
+	// classStatus lines go to the status row.
+	classStatus
+)
+
+// lineClasses sorts every kind of line. A kind missing here is shown as
+// conversation, so nothing new goes unseen in the status row.
+var lineClasses = map[lineKind]lineClass{
+	lineChat:     classConversation,
+	lineEmote:    classConversation,
+	lineEdit:     classConversation,
+	lineDelete:   classConversation,
+	lineFile:     classConversation,
+	lineReaction: classStatus,
+	lineSession:  classStatus,
+	lineTransfer: classStatus,
+	lineWarning:  classStatus,
+	linePong:     classStatus,
+	linePreview:  classStatus,
+	lineUnknown:  classStatus,
+}
+
+// eraseUp moves to the start of the row above and clears it.
+const eraseUp = "\x1b[1A\r\x1b[2K"
+
+// renderer is what the chat writes through. In the inline layout it shows
+// lines as they come; in the split layout status lines are folded into a
+// status row that stays right above the prompt, moving down as the
+// conversation scrolls. Writes of bytes as they are, like questions
+// waiting for an answer and control sequences, go out unchanged in either
+// layout.
+type renderer struct {
+	console
+	// width returns the width of the terminal, which the split layout and
+	// rewriting lines in place need; nil means there is no terminal.
+	width func() int
+
+	mu     sync.Mutex
+	layout layout
+	status []string
+	// statusShown says the status row is the last row written, so it can
+	// be written over.
+	statusShown bool
+}
+
+func newRenderer(c console) *renderer {
+	return &renderer{console: c, layout: layoutInline}
+}
+
+// Readline reads a line, which the terminal shows below the status row.
+func (r *renderer) Readline() (string, error) {
+	line, err := r.console.Readline()
+	r.mu.Lock()
+	r.statusShown = false
+	r.mu.Unlock()
+	return line, err
+}
+
+// Write writes b as it is.
+func (r *renderer) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if visible(b) {
+		r.statusShown = false
+	}
+	return r.console.Write(b)
+}
+
+// setLayout switches to l and reports whether it could; the split layout
+// takes a terminal.
+func (r *renderer) setLayout(l layout) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l == layoutSplit && r.width == nil {
+		return false
+	}
+	r.layout, r.status, r.statusShown = l, nil, false
+	return true
+}
+
+// currentLayout returns the layout in use.
+func (r *renderer) currentLayout() layout {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.layout
+}
+
+// inMain reports whether lines of kind scroll in the main area.
+func (r *renderer) inMain(kind lineKind) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.layout != layoutSplit || lineClasses[kind] == classConversation
+}
+
+// line shows text, a line of the given kind.
+func (r *renderer) line(kind lineKind, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.layout != layoutSplit {
+		r.console.Write([]byte("\n" + text + "\n"))
+		return
+	}
+	if lineClasses[kind] == classStatus {
+		r.status = append(r.status, text)
+		if len(r.status) > statusLines {
+			r.status = r.status[len(r.status)-statusLines:]
+		}
+		// right below what was shown last, or over the status shown there
+		out := r.statusRow() + "\n"
+		if r.statusShown {
+			out = eraseUp + r.statusRow() + "\n"
+		}
+		r.console.Write([]byte(out))
+		r.statusShown = true
+		return
+	}
+	// the row of the status becomes the gap before the line, and the
+	// status goes below it again
+	out := "\n" + text + "\n"
+	if r.statusShown {
+		out = eraseUp + out
+	}
+	if len(r.status) > 0 {
+		out += r.statusRow() + "\n"
+		r.statusShown = true
+	}
+	r.console.Write([]byte(out))
+}
+
+// rewrite writes line over the last line of the conversation, which must
+// have been the last line shown in the main area.
+func (r *renderer) rewrite(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.statusShown {
+		r.console.Write([]byte("\x1b[2A\r\x1b[2K" + line + "\n\r\x1b[2K" + r.statusRow() + "\n"))
+		return
+	}
+	r.console.Write([]byte(eraseUp + line + "\n"))
+}
+
+// statusRow returns the status lines as one row that fits the terminal,
+// dropping the start of the oldest when they do not.
+func (r *renderer) statusRow() string {
+	parts := make([]string, 0, len(r.status))
+	for _, s := range r.status {
+		parts = append(parts, strings.Join(strings.Fields(stripANSI(s)), " "))
+	}
+	row := []rune(strings.Join(parts, " · "))
+	max := r.width() - 1
+	var runes readline.Runes
+	if runes.WidthAll(row) > max {
+		for len(row) > 0 && runes.WidthAll(row)+1 > max {
+			row = row[1:]
+		}
+		row = append([]rune("…"), row...)
+	}
+	return colorText(string(row), MagentaColor)
+}
+
+// visible reports whether writing b shows anything, unlike title updates
+// and the bell.
+func visible(b []byte) bool {
+	return strings.Trim(stripANSI(string(b)), " \t\r\n"+bell) != ""
+}
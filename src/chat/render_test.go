@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineClasses(t *testing.T) {
+	for kind, want := range map[lineKind]lineClass{
+		lineChat:     classConversation,
+		lineEmote:    classConversation,
+		lineEdit:     classConversation,
+		lineDelete:   classConversation,
+		lineFile:     classConversation,
+		lineReaction: classStatus,
+		lineSession:  classStatus,
+		lineTransfer: classStatus,
+		lineWarning:  classStatus,
+		linePong:     classStatus,
+		linePreview:  classStatus,
+		lineUnknown:  classStatus,
+	} {
+		got, ok := lineClasses[kind]
+		assert.True(t, ok, kind)
+		assert.Equal(t, want, got, kind)
+	}
+	assert.Equal(t, classConversation, lineClasses["something new"], "unsorted lines stay in sight")
+}
+
+func TestParseLayout(t *testing.T) {
+	for in, want := range map[string]layout{"split": layoutSplit, " Inline ": layoutInline} {
+		got, ok := parseLayout(in)
+		assert.True(t, ok, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, ok := parseLayout("columns")
+	assert.False(t, ok)
+	assert.False(t, newRenderer(newPlainConsole(strings.NewReader(""), &bytes.Buffer{})).setLayout(layoutSplit), "split takes a terminal")
+}
+
+func TestSplitLayout(t *testing.T) {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(false)
+	var out bytes.Buffer
+	r := newRenderer(newPlainConsole(strings.NewReader(""), &out))
+	r.width = func() int { return 40 }
+	assert.True(t, r.setLayout(layoutSplit))
+	c := newGroupedConsole(r, false)
+	at := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+
+	c.writeChat("m1", "bob", "hi", at)
+	c.line(lineSession, "alice joined")
+	// a status line neither breaks the group nor stays in the way
+	c.writeChat("m2", "bob", "there", at.Add(time.Second))
+	c.line(lineTransfer, "notes.txt 50%")
+	c.line(lineTransfer, "notes.txt 100%")
+	c.line(lineWarning, "the relay is slow to answer")
+	assert.True(t, c.react("m2", "[👍1]"))
+	c.line(lineEmote, "* alice waves")
+
+	header := timestampAt(at) + " [bob]: "
+	indent := strings.Repeat(" ", len(header))
+	want := "\n" + header + "hi\n" +
+		"alice joined\n" +
+		eraseUp + "\n" + indent + "there\n" + "alice joined\n" +
+		eraseUp + "alice joined · notes.txt 50%\n" +
+		eraseUp + "…oined · notes.txt 50% · notes.txt 100%\n" +
+		eraseUp + "…txt 100% · the relay is slow to answer\n"
+	assert.Equal(t, want, out.String()[:len(want)])
+	// only the latest few are kept
+	assert.Equal(t, []string{"notes.txt 50%", "notes.txt 100%", "the relay is slow to answer"}, r.status)
+	assert.True(t, strings.HasSuffix(out.String(), eraseUp+"\n* alice waves\n"+r.statusRow()+"\n"))
+	assert.Contains(t, out.String(), "\x1b[2A\r\x1b[2K"+indent+"there [👍1]\n\r\x1b[2K")
+
+	// back inline, status lines are shown where they arrive
+	assert.True(t, r.setLayout(layoutInline))
+	out.Reset()
+	c.line(lineSession, "alice left")
+	assert.Equal(t, "\nalice left\n", out.String())
+}
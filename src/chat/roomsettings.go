@@ -0,0 +1,306 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/cli/v2"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+)
+
+// typeRoomSettings negotiates how the room behaves. Message is the kind of
+// negotiation message and Meta, unless the kind is settingsAccept, a
+// RoomSettings document.
+//
+// The session that opened the room, which the relay tells when the first
+// peer arrives, proposes its settings. Every session says hello when it
+// joins, accepting whatever is proposed or presenting its own settings as
+// requirements, and the opener answers each hello with the room's current
+// settings. Each session works out the effective settings on its own, as
+// the strictest of everything it heard, and enforces them locally. Peers
+// that predate room settings neither take part nor enforce them.
+const typeRoomSettings message.Type = "roomsettings"
+
+// Kinds of room settings messages.
+const (
+	settingsPropose = "propose"
+	settingsRequire = "require"
+	settingsAccept  = "accept"
+)
+
+// ErrHistoryDisabled is returned by SaveTranscript in a room whose
+// settings do not allow keeping history.
+var ErrHistoryDisabled = errors.New("this room does not allow saving its history")
+
+// RoomSettings is how a room behaves. Settings conflict only in how much
+// they allow, and the stricter one always wins: a feature stays on only
+// if every side has it on, and the shortest ephemeral default applies.
+type RoomSettings struct {
+	// Receipts makes members acknowledge the messages they receive, which
+	// shows senders that they arrived.
+	Receipts bool `json:"receipts"`
+	// History allows members to save the conversation with /save.
+	History bool `json:"history"`
+	// Observers allows members that only watch the room.
+	Observers bool `json:"observers"`
+	// EphemeralTTL, in seconds, makes every chat message ephemeral unless
+	// it was sent with a shorter lifetime. Zero keeps messages.
+	EphemeralTTL int `json:"ephemeral_ttl,omitempty"`
+}
+
+// DefaultRoomSettings are the settings of a room nobody configured, which
+// is how rooms behaved before they had settings.
+func DefaultRoomSettings() RoomSettings {
+	return RoomSettings{Receipts: true, History: true, Observers: true}
+}
+
+// Validate reports whether the settings are in range.
+func (r RoomSettings) Validate() error {
+	if r.EphemeralTTL < 0 || time.Duration(r.EphemeralTTL)*time.Second > maxEphemeralTTL {
+		return fmt.Errorf("ephemeral default of %ds is not between 0 and %s", r.EphemeralTTL, maxEphemeralTTL)
+	}
+	return nil
+}
+
+// stricter returns the settings that satisfy both r and o. It does not
+// depend on the order the two come in, so sessions that heard the same
+// settings in a different order agree.
+func (r RoomSettings) stricter(o RoomSettings) RoomSettings {
+	ttl := r.EphemeralTTL
+	if o.EphemeralTTL > 0 && (ttl == 0 || o.EphemeralTTL < ttl) {
+		ttl = o.EphemeralTTL
+	}
+	return RoomSettings{
+		Receipts:     r.Receipts && o.Receipts,
+		History:      r.History && o.History,
+		Observers:    r.Observers && o.Observers,
+		EphemeralTTL: ttl,
+	}
+}
+
+// ephemeralDefault returns how long chat messages live by default.
+func (r RoomSettings) ephemeralDefault() time.Duration {
+	return time.Duration(r.EphemeralTTL) * time.Second
+}
+
+// describe lists the settings for the user.
+func (r RoomSettings) describe() string {
+	onOff := func(on bool) string {
+		if on {
+			return localize(msgSettingOn)
+		}
+		return localize(msgSettingOff)
+	}
+	fields := []string{
+		localize(msgSettingReceipts, onOff(r.Receipts)),
+		localize(msgSettingHistory, onOff(r.History)),
+		localize(msgSettingObservers, onOff(r.Observers)),
+	}
+	if r.EphemeralTTL > 0 {
+		fields = append(fields, localize(msgSettingEphemeral, r.ephemeralDefault()))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// parseRoomSettings returns the kind of a room settings message and the
+// settings it carries, if any.
+func parseRoomSettings(m message.Message) (kind string, r RoomSettings, err error) {
+	switch m.Message {
+	case settingsAccept:
+		return m.Message, r, nil
+	case settingsPropose, settingsRequire:
+	default:
+		return "", r, fmt.Errorf("unknown room settings message %q", m.Message)
+	}
+	if err = json.Unmarshal(m.Meta, &r); err != nil {
+		return "", r, fmt.Errorf("invalid room settings: %w", err)
+	}
+	if err = r.Validate(); err != nil {
+		return "", r, err
+	}
+	return m.Message, r, nil
+}
+
+// roomSettings is the negotiation state of a session.
+type roomSettings struct {
+	mu sync.Mutex
+	// own are the settings configured for the session, if configured is
+	// set: the proposal when it opened the room and its requirements
+	// otherwise.
+	own        RoomSettings
+	configured bool
+	// opener is set once the relay said a peer joined the room this
+	// session was waiting in.
+	opener bool
+	// effective are the strictest settings heard so far; settled is set
+	// once they were proposed or this session proposed them.
+	effective RoomSettings
+	settled   bool
+}
+
+func newRoomSettings() *roomSettings {
+	return &roomSettings{own: DefaultRoomSettings(), effective: DefaultRoomSettings()}
+}
+
+// configure sets the session's own settings.
+func (rs *roomSettings) configure(r RoomSettings) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.own, rs.configured = r, true
+	rs.effective = rs.effective.stricter(r)
+}
+
+func (rs *roomSettings) get() RoomSettings {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.effective
+}
+
+// hello is what the session says when it joins the room.
+func (rs *roomSettings) hello() message.Message {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !rs.configured {
+		return message.Message{Type: typeRoomSettings, Message: settingsAccept}
+	}
+	meta, _ := json.Marshal(rs.own)
+	return message.Message{Type: typeRoomSettings, Message: settingsRequire, Meta: meta}
+}
+
+// proposal returns the room's settings as the opener proposes them.
+func proposal(r RoomSettings) message.Message {
+	meta, _ := json.Marshal(r)
+	return message.Message{Type: typeRoomSettings, Message: settingsPropose, Meta: meta}
+}
+
+// opened records that the session opened the room, which settles the
+// settings it has, and returns the proposal to send.
+func (rs *roomSettings) opened() (message.Message, RoomSettings) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.opener, rs.settled = true, true
+	return proposal(rs.effective), rs.effective
+}
+
+// settingsUpdate is the outcome of a room settings message for the user.
+type settingsUpdate struct {
+	// show is set when the effective settings are to be shown: when they
+	// were settled or changed.
+	show      bool
+	effective RoomSettings
+	// stricter is set when the room allows less than the session asked
+	// for.
+	stricter bool
+	// reply is the proposal the opener answers a hello with.
+	reply *message.Message
+}
+
+// receive applies a room settings message from a peer.
+func (rs *roomSettings) receive(m message.Message) (u settingsUpdate, err error) {
+	kind, r, err := parseRoomSettings(m)
+	if err != nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	before, wasSettled := rs.effective, rs.settled
+	if kind != settingsAccept {
+		rs.effective = rs.effective.stricter(r)
+	}
+	if kind == settingsPropose {
+		rs.settled = true
+	}
+	if rs.opener && kind != settingsPropose {
+		reply := proposal(rs.effective)
+		u.reply = &reply
+	}
+	u.effective = rs.effective
+	u.show = rs.settled && (!wasSettled || before != rs.effective)
+	u.stricter = u.show && rs.configured && rs.own.stricter(rs.effective) != rs.own
+	return u, nil
+}
+
+// roomSettingsFlags returns the room settings set with the flags of croc
+// chat, and whether any was set.
+func roomSettingsFlags(cCtx *cli.Context) (r RoomSettings, configured bool, err error) {
+	r = DefaultRoomSettings()
+	r.Receipts = !cCtx.Bool("no-receipts")
+	r.History = !cCtx.Bool("no-history")
+	r.Observers = !cCtx.Bool("no-observers")
+	r.EphemeralTTL = int(cCtx.Duration("ephemeral-default") / time.Second)
+	if err = r.Validate(); err != nil {
+		return
+	}
+	return r, r != DefaultRoomSettings(), nil
+}
+
+// SetRoomSettings sets the settings the session proposes if it opens the
+// room, or requires if it joins one that is open already. It must be
+// called before Start. Sessions that do not call it accept whatever the
+// room has.
+func (s *Session) SetRoomSettings(r RoomSettings) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	s.settings.configure(r)
+	return nil
+}
+
+// RoomSettings returns the settings in effect in the room, as far as the
+// session heard.
+func (s *Session) RoomSettings() RoomSettings {
+	return s.settings.get()
+}
+
+// showSettings tells the user about the room settings in u.
+func showSettings(u settingsUpdate, onStatus func(string)) {
+	if !u.show {
+		return
+	}
+	onStatus(localize(msgRoomSettings, u.effective.describe()))
+	if u.stricter {
+		onStatus(localize(msgRoomStricter))
+	}
+}
+
+// roomOpened proposes the room's settings once the relay said a peer
+// joined the room this session opened.
+func (s *Session) roomOpened(onStatus func(string)) {
+	m, effective := s.settings.opened()
+	if err := s.Send(m); err != nil {
+		log.Debugf("error proposing room settings: %v", err)
+	}
+	showSettings(settingsUpdate{show: true, effective: effective}, onStatus)
+}
+
+// roomSettingsReceived applies a room settings message and sends the
+// answer it calls for.
+func (s *Session) roomSettingsReceived(m message.Message, onStatus func(string)) {
+	u, err := s.settings.receive(m)
+	if err != nil {
+		log.Debugf("ignoring room settings from %s: %v", m.Alias, err)
+		return
+	}
+	if u.reply != nil {
+		if err = s.Send(*u.reply); err != nil {
+			log.Debugf("error proposing room settings: %v", err)
+		}
+	}
+	showSettings(u, onStatus)
+}
+
+// applyRoomSettings enforces the room's ephemeral default on a chat, emote
+// or encrypted message, unless it is to disappear sooner anyway.
+func applyRoomSettings(m *message.Message, r RoomSettings) {
+	if (m.Type != "chat" && m.Type != typeEmote && m.Type != "encrypted") || r.EphemeralTTL == 0 {
+		return
+	}
+	if ttl, err := ephemeralTTL(*m); err == nil && (ttl == 0 || ttl > r.ephemeralDefault()) {
+		makeEphemeral(m, r.ephemeralDefault())
+	}
+}
@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestRoomSettingsStricter(t *testing.T) {
+	open := DefaultRoomSettings()
+	private := RoomSettings{Receipts: false, History: false, Observers: true, EphemeralTTL: 600}
+	short := RoomSettings{Receipts: true, History: true, Observers: false, EphemeralTTL: 60}
+
+	assert.Equal(t, open, open.stricter(open))
+	assert.Equal(t, private, open.stricter(private))
+	assert.Equal(t, RoomSettings{EphemeralTTL: 60}, private.stricter(short))
+	// the order settings are heard in does not matter
+	assert.Equal(t, private.stricter(short), short.stricter(private))
+	assert.Equal(t, open.stricter(private).stricter(short), short.stricter(open).stricter(private))
+
+	assert.Nil(t, private.Validate())
+	assert.NotNil(t, RoomSettings{EphemeralTTL: -1}.Validate())
+	assert.NotNil(t, RoomSettings{EphemeralTTL: int(maxEphemeralTTL/time.Second) + 1}.Validate())
+}
+
+func TestParseRoomSettings(t *testing.T) {
+	kind, _, err := parseRoomSettings(message.Message{Type: typeRoomSettings, Message: settingsAccept})
+	assert.Nil(t, err)
+	assert.Equal(t, settingsAccept, kind)
+
+	kind, r, err := parseRoomSettings(proposal(RoomSettings{History: true, EphemeralTTL: 30}))
+	assert.Nil(t, err)
+	assert.Equal(t, settingsPropose, kind)
+	assert.Equal(t, RoomSettings{History: true, EphemeralTTL: 30}, r)
+
+	for _, m := range []message.Message{
+		{Type: typeRoomSettings, Message: "insist"},
+		{Type: typeRoomSettings, Message: settingsRequire},
+		{Type: typeRoomSettings, Message: settingsRequire, Meta: []byte(`{"ephemeral_ttl":-5}`)},
+	} {
+		_, _, err = parseRoomSettings(m)
+		assert.NotNil(t, err, m)
+	}
+}
+
+func TestRoomSettingsNegotiation(t *testing.T) {
+	from := func(m message.Message, alias string) message.Message {
+		m.Alias = alias
+		return m
+	}
+	// alice opens a support room with receipts and history
+	alice := newRoomSettings()
+	alice.configure(RoomSettings{Receipts: true, History: true, Observers: true})
+	// bob only accepts, carol will not have the conversation kept
+	bob := newRoomSettings()
+	carol := newRoomSettings()
+	carol.configure(RoomSettings{Receipts: true, History: false, Observers: true})
+	// and dave, with receipts, joins a room that turned out not to have them
+	dave := newRoomSettings()
+	dave.configure(DefaultRoomSettings())
+
+	assert.Equal(t, settingsAccept, bob.hello().Message)
+	assert.Equal(t, settingsRequire, carol.hello().Message)
+	// until the room's settings are heard, a joiner enforces its own
+	assert.False(t, carol.get().History)
+
+	m, effective := alice.opened()
+	assert.Equal(t, DefaultRoomSettings(), effective)
+	u, err := bob.receive(from(m, "alice"))
+	assert.Nil(t, err)
+	assert.True(t, u.show, "settings are shown on join")
+	assert.False(t, u.stricter)
+	assert.Nil(t, u.reply, "only the opener answers")
+
+	// alice answers carol's hello with the room's settings, stricter now
+	u, err = alice.receive(from(carol.hello(), "carol"))
+	assert.Nil(t, err)
+	assert.True(t, u.show)
+	assert.False(t, u.effective.History)
+	if assert.NotNil(t, u.reply) {
+		u, err = carol.receive(from(*u.reply, "alice"))
+		assert.Nil(t, err)
+		assert.True(t, u.show)
+		assert.False(t, u.stricter)
+		u, err = bob.receive(from(carol.hello(), "carol"))
+		assert.Nil(t, err)
+		assert.True(t, u.show, "a change is shown")
+	}
+	for _, rs := range []*roomSettings{alice, bob, carol} {
+		assert.Equal(t, RoomSettings{Receipts: true, History: false, Observers: true}, rs.get())
+	}
+
+	// a room without receipts stays without them for a joiner that wants
+	// them, who is told the room is stricter
+	erin := newRoomSettings()
+	erin.configure(RoomSettings{Observers: true})
+	m, _ = erin.opened()
+	u, err = dave.receive(from(m, "erin"))
+	assert.Nil(t, err)
+	assert.True(t, u.stricter)
+	assert.False(t, dave.get().Receipts)
+	// and a settled room is not shown again when nothing changes
+	u, err = dave.receive(from(m, "erin"))
+	assert.Nil(t, err)
+	assert.False(t, u.show)
+
+	_, err = bob.receive(message.Message{Type: typeRoomSettings, Message: settingsRequire, Meta: []byte("{")})
+	assert.NotNil(t, err)
+}
+
+func TestApplyRoomSettings(t *testing.T) {
+	r := RoomSettings{EphemeralTTL: 60}
+	m := message.Message{Type: "chat", Message: "hi"}
+	applyRoomSettings(&m, r)
+	ttl, err := ephemeralTTL(m)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, ttl)
+
+	// a message that disappears sooner keeps its lifetime, a later one
+	// is cut short
+	m = message.Message{Type: "chat", Message: "hi"}
+	makeEphemeral(&m, 10*time.Second)
+	applyRoomSettings(&m, r)
+	ttl, _ = ephemeralTTL(m)
+	assert.Equal(t, 10*time.Second, ttl)
+	makeEphemeral(&m, time.Hour)
+	applyRoomSettings(&m, r)
+	ttl, _ = ephemeralTTL(m)
+	assert.Equal(t, time.Minute, ttl)
+
+	ack := message.Message{Type: typeAck, ID: "1"}
+	applyRoomSettings(&ack, r)
+	assert.Empty(t, ack.Meta)
+	m = message.Message{Type: "chat", Message: "hi"}
+	applyRoomSettings(&m, DefaultRoomSettings())
+	assert.Empty(t, m.Meta)
+}
+
+func TestRoomSettingsSession(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8436", "pass123", tcp.WithBanner("8437"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	options := croc.Options{SharedSecret: "1234-room-settings", RelayAddress: "127.0.0.1:8436", RelayPassword: "pass123"}
+
+	// alice opens a room without receipts, bob wants no history
+	alice, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	assert.Nil(t, alice.SetRoomSettings(RoomSettings{Observers: true, History: true}))
+	assert.NotNil(t, alice.SetRoomSettings(RoomSettings{EphemeralTTL: -1}))
+	toAlice := make(chan message.Message, 10)
+	aliceStatus := make(chan string, 10)
+	alice.Start(func(m message.Message) {
+		alice.Answer(m)
+		toAlice <- m
+	}, func(s string) { aliceStatus <- s })
+
+	bob, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+	assert.Nil(t, bob.SetRoomSettings(RoomSettings{Receipts: true, Observers: true}))
+	toBob := make(chan message.Message, 10)
+	bobStatus := make(chan string, 10)
+	bob.Start(func(m message.Message) {
+		bob.Answer(m)
+		toBob <- m
+	}, func(s string) { bobStatus <- s })
+
+	settled := RoomSettings{Observers: true}
+	waitFor := func(s *Session) {
+		deadline := time.Now().Add(5 * time.Second)
+		for s.RoomSettings() != settled && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.Equal(t, settled, s.RoomSettings())
+	}
+	waitFor(alice)
+	waitFor(bob)
+	assert.Contains(t, <-bobStatus, localize(msgRoomSettings, settled.describe()))
+	assert.Equal(t, localize(msgRoomStricter), <-bobStatus)
+
+	// settings messages are the session's business, and nobody acks
+	alice.SetAlias("alice")
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "hello", ID: "1"}))
+	select {
+	case m := <-toBob:
+		assert.Equal(t, "hello", m.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	select {
+	case m := <-toAlice:
+		t.Fatalf("alice got %s", m.Type)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// neither keeps the history
+	for _, s := range []*Session{alice, bob} {
+		assert.ErrorIs(t, s.SaveTranscript(filepath.Join(t.TempDir(), "t.txt"), false), ErrHistoryDisabled)
+	}
+}
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// Chat control messages. They are handled by the client and never shown as
+// chat lines.
+const (
+	typePing message.Type = "ping"
+	typePong message.Type = "pong"
+	typeAck  message.Type = "ack"
+)
+
+// probeTimeout is how long a ping or an unacknowledged message is tracked.
+const probeTimeout = 10 * time.Second
+
+// newMessageID returns a random id for a chat message or ping nonce.
+func newMessageID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shortID abbreviates a message id for display; any unique prefix of an id
+// is accepted where one is expected.
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// peerRTT is what /who shows for a single peer.
+type peerRTT struct {
+	Alias    string
+	LastSeen time.Time
+	// Ping is the round trip of the last /ping, zero if never measured.
+	Ping time.Duration
+	// Passive is a smoothed round trip derived from acks of normal
+	// messages, zero if never measured.
+	Passive time.Duration
+	// Observer is set once the peer said it only observes the room, and
+	// LowBandwidth once it said it saves bytes.
+	Observer     bool
+	LowBandwidth bool
+}
+
+// rttTracker measures round trips through the relay. /ping gives an active
+// measurement per peer; acks of ordinary messages feed a passive estimate.
+// A probe can be answered by every peer in the room, so it is kept until it
+// times out rather than removed on the first reply.
+type rttTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]time.Time
+	answers map[string]int
+	peers   map[string]*peerRTT
+}
+
+func newRTTTracker() *rttTracker {
+	return &rttTracker{
+		now:     time.Now,
+		pending: make(map[string]time.Time),
+		answers: make(map[string]int),
+		peers:   make(map[string]*peerRTT),
+	}
+}
+
+// sent records that a ping nonce or message id went out.
+func (t *rttTracker) sent(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked()
+	t.pending[id] = t.now()
+}
+
+// seen notes activity from a peer.
+func (t *rttTracker) seen(alias string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerLocked(alias).LastSeen = t.now()
+}
+
+// observing notes that a peer only observes the room.
+func (t *rttTracker) observing(alias string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peerLocked(alias).Observer = true
+}
+
+// lowBandwidth notes that a peer is in low-bandwidth mode and reports
+// whether it was not known to be.
+func (t *rttTracker) lowBandwidth(alias string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peerLocked(alias)
+	known := p.LowBandwidth
+	p.LowBandwidth = true
+	return !known
+}
+
+// pong records a reply to a ping and returns its round trip.
+func (t *rttTracker) pong(alias, nonce string) (rtt time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rtt, ok = t.elapsedLocked(nonce)
+	if ok {
+		t.peerLocked(alias).Ping = rtt
+	}
+	return
+}
+
+// ack records an acknowledgement of a message and folds it into the
+// passive estimate.
+func (t *rttTracker) ack(alias, id string) (rtt time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rtt, ok = t.elapsedLocked(id)
+	if !ok {
+		return
+	}
+	p := t.peerLocked(alias)
+	if p.Passive == 0 {
+		p.Passive = rtt
+	} else {
+		// same smoothing as TCP's SRTT
+		p.Passive = (7*p.Passive + rtt) / 8
+	}
+	return
+}
+
+// answered reports how many replies a probe received.
+func (t *rttTracker) answered(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.answers[id]
+}
+
+// list returns the known peers sorted by alias.
+func (t *rttTracker) list() (peers []peerRTT) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Alias < peers[j].Alias })
+	return
+}
+
+func (t *rttTracker) elapsedLocked(id string) (time.Duration, bool) {
+	t.expireLocked()
+	sent, ok := t.pending[id]
+	if !ok {
+		return 0, false
+	}
+	t.answers[id]++
+	return t.now().Sub(sent), true
+}
+
+func (t *rttTracker) peerLocked(alias string) *peerRTT {
+	p, ok := t.peers[alias]
+	if !ok {
+		p = &peerRTT{Alias: alias}
+		t.peers[alias] = p
+	}
+	return p
+}
+
+func (t *rttTracker) expireLocked() {
+	now := t.now()
+	for id, sent := range t.pending {
+		if now.Sub(sent) > probeTimeout {
+			delete(t.pending, id)
+			delete(t.answers, id)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTTTracker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := newRTTTracker()
+	tr.now = func() time.Time { return now }
+
+	// every peer may answer the same ping
+	tr.sent("nonce")
+	now = now.Add(40 * time.Millisecond)
+	d, ok := tr.pong("alice", "nonce")
+	assert.True(t, ok)
+	assert.Equal(t, 40*time.Millisecond, d)
+	now = now.Add(60 * time.Millisecond)
+	d, ok = tr.pong("bob", "nonce")
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, d)
+	assert.Equal(t, 2, tr.answered("nonce"))
+
+	// unknown nonces are ignored
+	_, ok = tr.pong("mallory", "other")
+	assert.False(t, ok)
+
+	// acks are smoothed
+	tr.sent("m1")
+	now = now.Add(80 * time.Millisecond)
+	tr.ack("alice", "m1")
+	tr.sent("m2")
+	now = now.Add(160 * time.Millisecond)
+	tr.ack("alice", "m2")
+
+	peers := tr.list()
+	assert.Len(t, peers, 2)
+	assert.Equal(t, "alice", peers[0].Alias)
+	assert.Equal(t, 40*time.Millisecond, peers[0].Ping)
+	assert.Equal(t, 90*time.Millisecond, peers[0].Passive)
+	assert.Equal(t, "bob", peers[1].Alias)
+	assert.Equal(t, time.Duration(0), peers[1].Passive)
+}
+
+func TestRTTTrackerTimeout(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tr := newRTTTracker()
+	tr.now = func() time.Time { return now }
+
+	tr.sent("nonce")
+	assert.Equal(t, 0, tr.answered("nonce"))
+	now = now.Add(probeTimeout + time.Second)
+	_, ok := tr.pong("alice", "nonce")
+	assert.False(t, ok)
+	assert.Empty(t, tr.list())
+}
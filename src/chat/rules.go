@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// rulesFileName is the file rules config inside croc's config directory.
+const rulesFileName = "chat_rules.json"
+
+// Actions of a file rule.
+const (
+	ruleSaveTo  = "save-to"
+	rulePrompt  = "prompt"
+	ruleDecline = "decline"
+)
+
+// fileRule decides what happens to a received file whose name matches
+// Pattern, a glob such as *.pdf, or whose type starts with MIME, such as
+// image/. Both are matched ignoring case. save-to saves the file to Dir
+// without asking.
+type fileRule struct {
+	Pattern string `json:"pattern,omitempty"`
+	MIME    string `json:"mime,omitempty"`
+	Action  string `json:"action"`
+	Dir     string `json:"dir,omitempty"`
+}
+
+func (r fileRule) String() string {
+	s := r.Pattern
+	if r.MIME != "" {
+		s = "type " + r.MIME
+	}
+	s += " → " + r.Action
+	if r.Action == ruleSaveTo {
+		s += " " + r.Dir
+	}
+	return s
+}
+
+// check reports whether r is complete, and expands a Dir starting with ~
+// to the home directory.
+func (r *fileRule) check() error {
+	if (r.Pattern == "") == (r.MIME == "") {
+		return errors.New("needs either a pattern or a mime prefix")
+	}
+	if _, err := filepath.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%s'", r.Pattern)
+	}
+	switch r.Action {
+	case ruleSaveTo:
+		if r.Dir == "" {
+			return errors.New("save-to needs a dir")
+		}
+		if r.Dir == "~" || strings.HasPrefix(r.Dir, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			r.Dir = filepath.Join(home, strings.TrimPrefix(r.Dir, "~"))
+		}
+	case rulePrompt, ruleDecline:
+	default:
+		return fmt.Errorf("unknown action '%s', use save-to, prompt or decline", r.Action)
+	}
+	return nil
+}
+
+func (r fileRule) matches(name, fileType string) bool {
+	if r.MIME != "" {
+		return strings.HasPrefix(strings.ToLower(fileType), strings.ToLower(r.MIME))
+	}
+	ok, _ := filepath.Match(strings.ToLower(r.Pattern), strings.ToLower(name))
+	return ok
+}
+
+// fileRulesConfig is the file rules config file, for example
+//
+//	{"rules": [
+//	  {"mime": "image/", "action": "save-to", "dir": "~/Pictures/croc"},
+//	  {"pattern": "*.pdf", "action": "save-to", "dir": "~/Documents/croc"},
+//	  {"pattern": "*.exe", "action": "decline"}
+//	]}
+//
+// The first rule that matches a file applies; files no rule matches are
+// offered with a prompt.
+type fileRulesConfig struct {
+	Rules []fileRule `json:"rules"`
+}
+
+// loadFileRules reads the file rules from the config file at path. A
+// missing file means there are none.
+func loadFileRules(path string) ([]fileRule, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config fileRulesConfig
+	if err = json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	for i := range config.Rules {
+		if err = config.Rules[i].check(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return config.Rules, nil
+}
+
+// defaultRulesPath returns the file rules config in croc's config
+// directory.
+func defaultRulesPath() (string, error) {
+	configDir, err := utils.GetConfigDir(false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, rulesFileName), nil
+}
+
+// fileType returns the media type of a received file, from its extension
+// or else from its first bytes.
+func fileType(name string, content []byte) string {
+	t := mime.TypeByExtension(filepath.Ext(name))
+	if t == "" {
+		t = http.DetectContentType(content)
+	}
+	t, _, _ = strings.Cut(t, ";")
+	return strings.TrimSpace(t)
+}
+
+// fileDecision is what to do with a received file.
+type fileDecision struct {
+	action string
+	dir    string
+	// rule is the number of the rule that decided, from 1, or 0 if none
+	// did. A file declined without a rule has the reason in err.
+	rule int
+	err  error
+}
+
+// decideFile applies rules to a file offer. The offer has been through
+// decodeFrame, so its name is sanitized and its size within maxFrameSize;
+// a name that is still unsafe, or contents over the cap, are declined
+// before any rule is looked at, so no rule can save them.
+func decideFile(rules []fileRule, m message.Message) fileDecision {
+	if err := checkFileName(m.Message); err != nil {
+		return fileDecision{action: ruleDecline, err: err}
+	}
+	if len(m.Bytes) > maxFrameSize {
+		return fileDecision{action: ruleDecline, err: fmt.Errorf("larger than %s", utils.ByteCountDecimal(maxFrameSize))}
+	}
+	t := fileType(m.Message, m.Bytes)
+	for i, r := range rules {
+		if r.matches(m.Message, t) {
+			return fileDecision{action: r.Action, dir: r.Dir, rule: i + 1}
+		}
+	}
+	return fileDecision{action: rulePrompt}
+}
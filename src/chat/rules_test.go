@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecideFile(t *testing.T) {
+	rules := []fileRule{
+		{MIME: "image/", Action: ruleSaveTo, Dir: "/tmp/pictures"},
+		{Pattern: "*.pdf", Action: ruleSaveTo, Dir: "/tmp/documents"},
+		{Pattern: "*.exe", Action: ruleDecline},
+		{Pattern: "notes-*.txt", Action: rulePrompt},
+		{MIME: "text/", Action: ruleDecline},
+	}
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		action  string
+		dir     string
+		rule    int
+	}{
+		{"holiday.png", png, ruleSaveTo, "/tmp/pictures", 1},
+		{"HOLIDAY.JPG", []byte("not really a jpeg"), ruleSaveTo, "/tmp/pictures", 1},
+		// no extension, so the type comes from the contents
+		{"screenshot", png, ruleSaveTo, "/tmp/pictures", 1},
+		{"Report.PDF", []byte("%PDF-1.7"), ruleSaveTo, "/tmp/documents", 2},
+		{"setup.exe", []byte("MZ"), ruleDecline, "", 3},
+		{"notes-monday.txt", []byte("hello"), rulePrompt, "", 4},
+		{"todo.txt", []byte("hello"), ruleDecline, "", 5},
+		{"data.bin", []byte{0, 1, 2, 3}, rulePrompt, "", 0},
+		// names are checked before any rule, so none can save these
+		{"../holiday.png", png, ruleDecline, "", 0},
+		{".", nil, ruleDecline, "", 0},
+		{"big.png", make([]byte, maxFrameSize+1), ruleDecline, "", 0},
+	} {
+		d := decideFile(rules, message.Message{Type: "chatfile", Message: tc.name, Bytes: tc.content})
+		assert.Equal(t, tc.action, d.action, tc.name)
+		assert.Equal(t, tc.dir, d.dir, tc.name)
+		assert.Equal(t, tc.rule, d.rule, tc.name)
+		assert.Equal(t, tc.rule == 0 && tc.action == ruleDecline, d.err != nil, tc.name)
+	}
+
+	// without rules every file is offered
+	d := decideFile(nil, message.Message{Type: "chatfile", Message: "holiday.png", Bytes: png})
+	assert.Equal(t, fileDecision{action: rulePrompt}, d)
+}
+
+func TestLoadFileRules(t *testing.T) {
+	dir := t.TempDir()
+	rules, err := loadFileRules(filepath.Join(dir, "missing.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, rules)
+
+	home, err := os.UserHomeDir()
+	assert.Nil(t, err)
+	path := filepath.Join(dir, rulesFileName)
+	assert.Nil(t, os.WriteFile(path, []byte(`{"rules": [
+		{"mime": "image/", "action": "save-to", "dir": "~/Pictures/croc"},
+		{"pattern": "*.exe", "action": "decline"}
+	]}`), 0o600))
+	rules, err = loadFileRules(path)
+	assert.Nil(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, filepath.Join(home, "Pictures/croc"), rules[0].Dir)
+		assert.Equal(t, "type image/ → save-to "+rules[0].Dir, rules[0].String())
+		assert.Equal(t, "*.exe → decline", rules[1].String())
+	}
+
+	for _, bad := range []string{
+		`{"rules": [{"action": "decline"}]}`,
+		`{"rules": [{"pattern": "*.exe", "mime": "application/", "action": "decline"}]}`,
+		`{"rules": [{"pattern": "[", "action": "decline"}]}`,
+		`{"rules": [{"pattern": "*.exe", "action": "delete"}]}`,
+		`{"rules": [{"pattern": "*.pdf", "action": "save-to"}]}`,
+		`{"rules": `,
+	} {
+		assert.Nil(t, os.WriteFile(path, []byte(bad), 0o600))
+		_, err = loadFileRules(path)
+		assert.NotNil(t, err, bad)
+	}
+}
@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// scheduledMessage is a chat message queued with /schedule.
+type scheduledMessage struct {
+	ID   string
+	At   time.Time
+	Text string
+}
+
+// parseSchedule reads when /schedule sends its message: after a delay
+// such as "10m" or at an absolute local time such as "@15:04". An absolute
+// time that already passed today means tomorrow.
+func parseSchedule(when string, now time.Time) (at time.Time, err error) {
+	if clock, ok := strings.CutPrefix(when, "@"); ok {
+		var t time.Time
+		if t, err = time.ParseInLocation("15:04", clock, now.Location()); err != nil {
+			err = fmt.Errorf("invalid time '%s', use @HH:MM", clock)
+			return
+		}
+		at = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return
+	}
+	delay, err := time.ParseDuration(when)
+	if err != nil || delay <= 0 {
+		err = fmt.Errorf("invalid delay '%s', use a duration like 10m or @HH:MM", when)
+		return
+	}
+	at = now.Add(delay)
+	return
+}
+
+// scheduler holds scheduled messages in the order they are due. It lives in
+// the Session, so pending items survive reconnects but not process exit.
+type scheduler struct {
+	mu    sync.Mutex
+	items []scheduledMessage
+	// wake is signalled when the earliest due time may have changed.
+	wake chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+func (s *scheduler) add(item scheduledMessage) {
+	s.mu.Lock()
+	i := sort.Search(len(s.items), func(i int) bool { return s.items[i].At.After(item.At) })
+	s.items = append(s.items, scheduledMessage{})
+	copy(s.items[i+1:], s.items[i:])
+	s.items[i] = item
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// list returns the pending items, earliest first.
+func (s *scheduler) list() []scheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]scheduledMessage(nil), s.items...)
+}
+
+// remove cancels the item whose id starts with prefix.
+func (s *scheduler) remove(prefix string) (item scheduledMessage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := -1
+	for i, it := range s.items {
+		if prefix != "" && strings.HasPrefix(it.ID, prefix) {
+			if found >= 0 {
+				return item, fmt.Errorf("id '%s' matches more than one scheduled message", prefix)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return item, fmt.Errorf("no scheduled message with id '%s'", prefix)
+	}
+	item = s.items[found]
+	s.items = append(s.items[:found], s.items[found+1:]...)
+	return
+}
+
+// next returns when the earliest item is due.
+func (s *scheduler) next() (at time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.items) == 0 {
+		return
+	}
+	return s.items[0].At, true
+}
+
+// due removes and returns the items due at now.
+func (s *scheduler) due(now time.Time) (items []scheduledMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := sort.Search(len(s.items), func(i int) bool { return s.items[i].At.After(now) })
+	items = append(items, s.items[:n]...)
+	s.items = s.items[n:]
+	return
+}
+
+// Schedule queues text to be sent to the room at the given time.
+func (s *Session) Schedule(at time.Time, text string) scheduledMessage {
+	item := scheduledMessage{ID: newMessageID(), At: at, Text: text}
+	s.schedule.add(item)
+	return item
+}
+
+// Scheduled returns the messages waiting to be sent, earliest first.
+func (s *Session) Scheduled() []scheduledMessage {
+	return s.schedule.list()
+}
+
+// Unschedule cancels the scheduled message whose id starts with prefix.
+func (s *Session) Unschedule(prefix string) (scheduledMessage, error) {
+	return s.schedule.remove(prefix)
+}
+
+// runScheduler sends scheduled messages as they fall due. A message that
+// cannot be sent, typically while the session is reconnecting, is retried
+// after reconnectDelay.
+func (s *Session) runScheduler(onStatus func(string)) {
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if at, ok := s.schedule.next(); ok {
+			timer = time.NewTimer(time.Until(at))
+			due = timer.C
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.schedule.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		case now := <-due:
+			for _, item := range s.schedule.due(now) {
+				err := s.Send(message.Message{Type: "chat", Message: item.Text, ID: item.ID})
+				if err != nil {
+					item.At = now.Add(reconnectDelay)
+					s.schedule.add(item)
+					onStatus(localize(msgScheduledRetry, shortID(item.ID), err))
+					continue
+				}
+				onStatus(localize(msgScheduledSent, shortID(item.ID), item.Text))
+			}
+		}
+	}
+}
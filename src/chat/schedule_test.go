@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestParseSchedule(t *testing.T) {
+	now := time.Date(2024, 5, 1, 14, 30, 0, 0, time.UTC)
+
+	c := mustParseCommand(t, "/schedule 10m remember to restart the relay")
+	at, err := parseSchedule(c.arg(0), now)
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(10*time.Minute), at)
+	assert.Equal(t, "remember to restart the relay", c.arg(1))
+
+	at, err = parseSchedule("@15:04", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 5, 1, 15, 4, 0, 0, time.UTC), at)
+
+	// a time that already passed is tomorrow
+	at, err = parseSchedule("@09:00", now)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC), at)
+
+	for _, line := range []string{"/schedule", "/schedule 10m"} {
+		_, err = parseCommand(line)
+		assert.ErrorIs(t, err, errUsage, line)
+	}
+	for _, when := range []string{"-5m", "soon", "@25:00"} {
+		_, err = parseSchedule(when, now)
+		assert.NotNil(t, err, when)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	now := time.Now()
+	s := newScheduler()
+	s.add(scheduledMessage{ID: "bbbb", At: now.Add(2 * time.Minute), Text: "second"})
+	s.add(scheduledMessage{ID: "aaaa", At: now.Add(time.Minute), Text: "first"})
+	s.add(scheduledMessage{ID: "abcd", At: now.Add(3 * time.Minute), Text: "third"})
+
+	next, ok := s.next()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), next)
+
+	_, err := s.remove("a")
+	assert.NotNil(t, err)
+	item, err := s.remove("ab")
+	assert.Nil(t, err)
+	assert.Equal(t, "third", item.Text)
+
+	due := s.due(now.Add(90 * time.Second))
+	assert.Len(t, due, 1)
+	assert.Equal(t, "first", due[0].Text)
+	assert.Len(t, s.list(), 1)
+}
+
+func TestSessionSchedule(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8425", "pass123", tcp.WithBanner("8426"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	options := croc.Options{
+		SharedSecret:  "1234-session-schedule",
+		RelayAddress:  "127.0.0.1:8425",
+		RelayPassword: "pass123",
+	}
+	alice, err := NewSession(context.Background(), options)
+	assert.Nil(t, err)
+	defer alice.Close()
+	bob, err := NewSession(context.Background(), options)
+	assert.Nil(t, err)
+	defer bob.Close()
+
+	received := make(chan message.Message, 2)
+	statuses := make(chan string, 4)
+	alice.Start(func(message.Message) {}, func(status string) { statuses <- status })
+	bob.Start(func(m message.Message) { received <- m }, func(string) {})
+
+	cancelled := alice.Schedule(time.Now().Add(100*time.Millisecond), "never")
+	item := alice.Schedule(time.Now().Add(200*time.Millisecond), "later")
+	_, err = alice.Unschedule(cancelled.ID)
+	assert.Nil(t, err)
+
+	select {
+	case m := <-received:
+		assert.Equal(t, "later", m.Message)
+		assert.Equal(t, item.ID, m.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message was not delivered")
+	}
+	// alice opened the room, so she was shown its settings first
+	status := <-statuses
+	for strings.HasPrefix(status, localize(msgRoomSettings, "")) {
+		status = <-statuses
+	}
+	assert.Contains(t, status, shortID(item.ID))
+	assert.Empty(t, alice.Scheduled())
+}
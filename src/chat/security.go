@@ -0,0 +1,158 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/models"
+)
+
+// e2eSuite is the suite chat messages are end-to-end encrypted with, empty
+// as long as the room carries them as plain frames the relay could read.
+// Only /encrypt protects single messages, with a key the peers share.
+const e2eSuite = ""
+
+// ErrE2EUnavailable is returned when joining with --require-e2e, as chat
+// messages are not end-to-end encrypted.
+var ErrE2EUnavailable = errors.New("chat messages are not end-to-end encrypted, the relay could read them; join without --require-e2e to chat anyway")
+
+// Relay authentication modes of a SecurityReport.
+const (
+	relayAuthPassword        = "password"
+	relayAuthDefaultPassword = "default-password"
+)
+
+// Warnings of a SecurityReport.
+const (
+	securityWarnDefaultPassword = "default-relay-password"
+	securityWarnNoE2E           = "not-end-to-end-encrypted"
+	securityWarnUnsignedPeers   = "unsigned-peers"
+)
+
+// SecurityReport says what protects a chat session, as /security shows it.
+type SecurityReport struct {
+	// Event is always "security", for scripts reading several kinds.
+	Event string `json:"event"`
+	// Transport is how the session reaches the relay: "tcp", as there is
+	// no TLS or QUIC.
+	Transport string `json:"transport"`
+	Relay     string `json:"relay"`
+	// RelayAuth is "password" or, for the password everyone knows,
+	// "default-password". Either is checked with PAKE.
+	RelayAuth string `json:"relay_auth"`
+	// E2E reports whether messages are end-to-end encrypted, and Suite
+	// with what.
+	E2E   bool   `json:"e2e"`
+	Suite string `json:"suite"`
+	// Signing reports whether this session signs its messages.
+	Signing bool           `json:"signing"`
+	Peers   []PeerSecurity `json:"peers"`
+	// Warnings are what falls short, such as "unsigned-peers".
+	Warnings []string `json:"warnings"`
+}
+
+// PeerSecurity says whether a peer heard in the room signs its messages.
+type PeerSecurity struct {
+	Alias string `json:"alias"`
+	Signs bool   `json:"signs"`
+}
+
+// Security returns what protects the session at the moment.
+func (s *Session) Security() SecurityReport {
+	r := SecurityReport{
+		Event:     "security",
+		Transport: "tcp",
+		Relay:     s.options.RelayAddress,
+		RelayAuth: relayAuthPassword,
+		E2E:       e2eSuite != "",
+		Suite:     e2eSuite,
+		Signing:   s.key != nil,
+		Peers:     s.identities.signers(),
+		Warnings:  []string{},
+	}
+	if r.Peers == nil {
+		r.Peers = []PeerSecurity{}
+	}
+	if s.options.RelayPassword == models.DEFAULT_PASSPHRASE {
+		r.RelayAuth = relayAuthDefaultPassword
+		r.Warnings = append(r.Warnings, securityWarnDefaultPassword)
+	}
+	if !r.E2E {
+		r.Warnings = append(r.Warnings, securityWarnNoE2E)
+	}
+	for _, p := range r.Peers {
+		if !p.Signs && r.Signing {
+			r.Warnings = append(r.Warnings, securityWarnUnsignedPeers)
+			break
+		}
+	}
+	return r
+}
+
+// requireE2E refuses to join when end-to-end encryption is required and
+// the session would not have it.
+func requireE2E(required bool) error {
+	if required && e2eSuite == "" {
+		return ErrE2EUnavailable
+	}
+	return nil
+}
+
+// summary is the line shown on joining.
+func (r SecurityReport) summary() string {
+	auth := localize(msgSecurityPass)
+	if r.RelayAuth == relayAuthDefaultPassword {
+		auth = localize(msgSecurityOpenPass)
+	}
+	e2e := localize(msgSecurityE2EOff)
+	if r.E2E {
+		e2e = localize(msgSecurityE2EOn, r.Suite)
+	}
+	signing := localize(msgSecurityUnsigned)
+	if r.Signing {
+		signing = localize(msgSecuritySigned)
+	}
+	return localize(msgSecuritySummary, auth, e2e, signing)
+}
+
+// printSecurity writes r for /security, line by line or as a JSON event
+// for scripts.
+func printSecurity(w io.Writer, r SecurityReport, asJSON bool) error {
+	if asJSON {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	lines := []string{localize(msgSecurityHeader), localize(msgSecurityTCP, r.Relay)}
+	if r.RelayAuth == relayAuthDefaultPassword {
+		lines = append(lines, localize(msgSecurityDefault))
+	} else {
+		lines = append(lines, localize(msgSecurityRelay))
+	}
+	if r.E2E {
+		lines = append(lines, localize(msgSecurityE2E, r.Suite))
+	} else {
+		lines = append(lines, localize(msgSecurityNoE2E))
+	}
+	if r.Signing {
+		lines = append(lines, localize(msgSecuritySigning))
+	}
+	if len(r.Peers) == 0 {
+		lines = append(lines, localize(msgSecurityNoPeers))
+	}
+	for _, p := range r.Peers {
+		if p.Signs {
+			lines = append(lines, localize(msgSecuritySigner, p.Alias))
+		} else {
+			lines = append(lines, localize(msgSecurityNoSigner, p.Alias))
+		}
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/schollz/cli/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/models"
+)
+
+func TestSecurityReport(t *testing.T) {
+	setLanguage("en")
+	s := &Session{options: croc.Options{RelayAddress: "relay.example:9009", RelayPassword: models.DEFAULT_PASSPHRASE}, key: newSessionKey()}
+	r := s.Security()
+	assert.Equal(t, "tcp", r.Transport)
+	assert.Equal(t, relayAuthDefaultPassword, r.RelayAuth)
+	assert.False(t, r.E2E)
+	assert.True(t, r.Signing)
+	assert.Empty(t, r.Peers)
+	assert.Equal(t, []string{securityWarnDefaultPassword, securityWarnNoE2E}, r.Warnings)
+	assert.Equal(t, "Security: plain TCP to the relay, default relay password, not end-to-end encrypted, messages signed; '/security' tells more", r.summary())
+
+	// peers are listed with whether they sign
+	bob := message.Message{Type: "chat", Alias: "bob", Message: "hi"}
+	sign(newSessionKey(), &bob, time.Now())
+	_, err := s.identities.check(bob)
+	assert.Nil(t, err)
+	_, err = s.identities.check(message.Message{Type: "chat", Alias: "alice", Message: "hi"})
+	assert.Nil(t, err)
+	s.options.RelayPassword = "secret"
+	r = s.Security()
+	assert.Equal(t, relayAuthPassword, r.RelayAuth)
+	assert.Equal(t, []PeerSecurity{{Alias: "alice"}, {Alias: "bob", Signs: true}}, r.Peers)
+	assert.Equal(t, []string{securityWarnNoE2E, securityWarnUnsignedPeers}, r.Warnings)
+
+	var b bytes.Buffer
+	assert.Nil(t, printSecurity(&b, r, false))
+	assert.Equal(t, `What protects this session:
+  transport: plain TCP to the relay relay.example:9009, without TLS or QUIC
+  relay: joined with its password, checked with PAKE
+  end-to-end encryption: none, the relay could read the messages; /encrypt protects single messages
+  signatures: this session signs its messages
+  alice does NOT sign its messages
+  bob signs its messages
+`, b.String())
+
+	b.Reset()
+	assert.Nil(t, printSecurity(&b, r, true))
+	var event map[string]any
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &event))
+	assert.Equal(t, "security", event["event"])
+	assert.Equal(t, "password", event["relay_auth"])
+	assert.Equal(t, false, event["e2e"])
+	assert.Len(t, event["peers"], 2)
+}
+
+func TestWarnUnsigned(t *testing.T) {
+	var ids identities
+	assert.False(t, ids.warnUnsigned("alice"), "not heard yet")
+	_, err := ids.check(message.Message{Type: "chat", Alias: "alice"})
+	assert.Nil(t, err)
+	assert.True(t, ids.warnUnsigned("alice"))
+	assert.False(t, ids.warnUnsigned("alice"), "warned once")
+
+	bob := message.Message{Type: "chat", Alias: "bob"}
+	sign(newSessionKey(), &bob, time.Now())
+	_, err = ids.check(bob)
+	assert.Nil(t, err)
+	assert.False(t, ids.warnUnsigned("bob"))
+}
+
+func TestRequireE2E(t *testing.T) {
+	assert.Nil(t, requireE2E(false))
+	assert.ErrorIs(t, requireE2E(true), ErrE2EUnavailable)
+
+	// the commands refuse before connecting to anything
+	set := flag.NewFlagSet("chat", flag.ContinueOnError)
+	set.Bool("require-e2e", true, "")
+	set.String("relay", "127.0.0.1:1", "")
+	c := cli.NewContext(cli.NewApp(), set, nil)
+	assert.ErrorIs(t, StartChat(c, "1234-e2e"), ErrE2EUnavailable)
+	assert.ErrorIs(t, SendStdin(c, "1234-e2e"), ErrE2EUnavailable)
+}
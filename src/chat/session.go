@@ -0,0 +1,495 @@
+package chat
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/internal/bandwidth"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+)
+
+// reconnectDelay is how long the session waits between reconnect attempts.
+const reconnectDelay = 5 * time.Second
+
+// connectTimeout bounds a single attempt to join the relay room.
+const connectTimeout = 30 * time.Second
+
+// Bandwidth weights of chat traffic, see bandwidth.Manager.Register.
+const (
+	messageWeight = 4
+	fileWeight    = 1
+)
+
+// Session is a connection to a chat room. It owns the relay connection and
+// the goroutine receiving from it, and Close stops both.
+type Session struct {
+	options croc.Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	conn  *comm.Comm
+	alias string
+
+	schedule *scheduler
+	// transcript chains every conversation message sent or received.
+	transcript *transcript
+	// key signs this session's messages, edits and deletes; its public
+	// half is the session id in the messages it sends. scrollback holds
+	// the recent chat messages those changes refer to.
+	key        ed25519.PrivateKey
+	scrollback *scrollback
+	// identities are the sessions peers' aliases were heard with.
+	identities identities
+	// confirm holds which peers the user confirmed, in rooms that require
+	// it.
+	confirm peerConfirm
+	// settings are the room settings the session negotiated.
+	settings *roomSettings
+	// commands are the plugin slash commands, guarded by mu.
+	commands map[string]CommandHandler
+	// announced are the peers an observing session told it is observing,
+	// "" standing for the room; guarded by mu.
+	announced map[string]bool
+
+	// messages and files draw on the process-wide bandwidth budget, with
+	// messages weighted so they stay responsive next to a file.
+	messages *bandwidth.Consumer
+	files    *bandwidth.Consumer
+
+	// acks are the acks a low-bandwidth session has yet to send, and
+	// traffic counts the bytes the session sent and received.
+	acks    ackBatch
+	traffic trafficCounter
+
+	// handling serializes the messages received through the relay and
+	// the data channel. direct is set in direct mode, see GoDirect.
+	handling sync.Mutex
+	direct   *direct
+}
+
+// NewSession joins the chat room for options.SharedSecret. The session lives
+// until Close is called or ctx is cancelled. With options.Observe it joins
+// read-only, which rooms created with options.DenyObservers refuse with
+// tcp.ErrObserversDenied. With options.LowBandwidth it saves bytes where it
+// can, see LowBandwidth.
+func NewSession(ctx context.Context, options croc.Options) (s *Session, err error) {
+	if len(options.SharedSecret) < 4 {
+		return nil, fmt.Errorf("code is too short")
+	}
+	options.IsChat = true
+	options.RoomName = croc.DeriveRoomName(options.SharedSecret, croc.NamespaceChat)
+
+	conn, banner, ip, err := options.ConnectToRoom(options.RelayAddress, chatRoomRequest(options), connectTimeout)
+	if err != nil {
+		return
+	}
+	log.Debugf("chat connection established: banner='%s', externalIP=%s", banner, ip)
+	s = &Session{
+		options:    options,
+		conn:       conn,
+		schedule:   newScheduler(),
+		transcript: &transcript{},
+		key:        newSessionKey(),
+		scrollback: &scrollback{},
+		settings:   newRoomSettings(),
+		announced:  make(map[string]bool),
+		messages:   bandwidth.Default.Register("chat messages", messageWeight),
+		files:      bandwidth.Default.Register("chat files", fileWeight),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return
+}
+
+// chatRoomRequest is what a session asks the relay for.
+func chatRoomRequest(options croc.Options) tcp.RoomRequest {
+	return tcp.RoomRequest{
+		Room:          options.RoomName,
+		Mode:          tcp.RoomModeChat,
+		App:           options.App,
+		Observer:      options.Observe,
+		DenyObservers: options.DenyObservers,
+		Capabilities:  []string{tcp.CapabilityControlFrames, tcp.CapabilityLimitWarnings},
+	}
+}
+
+// ReadOnly reports whether the session only observes the room: it sends
+// no messages and peers see it as an observer.
+func (s *Session) ReadOnly() bool {
+	return s.options.Observe
+}
+
+// RoomName returns the relay room the session joined.
+func (s *Session) RoomName() string {
+	return s.options.RoomName
+}
+
+// Start begins receiving from the room. onMessage is called for every chat
+// message and onStatus for connection status changes; both are called from
+// the receive goroutine or, in direct mode, the data channel's, one
+// message at a time. onStatus also reports scheduled messages as they are
+// sent, the room settings once they are negotiated and the transport
+// changing.
+func (s *Session) Start(onMessage func(message.Message), onStatus func(string)) {
+	if s.direct != nil {
+		s.direct.onMessage, s.direct.onStatus = onMessage, onStatus
+	}
+	s.wg.Add(3)
+	go func() {
+		defer s.wg.Done()
+		<-s.ctx.Done()
+		s.closeConn()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.receive(onMessage, onStatus)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.runScheduler(onStatus)
+	}()
+	if s.presence() != "" {
+		s.announce("")
+	}
+	s.sayHello()
+}
+
+// sayHello takes part in the room settings negotiation and, if the
+// session requires it, the peer confirmation on joining.
+func (s *Session) sayHello() {
+	if err := s.Send(s.settings.hello()); err != nil {
+		log.Debugf("error sending room settings: %v", err)
+	}
+	s.confirmHello()
+	s.helloDirect()
+}
+
+// SetAlias changes the alias attached to outgoing messages.
+func (s *Session) SetAlias(alias string) {
+	s.mu.Lock()
+	s.alias = alias
+	s.mu.Unlock()
+}
+
+// Alias returns the alias attached to outgoing messages.
+func (s *Session) Alias() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.alias
+}
+
+// Send writes a message to the room, filling in the session alias if the
+// message has none. Messages covered by the integrity chain get an id if
+// they lack one and are added to the chain once sent. Chat messages get
+// the room's ephemeral default. A read-only session only sends its
+// presence, pongs, acks and room settings, and returns ErrReadOnly for
+// anything else. A session that requires confirmation returns
+// ErrUnconfirmed for conversation messages and reactions until its peers
+// are confirmed. A low-bandwidth session compresses what it sends. In
+// direct mode messages go on the data channel once it is open, see
+// GoDirect.
+func (s *Session) Send(m message.Message) (err error) {
+	if s.ReadOnly() && !observerSends[m.Type] {
+		return ErrReadOnly
+	}
+	if (chained[m.Type] || m.Type == typeReaction) && !s.confirm.ready() {
+		return ErrUnconfirmed
+	}
+	s.mu.Lock()
+	conn := s.conn
+	if m.Alias == "" {
+		m.Alias = s.alias
+	}
+	s.mu.Unlock()
+	if chained[m.Type] && m.ID == "" {
+		m.ID = newMessageID()
+	}
+	applyRoomSettings(&m, s.settings.get())
+	if signed[m.Type] && s.key != nil {
+		sign(s.key, &m, time.Now())
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	if conn == nil {
+		return fmt.Errorf("chat session is closed")
+	}
+	if s.LowBandwidth() {
+		data = compressFrame(data)
+	}
+	consumer := s.messages
+	if len(m.Bytes) > 0 {
+		consumer = s.files
+	}
+	if err = consumer.Wait(s.ctx, len(data)); err != nil {
+		return
+	}
+	if err = s.transmit(conn, data); err != nil {
+		return
+	}
+	s.traffic.add(true, trafficCategory(m), len(data))
+	s.transcript.record(m, true, time.Now())
+	if m.Type == "chat" || m.Type == typeEmote {
+		s.addChat(m, true)
+	}
+	return
+}
+
+// Integrity returns the head of the room's integrity chain and how many
+// messages it covers. Members who compare equal heads saw the same
+// conversation in the same order.
+func (s *Session) Integrity() (head string, n int) {
+	return s.transcript.Head()
+}
+
+// SaveTranscript writes the conversation to path. A signed transcript
+// includes each message's digest and the integrity chain. Rooms whose
+// settings do not allow history refuse with ErrHistoryDisabled.
+func (s *Session) SaveTranscript(path string, signed bool) (err error) {
+	if !s.settings.get().History {
+		return ErrHistoryDisabled
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if err = s.transcript.write(f, signed); err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// acknowledged are the message types a receiving client acks, so senders
+// can tell they were delivered.
+var acknowledged = map[message.Type]bool{
+	"chat":          true,
+	typeEmote:       true,
+	"chatfile":      true,
+	typeChatArchive: true,
+}
+
+// Answer sends the replies a received message calls for without any user
+// involvement: a pong for a ping and, in rooms with receipts, an ack for a
+// delivered message, which a low-bandwidth session batches. An observer or
+// low-bandwidth session also tells each peer it hears from for the first
+// time what it is. Whoever handles messages passed to onMessage should
+// call it for each.
+func (s *Session) Answer(m message.Message) {
+	if s.presence() != "" {
+		s.announce(m.Alias)
+	}
+	var reply message.Message
+	switch {
+	case m.Type == typePing:
+		reply = message.Message{Type: typePong, Message: m.Message}
+	case acknowledged[m.Type] && m.ID != "" && s.settings.get().Receipts:
+		if s.LowBandwidth() {
+			s.queueAck(m.ID)
+			return
+		}
+		reply = message.Message{Type: typeAck, ID: m.ID}
+	default:
+		return
+	}
+	if err := s.Send(reply); err != nil {
+		log.Debugf("error answering %s: %v", m.Type, err)
+	}
+}
+
+// Close leaves the room and waits for the receive goroutine to exit,
+// abandoning any reconnect attempt in progress.
+func (s *Session) Close() error {
+	s.cancel()
+	s.closeConn()
+	s.wg.Wait()
+	s.messages.Close()
+	s.files.Close()
+	return nil
+}
+
+func (s *Session) closeConn() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Session) receive(onMessage func(message.Message), onStatus func(string)) {
+	for {
+		s.mu.Lock()
+		conn := s.conn
+		s.mu.Unlock()
+		if conn == nil {
+			return
+		}
+		data, err := conn.Receive()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			log.Errorf("error receiving message: %v", err)
+			onStatus(localize(msgPeerDisconnected))
+			if !s.reconnect(onStatus) {
+				return
+			}
+			continue
+		}
+		if tcp.IsIdleTimeout(data) {
+			s.traffic.add(false, trafficOverhead, len(data))
+			// the relay closes the connection next, which reconnects
+			log.Debugf("relay dropped idle connection")
+			continue
+		}
+		if tcp.IsControlFrame(data) {
+			s.traffic.add(false, trafficOverhead, len(data))
+			if control, err := tcp.ParseControl(conn, data); err == nil {
+				log.Debugf("relay says: %s", control)
+				switch control.Kind {
+				case tcp.ControlRoomReady:
+					s.roomOpened(onStatus)
+				case tcp.ControlRoomExpiring:
+					onStatus(localize(msgRoomExpiring, control.Left.Round(time.Second)))
+				case tcp.ControlQuotaWarning:
+					onStatus(localize(msgRoomQuota, control.Used))
+				case tcp.ControlNobodyJoined:
+					onStatus(localize(msgRoomNobodyJoined))
+				}
+			}
+			continue
+		}
+		m, err := decodeFrame(data)
+		if err != nil {
+			s.traffic.add(false, trafficOverhead, len(data))
+			log.Debugf("dropping frame: %v", err)
+			continue
+		}
+		s.traffic.add(false, trafficCategory(m), len(data))
+		if s.directReceived(m) {
+			continue
+		}
+		s.handle(m, onMessage, onStatus)
+	}
+}
+
+// handle passes a message from a peer on, whether it came through the
+// relay or directly. Messages are handled one at a time.
+func (s *Session) handle(m message.Message, onMessage func(message.Message), onStatus func(string)) {
+	s.handling.Lock()
+	defer s.handling.Unlock()
+	changed, err := s.identities.check(m)
+	if err != nil {
+		log.Debugf("dropping %s: %v", m.Type, err)
+		return
+	}
+	if changed {
+		onStatus(localize(msgIdentityChanged, m.Alias))
+	}
+	if s.identities.warnUnsigned(m.Alias) {
+		onStatus(localize(msgPeerUnsigned, m.Alias))
+	}
+	s.confirmSeen(m, onStatus)
+	settings := s.settings.get()
+	applyRoomSettings(&m, settings)
+	switch m.Type {
+	case typeRoomSettings:
+		s.roomSettingsReceived(m, onStatus)
+		return
+	case typeConfirm:
+		s.confirmReceived(m, onStatus)
+		return
+	case typePresence:
+		if presenceHas(m, presenceObserver) && !settings.Observers {
+			onStatus(localize(msgObserverDenied, m.Alias))
+		}
+	case "chat", typeEmote:
+		s.addChat(m, false)
+	case typeChatEdit, typeChatDelete:
+		if err = s.scrollback.apply(m); err != nil {
+			log.Debugf("ignoring %s of %s: %v", m.Type, m.ID, err)
+			return
+		}
+	case typeReaction:
+		if _, err = s.scrollback.react(m); err != nil {
+			log.Debugf("ignoring reaction to %s: %v", m.ID, err)
+			return
+		}
+		s.transcript.react(m)
+	}
+	s.transcript.record(m, false, time.Now())
+	onMessage(m)
+}
+
+// reconnect rejoins the room until it succeeds, the session is closed or
+// the relay refuses this version of croc. It reports whether the session
+// has a connection again.
+func (s *Session) reconnect(onStatus func(string)) bool {
+	type result struct {
+		conn *comm.Comm
+		ip   string
+		err  error
+	}
+	for {
+		attempt := make(chan result, 1)
+		go func() {
+			conn, _, ip, err := s.options.ConnectToRoom(s.options.RelayAddress, chatRoomRequest(s.options), connectTimeout)
+			attempt <- result{conn, ip, err}
+		}()
+		var r result
+		select {
+		case <-s.ctx.Done():
+			go func() {
+				if r := <-attempt; r.err == nil {
+					r.conn.Close()
+				}
+			}()
+			return false
+		case r = <-attempt:
+		}
+		if errors.Is(r.err, tcp.ErrUpgradeRequired) {
+			// retrying cannot help until the user upgrades
+			onStatus(localize(msgUpgradeRequired))
+			return false
+		}
+		if r.err != nil {
+			log.Errorf("reconnect failed: %v", r.err)
+			select {
+			case <-s.ctx.Done():
+				return false
+			case <-time.After(reconnectDelay):
+			}
+			continue
+		}
+		s.mu.Lock()
+		if s.ctx.Err() != nil {
+			s.mu.Unlock()
+			r.conn.Close()
+			return false
+		}
+		s.conn = r.conn
+		// peers may have come and gone while the session was away
+		s.announced = make(map[string]bool)
+		s.mu.Unlock()
+		onStatus(localize(msgReconnected, s.options.RoomName, r.ip))
+		if s.ReadOnly() {
+			s.announce("")
+		}
+		s.sayHello()
+		return true
+	}
+}
@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+func TestSessionClose(t *testing.T) {
+	log.SetLevel("error")
+	go tcp.RunWithOptionsAsync("127.0.0.1", "8421", "pass123", tcp.WithBanner("8422"), tcp.WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	options := croc.Options{
+		SharedSecret:  "1234-session-close",
+		RelayAddress:  "127.0.0.1:8421",
+		RelayPassword: "pass123",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	alice, err := NewSession(context.Background(), options)
+	assert.Nil(t, err)
+	bob, err := NewSession(ctx, options)
+	assert.Nil(t, err)
+	assert.Equal(t, alice.RoomName(), bob.RoomName())
+
+	received := make(chan message.Message, 1)
+	alice.Start(func(message.Message) {}, func(string) {})
+	bob.Start(func(m message.Message) { received <- m }, func(string) {})
+
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: "hello", Alias: "alice"}))
+	select {
+	case m := <-received:
+		assert.Equal(t, "hello", m.Message)
+		assert.Equal(t, "alice", m.Alias)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	aliceHead, n := alice.Integrity()
+	bobHead, _ := bob.Integrity()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, aliceHead, bobHead)
+
+	// cancelling the parent context stops bob without reconnecting, and
+	// Close stops alice even though her peer just left
+	cancel()
+	assert.Nil(t, bob.Close())
+	assert.Nil(t, alice.Close())
+	assert.NotNil(t, alice.Send(message.Message{Type: "chat", Message: "gone"}))
+
+	// polled by hand since assert.Eventually runs its condition in a
+	// goroutine of its own
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+}
+
+func TestSessionLimitWarnings(t *testing.T) {
+	log.SetLevel("error")
+	setLanguage("en")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(l), tcp.WithLogLevel("error"),
+			tcp.WithRoomByteQuota(10000), tcp.WithLimitWarnings(0.5, 0))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	options := croc.Options{SharedSecret: "1234-limit-warnings", RelayAddress: l.Addr().String(), RelayPassword: "pass123"}
+	alice, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	bob, err := NewSession(context.Background(), options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+
+	status := make(chan string, 10)
+	alice.Start(func(message.Message) {}, func(string) {})
+	bob.Start(func(message.Message) {}, func(s string) { status <- s })
+	assert.Nil(t, alice.Send(message.Message{Type: "chat", Message: strings.Repeat("x", 6000), Alias: "alice"}))
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case s := <-status:
+			if strings.Contains(s, "close to what the relay lets it transfer") {
+				return
+			}
+		case <-deadline:
+			t.Fatal("no quota warning")
+		}
+	}
+}
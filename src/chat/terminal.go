@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chzyer/readline"
+	"golang.org/x/term"
+)
+
+// colorEnabled says whether colorText emits ANSI sequences. StartChat sets
+// it from the terminal; it is on otherwise so the package behaves the same
+// for embedders.
+var colorEnabled atomic.Bool
+
+func init() {
+	colorEnabled.Store(true)
+}
+
+// ansiPattern matches CSI sequences such as colors and the OSC sequences
+// terminals use for inline images.
+var ansiPattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\a\x1b]*(\a|\x1b\\)`)
+
+// stripANSI removes escape sequences from s.
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// terminal is what the chat may assume about where it reads and writes.
+type terminal struct {
+	// color allows ANSI sequences on stdout.
+	color bool
+	// interactive means stdin and stdout are both terminals, so input can
+	// go through readline.
+	interactive bool
+}
+
+// detectTerminal looks at stdin and stdout with isTTY. Color is off with
+// noColor, with NO_COLOR set to anything but the empty string, or when
+// stdout is not a terminal.
+func detectTerminal(noColor bool, stdin, stdout *os.File, isTTY func(*os.File) bool) terminal {
+	outTTY := isTTY(stdout)
+	return terminal{
+		color:       outTTY && !noColor && os.Getenv("NO_COLOR") == "",
+		interactive: outTTY && isTTY(stdin),
+	}
+}
+
+func isTTY(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// console is the chat's line input and asynchronous output. readline
+// provides it on a terminal and plainConsole everywhere else.
+type console interface {
+	Readline() (string, error)
+	ReadPassword(prompt string) ([]byte, error)
+	Write(b []byte) (int, error)
+	Refresh()
+	SetPrompt(prompt string)
+	Close() error
+}
+
+var _ console = (*readline.Instance)(nil)
+
+// newConsole returns readline for an interactive terminal and plain line
+// reading otherwise, so the chat can be driven through pipes. onKey is
+// called for every key typed into readline.
+func newConsole(t terminal, prompt string, onKey func()) (console, error) {
+	if t.interactive {
+		return readline.NewEx(&readline.Config{Prompt: prompt, FuncFilterInputRune: func(r rune) (rune, bool) {
+			onKey()
+			return r, true
+		}})
+	}
+	return newPlainConsole(os.Stdin, os.Stdout), nil
+}
+
+// plainConsole reads whole lines and writes output as is, with no prompt
+// and no line editing.
+type plainConsole struct {
+	lines chan string
+	err   error
+	done  chan struct{}
+	once  sync.Once
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newPlainConsole(in io.Reader, out io.Writer) *plainConsole {
+	c := &plainConsole{lines: make(chan string), done: make(chan struct{}), out: out}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			select {
+			case c.lines <- scanner.Text():
+			case <-c.done:
+				return
+			}
+		}
+		c.err = scanner.Err()
+	}()
+	return c
+}
+
+// Readline returns the next line, or io.EOF once input ends or the
+// console is closed.
+func (c *plainConsole) Readline() (string, error) {
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			if c.err != nil {
+				return "", c.err
+			}
+			return "", io.EOF
+		}
+		return line, nil
+	case <-c.done:
+		return "", io.EOF
+	}
+}
+
+// ReadPassword reads the next line; without a terminal there is no echo
+// to turn off.
+func (c *plainConsole) ReadPassword(prompt string) ([]byte, error) {
+	c.Write([]byte(prompt))
+	line, err := c.Readline()
+	return []byte(line), err
+}
+
+func (c *plainConsole) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(b)
+}
+
+func (c *plainConsole) Refresh() {}
+
+func (c *plainConsole) SetPrompt(string) {}
+
+func (c *plainConsole) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,72 @@
+package chat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectTerminal(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	all := func(*os.File) bool { return true }
+	none := func(*os.File) bool { return false }
+	onlyStdout := func(f *os.File) bool { return f == os.Stdout }
+
+	assert.Equal(t, terminal{color: true, interactive: true}, detectTerminal(false, os.Stdin, os.Stdout, all))
+	assert.Equal(t, terminal{color: false, interactive: true}, detectTerminal(true, os.Stdin, os.Stdout, all))
+	assert.Equal(t, terminal{}, detectTerminal(false, os.Stdin, os.Stdout, none))
+	// piped input still gets color on a terminal, but no readline
+	assert.Equal(t, terminal{color: true}, detectTerminal(false, os.Stdin, os.Stdout, onlyStdout))
+	t.Setenv("NO_COLOR", "1")
+	assert.Equal(t, terminal{interactive: true}, detectTerminal(false, os.Stdin, os.Stdout, all))
+}
+
+func TestColorText(t *testing.T) {
+	defer colorEnabled.Store(true)
+	colorEnabled.Store(true)
+	assert.Equal(t, BlueColor+"bob"+ResetColor, colorText("bob", BlueColor))
+
+	colorEnabled.Store(false)
+	assert.Equal(t, "bob", colorText("bob", BlueColor))
+	assert.Equal(t, "see http://x.y/z.", highlightURLs("see http://x.y/z."))
+	assert.NotContains(t, timestamp(), "\x1b")
+}
+
+func TestStripANSI(t *testing.T) {
+	assert.Equal(t, "ab", stripANSI("\x1b[38;2;1;2;3m\x1b[48;2;4;5;6ma\x1b[0mb"))
+	assert.Equal(t, "x\n", stripANSI("x\x1b]1337;File=inline=1;size=3:AAAA\a\n"))
+	assert.Equal(t, "plain", stripANSI("plain"))
+}
+
+func TestPlainConsole(t *testing.T) {
+	var out bytes.Buffer
+	c := newPlainConsole(strings.NewReader("hello\n/quit\n"), &out)
+	c.SetPrompt("ignored> ")
+	c.Refresh()
+	line, err := c.Readline()
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", line)
+	pass, err := c.ReadPassword("Passphrase: ")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("/quit"), pass)
+	_, err = c.Readline()
+	assert.Equal(t, io.EOF, err)
+	c.Write([]byte("bye\n"))
+	assert.Equal(t, "Passphrase: bye\n", out.String())
+
+	// closing unblocks a read waiting on input that never comes
+	r, w := io.Pipe()
+	defer w.Close()
+	c = newPlainConsole(r, io.Discard)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Close()
+	}()
+	_, err = c.Readline()
+	assert.Equal(t, io.EOF, err)
+}
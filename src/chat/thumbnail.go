@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // register decoders for thumbnails
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// Thumbnail limits. Sources are checked from their header before decoding
+// so a huge image cannot exhaust memory, and received thumbnails are
+// rejected if they are larger than any sender would produce.
+const (
+	thumbnailMaxSide      = 96
+	thumbnailQuality      = 60
+	thumbnailMaxPixels    = 24_000_000
+	thumbnailMaxBytes     = 32 * 1024
+	thumbnailBlockColumns = 32
+)
+
+// thumbnailExtensions are the file types a thumbnail is made for.
+var thumbnailExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// thumbnail is a small JPEG preview of an offered image, carried in the
+// offer's Bytes2. Width and Height are the dimensions of the original.
+type thumbnail struct {
+	Width  int    `json:"w"`
+	Height int    `json:"h"`
+	JPEG   []byte `json:"jpeg"`
+}
+
+// makeThumbnail returns a preview of the image at path, or nil if the file
+// is not an image croc makes previews for.
+func makeThumbnail(path string) (t *thumbnail, err error) {
+	if !thumbnailExtensions[strings.ToLower(filepath.Ext(path))] {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, nil
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("image of %dx%d is too large for a thumbnail", cfg.Width, cfg.Height)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, scaleDown(img, thumbnailMaxSide), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return
+	}
+	return &thumbnail{Width: cfg.Width, Height: cfg.Height, JPEG: buf.Bytes()}, nil
+}
+
+// scaleDown shrinks img to fit in a maxSide square by averaging the source
+// pixels that fall into each target pixel.
+func scaleDown(img image.Image, maxSide int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			w, h = maxSide, max(1, h*maxSide/b.Dx())
+		} else {
+			w, h = max(1, w*maxSide/b.Dy()), maxSide
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// attachThumbnail adds a preview of path to an offer when it is an image.
+// Failing to make one never stops the offer.
+func attachThumbnail(m *message.Message, path string, warn func(string)) {
+	t, err := makeThumbnail(path)
+	if err != nil {
+		warn(localize(msgNoThumbnail, filepath.Base(path), err))
+		return
+	}
+	if t == nil {
+		return
+	}
+	if m.Bytes2, err = json.Marshal(t); err != nil {
+		m.Bytes2 = nil
+	}
+}
+
+// thumbnailFrom returns the preview carried by an offer, nil if there is
+// none.
+func thumbnailFrom(m message.Message) (t *thumbnail, err error) {
+	if len(m.Bytes2) == 0 || m.Type == "encrypted" {
+		return
+	}
+	t = new(thumbnail)
+	if err = json.Unmarshal(m.Bytes2, t); err != nil {
+		return nil, err
+	}
+	if len(t.JPEG) > thumbnailMaxBytes {
+		return nil, fmt.Errorf("thumbnail of %d bytes is too large", len(t.JPEG))
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(t.JPEG))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width > thumbnailMaxSide || cfg.Height > thumbnailMaxSide {
+		return nil, fmt.Errorf("thumbnail of %dx%d is too large", cfg.Width, cfg.Height)
+	}
+	return
+}
+
+// renderThumbnail draws a preview for the terminal: inline with the iTerm2
+// image protocol where it is available, as colored half blocks otherwise.
+func renderThumbnail(t *thumbnail) (string, error) {
+	if os.Getenv("TERM_PROGRAM") == "iTerm.app" || os.Getenv("LC_TERMINAL") == "iTerm2" {
+		return fmt.Sprintf("\x1b]1337;File=inline=1;size=%d;preserveAspectRatio=1:%s\a\n",
+			len(t.JPEG), base64.StdEncoding.EncodeToString(t.JPEG)), nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(t.JPEG))
+	if err != nil {
+		return "", err
+	}
+	return blockArt(img, thumbnailBlockColumns), nil
+}
+
+// blockArt renders img with upper half blocks, each character showing two
+// pixels through its foreground and background color.
+func blockArt(img image.Image, columns int) string {
+	small := scaleDown(img, columns)
+	b := small.Bounds()
+	var sb strings.Builder
+	for y := b.Min.Y; y < b.Max.Y; y += 2 {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			top := small.RGBAAt(x, y)
+			bottom := top
+			if y+1 < b.Max.Y {
+				bottom = small.RGBAAt(x, y+1)
+			}
+			fmt.Fprintf(&sb, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	return sb.String()
+}
+
+// describeThumbnail is the one-line summary shown with a preview.
+func describeThumbnail(t *thumbnail) string {
+	return fmt.Sprintf("image %dx%d", t.Width, t.Height)
+}
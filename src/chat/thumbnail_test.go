@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/message"
+)
+
+func TestThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, png.Encode(&buf, img))
+	imgPath := filepath.Join(dir, "IMG_4032.png")
+	assert.Nil(t, os.WriteFile(imgPath, buf.Bytes(), 0o644))
+	txtPath := filepath.Join(dir, "notes.txt")
+	assert.Nil(t, os.WriteFile(txtPath, []byte("not an image"), 0o644))
+	fakePath := filepath.Join(dir, "fake.jpg")
+	assert.Nil(t, os.WriteFile(fakePath, []byte("not a jpeg either"), 0o644))
+
+	var warnings []string
+	warn := func(w string) { warnings = append(warnings, w) }
+
+	m := message.Message{Type: "chatfile", Message: "IMG_4032.png"}
+	attachThumbnail(&m, imgPath, warn)
+	th, err := thumbnailFrom(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, th.Width)
+	assert.Equal(t, 200, th.Height)
+	assert.LessOrEqual(t, len(th.JPEG), thumbnailMaxBytes)
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(th.JPEG))
+	assert.Nil(t, err)
+	assert.Equal(t, thumbnailMaxSide, cfg.Width)
+	assert.Equal(t, thumbnailMaxSide/2, cfg.Height)
+
+	preview, err := renderThumbnail(th)
+	assert.Nil(t, err)
+	if !strings.HasPrefix(preview, "\x1b]1337;") {
+		assert.Equal(t, thumbnailBlockColumns/4, strings.Count(preview, "\n"))
+	}
+
+	// other files and undecodable images get no thumbnail
+	for _, path := range []string{txtPath, fakePath} {
+		m = message.Message{Type: "chatfile"}
+		attachThumbnail(&m, path, warn)
+		assert.Empty(t, m.Bytes2, path)
+	}
+	assert.Empty(t, warnings)
+
+	// received previews are checked before they are shown
+	th, err = thumbnailFrom(message.Message{Type: "chatfile"})
+	assert.Nil(t, err)
+	assert.Nil(t, th)
+	_, err = thumbnailFrom(message.Message{Type: "chatfile", Bytes2: []byte(`{"w":1,"h":1,"jpeg":"AAAA"}`)})
+	assert.NotNil(t, err)
+}
+
+func TestScaleDown(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 300))
+	small := scaleDown(img, 96)
+	assert.Equal(t, image.Rect(0, 0, 3, 96), small.Bounds())
+	// small images are left at their size
+	assert.Equal(t, image.Rect(0, 0, 10, 30), scaleDown(image.NewRGBA(image.Rect(0, 0, 10, 30)), 96).Bounds())
+}
@@ -0,0 +1,282 @@
+package chat
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/models"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// typeTransferOffer announces a file that is waiting to be fetched through
+// croc's native transfer engine rather than the chat's inline file path.
+const typeTransferOffer message.Type = "transfer_offer"
+
+// transferProgressInterval is how often an active transfer reports its
+// progress into the chat.
+const transferProgressInterval = 5 * time.Second
+
+// transferOffer is an offer received from a peer.
+type transferOffer struct {
+	ID    string
+	Nonce []byte
+	Name  string
+	Size  int64
+	Alias string
+}
+
+// transfers bridges /transfer and /get to the croc package. Transfer codes
+// are derived from the chat secret and a per-offer nonce, so only the nonce
+// ever crosses the relay and both peers can compute the code on their own.
+type transfers struct {
+	options croc.Options
+	notify  func(string)
+
+	mu     sync.Mutex
+	offers map[string]transferOffer
+}
+
+func newTransfers(options croc.Options, notify func(string)) *transfers {
+	return &transfers{
+		options: options,
+		notify:  notify,
+		offers:  make(map[string]transferOffer),
+	}
+}
+
+// deriveTransferCode turns the chat secret and an offer nonce into a croc
+// code. The first four characters pick the relay room and the rest is the
+// PAKE secret, matching the layout croc expects.
+func deriveTransferCode(secret string, nonce []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("croc-chat-transfer"))
+	mac.Write(nonce)
+	sum := mac.Sum(nil)
+	pin := binary.BigEndian.Uint16(sum[:2]) % 10000
+	return fmt.Sprintf("%04d-%s", pin, hex.EncodeToString(sum[2:18]))
+}
+
+func (t *transfers) crocOptions(code string, isSender bool) croc.Options {
+	return croc.Options{
+		IsSender:      isSender,
+		SharedSecret:  code,
+		Debug:         t.options.Debug,
+		RelayAddress:  t.options.RelayAddress,
+		RelayAddress6: t.options.RelayAddress6,
+		RelayPassword: t.options.RelayPassword,
+		Connect:       t.options.Connect,
+		RelayPorts:    t.relayPorts(),
+		DisableLocal:  true,
+		NoPrompt:      true,
+		Curve:         "p256",
+		HashAlgorithm: "xxhash",
+	}
+}
+
+// relayPorts are the ports of the chat's relay, or the port of its
+// address when they are not known; the relay tells the rest as the
+// transfer joins it.
+func (t *transfers) relayPorts() []string {
+	if len(t.options.RelayPorts) > 0 {
+		return slices.Clone(t.options.RelayPorts)
+	}
+	if _, port, err := net.SplitHostPort(t.options.RelayAddress); err == nil && port != "" {
+		return []string{port}
+	}
+	return []string{models.DEFAULT_PORT}
+}
+
+// transferNonceSize is the size of the nonce a transfer code is derived
+// from.
+const transferNonceSize = 16
+
+// start starts a croc send of fpath in the background, reporting its
+// progress under name, and returns the nonce of its code and the size of
+// what it sends. after, if set, is called once the send is over.
+func (t *transfers) start(fpath, name string, after func(error)) (nonce []byte, size int64, err error) {
+	filesInfo, emptyFolders, totalNumberFolders, err := croc.GetFilesInfo([]string{fpath}, false, false, nil)
+	if err != nil {
+		return
+	}
+	for _, fi := range filesInfo {
+		size += fi.Size
+	}
+	nonce = make([]byte, transferNonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	cr, err := croc.New(t.crocOptions(deriveTransferCode(t.options.SharedSecret, nonce), true))
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cr.Send(filesInfo, emptyFolders, totalNumberFolders)
+	}()
+	go t.watch(cr, localize(msgTransferLabel, hex.EncodeToString(nonce[:4]), name), done, after)
+	return
+}
+
+// send starts a croc send of fpath in the background and returns the offer
+// message to announce it to the room.
+func (t *transfers) send(fpath, alias string) (m message.Message, err error) {
+	_, name := filepath.Split(filepath.Clean(fpath))
+	nonce, size, err := t.start(fpath, name, nil)
+	if err != nil {
+		return
+	}
+	m = message.Message{
+		Type:    typeTransferOffer,
+		Message: name,
+		Bytes:   nonce,
+		Num:     int(size),
+		Alias:   alias,
+	}
+	return
+}
+
+// OfferTransfer offers the file or folder at path to the room through
+// croc's transfer engine, as /transfer does, and returns the offer id the
+// peer fetches it with. progress gets the lines /transfer shows, up to the
+// one saying the transfer is done or failed.
+func (s *Session) OfferTransfer(path string, progress func(string)) (id string, err error) {
+	m, err := newTransfers(s.options, progress).send(path, s.Alias())
+	if err != nil {
+		return
+	}
+	if err = s.Send(m); err != nil {
+		return
+	}
+	return hex.EncodeToString(m.Bytes[:4]), nil
+}
+
+// FetchTransfer receives the file or folder a peer offered with m, a
+// message OfferTransfer sent, into dir, as /get does. progress gets the
+// lines /get shows, up to the one saying the transfer is done or failed.
+func (s *Session) FetchTransfer(m message.Message, dir string, progress func(string)) error {
+	if m.Type != typeTransferOffer {
+		return fmt.Errorf("not a transfer offer")
+	}
+	t := newTransfers(s.options, progress)
+	offer, err := t.received(m)
+	if err != nil {
+		return err
+	}
+	return t.fetch(offer.Nonce, dir, offer.Name, nil)
+}
+
+// received records an offer from a peer so it can later be fetched with /get.
+func (t *transfers) received(m message.Message) (offer transferOffer, err error) {
+	if len(m.Bytes) < 4 {
+		err = fmt.Errorf("malformed transfer offer")
+		return
+	}
+	_, name := filepath.Split(filepath.Clean(m.Message))
+	if err = utils.ValidFileName(name); err != nil {
+		return
+	}
+	offer = transferOffer{
+		ID:    hex.EncodeToString(m.Bytes[:4]),
+		Nonce: m.Bytes,
+		Name:  name,
+		Size:  int64(m.Num),
+		Alias: m.Alias,
+	}
+	t.mu.Lock()
+	t.offers[offer.ID] = offer
+	t.mu.Unlock()
+	return
+}
+
+// get starts receiving a previously offered transfer into dir.
+func (t *transfers) get(id, dir string) (err error) {
+	t.mu.Lock()
+	offer, ok := t.offers[strings.TrimSpace(id)]
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no transfer offer with id '%s'", id)
+	}
+	return t.fetch(offer.Nonce, dir, offer.Name, nil)
+}
+
+// fetch starts a croc receive of the transfer whose code nonce was derived
+// from into dir in the background, reporting its progress under name.
+// after, if set, is called once the receive is over.
+func (t *transfers) fetch(nonce []byte, dir, name string, after func(error)) error {
+	options := t.crocOptions(deriveTransferCode(t.options.SharedSecret, nonce), false)
+	options.OutputFolder = dir
+	return t.receive(options, nonce, name, after)
+}
+
+// fetchTo is fetch writing the file to w as it arrives instead of to disk.
+// The sender goes no faster than w takes it.
+func (t *transfers) fetchTo(nonce []byte, w io.Writer, name string, after func(error)) error {
+	options := t.crocOptions(deriveTransferCode(t.options.SharedSecret, nonce), false)
+	options.Output = w
+	return t.receive(options, nonce, name, after)
+}
+
+func (t *transfers) receive(options croc.Options, nonce []byte, name string, after func(error)) (err error) {
+	cr, err := croc.New(options)
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cr.Receive()
+	}()
+	go t.watch(cr, localize(msgTransferLabel, hex.EncodeToString(nonce[:4]), name), done, after)
+	return
+}
+
+// progressLine is the line reporting p, unless there is nothing to report
+// or nothing changed since done bytes were reported.
+func progressLine(label string, p croc.TransferProgress, done int64) (string, bool) {
+	if p.FileSize == 0 || p.Size == 0 || p.Done == done {
+		return "", false
+	}
+	return localize(msgTransferProgress, label, p.File+1, p.Files,
+		utils.ByteCountDecimal(p.FileDone), utils.ByteCountDecimal(p.FileSize), p.FileDone*100/p.FileSize,
+		utils.ByteCountDecimal(p.Done), utils.ByteCountDecimal(p.Size), p.Done*100/p.Size), true
+}
+
+// watch reports the progress of a croc transfer into the chat until it
+// finishes, and then calls after, if set, with how it went.
+func (t *transfers) watch(cr *croc.Client, label string, done <-chan error, after func(error)) {
+	ticker := time.NewTicker(transferProgressInterval)
+	defer ticker.Stop()
+	lastReported := int64(-1)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.notify(localize(msgTransferError, label, err))
+			} else {
+				t.notify(localize(msgTransferDone, label))
+			}
+			if after != nil {
+				after(err)
+			}
+			return
+		case <-ticker.C:
+			p := cr.Progress()
+			if line, ok := progressLine(label, p, lastReported); ok {
+				lastReported = p.Done
+				t.notify(line)
+			}
+		}
+	}
+}
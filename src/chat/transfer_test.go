@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeriveTransferCode(t *testing.T) {
+	nonce := []byte("0123456789abcdef")
+	code := deriveTransferCode("chat-secret", nonce)
+	assert.Regexp(t, `^\d{4}-[0-9a-f]{32}$`, code)
+	assert.Equal(t, code, deriveTransferCode("chat-secret", nonce))
+	assert.NotEqual(t, code, deriveTransferCode("other-secret", nonce))
+	assert.NotEqual(t, code, deriveTransferCode("chat-secret", []byte("fedcba9876543210")))
+}
+
+func TestTransferOfferReceived(t *testing.T) {
+	tr := newTransfers(croc.Options{SharedSecret: "chat-secret"}, func(string) {})
+	offer, err := tr.received(message.Message{
+		Type:    typeTransferOffer,
+		Message: "../../etc/passwd",
+		Bytes:   []byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4},
+		Num:     1234,
+		Alias:   "bob",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "deadbeef", offer.ID)
+	assert.Equal(t, "passwd", offer.Name)
+	assert.Equal(t, int64(1234), offer.Size)
+
+	_, err = tr.received(message.Message{Type: typeTransferOffer, Message: "x"})
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, tr.get("missing", "."))
+}
+
+func TestTransferRelayPorts(t *testing.T) {
+	tr := newTransfers(croc.Options{RelayAddress: "relay.example:9109"}, func(string) {})
+	assert.Equal(t, []string{"9109"}, tr.crocOptions("code", true).RelayPorts)
+	tr.options.RelayPorts = []string{"9209", "9210"}
+	options := tr.crocOptions("code", false)
+	assert.Equal(t, []string{"9209", "9210"}, options.RelayPorts)
+	options.RelayPorts[0] = "1"
+	assert.Equal(t, "9209", tr.options.RelayPorts[0], "the transfer has ports of its own")
+	tr.options = croc.Options{RelayAddress: "relay.example"}
+	assert.Equal(t, []string{"9009"}, tr.crocOptions("code", true).RelayPorts)
+}
+
+func TestTransferProgressLine(t *testing.T) {
+	setLanguage("en")
+	p := croc.TransferProgress{File: 1, Files: 2, FileDone: 500, FileSize: 1000, Done: 1500, Size: 3000}
+	line, ok := progressLine("#1 a", p, -1)
+	assert.True(t, ok)
+	assert.Equal(t, "#1 a: file 2/2, 500 B of 1000 B (50%), 1.5 kB of 2.9 kB in all (50%)", line)
+	_, ok = progressLine("#1 a", p, 1500)
+	assert.False(t, ok, "nothing changed")
+	_, ok = progressLine("#1 a", croc.TransferProgress{}, -1)
+	assert.False(t, ok)
+}
@@ -0,0 +1,91 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// unreadIdle is how long the user has to have typed nothing before
+// incoming messages count as unread. Without a way to ask the terminal
+// whether it has focus, a quiet keyboard is taken to mean the user is
+// looking elsewhere.
+const unreadIdle = 60 * time.Second
+
+// Terminal title sequences. The title is pushed onto the xterm title stack
+// before it is first changed and popped when it is cleared, which gives
+// back the title the user had; terminals without the stack ignore both
+// and keep the plain title set before the pop.
+const (
+	titlePush = "\x1b[22;0t"
+	titlePop  = "\x1b[23;0t"
+)
+
+// setTitle returns the OSC 0 sequence that sets the window and icon title.
+func setTitle(title string) string {
+	return "\x1b]0;" + stripANSI(title) + "\a"
+}
+
+// unreadTracker notices messages that arrive while the user is away from
+// the chat, so the first of them can be marked with a divider and the
+// terminal title can count them.
+type unreadTracker struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	lastKey time.Time
+	// count is how many messages arrived since the user was last active;
+	// titled is set once the title shows it.
+	count  int
+	titled bool
+}
+
+func newUnreadTracker(now func() time.Time) *unreadTracker {
+	return &unreadTracker{now: now, lastKey: now()}
+}
+
+// arrived counts a message and returns how many are unread, none while
+// the user is active. divider is set for the first unread message.
+func (u *unreadTracker) arrived() (count int, divider bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.now().Sub(u.lastKey) < unreadIdle {
+		return 0, false
+	}
+	u.count++
+	return u.count, u.count == 1
+}
+
+// keystroke records that the user is active and reports whether there
+// were unread messages, whose divider and title are cleared with it.
+func (u *unreadTracker) keystroke() (cleared bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.lastKey = u.now()
+	cleared = u.count > 0
+	u.count = 0
+	return
+}
+
+// title returns what to write to the terminal for count unread messages:
+// the title counting them, pushing the user's own first.
+func (u *unreadTracker) title(count int) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	seq := setTitle(localize(msgTitleUnread, count))
+	if !u.titled {
+		seq = titlePush + seq
+		u.titled = true
+	}
+	return seq
+}
+
+// clearTitle returns what to write to the terminal to take the count out
+// of the title, nothing if it never showed one.
+func (u *unreadTracker) clearTitle() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.titled {
+		return ""
+	}
+	u.titled = false
+	return setTitle(localize(msgTitle)) + titlePop
+}
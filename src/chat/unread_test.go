@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnreadTracker(t *testing.T) {
+	setLanguage("en")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	u := newUnreadTracker(func() time.Time { return now })
+
+	// nothing is unread while the user is typing
+	count, divider := u.arrived()
+	assert.Zero(t, count)
+	assert.False(t, divider)
+	assert.False(t, u.keystroke())
+	now = now.Add(unreadIdle - time.Second)
+	count, _ = u.arrived()
+	assert.Zero(t, count)
+
+	// after a quiet minute the first message gets the divider
+	now = now.Add(2 * time.Second)
+	count, divider = u.arrived()
+	assert.Equal(t, 1, count)
+	assert.True(t, divider)
+	assert.Equal(t, titlePush+"\x1b]0;(1) croc chat\a", u.title(count))
+	count, divider = u.arrived()
+	assert.Equal(t, 2, count)
+	assert.False(t, divider)
+	assert.Equal(t, "\x1b]0;(2) croc chat\a", u.title(count))
+
+	// the next keystroke clears both
+	assert.True(t, u.keystroke())
+	assert.Equal(t, "\x1b]0;croc chat\a"+titlePop, u.clearTitle())
+	assert.Empty(t, u.clearTitle())
+	count, _ = u.arrived()
+	assert.Zero(t, count)
+
+	// a later batch starts over with a divider of its own
+	now = now.Add(unreadIdle)
+	count, divider = u.arrived()
+	assert.Equal(t, 1, count)
+	assert.True(t, divider)
+	assert.False(t, u.keystroke() && u.keystroke(), "cleared once")
+}
+
+func TestSetTitle(t *testing.T) {
+	assert.Equal(t, "\x1b]0;plain\a", setTitle("pl\x1b[31main"+"\x1b]0;evil\a"))
+}
@@ -1,18 +1,24 @@
 package cli
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/chzyer/readline"
@@ -23,10 +29,12 @@ import (
 	"github.com/schollz/croc/v10/src/croc"
 	"github.com/schollz/croc/v10/src/mnemonicode"
 	"github.com/schollz/croc/v10/src/models"
+	"github.com/schollz/croc/v10/src/session"
 	"github.com/schollz/croc/v10/src/tcp"
 	"github.com/schollz/croc/v10/src/utils"
 	log "github.com/schollz/logger"
 	"github.com/schollz/pake/v3"
+	"golang.org/x/term"
 )
 
 // Version specifies the version
@@ -95,9 +103,30 @@ func Run() (err error) {
 			Action:      relay,
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "host", Usage: "host of the relay"},
+				&cli.BoolFlag{Name: "bind-exactly", Usage: "listen only on the --host address, instead of on every address when it is 127.0.0.1 or ::1"},
 				&cli.StringFlag{Name: "ports", Value: "9009,9010,9011,9012,9013", Usage: "ports of the relay"},
 				&cli.IntFlag{Name: "port", Value: 9009, Usage: "base port for the relay"},
 				&cli.IntFlag{Name: "transfers", Value: 5, Usage: "number of ports to use for relay"},
+				&cli.StringFlag{Name: "stats", Usage: "serve statistics of the base port as JSON on http://<addr>/stats, e.g. 127.0.0.1:9090"},
+				&cli.StringFlag{Name: "status", Usage: "serve a status page of the base port on http://<addr>/, e.g. 127.0.0.1:9091"},
+				&cli.StringFlag{Name: "status-user", Value: "admin", Usage: "user for the status page"},
+				&cli.StringFlag{Name: "status-pass", Usage: "password for the status page", EnvVars: []string{"CROC_STATUS_PASS"}},
+				&cli.DurationFlag{Name: "conn-idle-timeout", Usage: "drop connections of the base port that send nothing for this long, e.g. 30m (0 to disable)"},
+				&cli.BoolFlag{Name: "keepalive-is-activity", Usage: "count keepalive frames as activity for --conn-idle-timeout"},
+				&cli.DurationFlag{Name: "sniff-timeout", Value: tcp.DEFAULT_SNIFF_TIMEOUT, Usage: "close connections of the base port whose first frame is not from croc or takes longer than this (0 to disable)"},
+				&cli.DurationFlag{Name: "handshake-timeout", Value: tcp.DEFAULT_HANDSHAKE_TIMEOUT, Usage: "close connections of the base port that have not finished the handshake and asked for a room within this long (0 to disable)"},
+				&cli.Int64Flag{Name: "room-quota", Usage: "bytes a room may relay before it is closed, on every port (0 for no quota)"},
+				&cli.Float64Flag{Name: "quota-warning", Value: tcp.DEFAULT_QUOTA_WARNING, Usage: "warn rooms that have used this fraction of --room-quota (0 to disable)"},
+				&cli.DurationFlag{Name: "expiry-warning", Value: tcp.DEFAULT_EXPIRY_WARNING, Usage: "warn rooms this long before they expire (0 to disable)"},
+				&cli.IntFlag{Name: "max-rooms-per-ip", Usage: "how many rooms connections from one IP can be in at once (0 for no limit)"},
+				&cli.StringSliceFlag{Name: "blocked-clients", Usage: "refuse clients of the base port whose version matches, asking them to upgrade, e.g. 'croc-chat/10.1.* *' (* matches anything)"},
+				&cli.StringFlag{Name: "setuid", Usage: "switch to this user after binding the ports (Linux, needs root)"},
+				&cli.StringSliceFlag{Name: "cluster", Usage: "hosts of every relay of a cluster behind one name, this one included, so peers of a room meet on the relay that owns it"},
+				&cli.StringFlag{Name: "cluster-self", Usage: "host of this relay, as listed in --cluster"},
+				&cli.StringFlag{Name: "cluster-policy", Value: string(tcp.ClusterRedirect), Usage: "send clients to the relay owning their room with 'redirect', or 'proxy' them there"},
+				&cli.IntFlag{Name: "log-sampling", Value: tcp.DEFAULT_LOG_SAMPLING, Usage: "debug lines of each kind the relay writes a second, counting the rest (0 writes every line)"},
+				&cli.StringFlag{Name: "config", Usage: "JSON file setting pass, max-rooms-per-ip and blocked-clients where their flags are not set, read again along with the --pass file on reload (SIGHUP, or paramchange with --service)"},
+				&cli.BoolFlag{Name: "service", Usage: "run under the Windows service manager as service " + tcp.ServiceName + "; stopping the service stops the relay"},
 			},
 		},
 		{
@@ -107,6 +136,33 @@ func Run() (err error) {
 			HelpName:    "croc chat",
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "code", Usage: "code to enter"},
+				&cli.StringFlag{Name: "room-name", Usage: "join a room saved with /bookmark"},
+				&cli.BoolFlag{Name: "list-bookmarks", Usage: "list saved rooms and exit"},
+				&cli.BoolFlag{Name: "no-thumbnails", Usage: "do not attach previews to offered images"},
+				&cli.BoolFlag{Name: "low-bandwidth", Usage: "save bytes on metered links: batch receipts, compress messages, attach no previews, confirm every file and tell peers; '/stats' shows the bytes used"},
+				&cli.BoolFlag{Name: "no-file-metadata", Usage: "save received files with mode 0644 and the current time instead of the sender's mode and modification time, e.g. in rooms you do not trust"},
+				&cli.BoolFlag{Name: "keep-exec-bit", Usage: "also keep the executable bits of received files"},
+				&cli.BoolFlag{Name: "link-previews", Usage: "fetch and show the titles of http(s) links peers post"},
+				&cli.BoolFlag{Name: "no-confirm", Usage: "chat right away in rooms with weak codes instead of confirming each peer's fingerprint with /confirm first"},
+				&cli.BoolFlag{Name: "require-e2e", Usage: "refuse to join unless chat messages are end-to-end encrypted, which this version does not do yet; '/security' shows what protects a session"},
+				&cli.BoolFlag{Name: "direct", Usage: "once the peer, also with --direct, is reachable, send messages straight to it over WebRTC rather than through the relay, which then only sets the connection up; falls back to the relay if the connection drops, in rooms of two"},
+				&cli.StringFlag{Name: "ice-servers", Usage: "comma separated STUN or TURN URLs without credentials, e.g. stun:stun.l.google.com:19302, that --direct gathers from to reach peers behind NAT"},
+				&cli.BoolFlag{Name: "keep-identity", Usage: "sign messages with the same key every time you join this room, kept in the config directory, so peers can tell it is still you"},
+				&cli.BoolFlag{Name: "observe", Usage: "join read-only: receive messages without sending any; peers see you as an observer"},
+				&cli.BoolFlag{Name: "no-observers", Usage: "keep observers out of the room, if this client is the one that opens it, and warn about any that watch anyway"},
+				&cli.BoolFlag{Name: "no-receipts", Usage: "do not acknowledge received messages; a room opened with it has nobody acknowledge them"},
+				&cli.BoolFlag{Name: "no-history", Usage: "do not allow saving the conversation with /save in this room"},
+				&cli.DurationFlag{Name: "ephemeral-default", Usage: "make chat messages in this room disappear after this long, e.g. 10m"},
+				&cli.StringFlag{Name: "lang", Usage: "language of chat messages, e.g. de; defaults to LANG"},
+				&cli.BoolFlag{Name: "no-color", Usage: "disable colored output; also off with NO_COLOR or when stdout is not a terminal"},
+				&cli.BoolFlag{Name: "bell", Usage: "ring the terminal bell for incoming messages, except during the quiet hours set with /quiet or in chat_quiet.json in the config directory"},
+				&cli.BoolFlag{Name: "urgent-mentions", Usage: "ring the bell during quiet hours for messages that mention your alias"},
+				&cli.BoolFlag{Name: "reaction-alerts", Usage: "treat reactions to your messages like new messages, which ring the bell with --bell; they are quiet otherwise"},
+				&cli.StringFlag{Name: "commands", Usage: "JSON file mapping slash commands to executables; defaults to chat_commands.json in the config directory"},
+				&cli.BoolFlag{Name: "no-preflight", Usage: "join without first checking that the relay answers and accepts the password, for relays that drop such probes"},
+				&cli.BoolFlag{Name: "send-stdin", Usage: "send standard input to the room, wait for delivery and exit"},
+				&cli.StringFlag{Name: "alias", Usage: "alias to use with --send-stdin"},
+				&cli.DurationFlag{Name: "timeout", Value: chat.DefaultOneShotPeerTimeout, Usage: "how long --send-stdin waits for a peer"},
 			},
 			Action: func(c *cli.Context) error {
 				if c.Bool("debug") {
@@ -114,6 +170,9 @@ func Run() (err error) {
 				} else {
 					log.SetLevel("info")
 				}
+				if c.Bool("list-bookmarks") {
+					return chat.PrintBookmarks(os.Stdout)
+				}
 				// Get code from flag, argument, or env.
 				code := c.String("code")
 				if code == "" && c.Args().Present() {
@@ -122,6 +181,29 @@ func Run() (err error) {
 				if code == "" {
 					code = os.Getenv("CROC_SECRET")
 				}
+				if code == "" && c.String("room-name") != "" {
+					bookmarks, err := chat.DefaultBookmarks()
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Passphrase for '%s': ", c.String("room-name"))
+					passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+					fmt.Println()
+					if err != nil {
+						return err
+					}
+					if code, err = bookmarks.Load(c.String("room-name"), string(passphrase)); err != nil {
+						return err
+					}
+				}
+				// standard input is the message to send, so there is no
+				// prompting for the code
+				if c.Bool("send-stdin") {
+					if code == "" {
+						return fmt.Errorf("--send-stdin needs a code from --code, an argument or CROC_SECRET")
+					}
+					return chat.SendStdin(c, code)
+				}
 				if code == "" {
 					fmt.Print("Enter chat code: ")
 					code = strings.TrimSpace(utils.GetInput(""))
@@ -136,30 +218,55 @@ func Run() (err error) {
 			Usage:       "start an audio call with a peer using a shared code",
 			Description: "initiate audio calling via the relay",
 			HelpName:    "croc audio",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "code", Usage: "code for the call"},
-				// you may add other call-specific flags here
-			},
+				&cli.StringFlag{Name: "direction", Value: string(call.DirectionSendRecv), Usage: "sendrecv, sendonly or recvonly (recvonly needs no microphone)"},
+				&cli.BoolFlag{Name: "echo-test", Usage: "play the microphone back a second later through the call codec, no peer needed"},
+				&cli.DurationFlag{Name: "echo-duration", Value: 10 * time.Second, Usage: "how long the echo test records"},
+				&cli.StringFlag{Name: "signal-log", Usage: "append every call signal, with credentials redacted, to this file for debugging"},
+			}, slices.Concat(audioFlags, degradeFlags, capFlags, networkFlags, iceFlags, captionFlags, recordFlags, preflightFlags)...),
 			Action: func(c *cli.Context) error {
+				if c.Bool("echo-test") {
+					return call.StartEchoTest(c.Duration("echo-duration"))
+				}
+				dir, err := call.ParseDirection(c.String("direction"))
+				if err != nil {
+					return err
+				}
+				network, err := networkOptions(c)
+				if err != nil {
+					return err
+				}
 				options := croc.Options{
 					SharedSecret:  c.String("code"),
-					IsSender:      true, // caller initiates call
 					Debug:         c.Bool("debug"),
 					RelayAddress:  c.String("relay"),
 					RelayAddress6: c.String("relay6"),
 					RelayPassword: c.String("pass"),
+					App:           tcp.ClientApp("croc-call", Version),
 				}
 				// If no code is provided, prompt the user.
 				if options.SharedSecret == "" {
 					fmt.Print("Enter call code: ")
 					options.SharedSecret = strings.TrimSpace(utils.GetInput(""))
 				}
-				// Generate room name as done in chat
-
-				hashExtra := "croc"
-				roomNameBytes := sha256.Sum256([]byte(options.SharedSecret + hashExtra))
-				options.RoomName = hex.EncodeToString(roomNameBytes[:])
-				return call.StartAudioCall(options)
+				signalLog, err := openSignalLog(c)
+				if err != nil {
+					return err
+				}
+				defer signalLog.Close()
+				summary, err := openCallSummary(c)
+				if err != nil {
+					return err
+				}
+				defer summary.Close()
+				co := call.CallOptions{Audio: audioOptions(c), Degrade: degradeOptions(c), Network: network, ICE: iceOptions(c), SignalLog: signalLog,
+					Captions: captionOptions(c), Record: recordOptions(c), Summary: summary}
+				co.MaxSendBitrate, co.MaxRecvBitrate = capOptions(c)
+				if co.Preflight, err = preflight(c); err != nil {
+					return err
+				}
+				return placeCall(options, call.MediaAudio, dir, co)
 			},
 		},
 		{
@@ -167,27 +274,132 @@ func Run() (err error) {
 			Usage:       "start a video call with a peer using a shared code",
 			Description: "initiate video calling via the relay",
 			HelpName:    "croc video",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "code", Usage: "code for the call"},
-				// additional video call flags can be added here
+				&cli.StringFlag{Name: "direction", Value: string(call.DirectionSendRecv), Usage: "sendrecv, sendonly or recvonly (recvonly needs no camera)"},
+				&cli.BoolFlag{Name: "simulcast", Usage: "experimental: send the camera in several resolutions and pause those the bandwidth limit cannot carry"},
+				&cli.IntFlag{Name: "simulcast-layers", Value: call.DefaultVideoOptions().SimulcastLayers, Usage: "how many resolutions to send with --simulcast, 2 or 3"},
+				&cli.StringFlag{Name: "fallback", Value: string(call.FallbackRecvOnly), Usage: "if the peer has no camera: recvonly to only send them video, or audio to place an audio call instead"},
+				&cli.DurationFlag{Name: "stall-timeout", Value: call.DefaultStallTimeout, Usage: "reopen the camera once if it produces no frames for this long after the call connects (negative to disable)"},
+				&cli.StringFlag{Name: "alias", Usage: "name the peer is given for you, e.g. when your camera stalls"},
+				&cli.StringFlag{Name: "signal-log", Usage: "append every call signal, with credentials redacted, to this file for debugging"},
+			}, slices.Concat(degradeFlags, capFlags, networkFlags, iceFlags, captionFlags, preflightFlags)...),
+			Action: func(c *cli.Context) error {
+				dir, err := call.ParseDirection(c.String("direction"))
+				if err != nil {
+					return err
+				}
+				fallback, err := call.ParseVideoFallback(c.String("fallback"))
+				if err != nil {
+					return err
+				}
+				network, err := networkOptions(c)
+				if err != nil {
+					return err
+				}
+				options := croc.Options{
+					SharedSecret:  c.String("code"),
+					Debug:         c.Bool("debug"),
+					RelayAddress:  c.String("relay"),
+					RelayAddress6: c.String("relay6"),
+					RelayPassword: c.String("pass"),
+					App:           tcp.ClientApp("croc-call", Version),
+				}
+				if options.SharedSecret == "" {
+					fmt.Print("Enter call code: ")
+					options.SharedSecret = strings.TrimSpace(utils.GetInput(""))
+				}
+				signalLog, err := openSignalLog(c)
+				if err != nil {
+					return err
+				}
+				defer signalLog.Close()
+				summary, err := openCallSummary(c)
+				if err != nil {
+					return err
+				}
+				defer summary.Close()
+				co := call.CallOptions{Video: call.VideoOptions{
+					Simulcast:       c.Bool("simulcast"),
+					SimulcastLayers: c.Int("simulcast-layers"),
+					Fallback:        fallback,
+					StallTimeout:    c.Duration("stall-timeout"),
+				}, Audio: call.DefaultAudioOptions(), Degrade: degradeOptions(c), Network: network, ICE: iceOptions(c), SignalLog: signalLog,
+					Captions: captionOptions(c), Summary: summary, Alias: c.String("alias")}
+				co.MaxSendBitrate, co.MaxRecvBitrate = capOptions(c)
+				if co.Preflight, err = preflight(c); err != nil {
+					return err
+				}
+				return placeCall(options, call.MediaVideo, dir, co)
 			},
+		},
+		{
+			Name:        "call",
+			Usage:       "wait for audio or video calls from a peer using a shared code",
+			Description: "answer calls placed with 'croc audio' or 'croc video', optionally unattended",
+			HelpName:    "croc call",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{Name: "code", Usage: "code for the call", EnvVars: []string{"CROC_CALL_CODE"}},
+				&cli.BoolFlag{Name: "listen", Usage: "wait in the call room and answer invites, one call at a time"},
+				&cli.BoolFlag{Name: "auto-answer", Usage: "answer without asking; never reads standard input"},
+				&cli.BoolFlag{Name: "send-only-video", Usage: "only answer calls where this side sends video and nothing else"},
+				&cli.StringFlag{Name: "signal-log", Usage: "append every call signal, with credentials redacted, to this file for debugging"},
+			}, slices.Concat(audioFlags, degradeFlags, capFlags, networkFlags, iceFlags)...),
 			Action: func(c *cli.Context) error {
+				if !c.Bool("listen") {
+					return fmt.Errorf("croc call only answers calls, add --listen; use 'croc audio' or 'croc video' to place one")
+				}
+				network, err := networkOptions(c)
+				if err != nil {
+					return err
+				}
 				options := croc.Options{
 					SharedSecret:  c.String("code"),
-					IsSender:      true,
 					Debug:         c.Bool("debug"),
 					RelayAddress:  c.String("relay"),
 					RelayAddress6: c.String("relay6"),
 					RelayPassword: c.String("pass"),
+					App:           tcp.ClientApp("croc-call", Version),
 				}
 				if options.SharedSecret == "" {
+					if c.Bool("auto-answer") {
+						return fmt.Errorf("--auto-answer needs --code or CROC_CALL_CODE")
+					}
 					fmt.Print("Enter call code: ")
 					options.SharedSecret = strings.TrimSpace(utils.GetInput(""))
 				}
-				hashExtra := "croc"
-				roomNameBytes := sha256.Sum256([]byte(options.SharedSecret + hashExtra))
-				options.RoomName = hex.EncodeToString(roomNameBytes[:])
-				return call.StartVideoCall(options)
+				warnWeakCode(options.SharedSecret)
+				signalLog, err := openSignalLog(c)
+				if err != nil {
+					return err
+				}
+				defer signalLog.Close()
+				lo := call.ListenOptions{
+					AutoAnswer: c.Bool("auto-answer"),
+					Policy:     call.AnswerPolicy{SendOnlyVideo: c.Bool("send-only-video")},
+					Audio:      audioOptions(c),
+					Degrade:    degradeOptions(c),
+					Network:    network,
+					ICE:        iceOptions(c),
+					SignalLog:  signalLog,
+					Confirm: func(dirs call.Directions) bool {
+						fmt.Printf("Incoming call (%s). Accept? (yes/no): ", dirs.Describe())
+						return strings.ToLower(strings.TrimSpace(utils.GetInput(""))) == "yes"
+					},
+				}
+				lo.MaxSendBitrate, lo.MaxRecvBitrate = capOptions(c)
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				defer stop()
+				sess, err := session.New(ctx, options)
+				if err != nil {
+					return err
+				}
+				defer sess.Close()
+				go func() {
+					for range sess.Events() {
+					}
+				}()
+				return sess.Listen(ctx, lo)
 			},
 		},
 	}
@@ -356,6 +568,200 @@ func determinePass(c *cli.Context) (pass string) {
 	return
 }
 
+// audioFlags tune the Opus encoder of the commands that send audio.
+var audioFlags = []cli.Flag{
+	&cli.BoolFlag{Name: "fec", Value: call.DefaultAudioOptions().FEC, Usage: "send forward error correction so the peer can rebuild lost audio packets"},
+	&cli.IntFlag{Name: "expected-loss", Value: call.DefaultAudioOptions().ExpectedLossPct, Usage: "packet loss in percent the audio encoder prepares for"},
+	&cli.IntFlag{Name: "opus-complexity", Value: call.DefaultAudioOptions().Complexity, Usage: "audio encoder complexity from 0 (cheapest) to 10 (best)"},
+	&cli.BoolFlag{Name: "warm-up", Usage: "start the microphone while the call rings so audio flows as soon as it connects; nothing is sent before the call is answered"},
+	&cli.BoolFlag{Name: "no-tones", Usage: "play no ring-back tone while placing a call, nor the chimes when it connects and ends"},
+}
+
+// audioOptions reads the flags in audioFlags.
+func audioOptions(c *cli.Context) call.AudioOptions {
+	return call.AudioOptions{
+		FEC:             c.Bool("fec"),
+		ExpectedLossPct: c.Int("expected-loss"),
+		Complexity:      c.Int("opus-complexity"),
+		WarmUp:          c.Bool("warm-up"),
+		NoTones:         c.Bool("no-tones"),
+	}
+}
+
+// degradeFlags set when calls pause the video they send on a poor network.
+var degradeFlags = []cli.Flag{
+	&cli.BoolFlag{Name: "no-video-pause", Usage: "keep sending video however poor the network gets"},
+	&cli.IntFlag{Name: "video-floor", Value: int(call.DefaultDegradeOptions().Floor / 1000), Usage: "pause the video sent while the estimated bandwidth stays under this many kbit/s"},
+	&cli.IntFlag{Name: "video-resume", Value: int(call.DefaultDegradeOptions().Resume / 1000), Usage: "resume paused video once the estimated bandwidth stays at this many kbit/s"},
+	&cli.DurationFlag{Name: "video-pause-after", Value: call.DefaultDegradeOptions().After, Usage: "how long the bandwidth has to stay under --video-floor before the video pauses"},
+}
+
+// capFlags cap the bitrate of calls in each direction.
+var capFlags = []cli.Flag{
+	&cli.IntFlag{Name: "max-send-kbps", Usage: "send at most this many kbit/s on the call"},
+	&cli.IntFlag{Name: "max-recv-kbps", Usage: "ask the peer to send at most this many kbit/s, and warn if it sends more"},
+}
+
+// capOptions reads the flags in capFlags, in bits per second.
+func capOptions(c *cli.Context) (send, recv int64) {
+	return int64(c.Int("max-send-kbps")) * 1000, int64(c.Int("max-recv-kbps")) * 1000
+}
+
+// degradeOptions reads the flags in degradeFlags.
+func degradeOptions(c *cli.Context) call.DegradeOptions {
+	return call.DegradeOptions{
+		Disabled:    c.Bool("no-video-pause"),
+		Floor:       int64(c.Int("video-floor")) * 1000,
+		After:       c.Duration("video-pause-after"),
+		Resume:      int64(c.Int("video-resume")) * 1000,
+		ResumeAfter: call.DefaultDegradeOptions().ResumeAfter,
+	}
+}
+
+// preflightFlags check the network before a call is placed.
+var preflightFlags = []cli.Flag{
+	&cli.BoolFlag{Name: "preflight", Usage: "before calling, check how this network reaches peers and whether the call will need a TURN server"},
+	&cli.StringFlag{Name: "stun", Value: strings.Join(call.DefaultSTUNServers, ","), Usage: "comma separated STUN servers --preflight asks"},
+	&cli.StringFlag{Name: "turn", Usage: "TURN server, as host:port, --preflight tries to allocate a relayed address on"},
+	&cli.StringFlag{Name: "turn-user", Usage: "user name for --turn"},
+	&cli.StringFlag{Name: "turn-pass", Usage: "password for --turn", EnvVars: []string{"CROC_TURN_PASS"}},
+}
+
+// preflight runs the check of preflightFlags, if asked to, and prints its
+// report.
+func preflight(c *cli.Context) (*call.Report, error) {
+	if !c.Bool("preflight") {
+		return nil, nil
+	}
+	opts := call.DefaultPreflightOptions()
+	opts.STUNServers = nil
+	for _, server := range strings.Split(c.String("stun"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			opts.STUNServers = append(opts.STUNServers, server)
+		}
+	}
+	if c.String("turn") != "" {
+		opts.TURN = &call.TURNServer{Address: c.String("turn"), Username: c.String("turn-user"), Password: c.String("turn-pass")}
+	}
+	fmt.Fprintln(os.Stderr, "Checking the network...")
+	report, err := call.Preflight(opts)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, report)
+	return &report, nil
+}
+
+// networkFlags mark the traffic of calls and pin the ports ICE uses.
+var networkFlags = []cli.Flag{
+	&cli.StringFlag{Name: "dscp", Usage: "mark call media with this DSCP, a number or a name like ef or af41, for networks that prioritize by it"},
+	&cli.StringFlag{Name: "signaling-dscp", Usage: "mark the connection to the relay with this DSCP"},
+	&cli.UintFlag{Name: "ice-port-min", Usage: "lowest local UDP port for call media, with --ice-port-max"},
+	&cli.UintFlag{Name: "ice-port-max", Usage: "highest local UDP port for call media, with --ice-port-min"},
+}
+
+// networkOptions reads the flags in networkFlags.
+func networkOptions(c *cli.Context) (o call.NetworkOptions, err error) {
+	if o.MediaDSCP, err = call.ParseDSCP(c.String("dscp")); err != nil {
+		return
+	}
+	if o.SignalingDSCP, err = call.ParseDSCP(c.String("signaling-dscp")); err != nil {
+		return
+	}
+	if c.Uint("ice-port-min") > math.MaxUint16 || c.Uint("ice-port-max") > math.MaxUint16 {
+		return o, fmt.Errorf("ICE ports cannot be above %d", math.MaxUint16)
+	}
+	o.PortMin, o.PortMax = uint16(c.Uint("ice-port-min")), uint16(c.Uint("ice-port-max"))
+	return o, o.Validate()
+}
+
+// iceFlags give calls STUN and TURN servers.
+var iceFlags = []cli.Flag{
+	&cli.StringFlag{Name: "ice-servers", Usage: "comma separated STUN or TURN URLs without credentials, e.g. stun:stun.l.google.com:19302, the call always gathers from"},
+	&cli.StringFlag{Name: "turn-credential-url", Usage: "fetch short-lived TURN credentials from this URL, in the JSON of coturn's REST API, as each call is set up"},
+	&cli.StringFlag{Name: "turn-token", Usage: "bearer token for --turn-credential-url", EnvVars: []string{"CROC_TURN_TOKEN"}},
+	&cli.StringFlag{Name: "turn-secret", Usage: "secret that signs the requests to --turn-credential-url with an HMAC instead of a token", EnvVars: []string{"CROC_TURN_SECRET"}},
+}
+
+// iceOptions reads the flags in iceFlags.
+func iceOptions(c *cli.Context) call.ICEOptions {
+	return call.ICEOptions{
+		Servers:           call.ParseICEServers(c.String("ice-servers")),
+		TURNCredentialURL: c.String("turn-credential-url"),
+		TURNToken:         c.String("turn-token"),
+		TURNSecret:        c.String("turn-secret"),
+	}
+}
+
+// openSignalLog opens the transcript named by --signal-log, if any.
+func openSignalLog(c *cli.Context) (*call.SignalLog, error) {
+	if c.String("signal-log") == "" {
+		return nil, nil
+	}
+	return call.OpenSignalLog(c.String("signal-log"))
+}
+
+// captionFlags caption calls and summarize them to a file.
+var captionFlags = []cli.Flag{
+	&cli.StringFlag{Name: "captions-cmd", Usage: "caption the peer with this command, split on spaces, which reads 16 bit little endian mono audio at 48 kHz on stdin and writes a caption per line"},
+	&cli.StringFlag{Name: "call-summary", Usage: "append when the call started and ended, its captions and how the peer acknowledged its recording, to this file"},
+}
+
+// recordFlags record what the peer says, once the peer acknowledges it.
+var recordFlags = []cli.Flag{
+	&cli.StringFlag{Name: "record", Usage: "record the audio the peer sends to this WAV file, once the peer acknowledges the recording"},
+	&cli.DurationFlag{Name: "record-consent-timeout", Value: call.DefaultConsentTimeout, Usage: "how long to wait for the peer to acknowledge the recording, after which r and Enter records anyway"},
+}
+
+// recordOptions reads recordFlags.
+func recordOptions(c *cli.Context) call.RecordOptions {
+	return call.RecordOptions{File: c.String("record"), ConsentTimeout: c.Duration("record-consent-timeout")}
+}
+
+// captionOptions reads --captions-cmd.
+func captionOptions(c *cli.Context) call.CaptionOptions {
+	return call.CaptionOptions{Command: strings.Fields(c.String("captions-cmd"))}
+}
+
+// openCallSummary opens the summary named by --call-summary, if any.
+func openCallSummary(c *cli.Context) (*call.CallSummary, error) {
+	if c.String("call-summary") == "" {
+		return nil, nil
+	}
+	return call.OpenCallSummary(c.String("call-summary"))
+}
+
+// warnWeakCode warns when a code is easy to guess.
+func warnWeakCode(code string) {
+	if _, err := croc.ValidateCode(code); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", err)
+	}
+}
+
+// placeCall places a call of kind through a session for the code of
+// options and runs it from the keyboard until it ends or is interrupted.
+func placeCall(options croc.Options, kind call.MediaKind, dir call.Direction, co call.CallOptions) error {
+	warnWeakCode(options.SharedSecret)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sess, err := session.New(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	// the call reports itself on the terminal
+	go func() {
+		for range sess.Events() {
+		}
+	}()
+	cs, err := sess.Call(kind, dir, co)
+	if err != nil {
+		return err
+	}
+	cs.Interact(os.Stdin)
+	return nil
+}
+
 func send(c *cli.Context) (err error) {
 	setDebugLevel(c)
 	comm.Socks5Proxy = c.String("socks5")
@@ -519,7 +925,7 @@ Or you can go back to the classic croc behavior by enabling classic mode:
 
 	if len(crocOptions.SharedSecret) == 0 {
 		// generate code phrase
-		crocOptions.SharedSecret = utils.GetRandomName()
+		crocOptions.SharedSecret = croc.GenerateCode(croc.DefaultCodeWords)
 	}
 	minimalFileInfos, emptyFoldersToTransfer, totalNumberFolders, err := croc.GetFilesInfo(fnames, crocOptions.ZipFolder, crocOptions.GitIgnore, crocOptions.Exclude)
 	if err != nil {
@@ -844,17 +1250,176 @@ func relay(c *cli.Context) (err error) {
 		}
 	}
 
-	tcpPorts := strings.Join(ports[1:], ",")
+	clusterPolicy, err := tcp.ParseClusterPolicy(c.String("cluster-policy"))
+	if err != nil {
+		return err
+	}
+	if c.IsSet("cluster") && !slices.Contains(c.StringSlice("cluster"), c.String("cluster-self")) {
+		return fmt.Errorf("--cluster-self must be one of the --cluster hosts")
+	}
+	// each port forms a cluster with the same port of the other relays
+	cluster := func(port string) (self string, peers []string, policy tcp.ClusterPolicy) {
+		for _, peer := range c.StringSlice("cluster") {
+			peers = append(peers, net.JoinHostPort(peer, port))
+		}
+		return net.JoinHostPort(c.String("cluster-self"), port), peers, clusterPolicy
+	}
+
+	// bind every port before any relay starts, so the base relay can drop
+	// privileges without the others losing a privileged port; sockets
+	// handed over by the relay process this one replaces, or else from
+	// systemd socket activation, are used for the ports they are bound to
+	upgrader, err := tcp.NewUpgrader()
+	if err != nil {
+		return err
+	}
+	handedOver := upgrader.Listeners()
+	inherited, err := tcp.ActivationListeners()
+	if err != nil {
+		return err
+	}
+	inherited = append(handedOver, inherited...)
+	listen := tcp.Listen
+	if c.Bool("bind-exactly") {
+		listen = tcp.ListenExactly
+	}
+	listeners := make([]net.Listener, len(ports))
 	for i, port := range ports {
-		if i == 0 {
+		if listeners[i] = tcp.ListenerOnPort(inherited, port); listeners[i] != nil {
+			if slices.Contains(handedOver, listeners[i]) {
+				log.Debugf("using socket of the previous relay for port %s", port)
+			} else {
+				log.Debugf("using socket from systemd for port %s", port)
+			}
 			continue
 		}
-		go func(portStr string) {
-			err := tcp.Run(debugString, host, portStr, determinePass(c))
-			if err != nil {
-				panic(err)
+		if listeners[i], err = listen(host, port); err != nil {
+			for _, l := range append(listeners[:i], inherited...) {
+				l.Close()
 			}
-		}(port)
+			return err
+		}
 	}
-	return tcp.Run(debugString, host, ports[0], determinePass(c), tcpPorts)
+	for _, l := range inherited {
+		if !slices.Contains(listeners, l) {
+			log.Warnf("ignoring inherited socket on %s, it is not one of the relay ports", l.Addr())
+			l.Close()
+		}
+	}
+	// the previous relay drains once this one holds the sockets
+	if err = upgrader.Ready(); err != nil {
+		log.Warnf("could not tell the previous relay to drain: %v", err)
+	}
+	// the base port has the settings of the relay; the others only check
+	// the password
+	tcpPorts := strings.Join(ports[1:], ",")
+	config, err := relayConfig(c)
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	reloader := tcp.NewReloader()
+	reload := func() {
+		config, err := relayConfig(c)
+		if err != nil {
+			log.Errorf("not reloading: %v", err)
+			return
+		}
+		for i, port := range ports {
+			portConfig := tcp.RelayConfig{Password: config.Password}
+			if i == 0 {
+				portConfig = config
+				portConfig.Banner = tcpPorts
+			}
+			if err := reloader.Reload(port, portConfig); err != nil {
+				log.Errorf("could not reload the relay on port %s: %v", port, err)
+			}
+		}
+	}
+	return tcp.RunProcess(c.Bool("service"), func(ctx context.Context) error {
+		// closing the listeners shuts the relays down; SIGUSR2 hands them
+		// over to a new relay process, on Linux and macOS
+		go func() {
+			<-ctx.Done()
+			for _, l := range listeners {
+				l.Close()
+			}
+		}()
+		go func() {
+			if err := upgrader.UpgradeOnSignal(ctx); err != nil {
+				log.Debugf("%v", err)
+			}
+		}()
+
+		// transfers use every port, so every port enforces the room quota
+		limits := tcp.WithRoomByteQuota(c.Int64("room-quota"))
+		warnings := tcp.WithLimitWarnings(c.Float64("quota-warning"), c.Duration("expiry-warning"))
+
+		// relays return once their rooms are drained after a handoff, so
+		// the process waits for all of them
+		var relays sync.WaitGroup
+		for i, port := range ports {
+			if i == 0 {
+				continue
+			}
+			relays.Add(1)
+			go func(portStr string, l net.Listener) {
+				defer relays.Done()
+				err := tcp.RunWithOptionsAsync(host, portStr, config.Password, tcp.WithLogLevel(debugString), tcp.WithLogSampling(c.Int("log-sampling")), tcp.WithListener(l), tcp.WithUpgrader(upgrader),
+					tcp.WithReloader(reloader), tcp.WithCluster(cluster(portStr)), limits, warnings)
+				if err != nil {
+					panic(err)
+				}
+			}(port, listeners[i])
+		}
+		err := tcp.RunWithOptionsAsync(host, ports[0], config.Password, tcp.WithBanner(tcpPorts), tcp.WithLogLevel(debugString), tcp.WithLogSampling(c.Int("log-sampling")), tcp.WithStatsAddress(c.String("stats")),
+			tcp.WithStatusPage(c.String("status"), c.String("status-user"), c.String("status-pass")), tcp.WithVersion(Version),
+			tcp.WithConnIdleTimeout(c.Duration("conn-idle-timeout")), tcp.WithKeepalivesAsActivity(c.Bool("keepalive-is-activity")),
+			tcp.WithMaxRoomsPerIP(config.MaxRoomsPerIP), tcp.WithBlockedClients(config.BlockedClients), tcp.WithSniffTimeout(c.Duration("sniff-timeout")), tcp.WithHandshakeTimeout(c.Duration("handshake-timeout")), tcp.WithListener(listeners[0]), tcp.WithBindExactly(c.Bool("bind-exactly")), tcp.WithSetuid(c.String("setuid")), tcp.WithUpgrader(upgrader),
+			tcp.WithReloader(reloader), tcp.WithCluster(cluster(ports[0])), limits, warnings)
+		if err == nil {
+			relays.Wait()
+		}
+		return err
+	}, reload)
+}
+
+// relayConfigFile is what the file named by relay --config can set, under
+// the names of the flags.
+type relayConfigFile struct {
+	Pass           *string  `json:"pass"`
+	MaxRoomsPerIP  *int     `json:"max-rooms-per-ip"`
+	BlockedClients []string `json:"blocked-clients"`
+}
+
+// relayConfig reads the settings a running relay can reload from the flags
+// and the --pass and --config files; a setting of the --config file
+// applies unless its flag is set.
+func relayConfig(c *cli.Context) (config tcp.RelayConfig, err error) {
+	config = tcp.RelayConfig{Password: determinePass(c), MaxRoomsPerIP: c.Int("max-rooms-per-ip"), BlockedClients: c.StringSlice("blocked-clients")}
+	if c.String("config") == "" {
+		return
+	}
+	b, err := os.ReadFile(c.String("config"))
+	if err != nil {
+		return
+	}
+	var file relayConfigFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&file); err != nil {
+		return config, fmt.Errorf("could not read %s: %w", c.String("config"), err)
+	}
+	if file.Pass != nil && !c.IsSet("pass") {
+		config.Password = *file.Pass
+	}
+	if file.MaxRoomsPerIP != nil && !c.IsSet("max-rooms-per-ip") {
+		config.MaxRoomsPerIP = *file.MaxRoomsPerIP
+	}
+	if file.BlockedClients != nil && !c.IsSet("blocked-clients") {
+		config.BlockedClients = file.BlockedClients
+	}
+	return
 }
@@ -3,6 +3,7 @@ package comm
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -21,9 +22,34 @@ var HttpProxy = ""
 
 var MAGIC_BYTES = []byte("croc")
 
+// EOF_MAGIC_BYTES start the frame that says the sender is done sending. The
+// frame has no length or payload.
+var EOF_MAGIC_BYTES = []byte("cEOF")
+
+// CapabilityEOF is advertised by relays and peers that understand EOF
+// frames. Peers that do not would treat one as a broken connection.
+const CapabilityEOF = "eof"
+
+// ErrPeerDone is returned by Receive when the peer sent an EOF frame: it
+// finished sending on purpose, as opposed to the connection breaking.
+var ErrPeerDone = errors.New("peer finished sending")
+
+// ErrEOFUnsupported is returned by SendEOF when EOF frames were not
+// enabled for the connection.
+var ErrEOFUnsupported = errors.New("peer does not understand EOF frames")
+
 // Comm is some basic TCP communication
 type Comm struct {
 	connection net.Conn
+	// eof is set once both ends, and any relay between them, are known to
+	// understand EOF frames.
+	eof bool
+	// relayCapabilities are those the relay announced in its handshake.
+	relayCapabilities []string
+	// relayKey is the key of the handshake with the relay.
+	relayKey []byte
+	// sessionTag is what the relay calls this connection in its room.
+	sessionTag string
 }
 
 // NewConnection gets a new comm to a tcp address
@@ -109,6 +135,96 @@ func (c *Comm) Connection() net.Conn {
 	return c.connection
 }
 
+// EnableEOF marks the connection as one whose peer, and any relay on the
+// way, understands EOF frames. Call it only after negotiating that, as
+// SendEOF refuses to send the frame otherwise.
+func (c *Comm) EnableEOF() {
+	c.eof = true
+}
+
+// EOFEnabled reports whether EnableEOF was called.
+func (c *Comm) EOFEnabled() bool {
+	return c.eof
+}
+
+// SetRelayCapabilities records the capabilities the relay announced.
+func (c *Comm) SetRelayCapabilities(capabilities []string) {
+	c.relayCapabilities = capabilities
+}
+
+// SetRelayKey records the key of the handshake with the relay, with which
+// the relay encrypts the frames it sends itself.
+func (c *Comm) SetRelayKey(key []byte) {
+	c.relayKey = key
+}
+
+// RelayKey returns the key set with SetRelayKey.
+func (c *Comm) RelayKey() []byte {
+	return c.relayKey
+}
+
+// SetSessionTag records the tag the relay gave the connection when it
+// joined its room, with which peers can address frames to it.
+func (c *Comm) SetSessionTag(tag string) {
+	c.sessionTag = tag
+}
+
+// SessionTag returns the tag set with SetSessionTag, or an empty string if
+// the relay gave none.
+func (c *Comm) SessionTag() string {
+	return c.sessionTag
+}
+
+// RelaySupports reports whether the relay announced the capability.
+func (c *Comm) RelaySupports(capability string) bool {
+	for _, have := range c.relayCapabilities {
+		if have == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// SendEOF tells the peer that nothing more will be sent and half-closes
+// the connection when the underlying conn supports it, so the peer can
+// still reply. It fails with ErrEOFUnsupported unless EnableEOF was called.
+func (c *Comm) SendEOF() (err error) {
+	if err = c.WriteEOF(); err != nil {
+		return
+	}
+	if cw, ok := c.connection.(interface{ CloseWrite() error }); ok {
+		if err = cw.CloseWrite(); err != nil {
+			err = fmt.Errorf("could not half-close connection: %w", err)
+		}
+	}
+	return
+}
+
+// WriteEOF sends an EOF frame without half-closing, for relays passing a
+// peer's EOF on over a connection that other peers still use.
+func (c *Comm) WriteEOF() (err error) {
+	if !c.eof {
+		return ErrEOFUnsupported
+	}
+	if _, err = c.connection.Write(EOF_MAGIC_BYTES); err != nil {
+		err = fmt.Errorf("connection.Write failed: %w", err)
+	}
+	return
+}
+
+// ReceiveEOF waits for the peer's EOF frame. It returns an error if a
+// message arrives first or the connection breaks.
+func (c *Comm) ReceiveEOF() error {
+	b, err := c.Receive()
+	if errors.Is(err, ErrPeerDone) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("expected EOF, got a %d byte message", len(b))
+}
+
 // Close closes the connection
 func (c *Comm) Close() {
 	if err := c.connection.Close(); err != nil {
@@ -151,6 +267,10 @@ func (c *Comm) Read() (buf []byte, numBytes int, bs []byte, err error) {
 		log.Debugf("initial read error: %v", err)
 		return
 	}
+	if c.eof && bytes.Equal(header, EOF_MAGIC_BYTES) {
+		err = ErrPeerDone
+		return
+	}
 	if !bytes.Equal(header, MAGIC_BYTES) {
 		err = fmt.Errorf("initial bytes are not magic: %x", header)
 		return
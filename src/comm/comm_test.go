@@ -64,3 +64,48 @@ func TestComm(t *testing.T) {
 	_, err = a.Write(token)
 	assert.NotNil(t, err)
 }
+
+func TestEOF(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:8002")
+	assert.Nil(t, err)
+	defer server.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		connection, err := server.Accept()
+		if !assert.Nil(t, err) {
+			return
+		}
+		c := New(connection)
+		c.EnableEOF()
+		defer c.Close()
+		data, err := c.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("last words"), data)
+		_, err = c.Receive()
+		assert.ErrorIs(t, err, ErrPeerDone)
+		// the peer only half-closed, so it still gets the reply
+		assert.Nil(t, c.Send([]byte("got it")))
+		assert.Nil(t, c.SendEOF())
+	}()
+
+	a, err := NewConnection("127.0.0.1:8002", time.Minute)
+	assert.Nil(t, err)
+	defer a.Close()
+	assert.ErrorIs(t, a.SendEOF(), ErrEOFUnsupported)
+	a.EnableEOF()
+	assert.True(t, a.EOFEnabled())
+	assert.Nil(t, a.Send([]byte("last words")))
+	assert.Nil(t, a.SendEOF())
+	data, err := a.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("got it"), data)
+	assert.Nil(t, a.ReceiveEOF())
+	<-done
+
+	// relay support is only what the relay announced
+	b := &Comm{}
+	assert.False(t, b.RelaySupports(CapabilityEOF))
+	b.SetRelayCapabilities([]string{"other", CapabilityEOF})
+	assert.True(t, b.RelaySupports(CapabilityEOF))
+}
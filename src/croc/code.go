@@ -0,0 +1,150 @@
+package croc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"github.com/schollz/croc/v10/src/mnemonicode"
+	"github.com/schollz/croc/v10/src/utils"
+)
+
+// Namespaces keep the rooms of different features apart, so a chat and a
+// call started with the same code never end up in the same relay room.
+const (
+	NamespaceTransfer = "transfer"
+	NamespaceChat     = "chat"
+	NamespaceSignal   = "signal"
+	// NamespaceSession is the room of a Session, which carries the rooms
+	// of the others.
+	NamespaceSession = "session"
+)
+
+// roomHashExtra is appended to the secret before hashing it into a room.
+const roomHashExtra = "croc"
+
+// DeriveRoomName returns the relay room for secret in the given namespace.
+//
+// Transfer and chat rooms are derived as croc has always derived them, so
+// peers on older releases still meet: a transfer room hashes only the
+// first four characters of the code, which senders keep as a pin, and a
+// chat room hashes the whole code. Every other namespace, signal included,
+// hashes the whole code together with the namespace. The result must never
+// change for an existing namespace, or peers on different releases would
+// wait in different rooms.
+func DeriveRoomName(secret, namespace string) string {
+	var input string
+	switch namespace {
+	case NamespaceTransfer:
+		input = secret[:min(4, len(secret))] + roomHashExtra
+	case NamespaceChat:
+		input = secret + roomHashExtra
+	default:
+		input = secret + roomHashExtra + "/" + namespace
+	}
+	sum := sha256.Sum256([]byte(input))
+	return hex.EncodeToString(sum[:])
+}
+
+// DefaultCodeWords is how many words GenerateCode puts in a code that
+// croc makes up on its own.
+const DefaultCodeWords = 3
+
+// GenerateCode returns a random code of a pin followed by the given number
+// of words from the mnemonicode word list, such as "4817-ocean-pilot-radar".
+// The pin is the part a transfer room is derived from. At least one word is
+// always included.
+func GenerateCode(words int) string {
+	parts := []string{utils.GenerateRandomPin()}
+	size := big.NewInt(int64(len(mnemonicode.WordList)))
+	for i := 0; i < max(words, 1); i++ {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			panic(err)
+		}
+		parts = append(parts, mnemonicode.WordList[n.Int64()])
+	}
+	return strings.Join(parts, "-")
+}
+
+// MinCodeEntropy is the estimated strength, in bits, below which
+// ValidateCode reports a code as weak. A generated code with the default
+// number of words is above it.
+const MinCodeEntropy = 40
+
+// ErrWeakCode is wrapped by the error ValidateCode returns for a code that
+// is easy to guess.
+var ErrWeakCode = errors.New("code is easy to guess")
+
+// ValidateCode estimates how many bits of entropy secret has and returns
+// an error wrapping ErrWeakCode if it is below MinCodeEntropy. Codes too
+// short to derive a room from are rejected outright. The estimate treats
+// each dash-separated part that is a word of the word list as one choice
+// among all of them, and any other part as a string of random characters
+// from the classes it uses, so it errs on the generous side for
+// passphrases a person made up.
+func ValidateCode(secret string) (bits float64, err error) {
+	if len(secret) < 4 {
+		return 0, fmt.Errorf("code must be at least 4 characters")
+	}
+	for _, part := range strings.Split(secret, "-") {
+		if part == "" {
+			continue
+		}
+		if isCodeWord(part) {
+			bits += math.Log2(float64(len(mnemonicode.WordList)))
+			continue
+		}
+		bits += float64(len([]rune(part))) * math.Log2(float64(charsetSize(part)))
+	}
+	if bits < MinCodeEntropy {
+		return bits, fmt.Errorf("%w: about %.0f bits, use at least %d or let croc generate one", ErrWeakCode, bits, MinCodeEntropy)
+	}
+	return bits, nil
+}
+
+// codeWords indexes the word list for ValidateCode.
+var codeWords = func() map[string]bool {
+	words := make(map[string]bool, len(mnemonicode.WordList))
+	for _, w := range mnemonicode.WordList {
+		words[w] = true
+	}
+	return words
+}()
+
+func isCodeWord(s string) bool {
+	return codeWords[strings.ToLower(s)]
+}
+
+// charsetSize returns the number of characters in the classes s draws
+// from: digits, lower case, upper case and everything else.
+func charsetSize(s string) (size int) {
+	var digit, lower, upper, other bool
+	for _, r := range s {
+		switch {
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		default:
+			other = true
+		}
+	}
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{digit, 10}, {lower, 26}, {upper, 26}, {other, 33}} {
+		if class.used {
+			size += class.size
+		}
+	}
+	return max(size, 2)
+}
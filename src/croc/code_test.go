@@ -0,0 +1,69 @@
+package croc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/schollz/croc/v10/src/mnemonicode"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeriveRoomNameVectors pins room names across releases; peers on
+// different versions only meet if these never change.
+func TestDeriveRoomNameVectors(t *testing.T) {
+	for _, tc := range []struct {
+		secret, namespace, room string
+	}{
+		{"1234-alpha-bravo-charlie", NamespaceTransfer, "12e3e4f3c9d8f5a97d5640ce24721652c4e909ab279618778aad54980f935cf9"},
+		{"1234-alpha-bravo-charlie", NamespaceChat, "8a251f2dcec124c4bde217cadaadbf3b19000839ce660b2c4f5b631a30fec010"},
+		{"1234-alpha-bravo-charlie", NamespaceSignal, "adbd8971c36fb572332c1d48a5a16b02edcbce8a74f80bd6ca4895f90ef5d881"},
+		{"correct-horse-battery", NamespaceTransfer, "0c91f3fe756beb17e2a527224d62c1340b45df2cf8569d1a3f14a79a72383e6e"},
+		{"correct-horse-battery", NamespaceChat, "5f2c71c6a8d1104f5307897a3ba78f29a009f54ca959d3648f776a917901cfc7"},
+		{"correct-horse-battery", NamespaceSignal, "2c687f2bb4a58f2932b57f17408196b16058a0e59e0dfcc08b3d007e9247cd50"},
+	} {
+		assert.Equal(t, tc.room, DeriveRoomName(tc.secret, tc.namespace), "%s in %s", tc.secret, tc.namespace)
+	}
+	// transfer rooms only depend on the pin
+	assert.Equal(t, DeriveRoomName("1234-alpha-bravo-charlie", NamespaceTransfer), DeriveRoomName("1234-other", NamespaceTransfer))
+	assert.NotEqual(t, DeriveRoomName("1234-alpha", "custom"), DeriveRoomName("1234-alpha", NamespaceSignal))
+}
+
+func TestGenerateCode(t *testing.T) {
+	words := make(map[string]bool)
+	for _, w := range mnemonicode.WordList {
+		words[w] = true
+	}
+	for _, n := range []int{0, 1, DefaultCodeWords, 5} {
+		code := GenerateCode(n)
+		parts := strings.Split(code, "-")
+		assert.Len(t, parts, 1+max(n, 1), code)
+		assert.Len(t, parts[0], 4, code)
+		for _, w := range parts[1:] {
+			assert.True(t, words[w], w)
+		}
+	}
+	_, err := ValidateCode(GenerateCode(DefaultCodeWords))
+	assert.Nil(t, err)
+	assert.NotEqual(t, GenerateCode(DefaultCodeWords), GenerateCode(DefaultCodeWords))
+}
+
+func TestValidateCode(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		weak bool
+	}{
+		{"1234-alpha-bravo-charlie", false},
+		{"correct-horse-battery", true},
+		{"hunter2", true},
+		{"1234", true},
+		{"Tr0ub4dor&3", false},
+	} {
+		bits, err := ValidateCode(tc.code)
+		assert.Greater(t, bits, 0.0, tc.code)
+		assert.Equal(t, tc.weak, errors.Is(err, ErrWeakCode), tc.code)
+	}
+	_, err := ValidateCode("abc")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrWeakCode))
+}
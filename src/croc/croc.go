@@ -3,10 +3,9 @@ package croc
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -89,6 +88,29 @@ type Options struct {
 	MulticastAddress string
 	ShowQrCode       bool
 	Exclude          []string
+	// OutputFolder is where received files are written. If empty, files are
+	// written relative to the current working directory.
+	OutputFolder string
+	// Output, if set, receives the single file of a transfer in order
+	// instead of it being written to disk. A slow Output slows the sender
+	// down, and if writing to it fails the rest of the file is dropped and
+	// Receive returns the error.
+	Output io.Writer
+	// App names the client to the relay, as returned by tcp.ClientApp, so
+	// relay operators can tell which builds connect. Chat and calls send
+	// it.
+	App string
+	// Observe joins a chat read-only: the session receives but sends no
+	// messages, and peers see it as an observer. DenyObservers keeps
+	// observers out of a chat room this client creates.
+	Observe       bool
+	DenyObservers bool
+	// LowBandwidth makes a chat save bytes for metered links, see
+	// chat.Session.LowBandwidth.
+	LowBandwidth bool
+	// Connect, if set, joins relay rooms in place of tcp.ConnectToRoom.
+	// A Session sets it to carry them over its connection.
+	Connect func(address string, req tcp.RoomRequest, timelimit ...time.Duration) (conn *comm.Comm, banner, ipaddr string, err error)
 }
 
 type SimpleMessage struct {
@@ -122,6 +144,7 @@ type Client struct {
 
 	// send / receive information of current file
 	CurrentFile            *os.File
+	output                 *orderedOutput
 	CurrentFileChunkRanges []int64
 	CurrentFileChunks      []int64
 	CurrentFileIsClosed    bool
@@ -207,16 +230,13 @@ func New(ops Options) (c *Client, err error) {
 		if c.Options.SharedSecret == "" {
 			return nil, fmt.Errorf("chat code required")
 		}
-		// Compute room name using the full shared secret.
-		hashExtra := "croc"
-		roomNameBytes := sha256.Sum256([]byte(c.Options.SharedSecret + hashExtra))
-		c.Options.RoomName = hex.EncodeToString(roomNameBytes[:])
+		c.Options.RoomName = DeriveRoomName(c.Options.SharedSecret, NamespaceChat)
 	} else {
 		// For file transfers: if the shared secret is too short, auto-generate for sender
 		// and pad for receiver.
 		if len(c.Options.SharedSecret) < 6 {
 			if c.Options.IsSender {
-				c.Options.SharedSecret = utils.GetRandomName()
+				c.Options.SharedSecret = GenerateCode(DefaultCodeWords)
 			} else {
 				// Pad receiver's code to ensure at least 4 characters for room hashing
 				for len(c.Options.SharedSecret) < 4 {
@@ -225,9 +245,10 @@ func New(ops Options) (c *Client, err error) {
 				log.Warn("Entered secret is shorter than recommended; proceeding with padded code")
 			}
 		}
-		hashExtra := "croc"
-		roomNameBytes := sha256.Sum256([]byte(c.Options.SharedSecret[:4] + hashExtra))
-		c.Options.RoomName = hex.EncodeToString(roomNameBytes[:])
+		if _, errCode := ValidateCode(c.Options.SharedSecret); errors.Is(errCode, ErrWeakCode) {
+			log.Warnf("%s", errCode)
+		}
+		c.Options.RoomName = DeriveRoomName(c.Options.SharedSecret, NamespaceTransfer)
 	}
 
 	c.conn = make([]*comm.Comm, 16)
@@ -272,10 +293,46 @@ func New(ops Options) (c *Client, err error) {
 		return
 	}
 
+	if c.Options.Output != nil && !c.Options.IsSender {
+		c.output = newOrderedOutput(c.Options.Output)
+	}
+
 	c.mutex = &sync.Mutex{}
 	return
 }
 
+// TransferProgress is how far a transfer is, see Client.Progress.
+type TransferProgress struct {
+	// File is the number of the file being transferred, from 0, out of
+	// Files.
+	File, Files int
+	// FileDone of the FileSize bytes of that file are transferred, and
+	// Done of the Size bytes of all files.
+	FileDone, FileSize int64
+	Done, Size         int64
+}
+
+// Progress reports which file is currently being transferred and how
+// far, on its own and with the files before it out of all.
+func (c *Client) Progress() (p TransferProgress) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p.Files = len(c.FilesToTransfer)
+	p.File = c.FilesToTransferCurrentNum
+	p.FileDone = c.TotalSent
+	for i, f := range c.FilesToTransfer {
+		p.Size += f.Size
+		if i < p.File {
+			p.Done += f.Size
+		}
+	}
+	if p.File < p.Files {
+		p.FileSize = c.FilesToTransfer[p.File].Size
+		p.Done += p.FileDone
+	}
+	return
+}
+
 // TransferOptions for sending
 type TransferOptions struct {
 	PathToFiles      []string
@@ -636,11 +693,40 @@ func (c *Client) broadcastOnLocalNetwork(useipv6 bool) {
 	}
 }
 
+// transferRoom is the room request of a transfer connection, which asks
+// the relay to warn it before the room reaches its byte quota or TTL.
+func transferRoom(room string) tcp.RoomRequest {
+	return tcp.RoomRequest{Room: room, Capabilities: []string{tcp.CapabilityLimitWarnings}}
+}
+
+// logRelayControl logs what a control frame from the relay of conn says,
+// reporting whether data was one. Transfers only get them as their room
+// nears its limits, which the relay enforces as it always has.
+func logRelayControl(conn *comm.Comm, data []byte) bool {
+	if !tcp.IsControlFrame(data) {
+		return false
+	}
+	control, err := tcp.ParseControl(conn, data)
+	switch {
+	case err != nil:
+		log.Debugf("ignoring control frame: %v", err)
+	case control.Kind == tcp.ControlRoomExpiring:
+		log.Warnf("the relay closes this transfer's room in %s", control.Left.Round(time.Second))
+	case control.Kind == tcp.ControlQuotaWarning:
+		log.Warnf("this transfer's room used %d%% of the relay's quota; the relay closes it once it is used up", control.Used)
+	case control.Kind == tcp.ControlNobodyJoined:
+		log.Warnf("nobody else joined this transfer's room before the relay closed it; check that the other side used the same code and relay")
+	default:
+		log.Debugf("relay says: %s", control)
+	}
+	return true
+}
+
 func (c *Client) transferOverLocalRelay(errchan chan<- error) {
 	time.Sleep(500 * time.Millisecond)
 	log.Debug("establishing connection")
 	var banner string
-	conn, banner, ipaddr, err := tcp.ConnectToTCPServer("127.0.0.1:"+c.Options.RelayPorts[0], c.Options.RelayPassword, c.Options.RoomName)
+	conn, banner, ipaddr, err := c.Options.ConnectToRoom("127.0.0.1:"+c.Options.RelayPorts[0], transferRoom(c.Options.RoomName))
 	log.Debugf("banner: %s", banner)
 	if err != nil {
 		err = fmt.Errorf("could not connect to 127.0.0.1:%s: %w", c.Options.RelayPorts[0], err)
@@ -651,6 +737,9 @@ func (c *Client) transferOverLocalRelay(errchan chan<- error) {
 	log.Debugf("local connection established: %+v", conn)
 	for {
 		data, _ := conn.Receive()
+		if logRelayControl(conn, data) {
+			continue
+		}
 		if bytes.Equal(data, handshakeRequest) {
 			break
 		} else if bytes.Equal(data, []byte{1}) {
@@ -739,7 +828,7 @@ On the other computer run:
 				log.Debugf("got host '%v' and port '%v'", host, port)
 				address = net.JoinHostPort(host, port)
 				log.Debugf("trying connection to %s", address)
-				conn, banner, ipaddr, err = tcp.ConnectToTCPServer(address, c.Options.RelayPassword, c.Options.RoomName, durations[i])
+				conn, banner, ipaddr, err = c.Options.ConnectToRoom(address, transferRoom(c.Options.RoomName), durations[i])
 				if err == nil {
 					c.Options.RelayAddress = address
 					break
@@ -766,6 +855,9 @@ On the other computer run:
 				if errConn != nil {
 					log.Tracef("[%+v] had error: %s", conn, errConn.Error())
 				}
+				if logRelayControl(conn, data) {
+					continue
+				}
 				json.Unmarshal(data, &dataMessage)
 				log.Tracef("data: %+v '%s'", data, data)
 				log.Tracef("dataMessage: %s", dataMessage)
@@ -991,7 +1083,7 @@ func (c *Client) Receive() (err error) {
 		log.Debugf("got host '%v' and port '%v'", host, port)
 		address = net.JoinHostPort(host, port)
 		log.Debugf("trying connection to %s", address)
-		c.conn[0], banner, c.ExternalIP, err = tcp.ConnectToTCPServer(address, c.Options.RelayPassword, c.Options.RoomName, durations[i])
+		c.conn[0], banner, c.ExternalIP, err = c.Options.ConnectToRoom(address, transferRoom(c.Options.RoomName), durations[i])
 		if err == nil {
 			c.Options.RelayAddress = address
 			break
@@ -1097,7 +1189,7 @@ func (c *Client) Receive() (err error) {
 				}
 
 				serverTry := net.JoinHostPort(ip, port)
-				conn, banner2, externalIP, errConn := tcp.ConnectToTCPServer(serverTry, c.Options.RelayPassword, c.Options.RoomName, 500*time.Millisecond)
+				conn, banner2, externalIP, errConn := c.Options.ConnectToRoom(serverTry, transferRoom(c.Options.RoomName), 500*time.Millisecond)
 				if errConn != nil {
 					log.Debug(errConn)
 					log.Debug("could not connect to " + serverTry)
@@ -1167,6 +1259,13 @@ func (c *Client) transfer() (err error) {
 			}
 			break
 		}
+		if tcp.IsIdleTimeout(data) {
+			err = fmt.Errorf("relay dropped the connection for being idle")
+			break
+		}
+		if logRelayControl(c.conn[0], data) {
+			continue
+		}
 		done, err = c.processMessage(data)
 		if err != nil {
 			log.Debugf("data: %s", data)
@@ -1184,6 +1283,11 @@ func (c *Client) transfer() (err error) {
 		}
 		err = nil
 	}
+	if c.output != nil {
+		if errOutput := c.output.close(); errOutput != nil && err == nil {
+			err = fmt.Errorf("could not write the received file: %w", errOutput)
+		}
+	}
 	if c.Options.IsSender && c.SuccessfulTransfer {
 		for _, file := range c.FilesToTransfer {
 			if file.TempFile {
@@ -1289,6 +1393,18 @@ func (c *Client) processMessageFileInfo(m message.Message) (done bool, err error
 		if errFileName != nil {
 			return true, errFileName
 		}
+		if c.Options.OutputFolder != "" {
+			c.FilesToTransfer[i].FolderRemote = filepath.Join(c.Options.OutputFolder, c.FilesToTransfer[i].FolderRemote)
+		}
+	}
+	if c.Options.OutputFolder != "" {
+		for i, fi := range c.EmptyFoldersToTransfer {
+			folder := filepath.Clean(fi.FolderRemote)
+			if strings.Contains(folder, "..") {
+				return true, fmt.Errorf("invalid path detected: '%s'", fi.FolderRemote)
+			}
+			c.EmptyFoldersToTransfer[i].FolderRemote = filepath.Join(c.Options.OutputFolder, folder)
+		}
 	}
 	c.TotalNumberOfContents = 0
 	if c.FilesToTransfer != nil {
@@ -1476,10 +1592,9 @@ func (c *Client) processMessagePake(m message.Message) (err error) {
 			}
 			server := net.JoinHostPort(host, c.Options.RelayPorts[j])
 			log.Debugf("connecting to %s", server)
-			c.conn[j+1], _, _, err = tcp.ConnectToTCPServer(
+			c.conn[j+1], _, _, err = c.Options.ConnectToRoom(
 				server,
-				c.Options.RelayPassword,
-				fmt.Sprintf("%s-%d", c.Options.RoomName, j),
+				transferRoom(fmt.Sprintf("%s-%d", c.Options.RoomName, j)),
 			)
 			if err != nil {
 				panic(err)
@@ -1649,6 +1764,14 @@ func (c *Client) recipientInitializeFile() (err error) {
 		c.FilesToTransfer[c.FilesToTransferCurrentNum].FolderRemote,
 		c.FilesToTransfer[c.FilesToTransferCurrentNum].Name,
 	)
+	if c.output != nil {
+		if len(c.FilesToTransfer) != 1 {
+			return fmt.Errorf("cannot receive %d files into one output", len(c.FilesToTransfer))
+		}
+		c.CurrentFileChunks = []int64{}
+		c.CurrentFileChunkRanges = []int64{}
+		return
+	}
 	folderForFile, _ := filepath.Split(pathToFile)
 	folderForFileBase := filepath.Base(folderForFile)
 	if folderForFileBase != "." && folderForFileBase != "" {
@@ -1835,13 +1958,21 @@ func (c *Client) updateIfRecipientHasFileInfo() (err error) {
 		}
 		log.Debugf("checking %+v", fileInfo)
 		recipientFileInfo, errRecipientFile := os.Lstat(path.Join(fileInfo.FolderRemote, fileInfo.Name))
+		if c.output != nil {
+			// nothing is written to disk, so nothing there is resumed
+			errRecipientFile = os.ErrNotExist
+		}
 		var errHash error
 		var fileHash []byte
 		if errRecipientFile == nil && recipientFileInfo.Size() == fileInfo.Size {
 			// the file exists, but is same size, so hash it
 			fileHash, errHash = utils.HashFile(path.Join(fileInfo.FolderRemote, fileInfo.Name), c.Options.HashAlgorithm)
 		}
-		if fileInfo.Size == 0 || fileInfo.Symlink != "" {
+		if c.output != nil && c.output.written() == fileInfo.Size {
+			// the file went to Output whole, which an empty one has
+			fileHash = fileInfo.Hash
+		}
+		if c.output == nil && (fileInfo.Size == 0 || fileInfo.Symlink != "") {
 			err = c.createEmptyFileAndFinish(fileInfo, i)
 			if err != nil {
 				return
@@ -2017,6 +2148,13 @@ func (c *Client) receiveData(i int) {
 			log.Trace("got ping")
 			continue
 		}
+		if tcp.IsIdleTimeout(data) {
+			log.Debugf("%d dropped by relay for being idle", i)
+			break
+		}
+		if logRelayControl(c.conn[i+1], data) {
+			continue
+		}
 
 		data, err = crypt.Decrypt(data, c.Key)
 		if err != nil {
@@ -2035,10 +2173,19 @@ func (c *Client) receiveData(i int) {
 		}
 		positionInt64 := int64(position)
 
+		if c.output != nil {
+			// wait for the chunks before this one outside the lock, as
+			// the connections bringing them need it
+			if err = c.output.writeAt(data[8:], positionInt64); err != nil {
+				break
+			}
+		}
 		c.mutex.Lock()
-		_, err = c.CurrentFile.WriteAt(data[8:], positionInt64)
-		if err != nil {
-			panic(err)
+		if c.output == nil {
+			_, err = c.CurrentFile.WriteAt(data[8:], positionInt64)
+			if err != nil {
+				panic(err)
+			}
 		}
 		c.bar.Add(len(data[8:]))
 		c.TotalSent += int64(len(data[8:]))
@@ -2048,7 +2195,9 @@ func (c *Client) receiveData(i int) {
 		if !c.CurrentFileIsClosed && (c.TotalChunksTransferred == len(c.CurrentFileChunks) || c.TotalSent == c.FilesToTransfer[c.FilesToTransferCurrentNum].Size) {
 			c.CurrentFileIsClosed = true
 			log.Debug("finished receiving!")
-			if err = c.CurrentFile.Close(); err != nil {
+			if c.output != nil {
+				log.Debug("received into output")
+			} else if err = c.CurrentFile.Close(); err != nil {
 				log.Debugf("error closing %s: %v", c.CurrentFile.Name(), err)
 			} else {
 				log.Debugf("Successful closing %s", c.CurrentFile.Name())
@@ -2140,7 +2289,10 @@ func (c *Client) sendData(i int) {
 						panic(err)
 					}
 					c.bar.Add(n)
+					// Progress reads it under the lock
+					c.mutex.Lock()
 					c.TotalSent += int64(n)
+					c.mutex.Unlock()
 					// time.Sleep(100 * time.Millisecond)
 				}
 			}
@@ -1,6 +1,8 @@
 package croc
 
 import (
+	"bytes"
+	"crypto/rand"
 	"os"
 	"path"
 	"path/filepath"
@@ -398,3 +400,80 @@ func TestCleanUp(t *testing.T) {
 		}
 	}
 }
+
+func TestProgress(t *testing.T) {
+	c := &Client{FilesToTransfer: []FileInfo{{Size: 100}, {Size: 300}, {Size: 600}}, FilesToTransferCurrentNum: 1, TotalSent: 150, mutex: &sync.Mutex{}}
+	assert.Equal(t, TransferProgress{File: 1, Files: 3, FileDone: 150, FileSize: 300, Done: 250, Size: 1000}, c.Progress())
+	assert.Equal(t, TransferProgress{}, (&Client{mutex: &sync.Mutex{}}).Progress())
+}
+
+// gatedWriter holds every write until it is opened.
+type gatedWriter struct {
+	open chan struct{}
+	bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	return w.Buffer.Write(p)
+}
+
+func TestCrocOutput(t *testing.T) {
+	log.SetLevel("error")
+	defer log.SetLevel("trace")
+	data := make([]byte, 64<<20)
+	_, err := rand.Read(data)
+	assert.Nil(t, err)
+	fname := filepath.Join(t.TempDir(), "output.bin")
+	assert.Nil(t, os.WriteFile(fname, data, 0o644))
+
+	sender, err := New(Options{
+		IsSender:      true,
+		SharedSecret:  "8125-testingoutput",
+		RelayAddress:  "127.0.0.1:8281",
+		RelayPorts:    []string{"8281"},
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Curve:         "siec",
+		Overwrite:     true,
+		NoCompress:    true,
+	})
+	assert.Nil(t, err)
+	out := &gatedWriter{open: make(chan struct{})}
+	receiver, err := New(Options{
+		SharedSecret:  "8125-testingoutput",
+		RelayAddress:  "127.0.0.1:8281",
+		RelayPassword: "pass123",
+		NoPrompt:      true,
+		DisableLocal:  true,
+		Curve:         "siec",
+		Output:        out,
+		OutputFolder:  t.TempDir(),
+	})
+	assert.Nil(t, err)
+
+	sent, received := make(chan error, 1), make(chan error, 1)
+	go func() {
+		filesInfo, emptyFolders, totalNumberFolders, err := GetFilesInfo([]string{fname}, false, false, nil)
+		if err != nil {
+			sent <- err
+			return
+		}
+		sent <- sender.Send(filesInfo, emptyFolders, totalNumberFolders)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() { received <- receiver.Receive() }()
+
+	// while the output takes nothing, the sender gets only as far as the
+	// connections buffer
+	time.Sleep(3 * time.Second)
+	assert.Less(t, sender.Progress().Done, int64(len(data)))
+	close(out.open)
+	assert.Nil(t, <-received)
+	assert.Nil(t, <-sent)
+	assert.True(t, bytes.Equal(data, out.Bytes()), "the file arrives whole and in order")
+	entries, err := os.ReadDir(receiver.Options.OutputFolder)
+	assert.Nil(t, err)
+	assert.Empty(t, entries, "nothing is written to disk")
+}
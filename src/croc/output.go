@@ -0,0 +1,84 @@
+package croc
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// errOutputClosed is returned to a chunk waiting for its turn once the
+// transfer is over.
+var errOutputClosed = errors.New("transfer ended before the data was written")
+
+// orderedOutput writes the chunks of a received file to an io.Writer in
+// file order, although they arrive over several connections at once. A
+// chunk waits for those before it, and the connection it came on is not
+// read meanwhile, so a slow writer holds up the connections and through
+// them the sender, and at most one chunk per connection is held.
+type orderedOutput struct {
+	w io.Writer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// next is the offset of the next chunk to write.
+	next   int64
+	closed bool
+	// err is the first write error; the chunks after it are dropped so
+	// the transfer still completes.
+	err error
+}
+
+func newOrderedOutput(w io.Writer) *orderedOutput {
+	o := &orderedOutput{w: w}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// writeAt writes p, the chunk at offset off, once every chunk before it is
+// written. It only fails once the output is closed.
+func (o *orderedOutput) writeAt(p []byte, off int64) error {
+	o.mu.Lock()
+	for o.next != off && !o.closed {
+		o.cond.Wait()
+	}
+	if o.closed {
+		o.mu.Unlock()
+		return errOutputClosed
+	}
+	failed := o.err != nil
+	o.mu.Unlock()
+
+	// chunks after this one wait for next to move, so the write is done
+	// without holding the lock
+	var err error
+	if !failed {
+		_, err = o.w.Write(p)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil && o.err == nil {
+		o.err = err
+	}
+	o.next += int64(len(p))
+	o.cond.Broadcast()
+	return nil
+}
+
+// written is how much of the file was written, or dropped after a
+// write failed.
+func (o *orderedOutput) written() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.next
+}
+
+// close wakes the chunks still waiting, which will not be written, and
+// returns the error that stopped the writes, if any.
+func (o *orderedOutput) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.cond.Broadcast()
+	return o.err
+}
@@ -0,0 +1,122 @@
+package croc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// sessionConnectTimeout bounds joining the session room.
+const sessionConnectTimeout = 30 * time.Second
+
+// ConnectToRoom joins the relay room of req at address, through o.Connect
+// if it is set.
+func (o Options) ConnectToRoom(address string, req tcp.RoomRequest, timelimit ...time.Duration) (conn *comm.Comm, banner, ipaddr string, err error) {
+	if o.Connect != nil {
+		return o.Connect(address, req, timelimit...)
+	}
+	return tcp.ConnectToRoom(address, o.RelayPassword, req, timelimit...)
+}
+
+// Session is one connection to the relay that chat, calls and transfers
+// for a code share. It joins the session room of the code, and the rooms
+// they would each join are channels of it, see tcp.Mux, so the peer has
+// to use a Session too. If the connection is lost it is joined again when
+// a room is next joined through it.
+type Session struct {
+	options Options
+	request tcp.RoomRequest
+
+	mu     sync.Mutex
+	mux    *tcp.Mux
+	banner string
+	ipaddr string
+	closed bool
+}
+
+// NewSession joins the session room for options.SharedSecret on the relay
+// at options.RelayAddress. As the room is what a chat uses it for, it is
+// joined as a chat room, read-only with options.Observe.
+func NewSession(options Options) (*Session, error) {
+	if len(options.SharedSecret) < 4 {
+		return nil, fmt.Errorf("code is too short")
+	}
+	s := &Session{
+		options: options,
+		request: tcp.RoomRequest{
+			Room:          DeriveRoomName(options.SharedSecret, NamespaceSession),
+			Mode:          tcp.RoomModeChat,
+			App:           options.App,
+			Observer:      options.Observe,
+			DenyObservers: options.DenyObservers,
+			Capabilities:  []string{tcp.CapabilityControlFrames, tcp.CapabilityLimitWarnings},
+		},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.join(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Options returns the options of s with Connect joining rooms as channels
+// of its connection. Transfers with them use no local relay.
+func (s *Session) Options() Options {
+	options := s.options
+	options.Connect = s.connect
+	options.RelayAddress6 = ""
+	options.DisableLocal = true
+	return options
+}
+
+// join returns the Mux of the connection, joining the room again if it was
+// lost. s.mu is held.
+func (s *Session) join() (*tcp.Mux, error) {
+	if s.closed {
+		return nil, tcp.ErrMuxClosed
+	}
+	if s.mux != nil {
+		select {
+		case <-s.mux.Done():
+		default:
+			return s.mux, nil
+		}
+	}
+	conn, banner, ipaddr, err := tcp.ConnectToRoom(s.options.RelayAddress, s.options.RelayPassword, s.request, sessionConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.mux, s.banner, s.ipaddr = tcp.NewMux(conn), banner, ipaddr
+	return s.mux, nil
+}
+
+// connect opens the room of req as a channel. The address is not needed,
+// as every room is on the relay of the session.
+func (s *Session) connect(_ string, req tcp.RoomRequest, _ ...time.Duration) (*comm.Comm, string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mux, err := s.join()
+	if err != nil {
+		return nil, "", "", err
+	}
+	conn, err := mux.Open(req.Room)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return conn, s.banner, s.ipaddr, nil
+}
+
+// Close leaves the session room, closing every room joined through it.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.mux != nil {
+		return s.mux.Close()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package croc
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+// sessionRelay runs a relay for the test, counting its connections.
+func sessionRelay(t *testing.T) *countingListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: l}
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(counted), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return counted
+}
+
+func TestSessionTransfer(t *testing.T) {
+	log.SetLevel("error")
+	defer log.SetLevel("trace")
+	relay := sessionRelay(t)
+	options := Options{SharedSecret: "8126-session-transfer", RelayAddress: relay.Addr().String(), RelayPassword: "pass123"}
+	_, err := NewSession(Options{SharedSecret: "812"})
+	assert.NotNil(t, err)
+	alice, err := NewSession(options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer alice.Close()
+	bob, err := NewSession(options)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer bob.Close()
+
+	fname := filepath.Join(t.TempDir(), "session.txt")
+	assert.Nil(t, os.WriteFile(fname, []byte("over one connection"), 0o644))
+	transfer := func(s *Session, isSender bool) Options {
+		o := s.Options()
+		o.IsSender = isSender
+		o.NoPrompt = true
+		o.Curve = "siec"
+		o.Overwrite = true
+		o.OutputFolder = t.TempDir()
+		return o
+	}
+	sender, err := New(transfer(alice, true))
+	assert.Nil(t, err)
+	receiver, err := New(transfer(bob, false))
+	assert.Nil(t, err)
+
+	sent := make(chan error, 1)
+	go func() {
+		filesInfo, emptyFolders, totalNumberFolders, err := GetFilesInfo([]string{fname}, false, false, nil)
+		if err != nil {
+			sent <- err
+			return
+		}
+		sent <- sender.Send(filesInfo, emptyFolders, totalNumberFolders)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, receiver.Receive())
+	assert.Nil(t, <-sent)
+	received, err := os.ReadFile(filepath.Join(receiver.Options.OutputFolder, "session.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "over one connection", string(received))
+	assert.EqualValues(t, 2, relay.accepted.Load(), "each peer has one connection to the relay")
+
+	// a closed session joins no more rooms
+	assert.Nil(t, alice.Close())
+	_, _, _, err = alice.Options().ConnectToRoom("", transferRoom("room"))
+	assert.ErrorIs(t, err, tcp.ErrMuxClosed)
+}
@@ -0,0 +1,161 @@
+// Package bandwidth shares one outbound bandwidth budget between the parts
+// of croc that send at the same time, such as chat messages, chat files and
+// calls. Each consumer registers with a weight and is limited to its weighted
+// share of the budget among the consumers currently registered.
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst is the smallest burst a consumer is allowed, so that small
+// messages are never split when the budget is tight.
+const minBurst = 16 * 1024
+
+// Default is the process-wide manager. It starts unlimited.
+var Default = New(0)
+
+// Manager holds the budget and its consumers.
+type Manager struct {
+	mu        sync.Mutex
+	limit     int64
+	consumers map[*Consumer]bool
+}
+
+// Consumer is a sender drawing from a Manager's budget.
+type Consumer struct {
+	m       *Manager
+	name    string
+	weight  int
+	limiter *rate.Limiter
+}
+
+// New returns a manager with a budget of limit bytes per second. Zero means
+// unlimited.
+func New(limit int64) *Manager {
+	return &Manager{limit: limit, consumers: make(map[*Consumer]bool)}
+}
+
+// SetLimit changes the budget in bytes per second at runtime. Zero means
+// unlimited.
+func (m *Manager) SetLimit(limit int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limit = limit
+	m.rebalanceLocked()
+}
+
+// Limit returns the budget in bytes per second, zero if unlimited.
+func (m *Manager) Limit() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.limit
+}
+
+// Register adds a consumer with the given weight. A weight below one counts
+// as one. Close the consumer when it stops sending so that the others get
+// its share back.
+func (m *Manager) Register(name string, weight int) *Consumer {
+	if weight < 1 {
+		weight = 1
+	}
+	c := &Consumer{m: m, name: name, weight: weight, limiter: rate.NewLimiter(rate.Inf, minBurst)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consumers[c] = true
+	m.rebalanceLocked()
+	return c
+}
+
+func (m *Manager) rebalanceLocked() {
+	total := 0
+	for c := range m.consumers {
+		total += c.weight
+	}
+	for c := range m.consumers {
+		if m.limit <= 0 {
+			c.limiter.SetLimit(rate.Inf)
+			continue
+		}
+		share := m.limit * int64(c.weight) / int64(total)
+		if share < 1 {
+			share = 1
+		}
+		c.limiter.SetLimit(rate.Limit(share))
+		c.limiter.SetBurst(max(int(share), minBurst))
+	}
+}
+
+// Close unregisters the consumer.
+func (c *Consumer) Close() {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	delete(c.m.consumers, c)
+	c.m.rebalanceLocked()
+}
+
+// Name returns the name the consumer registered with.
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Share returns the consumer's granted bytes per second, zero if unlimited.
+func (c *Consumer) Share() int64 {
+	if l := c.limiter.Limit(); l != rate.Inf {
+		return int64(l)
+	}
+	return 0
+}
+
+// Wait blocks until the consumer may send n bytes. Sends larger than the
+// burst wait for their share in burst-sized steps.
+func (c *Consumer) Wait(ctx context.Context, n int) error {
+	for n > 0 {
+		step := min(n, c.limiter.Burst())
+		if err := c.limiter.WaitN(ctx, step); err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// reserve books n bytes at now and returns how long the sender has to wait.
+func (c *Consumer) reserve(now time.Time, n int) time.Duration {
+	return c.limiter.ReserveN(now, n).DelayFrom(now)
+}
+
+// ParseLimit parses a budget such as "500k", "2M" or "1g" into bytes per
+// second, using the same units as --throttleUpload. "0", "off" and
+// "unlimited" mean no limit.
+func ParseLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "", "0", "off", "unlimited":
+		return 0, nil
+	}
+	value, unit := s, int64(1)
+	switch s[len(s)-1] {
+	case 'g', 'G':
+		unit = 1024 * 1024 * 1024
+	case 'm', 'M':
+		unit = 1024 * 1024
+	case 'k', 'K':
+		unit = 1024
+	}
+	if unit > 1 {
+		value = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid bandwidth limit '%s'", s)
+	}
+	return n * unit, nil
+}
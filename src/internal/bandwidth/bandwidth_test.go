@@ -0,0 +1,71 @@
+package bandwidth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sendFor simulates a consumer sending chunks back to back until the clock
+// passes end, and returns how many bytes it got out.
+func sendFor(c *Consumer, start, end time.Time, chunk int) (sent int64) {
+	now := start
+	for {
+		now = now.Add(c.reserve(now, chunk))
+		if now.After(end) {
+			return
+		}
+		sent += int64(chunk)
+	}
+}
+
+func TestWeightedShares(t *testing.T) {
+	const limit = 1024 * 1024
+	m := New(limit)
+	file := m.Register("file", 1)
+	call := m.Register("call", 3)
+	assert.Equal(t, int64(limit/4), file.Share())
+	assert.Equal(t, int64(3*limit/4), call.Share())
+
+	start := time.Now()
+	window := 10 * time.Second
+	end := start.Add(window)
+	fileSent := sendFor(file, start, end, 4096)
+	callSent := sendFor(call, start, end, 1200)
+
+	// the aggregate stays within the budget plus one burst per consumer
+	budget := int64(limit * window.Seconds())
+	assert.LessOrEqual(t, fileSent+callSent, budget+int64(file.limiter.Burst()+call.limiter.Burst()))
+	assert.Greater(t, fileSent+callSent, budget*9/10)
+	ratio := float64(callSent) / float64(fileSent)
+	assert.InDelta(t, 3.0, ratio, 0.2)
+
+	// a consumer leaving hands its share back
+	call.Close()
+	assert.Equal(t, int64(limit), file.Share())
+
+	m.SetLimit(0)
+	assert.Equal(t, int64(0), file.Share())
+	assert.Nil(t, file.Wait(context.Background(), 10*limit))
+}
+
+func TestParseLimit(t *testing.T) {
+	for s, want := range map[string]int64{
+		"":     0,
+		"off":  0,
+		"500":  500,
+		"500k": 500 * 1024,
+		"2M":   2 * 1024 * 1024,
+		"1g":   1024 * 1024 * 1024,
+	} {
+		got, err := ParseLimit(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	for _, s := range []string{"fast", "-1k", "k"} {
+		_, err := ParseLimit(s)
+		assert.NotNil(t, err, s)
+	}
+}
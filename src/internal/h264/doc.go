@@ -0,0 +1,5 @@
+// Package h264 decodes the H.264 video of calls with openh264, so that
+// received frames can be handed to the application as pictures. It links
+// the openh264 that mediadevices bundles for its encoder and is only
+// built with media support.
+package h264
@@ -0,0 +1,166 @@
+//go:build !nomedia
+
+package h264
+
+/*
+#include <stdbool.h>
+#include <string.h>
+
+// The declarations come from codec_api.h, codec_app_def.h and codec_def.h;
+// the library itself is the static openh264 linked by mediadevices.
+typedef struct {
+	unsigned int size;
+	int eVideoBsType;
+} SVideoProperty;
+
+typedef struct {
+	char *pFileNameRestructed;
+	unsigned int uiCpuLoad;
+	unsigned char uiTargetDqLayer;
+	int eEcActiveIdc;
+	bool bParseOnly;
+	SVideoProperty sVideoProperty;
+} SDecodingParam;
+
+typedef struct {
+	int iWidth;
+	int iHeight;
+	int iFormat;
+	int iStride[2];
+} SSysMEMBuffer;
+
+typedef struct {
+	int iBufferStatus;
+	unsigned long long uiInBsTimeStamp;
+	unsigned long long uiOutYuvTimeStamp;
+	union {
+		SSysMEMBuffer sSystemBuffer;
+	} UsrData;
+	unsigned char *pDst[3];
+} SBufferInfo;
+
+typedef struct ISVCDecoderVtbl ISVCDecoderVtbl;
+typedef const ISVCDecoderVtbl *ISVCDecoder;
+struct ISVCDecoderVtbl {
+	long (*Initialize)(ISVCDecoder *, const SDecodingParam *);
+	long (*Uninitialize)(ISVCDecoder *);
+	int (*DecodeFrame)(ISVCDecoder *, const unsigned char *, const int, unsigned char **, int *, int *, int *);
+	int (*DecodeFrameNoDelay)(ISVCDecoder *, const unsigned char *, const int, unsigned char **, SBufferInfo *);
+	int (*DecodeFrame2)(ISVCDecoder *, const unsigned char *, const int, unsigned char **, SBufferInfo *);
+	int (*FlushFrame)(ISVCDecoder *, unsigned char **, SBufferInfo *);
+	int (*DecodeParser)(ISVCDecoder *, const unsigned char *, const int, void *);
+	int (*DecodeFrameEx)(ISVCDecoder *, const unsigned char *, const int, unsigned char *, int, int *, int *, int *, int *);
+	long (*SetOption)(ISVCDecoder *, int, void *);
+	long (*GetOption)(ISVCDecoder *, int, void *);
+};
+
+long WelsCreateDecoder(ISVCDecoder **ppDecoder);
+void WelsDestroyDecoder(ISVCDecoder *pDecoder);
+
+enum {
+	CROC_H264_VIDEO_BITSTREAM_AVC = 0,
+	CROC_H264_ERROR_CON_SLICE_COPY = 2,
+	CROC_H264_VIDEO_FORMAT_I420 = 23,
+};
+
+// the decoder is a table of function pointers, which cgo cannot call.
+static long croc_h264_init(ISVCDecoder *d) {
+	SDecodingParam p;
+	memset(&p, 0, sizeof p);
+	p.eEcActiveIdc = CROC_H264_ERROR_CON_SLICE_COPY;
+	p.sVideoProperty.size = sizeof p.sVideoProperty;
+	p.sVideoProperty.eVideoBsType = CROC_H264_VIDEO_BITSTREAM_AVC;
+	return (*d)->Initialize(d, &p);
+}
+static int croc_h264_decode(ISVCDecoder *d, const unsigned char *src, int len, unsigned char **dst, SBufferInfo *info) {
+	memset(info, 0, sizeof *info);
+	return (*d)->DecodeFrameNoDelay(d, src, len, dst, info);
+}
+static void croc_h264_close(ISVCDecoder *d) {
+	(*d)->Uninitialize(d);
+	WelsDestroyDecoder(d);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"unsafe"
+
+	// also links openh264
+	_ "github.com/pion/mediadevices/pkg/codec/openh264"
+)
+
+// Decoder decodes an H.264 stream, one Annex B access unit at a time.
+type Decoder struct {
+	mu  sync.Mutex
+	dec *C.ISVCDecoder
+}
+
+// NewDecoder returns a decoder for a stream that starts at a key frame.
+func NewDecoder() (*Decoder, error) {
+	var dec *C.ISVCDecoder
+	if C.WelsCreateDecoder(&dec) != 0 || dec == nil {
+		return nil, errors.New("h264: could not create decoder")
+	}
+	if r := C.croc_h264_init(dec); r != 0 {
+		C.WelsDestroyDecoder(dec)
+		return nil, fmt.Errorf("h264: could not initialize decoder: error %d", int(r))
+	}
+	return &Decoder{dec: dec}, nil
+}
+
+// Decode decodes an access unit and returns the picture it completes, or
+// nil if it completes none. A unit that does not decode, such as one
+// referring to a lost frame, is an error; decoding goes on with the next.
+func (d *Decoder) Decode(au []byte) (*image.YCbCr, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dec == nil {
+		return nil, io.EOF
+	}
+	if len(au) == 0 {
+		return nil, errors.New("h264: empty access unit")
+	}
+	var planes [3]*C.uchar
+	var info C.SBufferInfo
+	if state := C.croc_h264_decode(d.dec, (*C.uchar)(unsafe.Pointer(&au[0])), C.int(len(au)), &planes[0], &info); state != 0 {
+		return nil, fmt.Errorf("h264: could not decode: state %#x", int(state))
+	}
+	if info.iBufferStatus != 1 {
+		return nil, nil
+	}
+	buf := (*C.SSysMEMBuffer)(unsafe.Pointer(&info.UsrData))
+	if buf.iFormat != C.CROC_H264_VIDEO_FORMAT_I420 {
+		return nil, fmt.Errorf("h264: unexpected picture format %d", int(buf.iFormat))
+	}
+	w, h := int(buf.iWidth), int(buf.iHeight)
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	// the planes belong to the decoder and are reused for the next picture
+	copyPlane(img.Y, img.YStride, planes[0], int(buf.iStride[0]), w, h)
+	copyPlane(img.Cb, img.CStride, planes[1], int(buf.iStride[1]), (w+1)/2, (h+1)/2)
+	copyPlane(img.Cr, img.CStride, planes[2], int(buf.iStride[1]), (w+1)/2, (h+1)/2)
+	return img, nil
+}
+
+func copyPlane(dst []byte, dstStride int, src *C.uchar, srcStride, w, h int) {
+	plane := unsafe.Slice((*byte)(unsafe.Pointer(src)), srcStride*(h-1)+w)
+	for y := 0; y < h; y++ {
+		copy(dst[y*dstStride:y*dstStride+w], plane[y*srcStride:])
+	}
+}
+
+// Close releases the decoder.
+func (d *Decoder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dec != nil {
+		C.croc_h264_close(d.dec)
+		d.dec = nil
+	}
+	return nil
+}
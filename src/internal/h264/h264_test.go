@@ -0,0 +1,65 @@
+//go:build !nomedia
+
+package h264
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(src, src.Bounds(), &image.Uniform{C: color.RGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+	params, err := openh264.NewParams()
+	if !assert.Nil(t, err) {
+		return
+	}
+	params.BitRate = 500_000
+	enc, err := params.BuildVideoEncoder(video.ReaderFunc(func() (image.Image, func(), error) {
+		return src, func() {}, nil
+	}), prop.Media{Video: prop.Video{Width: 64, Height: 48, FrameRate: 30}})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer enc.Close()
+
+	d, err := NewDecoder()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer d.Close()
+	var pictures []*image.YCbCr
+	for i := 0; i < 5; i++ {
+		au, release, err := enc.Read()
+		if !assert.Nil(t, err) {
+			return
+		}
+		img, err := d.Decode(au)
+		release()
+		assert.Nil(t, err)
+		if img != nil {
+			pictures = append(pictures, img)
+		}
+	}
+	if assert.Len(t, pictures, 5) {
+		img := pictures[4]
+		assert.Equal(t, src.Bounds(), img.Bounds())
+		r, g, b, _ := img.At(32, 24).RGBA()
+		assert.InDelta(t, 0xffff, r, 0x1800)
+		assert.InDelta(t, 0, g, 0x1800)
+		assert.InDelta(t, 0, b, 0x1800)
+	}
+
+	_, err = d.Decode(nil)
+	assert.NotNil(t, err)
+	d.Close()
+	_, err = d.Decode([]byte{0, 0, 0, 1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,6 @@
+// Package opus encodes and decodes call audio with libopus, exposing the
+// loss resilience settings the encoder of mediadevices leaves out: in-band
+// forward error correction, the expected packet loss and the complexity.
+// It links the libopus that mediadevices bundles and is only built with
+// media support.
+package opus
@@ -0,0 +1,14 @@
+package opus
+
+import "fmt"
+
+// Fmtp returns the SDP format parameters for Opus. useinbandfec tells the
+// peer whether this side makes use of in-band FEC when decoding, and so
+// whether it is worth sending.
+func Fmtp(fec bool) string {
+	useFEC := 0
+	if fec {
+		useFEC = 1
+	}
+	return fmt.Sprintf("minptime=10;useinbandfec=%d", useFEC)
+}
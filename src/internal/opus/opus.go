@@ -0,0 +1,332 @@
+//go:build !nomedia
+
+package opus
+
+/*
+// The prototypes and constants come from opus.h and opus_defines.h; the
+// library itself is the static libopus linked by mediadevices.
+typedef struct OpusEncoder OpusEncoder;
+typedef struct OpusDecoder OpusDecoder;
+
+OpusEncoder *opus_encoder_create(int fs, int channels, int application, int *error);
+int opus_encode(OpusEncoder *st, const short *pcm, int frame_size, unsigned char *data, int max_data_bytes);
+int opus_encoder_ctl(OpusEncoder *st, int request, ...);
+void opus_encoder_destroy(OpusEncoder *st);
+
+OpusDecoder *opus_decoder_create(int fs, int channels, int *error);
+int opus_decode(OpusDecoder *st, const unsigned char *data, int len, short *pcm, int frame_size, int decode_fec);
+void opus_decoder_destroy(OpusDecoder *st);
+
+enum {
+	CROC_OPUS_OK = 0,
+	CROC_OPUS_APPLICATION_VOIP = 2048,
+	CROC_OPUS_SET_BITRATE = 4002,
+	CROC_OPUS_SET_COMPLEXITY = 4010,
+	CROC_OPUS_GET_COMPLEXITY = 4011,
+	CROC_OPUS_SET_INBAND_FEC = 4012,
+	CROC_OPUS_GET_INBAND_FEC = 4013,
+	CROC_OPUS_SET_PACKET_LOSS_PERC = 4014,
+	CROC_OPUS_GET_PACKET_LOSS_PERC = 4015,
+};
+
+// opus_encoder_ctl is variadic, which cgo cannot call.
+static int croc_opus_set(OpusEncoder *e, int request, int value) {
+	return opus_encoder_ctl(e, request, value);
+}
+static int croc_opus_get(OpusEncoder *e, int request, int *value) {
+	return opus_encoder_ctl(e, request, value);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	// also links libopus
+	mdopus "github.com/pion/mediadevices/pkg/codec/opus"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/mediadevices/pkg/wave/mixer"
+)
+
+// SampleRate is the clock rate of Opus over RTP.
+const SampleRate = 48000
+
+// maxPacket bounds an encoded packet; Opus recommends 4000 bytes.
+const maxPacket = 4000
+
+// Params configures the encoder. Use it as a mediadevices audio encoder
+// in a codec selector.
+type Params struct {
+	codec.BaseParams
+	// Latency is the frame duration, 20ms unless set.
+	Latency mdopus.Latency
+	// FEC adds in-band forward error correction, which lets the receiver
+	// rebuild a lost packet from the one after it. It only takes effect
+	// with an ExpectedLossPct above zero.
+	FEC bool
+	// ExpectedLossPct is the packet loss, in percent, the encoder prepares
+	// for; more trades bitrate for resilience.
+	ExpectedLossPct int
+	// Complexity is the encoder complexity from 0 to 10.
+	Complexity int
+	// OnEncoder, if set, is called with each encoder built from the
+	// params, to change its bitrate as the stream goes on.
+	OnEncoder func(*Encoder)
+}
+
+// RTPCodec returns the Opus codec with the format parameters Fmtp returns for p.FEC, so
+// registering it in a media engine advertises them.
+func (p *Params) RTPCodec() *codec.RTPCodec {
+	c := codec.NewRTPOpusCodec(SampleRate)
+	c.SDPFmtpLine = Fmtp(p.FEC)
+	c.Latency = p.latency().Duration()
+	return c
+}
+
+func (p *Params) latency() mdopus.Latency {
+	if p.Latency == 0 {
+		return mdopus.Latency20ms
+	}
+	return p.Latency
+}
+
+// BuildAudioEncoder builds an encoder reading from r.
+func (p *Params) BuildAudioEncoder(r audio.Reader, property prop.Media) (codec.ReadCloser, error) {
+	if property.SampleRate == 0 {
+		return nil, fmt.Errorf("opus: sample rate is required")
+	}
+	if !p.latency().Validate() {
+		return nil, fmt.Errorf("opus: unsupported latency %v", time.Duration(p.latency()))
+	}
+	e, err := NewEncoder(property.SampleRate, property.ChannelCount, *p)
+	if err != nil {
+		return nil, err
+	}
+	if p.OnEncoder != nil {
+		p.OnEncoder(e)
+	}
+	samples := int(p.latency().Duration() * time.Duration(property.SampleRate) / time.Second)
+	mix := audio.NewChannelMixer(property.ChannelCount, &mixer.MonoMixer{})
+	return &readEncoder{Encoder: e, reader: mix(audio.NewBuffer(samples)(r))}, nil
+}
+
+// Encoder is an Opus encoder for 16 bit samples.
+type Encoder struct {
+	mu       sync.Mutex
+	engine   *C.OpusEncoder
+	channels int
+}
+
+// NewEncoder returns an encoder for voice at the given sample rate.
+func NewEncoder(sampleRate, channels int, p Params) (*Encoder, error) {
+	if p.ExpectedLossPct < 0 || p.ExpectedLossPct > 100 {
+		return nil, fmt.Errorf("opus: expected loss %d%% is not between 0 and 100", p.ExpectedLossPct)
+	}
+	if p.Complexity < 0 || p.Complexity > 10 {
+		return nil, fmt.Errorf("opus: complexity %d is not between 0 and 10", p.Complexity)
+	}
+	var cerr C.int
+	engine := C.opus_encoder_create(C.int(sampleRate), C.int(channels), C.CROC_OPUS_APPLICATION_VOIP, &cerr)
+	if cerr != C.CROC_OPUS_OK {
+		return nil, fmt.Errorf("opus: could not create encoder: error %d", int(cerr))
+	}
+	e := &Encoder{engine: engine, channels: channels}
+	if p.BitRate == 0 {
+		p.BitRate = 32000
+	}
+	fec := 0
+	if p.FEC {
+		fec = 1
+	}
+	for _, ctl := range []struct {
+		name           string
+		request, value C.int
+	}{
+		{"bitrate", C.CROC_OPUS_SET_BITRATE, C.int(p.BitRate)},
+		{"in-band FEC", C.CROC_OPUS_SET_INBAND_FEC, C.int(fec)},
+		{"expected packet loss", C.CROC_OPUS_SET_PACKET_LOSS_PERC, C.int(p.ExpectedLossPct)},
+		{"complexity", C.CROC_OPUS_SET_COMPLEXITY, C.int(p.Complexity)},
+	} {
+		if C.croc_opus_set(engine, ctl.request, ctl.value) != C.CROC_OPUS_OK {
+			e.Close()
+			return nil, fmt.Errorf("opus: could not set %s to %d", ctl.name, int(ctl.value))
+		}
+	}
+	return e, nil
+}
+
+// Encode encodes one frame of interleaved samples.
+func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.engine == nil {
+		return nil, io.EOF
+	}
+	if len(pcm) == 0 {
+		return nil, errors.New("opus: empty frame")
+	}
+	out := make([]byte, maxPacket)
+	n := C.opus_encode(e.engine, (*C.short)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&out[0])), C.int(len(out)))
+	if n < 0 {
+		return nil, fmt.Errorf("opus: could not encode: error %d", int(n))
+	}
+	return out[:n:n], nil
+}
+
+// SetBitRate changes the target bitrate.
+func (e *Encoder) SetBitRate(bitRate int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.engine == nil {
+		return io.EOF
+	}
+	if C.croc_opus_set(e.engine, C.CROC_OPUS_SET_BITRATE, C.int(bitRate)) != C.CROC_OPUS_OK {
+		return fmt.Errorf("opus: could not set bitrate to %d", bitRate)
+	}
+	return nil
+}
+
+// settings returns the FEC, expected loss and complexity in effect.
+func (e *Encoder) settings() (fec bool, lossPct, complexity int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var v [3]C.int
+	for i, request := range []C.int{C.CROC_OPUS_GET_INBAND_FEC, C.CROC_OPUS_GET_PACKET_LOSS_PERC, C.CROC_OPUS_GET_COMPLEXITY} {
+		if C.croc_opus_get(e.engine, request, &v[i]) != C.CROC_OPUS_OK {
+			return false, 0, 0, fmt.Errorf("opus: could not read setting %d", int(request))
+		}
+	}
+	return v[0] != 0, int(v[1]), int(v[2]), nil
+}
+
+// Close frees the encoder.
+func (e *Encoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.engine != nil {
+		C.opus_encoder_destroy(e.engine)
+		e.engine = nil
+	}
+	return nil
+}
+
+// readEncoder encodes the frames of an audio reader for mediadevices.
+type readEncoder struct {
+	*Encoder
+	reader audio.Reader
+}
+
+func (r *readEncoder) Read() ([]byte, func(), error) {
+	chunk, _, err := r.reader.Read()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	var pcm []int16
+	switch b := chunk.(type) {
+	case *wave.Int16Interleaved:
+		pcm = b.Data
+	case *wave.Float32Interleaved:
+		pcm = make([]int16, len(b.Data))
+		for i, s := range b.Data {
+			pcm[i] = int16(max(-1, min(1, s)) * 32767)
+		}
+	default:
+		return nil, func() {}, errors.New("opus: unknown type of audio buffer")
+	}
+	b, err := r.Encode(pcm)
+	return b, func() {}, err
+}
+
+func (r *readEncoder) Controller() codec.EncoderController {
+	return r.Encoder
+}
+
+// Decoder is an Opus decoder producing 16 bit samples.
+type Decoder struct {
+	engine   *C.OpusDecoder
+	channels int
+	// frame is the duration, in samples per channel, of the last frame,
+	// which a lost frame is assumed to match.
+	frame int
+	pcm   []int16
+}
+
+// NewDecoder returns a decoder for the given sample rate and channels.
+func NewDecoder(sampleRate, channels int) (*Decoder, error) {
+	var cerr C.int
+	engine := C.opus_decoder_create(C.int(sampleRate), C.int(channels), &cerr)
+	if cerr != C.CROC_OPUS_OK {
+		return nil, fmt.Errorf("opus: could not create decoder: error %d", int(cerr))
+	}
+	return &Decoder{
+		engine:   engine,
+		channels: channels,
+		frame:    sampleRate / 50,
+		// the longest Opus packet is 120ms
+		pcm: make([]int16, sampleRate*120/1000*channels),
+	}, nil
+}
+
+// Decode decodes a packet into interleaved samples. The result is only
+// valid until the next call.
+func (d *Decoder) Decode(packet []byte) ([]int16, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("opus: empty packet")
+	}
+	return d.decode(packet, len(d.pcm)/d.channels, false)
+}
+
+// DecodeFEC rebuilds the frame lost just before next from the forward
+// error correction data in next. Without such data libopus conceals the
+// loss instead. next itself still has to be decoded with Decode.
+func (d *Decoder) DecodeFEC(next []byte) ([]int16, error) {
+	if len(next) == 0 {
+		return nil, errors.New("opus: empty packet")
+	}
+	return d.decode(next, d.frame, true)
+}
+
+// Conceal makes up a frame for a lost packet from the audio before it.
+func (d *Decoder) Conceal() ([]int16, error) {
+	return d.decode(nil, d.frame, false)
+}
+
+func (d *Decoder) decode(packet []byte, frame int, fec bool) ([]int16, error) {
+	if d.engine == nil {
+		return nil, io.EOF
+	}
+	var data *C.uchar
+	if len(packet) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&packet[0]))
+	}
+	decodeFEC := 0
+	if fec {
+		decodeFEC = 1
+	}
+	n := C.opus_decode(d.engine, data, C.int(len(packet)), (*C.short)(unsafe.Pointer(&d.pcm[0])), C.int(frame), C.int(decodeFEC))
+	if n < 0 {
+		return nil, fmt.Errorf("opus: could not decode: error %d", int(n))
+	}
+	if !fec && packet != nil {
+		d.frame = int(n)
+	}
+	return d.pcm[:int(n)*d.channels], nil
+}
+
+// Close frees the decoder.
+func (d *Decoder) Close() error {
+	if d.engine != nil {
+		C.opus_decoder_destroy(d.engine)
+		d.engine = nil
+	}
+	return nil
+}
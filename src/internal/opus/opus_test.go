@@ -0,0 +1,114 @@
+//go:build !nomedia
+
+package opus
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoderSettings(t *testing.T) {
+	e, err := NewEncoder(SampleRate, 1, Params{FEC: true, ExpectedLossPct: 15, Complexity: 7})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer e.Close()
+	fec, loss, complexity, err := e.settings()
+	assert.NoError(t, err)
+	assert.True(t, fec)
+	assert.Equal(t, 15, loss)
+	assert.Equal(t, 7, complexity)
+
+	_, err = NewEncoder(SampleRate, 1, Params{ExpectedLossPct: 101})
+	assert.Error(t, err)
+	_, err = NewEncoder(SampleRate, 1, Params{Complexity: 11})
+	assert.Error(t, err)
+}
+
+func TestRTPCodec(t *testing.T) {
+	assert.Equal(t, "minptime=10;useinbandfec=1", (&Params{FEC: true}).RTPCodec().SDPFmtpLine)
+	assert.Equal(t, "minptime=10;useinbandfec=0", (&Params{}).RTPCodec().SDPFmtpLine)
+}
+
+// voice is a second of a vowel-like tone gliding in pitch, with an
+// envelope, which the encoder treats as speech.
+func voice() [][]int16 {
+	const frame = SampleRate / 50
+	var frames [][]int16
+	phase := 0.0
+	for f := 0; f < 50; f++ {
+		pcm := make([]int16, frame)
+		for i := range pcm {
+			n := float64(f*frame + i)
+			pitch := 140 + 60*math.Sin(2*math.Pi*n/SampleRate)
+			phase += 2 * math.Pi * pitch / SampleRate
+			env := 0.6 + 0.4*math.Sin(2*math.Pi*3*n/SampleRate)
+			s := math.Sin(phase) + 0.5*math.Sin(2*phase) + 0.25*math.Sin(3*phase)
+			pcm[i] = int16(6000 * env * s)
+		}
+		frames = append(frames, pcm)
+	}
+	return frames
+}
+
+// lossError decodes packets with every fifth one lost and returns the
+// squared error of the frames standing in for the lost ones, against a
+// decode without loss.
+func lossError(t *testing.T, packets [][]byte, fec bool) float64 {
+	clean, err := NewDecoder(SampleRate, 1)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer clean.Close()
+	lossy, err := NewDecoder(SampleRate, 1)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer lossy.Close()
+
+	total := 0.0
+	for i, p := range packets {
+		want, err := clean.Decode(p)
+		assert.NoError(t, err)
+		want = append([]int16(nil), want...)
+		if i%5 != 2 || i+1 == len(packets) {
+			_, err = lossy.Decode(p)
+			assert.NoError(t, err)
+			continue
+		}
+		var got []int16
+		if fec {
+			got, err = lossy.DecodeFEC(packets[i+1])
+		} else {
+			got, err = lossy.Conceal()
+		}
+		if assert.NoError(t, err) && assert.Len(t, got, len(want)) {
+			for j := range got {
+				d := float64(got[j]) - float64(want[j])
+				total += d * d
+			}
+		}
+	}
+	return total
+}
+
+func TestFECRecovery(t *testing.T) {
+	e, err := NewEncoder(SampleRate, 1, Params{FEC: true, ExpectedLossPct: 20, Complexity: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer e.Close()
+	var packets [][]byte
+	for _, pcm := range voice() {
+		p, err := e.Encode(pcm)
+		if !assert.NoError(t, err) {
+			return
+		}
+		packets = append(packets, p)
+	}
+	recovered := lossError(t, packets, true)
+	concealed := lossError(t, packets, false)
+	assert.Less(t, recovered, concealed*3/4, "FEC rebuilds lost frames closer than concealment")
+}
@@ -0,0 +1,114 @@
+// Package testutil holds helpers shared by tests across packages.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/clock"
+)
+
+// FakeClock is a clock.Clock that only moves when Advance is called.
+// Timers and tickers fire from Advance, in the calling goroutine, and like
+// time.Ticker a ticker drops ticks its reader has not kept up with.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+	added   *sync.Cond
+}
+
+type fakeWaiter struct {
+	at      time.Time
+	period  time.Duration
+	c       chan time.Time
+	stopped bool
+}
+
+// NewFakeClock returns a clock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	f := &FakeClock{now: now}
+	f.added = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the clock's current time.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives once the clock has been advanced by
+// d.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.add(d, 0).c
+}
+
+// NewTicker returns a ticker that ticks every d of advanced time.
+func (f *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("testutil: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f, f.add(d, d)}
+}
+
+func (f *FakeClock) add(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	f.added.Broadcast()
+	return w
+}
+
+// Advance moves the clock forward by d and fires every timer and ticker
+// that came due.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.stopped {
+			continue
+		}
+		if !w.at.After(f.now) {
+			select {
+			case w.c <- f.now:
+			default:
+			}
+			if w.period == 0 {
+				continue
+			}
+			for !w.at.After(f.now) {
+				w.at = w.at.Add(w.period)
+			}
+		}
+		pending = append(pending, w)
+	}
+	f.waiters = pending
+}
+
+// BlockUntil waits until at least n timers or tickers are pending, so a
+// test can be sure the code under test is waiting before it advances.
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.added.Wait()
+	}
+}
+
+type fakeTicker struct {
+	f *FakeClock
+	w *fakeWaiter
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.c }
+
+func (t fakeTicker) Stop() {
+	t.f.mu.Lock()
+	t.w.stopped = true
+	t.f.mu.Unlock()
+}
@@ -0,0 +1,34 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	f := NewFakeClock(start)
+	after := f.After(time.Minute)
+	ticker := f.NewTicker(30 * time.Second)
+
+	f.Advance(29 * time.Second)
+	assert.Equal(t, start.Add(29*time.Second), f.Now())
+	assert.Len(t, ticker.C(), 0)
+
+	f.Advance(time.Second)
+	assert.Equal(t, start.Add(30*time.Second), <-ticker.C())
+	assert.Len(t, after, 0)
+
+	// a ticker nobody reads keeps one tick, like time.Ticker
+	f.Advance(2 * time.Minute)
+	assert.Equal(t, start.Add(150*time.Second), <-after)
+	assert.Len(t, ticker.C(), 1)
+	<-ticker.C()
+
+	ticker.Stop()
+	f.Advance(time.Hour)
+	assert.Len(t, ticker.C(), 0)
+	f.BlockUntil(0)
+}
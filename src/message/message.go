@@ -21,6 +21,21 @@ const (
 	TypeCloseSender    Type = "close-sender"
 	TypeRecipientReady Type = "recipientready"
 	TypeFileInfo       Type = "fileinfo"
+
+	// call signaling
+	TypeWebRTCOffer        Type = "webrtc_offer"
+	TypeWebRTCAnswer       Type = "webrtc_answer"
+	TypeWebRTCCandidate    Type = "webrtc_candidate"
+	TypeWebRTCHangup       Type = "webrtc_hangup"
+	TypeWebRTCDeclined     Type = "webrtc_declined"
+	TypeWebRTCReoffer      Type = "webrtc_reoffer"
+	TypeWebRTCReanswer     Type = "webrtc_reanswer"
+	TypeWebRTCVideoState   Type = "webrtc_video_state"
+	TypeWebRTCBitrateCap   Type = "webrtc_bitrate_cap"
+	TypeWebRTCCaptureState Type = "webrtc_capture_state"
+	TypeWebRTCRecording    Type = "webrtc_recording"
+	TypeWebRTCDataOffer    Type = "webrtc_data_offer"
+	TypeWebRTCDataAnswer   Type = "webrtc_data_answer"
 )
 
 // Message is the possible payload for messaging
@@ -31,6 +46,23 @@ type Message struct {
 	Bytes   []byte `json:"b,omitempty"`
 	Bytes2  []byte `json:"b2,omitempty"`
 	Num     int    `json:"n,omitempty"`
+	// ID identifies a chat message so peers can refer back to it.
+	ID string `json:"id,omitempty"`
+	// Session is the public key of the chat session that sent a message;
+	// only that session can edit or delete it.
+	Session string `json:"s,omitempty"`
+	// Meta is metadata specific to the message type, such as the mode
+	// and modification time of a file sent in the chat.
+	Meta []byte `json:"meta,omitempty"`
+	// Time is when a signed chat message was sent, in Unix milliseconds,
+	// and Signature the signature of the sending session over it, its id
+	// and its content.
+	Time      int64  `json:"ts,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+	// SignalingVersion is the call signaling version a call invite offers
+	// and its answer settles on. Peers from before versions were
+	// negotiated leave it out, which is version 0.
+	SignalingVersion int `json:"sv,omitempty"`
 }
 
 func (m Message) String() string {
@@ -0,0 +1,86 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Call signaling versions. A peer offers CurrentSignalingVersion in its
+// invite and the callee answers with the lower of that and its own; both
+// refuse a version below MinSignalingVersion. Version 0 is the format of
+// peers from before versions were negotiated. Version 2 adds the devices
+// of each side to the invite and the answer.
+const (
+	CurrentSignalingVersion = 2
+	MinSignalingVersion     = 0
+)
+
+// SignalSchema is the wire format of one signaling type from a signaling
+// version on, naming fields by their JSON keys. Fields outside Required
+// and Optional, and JSON keys Message does not know, are ignored by
+// readers, so adding one is compatible; renaming or dropping a required
+// one is not.
+type SignalSchema struct {
+	Type Type
+	// Since is the first signaling version with this format.
+	Since    int
+	Required []string
+	Optional []string
+}
+
+// SignalSchemas lists every format each signaling type has had, oldest
+// first. Signals are sealed as a whole, so these describe the message
+// inside the seal.
+var SignalSchemas = []SignalSchema{
+	// the invite: SDP in m, offered directions in b, call id in id; from
+	// version 2 on b also holds the caller's devices
+	{Type: TypeWebRTCOffer, Since: 0, Required: []string{"t", "m"}, Optional: []string{"b", "id"}},
+	{Type: TypeWebRTCOffer, Since: 1, Required: []string{"t", "m", "id", "sv"}, Optional: []string{"b"}},
+	{Type: TypeWebRTCAnswer, Since: 0, Required: []string{"t", "m"}, Optional: []string{"id"}},
+	{Type: TypeWebRTCAnswer, Since: 1, Required: []string{"t", "m", "id"}, Optional: []string{"sv"}},
+	// the settled directions and the callee's devices in b
+	{Type: TypeWebRTCAnswer, Since: 2, Required: []string{"t", "m", "id", "sv"}, Optional: []string{"b"}},
+	{Type: TypeWebRTCCandidate, Since: 0, Required: []string{"t", "m"}},
+	{Type: TypeWebRTCHangup, Since: 0, Required: []string{"t"}, Optional: []string{"m", "id"}},
+	// m is the reason
+	{Type: TypeWebRTCDeclined, Since: 0, Required: []string{"t", "id", "m"}},
+	// renegotiation: n numbers the offer and the answer repeats it
+	{Type: TypeWebRTCReoffer, Since: 0, Required: []string{"t", "id", "m", "n"}},
+	{Type: TypeWebRTCReanswer, Since: 0, Required: []string{"t", "id", "m", "n"}},
+}
+
+// LookupSignalSchema returns the format of signaling type t at version.
+func LookupSignalSchema(t Type, version int) (schema SignalSchema, ok bool) {
+	for _, s := range SignalSchemas {
+		if s.Type == t && s.Since <= version {
+			schema, ok = s, true
+		}
+	}
+	return
+}
+
+// SignalFields returns the JSON keys m sets, sorted.
+func SignalFields(m Message) []string {
+	b, _ := json.Marshal(m)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(b, &fields)
+	return slices.Sorted(maps.Keys(fields))
+}
+
+// CheckSignal reports whether m has the fields its type requires at the
+// given signaling version.
+func CheckSignal(m Message, version int) error {
+	schema, ok := LookupSignalSchema(m.Type, version)
+	if !ok {
+		return fmt.Errorf("%q is not a signaling type at version %d", m.Type, version)
+	}
+	fields := SignalFields(m)
+	for _, f := range schema.Required {
+		if !slices.Contains(fields, f) {
+			return fmt.Errorf("%s signal at version %d lacks %q", m.Type, version, f)
+		}
+	}
+	return nil
+}
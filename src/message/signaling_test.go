@@ -0,0 +1,74 @@
+package message
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSignalVectors decodes the signals every signaling version has sent,
+// kept in testdata/signaling/v<version>, with the current code.
+func TestSignalVectors(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "signaling", "v*", "*.json"))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, files)
+	seen := make(map[int]bool)
+	for _, file := range files {
+		version, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(file)), "v"))
+		if !assert.Nil(t, err, file) {
+			continue
+		}
+		seen[version] = true
+		b, err := os.ReadFile(file)
+		assert.Nil(t, err)
+		var m Message
+		if !assert.Nil(t, json.Unmarshal(b, &m), file) {
+			continue
+		}
+		assert.Nil(t, CheckSignal(m, version), file)
+	}
+	for v := MinSignalingVersion; v <= CurrentSignalingVersion; v++ {
+		assert.True(t, seen[v], "no vectors for signaling version %d", v)
+	}
+}
+
+func TestSignalUnknownFields(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "signaling", "v1", "webrtc_offer_unknown_fields.json"))
+	assert.Nil(t, err)
+	var m Message
+	assert.Nil(t, json.Unmarshal(b, &m))
+	assert.Equal(t, TypeWebRTCOffer, m.Type)
+	assert.Equal(t, "fcde2b2edba56bf4", m.ID)
+	assert.Equal(t, 2, m.SignalingVersion)
+	assert.Equal(t, []string{"b", "id", "m", "sv", "t"}, SignalFields(m))
+}
+
+func TestCheckSignal(t *testing.T) {
+	offer := Message{Type: TypeWebRTCOffer, Message: "sdp"}
+	assert.Nil(t, CheckSignal(offer, 0))
+	assert.NotNil(t, CheckSignal(offer, 1), "a version 1 invite carries its id and version")
+	offer.ID, offer.SignalingVersion = "abc", 1
+	assert.Nil(t, CheckSignal(offer, 1))
+	// later versions use the newest format before them
+	assert.Nil(t, CheckSignal(offer, 7))
+
+	assert.NotNil(t, CheckSignal(Message{Type: TypeWebRTCReoffer, ID: "abc", Message: "sdp"}, 1))
+	assert.NotNil(t, CheckSignal(Message{Type: TypePAKE}, 1))
+}
+
+func TestSignalSchemas(t *testing.T) {
+	last := make(map[Type]int)
+	for _, s := range SignalSchemas {
+		if prev, ok := last[s.Type]; ok {
+			assert.Greater(t, s.Since, prev, s.Type)
+		}
+		last[s.Type] = s.Since
+		assert.LessOrEqual(t, s.Since, CurrentSignalingVersion, s.Type)
+		assert.Contains(t, s.Required, "t", s.Type)
+	}
+}
@@ -0,0 +1,296 @@
+// Package session ties together what two peers sharing a code can do: chat,
+// calls and file transfers. A Session carries them all over one relay
+// connection, a croc.Session, opening each on first use, and reports what
+// happens in all of them on one channel. The peer has to use one too, as
+// croc chat, croc call --listen, croc audio and croc video do.
+//
+// The connection is in package croc, which chat and call build on; this
+// package, which builds on them, is apart from it for that reason.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/chat"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+)
+
+// EventKind says what an Event reports.
+type EventKind string
+
+const (
+	// EventMessage is a chat message from the room, Message holds it.
+	EventMessage EventKind = "message"
+	// EventStatus is a change of the chat connection, described by Text.
+	EventStatus EventKind = "status"
+	// EventTransfer is progress of a file offered with SendFile, described
+	// by Text.
+	EventTransfer EventKind = "transfer"
+	// EventCallStarted is a call placed with Call that is established.
+	EventCallStarted EventKind = "call_started"
+	// EventCallEnded is the end of that call, summarized by Text.
+	EventCallEnded EventKind = "call_ended"
+)
+
+// Event is something that happened in a session.
+type Event struct {
+	Kind    EventKind
+	Message message.Message
+	Text    string
+	// Call is the call of EventCallStarted and EventCallEnded.
+	Call *call.CallSession
+}
+
+// eventBuffer is how many events wait for the reader before the parts of
+// the session reporting them block.
+const eventBuffer = 64
+
+var (
+	// ErrClosed is returned by a Session that was closed.
+	ErrClosed = errors.New("session is closed")
+	// ErrCallInProgress is returned by Call while another call is placed
+	// or established.
+	ErrCallInProgress = errors.New("a call is in progress")
+)
+
+// Session is what two peers sharing a code do together. Chat, calls and
+// transfers are channels of one connection to the relay, joined on first
+// use.
+type Session struct {
+	options croc.Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// events is closed by Close, under the write lock of eventsMu once ctx
+	// is done, so emit never sends on a closed channel.
+	events   chan Event
+	eventsMu sync.RWMutex
+	closed   bool
+
+	mu sync.Mutex
+	// relay is the connection, joined by the first feature used; chat is
+	// opened by Chat; call is the call placed by Call, and calling is set
+	// while one is placed or established.
+	relay   *croc.Session
+	chat    *chat.Session
+	call    *call.CallSession
+	calling bool
+}
+
+// New returns a session for options.SharedSecret on the relay of options.
+// Nothing connects before Chat, Call, Listen or SendFile is first called. The
+// session lives until Close is called or ctx is cancelled. Events must be
+// read for the session to make progress.
+func New(ctx context.Context, options croc.Options) (*Session, error) {
+	if len(options.SharedSecret) < 4 {
+		return nil, fmt.Errorf("code is too short")
+	}
+	s := &Session{
+		options: options,
+		events:  make(chan Event, eventBuffer),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return s, nil
+}
+
+// Events returns the channel events are reported on. It is closed by
+// Close.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// RoomName returns the relay room the session uses for namespace, one of
+// the croc.Namespace constants.
+func (s *Session) RoomName(namespace string) string {
+	return croc.DeriveRoomName(s.options.SharedSecret, namespace)
+}
+
+// connection returns the options the features use, which carry them over
+// the relay connection of s, joining it on the first call. s.mu is held.
+func (s *Session) connection() (croc.Options, error) {
+	if s.ctx.Err() != nil {
+		return croc.Options{}, ErrClosed
+	}
+	if s.relay == nil {
+		relay, err := croc.NewSession(s.options)
+		if err != nil {
+			return croc.Options{}, err
+		}
+		s.relay = relay
+	}
+	return s.relay.Options(), nil
+}
+
+// emit reports e unless the session is closed.
+func (s *Session) emit(e Event) {
+	s.eventsMu.RLock()
+	defer s.eventsMu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+// Chat returns the chat of the session, joining the chat room on the first
+// call. Messages received are reported as EventMessage and connection
+// changes as EventStatus; pings and delivered messages are answered.
+func (s *Session) Chat() (*chat.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	if s.chat != nil {
+		return s.chat, nil
+	}
+	options, err := s.connection()
+	if err != nil {
+		return nil, err
+	}
+	cs, err := chat.NewSession(s.ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cs.Start(func(m message.Message) {
+		cs.Answer(m)
+		s.emit(Event{Kind: EventMessage, Message: m})
+	}, func(status string) {
+		s.emit(Event{Kind: EventStatus, Text: status})
+	})
+	s.chat = cs
+	return cs, nil
+}
+
+// SendFile offers the file or folder at path to the peer through the
+// chat, as /transfer does, and returns the offer id. The transfer runs in
+// the background, reporting its progress as EventTransfer.
+func (s *Session) SendFile(path string) (id string, err error) {
+	cs, err := s.Chat()
+	if err != nil {
+		return
+	}
+	return cs.OfferTransfer(path, func(line string) {
+		s.emit(Event{Kind: EventTransfer, Text: line})
+	})
+}
+
+// ReceiveFile receives what the peer offered with m, a message of an
+// EventMessage the peer's SendFile or /transfer sent, into dir. The
+// transfer runs in the background, reporting its progress as
+// EventTransfer.
+func (s *Session) ReceiveFile(m message.Message, dir string) error {
+	cs, err := s.Chat()
+	if err != nil {
+		return err
+	}
+	return cs.FetchTransfer(m, dir, func(line string) {
+		s.emit(Event{Kind: EventTransfer, Text: line})
+	})
+}
+
+// Call places a call of kind to the peer, who waits for it with Listen, as
+// croc call --listen does, and returns it once established. One call is placed at a time.
+// It is reported as EventCallStarted and, once it ends, EventCallEnded;
+// Close hangs it up.
+func (s *Session) Call(kind call.MediaKind, dir call.Direction, co call.CallOptions) (*call.CallSession, error) {
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if s.calling {
+		s.mu.Unlock()
+		return nil, ErrCallInProgress
+	}
+	options, err := s.connection()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.calling = true
+	s.mu.Unlock()
+
+	options.IsSender = true
+	options.RoomName = s.RoomName(croc.NamespaceSignal)
+	cs, err := call.Dial(s.ctx, options, kind, dir, co)
+	s.mu.Lock()
+	if err == nil && s.ctx.Err() != nil {
+		// closed just as the call was established
+		cs.Hangup()
+		err = ErrClosed
+	}
+	if err != nil {
+		s.calling = false
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.call = cs
+	s.wg.Add(1)
+	s.mu.Unlock()
+	s.emit(Event{Kind: EventCallStarted, Call: cs})
+	go func() {
+		defer s.wg.Done()
+		select {
+		case <-cs.Done():
+		case <-s.ctx.Done():
+		}
+		summary := cs.Hangup()
+		s.mu.Lock()
+		s.call, s.calling = nil, false
+		s.mu.Unlock()
+		s.emit(Event{Kind: EventCallEnded, Call: cs, Text: summary})
+	}()
+	return cs, nil
+}
+
+// Listen answers the calls the peer places with Call, one at a time, as
+// lo says, until the session is closed or ctx is done. A session listening
+// cannot place calls itself.
+func (s *Session) Listen(ctx context.Context, lo call.ListenOptions) error {
+	s.mu.Lock()
+	options, err := s.connection()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	options.RoomName = s.RoomName(croc.NamespaceSignal)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+	return call.Listen(ctx, options, lo)
+}
+
+// Close hangs up the call, leaves the chat, gives up a call being placed,
+// stops Listen, closes the relay connection and closes Events.
+func (s *Session) Close() error {
+	s.cancel()
+	s.mu.Lock()
+	cs, relay := s.chat, s.relay
+	s.chat, s.relay = nil, nil
+	s.mu.Unlock()
+	if cs != nil {
+		cs.Close()
+	}
+	s.wg.Wait()
+	if relay != nil {
+		relay.Close()
+	}
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	return nil
+}
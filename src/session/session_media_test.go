@@ -0,0 +1,181 @@
+//go:build !nomedia
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// silence is a microphone that records nothing, in 20ms frames.
+type silence struct {
+	ticker *time.Ticker
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newSilence() *silence {
+	return &silence{ticker: time.NewTicker(20 * time.Millisecond), closed: make(chan struct{})}
+}
+
+func (s *silence) ReadFrame() (call.Frame, error) {
+	select {
+	case <-s.ticker.C:
+		return call.Frame{Samples: make([]int16, 960), SampleRate: 48000, Captured: time.Now()}, nil
+	case <-s.closed:
+		return call.Frame{}, io.EOF
+	}
+}
+
+func (s *silence) Close() error {
+	s.once.Do(func() {
+		s.ticker.Stop()
+		close(s.closed)
+	})
+	return nil
+}
+
+// speaker counts the frames of the peer's audio.
+type speaker struct {
+	mu     sync.Mutex
+	frames int
+}
+
+func (s *speaker) WriteFrame(call.Frame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames++
+	return nil
+}
+
+func (s *speaker) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frames
+}
+
+func (s *speaker) heard() bool {
+	return s.count() > 10
+}
+
+// TestSessionCallAndChat places a real call from one session to a peer
+// listening on another while they chat and send a file, each peer over one
+// connection to the relay.
+func TestSessionCallAndChat(t *testing.T) {
+	log.SetLevel("error")
+	relay := testRelay(t)
+	options := croc.Options{SharedSecret: "1234-session-call", RelayAddress: relay.Addr().String(), RelayPassword: "pass123"}
+	alice, err := New(context.Background(), options)
+	assert.Nil(t, err)
+	bob, err := New(context.Background(), options)
+	assert.Nil(t, err)
+	defer bob.Close()
+
+	// bob answers calls as croc call --listen does
+	callee := &speaker{}
+	ctx, cancel := context.WithCancel(context.Background())
+	listening := make(chan error, 1)
+	go func() {
+		listening <- bob.Listen(ctx, call.ListenOptions{
+			AutoAnswer: true,
+			Audio:      call.DefaultAudioOptions(),
+			Devices:    call.Devices{Microphone: newSilence(), Speaker: callee},
+		})
+	}()
+	defer func() {
+		cancel()
+		assert.Nil(t, <-listening)
+	}()
+	// the invite is only seen by a listener already in the room
+	time.Sleep(200 * time.Millisecond)
+
+	caller := &speaker{}
+	co := call.DefaultCallOptions()
+	co.Devices = call.Devices{Microphone: newSilence(), Speaker: caller}
+	cs, err := alice.Call(call.MediaAudio, call.DirectionSendRecv, co)
+	if !assert.Nil(t, err) {
+		return
+	}
+	started := waitEvent(t, alice, func(e Event) bool { return e.Kind == EventCallStarted })
+	assert.Same(t, cs, started.Call)
+	_, err = alice.Call(call.MediaAudio, call.DirectionSendRecv, co)
+	assert.ErrorIs(t, err, ErrCallInProgress)
+
+	assert.Eventually(t, func() bool { return caller.heard() && callee.heard() }, 10*time.Second, 50*time.Millisecond)
+
+	// the chat and a transfer work during the call
+	aliceChat, err := alice.Chat()
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = bob.Chat()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, aliceChat.Send(message.Message{Type: "chat", Message: "hello bob", Alias: "alice"}))
+	waitEvent(t, bob, func(e Event) bool { return e.Kind == EventMessage && e.Message.Message == "hello bob" })
+	go func() {
+		for range alice.Events() {
+		}
+	}()
+	fname := filepath.Join(t.TempDir(), "during-call.bin")
+	assert.Nil(t, os.WriteFile(fname, bytes.Repeat([]byte("call"), 1<<18), 0o644))
+	_, err = alice.SendFile(fname)
+	assert.Nil(t, err)
+	offer := waitEvent(t, bob, func(e Event) bool { return e.Kind == EventMessage && e.Message.Message == "during-call.bin" })
+	dir := t.TempDir()
+	assert.Nil(t, bob.ReceiveFile(offer.Message, dir))
+	go func() {
+		for range bob.Events() {
+		}
+	}()
+	assert.Eventually(t, func() bool {
+		fi, err := os.Stat(filepath.Join(dir, "during-call.bin"))
+		return err == nil && fi.Size() == 1<<20
+	}, 10*time.Second, 20*time.Millisecond)
+	heard := callee.count()
+	assert.Eventually(t, func() bool { return callee.count() > heard+10 }, 10*time.Second, 50*time.Millisecond, "the call goes on")
+	select {
+	case <-cs.Done():
+		t.Error("the call ended during the transfer")
+	default:
+	}
+	assert.EqualValues(t, 2, relay.accepted.Load(), "each peer has one connection to the relay")
+
+	assert.Nil(t, alice.Close())
+	select {
+	case <-cs.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Close did not hang up the call")
+	}
+
+	// a call nobody answers is given up by Close
+	options.SharedSecret = "1234-session-unanswered"
+	carol, err := New(context.Background(), options)
+	assert.Nil(t, err)
+	callErr := make(chan error, 1)
+	go func() {
+		_, err := carol.Call(call.MediaAudio, call.DirectionRecvOnly, call.DefaultCallOptions())
+		callErr <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, carol.Close())
+	select {
+	case err = <-callErr:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not give up the call")
+	}
+}
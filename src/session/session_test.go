@@ -0,0 +1,135 @@
+package session
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/call"
+	"github.com/schollz/croc/v10/src/croc"
+	"github.com/schollz/croc/v10/src/message"
+	"github.com/schollz/croc/v10/src/tcp"
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	_, err := New(context.Background(), croc.Options{SharedSecret: "123"})
+	assert.NotNil(t, err)
+	s, err := New(context.Background(), croc.Options{SharedSecret: "1234-session"})
+	assert.Nil(t, err)
+	assert.Equal(t, croc.DeriveRoomName("1234-session", croc.NamespaceSignal), s.RoomName(croc.NamespaceSignal))
+	assert.Nil(t, s.Close())
+	_, ok := <-s.Events()
+	assert.False(t, ok, "Close closes Events")
+	_, err = s.Chat()
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = s.Call(call.MediaAudio, call.DirectionSendRecv, call.DefaultCallOptions())
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.Nil(t, s.Close(), "Close can be called twice")
+}
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+// testRelay runs a relay for the test, counting its connections.
+func testRelay(t *testing.T) *countingListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: l}
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", "pass123", tcp.WithListener(counted), tcp.WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return counted
+}
+
+func TestSession(t *testing.T) {
+	log.SetLevel("error")
+	relay := testRelay(t)
+	options := croc.Options{SharedSecret: "1234-session-facade", RelayAddress: relay.Addr().String(), RelayPassword: "pass123"}
+	alice, err := New(context.Background(), options)
+	assert.Nil(t, err)
+	bob, err := New(context.Background(), options)
+	assert.Nil(t, err)
+	defer bob.Close()
+	assert.EqualValues(t, 0, relay.accepted.Load(), "nothing connects before it is used")
+
+	aliceChat, err := alice.Chat()
+	if !assert.Nil(t, err) {
+		return
+	}
+	again, err := alice.Chat()
+	assert.Nil(t, err)
+	assert.Same(t, aliceChat, again, "the chat is joined once")
+	_, err = bob.Chat()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, aliceChat.Send(message.Message{Type: "chat", Message: "hello bob", Alias: "alice"}))
+	waitEvent(t, bob, func(e Event) bool { return e.Kind == EventMessage && e.Message.Message == "hello bob" })
+
+	// a file goes over the connection of the chat
+	fname := filepath.Join(t.TempDir(), "notes.txt")
+	assert.Nil(t, os.WriteFile(fname, []byte("from alice"), 0o644))
+	go func() {
+		for range alice.Events() {
+		}
+	}()
+	_, err = alice.SendFile(fname)
+	assert.Nil(t, err)
+	offer := waitEvent(t, bob, func(e Event) bool { return e.Kind == EventMessage && e.Message.Message == "notes.txt" })
+	assert.NotNil(t, bob.ReceiveFile(message.Message{Type: "chat", Message: "notes.txt"}, t.TempDir()), "only offers are received")
+	dir := t.TempDir()
+	assert.Nil(t, bob.ReceiveFile(offer.Message, dir))
+	waitEvent(t, bob, func(e Event) bool { return e.Kind == EventTransfer })
+	assert.Eventually(t, func() bool {
+		received, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+		return err == nil && string(received) == "from alice"
+	}, 10*time.Second, 20*time.Millisecond)
+	assert.EqualValues(t, 2, relay.accepted.Load(), "each peer has one connection to the relay")
+
+	assert.Nil(t, alice.Close())
+	_, err = alice.Chat()
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+// waitEvent reads the events of s until one matches.
+func waitEvent(t *testing.T, s *Session, match func(Event) bool) Event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				t.Fatal("the session closed")
+			}
+			if match(e) {
+				return e
+			}
+		case <-timeout:
+			t.Fatal("the event was not reported")
+		}
+	}
+}
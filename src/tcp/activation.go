@@ -0,0 +1,66 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor systemd passes sockets on.
+const listenFDsStart = 3
+
+// ActivationListeners returns the sockets passed to the process by systemd
+// socket activation, in the order the socket unit lists them, or none if
+// the process was started otherwise. It unsets the environment variables
+// of the protocol so processes started later do not claim the sockets too.
+// Pass each listener to a relay with WithListener.
+func ActivationListeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+	return activationListeners(pid, fds, listenFDsStart)
+}
+
+// activationListeners wraps the fds descriptors from first on, if pid is
+// this process.
+func activationListeners(pid, fds string, first int) (listeners []net.Listener, err error) {
+	if pid == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	return fileListeners(first, n, "systemd")
+}
+
+// fileListeners wraps the n descriptors from first on as listeners, which
+// were passed on by from.
+func fileListeners(first, n int, from string) (listeners []net.Listener, err error) {
+	for fd := first; fd < first+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, errListener := net.FileListener(f)
+		// the listener has its own copy of the descriptor
+		f.Close()
+		if errListener != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %d from %s: %w", fd, from, errListener)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// ListenerOnPort returns the listener among listeners bound to port, or nil.
+func ListenerOnPort(listeners []net.Listener, port string) net.Listener {
+	for _, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && strconv.Itoa(addr.Port) == port {
+			return l
+		}
+	}
+	return nil
+}
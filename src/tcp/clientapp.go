@@ -0,0 +1,86 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxClientAppLength caps, in bytes, the application a client declares in
+// its room request. Longer declarations are truncated.
+const maxClientAppLength = 64
+
+// upgradeRequiredResponse is sent instead of "ok" when the application the
+// client declared matches a pattern the relay was started
+// WithBlockedClients.
+const upgradeRequiredResponse = "upgrade required"
+
+// ErrUpgradeRequired is returned by ConnectToRoom when the relay refused
+// the client's version.
+var ErrUpgradeRequired = errors.New("relay refused this version of croc, please upgrade")
+
+// ClientApp returns what croc clients declare as their application, for
+// example "croc-chat/10.2.1 linux/amd64".
+func ClientApp(name, version string) string {
+	return fmt.Sprintf("%s/%s %s/%s", name, version, runtime.GOOS, runtime.GOARCH)
+}
+
+// sanitizeClientApp drops control and other unprintable characters from a
+// declared application and truncates it to maxClientAppLength, so it can
+// be logged and shown as is.
+func sanitizeClientApp(app string) string {
+	var b strings.Builder
+	for _, r := range app {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if b.Len()+utf8.RuneLen(r) > maxClientAppLength {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// clientPatterns match declared applications. In a pattern * stands for
+// any run of characters; everything else matches itself.
+type clientPatterns []*regexp.Regexp
+
+func compileClientPatterns(patterns []string) (clientPatterns, error) {
+	var compiled clientPatterns
+	for _, p := range patterns {
+		if strings.TrimSpace(p) == "" {
+			return nil, fmt.Errorf("empty client pattern")
+		}
+		re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid client pattern '%s': %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// match reports whether app matches any of the patterns. Clients that
+// declare nothing never match.
+func (p clientPatterns) match(app string) bool {
+	if app == "" {
+		return false
+	}
+	for _, re := range p {
+		if re.MatchString(app) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal reports whether p and q are the same patterns.
+func (p clientPatterns) equal(q clientPatterns) bool {
+	return slices.EqualFunc(p, q, func(a, b *regexp.Regexp) bool { return a.String() == b.String() })
+}
@@ -0,0 +1,309 @@
+package tcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+)
+
+// ClusterPolicy is how a relay in a cluster deals with a client that asks
+// for a room another instance owns.
+type ClusterPolicy string
+
+const (
+	// ClusterRedirect tells clients that can follow a redirect to connect
+	// to the owner themselves, and proxies the others.
+	ClusterRedirect ClusterPolicy = "redirect"
+	// ClusterProxy always proxies the connection to the owner, for
+	// instances clients cannot reach directly.
+	ClusterProxy ClusterPolicy = "proxy"
+)
+
+// ParseClusterPolicy parses the name of a cluster policy.
+func ParseClusterPolicy(s string) (ClusterPolicy, error) {
+	switch p := ClusterPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case ClusterRedirect, ClusterProxy:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown cluster policy %q, use redirect or proxy", s)
+}
+
+// CapabilityClusterRedirect is announced by relays that can redirect a
+// client to the instance of their cluster that owns its room, and
+// declared in the room request by clients that follow such redirects.
+// ConnectToRoom always declares it.
+const CapabilityClusterRedirect = "cluster-redirect"
+
+// redirectResponsePrefix starts the reply to a room request that names
+// the instance to ask instead of "ok".
+const redirectResponsePrefix = "redirect:"
+
+// maxRedirects is how many redirects ConnectToRoom follows for one room;
+// instances that agree on their peers never redirect more than once.
+const maxRedirects = 3
+
+// ErrTooManyRedirects is returned by ConnectToRoom when relays kept
+// redirecting it, which happens when the instances of a cluster disagree
+// about their peers.
+var ErrTooManyRedirects = errors.New("relay redirected too many times")
+
+// ringReplicas is how many points each instance has on the hash ring, so
+// rooms spread evenly and move as little as possible when an instance is
+// added or removed.
+const ringReplicas = 128
+
+// clusterDialTimeout is how long a proxying instance waits for the owner
+// of a room to answer.
+const clusterDialTimeout = 5 * time.Second
+
+// hashRing assigns keys to nodes by consistent hashing.
+type hashRing struct {
+	points []uint64
+	nodes  map[uint64]string
+}
+
+// newHashRing returns a ring with replicas points for each of nodes. The
+// ring is the same whatever order the nodes are given in.
+func newHashRing(nodes []string, replicas int) *hashRing {
+	r := &hashRing{nodes: make(map[uint64]string, len(nodes)*replicas)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			p := ringHash(node + "#" + strconv.Itoa(i))
+			// a collision goes to the same node on every instance
+			if other, ok := r.nodes[p]; !ok {
+				r.points = append(r.points, p)
+			} else if other < node {
+				continue
+			}
+			r.nodes[p] = node
+		}
+	}
+	slices.Sort(r.points)
+	return r
+}
+
+// owner returns the node key belongs to: that of the first point at or
+// after the hash of key, going round.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// cluster is what an instance knows of the cluster it is in.
+type cluster struct {
+	// self is the address of this instance, as listed in peers.
+	self   string
+	peers  []string
+	policy ClusterPolicy
+	ring   *hashRing
+}
+
+// owner returns the address of the instance that owns room, and whether
+// that is this one.
+func (cl *cluster) owner(room string) (string, bool) {
+	owner := cl.ring.owner(room)
+	return owner, owner == cl.self
+}
+
+// isPeer reports whether a connection from host comes from an instance of
+// the cluster, the only ones whose forwarded room requests are honored.
+func (cl *cluster) isPeer(host string) bool {
+	for _, peer := range cl.peers {
+		peerHost, _, _ := net.SplitHostPort(peer)
+		if peerHost == host {
+			return true
+		}
+		addrs, err := net.LookupHost(peerHost)
+		if err == nil && slices.Contains(addrs, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCluster makes the relay one instance of a cluster that shares a
+// DNS name, where peers lists the address of every instance, self
+// included, and every instance has the same list and password. Each room
+// is owned by one instance, picked by consistent hashing of the room
+// name, so peers that land on different instances still meet. A client
+// asking for a room another instance owns is redirected there or
+// proxied, as policy says.
+//
+// Proxied clients count against the limits of the owner, such as
+// WithMaxRoomsPerIP, by their own address rather than by that of the
+// instance proxying them.
+func WithCluster(self string, peers []string, policy ClusterPolicy) serverOptsFunc {
+	return func(s *server) error {
+		if len(peers) == 0 {
+			return nil
+		}
+		if _, err := ParseClusterPolicy(string(policy)); err != nil {
+			return err
+		}
+		for i, peer := range peers {
+			if _, port, err := net.SplitHostPort(peer); err != nil || !validPort(port) {
+				return fmt.Errorf("invalid cluster peer %q, want host:port", peer)
+			}
+			if slices.Contains(peers[:i], peer) {
+				return fmt.Errorf("cluster peer %s is listed twice", peer)
+			}
+		}
+		if !slices.Contains(peers, self) {
+			return fmt.Errorf("cluster peers do not list this relay, %q", self)
+		}
+		s.cluster = &cluster{self: self, peers: slices.Clone(peers), policy: policy, ring: newHashRing(peers, ringReplicas)}
+		return nil
+	}
+}
+
+// clusterRoom is returned by clientCommunication for a connection it sent
+// to the owner of its room, which is closed instead of joining a room here.
+const clusterRoom = "\x00cluster"
+
+// roomForwardedSeparator introduces the field a proxying instance adds to
+// the room request, naming the host of the client it proxies.
+const roomForwardedSeparator = "\x00forwarded="
+
+// routeToOwner sends a client that asked for a room another instance
+// owns on its way and reports whether it did; a false return leaves the
+// client to join here. Clients that follow redirects are redirected under
+// ClusterRedirect, and the others are proxied, for as long as they stay
+// in the room. A client whose owner cannot be reached joins here rather
+// than not at all.
+func (s *server) routeToOwner(c *comm.Comm, key []byte, req RoomRequest, settings settings, clog *connLogger) (bool, error) {
+	owner, own := s.cluster.owner(req.Room)
+	if own {
+		return false, nil
+	}
+	if s.cluster.policy == ClusterRedirect && slices.Contains(req.Capabilities, CapabilityClusterRedirect) {
+		clog.Debugf("redirecting to %s", owner)
+		enc, err := crypt.Encrypt([]byte(redirectResponsePrefix+owner), key)
+		if err != nil {
+			return true, err
+		}
+		return true, c.Send(enc)
+	}
+
+	forwarded := req
+	forwarded.forwardedFor = remoteHost(c)
+	upstream, _, _, err := connectToRoom(owner, settings.password, forwarded, 0, clusterDialTimeout)
+	if reply, refused := refusalResponse(err); refused {
+		clog.Infof("owner %s refused the room: %v", owner, err)
+		enc, errEnc := crypt.Encrypt([]byte(reply), key)
+		if errEnc == nil {
+			c.Send(enc)
+		}
+		return true, err
+	}
+	if err != nil {
+		clog.Warnf("could not reach %s, which owns the room, joining here: %v", owner, err)
+		s.errors.add(s.clock.Now(), errorClusterUnreachable)
+		return false, nil
+	}
+	defer upstream.Close()
+	joined := "ok"
+	if tag := upstream.SessionTag(); tag != "" {
+		joined += joinTagSeparator + tag
+	}
+	enc, err := crypt.Encrypt([]byte(joined), key)
+	if err != nil {
+		return true, err
+	}
+	if err = c.Send(enc); err != nil {
+		return true, err
+	}
+	clog.Debugf("proxying to %s", owner)
+	proxyRoom(c, upstream, key, clog)
+	return true, nil
+}
+
+// refusalResponse returns the reply that passes on why the owner of a
+// room refused it, and false for errors that are not a refusal.
+func refusalResponse(err error) (string, bool) {
+	for reply, refusal := range map[string]error{
+		invalidRoomResponse:     ErrInvalidRoom,
+		tooManyRoomsResponse:    ErrTooManyRooms,
+		upgradeRequiredResponse: ErrUpgradeRequired,
+		observersDeniedResponse: ErrObserversDenied,
+	} {
+		if errors.Is(err, refusal) {
+			return reply, true
+		}
+	}
+	return "", false
+}
+
+// proxyRoom passes frames between a client and its connection to the
+// owner of its room until either goes away. Frames are passed on as they
+// are, except control frames, which the owner encrypted for the proxy
+// and are encrypted again for the client with key.
+func proxyRoom(c, upstream *comm.Comm, key []byte, clog *connLogger) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		for {
+			data, err := upstream.Receive()
+			if errors.Is(err, comm.ErrPeerDone) {
+				if c.WriteEOF() != nil {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if IsControlFrame(data) {
+				kind, errControl := ParseControlFrame(upstream, data)
+				if errControl == nil {
+					data, errControl = encodeControlFrame(kind, key)
+				}
+				if errControl != nil {
+					clog.Debugf("dropping control frame: %v", errControl)
+					continue
+				}
+			}
+			if c.Send(data) != nil {
+				return
+			}
+		}
+	}()
+	for {
+		data, err := c.Receive()
+		if errors.Is(err, comm.ErrPeerDone) {
+			// the client stays for replies, as it would in a room here,
+			// unless the owner does not understand EOF frames
+			if upstream.SendEOF() != nil {
+				upstream.Close()
+			}
+			break
+		}
+		if err != nil || upstream.Send(data) != nil {
+			upstream.Close()
+			break
+		}
+	}
+	<-done
+}
@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+	"github.com/schollz/pake/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyRelay answers one connection on l the way upstream croc's relay
+// does: it announces no capabilities and takes the room frame whole. The
+// room asked for is sent on rooms. done is closed on return.
+func legacyRelay(t *testing.T, l net.Listener, password string, rooms chan<- string, done chan<- struct{}) {
+	defer close(done)
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	c := comm.New(conn)
+	defer c.Close()
+	step := func(err error) bool {
+		if err != nil {
+			t.Errorf("legacy relay: %v", err)
+			return false
+		}
+		return true
+	}
+	B, err := pake.InitCurve(weakKey, 1, "siec")
+	if !step(err) {
+		return
+	}
+	A, err := c.Receive()
+	if !step(err) || !step(B.Update(A)) || !step(c.Send(B.Bytes())) {
+		return
+	}
+	strongKey, err := B.SessionKey()
+	if !step(err) {
+		return
+	}
+	salt, err := c.Receive()
+	if !step(err) {
+		return
+	}
+	key, _, err := crypt.New(strongKey, salt)
+	if !step(err) {
+		return
+	}
+	enc, err := c.Receive()
+	if !step(err) {
+		return
+	}
+	got, err := crypt.Decrypt(enc, key)
+	if !step(err) || !assert.Equal(t, password, strings.TrimSpace(string(got))) {
+		return
+	}
+	enc, err = crypt.Encrypt([]byte("ok|||"+conn.RemoteAddr().String()), key)
+	if !step(err) || !step(c.Send(enc)) {
+		return
+	}
+	// a client can leave before asking for a room
+	if enc, err = c.Receive(); err != nil {
+		return
+	}
+	room, err := crypt.Decrypt(enc, key)
+	if !step(err) {
+		return
+	}
+	rooms <- string(room)
+	enc, err = crypt.Encrypt([]byte("ok"), key)
+	if step(err) {
+		step(c.Send(enc))
+	}
+}
+
+// TestLegacyRelayRoomRequest checks that a relay that announces nothing is
+// asked for the bare room, so peers of different versions still meet.
+func TestLegacyRelayRoomRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	rooms := make(chan string, 1)
+	room := strings.Repeat("ab", 32)
+
+	done := make(chan struct{})
+	go legacyRelay(t, l, "pass123", rooms, done)
+	c, banner, ip, err := ConnectToRoom(l.Addr().String(), "pass123", RoomRequest{
+		Room:         room,
+		Policy:       RoomPolicyLatestOnly,
+		Mode:         RoomModeChat,
+		App:          ClientApp("croc-chat", "v10.1.0"),
+		Capabilities: []string{CapabilityControlFrames, CapabilityRouting},
+	}, time.Minute)
+	if assert.Nil(t, err) {
+		defer c.Close()
+		assert.Equal(t, "ok", banner)
+		assert.Equal(t, c.Connection().LocalAddr().String(), ip)
+		for _, capability := range relayCapabilities {
+			assert.False(t, c.RelaySupports(capability), capability)
+		}
+		assert.Empty(t, c.SessionTag())
+	}
+	assert.Equal(t, room, <-rooms)
+	<-done
+
+	// an observer would be seated as a peer
+	done = make(chan struct{})
+	go legacyRelay(t, l, "pass123", rooms, done)
+	_, _, _, err = ConnectToRoom(l.Addr().String(), "pass123", RoomRequest{Room: room, Observer: true}, time.Minute)
+	assert.ErrorIs(t, err, ErrObserversUnsupported)
+	<-done
+}
@@ -0,0 +1,109 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+)
+
+// CapabilityControlFrames is announced by relays that can tell a
+// connection about the room in control frames, and declared in the room
+// request by clients that want them. Clients that do not declare it, like
+// croc transfers and upstream croc, get the bare ready byte instead, so
+// both kinds can share a room.
+const CapabilityControlFrames = "control-frames"
+
+// ControlKind is what a control frame tells a connection.
+type ControlKind string
+
+// ControlRoomReady says a peer has joined the room the connection was
+// waiting in.
+const ControlRoomReady ControlKind = "ready"
+
+// controlFramePrefix introduces a control frame, so clients can tell it
+// from peer data without a key. The rest of the frame is encrypted with
+// the key of the connection's handshake, so only the relay can send one.
+var controlFramePrefix = []byte("croc-relay-control:")
+
+// encodeControlFrame returns a control frame of kind for the connection
+// whose handshake produced key.
+func encodeControlFrame(kind ControlKind, key []byte) ([]byte, error) {
+	return encodeControl(Control{Kind: kind}, key)
+}
+
+// encodeControl returns a control frame saying c for the connection whose
+// handshake produced key.
+func encodeControl(c Control, key []byte) ([]byte, error) {
+	enc, err := crypt.Encrypt([]byte(c.String()), key)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, controlFramePrefix...), enc...), nil
+}
+
+// IsControlFrame reports whether data is a control frame.
+func IsControlFrame(data []byte) bool {
+	return bytes.HasPrefix(data, controlFramePrefix)
+}
+
+// ParseControlFrame returns the kind of a control frame received on c. It
+// fails for frames that are not control frames and for those the relay of
+// c did not send.
+func ParseControlFrame(c *comm.Comm, data []byte) (ControlKind, error) {
+	control, err := ParseControl(c, data)
+	return control.Kind, err
+}
+
+// ParseControl is like ParseControlFrame but returns all the control frame
+// says.
+func ParseControl(c *comm.Comm, data []byte) (Control, error) {
+	if !IsControlFrame(data) {
+		return Control{}, fmt.Errorf("not a control frame")
+	}
+	key := c.RelayKey()
+	if key == nil {
+		return Control{}, fmt.Errorf("control frame on a connection without a relay key")
+	}
+	text, err := crypt.Decrypt(data[len(controlFramePrefix):], key)
+	if err != nil {
+		return Control{}, fmt.Errorf("could not authenticate control frame: %w", err)
+	}
+	return parseControl(string(text))
+}
+
+// supportedCapabilities returns those of capabilities the relay of c
+// announced, so a room request never declares one the relay would not
+// honor.
+func supportedCapabilities(c *comm.Comm, capabilities []string) (supported []string) {
+	for _, capability := range capabilities {
+		if c.RelaySupports(capability) && !slices.Contains(supported, capability) {
+			supported = append(supported, capability)
+		}
+	}
+	return
+}
+
+// parseCapabilities reads the capabilities field of a room request,
+// dropping empty and overlong entries.
+func parseCapabilities(value string) (capabilities []string) {
+	for _, capability := range strings.Split(value, ",") {
+		if capability != "" && len(capability) <= 32 && !slices.Contains(capabilities, capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return
+}
+
+// readyFrame returns the frame that tells conn a peer has joined: a
+// control frame if it declared CapabilityControlFrames and the ready byte
+// otherwise.
+func (r roomInfo) readyFrame(conn *comm.Comm) ([]byte, error) {
+	if key, ok := r.controlKeys[conn]; ok {
+		return encodeControlFrame(ControlRoomReady, key)
+	}
+	return []byte{1}, nil
+}
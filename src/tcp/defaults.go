@@ -6,4 +6,13 @@ const (
 	DEFAULT_LOG_LEVEL             = "debug"
 	DEFAULT_ROOM_CLEANUP_INTERVAL = 10 * time.Minute
 	DEFAULT_ROOM_TTL              = 3 * time.Hour
+	DEFAULT_SNIFF_TIMEOUT         = 3 * time.Second
+	DEFAULT_HANDSHAKE_TIMEOUT     = 30 * time.Second
+	// DEFAULT_QUOTA_WARNING is the fraction of its byte quota a room is
+	// warned at, and DEFAULT_EXPIRY_WARNING how long before its TTL.
+	DEFAULT_QUOTA_WARNING  = 0.8
+	DEFAULT_EXPIRY_WARNING = 5 * time.Minute
+	// DEFAULT_LOG_SAMPLING is how many debug lines of each kind the relay
+	// writes a second.
+	DEFAULT_LOG_SAMPLING = 10
 )
@@ -0,0 +1,238 @@
+package tcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// ErrHandoffUnsupported is returned by Upgrader on platforms that cannot
+// pass sockets to a new process.
+var ErrHandoffUnsupported = errors.New("listener handoff is only supported on Linux and macOS")
+
+// handoffEnv tells a relay process it was started by a handoff, and how
+// many listeners it inherited.
+const handoffEnv = "CROC_RELAY_HANDOFF"
+
+// handoffReadyTimeout is how long the old process waits for the new one to
+// take over before giving up and serving on.
+const handoffReadyTimeout = 30 * time.Second
+
+// drainPollInterval is how often a draining relay checks whether its rooms
+// are done.
+const drainPollInterval = time.Second
+
+// roomRecord is what a new relay process learns about a room of the old
+// one. Connections are not handed over; peers that reconnect find the room
+// with the policy and mode it was created with, and it still expires with
+// the TTL counted from when it was opened.
+type roomRecord struct {
+	Room   string     `json:"room"`
+	Opened time.Time  `json:"opened"`
+	Policy RoomPolicy `json:"policy,omitempty"`
+	Mode   RoomMode   `json:"mode,omitempty"`
+	// DenyObservers is set for rooms that keep observers out.
+	DenyObservers bool `json:"deny_observers,omitempty"`
+}
+
+// handoffState is sent from the old process to the new one over a pipe.
+type handoffState struct {
+	// Ports lists the port of each inherited listener, in order.
+	Ports []string `json:"ports"`
+	// Rooms are the rooms of each port.
+	Rooms map[string][]roomRecord `json:"rooms,omitempty"`
+}
+
+func writeHandoffState(w io.Writer, state handoffState) error {
+	return json.NewEncoder(w).Encode(state)
+}
+
+func readHandoffState(r io.Reader) (state handoffState, err error) {
+	if err = json.NewDecoder(r).Decode(&state); err != nil {
+		err = fmt.Errorf("bad handoff state: %w", err)
+	}
+	return
+}
+
+// Upgrader restarts relays without downtime: it hands their listeners and
+// rooms over to a new process, started from the same executable with the
+// same arguments, and lets the old process drain. Relays take part when
+// started WithUpgrader. Use NewUpgrader to create one, which also picks up
+// what a previous process handed over.
+type Upgrader struct {
+	mu sync.Mutex
+	// relays are the relays to hand over, by port.
+	relays map[string]handoffRelay
+	// upgraded is set once the relays have been handed over, which can
+	// only happen once.
+	upgraded bool
+
+	// inherited, rooms and ready are what this process got from the one
+	// it took over from.
+	inherited []net.Listener
+	rooms     map[string][]roomRecord
+	ready     io.WriteCloser
+}
+
+type handoffRelay struct {
+	s *server
+	l net.Listener
+}
+
+func newUpgrader() *Upgrader {
+	return &Upgrader{relays: make(map[string]handoffRelay)}
+}
+
+// Listeners returns the listeners handed over by the previous process, none
+// if this one was started otherwise. Pass each to its relay with
+// WithListener; ListenerOnPort finds the one for a port.
+func (u *Upgrader) Listeners() []net.Listener {
+	return u.inherited
+}
+
+// Ready tells the previous process this one has taken over, so it stops
+// accepting connections and drains. Call it once the inherited listeners
+// are passed to their relays; connections arriving before the relays run
+// wait in the listen queue.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	if errClose := u.ready.Close(); err == nil {
+		err = errClose
+	}
+	u.ready = nil
+	return err
+}
+
+// register adds a relay serving on l and gives it the rooms the previous
+// process had on its port.
+func (u *Upgrader) register(s *server, l net.Listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.relays[s.port] = handoffRelay{s: s, l: l}
+	if records := u.rooms[s.port]; len(records) > 0 {
+		s.restoreRooms(records)
+		delete(u.rooms, s.port)
+	}
+}
+
+// state returns the listeners of the relays and the state to send along
+// with them.
+func (u *Upgrader) state() (listeners []net.Listener, state handoffState) {
+	state.Rooms = make(map[string][]roomRecord)
+	for port := range u.relays {
+		state.Ports = append(state.Ports, port)
+	}
+	sort.Strings(state.Ports)
+	for _, port := range state.Ports {
+		r := u.relays[port]
+		listeners = append(listeners, r.l)
+		if records := r.s.snapshotRooms(); len(records) > 0 {
+			state.Rooms[port] = records
+		}
+	}
+	return
+}
+
+// drain stops the relays accepting connections. Each relay then drains
+// before it returns.
+func (u *Upgrader) drain() {
+	for _, r := range u.relays {
+		r.s.draining.Store(true)
+		r.l.Close()
+	}
+}
+
+// snapshotRooms returns the records of the rooms, ping rooms aside.
+func (s *server) snapshotRooms() (records []roomRecord) {
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	for room, r := range s.rooms.rooms {
+		if room == pingRoom {
+			continue
+		}
+		records = append(records, roomRecord{Room: room, Opened: r.opened, Policy: r.policy, Mode: r.mode, DenyObservers: r.denyObservers})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Room < records[j].Room })
+	return
+}
+
+// restoreRooms adds empty rooms for records, for peers to rejoin. Rooms
+// that exist already are left alone.
+func (s *server) restoreRooms(records []roomRecord) {
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	for _, rec := range records {
+		if _, ok := s.rooms.rooms[rec.Room]; ok {
+			continue
+		}
+		r := roomInfo{
+			opened:        rec.Opened,
+			policy:        rec.Policy,
+			mode:          rec.Mode,
+			hosts:         make(map[*comm.Comm]string),
+			instances:     make(map[*comm.Comm]string),
+			superseded:    make(map[*comm.Comm]bool),
+			joined:        make(map[*comm.Comm]time.Time),
+			traffic:       new(trafficWindow),
+			lastReceive:   make(map[*comm.Comm]time.Time),
+			spans:         make(map[*comm.Comm]trace.Span),
+			apps:          make(map[*comm.Comm]string),
+			denyObservers: rec.DenyObservers,
+			controlKeys:   make(map[*comm.Comm][]byte),
+			routeTags:     make(map[*comm.Comm]string),
+			warningKeys:   make(map[*comm.Comm][]byte),
+			usage:         new(roomUsage),
+		}
+		if s.replayMaxFrames > 0 {
+			var err error
+			if r.replay, err = newReplayBuffer(s.replayMaxFrames, s.replayMaxBytes, s.bufferEncryption); err != nil {
+				s.logger.Warnf("[room=%s] not restoring room: %v", roomLogName(rec.Room), err)
+				continue
+			}
+		}
+		s.rooms.open(&r)
+		s.rooms.rooms[rec.Room] = r
+	}
+	s.logger.Infof("restored %d rooms from the previous relay", len(records))
+}
+
+// drain closes the rooms still waiting for a peer, so that their clients
+// reconnect to the relay that took over, and waits for the others to
+// finish or expire with the room TTL.
+func (s *server) drain() {
+	s.rooms.Lock()
+	var waiting []string
+	for room, r := range s.rooms.rooms {
+		if len(r.conns) < 2 {
+			waiting = append(waiting, room)
+		}
+	}
+	s.rooms.Unlock()
+	for _, room := range waiting {
+		s.deleteRoom(room)
+	}
+	for {
+		s.rooms.Lock()
+		n := len(s.rooms.rooms)
+		s.rooms.Unlock()
+		if n == 0 {
+			return
+		}
+		s.logger.Debugf("draining %d rooms", n)
+		<-s.clock.After(drainPollInterval)
+	}
+}
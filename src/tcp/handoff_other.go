@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package tcp
+
+import "context"
+
+// NewUpgrader returns an Upgrader that hands nothing over, since listener
+// handoff is not supported on this platform.
+func NewUpgrader() (*Upgrader, error) {
+	return newUpgrader(), nil
+}
+
+// Upgrade returns ErrHandoffUnsupported.
+func (u *Upgrader) Upgrade() error {
+	return ErrHandoffUnsupported
+}
+
+// UpgradeOnSignal returns ErrHandoffUnsupported.
+func (u *Upgrader) UpgradeOnSignal(ctx context.Context) error {
+	return ErrHandoffUnsupported
+}
@@ -0,0 +1,175 @@
+//go:build linux || darwin
+
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/schollz/logger"
+)
+
+// NewUpgrader returns an Upgrader holding whatever a previous relay process
+// handed over to this one, which is nothing unless this process was
+// started by Upgrade. It unsets the environment variable of the handoff so
+// processes started later do not claim the descriptors too.
+func NewUpgrader() (*Upgrader, error) {
+	n := os.Getenv(handoffEnv)
+	os.Unsetenv(handoffEnv)
+	u := newUpgrader()
+	if n == "" {
+		return u, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid %s %q", handoffEnv, n)
+	}
+	if err = u.inherit(count, listenFDsStart); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// inherit takes over n listeners from descriptor first on, followed by the
+// pipe carrying the handoff state and the pipe to report readiness on.
+func (u *Upgrader) inherit(n, first int) (err error) {
+	statePipe := os.NewFile(uintptr(first+n), "handoff-state")
+	readyPipe := os.NewFile(uintptr(first+n+1), "handoff-ready")
+	defer func() {
+		statePipe.Close()
+		if err != nil {
+			readyPipe.Close()
+		}
+	}()
+	state, err := readHandoffState(statePipe)
+	if err != nil {
+		return
+	}
+	if len(state.Ports) != n {
+		return fmt.Errorf("handoff of %d listeners lists %d ports", n, len(state.Ports))
+	}
+	if u.inherited, err = fileListeners(first, n, "the previous relay"); err != nil {
+		return
+	}
+	u.rooms = state.Rooms
+	u.ready = readyPipe
+	return nil
+}
+
+// Upgrade hands the relays over to a new process running the current
+// executable with the same arguments. It returns once the new process has
+// called Ready, after which the relays here stop accepting connections,
+// close the rooms that are waiting for a peer and return once the rest are
+// done. If the new process fails to take over in time, it is killed and
+// the relays serve on.
+func (u *Upgrader) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find the relay executable: %w", err)
+	}
+	return u.upgrade(exe, os.Args[1:], handoffReadyTimeout)
+}
+
+func (u *Upgrader) upgrade(path string, args []string, timeout time.Duration) (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.upgraded {
+		return errors.New("relays were handed over already")
+	}
+	if len(u.relays) == 0 {
+		return errors.New("no relays to hand over")
+	}
+	listeners, state := u.state()
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over listener on port %s", state.Ports[i])
+		}
+		f, errFile := fl.File()
+		if errFile != nil {
+			return fmt.Errorf("cannot hand over listener on port %s: %w", state.Ports[i], errFile)
+		}
+		files = append(files, f)
+	}
+	stateRead, stateWrite, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer stateWrite.Close()
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		stateRead.Close()
+		return
+	}
+	defer readyRead.Close()
+	// the child's ends are closed with the listener copies once it has them
+	files = append(files, stateRead, readyWrite)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", handoffEnv, len(listeners)))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start new relay: %w", err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+	fail := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err = writeHandoffState(stateWrite, state); err != nil {
+		return fail(fmt.Errorf("cannot send handoff state: %w", err))
+	}
+	stateWrite.Close()
+	if err = readyRead.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fail(err)
+	}
+	if _, err = readyRead.Read(make([]byte, 1)); err != nil {
+		return fail(fmt.Errorf("new relay did not take over: %w", err))
+	}
+	// the new relay outlives this process; reap it if it exits first
+	go cmd.Wait()
+	log.Infof("relay process %d took over, draining", cmd.Process.Pid)
+	u.upgraded = true
+	u.drain()
+	return nil
+}
+
+// UpgradeOnSignal calls Upgrade whenever the process gets SIGUSR2, until
+// ctx is done or an upgrade succeeds. Failed upgrades are logged and the
+// relays serve on.
+func (u *Upgrader) UpgradeOnSignal(ctx context.Context) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sigs:
+			log.Infof("got SIGUSR2, handing relays over to a new process")
+			if err := u.Upgrade(); err != nil {
+				log.Errorf("upgrade failed: %v", err)
+				continue
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//go:build linux || darwin
+
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// handoffHelperEnv runs TestHandoffHelper as the relay taking over, writing
+// what it inherited to the file it names.
+const handoffHelperEnv = "CROC_TEST_HANDOFF_HELPER"
+
+func TestHandoff(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	u := newUpgrader()
+	assert.NotNil(t, u.upgrade(os.Args[0], nil, time.Second), "nothing to hand over yet")
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithUpgrader(u), WithBanner("9010"), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	var waiting *comm.Comm
+	assert.Eventually(t, func() bool {
+		waiting, _, _, err = ConnectToRoom(addr, "pass123", RoomRequest{Room: "waiting", Mode: RoomModeChat}, time.Second)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	defer waiting.Close()
+
+	report := filepath.Join(t.TempDir(), "inherited.json")
+	t.Setenv(handoffHelperEnv, report)
+	assert.Nil(t, u.upgrade(os.Args[0], []string{"-test.run=^TestHandoffHelper$"}, 10*time.Second))
+	assert.NotNil(t, u.upgrade(os.Args[0], nil, time.Second), "handed over already")
+
+	// the new process inherited the socket and the rooms
+	b, err := os.ReadFile(report)
+	assert.Nil(t, err)
+	var inherited []roomRecord
+	assert.Nil(t, json.Unmarshal(b, &inherited))
+	if assert.Len(t, inherited, 1) {
+		assert.Equal(t, "waiting", inherited[0].Room)
+		assert.Equal(t, RoomModeChat, inherited[0].Mode)
+	}
+
+	// the old relay drains, which closes the waiting room, and stops
+	_, err = waiting.Receive()
+	assert.NotNil(t, err)
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("old relay did not stop")
+	}
+
+	// the new one answers on the same address, and exits once it sees us
+	c, banner, _, err := ConnectToRoom(addr, "pass123", RoomRequest{Room: "handoff-done"}, 2*time.Second)
+	if assert.Nil(t, err) {
+		defer c.Close()
+		assert.Equal(t, "9011", banner)
+		_, err = c.Receive()
+		assert.NotNil(t, err)
+	}
+}
+
+// TestHandoffHelper is the relay TestHandoff hands over to.
+func TestHandoffHelper(t *testing.T) {
+	report := os.Getenv(handoffHelperEnv)
+	if report == "" {
+		t.Skip("only run by TestHandoff")
+	}
+	log.SetLevel("error")
+	exit := func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// exit before the test framework reports to the parent's output
+		os.Exit(0)
+	}
+	u, err := NewUpgrader()
+	if err != nil {
+		exit(err)
+	}
+	if len(u.Listeners()) != 1 {
+		exit(fmt.Errorf("inherited %d listeners", len(u.Listeners())))
+	}
+	s, err := configure("127.0.0.1", "", "pass123", []serverOptsFunc{WithListener(u.Listeners()[0]), WithUpgrader(u), WithBanner("9011"), WithLogLevel("error"), WithStrictRoomNames(false)})
+	if err != nil {
+		exit(err)
+	}
+	go s.start()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.hasRoom("waiting") {
+		if time.Now().After(deadline) {
+			exit(fmt.Errorf("rooms were not restored"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b, err := json.Marshal(s.snapshotRooms())
+	if err == nil {
+		err = os.WriteFile(report, b, 0o644)
+	}
+	if err == nil {
+		err = u.Ready()
+	}
+	if err != nil {
+		exit(err)
+	}
+	for !s.hasRoom("handoff-done") {
+		if time.Now().After(deadline.Add(5 * time.Second)) {
+			exit(fmt.Errorf("parent never connected"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	exit(nil)
+}
+
+func (s *server) hasRoom(room string) bool {
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	_, ok := s.rooms.rooms[room]
+	return ok
+}
+
+func TestNewUpgraderEnv(t *testing.T) {
+	t.Setenv(handoffEnv, "")
+	u, err := NewUpgrader()
+	assert.Nil(t, err)
+	assert.Empty(t, u.Listeners())
+	assert.Nil(t, u.Ready())
+	t.Setenv(handoffEnv, "two")
+	_, err = NewUpgrader()
+	assert.NotNil(t, err)
+	_, ok := os.LookupEnv(handoffEnv)
+	assert.False(t, ok, "the variable is not passed on")
+}
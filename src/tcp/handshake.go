@@ -0,0 +1,52 @@
+package tcp
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// errHandshakeTimeout is returned by clientCommunication for a connection
+// that did not ask for a room within the handshake timeout.
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// States of a handshakeDeadline.
+const (
+	deadlinePending int32 = iota
+	deadlineMet
+	deadlineExpired
+)
+
+// handshakeDeadline closes a connection that is not through the handshake
+// in time. comm.Comm sets its own read deadlines on every frame, hours
+// long, so the deadline is a timer rather than one on the connection.
+type handshakeDeadline struct {
+	timer *time.Timer
+	state atomic.Int32
+}
+
+// newHandshakeDeadline closes c after timeout unless stop is called
+// first. A zero timeout never closes it.
+func newHandshakeDeadline(c *comm.Comm, timeout time.Duration) *handshakeDeadline {
+	d := new(handshakeDeadline)
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, func() {
+			if d.state.CompareAndSwap(deadlinePending, deadlineExpired) {
+				c.Close()
+			}
+		})
+	}
+	return d
+}
+
+// stop lifts the deadline and reports whether it was met, which it still
+// is when stop is called again.
+func (d *handshakeDeadline) stop() bool {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.state.CompareAndSwap(deadlinePending, deadlineMet)
+	return d.state.Load() == deadlineMet
+}
@@ -0,0 +1,156 @@
+package tcp
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/clock"
+)
+
+// Histograms count microseconds in HDR-style buckets: exact below
+// 1<<histogramSubBits, then histogramSubBits bits of precision for each
+// power of two above, which keeps every quantile within about 6% of the
+// value recorded at a fixed size per histogram.
+const (
+	histogramSubBits    = 4
+	histogramSubBuckets = 1 << histogramSubBits
+	histogramBuckets    = histogramSubBuckets * (64 - histogramSubBits + 1)
+)
+
+// histogram is a fixed size histogram of durations. Its methods do
+// nothing on a nil histogram, which is how a relay without metrics skips
+// recording.
+type histogram struct {
+	sync.Mutex
+	counts [histogramBuckets]uint64
+	count  uint64
+	max    uint64
+}
+
+// histogramBucket returns the index of the bucket counting v.
+func histogramBucket(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histogramSubBits - 1
+	return histogramSubBuckets*(shift+1) + int(v>>shift) - histogramSubBuckets
+}
+
+// histogramUpper returns the highest value bucket i counts.
+func histogramUpper(i int) uint64 {
+	if i < histogramSubBuckets {
+		return uint64(i)
+	}
+	shift := i/histogramSubBuckets - 1
+	sub := uint64(i%histogramSubBuckets + histogramSubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	if h == nil {
+		return
+	}
+	v := uint64(max(d.Microseconds(), 0))
+	h.Lock()
+	defer h.Unlock()
+	h.counts[histogramBucket(v)]++
+	h.count++
+	h.max = max(h.max, v)
+}
+
+// quantiles returns how many durations were recorded and the duration
+// under which the fraction q of them fall, for each q. A quantile is the
+// highest value of its bucket, but never more than the largest recorded.
+func (h *histogram) quantiles(q ...float64) (count uint64, d []time.Duration) {
+	d = make([]time.Duration, len(q))
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.count == 0 {
+		return
+	}
+	for j, f := range q {
+		rank := max(uint64(f*float64(h.count)+0.5), 1)
+		var seen uint64
+		for i, n := range h.counts {
+			if seen += n; seen >= rank {
+				d[j] = time.Duration(min(histogramUpper(i), h.max)) * time.Microsecond
+				break
+			}
+		}
+	}
+	return h.count, d
+}
+
+// Handshake phases timed in Stats.Handshake, in the order they run.
+const (
+	phaseFirstFrame = "first_frame"
+	phasePAKE       = "pake"
+	phaseAuth       = "auth"
+	phaseRoomJoin   = "room_join"
+)
+
+// handshakeTimings times each phase of the handshakes clientCommunication
+// runs: from accepting the connection to its first frame, the PAKE, the
+// password check and joining the room. Only phases that complete are
+// recorded. It is nil unless the relay serves stats or a status page.
+type handshakeTimings struct {
+	firstFrame, pake, auth, roomJoin *histogram
+	// clock is the relay's, which phases are timed with.
+	clock clock.Clock
+}
+
+func newHandshakeTimings(c clock.Clock) *handshakeTimings {
+	return &handshakeTimings{firstFrame: new(histogram), pake: new(histogram), auth: new(histogram), roomJoin: new(histogram), clock: c}
+}
+
+// record adds the time since start to the histogram of phase and returns
+// now, when the next phase starts. It does nothing on nil timings.
+func (t *handshakeTimings) record(phase string, start time.Time) time.Time {
+	if t == nil {
+		return start
+	}
+	now := t.clock.Now()
+	t.histogram(phase).record(now.Sub(start))
+	return now
+}
+
+func (t *handshakeTimings) histogram(phase string) *histogram {
+	switch phase {
+	case phaseFirstFrame:
+		return t.firstFrame
+	case phasePAKE:
+		return t.pake
+	case phaseAuth:
+		return t.auth
+	case phaseRoomJoin:
+		return t.roomJoin
+	}
+	return nil
+}
+
+// PhaseTiming are the quantiles of one handshake phase since the relay
+// started.
+type PhaseTiming struct {
+	Phase string `json:"phase"`
+	Count uint64 `json:"count"`
+	P50   string `json:"p50"`
+	P95   string `json:"p95"`
+	P99   string `json:"p99"`
+}
+
+// stats returns the quantiles of each phase in order, or nil on nil
+// timings.
+func (t *handshakeTimings) stats() (phases []PhaseTiming) {
+	if t == nil {
+		return nil
+	}
+	for _, phase := range []string{phaseFirstFrame, phasePAKE, phaseAuth, phaseRoomJoin} {
+		count, q := t.histogram(phase).quantiles(0.5, 0.95, 0.99)
+		phases = append(phases, PhaseTiming{Phase: phase, Count: count, P50: q[0].String(), P95: q[1].String(), P99: q[2].String()})
+	}
+	return
+}
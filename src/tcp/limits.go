@@ -0,0 +1,209 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// CapabilityLimitWarnings is declared in the room request by clients that
+// want to be warned, in control frames, before their room reaches its
+// byte quota or TTL. Clients that do not declare it are cut off without
+// warning, as they always were.
+const CapabilityLimitWarnings = "limit-warnings"
+
+// ControlRoomExpiring warns that the room reaches its TTL in
+// Control.Left.
+const ControlRoomExpiring ControlKind = "expiring"
+
+// ControlQuotaWarning warns that the room has relayed Control.Used percent
+// of its byte quota.
+const ControlQuotaWarning ControlKind = "quota"
+
+// expiryCheckInterval is how often the relay looks for rooms to warn of
+// their TTL, unless the warning comes sooner than that before it.
+const expiryCheckInterval = 30 * time.Second
+
+// Kinds of limit events counted in Stats.LimitEvents.
+const (
+	limitExpiryWarning = "expiry_warning"
+	limitQuotaWarning  = "quota_warning"
+	limitRoomExpired   = "room_expired"
+	limitQuotaExceeded = "quota_exceeded"
+)
+
+// Control is what a control frame says.
+type Control struct {
+	Kind ControlKind
+	// Left is how long the room has until its TTL, for
+	// ControlRoomExpiring.
+	Left time.Duration
+	// Used is the percentage of its byte quota the room has relayed, for
+	// ControlQuotaWarning.
+	Used int
+}
+
+// String returns the text of a control frame saying c.
+func (c Control) String() string {
+	switch c.Kind {
+	case ControlRoomExpiring:
+		return fmt.Sprintf("%s %d", c.Kind, int64(c.Left/time.Second))
+	case ControlQuotaWarning:
+		return fmt.Sprintf("%s %d", c.Kind, c.Used)
+	}
+	return string(c.Kind)
+}
+
+// parseControl reads the text of a control frame. Kinds this relay does
+// not know are returned without their argument.
+func parseControl(text string) (c Control, err error) {
+	kind, arg, _ := strings.Cut(text, " ")
+	c.Kind = ControlKind(kind)
+	switch c.Kind {
+	case ControlRoomExpiring:
+		var seconds int64
+		if seconds, err = strconv.ParseInt(arg, 10, 64); err != nil || seconds < 0 {
+			return c, fmt.Errorf("malformed %s control frame: %q", c.Kind, arg)
+		}
+		c.Left = time.Duration(seconds) * time.Second
+	case ControlQuotaWarning:
+		if c.Used, err = strconv.Atoi(arg); err != nil || c.Used < 0 {
+			return c, fmt.Errorf("malformed %s control frame: %q", c.Kind, arg)
+		}
+	}
+	return c, nil
+}
+
+// roomUsage is what a room has used of its limits, and the warnings it
+// got for that.
+type roomUsage struct {
+	relayed      int64
+	quotaWarned  bool
+	expiryWarned bool
+}
+
+// charge counts n more bytes relayed against quota, where zero is no
+// quota. It reports whether they took the room past warning, the
+// fraction of the quota it is warned at, for the first time, and whether
+// they took it past the quota. The caller holds the rooms lock.
+func (u *roomUsage) charge(n, quota int64, warning float64) (warn, exceeded bool) {
+	u.relayed += n
+	if quota <= 0 {
+		return false, false
+	}
+	if u.relayed > quota {
+		return false, true
+	}
+	if warning > 0 && !u.quotaWarned && float64(u.relayed) >= warning*float64(quota) {
+		u.quotaWarned = true
+		return true, false
+	}
+	return false, false
+}
+
+// errRoomQuotaExceeded is returned for a connection whose joining took its
+// room past the byte quota, as the replay buffer was sent to it.
+var errRoomQuotaExceeded = errors.New("room passed its byte quota")
+
+// chargeRoom counts n relayed bytes against the byte quota of r. It
+// returns the quota warnings to send once the rooms lock, which the caller
+// holds, is released, and whether r passed its quota, in which case the
+// caller deletes it.
+func (s *server) chargeRoom(r roomInfo, n int, clog *connLogger) (warnings []controlDelivery, exceeded bool) {
+	if r.usage == nil {
+		return
+	}
+	warn, exceeded := r.usage.charge(int64(n), s.roomByteQuota, s.quotaWarning)
+	if exceeded {
+		s.limitEvents.add(limitQuotaExceeded)
+		clog.Infof("room passed its quota of %d bytes, deleting it", s.roomByteQuota)
+		return
+	}
+	if warn {
+		s.limitEvents.add(limitQuotaWarning)
+		used := int(r.usage.relayed * 100 / s.roomByteQuota)
+		clog.Debugf("room used %d%% of its quota", used)
+		warnings = r.warnings(Control{Kind: ControlQuotaWarning, Used: used})
+	}
+	return
+}
+
+// controlDelivery is a control frame for one connection.
+type controlDelivery struct {
+	conn  *comm.Comm
+	frame []byte
+}
+
+// warnings returns c as a control frame for every connection of the room
+// that declared CapabilityLimitWarnings. The caller holds the rooms lock
+// and sends them once it is released.
+func (r roomInfo) warnings(c Control) (deliveries []controlDelivery) {
+	for conn, key := range r.warningKeys {
+		frame, err := encodeControl(c, key)
+		if err != nil {
+			continue
+		}
+		deliveries = append(deliveries, controlDelivery{conn, frame})
+	}
+	return
+}
+
+// sendWarnings sends control frames returned by warnings.
+func sendWarnings(deliveries []controlDelivery) {
+	for _, d := range deliveries {
+		_ = d.conn.Send(d.frame)
+	}
+}
+
+// warnExpiringRooms warns the rooms that reach their TTL within the expiry
+// warning, once each.
+func (s *server) warnExpiringRooms() {
+	now := s.clock.Now()
+	var deliveries []controlDelivery
+	s.rooms.Lock()
+	for room, r := range s.rooms.rooms {
+		if r.usage == nil || r.usage.expiryWarned {
+			continue
+		}
+		left := r.opened.Add(s.roomTTL).Sub(now)
+		if left > s.expiryWarning || left <= 0 {
+			continue
+		}
+		r.usage.expiryWarned = true
+		s.limitEvents.add(limitExpiryWarning)
+		s.debugf("[room=%s] room expires in %s", roomLogName(room), left.Round(time.Second))
+		deliveries = append(deliveries, r.warnings(Control{Kind: ControlRoomExpiring, Left: left})...)
+	}
+	s.rooms.Unlock()
+	sendWarnings(deliveries)
+}
+
+// limitEvents counts limit events by kind since the relay started.
+type limitEvents struct {
+	sync.Mutex
+	kinds map[string]int64
+}
+
+func (e *limitEvents) add(kind string) {
+	e.Lock()
+	defer e.Unlock()
+	if e.kinds == nil {
+		e.kinds = make(map[string]int64)
+	}
+	e.kinds[kind]++
+}
+
+func (e *limitEvents) totals() map[string]int64 {
+	e.Lock()
+	defer e.Unlock()
+	totals := make(map[string]int64, len(e.kinds))
+	for kind, n := range e.kinds {
+		totals[kind] = n
+	}
+	return totals
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package loadtest
+
+import "time"
+
+// cpuTime returns zero, as reading the process CPU time is not supported
+// on this platform.
+func cpuTime() time.Duration {
+	return 0
+}
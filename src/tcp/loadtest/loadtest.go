@@ -0,0 +1,375 @@
+// Package loadtest puts a croc relay under load: synthetic clients go
+// through the full relay handshake, join rooms and exchange frames at a
+// fixed rate, and the run reports how long the handshakes and the
+// broadcasts took. It targets a relay at an address, or one it starts in
+// this process for smoke runs in CI.
+package loadtest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/tcp"
+)
+
+// stampSize is the send time every frame starts with.
+const stampSize = 8
+
+// drainTimeout is how long clients keep reading after the last frame was
+// sent, for the broadcasts still in flight.
+const drainTimeout = 2 * time.Second
+
+// Config is a load test run. The zero value of each field but Address and
+// Password stands for the value in DefaultConfig.
+type Config struct {
+	// Address is the relay to test, as host:port. Empty starts a relay in
+	// this process on a loopback port.
+	Address  string `json:"-"`
+	Password string `json:"-"`
+	// Clients connect and are spread evenly over Rooms, so rooms have
+	// Clients/Rooms members each.
+	Clients int `json:"clients"`
+	Rooms   int `json:"rooms"`
+	// Concurrency is how many handshakes are in flight at once.
+	Concurrency int `json:"concurrency"`
+	// Rate is the frames per second each client sends, of Size bytes, for
+	// Duration once every client is in its room.
+	Rate     float64       `json:"rate"`
+	Size     int           `json:"size"`
+	Duration time.Duration `json:"duration"`
+	// Timeout bounds each handshake.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// DefaultConfig is a small run that any machine handles in a few seconds.
+func DefaultConfig() Config {
+	return Config{
+		Password:    "pass123",
+		Clients:     100,
+		Rooms:       50,
+		Concurrency: 32,
+		Rate:        10,
+		Size:        1024,
+		Duration:    5 * time.Second,
+		Timeout:     10 * time.Second,
+	}
+}
+
+func (c Config) orDefault() Config {
+	d := DefaultConfig()
+	if c.Password == "" {
+		c.Password = d.Password
+	}
+	if c.Clients == 0 {
+		c.Clients = d.Clients
+	}
+	if c.Rooms == 0 {
+		c.Rooms = d.Rooms
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = d.Concurrency
+	}
+	if c.Rate == 0 {
+		c.Rate = d.Rate
+	}
+	if c.Size == 0 {
+		c.Size = d.Size
+	}
+	if c.Duration == 0 {
+		c.Duration = d.Duration
+	}
+	if c.Timeout == 0 {
+		c.Timeout = d.Timeout
+	}
+	return c
+}
+
+// Validate reports whether the config is in range.
+func (c Config) Validate() error {
+	c = c.orDefault()
+	switch {
+	case c.Clients < 0 || c.Rooms < 0 || c.Concurrency < 0:
+		return fmt.Errorf("clients, rooms and concurrency cannot be negative")
+	case c.Rooms > c.Clients:
+		return fmt.Errorf("%d rooms need at least as many clients, got %d", c.Rooms, c.Clients)
+	case c.Rate < 0 || c.Duration < 0 || c.Timeout < 0:
+		return fmt.Errorf("rate, duration and timeout cannot be negative")
+	case c.Size < stampSize:
+		return fmt.Errorf("frames must be at least %d bytes, got %d", stampSize, c.Size)
+	}
+	return nil
+}
+
+// Latency sums up a set of durations.
+type Latency struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func newLatency(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	slices.Sort(samples)
+	at := func(p float64) time.Duration {
+		return samples[int(p*float64(len(samples)-1))]
+	}
+	return Latency{Count: len(samples), P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: samples[len(samples)-1]}
+}
+
+func (l Latency) String() string {
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s (n=%d)", l.P50, l.P90, l.P99, l.Max, l.Count)
+}
+
+// Report is the result of Run.
+type Report struct {
+	// Handshake is from dialing the relay until it accepted the room;
+	// Failed counts the clients that did not get there.
+	Handshake Latency `json:"handshake"`
+	Failed    int     `json:"failed"`
+	// Broadcast is from a client sending a frame until another member of
+	// the room received it. Sent counts the frames sent, Expected the
+	// deliveries they should have made and Received those that were made.
+	Broadcast Latency `json:"broadcast"`
+	Sent      int64   `json:"sent"`
+	Expected  int64   `json:"expected"`
+	Received  int64   `json:"received"`
+	// CPU and HeapBytes are only measured for a relay in this process, and
+	// then include the clients: CPU is the time the process spent on the
+	// send phase and HeapBytes its heap in use at the end of it.
+	CPU       time.Duration `json:"cpu,omitempty"`
+	HeapBytes uint64        `json:"heap_bytes,omitempty"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+// DeliveryRatio is the share of expected deliveries that were made.
+func (r Report) DeliveryRatio() float64 {
+	if r.Expected == 0 {
+		return 1
+	}
+	return float64(r.Received) / float64(r.Expected)
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "handshake: %s, %d failed\n", r.Handshake, r.Failed)
+	fmt.Fprintf(&b, "broadcast: %s\n", r.Broadcast)
+	fmt.Fprintf(&b, "frames: %d sent, %d of %d delivered (%.2f%%)\n", r.Sent, r.Received, r.Expected, 100*r.DeliveryRatio())
+	if r.CPU > 0 || r.HeapBytes > 0 {
+		fmt.Fprintf(&b, "process: %s cpu, %.1f MiB heap\n", r.CPU.Round(time.Millisecond), float64(r.HeapBytes)/(1<<20))
+	}
+	fmt.Fprintf(&b, "elapsed: %s", r.Elapsed.Round(time.Millisecond))
+	return b.String()
+}
+
+// client is one synthetic client.
+type client struct {
+	room int
+	c    *comm.Comm
+	// broadcast holds the latencies of the frames this client received.
+	broadcast []time.Duration
+	sent      int64
+}
+
+// roomName returns the name of room i, in the form strict relays accept.
+func roomName(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("croc-loadtest-%d", i)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Run runs the load test c describes.
+func Run(c Config) (r Report, err error) {
+	c = c.orDefault()
+	if err = c.Validate(); err != nil {
+		return
+	}
+	start := time.Now()
+	address := c.Address
+	inProcess := address == ""
+	if inProcess {
+		var stop func() error
+		if address, stop, err = startRelay(c.Password); err != nil {
+			return
+		}
+		defer func() {
+			if errStop := stop(); err == nil {
+				err = errStop
+			}
+		}()
+	}
+
+	clients, handshakes := connect(address, c)
+	r.Handshake = newLatency(handshakes)
+	r.Failed = c.Clients - len(handshakes)
+	if len(handshakes) == 0 {
+		return r, errors.New("no client could join a room")
+	}
+
+	members := make([]int64, c.Rooms)
+	for _, cl := range clients {
+		if cl.c != nil {
+			members[cl.room]++
+		}
+	}
+	cpuBefore := cpuTime()
+	var readers sync.WaitGroup
+	for _, cl := range clients {
+		if cl.c == nil {
+			continue
+		}
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			cl.read()
+		}()
+	}
+	var senders sync.WaitGroup
+	interval := time.Duration(float64(time.Second) / c.Rate)
+	for _, cl := range clients {
+		if cl.c == nil {
+			continue
+		}
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			cl.send(interval, c.Size, c.Duration)
+		}()
+	}
+	senders.Wait()
+	if inProcess {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		r.HeapBytes = m.HeapInuse
+	}
+	time.Sleep(drainTimeout)
+	if inProcess {
+		r.CPU = cpuTime() - cpuBefore
+	}
+	for _, cl := range clients {
+		if cl.c != nil {
+			cl.c.Close()
+		}
+	}
+	readers.Wait()
+
+	var broadcast []time.Duration
+	for _, cl := range clients {
+		if cl.c == nil {
+			continue
+		}
+		r.Sent += cl.sent
+		r.Expected += cl.sent * (members[cl.room] - 1)
+		broadcast = append(broadcast, cl.broadcast...)
+	}
+	r.Received = int64(len(broadcast))
+	r.Broadcast = newLatency(broadcast)
+	r.Elapsed = time.Since(start)
+	return r, nil
+}
+
+// connect joins c.Clients clients to their rooms, c.Concurrency at a time,
+// and returns them with the handshake latencies of those that made it.
+// Clients that failed have no connection.
+func connect(address string, c Config) (clients []*client, handshakes []time.Duration) {
+	clients = make([]*client, c.Clients)
+	latencies := make([]time.Duration, c.Clients)
+	sem := make(chan struct{}, c.Concurrency)
+	var wg sync.WaitGroup
+	for i := range clients {
+		clients[i] = &client{room: i % c.Rooms}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			conn, _, _, err := tcp.ConnectToRoom(address, c.Password, tcp.RoomRequest{Room: roomName(clients[i].room), App: "croc-loadtest"}, c.Timeout)
+			if err != nil {
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+			latencies[i] = time.Since(start)
+			clients[i].c = conn
+		}()
+	}
+	wg.Wait()
+	for i, cl := range clients {
+		if cl.c != nil {
+			handshakes = append(handshakes, latencies[i])
+		}
+	}
+	return
+}
+
+// send sends a frame every interval for d, each stamped with its send time.
+func (cl *client) send(interval time.Duration, size int, d time.Duration) {
+	frame := make([]byte, size)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	end := time.Now().Add(d)
+	for now := range ticker.C {
+		if now.After(end) {
+			return
+		}
+		binary.BigEndian.PutUint64(frame, uint64(time.Now().UnixNano()))
+		if err := cl.c.Send(frame); err != nil {
+			return
+		}
+		cl.sent++
+	}
+}
+
+// read records the latency of each stamped frame until the connection is
+// closed. Shorter frames, like the relay's room ready byte, are skipped.
+func (cl *client) read() {
+	for {
+		b, err := cl.c.Receive()
+		if err != nil {
+			return
+		}
+		if len(b) < stampSize {
+			continue
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+		cl.broadcast = append(cl.broadcast, time.Since(sent))
+	}
+}
+
+// startRelay starts a relay in this process on a loopback port and returns
+// its address and a function that stops it.
+func startRelay(password string) (address string, stop func() error, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- tcp.RunWithOptionsAsync("127.0.0.1", "", password, tcp.WithListener(l), tcp.WithLogLevel("error"))
+	}()
+	stop = func() error {
+		l.Close()
+		return <-done
+	}
+	return l.Addr().String(), stop, nil
+}
+
+// Baseline is a run kept for comparison: the config and what it reported.
+type Baseline struct {
+	Config Config `json:"config"`
+	Report Report `json:"report"`
+}
@@ -0,0 +1,62 @@
+package loadtest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatency(t *testing.T) {
+	assert.Equal(t, Latency{}, newLatency(nil))
+	var samples []time.Duration
+	for i := 100; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	l := newLatency(samples)
+	assert.Equal(t, 100, l.Count)
+	assert.Equal(t, 50*time.Millisecond, l.P50)
+	assert.Equal(t, 90*time.Millisecond, l.P90)
+	assert.Equal(t, 99*time.Millisecond, l.P99)
+	assert.Equal(t, 100*time.Millisecond, l.Max)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.Nil(t, Config{}.Validate())
+	assert.NotNil(t, Config{Clients: 10, Rooms: 20}.Validate())
+	assert.NotNil(t, Config{Rate: -1}.Validate())
+	assert.NotNil(t, Config{Size: 4}.Validate())
+}
+
+// TestBaseline runs the load test kept in testdata/baseline.json against
+// an in-process relay and compares it with the numbers recorded there.
+// The bounds are loose, as CI machines vary: it is after regressions that
+// multiply latencies or lose frames, not after small drifts. Record a new
+// baseline with
+//
+//	go run ./examples/loadtest -clients 40 -rooms 20 -concurrency 8 -rate 20 -duration 2s -json
+func TestBaseline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	log.SetLevel("error")
+	b, err := os.ReadFile(filepath.Join("testdata", "baseline.json"))
+	assert.Nil(t, err)
+	var baseline Baseline
+	assert.Nil(t, json.Unmarshal(b, &baseline))
+
+	r, err := Run(baseline.Config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	t.Logf("baseline:\n%s\nnow:\n%s", baseline.Report, r)
+	assert.Zero(t, r.Failed)
+	assert.Equal(t, baseline.Report.Handshake.Count, r.Handshake.Count)
+	assert.GreaterOrEqual(t, r.DeliveryRatio(), 0.99)
+	assert.LessOrEqual(t, r.Handshake.P90, 10*baseline.Report.Handshake.P90+time.Second)
+	assert.LessOrEqual(t, r.Broadcast.P90, 10*baseline.Report.Broadcast.P90+250*time.Millisecond)
+}
@@ -0,0 +1,161 @@
+package tcp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/internal/clock"
+	log "github.com/schollz/logger"
+)
+
+// roomLogPrefixLength is how much of a room name is shown in logs. Room
+// names are hashes of the shared secret, so a short prefix is enough to
+// correlate lines without printing the full value.
+const roomLogPrefixLength = 8
+
+// connLogger writes log lines for a single relay connection, tagging each
+// line with the connection id, the remote address and, once it is known,
+// the room.
+type connLogger struct {
+	l       *log.Logger
+	sampler *logSampler
+	id      uint64
+	remote  string
+	room    string
+	app     string
+	prefix  string
+}
+
+func newConnLogger(l *log.Logger, sampler *logSampler, id uint64, remote string) *connLogger {
+	cl := &connLogger{l: l, sampler: sampler, id: id, remote: remote}
+	cl.prefix = cl.buildPrefix()
+	return cl
+}
+
+// withRoom returns a copy of the logger that also tags lines with the room.
+func (cl *connLogger) withRoom(room string) *connLogger {
+	c := *cl
+	c.room = room
+	c.prefix = c.buildPrefix()
+	return &c
+}
+
+// withApp returns a copy of the logger that also tags lines with the
+// application the client declared, if any.
+func (cl *connLogger) withApp(app string) *connLogger {
+	c := *cl
+	c.app = app
+	c.prefix = c.buildPrefix()
+	return &c
+}
+
+func (cl *connLogger) buildPrefix() string {
+	prefix := fmt.Sprintf("[conn=%d remote=%s", cl.id, cl.remote)
+	if cl.room != "" {
+		prefix += " room=" + roomLogName(cl.room)
+	}
+	if cl.app != "" {
+		prefix += fmt.Sprintf(" app=%q", cl.app)
+	}
+	return prefix + "] "
+}
+
+// roomLogName shortens a room name for logging.
+func roomLogName(room string) string {
+	if len(room) > roomLogPrefixLength {
+		return room[:roomLogPrefixLength]
+	}
+	return room
+}
+
+func (cl *connLogger) Tracef(format string, v ...interface{}) {
+	if format, v, ok := cl.sampler.sample(format, v); ok {
+		cl.l.Tracef(cl.prefix+format, v...)
+	}
+}
+
+func (cl *connLogger) Debugf(format string, v ...interface{}) {
+	if format, v, ok := cl.sampler.sample(format, v); ok {
+		cl.l.Debugf(cl.prefix+format, v...)
+	}
+}
+
+func (cl *connLogger) Infof(format string, v ...interface{}) {
+	cl.l.Infof(cl.prefix+format, v...)
+}
+
+func (cl *connLogger) Warnf(format string, v ...interface{}) {
+	cl.l.Warnf(cl.prefix+format, v...)
+}
+
+func (cl *connLogger) Errorf(format string, v ...interface{}) {
+	cl.l.Errorf(cl.prefix+format, v...)
+}
+
+// debugf writes a debug line of the server, sampled like those of the
+// connections.
+func (s *server) debugf(format string, v ...interface{}) {
+	if format, v, ok := s.sampler.sample(format, v); ok {
+		s.logger.Debugf(format, v...)
+	}
+}
+
+// logSampler limits how many debug and trace lines of each kind the relay
+// writes, so that logging at debug level cannot become what holds up a
+// busy relay or fills its disk. The kind of a line is its format string.
+// Each kind has a bucket of perSecond tokens, refilled at perSecond a
+// second; a line that finds its bucket empty is dropped, and the next
+// line of that kind written says how many were. Info, warning and error
+// lines are never sampled. A nil sampler lets every line through.
+type logSampler struct {
+	perSecond int
+	clock     clock.Clock
+	mu        sync.Mutex
+	buckets   map[string]*logBucket
+}
+
+type logBucket struct {
+	tokens     float64
+	refilled   time.Time
+	suppressed int
+}
+
+// newLogSampler returns a sampler letting perSecond lines of each kind
+// through a second, or nil for zero.
+func newLogSampler(perSecond int, c clock.Clock) *logSampler {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &logSampler{perSecond: perSecond, clock: c, buckets: make(map[string]*logBucket)}
+}
+
+// sample returns the line of format and v to write, with the count of
+// lines of its kind dropped since the last one added, and false if this
+// line is dropped too.
+func (ls *logSampler) sample(format string, v []interface{}) (string, []interface{}, bool) {
+	if ls == nil {
+		return format, v, true
+	}
+	now := ls.clock.Now()
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	b, ok := ls.buckets[format]
+	if !ok {
+		b = &logBucket{tokens: float64(ls.perSecond), refilled: now}
+		ls.buckets[format] = b
+	}
+	b.tokens = min(float64(ls.perSecond), b.tokens+now.Sub(b.refilled).Seconds()*float64(ls.perSecond))
+	b.refilled = now
+	if b.tokens < 1 {
+		b.suppressed++
+		return "", nil, false
+	}
+	b.tokens--
+	if b.suppressed > 0 {
+		format += " (+%d suppressed)"
+		v = append(v[:len(v):len(v)], b.suppressed)
+		b.suppressed = 0
+	}
+	return format, v, true
+}
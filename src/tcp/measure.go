@@ -0,0 +1,63 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// measureTimeout bounds each connection MeasureRelay opens.
+const measureTimeout = 5 * time.Second
+
+// RelayTiming is the result of MeasureRelay.
+type RelayTiming struct {
+	// Ping is the round trip of a ping on an established connection.
+	Ping time.Duration
+	// Dial, PAKE and Auth break down a full handshake: opening the TCP
+	// connection, agreeing on a key, and sending the password until the
+	// relay answered with its banner.
+	Dial time.Duration
+	PAKE time.Duration
+	Auth time.Duration
+	// Banner is what the relay sent back after authentication.
+	Banner string
+}
+
+// Handshake is the time from dialing until the relay accepted the password.
+func (t RelayTiming) Handshake() time.Duration {
+	return t.Dial + t.PAKE + t.Auth
+}
+
+// MeasureRelay times a ping and a handshake against the relay at address.
+// It uses connections of its own and never joins a room, so it can run
+// alongside a live session to the same relay.
+func MeasureRelay(address, password string) (t RelayTiming, err error) {
+	pc, err := comm.NewConnection(address, measureTimeout)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	if err = pc.Send([]byte("ping")); err == nil {
+		var b []byte
+		if b, err = pc.Receive(); err == nil && !bytes.Equal(b, []byte("pong")) {
+			err = fmt.Errorf("no pong")
+		}
+	}
+	t.Ping = time.Since(start)
+	pc.Close()
+	if err != nil {
+		return
+	}
+
+	start = time.Now()
+	c, err := comm.NewConnection(address, measureTimeout)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	t.Dial = time.Since(start)
+	_, t.Banner, _, err = clientHandshake(c, password, &t)
+	return
+}
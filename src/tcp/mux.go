@@ -0,0 +1,251 @@
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/schollz/croc/v10/src/comm"
+	log "github.com/schollz/logger"
+)
+
+// muxFramePrefix introduces a frame of a Mux: the prefix, the length of
+// the channel name in a byte, the name, then the payload.
+var muxFramePrefix = []byte("croc-mux:")
+
+// muxQueue is how many frames of a channel wait for its reader. A channel
+// that falls further behind holds up the others, as they share one
+// connection.
+const muxQueue = 64
+
+var (
+	// ErrMuxClosed is returned by Open once the connection of the Mux is
+	// gone.
+	ErrMuxClosed = errors.New("multiplexed connection is closed")
+	// ErrChannelInUse is returned by Open for a channel that is open.
+	ErrChannelInUse = errors.New("channel is already open")
+)
+
+// Mux carries named channels over one connection to a relay room, so
+// features that would each join a room of their own share it. Each
+// channel is a connection of its own to the code using it, and a frame
+// sent on one reaches the channel of the same name of the peers. As in a
+// room, frames for a channel a peer has not opened are dropped. What the
+// relay itself sends, such as control frames, reaches every channel.
+type Mux struct {
+	conn *comm.Comm
+
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	channels map[string]*muxChannel
+	err      error
+	done     chan struct{}
+}
+
+// muxChannel is the Mux end of an open channel.
+type muxChannel struct {
+	name  string
+	end   *comm.Comm
+	queue chan []byte
+	once  sync.Once
+	// closed is closed with the channel.
+	closed chan struct{}
+}
+
+// NewMux starts carrying channels over conn, which has joined a room. The
+// Mux owns conn from then on.
+func NewMux(conn *comm.Comm) *Mux {
+	m := &Mux{
+		conn:     conn,
+		channels: make(map[string]*muxChannel),
+		done:     make(chan struct{}),
+	}
+	go m.receive()
+	return m
+}
+
+// Open opens the channel name, returning the connection it is used
+// through. Closing the connection closes the channel, which can then be
+// opened again.
+func (m *Mux) Open(name string) (*comm.Comm, error) {
+	if len(name) > 255 {
+		return nil, fmt.Errorf("channel name is too long")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.channels[name]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrChannelInUse, name)
+	}
+	local, end := net.Pipe()
+	ch := &muxChannel{
+		name:   name,
+		end:    comm.New(end),
+		queue:  make(chan []byte, muxQueue),
+		closed: make(chan struct{}),
+	}
+	m.channels[name] = ch
+	go m.deliver(ch)
+	go m.forward(ch)
+
+	c := comm.New(local)
+	// control frames are the relay's, and are checked with its key
+	c.SetRelayKey(m.conn.RelayKey())
+	c.SetSessionTag(m.conn.SessionTag())
+	return c, nil
+}
+
+// Done is closed once the connection of m is gone, and with it every
+// channel.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Close closes the connection of m and every channel.
+func (m *Mux) Close() error {
+	m.closeAll(ErrMuxClosed)
+	return nil
+}
+
+// closeAll ends m with err.
+func (m *Mux) closeAll(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	channels := m.channels
+	m.channels = nil
+	close(m.done)
+	m.mu.Unlock()
+	m.conn.Close()
+	for _, ch := range channels {
+		ch.close()
+	}
+}
+
+// close closes the channel's end, which its user sees as the connection
+// closing.
+func (ch *muxChannel) close() {
+	ch.once.Do(func() {
+		close(ch.closed)
+		ch.end.Close()
+	})
+}
+
+// drop closes ch and forgets it, so the name can be opened again.
+func (m *Mux) drop(ch *muxChannel) {
+	ch.close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.channels[ch.name] == ch {
+		delete(m.channels, ch.name)
+	}
+}
+
+// receive hands the frames of the connection to their channels until it
+// fails.
+func (m *Mux) receive() {
+	for {
+		data, err := m.conn.Receive()
+		if err != nil {
+			log.Debugf("multiplexed connection: %v", err)
+			m.closeAll(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+			return
+		}
+		if IsControlFrame(data) || IsIdleTimeout(data) || bytes.Equal(data, []byte{1}) {
+			// from the relay, about the room every channel is in
+			m.mu.Lock()
+			channels := make([]*muxChannel, 0, len(m.channels))
+			for _, ch := range m.channels {
+				channels = append(channels, ch)
+			}
+			m.mu.Unlock()
+			for _, ch := range channels {
+				ch.push(data)
+			}
+			continue
+		}
+		name, payload, ok := parseMuxFrame(data)
+		if !ok {
+			log.Debugf("dropping a frame that is not multiplexed")
+			continue
+		}
+		m.mu.Lock()
+		ch := m.channels[name]
+		m.mu.Unlock()
+		if ch == nil {
+			log.Tracef("dropping a frame for channel %q, which is not open", name)
+			continue
+		}
+		ch.push(payload)
+	}
+}
+
+// push queues data for the reader of ch, waiting while the queue is full.
+func (ch *muxChannel) push(data []byte) {
+	select {
+	case ch.queue <- data:
+	case <-ch.closed:
+	}
+}
+
+// deliver passes the frames queued for ch to its user.
+func (m *Mux) deliver(ch *muxChannel) {
+	for {
+		select {
+		case data := <-ch.queue:
+			if err := ch.end.Send(data); err != nil {
+				m.drop(ch)
+				return
+			}
+		case <-ch.closed:
+			return
+		}
+	}
+}
+
+// forward sends what the user of ch sends on the connection, until the
+// user closes the channel.
+func (m *Mux) forward(ch *muxChannel) {
+	defer m.drop(ch)
+	for {
+		data, err := ch.end.Receive()
+		if err != nil {
+			return
+		}
+		m.sendMu.Lock()
+		err = m.conn.Send(muxFrame(ch.name, data))
+		m.sendMu.Unlock()
+		if err != nil {
+			m.closeAll(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+			return
+		}
+	}
+}
+
+// muxFrame returns the frame carrying data on the channel name.
+func muxFrame(name string, data []byte) []byte {
+	frame := make([]byte, 0, len(muxFramePrefix)+1+len(name)+len(data))
+	frame = append(frame, muxFramePrefix...)
+	frame = append(frame, byte(len(name)))
+	frame = append(frame, name...)
+	return append(frame, data...)
+}
+
+// parseMuxFrame returns the channel name and payload of a frame of a Mux,
+// and false if data is not one.
+func parseMuxFrame(data []byte) (name string, payload []byte, ok bool) {
+	rest, ok := bytes.CutPrefix(data, muxFramePrefix)
+	if !ok || len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return "", nil, false
+	}
+	n := int(rest[0])
+	return string(rest[1 : 1+n]), rest[1+n:], true
+}
@@ -0,0 +1,94 @@
+package tcp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxFrame(t *testing.T) {
+	name, payload, ok := parseMuxFrame(muxFrame("chat", []byte("hello")))
+	assert.True(t, ok)
+	assert.Equal(t, "chat", name)
+	assert.Equal(t, []byte("hello"), payload)
+	for _, data := range [][]byte{[]byte("hello"), muxFramePrefix, append(muxFramePrefix, 5, 'a')} {
+		_, _, ok = parseMuxFrame(data)
+		assert.False(t, ok, string(data))
+	}
+}
+
+func TestMux(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	join := func() *Mux {
+		conn, _, _, err := ConnectToRoom(l.Addr().String(), "pass123", RoomRequest{Room: strings.Repeat("4d", 32), Capabilities: []string{CapabilityControlFrames}}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewMux(conn)
+	}
+	alice, bob := join(), join()
+	defer bob.Close()
+
+	aliceChat, err := alice.Open("chat")
+	assert.Nil(t, err)
+	bobChat, err := bob.Open("chat")
+	assert.Nil(t, err)
+	_, err = alice.Open("chat")
+	assert.ErrorIs(t, err, ErrChannelInUse)
+
+	assert.Nil(t, aliceChat.Send([]byte("hello bob")))
+	assert.Equal(t, []byte("hello bob"), receiveWithin(t, bobChat, 5*time.Second))
+	assert.Nil(t, bobChat.Send([]byte("hello alice")))
+	assert.Equal(t, []byte("hello alice"), receiveWithin(t, aliceChat, 5*time.Second))
+
+	// a frame for a channel bob has not opened is dropped, as in a room
+	aliceSignal, err := alice.Open("signal")
+	assert.Nil(t, err)
+	assert.Nil(t, aliceSignal.Send([]byte("lost")))
+	assert.Nil(t, aliceChat.Send([]byte("sync")))
+	assert.Equal(t, []byte("sync"), receiveWithin(t, bobChat, 5*time.Second))
+	bobSignal, err := bob.Open("signal")
+	assert.Nil(t, err)
+	assert.Nil(t, aliceSignal.Send([]byte("offer")))
+	assert.Equal(t, []byte("offer"), receiveWithin(t, bobSignal, 5*time.Second))
+
+	// a closed channel can be opened again, and the others go on
+	bobSignal.Close()
+	assert.Eventually(t, func() bool {
+		c, err := bob.Open("signal")
+		if err == nil {
+			bobSignal = c
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, aliceSignal.Send([]byte("again")))
+	assert.Equal(t, []byte("again"), receiveWithin(t, bobSignal, 5*time.Second))
+	assert.Nil(t, aliceChat.Send([]byte("still here")))
+	assert.Equal(t, []byte("still here"), receiveWithin(t, bobChat, 5*time.Second))
+
+	// closing the connection closes every channel
+	assert.Nil(t, alice.Close())
+	select {
+	case <-alice.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mux did not end")
+	}
+	_, err = aliceChat.Receive()
+	assert.NotNil(t, err)
+	_, err = alice.Open("chat")
+	assert.ErrorIs(t, err, ErrMuxClosed)
+}
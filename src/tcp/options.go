@@ -2,7 +2,14 @@ package tcp
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/schollz/croc/v10/src/internal/clock"
 )
 
 // TODO: maybe export from logger library?
@@ -13,12 +20,26 @@ type serverOptsFunc func(s *server) error
 func WithBanner(banner ...string) serverOptsFunc {
 	return func(s *server) error {
 		if len(banner) > 0 {
-			s.banner = banner[0]
+			s.settings.banner = banner[0]
 		}
 		return nil
 	}
 }
 
+// WithLogSampling limits the debug and trace lines of each kind the relay
+// writes to perSecond a second, counting those it drops in the next line
+// of the kind written. Info, warning and error lines are always written.
+// Zero writes every line; the default is DEFAULT_LOG_SAMPLING.
+func WithLogSampling(perSecond int) serverOptsFunc {
+	return func(s *server) error {
+		if perSecond < 0 {
+			return fmt.Errorf("invalid log sampling: %d lines a second", perSecond)
+		}
+		s.logSampling = perSecond
+		return nil
+	}
+}
+
 func WithLogLevel(level string) serverOptsFunc {
 	return func(s *server) error {
 		if !containsSlice(availableLogLevels, level) {
@@ -29,6 +50,18 @@ func WithLogLevel(level string) serverOptsFunc {
 	}
 }
 
+// WithLogWriter sends the relay's logs to w instead of stdout, so embedders
+// can keep them apart from their own.
+func WithLogWriter(w io.Writer) serverOptsFunc {
+	return func(s *server) error {
+		if w == nil {
+			return fmt.Errorf("log writer cannot be nil")
+		}
+		s.logger.SetOutput(w)
+		return nil
+	}
+}
+
 func WithRoomCleanupInterval(interval time.Duration) serverOptsFunc {
 	return func(s *server) error {
 		s.roomCleanupInterval = interval
@@ -43,6 +76,289 @@ func WithRoomTTL(ttl time.Duration) serverOptsFunc {
 	}
 }
 
+// WithRoomByteQuota makes the relay delete a room once it has relayed more
+// than n bytes, counting each frame once for every connection it goes to.
+// Frames held in the replay buffer count when they are replayed, at their
+// stored size, so with buffer encryption a replayed frame counts for a
+// little more than it would have live. Zero, the default, is no quota.
+func WithRoomByteQuota(n int64) serverOptsFunc {
+	return func(s *server) error {
+		if n < 0 {
+			return fmt.Errorf("invalid room byte quota: %d", n)
+		}
+		s.roomByteQuota = n
+		return nil
+	}
+}
+
+// WithLimitWarnings sets when the connections of a room that declared
+// CapabilityLimitWarnings are warned before the room is cut off: once it
+// has relayed quota, a fraction, of its byte quota, and expiry before its
+// TTL. The defaults are DEFAULT_QUOTA_WARNING and DEFAULT_EXPIRY_WARNING;
+// zero turns either warning off.
+func WithLimitWarnings(quota float64, expiry time.Duration) serverOptsFunc {
+	return func(s *server) error {
+		if quota < 0 || quota >= 1 {
+			return fmt.Errorf("invalid quota warning: %v is not a fraction below 1", quota)
+		}
+		if expiry < 0 {
+			return fmt.Errorf("invalid expiry warning: %s", expiry)
+		}
+		s.quotaWarning = quota
+		s.expiryWarning = expiry
+		return nil
+	}
+}
+
+// WithSupersededGracePeriod sets how long the relay keeps a connection open
+// after a newer one of the same client instance replaced it in a
+// latest-only room.
+func WithSupersededGracePeriod(d time.Duration) serverOptsFunc {
+	return func(s *server) error {
+		s.supersededGracePeriod = d
+		return nil
+	}
+}
+
+// WithConnIdleTimeout makes the relay drop a connection that has sent
+// nothing for longer than d, even while the rest of its room is busy, so a
+// dead connection cannot keep a room open for its peer. The connection gets
+// a final frame, recognized by IsIdleTimeout, before it is closed. Zero, the
+// default, turns this off.
+func WithConnIdleTimeout(d time.Duration) serverOptsFunc {
+	return func(s *server) error {
+		if d < 0 {
+			return fmt.Errorf("invalid connection idle timeout: %s", d)
+		}
+		s.connIdleTimeout = d
+		return nil
+	}
+}
+
+// WithSniffTimeout makes the relay close a new connection, without a
+// handshake, unless its first frame arrives within d and looks like one a
+// croc client sends. Such connections are counted as "protocol_junk" in
+// Stats.Errors instead of as failed handshakes. The default is
+// DEFAULT_SNIFF_TIMEOUT; zero turns sniffing off.
+func WithSniffTimeout(d time.Duration) serverOptsFunc {
+	return func(s *server) error {
+		if d < 0 {
+			return fmt.Errorf("invalid sniff timeout: %s", d)
+		}
+		s.sniffTimeout = d
+		return nil
+	}
+}
+
+// WithHandshakeTimeout makes the relay close a connection that has not
+// got through the handshake and asked for a room within d of its first
+// frame passing WithSniffTimeout, so clients that stall partway cannot
+// hold a goroutine and PAKE state each until the read deadline hours
+// later. Such
+// connections are counted as "handshake_timeout" in Stats.Errors. The
+// default is DEFAULT_HANDSHAKE_TIMEOUT; zero turns the deadline off.
+func WithHandshakeTimeout(d time.Duration) serverOptsFunc {
+	return func(s *server) error {
+		if d < 0 {
+			return fmt.Errorf("invalid handshake timeout: %s", d)
+		}
+		s.handshakeTimeout = d
+		return nil
+	}
+}
+
+// WithKeepalivesAsActivity controls whether keepalive frames reset a
+// connection's idle time. It is off by default, so a client that only
+// sends keepalives is still dropped by WithConnIdleTimeout.
+func WithKeepalivesAsActivity(enabled bool) serverOptsFunc {
+	return func(s *server) error {
+		s.keepalivesAreActivity = enabled
+		return nil
+	}
+}
+
+// WithMaxRoomsPerIP caps how many rooms connections from one remote IP can
+// be in at once, so a single host cannot hold thousands of rooms open by
+// joining them slowly enough to stay under any rate limit. A join beyond
+// the cap is refused with ErrTooManyRooms. Zero, the default, means no
+// cap.
+func WithMaxRoomsPerIP(n int) serverOptsFunc {
+	return func(s *server) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum rooms per IP: %d", n)
+		}
+		s.settings.maxRoomsPerIP = n
+		return nil
+	}
+}
+
+// WithBlockedClients refuses clients whose declared application, as
+// returned by ClientApp, matches one of patterns, telling them to upgrade
+// with ErrUpgradeRequired. In a pattern * stands for any run of
+// characters, so "croc-chat/10.1.* *" blocks every 10.1 build of croc
+// chat. Clients that declare no application are let in.
+func WithBlockedClients(patterns []string) serverOptsFunc {
+	return func(s *server) (err error) {
+		s.settings.blockedClients, err = compileClientPatterns(patterns)
+		return
+	}
+}
+
+// WithReplayBuffer makes the relay keep up to maxFrames frames, and at most
+// maxBytes bytes of them, that were sent to a room while nobody else was in
+// it, and replay them to the next connection that joins. Both limits count
+// the bytes actually stored, which are ciphertext unless buffer encryption
+// is turned off. Replayed frames count against WithRoomByteQuota, at
+// their stored size. The buffer lives in memory only and is wiped when
+// the room is deleted.
+func WithReplayBuffer(maxFrames, maxBytes int) serverOptsFunc {
+	return func(s *server) error {
+		if maxFrames < 0 || maxBytes < 0 || (maxFrames > 0) != (maxBytes > 0) {
+			return fmt.Errorf("invalid replay buffer limits: %d frames, %d bytes", maxFrames, maxBytes)
+		}
+		s.replayMaxFrames = maxFrames
+		s.replayMaxBytes = maxBytes
+		return nil
+	}
+}
+
+// WithBufferEncryption controls whether replay buffer frames are encrypted
+// with an ephemeral per-room key. It is on by default.
+func WithBufferEncryption(enabled bool) serverOptsFunc {
+	return func(s *server) error {
+		s.bufferEncryption = enabled
+		return nil
+	}
+}
+
+// WithBindExactly makes the relay listen on exactly the address of its
+// host when enabled. Otherwise a relay asked to listen on 127.0.0.1 or ::1
+// listens on every address of that family instead, as croc relays always
+// have.
+func WithBindExactly(enabled bool) serverOptsFunc {
+	return func(s *server) error {
+		s.bindExactly = enabled
+		return nil
+	}
+}
+
+// WithStrictRoomNames controls whether the relay only accepts the sha256
+// hex room names that croc clients derive from their codes. It is on by
+// default; turning it off is meant for experimentation. The limit on the
+// length of the room request applies either way.
+func WithStrictRoomNames(strict bool) serverOptsFunc {
+	return func(s *server) error {
+		s.strictRoomNames = strict
+		return nil
+	}
+}
+
+// WithStatsAddress serves the relay's statistics as JSON on
+// http://addr/stats. Bind it to a private address: the endpoint has no
+// authentication.
+func WithStatsAddress(addr string) serverOptsFunc {
+	return func(s *server) error {
+		s.statsAddress = addr
+		return nil
+	}
+}
+
+// WithStatusPage serves a human-readable status page on http://addr/,
+// protected by HTTP basic auth with the given user and password. The page
+// shows the same snapshot as Stats, with room names truncated and no
+// client addresses.
+func WithStatusPage(addr, user, password string) serverOptsFunc {
+	return func(s *server) error {
+		if addr == "" {
+			return nil
+		}
+		if user == "" || password == "" {
+			return fmt.Errorf("status page needs a user and password")
+		}
+		s.statusAddress = addr
+		s.statusUser = user
+		s.statusPassword = password
+		return nil
+	}
+}
+
+// WithVersion sets the version the relay reports in Stats.
+func WithVersion(version string) serverOptsFunc {
+	return func(s *server) error {
+		s.version = version
+		return nil
+	}
+}
+
+// WithClock replaces the server's time source, so tests can drive room
+// expiry and other timers without sleeping.
+func WithClock(c clock.Clock) serverOptsFunc {
+	return func(s *server) error {
+		if c == nil {
+			return fmt.Errorf("clock cannot be nil")
+		}
+		s.clock = c
+		return nil
+	}
+}
+
+// WithListener makes the relay accept connections on l instead of binding
+// its host and port, for sockets bound by someone else, such as those
+// systemd passes on socket activation (see ActivationListeners). An empty
+// port is taken from l. The relay closes l when it stops, and closing l
+// stops the relay.
+func WithListener(l net.Listener) serverOptsFunc {
+	return func(s *server) error {
+		if l == nil {
+			return fmt.Errorf("listener cannot be nil")
+		}
+		s.listener = l
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && s.port == "" {
+			s.port = strconv.Itoa(addr.Port)
+		}
+		return nil
+	}
+}
+
+// WithTracerProvider makes the relay trace each connection with a tracer
+// from tp: a span from accept to disconnect with the PAKE, authentication
+// and room join as children, and events for relayed frames and room
+// expiry. See examples/otel for exporting them.
+func WithTracerProvider(tp trace.TracerProvider) serverOptsFunc {
+	return func(s *server) error {
+		if tp == nil {
+			return fmt.Errorf("tracer provider cannot be nil")
+		}
+		s.tracer = tp.Tracer(tracerName)
+		return nil
+	}
+}
+
+// WithUpgrader lets u hand the relay over to a new process, see Upgrader.
+// A relay started by such a handoff gets the rooms the old one had on its
+// port; pass it the inherited listener with WithListener.
+func WithUpgrader(u *Upgrader) serverOptsFunc {
+	return func(s *server) error {
+		if u == nil {
+			return fmt.Errorf("upgrader cannot be nil")
+		}
+		s.upgrader = u
+		return nil
+	}
+}
+
+// WithSetuid makes the relay switch to the given user once it has bound
+// its sockets, so it can bind a privileged port as root and then serve
+// without root or any capabilities. It is only supported on Linux. The
+// relay refuses to serve if the switch fails. An empty user keeps the
+// relay running as whoever started it.
+func WithSetuid(user string) serverOptsFunc {
+	return func(s *server) error {
+		s.setuid = user
+		return nil
+	}
+}
+
 func containsSlice(s []string, e string) bool {
 	for _, ss := range s {
 		if e == ss {
@@ -0,0 +1,247 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// RoomPolicy controls which connections in a room receive a frame. The
+// policy is declared by the connection that creates the room; policies
+// requested by later joiners are ignored.
+type RoomPolicy string
+
+const (
+	// RoomPolicyBroadcast forwards every frame to every other connection.
+	RoomPolicyBroadcast RoomPolicy = ""
+	// RoomPolicyLatestOnly treats an earlier connection of the same client
+	// instance, see RoomRequest.Instance, as superseded once a newer one
+	// joins: frames are neither forwarded to nor accepted from it, and it is
+	// closed after a grace period. It suits rooms that are reused across
+	// retries, like call signaling, where a client's dropped socket may
+	// linger. Connections that declare no instance are never superseded,
+	// so peers sharing a host or public address do not silence each other.
+	RoomPolicyLatestOnly RoomPolicy = "latest-only"
+)
+
+// DEFAULT_SUPERSEDED_GRACE_PERIOD is how long a superseded connection is
+// kept open before the relay closes it.
+const DEFAULT_SUPERSEDED_GRACE_PERIOD = 5 * time.Second
+
+// RoomMode is what a room is used for, declared by the client that joins
+// it. The relay only uses it for statistics.
+type RoomMode string
+
+const (
+	RoomModeUndeclared RoomMode = ""
+	RoomModeChat       RoomMode = "chat"
+	RoomModeTransfer   RoomMode = "transfer"
+	RoomModeSignal     RoomMode = "signal"
+)
+
+// RoomRequest is what a client asks the relay for when it joins a room.
+type RoomRequest struct {
+	Room   string
+	Policy RoomPolicy
+	Mode   RoomMode
+	// App names the client, as returned by ClientApp, for the relay's logs
+	// and statistics. It is truncated to 64 bytes.
+	App string
+	// Observer declares that the connection only watches the room.
+	// DenyObservers keeps observers out of the room; like the policy, it
+	// is declared by the connection that creates the room.
+	Observer      bool
+	DenyObservers bool
+	// Capabilities are what the client understands beyond what legacy
+	// croc does, such as CapabilityControlFrames. ConnectToRoom only
+	// declares those the relay announced.
+	Capabilities []string
+	// Instance identifies the client across its reconnections, for
+	// RoomPolicyLatestOnly; see NewInstance. It is sanitized like App.
+	Instance string
+
+	// forwardedFor is the host of the client an instance of a cluster
+	// proxies the request for; see WithCluster.
+	forwardedFor string
+}
+
+// observersDeniedResponse is sent instead of "ok" when an observer asks to
+// join a room that does not allow observers.
+const observersDeniedResponse = "observers not allowed"
+
+// ErrObserversDenied is returned by ConnectToRoom when an observer asked to
+// join a room created with DenyObservers.
+var ErrObserversDenied = errors.New("relay refused the room: it does not allow observers")
+
+// ErrObserversUnsupported is returned by ConnectToRoom when an observer
+// asks a relay that cannot tell observers from peers.
+var ErrObserversUnsupported = errors.New("relay does not support observers")
+
+// CapabilityRoomFields is announced by relays that read the fields of a
+// room request. Relays that do not, like those of upstream croc, take the
+// whole frame for the room name, so peers whose fields differ, say in the
+// version of App, would wait in different rooms. ConnectToRoom sends them
+// the bare room name.
+const CapabilityRoomFields = "room-fields"
+
+// Room request fields follow the room name, each introduced by a NUL byte.
+// Clients that request nothing send the bare room name, so older relays and
+// clients are unaffected.
+const (
+	roomPolicySeparator = "\x00policy="
+	roomModeSeparator   = "\x00mode="
+	roomAppSeparator    = "\x00app="
+	roomObserverField   = "\x00observer=1"
+	roomDenyObservers   = "\x00observers=deny"
+	roomCapsSeparator   = "\x00caps="
+	roomInstanceField   = "\x00instance="
+)
+
+// maxInstanceLength caps, in bytes, the instance a client declares.
+const maxInstanceLength = 64
+
+// NewInstance returns a random RoomRequest.Instance.
+func NewInstance() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sanitizeInstance keeps the letters, digits, '-' and '_' of a declared
+// instance, up to maxInstanceLength of them.
+func sanitizeInstance(instance string) string {
+	var b strings.Builder
+	for _, r := range instance {
+		if b.Len() == maxInstanceLength {
+			break
+		}
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func encodeRoomRequest(req RoomRequest) string {
+	s := req.Room
+	if req.Policy != RoomPolicyBroadcast {
+		s += roomPolicySeparator + string(req.Policy)
+	}
+	if req.Mode != RoomModeUndeclared {
+		s += roomModeSeparator + string(req.Mode)
+	}
+	if req.Observer {
+		s += roomObserverField
+	}
+	if req.DenyObservers {
+		s += roomDenyObservers
+	}
+	if len(req.Capabilities) > 0 {
+		s += roomCapsSeparator + strings.Join(req.Capabilities, ",")
+	}
+	if instance := sanitizeInstance(req.Instance); instance != "" {
+		s += roomInstanceField + instance
+	}
+	if app := sanitizeClientApp(req.App); app != "" {
+		s += roomAppSeparator + app
+	}
+	if req.forwardedFor != "" {
+		s += roomForwardedSeparator + req.forwardedFor
+	}
+	return s
+}
+
+// parseRoomRequest reads a room frame. Unknown policies fall back to
+// broadcast and unknown modes to undeclared. The application and instance
+// are sanitized.
+func parseRoomRequest(request string) (req RoomRequest) {
+	fields := strings.Split(request, "\x00")
+	req.Room = fields[0]
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "policy":
+			if RoomPolicy(value) == RoomPolicyLatestOnly {
+				req.Policy = RoomPolicyLatestOnly
+			}
+		case "mode":
+			switch m := RoomMode(value); m {
+			case RoomModeChat, RoomModeTransfer, RoomModeSignal:
+				req.Mode = m
+			}
+		case "app":
+			req.App = sanitizeClientApp(value)
+		case "observer":
+			req.Observer = value == "1"
+		case "observers":
+			req.DenyObservers = value == "deny"
+		case "caps":
+			req.Capabilities = parseCapabilities(value)
+		case "instance":
+			req.Instance = sanitizeInstance(value)
+		case "forwarded":
+			if net.ParseIP(value) != nil {
+				req.forwardedFor = value
+			}
+		}
+	}
+	return
+}
+
+// remoteHost returns the host part of a connection's remote address.
+func remoteHost(c *comm.Comm) string {
+	addr := c.Connection().RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// supersede records that c joined from host as instance and, in a
+// latest-only room, marks earlier live connections of the same instance as
+// superseded. It returns the connections that were newly superseded.
+func (r roomInfo) supersede(c *comm.Comm, host, instance string) (old []*comm.Comm) {
+	r.hosts[c] = host
+	if instance != "" {
+		r.instances[c] = instance
+	}
+	if r.policy != RoomPolicyLatestOnly || instance == "" {
+		return
+	}
+	for _, conn := range r.conns {
+		if conn != c && !r.superseded[conn] && r.instances[conn] == instance {
+			r.superseded[conn] = true
+			old = append(old, conn)
+		}
+	}
+	return
+}
+
+// forwardsTo reports whether a frame from sender should be sent to conn.
+func (r roomInfo) forwardsTo(sender, conn *comm.Comm) bool {
+	if conn == sender {
+		return false
+	}
+	if r.policy != RoomPolicyLatestOnly {
+		return true
+	}
+	return !r.superseded[sender] && !r.superseded[conn]
+}
+
+// targets appends the connections a frame from sender is forwarded to.
+func (r roomInfo) targets(sender *comm.Comm, to []*comm.Comm) []*comm.Comm {
+	for _, conn := range r.conns {
+		if r.forwardsTo(sender, conn) {
+			to = append(to, conn)
+		}
+	}
+	return to
+}
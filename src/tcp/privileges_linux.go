@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lookupUnprivileged returns the ids of the user a relay switches to,
+// refusing root since switching to it would drop nothing.
+func lookupUnprivileged(name string) (uid, gid int, groups []int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+	if uid == 0 {
+		return 0, 0, nil, fmt.Errorf("user %s is root", name)
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		g, errAtoi := strconv.Atoi(id)
+		if errAtoi != nil {
+			return 0, 0, nil, errAtoi
+		}
+		groups = append(groups, g)
+	}
+	return
+}
+
+// checkSetuid reports whether the relay could switch to user.
+func checkSetuid(name string) error {
+	uid, _, _, err := lookupUnprivileged(name)
+	if err != nil {
+		return fmt.Errorf("cannot switch to user %s: %w", name, err)
+	}
+	if os.Geteuid() != 0 && os.Geteuid() != uid {
+		return fmt.Errorf("cannot switch to user %s: the relay is not running as root", name)
+	}
+	return nil
+}
+
+// dropPrivileges switches every thread of the process to the user. Leaving
+// root clears all capabilities, which it then verifies for every thread. A
+// process running as the user already, like a relay started by a handoff
+// from one that switched, only verifies.
+func dropPrivileges(name string) error {
+	uid, gid, groups, err := lookupUnprivileged(name)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() == uid {
+		return checkDropped(uid)
+	}
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return checkDropped(uid)
+}
+
+// checkDropped reads the status of every thread and fails unless all of
+// them run as uid with no capabilities left.
+func checkDropped(uid int) error {
+	tasks, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil || len(tasks) == 0 {
+		return fmt.Errorf("cannot verify privileges: no thread status in /proc")
+	}
+	want := strconv.Itoa(uid)
+	for _, task := range tasks {
+		f, err := os.Open(task)
+		if err != nil {
+			// the thread may have exited since
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), ":")
+			fields := strings.Fields(value)
+			switch key {
+			case "Uid":
+				for _, id := range fields {
+					if id != want {
+						f.Close()
+						return fmt.Errorf("thread still has uid %s", id)
+					}
+				}
+			case "CapPrm", "CapEff", "CapAmb":
+				if len(fields) == 1 && strings.Trim(fields[0], "0") != "" {
+					f.Close()
+					return fmt.Errorf("thread still has capabilities %s %s", key, fields[0])
+				}
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tcp
+
+import "fmt"
+
+func checkSetuid(name string) error {
+	return fmt.Errorf("cannot switch to user %s: only supported on Linux", name)
+}
+
+func dropPrivileges(name string) error {
+	return checkSetuid(name)
+}
@@ -0,0 +1,133 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// settings are those of a relay's settings that Reload can change while
+// it runs. Connections past their handshake are not affected, so a new
+// password or a lower cap leaves the rooms as they are.
+type settings struct {
+	password string
+	banner   string
+	// maxRoomsPerIP caps the rooms one remote host can be in at once;
+	// zero means no cap.
+	maxRoomsPerIP int
+	// blockedClients are refused with ErrUpgradeRequired.
+	blockedClients clientPatterns
+}
+
+// current returns the settings in effect.
+func (s *server) current() settings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.settings
+}
+
+// RelayConfig is what Reload can change of a running relay: its password,
+// the banner set WithBanner, and the limits set WithMaxRoomsPerIP and
+// WithBlockedClients. Every field replaces the setting in effect, so a
+// zero field turns its setting off. What else a relay was started with
+// takes a restart to change.
+type RelayConfig struct {
+	Password       string
+	Banner         string
+	MaxRoomsPerIP  int
+	BlockedClients []string
+}
+
+// compile checks c and returns the settings it stands for.
+func (c RelayConfig) compile() (st settings, err error) {
+	var errs []error
+	if c.Banner != "" {
+		for _, p := range strings.Split(c.Banner, ",") {
+			if !validPort(p) {
+				errs = append(errs, fmt.Errorf("banner lists invalid port %q", p))
+			}
+		}
+	}
+	if c.MaxRoomsPerIP < 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum rooms per IP: %d", c.MaxRoomsPerIP))
+	}
+	blocked, err := compileClientPatterns(c.BlockedClients)
+	errs = append(errs, err)
+	if err = errors.Join(errs...); err != nil {
+		return
+	}
+	return settings{password: c.Password, banner: c.Banner, maxRoomsPerIP: c.MaxRoomsPerIP, blockedClients: blocked}, nil
+}
+
+// reload swaps in st at once, so no handshake sees half of it.
+func (s *server) reload(st settings) {
+	s.settingsMu.Lock()
+	before := s.settings
+	s.settings = st
+	s.settingsMu.Unlock()
+	var changed []string
+	if st.password != before.password {
+		changed = append(changed, "password")
+	}
+	if st.banner != before.banner {
+		changed = append(changed, fmt.Sprintf("banner %q", st.banner))
+	}
+	if st.maxRoomsPerIP != before.maxRoomsPerIP {
+		changed = append(changed, fmt.Sprintf("max rooms per ip %d", st.maxRoomsPerIP))
+	}
+	if !st.blockedClients.equal(before.blockedClients) {
+		changed = append(changed, fmt.Sprintf("%d blocked client patterns", len(st.blockedClients)))
+	}
+	if len(changed) == 0 {
+		s.logger.Infof("reloaded configuration, nothing changed")
+		return
+	}
+	s.logger.Infof("reloaded configuration: %s", strings.Join(changed, ", "))
+}
+
+// Reloader changes the settings of running relays, see RelayConfig.
+// Relays take part when started WithReloader.
+type Reloader struct {
+	mu     sync.Mutex
+	relays map[string]*server
+}
+
+// NewReloader returns a Reloader with no relays yet.
+func NewReloader() *Reloader {
+	return &Reloader{relays: make(map[string]*server)}
+}
+
+// WithReloader lets r change the settings of the relay while it runs.
+func WithReloader(r *Reloader) serverOptsFunc {
+	return func(s *server) error {
+		if r == nil {
+			return fmt.Errorf("reloader cannot be nil")
+		}
+		s.reloader = r
+		return nil
+	}
+}
+
+func (r *Reloader) register(s *server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.relays[s.port] = s
+}
+
+// Reload applies c to the relay on port. Nothing changes if c is invalid
+// or no relay runs on port.
+func (r *Reloader) Reload(port string, c RelayConfig) error {
+	st, err := c.compile()
+	if err != nil {
+		return fmt.Errorf("invalid relay configuration: %w", err)
+	}
+	r.mu.Lock()
+	s, ok := r.relays[port]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no relay on port %s", port)
+	}
+	s.reload(st)
+	return nil
+}
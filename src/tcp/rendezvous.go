@@ -0,0 +1,52 @@
+package tcp
+
+import (
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// ControlNobodyJoined tells the only connection of a room that reached
+// its TTL that nobody else ever joined it, which usually means the peers
+// used different codes or relays. The room is deleted right after.
+const ControlNobodyJoined ControlKind = "nobody-joined"
+
+// present returns the connections of the room that are not superseded.
+func (r roomInfo) present() (conns []*comm.Comm) {
+	for _, conn := range r.conns {
+		if conn != nil && !r.superseded[conn] {
+			conns = append(conns, conn)
+		}
+	}
+	return
+}
+
+// nobodyJoined returns the control frame telling each connection of the
+// room that nobody else joined it, for connections that declared
+// CapabilityControlFrames or CapabilityLimitWarnings.
+func (r roomInfo) nobodyJoined() (deliveries []controlDelivery) {
+	for _, conn := range r.present() {
+		key, ok := r.controlKeys[conn]
+		if !ok {
+			key, ok = r.warningKeys[conn]
+		}
+		if !ok {
+			continue
+		}
+		frame, err := encodeControlFrame(ControlNobodyJoined, key)
+		if err != nil {
+			continue
+		}
+		deliveries = append(deliveries, controlDelivery{conn, frame})
+	}
+	return
+}
+
+// expiredUnmet counts a room that reached its TTL at now with only one
+// connection ever in it, and returns the control frames telling that
+// connection. The caller holds the rooms lock.
+func (s *server) expiredUnmet(room string, r roomInfo, now time.Time) []controlDelivery {
+	s.unmetRooms.Add(1)
+	s.debugf("[room=%s] room expired after %s without anybody else joining", roomLogName(room), now.Sub(r.opened).Round(time.Second))
+	return r.nobodyJoined()
+}
@@ -0,0 +1,167 @@
+package tcp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+)
+
+// replayBuffer holds frames sent to a room while nobody else was there to
+// receive them, so they can be replayed to the next connection that joins.
+//
+// Frames are encrypted with a key that is generated per room and only ever
+// kept in memory, so the operator never holds readable user content even
+// though it sits in the relay's heap. The buffer is never persisted. All
+// limits are accounted in stored bytes, which are ciphertext bytes when
+// encryption is on.
+type replayBuffer struct {
+	key      []byte
+	frames   [][]byte
+	size     int
+	maxCount int
+	maxBytes int
+	// pending are the frames still to be sent to each connection being
+	// replayed to, with the live frames for it queued after the replayed
+	// ones so they cannot overtake them. A nil frame stands for the EOF
+	// of a peer. The rooms lock guards it.
+	pending map[*comm.Comm][][]byte
+}
+
+// newReplayBuffer returns a buffer holding at most maxCount frames and
+// maxBytes stored bytes. If encrypt is false frames are kept as they are.
+func newReplayBuffer(maxCount, maxBytes int, encrypt bool) (b *replayBuffer, err error) {
+	b = &replayBuffer{maxCount: maxCount, maxBytes: maxBytes, pending: make(map[*comm.Comm][][]byte)}
+	if encrypt {
+		b.key = make([]byte, 32)
+		if _, err = rand.Read(b.key); err != nil {
+			err = fmt.Errorf("could not generate buffer key: %w", err)
+		}
+	}
+	return
+}
+
+// add stores a frame, dropping the oldest frames to stay within the limits.
+// A frame that alone exceeds maxBytes is not stored.
+func (b *replayBuffer) add(frame []byte) (err error) {
+	stored := append([]byte{}, frame...)
+	if b.key != nil {
+		stored, err = crypt.Encrypt(frame, b.key)
+		if err != nil {
+			return
+		}
+	}
+	if len(stored) > b.maxBytes {
+		zero(stored)
+		return fmt.Errorf("frame of %d bytes exceeds the replay buffer", len(stored))
+	}
+	for len(b.frames) > 0 && (len(b.frames) >= b.maxCount || b.size+len(stored) > b.maxBytes) {
+		b.size -= len(b.frames[0])
+		zero(b.frames[0])
+		b.frames = b.frames[1:]
+	}
+	b.frames = append(b.frames, stored)
+	b.size += len(stored)
+	return
+}
+
+// drain returns the buffered frames in order and empties the buffer.
+func (b *replayBuffer) drain() (frames [][]byte, err error) {
+	for _, stored := range b.frames {
+		frame := stored
+		if b.key != nil {
+			frame, err = crypt.Decrypt(stored, b.key)
+			zero(stored)
+			if err != nil {
+				return
+			}
+		}
+		frames = append(frames, frame)
+	}
+	b.frames = nil
+	b.size = 0
+	return
+}
+
+// wipe zeroes every buffered frame and the key.
+func (b *replayBuffer) wipe() {
+	for _, stored := range b.frames {
+		zero(stored)
+	}
+	b.frames = nil
+	b.size = 0
+	zero(b.key)
+	b.key = nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// startReplay drains the buffer into the frames pending for c, which just
+// joined, and returns the stored bytes drained, which count against the
+// room's byte quota. The caller holds the rooms lock and calls replayTo
+// once it is released.
+func (b *replayBuffer) startReplay(c *comm.Comm) (stored int, err error) {
+	stored = b.size
+	frames, err := b.drain()
+	if err != nil {
+		return
+	}
+	b.pending[c] = frames
+	return
+}
+
+// queue takes the connections of targets that are being replayed to out
+// of it, queuing frame for them instead. The caller holds the rooms lock.
+func (b *replayBuffer) queue(targets []*comm.Comm, frame []byte) []*comm.Comm {
+	return slices.DeleteFunc(targets, func(conn *comm.Comm) bool {
+		frames, ok := b.pending[conn]
+		if ok {
+			b.pending[conn] = append(frames, frame)
+		}
+		return ok
+	})
+}
+
+// replayTo sends c the frames startReplay left pending for it, and the
+// live frames queued behind them, writing outside the rooms lock. Once
+// nothing is pending, frames go to c directly again.
+func (s *server) replayTo(b *replayBuffer, c *comm.Comm, clog *connLogger) error {
+	s.rooms.Lock()
+	if n := len(b.pending[c]); n > 0 {
+		clog.Debugf("replaying %d frames", n)
+	}
+	for {
+		frames := b.pending[c]
+		if len(frames) == 0 {
+			delete(b.pending, c)
+			s.rooms.Unlock()
+			return nil
+		}
+		b.pending[c] = [][]byte{}
+		s.rooms.Unlock()
+		for _, frame := range frames {
+			var err error
+			switch {
+			case frame != nil:
+				err = c.Send(frame)
+			case c.EOFEnabled():
+				err = c.WriteEOF()
+			default:
+				c.Close()
+			}
+			if err != nil {
+				s.rooms.Lock()
+				delete(b.pending, c)
+				s.rooms.Unlock()
+				return err
+			}
+		}
+		s.rooms.Lock()
+	}
+}
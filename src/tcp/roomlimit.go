@@ -0,0 +1,35 @@
+package tcp
+
+import "errors"
+
+// tooManyRoomsResponse is sent instead of "ok" when the client's address
+// is already in as many rooms as the relay allows.
+const tooManyRoomsResponse = "too many rooms"
+
+// ErrTooManyRooms is returned by ConnectToTCPServer when the relay refused
+// the room because the client's address is in too many rooms already.
+var ErrTooManyRooms = errors.New("relay refused the room: too many rooms from this address")
+
+// join counts a room membership for host and reports whether it is within
+// max, where zero means no limit. A membership that would exceed max is
+// not counted. The caller holds the lock.
+func (m *roomMap) join(host string, max int) bool {
+	if max > 0 && m.members[host] >= max {
+		return false
+	}
+	if m.members == nil {
+		m.members = make(map[string]int)
+	}
+	m.members[host]++
+	return true
+}
+
+// leave gives back a membership counted by join. The caller holds the
+// lock.
+func (m *roomMap) leave(host string) {
+	if m.members[host] <= 1 {
+		delete(m.members, host)
+		return
+	}
+	m.members[host]--
+}
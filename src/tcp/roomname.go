@@ -0,0 +1,45 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// MAX_ROOM_REQUEST_LENGTH bounds the raw room frame, policy included. It is
+// enforced even when strict room names are off.
+const MAX_ROOM_REQUEST_LENGTH = 256
+
+// invalidRoomResponse is sent instead of "ok" when the relay refuses a room
+// name.
+const invalidRoomResponse = "invalid room"
+
+// ErrInvalidRoom is returned by ConnectToTCPServer when the relay refused
+// the room name.
+var ErrInvalidRoom = errors.New("relay rejected the room name")
+
+// validRoomName matches the sha256 hex names clients derive from the shared
+// secret, optionally followed by the index croc appends for the rooms of
+// its extra transfer ports.
+var validRoomName = regexp.MustCompile(`^[a-f0-9]{64}(-[0-9]{1,3})?$`)
+
+// reservedRoomNames are accepted even though they are not hashes.
+var reservedRoomNames = map[string]bool{
+	pingRoom: true,
+}
+
+// checkRoomRequest validates a room frame before it is parsed. The length
+// limit always applies; the name format only if strict is set.
+func checkRoomRequest(request string, strict bool) error {
+	if len(request) > MAX_ROOM_REQUEST_LENGTH {
+		return fmt.Errorf("%w: room request of %d bytes", ErrInvalidRoom, len(request))
+	}
+	if !strict {
+		return nil
+	}
+	room := parseRoomRequest(request).Room
+	if !validRoomName.MatchString(room) && !reservedRoomNames[room] {
+		return fmt.Errorf("%w: '%s'", ErrInvalidRoom, roomLogName(room))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// CapabilityRouting is announced by relays that can deliver a frame to a
+// single connection of a room, and declared in the room request by
+// clients that want to address or be addressed that way. The relay gives
+// each such connection a session tag when it joins; a client that wraps
+// a frame with RouteFrame gets it delivered only to the connection with
+// that tag. How peers learn each other's tags is up to them, typically
+// by sending their own in a broadcast frame.
+const CapabilityRouting = "routing"
+
+// routeFramePrefix introduces a routed frame: the prefix, then the session
+// tag of the connection to deliver to, then the payload. The relay strips
+// the prefix and tag and passes the payload on untouched, so it can stay
+// encrypted between the peers.
+var routeFramePrefix = []byte("croc-relay-route:")
+
+// sessionTagLen is the length of a session tag, the hex of 8 random
+// bytes.
+const sessionTagLen = 16
+
+// joinTagSeparator separates the session tag from "ok" in the reply to a
+// room request that declared CapabilityRouting.
+const joinTagSeparator = "|||"
+
+func newSessionTag() (string, error) {
+	b := make([]byte, sessionTagLen/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RouteFrame returns a frame that a relay announcing CapabilityRouting
+// delivers, as data, only to the connection of the room whose session tag
+// is tag. The connection sending it must have declared the capability;
+// otherwise the relay broadcasts the frame as it is.
+func RouteFrame(tag string, data []byte) []byte {
+	frame := make([]byte, 0, len(routeFramePrefix)+len(tag)+len(data))
+	frame = append(append(append(frame, routeFramePrefix...), tag...), data...)
+	return frame
+}
+
+// parseRouteFrame returns the session tag and payload of a routed frame,
+// and false if data is not one.
+func parseRouteFrame(data []byte) (tag string, payload []byte, ok bool) {
+	rest, ok := bytes.CutPrefix(data, routeFramePrefix)
+	if !ok || len(rest) < sessionTagLen {
+		return "", nil, false
+	}
+	return string(rest[:sessionTagLen]), rest[sessionTagLen:], true
+}
+
+// route appends the connections a frame from sender goes to and returns
+// the frame to send them. A routed frame from a connection that declared
+// CapabilityRouting goes, unwrapped, to the connection with its tag if
+// the room policy allows, and to nobody if there is none; routed is set
+// then, so the frame is not kept for a later joiner. Every other frame is
+// broadcast as it is.
+func (r roomInfo) route(sender *comm.Comm, data []byte, to []*comm.Comm) (targets []*comm.Comm, frame []byte, routed bool) {
+	if _, ok := r.routeTags[sender]; !ok {
+		return r.targets(sender, to), data, false
+	}
+	tag, payload, ok := parseRouteFrame(data)
+	if !ok {
+		return r.targets(sender, to), data, false
+	}
+	for _, conn := range r.conns {
+		if r.routeTags[conn] == tag && r.forwardsTo(sender, conn) {
+			to = append(to, conn)
+			break
+		}
+	}
+	return to, payload, true
+}
@@ -0,0 +1,453 @@
+package tcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+	log "github.com/schollz/logger"
+)
+
+// CapabilityControlRPC is announced by relays that answer control
+// requests: a client that sends controlRoom in place of a room request
+// gets a control channel, on which every frame is a JSON request the
+// relay answers itself, and no room is created. New control features land
+// as methods of the channel rather than as more magic room names.
+const CapabilityControlRPC = "control-rpc"
+
+// controlRoom is sent in place of a room request to open a control
+// channel. It starts with a NUL byte, which no room name does.
+const controlRoom = "\x00control"
+
+const (
+	// controlIdleTimeout closes control channels that sent no request for
+	// that long, as they are in no room the cleanup would find them in.
+	controlIdleTimeout = 30 * time.Second
+	// maxControlRequest bounds a control request frame.
+	maxControlRequest = 4096
+	// controlLimitWindow is the window of the per-method rate limits.
+	controlLimitWindow = time.Minute
+	// controlRequestTimeout bounds the connections of DialControl.
+	controlRequestTimeout = 30 * time.Second
+)
+
+// Codes of control errors, each standing for an error the client gets
+// back, so callers can tell them apart with errors.Is.
+const (
+	controlErrUnknownMethod = "unknown_method"
+	controlErrRateLimited   = "rate_limited"
+	controlErrBadRequest    = "bad_request"
+	controlErrFailed        = "failed"
+	controlErrInvalidRoom   = "invalid_room"
+	controlErrUnknownToken  = "unknown_token"
+	controlErrTokenAttempts = "token_attempts"
+	controlErrTooManyTokens = "too_many_tokens"
+)
+
+var (
+	// ErrControlUnsupported is returned by DialControl when the relay
+	// does not announce CapabilityControlRPC.
+	ErrControlUnsupported = errors.New("relay does not answer control requests")
+	// ErrUnknownControlMethod is returned by Call for a method the relay
+	// does not know.
+	ErrUnknownControlMethod = errors.New("relay does not know the control method")
+	// ErrControlRateLimited is returned by Call when this address called
+	// the method too often lately.
+	ErrControlRateLimited = errors.New("relay refused the control request: too many requests from this address")
+)
+
+// controlErrors are the errors the codes of control errors stand for.
+var controlErrors = map[string]error{
+	controlErrUnknownMethod: ErrUnknownControlMethod,
+	controlErrRateLimited:   ErrControlRateLimited,
+	controlErrInvalidRoom:   ErrInvalidRoom,
+	controlErrUnknownToken:  ErrUnknownRoomToken,
+	controlErrTokenAttempts: ErrTooManyTokenAttempts,
+	controlErrTooManyTokens: ErrTooManyRoomTokens,
+}
+
+// ControlError is a control request the relay failed.
+type ControlError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ControlError) Error() string {
+	return "relay control: " + e.Message
+}
+
+// Unwrap returns the error the code of e stands for, if any.
+func (e *ControlError) Unwrap() error {
+	return controlErrors[e.Code]
+}
+
+// controlFailure returns the control error for err, keeping the code of
+// the errors clients know.
+func controlFailure(err error) *ControlError {
+	var ce *ControlError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	for code, known := range controlErrors {
+		if errors.Is(err, known) {
+			return &ControlError{Code: code, Message: err.Error()}
+		}
+	}
+	return &ControlError{Code: controlErrFailed, Message: err.Error()}
+}
+
+type controlRequest struct {
+	Method string          `json:"method"`
+	ID     uint64          `json:"id"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ControlError   `json:"error,omitempty"`
+}
+
+// controlCall is a control request as a handler sees it.
+type controlCall struct {
+	// host is the address the request came from, without the port, and
+	// remote the address with it.
+	host   string
+	remote string
+	params json.RawMessage
+	now    time.Time
+}
+
+// decode reads the params of the call into v, failing with a bad request.
+func (c controlCall) decode(v any) error {
+	if len(c.params) == 0 {
+		return &ControlError{Code: controlErrBadRequest, Message: "missing params"}
+	}
+	if err := json.Unmarshal(c.params, v); err != nil {
+		return &ControlError{Code: controlErrBadRequest, Message: fmt.Sprintf("bad params: %v", err)}
+	}
+	return nil
+}
+
+// controlMethod is a method of the control channel: its handler and how
+// many calls one host may make per controlLimitWindow.
+type controlMethod struct {
+	limit  int
+	handle func(s *server, call controlCall) (any, error)
+}
+
+// controlMethods are the methods relays answer, by name.
+var controlMethods = map[string]controlMethod{
+	"whoami":        {limit: 30, handle: (*server).controlWhoami},
+	"settings":      {limit: 30, handle: (*server).controlSettings},
+	"token.claim":   {limit: 20, handle: (*server).controlClaimToken},
+	"token.resolve": {limit: maxTokenAttempts, handle: (*server).controlResolveToken},
+}
+
+// controlLimits counts the calls of each host to each method over
+// controlLimitWindow.
+type controlLimits struct {
+	sync.Mutex
+	calls map[[2]string]tokenAttempts
+}
+
+// allow counts a call of host to method and reports whether it is within
+// limit.
+func (l *controlLimits) allow(host, method string, limit int, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	key := [2]string{host, method}
+	a := l.calls[key]
+	if now.Sub(a.start) >= controlLimitWindow {
+		a = tokenAttempts{start: now}
+	}
+	if a.n >= limit {
+		return false
+	}
+	a.n++
+	if l.calls == nil {
+		l.calls = make(map[[2]string]tokenAttempts)
+	}
+	l.calls[key] = a
+	return true
+}
+
+// sweep forgets the counts whose window has passed.
+func (l *controlLimits) sweep(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for key, a := range l.calls {
+		if now.Sub(a.start) >= controlLimitWindow {
+			delete(l.calls, key)
+		}
+	}
+}
+
+// handleControl answers one control request frame from a client at
+// remote.
+func (s *server) handleControl(data []byte, remote string, clog *connLogger) controlResponse {
+	var req controlRequest
+	if len(data) > maxControlRequest {
+		return controlResponse{Error: &ControlError{Code: controlErrBadRequest, Message: fmt.Sprintf("request of %d bytes", len(data))}}
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return controlResponse{Error: &ControlError{Code: controlErrBadRequest, Message: "request is not JSON"}}
+	}
+	resp := controlResponse{ID: req.ID}
+	method, ok := s.controlMethods[req.Method]
+	if !ok {
+		resp.Error = &ControlError{Code: controlErrUnknownMethod, Message: fmt.Sprintf("unknown method '%s'", req.Method)}
+		return resp
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	now := s.clock.Now()
+	if !s.controlLimits.allow(host, req.Method, method.limit, now) {
+		clog.Infof("refusing control request: %s called %s too often", host, req.Method)
+		s.errors.add(now, errorControlRateLimited)
+		resp.Error = &ControlError{Code: controlErrRateLimited, Message: ErrControlRateLimited.Error()}
+		return resp
+	}
+	result, err := method.handle(s, controlCall{host: host, remote: remote, params: req.Params, now: now})
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		clog.Debugf("control request %s failed: %v", req.Method, err)
+		resp.Result = nil
+		resp.Error = controlFailure(err)
+	}
+	return resp
+}
+
+// serveControl answers the control requests of c, whose handshake
+// produced key, until it closes or goes idle.
+func (s *server) serveControl(c *comm.Comm, key []byte, clog *connLogger) error {
+	enc, err := crypt.Encrypt([]byte("ok"), key)
+	if err != nil {
+		return err
+	}
+	if err = c.Send(enc); err != nil {
+		return err
+	}
+	clog.Debugf("serving control requests")
+	idle := time.AfterFunc(controlIdleTimeout, c.Close)
+	defer idle.Stop()
+	remote := c.Connection().RemoteAddr().String()
+	for {
+		enc, err = c.Receive()
+		if err != nil {
+			// the client is done, or went idle
+			return nil
+		}
+		idle.Reset(controlIdleTimeout)
+		data, err := crypt.Decrypt(enc, key)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(s.handleControl(data, remote, clog))
+		if err != nil {
+			return err
+		}
+		if enc, err = crypt.Encrypt(b, key); err != nil {
+			return err
+		}
+		if err = c.Send(enc); err != nil {
+			return err
+		}
+	}
+}
+
+// Whoami is what the relay sees of a client.
+type Whoami struct {
+	// Address is the address the client connects from, as host:port.
+	Address string `json:"address"`
+	Host    string `json:"host"`
+}
+
+func (s *server) controlWhoami(call controlCall) (any, error) {
+	return Whoami{Address: call.remote, Host: call.host}, nil
+}
+
+// RelaySettings are the settings of a relay a client may know.
+type RelaySettings struct {
+	Banner       string   `json:"banner,omitempty"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	// MaxRoomsPerIP is how many rooms one host may be in at once; zero
+	// means no cap.
+	MaxRoomsPerIP int `json:"max_rooms_per_ip,omitempty"`
+	// RoomTTL is how long a room may stay open.
+	RoomTTL time.Duration `json:"room_ttl"`
+	// ReplayFrames is how many frames a room buffers for a peer that has
+	// yet to join; zero means rooms buffer nothing.
+	ReplayFrames int `json:"replay_frames,omitempty"`
+}
+
+func (s *server) controlSettings(controlCall) (any, error) {
+	settings := s.current()
+	return RelaySettings{
+		Banner:        settings.banner,
+		Version:       s.version,
+		Capabilities:  relayCapabilities,
+		MaxRoomsPerIP: settings.maxRoomsPerIP,
+		RoomTTL:       s.roomTTL,
+		ReplayFrames:  s.replayMaxFrames,
+	}, nil
+}
+
+type tokenParams struct {
+	Room  string `json:"room,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+func (s *server) controlClaimToken(call controlCall) (any, error) {
+	var p tokenParams
+	if err := call.decode(&p); err != nil {
+		return nil, err
+	}
+	if !validRoomName.MatchString(p.Room) {
+		s.errors.add(call.now, errorInvalidRoom)
+		return nil, ErrInvalidRoom
+	}
+	token, err := s.tokens.claim(p.Room, call.now)
+	if err != nil {
+		return nil, err
+	}
+	return tokenParams{Token: token}, nil
+}
+
+func (s *server) controlResolveToken(call controlCall) (any, error) {
+	var p tokenParams
+	if err := call.decode(&p); err != nil {
+		return nil, err
+	}
+	room, err := s.tokens.resolve(call.host, p.Token, call.now)
+	if errors.Is(err, ErrTooManyTokenAttempts) {
+		s.errors.add(call.now, errorTokenAttempts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tokenParams{Room: room}, nil
+}
+
+// ControlClient is a control channel to a relay. Its calls are answered
+// one at a time.
+type ControlClient struct {
+	mu     sync.Mutex
+	c      *comm.Comm
+	key    []byte
+	lastID uint64
+}
+
+// DialControl opens a control channel to the relay at address. The relay
+// closes channels that sent no request for a while.
+func DialControl(address, password string) (*ControlClient, error) {
+	c, err := comm.NewConnection(address, controlRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, err := clientHandshake(c, password, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !c.RelaySupports(CapabilityControlRPC) {
+		c.Close()
+		return nil, ErrControlUnsupported
+	}
+	enc, err := crypt.Encrypt([]byte(controlRoom), key)
+	if err == nil {
+		err = c.Send(enc)
+	}
+	if err == nil {
+		enc, err = c.Receive()
+	}
+	var data []byte
+	if err == nil {
+		data, err = crypt.Decrypt(enc, key)
+	}
+	if err == nil && string(data) != "ok" {
+		err = fmt.Errorf("got bad response: %s", data)
+	}
+	if err != nil {
+		log.Debug(err)
+		c.Close()
+		return nil, err
+	}
+	return &ControlClient{c: c, key: key}, nil
+}
+
+// Call calls method with params and reads its result into result, which
+// may be nil. Failed calls return a *ControlError.
+func (cc *ControlClient) Call(method string, params, result any) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.lastID++
+	req := controlRequest{Method: method, ID: cc.lastID}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = b
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	enc, err := crypt.Encrypt(b, cc.key)
+	if err != nil {
+		return err
+	}
+	if err = cc.c.Send(enc); err != nil {
+		return err
+	}
+	enc, err = cc.c.Receive()
+	if err != nil {
+		return err
+	}
+	data, err := crypt.Decrypt(enc, cc.key)
+	if err != nil {
+		return err
+	}
+	var resp controlResponse
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("got bad response: %w", err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("got response %d to request %d", resp.ID, req.ID)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Whoami returns what the relay sees of this client.
+func (cc *ControlClient) Whoami() (w Whoami, err error) {
+	err = cc.Call("whoami", nil, &w)
+	return
+}
+
+// Settings returns the settings of the relay.
+func (cc *ControlClient) Settings() (st RelaySettings, err error) {
+	err = cc.Call("settings", nil, &st)
+	return
+}
+
+// Close closes the control channel.
+func (cc *ControlClient) Close() {
+	cc.c.Close()
+}
@@ -0,0 +1,14 @@
+package tcp
+
+import "errors"
+
+// ServiceName is the name croc relays register under with the Windows
+// service manager, e.g. with
+//
+//	sc.exe create croc-relay binPath= "C:\path\to\croc.exe relay --service"
+const ServiceName = "croc-relay"
+
+// ErrServiceUnsupported is returned by RunProcess when asked to run as a
+// service anywhere but on Windows, or on Windows when the process was not
+// started by the service manager.
+var ErrServiceUnsupported = errors.New("running as a service is only supported under the Windows service manager")
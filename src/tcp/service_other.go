@@ -0,0 +1,41 @@
+//go:build !windows
+
+package tcp
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/schollz/logger"
+)
+
+// RunProcess runs the relays of the process with run until the system asks
+// the process to stop, which cancels the context run gets, and calls
+// reload whenever it asks the process to reload its configuration. Here
+// interrupts and SIGTERM stop the process and SIGHUP reloads it. service
+// runs the process under the Windows service manager, so it returns
+// ErrServiceUnsupported.
+func RunProcess(service bool, run func(ctx context.Context) error, reload func()) error {
+	if service {
+		return ErrServiceUnsupported
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Infof("got SIGHUP, reloading configuration")
+				reload()
+			}
+		}
+	}()
+	return run(ctx)
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package tcp
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProcess(t *testing.T) {
+	log.SetLevel("error")
+	assert.ErrorIs(t, RunProcess(true, func(ctx context.Context) error { return nil }, func() {}), ErrServiceUnsupported)
+
+	reloaded := make(chan struct{}, 1)
+	err := RunProcess(false, func(ctx context.Context) error {
+		syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+		select {
+		case <-reloaded:
+		case <-time.After(5 * time.Second):
+			t.Error("SIGHUP did not reload")
+		}
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Error("SIGTERM did not stop")
+		}
+		return nil
+	}, func() { reloaded <- struct{}{} })
+	assert.Nil(t, err)
+}
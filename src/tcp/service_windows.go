@@ -0,0 +1,87 @@
+//go:build windows
+
+package tcp
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/schollz/logger"
+	"golang.org/x/sys/windows/svc"
+)
+
+// RunProcess runs the relays of the process with run until the system asks
+// the process to stop, which cancels the context run gets, and calls
+// reload whenever it asks the process to reload its configuration. With
+// service the process runs under the Windows service manager, which stops
+// it with the stop and shutdown controls and reloads it with the
+// paramchange control, e.g. sc.exe control croc-relay paramchange.
+// Otherwise Ctrl-C stops it and nothing reloads it.
+func RunProcess(service bool, run func(ctx context.Context) error, reload func()) error {
+	if !service {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return run(ctx)
+	}
+	if isService, err := svc.IsWindowsService(); err != nil || !isService {
+		return ErrServiceUnsupported
+	}
+	h := &serviceHandler{run: run, reload: reload}
+	if err := svc.Run(ServiceName, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+// serviceAccepts are the controls a relay service handles.
+const serviceAccepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+
+// serviceHandler runs the relays as a service, reporting their state to
+// the service manager.
+type serviceHandler struct {
+	run    func(ctx context.Context) error
+	reload func()
+	// err is what run returned.
+	err error
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.run(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: serviceAccepts}
+	stopping := false
+	for {
+		select {
+		case h.err = <-done:
+			status <- svc.Status{State: svc.StopPending}
+			if h.err != nil {
+				// a service-specific exit code tells the service manager
+				// the relays failed rather than were stopped
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Infof("service stopping")
+				stopping = true
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			case svc.ParamChange:
+				if stopping {
+					continue
+				}
+				log.Infof("service asked to reload configuration")
+				h.reload()
+				status <- svc.Status{State: svc.Running, Accepts: serviceAccepts}
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+)
+
+// maxFirstFrame bounds the first frame of a croc client, which is "ping"
+// or PAKE bytes of a few hundred bytes.
+const maxFirstFrame = 64 << 10
+
+// errNotCroc is returned by sniff for a connection that does not open
+// like a croc client.
+var errNotCroc = fmt.Errorf("not a croc client")
+
+// sniff reads the first frame from conn within timeout and checks that it
+// is framed like croc's. Scanners and other stray traffic fail this at
+// once or when the deadline passes, before the relay spends a PAKE on
+// them. A croc frame that is neither "ping" nor PAKE bytes passes, so the
+// handshake can tell a client of an incompatible version why it is
+// refused. On success the returned connection reads the frame again.
+func sniff(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotCroc, err)
+	}
+	if !bytes.Equal(header[:4], comm.MAGIC_BYTES) {
+		return nil, fmt.Errorf("%w: starts with %q", errNotCroc, header[:4])
+	}
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size > maxFirstFrame {
+		return nil, fmt.Errorf("%w: first frame of %d bytes", errNotCroc, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(conn, frame); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNotCroc, err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(append(header, frame...)), conn)}, nil
+}
+
+// sniffedConn replays the bytes sniff read before reading on from the
+// connection.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
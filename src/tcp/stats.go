@@ -0,0 +1,289 @@
+package tcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Traffic is counted per room in a ring of fixed buckets, so memory per room
+// stays constant however busy it is.
+const (
+	trafficBucketWidth = 10 * time.Second
+	trafficBuckets     = 30 // 5 minutes
+	// statsTopRooms is how many rooms Stats ranks by traffic.
+	statsTopRooms = 10
+)
+
+// connectionAgeBounds are the upper bounds of the connection age histogram;
+// a final bucket counts everything older.
+var connectionAgeBounds = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, DEFAULT_ROOM_TTL}
+
+// trafficWindow is a rolling count of bytes over the last
+// trafficBuckets*trafficBucketWidth.
+type trafficWindow struct {
+	buckets [trafficBuckets]struct {
+		index int64
+		bytes int64
+	}
+}
+
+func trafficBucketIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(trafficBucketWidth)
+}
+
+func (w *trafficWindow) add(now time.Time, n int) {
+	if w == nil || n == 0 {
+		return
+	}
+	idx := trafficBucketIndex(now)
+	b := &w.buckets[idx%trafficBuckets]
+	if b.index != idx {
+		b.index = idx
+		b.bytes = 0
+	}
+	b.bytes += int64(n)
+}
+
+// total returns the bytes counted in the window ending at now.
+func (w *trafficWindow) total(now time.Time) (total int64) {
+	if w == nil {
+		return
+	}
+	idx := trafficBucketIndex(now)
+	for _, b := range w.buckets {
+		if b.index > idx-trafficBuckets && b.index <= idx {
+			total += b.bytes
+		}
+	}
+	return
+}
+
+// Kinds of failed connections counted in Stats.Errors.
+const (
+	errorHandshake          = "handshake"
+	errorBadPassword        = "bad_password"
+	errorInvalidRoom        = "invalid_room"
+	errorRoomsPerIP         = "rooms_per_ip"
+	errorProtocolJunk       = "protocol_junk"
+	errorHandshakeTimeout   = "handshake_timeout"
+	errorBlockedClient      = "blocked_client"
+	errorObserversDenied    = "observers_denied"
+	errorTokenAttempts      = "token_attempts"
+	errorControlRateLimited = "control_rate_limited"
+	errorClusterUnreachable = "cluster_unreachable"
+)
+
+// errorCounts keeps a rolling count per kind of failed connection over the
+// same window as room traffic.
+type errorCounts struct {
+	sync.Mutex
+	kinds map[string]*trafficWindow
+}
+
+func (e *errorCounts) add(now time.Time, kind string) {
+	e.Lock()
+	defer e.Unlock()
+	if e.kinds == nil {
+		e.kinds = make(map[string]*trafficWindow)
+	}
+	w, ok := e.kinds[kind]
+	if !ok {
+		w = new(trafficWindow)
+		e.kinds[kind] = w
+	}
+	w.add(now, 1)
+}
+
+func (e *errorCounts) totals(now time.Time) map[string]int64 {
+	e.Lock()
+	defer e.Unlock()
+	totals := make(map[string]int64, len(e.kinds))
+	for kind, w := range e.kinds {
+		if n := w.total(now); n > 0 {
+			totals[kind] = n
+		}
+	}
+	return totals
+}
+
+// RoomTraffic is a room's share of relayed bytes over the last five
+// minutes. Room is truncated like in the logs. Apps lists the applications
+// the connections in the room declared.
+type RoomTraffic struct {
+	Room  string   `json:"room"`
+	Bytes int64    `json:"bytes"`
+	Apps  []string `json:"apps,omitempty"`
+}
+
+// AgeBucket counts connections up to a given age; UpTo is empty for the
+// final, unbounded bucket.
+type AgeBucket struct {
+	UpTo  string `json:"up_to,omitempty"`
+	Count int    `json:"count"`
+}
+
+// Limits are the relay settings that bound what clients can do.
+type Limits struct {
+	RoomTTL          string  `json:"room_ttl"`
+	RoomCleanup      string  `json:"room_cleanup"`
+	MaxRoomRequest   int     `json:"max_room_request"`
+	StrictRoomNames  bool    `json:"strict_room_names"`
+	ReplayMaxFrames  int     `json:"replay_max_frames"`
+	ReplayMaxBytes   int     `json:"replay_max_bytes"`
+	SupersededGrace  string  `json:"superseded_grace"`
+	ConnIdleTimeout  string  `json:"conn_idle_timeout"`
+	MaxRoomsPerIP    int     `json:"max_rooms_per_ip"`
+	SniffTimeout     string  `json:"sniff_timeout"`
+	HandshakeTimeout string  `json:"handshake_timeout"`
+	RoomByteQuota    int64   `json:"room_byte_quota"`
+	QuotaWarning     float64 `json:"quota_warning"`
+	ExpiryWarning    string  `json:"expiry_warning"`
+}
+
+// Stats is a snapshot of the relay for capacity planning.
+type Stats struct {
+	Version        string        `json:"version,omitempty"`
+	Uptime         string        `json:"uptime"`
+	Rooms          int           `json:"rooms"`
+	Connections    int           `json:"connections"`
+	TopRooms       []RoomTraffic `json:"top_rooms"`
+	ConnectionAges []AgeBucket   `json:"connection_ages"`
+	// ConnectionIdle counts connections by how long ago they last sent a
+	// frame; half-closed connections are left out.
+	ConnectionIdle []AgeBucket      `json:"connection_idle"`
+	Modes          map[RoomMode]int `json:"modes"`
+	// Errors counts failed connections by kind over the last five minutes.
+	Errors map[string]int64 `json:"errors"`
+	// LimitEvents counts, since the relay started, the rooms warned of
+	// their TTL or byte quota and those cut off at either.
+	LimitEvents map[string]int64 `json:"limit_events"`
+	// UnmetRooms counts, since the relay started, the rooms that reached
+	// their TTL without a second connection ever joining, which usually
+	// means peers with mismatched codes or relays.
+	UnmetRooms int64 `json:"unmet_rooms"`
+	// Handshake times each phase of the handshakes since the relay
+	// started; it is only kept when stats or a status page are served.
+	Handshake []PhaseTiming `json:"handshake,omitempty"`
+	Limits    Limits        `json:"limits"`
+}
+
+// Stats returns a snapshot of the relay's rooms. Rooms that never declared
+// a mode are counted under "".
+func (s *server) Stats() Stats {
+	return s.statsAt(s.clock.Now())
+}
+
+func (s *server) statsAt(now time.Time) (st Stats) {
+	st.Version = s.version
+	if !s.started.IsZero() {
+		st.Uptime = now.Sub(s.started).Round(time.Second).String()
+	}
+	st.Errors = s.errors.totals(now)
+	st.LimitEvents = s.limitEvents.totals()
+	st.UnmetRooms = s.unmetRooms.Load()
+	st.Handshake = s.handshakes.stats()
+	st.Limits = Limits{
+		RoomTTL:          s.roomTTL.String(),
+		RoomCleanup:      s.roomCleanupInterval.String(),
+		MaxRoomRequest:   MAX_ROOM_REQUEST_LENGTH,
+		StrictRoomNames:  s.strictRoomNames,
+		ReplayMaxFrames:  s.replayMaxFrames,
+		ReplayMaxBytes:   s.replayMaxBytes,
+		SupersededGrace:  s.supersededGracePeriod.String(),
+		ConnIdleTimeout:  s.connIdleTimeout.String(),
+		MaxRoomsPerIP:    s.current().maxRoomsPerIP,
+		SniffTimeout:     s.sniffTimeout.String(),
+		HandshakeTimeout: s.handshakeTimeout.String(),
+		RoomByteQuota:    s.roomByteQuota,
+		QuotaWarning:     s.quotaWarning,
+		ExpiryWarning:    s.expiryWarning.String(),
+	}
+	st.Modes = make(map[RoomMode]int)
+	st.ConnectionAges = make([]AgeBucket, len(connectionAgeBounds)+1)
+	st.ConnectionIdle = make([]AgeBucket, len(connectionAgeBounds)+1)
+	for i, bound := range connectionAgeBounds {
+		st.ConnectionAges[i].UpTo = bound.String()
+		st.ConnectionIdle[i].UpTo = bound.String()
+	}
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	for room, r := range s.rooms.rooms {
+		st.Rooms++
+		st.Connections += len(r.conns)
+		st.Modes[r.mode]++
+		if bytes := r.traffic.total(now); bytes > 0 {
+			st.TopRooms = append(st.TopRooms, RoomTraffic{Room: roomLogName(room), Bytes: bytes, Apps: r.declaredApps()})
+		}
+		for _, joined := range r.joined {
+			st.ConnectionAges[ageBucket(now.Sub(joined))].Count++
+		}
+		for _, last := range r.lastReceive {
+			st.ConnectionIdle[ageBucket(now.Sub(last))].Count++
+		}
+	}
+	sort.Slice(st.TopRooms, func(i, j int) bool {
+		if st.TopRooms[i].Bytes != st.TopRooms[j].Bytes {
+			return st.TopRooms[i].Bytes > st.TopRooms[j].Bytes
+		}
+		return st.TopRooms[i].Room < st.TopRooms[j].Room
+	})
+	if len(st.TopRooms) > statsTopRooms {
+		st.TopRooms = st.TopRooms[:statsTopRooms]
+	}
+	return
+}
+
+// declaredApps returns the distinct applications the connections in the
+// room declared, sorted.
+func (r roomInfo) declaredApps() (apps []string) {
+	seen := make(map[string]bool)
+	for _, app := range r.apps {
+		if app != "" && !seen[app] {
+			seen[app] = true
+			apps = append(apps, app)
+		}
+	}
+	sort.Strings(apps)
+	return
+}
+
+// ageBucket returns the index of the histogram bucket for age d.
+func ageBucket(d time.Duration) int {
+	return sort.Search(len(connectionAgeBounds), func(i int) bool { return d <= connectionAgeBounds[i] })
+}
+
+// handleStats serves Stats as JSON on /stats.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Stats()); err != nil {
+		s.logger.Debugf("could not write stats: %v", err)
+	}
+}
+
+// serveStats starts the stats endpoint if one was configured. The returned
+// server is nil otherwise. The address is bound before it returns, so it
+// is held before the relay drops privileges.
+func (s *server) serveStats() (*http.Server, error) {
+	if s.statsAddress == "" {
+		return nil, nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handleStats)
+	srv := &http.Server{Addr: s.statsAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	l, err := net.Listen("tcp", s.statsAddress)
+	if err != nil {
+		return nil, fmt.Errorf("stats endpoint: %w", err)
+	}
+	go func() {
+		s.logger.Infof("serving stats on http://%s/stats", s.statsAddress)
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("stats endpoint: %v", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,119 @@
+package tcp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusRefresh is how often the status page reloads itself.
+const statusRefresh = 10 * time.Second
+
+// statusTemplate is the whole status page; it pulls in nothing external so
+// it works on an isolated relay.
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>croc relay</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>croc relay {{.Stats.Version}}</h1>
+<table>
+<tr><th>uptime</th><td>{{.Stats.Uptime}}</td></tr>
+<tr><th>rooms</th><td>{{.Stats.Rooms}}</td></tr>
+<tr><th>connections</th><td>{{.Stats.Connections}}</td></tr>
+<tr><th>rooms nobody else joined</th><td>{{.Stats.UnmetRooms}}</td></tr>
+</table>
+<h2>Errors, last 5 minutes</h2>
+<table>
+{{range $kind, $n := .Stats.Errors}}<tr><th>{{$kind}}</th><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Limit events since start</h2>
+<table>
+{{range $kind, $n := .Stats.LimitEvents}}<tr><th>{{$kind}}</th><td>{{$n}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+<h2>Busiest rooms, last 5 minutes</h2>
+<table>
+{{range .Stats.TopRooms}}<tr><td>{{.Room}}&hellip;</td><td>{{.Bytes}} bytes</td><td>{{range $i, $app := .Apps}}{{if $i}}, {{end}}{{$app}}{{end}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+{{with .Stats.Handshake}}<h2>Handshake timing</h2>
+<table>
+<tr><th>phase</th><th>count</th><th>p50</th><th>p95</th><th>p99</th></tr>
+{{range .}}<tr><td>{{.Phase}}</td><td>{{.Count}}</td><td>{{.P50}}</td><td>{{.P95}}</td><td>{{.P99}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Limits</h2>
+<table>
+<tr><th>room TTL</th><td>{{.Stats.Limits.RoomTTL}}</td></tr>
+<tr><th>room byte quota</th><td>{{if .Stats.Limits.RoomByteQuota}}{{.Stats.Limits.RoomByteQuota}} bytes, warned at {{.Stats.Limits.QuotaWarning}}{{else}}unlimited{{end}}</td></tr>
+<tr><th>expiry warning</th><td>{{if eq .Stats.Limits.ExpiryWarning "0s"}}off{{else}}{{.Stats.Limits.ExpiryWarning}}{{end}}</td></tr>
+<tr><th>room cleanup</th><td>{{.Stats.Limits.RoomCleanup}}</td></tr>
+<tr><th>max room request</th><td>{{.Stats.Limits.MaxRoomRequest}} bytes</td></tr>
+<tr><th>strict room names</th><td>{{.Stats.Limits.StrictRoomNames}}</td></tr>
+<tr><th>replay buffer</th><td>{{if .Stats.Limits.ReplayMaxFrames}}{{.Stats.Limits.ReplayMaxFrames}} frames, {{.Stats.Limits.ReplayMaxBytes}} bytes{{else}}off{{end}}</td></tr>
+<tr><th>superseded grace</th><td>{{.Stats.Limits.SupersededGrace}}</td></tr>
+<tr><th>connection idle timeout</th><td>{{if eq .Stats.Limits.ConnIdleTimeout "0s"}}off{{else}}{{.Stats.Limits.ConnIdleTimeout}}{{end}}</td></tr>
+<tr><th>max rooms per IP</th><td>{{if .Stats.Limits.MaxRoomsPerIP}}{{.Stats.Limits.MaxRoomsPerIP}}{{else}}unlimited{{end}}</td></tr>
+<tr><th>sniff timeout</th><td>{{if eq .Stats.Limits.SniffTimeout "0s"}}off{{else}}{{.Stats.Limits.SniffTimeout}}{{end}}</td></tr>
+<tr><th>handshake timeout</th><td>{{if eq .Stats.Limits.HandshakeTimeout "0s"}}off{{else}}{{.Stats.Limits.HandshakeTimeout}}{{end}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// handleStatusPage renders the status page from a single Stats snapshot.
+func (s *server) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.statusUser)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.statusPassword)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="croc relay"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Refresh int
+		Stats   Stats
+	}{int(statusRefresh.Seconds()), s.Stats()}
+	if err := statusTemplate.Execute(w, data); err != nil {
+		s.logger.Debugf("could not write status page: %v", err)
+	}
+}
+
+// serveStatusPage starts the status page if one was configured. The
+// returned server is nil otherwise. Like serveStats, it binds the address
+// before it returns.
+func (s *server) serveStatusPage() (*http.Server, error) {
+	if s.statusAddress == "" {
+		return nil, nil
+	}
+	srv := &http.Server{Addr: s.statusAddress, Handler: http.HandlerFunc(s.handleStatusPage), ReadHeaderTimeout: 10 * time.Second}
+	l, err := net.Listen("tcp", s.statusAddress)
+	if err != nil {
+		return nil, fmt.Errorf("status page: %w", err)
+	}
+	go func() {
+		s.logger.Infof("serving status page on http://%s/", s.statusAddress)
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("status page: %v", err)
+		}
+	}()
+	return srv, nil
+}
@@ -2,17 +2,28 @@ package tcp
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/schollz/logger"
 	"github.com/schollz/pake/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
 	"github.com/schollz/croc/v10/src/comm"
 	"github.com/schollz/croc/v10/src/crypt"
+	"github.com/schollz/croc/v10/src/internal/clock"
 	"github.com/schollz/croc/v10/src/models"
 )
 
@@ -20,12 +31,105 @@ type server struct {
 	host       string
 	port       string
 	debugLevel string
-	banner     string
-	password   string
 	rooms      roomMap
 
-	roomCleanupInterval time.Duration
-	roomTTL             time.Duration
+	// settingsMu guards settings, which Reload swaps while the relay
+	// runs; each handshake uses the settings as they were when it began.
+	settingsMu sync.RWMutex
+	settings   settings
+
+	// clock drives room expiry and every other timer of the server.
+	clock clock.Clock
+
+	// logger is the relay's own logger, kept separate from the package
+	// level one so embedders can route relay logs elsewhere.
+	logger *log.Logger
+	connID atomic.Uint64
+	// logSampling is how many debug and trace lines of each kind sampler
+	// lets through a second; zero lets every line through.
+	logSampling int
+	sampler     *logSampler
+
+	roomCleanupInterval   time.Duration
+	roomTTL               time.Duration
+	supersededGracePeriod time.Duration
+
+	// connIdleTimeout drops single connections that have sent nothing for
+	// that long; zero leaves them to the room TTL. keepalivesAreActivity
+	// makes keepalive frames count as having sent something.
+	connIdleTimeout       time.Duration
+	keepalivesAreActivity bool
+
+	// roomByteQuota is how many bytes a room may relay before it is
+	// deleted; zero is no quota. Rooms that pass quotaWarning of it, or
+	// get within expiryWarning of their TTL, are warned first, and
+	// limitEvents counts both.
+	roomByteQuota int64
+	quotaWarning  float64
+	expiryWarning time.Duration
+	limitEvents   limitEvents
+	// unmetRooms counts the rooms that reached their TTL without a
+	// second connection ever joining.
+	unmetRooms atomic.Int64
+
+	// tokens are the room tokens handed out to clients.
+	tokens roomTokens
+
+	// controlMethods are the methods control channels answer, and
+	// controlLimits counts their calls.
+	controlMethods map[string]controlMethod
+	controlLimits  controlLimits
+
+	// cluster is the cluster the relay is an instance of, if any.
+	cluster *cluster
+
+	replayMaxFrames  int
+	replayMaxBytes   int
+	bufferEncryption bool
+
+	strictRoomNames bool
+
+	// sniffTimeout is how long a new connection has to send a first frame
+	// that looks like croc; zero accepts any first frame.
+	sniffTimeout time.Duration
+	// handshakeTimeout is how long a connection has to get through the
+	// handshake and ask for a room; zero leaves it to the read deadlines.
+	handshakeTimeout time.Duration
+
+	// listener is used instead of binding host and port when set, for
+	// sockets bound by someone else such as systemd.
+	listener net.Listener
+	// bindExactly binds loopback hosts as they are rather than widening
+	// them to every address.
+	bindExactly bool
+	// setuid is the user the relay switches to once it holds its sockets.
+	setuid string
+	// upgrader hands the listener and rooms over to a new process when
+	// set; draining is set once it has, so closing the listener drains the
+	// rooms rather than dropping them.
+	upgrader *Upgrader
+	draining atomic.Bool
+	// reloader changes the settings while the relay runs, when set.
+	reloader *Reloader
+
+	// statsAddress serves /stats over HTTP when set.
+	statsAddress string
+	// statusAddress serves the HTML status page, behind basic auth with
+	// statusUser and statusPassword, when set.
+	statusAddress  string
+	statusUser     string
+	statusPassword string
+
+	// tracer gets a span per connection; it records nothing unless the
+	// relay was started WithTracerProvider.
+	tracer trace.Tracer
+
+	// version, started and errors are reported in Stats, along with
+	// handshakes when stats or a status page are served.
+	version    string
+	started    time.Time
+	errors     errorCounts
+	handshakes *handshakeTimings
 
 	stopRoomCleanup chan struct{}
 }
@@ -33,36 +137,158 @@ type server struct {
 type roomInfo struct {
 	conns  []*comm.Comm
 	opened time.Time
+	policy RoomPolicy
+	// hosts are the remote hosts of the connections. instances and
+	// superseded track join order per client instance for rooms with
+	// RoomPolicyLatestOnly.
+	hosts      map[*comm.Comm]string
+	instances  map[*comm.Comm]string
+	superseded map[*comm.Comm]bool
+	// replay buffers frames nobody was there to receive; nil unless the
+	// relay was started WithReplayBuffer.
+	replay *replayBuffer
+	// mode, joined and traffic feed Stats.
+	mode    RoomMode
+	joined  map[*comm.Comm]time.Time
+	traffic *trafficWindow
+	// lastReceive is when each connection last sent a frame. Connections
+	// that half-closed are not in it: they are waiting for replies and
+	// have nothing more to send.
+	lastReceive map[*comm.Comm]time.Time
+	// spans are the connection spans, which get an event when the room
+	// expires.
+	spans map[*comm.Comm]trace.Span
+	// apps are the applications the connections declared, for Stats.
+	apps map[*comm.Comm]string
+	// denyObservers refuses connections that join as observers.
+	denyObservers bool
+	// controlKeys are the handshake keys of the connections that declared
+	// CapabilityControlFrames; the others get the legacy ready byte.
+	controlKeys map[*comm.Comm][]byte
+	// routeTags are the session tags of the connections that declared
+	// CapabilityRouting.
+	routeTags map[*comm.Comm]string
+	// warningKeys are the handshake keys of the connections that declared
+	// CapabilityLimitWarnings, and usage what the room used of its limits.
+	warningKeys map[*comm.Comm][]byte
+	usage       *roomUsage
+	// generation tells this room from others of the same name before or
+	// after it, and ctx is cancelled when it is deleted; see open.
+	generation uint64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// met is set once two connections were in the room at the same time,
+	// superseded ones aside.
+	met bool
 }
 
 type roomMap struct {
 	rooms map[string]roomInfo
+	// members counts the room memberships of each remote host.
+	members map[string]int
+	// generation is the generation of the room created last.
+	generation uint64
 	sync.Mutex
 }
 
+// open gives r, a room being created, the next generation and a context
+// of its own. A room deleted and created again under the same name is a
+// new generation, so a connection reading for the one deleted cannot
+// send into the other. The caller holds the lock.
+func (m *roomMap) open(r *roomInfo) {
+	m.generation++
+	r.generation = m.generation
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+}
+
+// close cancels the context of r, a room being deleted, which its
+// connections read under. The caller holds the lock.
+func (r roomInfo) close() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
 const pingRoom = "pinglkasjdlfjsaldjf"
 
+// keepaliveFrame is the single byte croc clients skip when reading, which
+// makes it the frame peers send to keep an otherwise quiet connection up.
+var keepaliveFrame = []byte{1}
+
+// idleTimeoutFrame is the last frame a connection gets before the relay
+// drops it for being idle. It is plaintext, like the handshake failure
+// frame, since the relay has no key shared with the peers.
+var idleTimeoutFrame = []byte("croc-relay: idle timeout")
+
+// idleFrameWriteTimeout bounds sending idleTimeoutFrame, which a dead peer
+// may never read.
+const idleFrameWriteTimeout = 5 * time.Second
+
+// IsIdleTimeout reports whether a frame received from the relay says the
+// connection is being dropped for being idle. Clients should reconnect
+// when they see it rather than wait for a peer that will not answer.
+func IsIdleTimeout(b []byte) bool {
+	return bytes.Equal(b, idleTimeoutFrame)
+}
+
+// handshakeFailurePrefix starts the plaintext frame the relay sends when it
+// cannot make sense of a client's handshake. No key exists at that point, so
+// the frame is unencrypted and deliberately says nothing about the cause.
+var handshakeFailurePrefix = []byte("croc-relay: handshake failed: ")
+
+const handshakeFailureReason = "unsupported client"
+
+// HandshakeError is returned by ConnectToTCPServer when the relay refused
+// the handshake, typically because the client speaks an incompatible
+// protocol version.
+type HandshakeError struct {
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("relay rejected handshake: %s (client and relay versions may be incompatible)", e.Reason)
+}
+
+// parseHandshakeFailure returns a *HandshakeError if b is the relay's
+// handshake failure frame.
+func parseHandshakeFailure(b []byte) error {
+	if !bytes.HasPrefix(b, handshakeFailurePrefix) {
+		return nil
+	}
+	reason := strings.TrimSpace(string(b[len(handshakeFailurePrefix):]))
+	if len(reason) > 64 {
+		reason = reason[:64]
+	}
+	return &HandshakeError{Reason: reason}
+}
+
 // newDefaultServer initializes a new server, with some default configuration options
 func newDefaultServer() *server {
 	s := new(server)
 	s.roomCleanupInterval = DEFAULT_ROOM_CLEANUP_INTERVAL
 	s.roomTTL = DEFAULT_ROOM_TTL
+	s.quotaWarning = DEFAULT_QUOTA_WARNING
+	s.expiryWarning = DEFAULT_EXPIRY_WARNING
+	s.supersededGracePeriod = DEFAULT_SUPERSEDED_GRACE_PERIOD
+	s.bufferEncryption = true
+	s.strictRoomNames = true
+	s.sniffTimeout = DEFAULT_SNIFF_TIMEOUT
+	s.handshakeTimeout = DEFAULT_HANDSHAKE_TIMEOUT
 	s.debugLevel = DEFAULT_LOG_LEVEL
+	s.logSampling = DEFAULT_LOG_SAMPLING
 	s.stopRoomCleanup = make(chan struct{})
+	s.logger = log.New()
+	s.clock = clock.Real
+	s.tracer = noop.NewTracerProvider().Tracer(tracerName)
+	s.controlMethods = controlMethods
 	return s
 }
 
 // RunWithOptionsAsync asynchronously starts a TCP listener.
 func RunWithOptionsAsync(host, port, password string, opts ...serverOptsFunc) error {
-	s := newDefaultServer()
-	s.host = host
-	s.port = port
-	s.password = password
-	for _, opt := range opts {
-		err := opt(s)
-		if err != nil {
-			return fmt.Errorf("could not apply optional configurations: %w", err)
-		}
+	s, err := configure(host, port, password, opts)
+	if err != nil {
+		return err
 	}
 	return s.start()
 }
@@ -74,153 +300,356 @@ func Run(debugLevel, host, port, password string, banner ...string) (err error)
 
 func (s *server) start() (err error) {
 	log.SetLevel(s.debugLevel)
+	s.logger.SetLevel(s.debugLevel)
+	s.sampler = newLogSampler(s.logSampling, s.clock)
 
-	// Mask our password in logs
-	maskedPassword := ""
-	if len(s.password) > 2 {
-		maskedPassword = fmt.Sprintf("%c***%c", s.password[0], s.password[len(s.password)-1])
-	} else {
-		maskedPassword = s.password
+	// check everything before listening so a bad setting fails now rather
+	// than when a client happens to need it
+	if err = s.validate(); err != nil {
+		err = fmt.Errorf("invalid relay configuration: %w", err)
+		s.logger.Errorf("%v", err)
+		return
 	}
-
-	log.Debugf("starting with password '%s'", maskedPassword)
+	s.logger.Infof("configuration:\n%s", s.dumpConfig())
 
 	s.rooms.Lock()
 	s.rooms.rooms = make(map[string]roomInfo)
 	s.rooms.Unlock()
+	s.started = s.clock.Now()
+	if s.statsAddress != "" || s.statusAddress != "" {
+		s.handshakes = newHandshakeTimings(s.clock)
+	}
 
 	go s.deleteOldRooms()
 	defer s.stopRoomDeletion()
 
+	for _, serve := range []func() (*http.Server, error){s.serveStats, s.serveStatusPage} {
+		srv, errServe := serve()
+		if errServe != nil {
+			err = errServe
+			s.logger.Errorf("%v", err)
+			return
+		}
+		if srv != nil {
+			defer srv.Close()
+		}
+	}
+
 	err = s.run()
 	if err != nil {
-		log.Error(err)
+		s.logger.Errorf("%v", err)
 	}
 	return
 }
 
-func (s *server) run() (err error) {
-	network := "tcp"
-	addr := net.JoinHostPort(s.host, s.port)
-	if s.host != "" {
-		ip := net.ParseIP(s.host)
-		if ip == nil {
-			var tcpIP *net.IPAddr
-			tcpIP, err = net.ResolveIPAddr("ip", s.host)
-			if err != nil {
-				return err
-			}
-			ip = tcpIP.IP
-		}
-		addr = net.JoinHostPort(ip.String(), s.port)
-		if s.host != "" {
-			if ip.To4() != nil {
-				network = "tcp4"
-			} else {
-				network = "tcp6"
-			}
+// listenAddress resolves the host and returns where a relay on host and
+// port listens. An empty host is every address. Unless exact is set, the
+// loopback addresses 127.0.0.1 and ::1 are widened to every address of
+// their family, as croc relays always did; widened reports whether that
+// happened. IPv4-mapped addresses listen on IPv4, and link-local IPv6
+// addresses keep their zone.
+func listenAddress(host, port string, exact bool) (network, addr string, widened bool, err error) {
+	if host == "" {
+		return "tcp", net.JoinHostPort("", port), false, nil
+	}
+	ip, err := resolveHost(host)
+	if err != nil {
+		return
+	}
+	if !exact {
+		switch ip {
+		case netip.AddrFrom4([4]byte{127, 0, 0, 1}):
+			ip, widened = netip.IPv4Unspecified(), true
+		case netip.IPv6Loopback():
+			ip, widened = netip.IPv6Unspecified(), true
 		}
 	}
-	addr = strings.Replace(addr, "127.0.0.1", "0.0.0.0", 1)
-	log.Info("starting TCP server on " + addr)
-	server, err := net.Listen(network, addr)
+	network = "tcp6"
+	if ip.Is4() {
+		network = "tcp4"
+	}
+	return network, net.JoinHostPort(ip.String(), port), widened, nil
+}
+
+// resolveHost returns the address host names: an IP literal, bracketed
+// or not and with or without a zone, or else the first address a lookup
+// finds, IPv4 first.
+func resolveHost(host string) (netip.Addr, error) {
+	literal := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip, err := netip.ParseAddr(literal); err == nil {
+		return ip.Unmap(), nil
+	}
+	resolved, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	ip, ok := netip.AddrFromSlice(resolved.IP)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("could not resolve %s: bad address %v", host, resolved.IP)
+	}
+	ip = ip.Unmap()
+	if resolved.Zone != "" && ip.Is6() {
+		ip = ip.WithZone(resolved.Zone)
+	}
+	return ip, nil
+}
+
+// Listen binds the address a relay started with host and port listens on.
+// Callers that bind relay sockets themselves, for example to bind every
+// port before dropping privileges, pass the result to WithListener. Like
+// the relay, it widens 127.0.0.1 and ::1 to every address; ListenExactly
+// does not.
+func Listen(host, port string) (net.Listener, error) {
+	return listen(host, port, false)
+}
+
+// ListenExactly is like Listen but binds only the address host names, as
+// a relay started WithBindExactly(true) does.
+func ListenExactly(host, port string) (net.Listener, error) {
+	return listen(host, port, true)
+}
+
+func listen(host, port string, exact bool) (net.Listener, error) {
+	network, addr, widened, err := listenAddress(host, port, exact)
+	if err != nil {
+		return nil, err
+	}
+	if widened {
+		log.Infof("listening on %s for host %s; bind exactly to listen on loopback only", addr, host)
+	}
+	l, err := net.Listen(network, addr)
 	if err != nil {
-		return fmt.Errorf("error listening on %s: %w", addr, err)
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+	return l, nil
+}
+
+// run serves clients until the listener fails or is closed. Closing the
+// listener, whoever bound it, is how a relay is shut down: run then drops
+// every room and returns nil. After a handoff it drains the rooms instead.
+func (s *server) run() (err error) {
+	server := s.listener
+	if server == nil {
+		if server, err = listen(s.host, s.port, s.bindExactly); err != nil {
+			return err
+		}
 	}
 	defer server.Close()
-	// spawn a new goroutine whenever a client connects
+	s.logger.Infof("starting TCP server on %s", server.Addr())
+	if s.upgrader != nil {
+		s.upgrader.register(s, server)
+	}
+	if s.reloader != nil {
+		s.reloader.register(s)
+	}
+	if s.setuid != "" {
+		// fail closed: a relay that meant to drop root must not serve as root
+		if err = dropPrivileges(s.setuid); err != nil {
+			return fmt.Errorf("could not switch to user %s: %w", s.setuid, err)
+		}
+		s.logger.Infof("running as user %s", s.setuid)
+	}
+	// spawn a new goroutine whenever a client connects; it runs the
+	// handshake and then reads from the connection for as long as it is
+	// in its room, so each live connection has exactly one
 	for {
 		connection, err := server.Accept()
+		if errors.Is(err, net.ErrClosed) && s.draining.Load() {
+			s.logger.Infof("handed over %s to a new relay, draining", server.Addr())
+			s.drain()
+			return nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			s.logger.Infof("listener on %s closed, shutting down", server.Addr())
+			s.deleteAllRooms()
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("problem accepting connection: %w", err)
 		}
-		log.Debugf("client %s connected", connection.RemoteAddr().String())
+		accepted := s.clock.Now()
+		clog := newConnLogger(s.logger, s.sampler, s.connID.Add(1), connection.RemoteAddr().String())
+		clog.Debugf("client connected")
 		go func(port string, connection net.Conn) {
+			// the span ends here unless the connection makes it into a
+			// room, where handleRoomConnection ends it
+			ctx, span := s.startSpan(context.Background(), spanConnection, attrRemoteAddress.String(connection.RemoteAddr().String()))
+			if s.sniffTimeout > 0 {
+				sniffed, errSniff := sniff(connection, s.sniffTimeout)
+				if errSniff != nil {
+					clog.Debugf("closing: %v", errSniff)
+					s.errors.add(s.clock.Now(), errorProtocolJunk)
+					connection.Close()
+					endSpan(span, errSniff)
+					return
+				}
+				connection = sniffed
+			}
 			c := comm.New(connection)
-			room, errCommunication := s.clientCommunication(port, c)
-			log.Debugf("room: %+v", room)
-			log.Debugf("err: %+v", errCommunication)
+			room, roomLog, errCommunication := s.clientCommunication(ctx, port, c, clog, accepted)
 			if errCommunication != nil {
-				log.Debugf("relay-%s: %s", connection.RemoteAddr().String(), errCommunication.Error())
+				clog.Debugf("handshake failed: %s", errCommunication.Error())
+				if errors.Is(errCommunication, errHandshakeTimeout) {
+					s.errors.add(s.clock.Now(), errorHandshakeTimeout)
+				} else {
+					s.errors.add(s.clock.Now(), errorHandshake)
+				}
 				connection.Close()
+				endSpan(span, errCommunication)
 				return
 			}
-			if room == pingRoom {
-				log.Debugf("got ping")
+			if room == pingRoom || room == tokenRoom || room == controlRoom || room == clusterRoom {
+				if room == pingRoom {
+					clog.Debugf("got ping")
+				}
 				connection.Close()
+				span.End()
 				return
 			}
-			for {
-				// check connection
-				log.Debugf("checking connection of room %s for %+v", room, c)
-				deleteIt := false
-				s.rooms.Lock()
-				if _, ok := s.rooms.rooms[room]; !ok {
-					log.Debug("room is gone")
-					s.rooms.Unlock()
-					return
-				}
-				log.Debugf("room: %+v", s.rooms.rooms[room])
-				if s.rooms.rooms[room].conns != nil {
-					log.Debug("rooms ready")
-					s.rooms.Unlock()
-					break
-				} else {
-					if s.rooms.rooms[room].conns != nil {
-						errSend := s.rooms.rooms[room].conns[0].Send([]byte{1})
-						if errSend != nil {
-							log.Debug(errSend)
-							deleteIt = true
-						}
-					}
-				}
-				s.rooms.Unlock()
-				if deleteIt {
-					s.deleteRoom(room)
-					break
-				}
-				time.Sleep(1 * time.Second)
+			if room == "" {
+				// turned away with a bad password, which the client was told
+				span.End()
+				return
 			}
+			s.handleRoomConnection(ctx, room, c, roomLog)
 		}(s.port, connection)
 	}
 }
 
 // deleteOldRooms checks for rooms at a regular interval and removes those that
-// have exceeded their allocated TTL.
+// have exceeded their allocated TTL. With a connection idle timeout set, it
+// also drops idle connections every half of that timeout. With an expiry
+// warning set, it warns rooms nearing their TTL every expiryCheckInterval,
+// or every expiry warning if that is shorter.
 func (s *server) deleteOldRooms() {
-	ticker := time.NewTicker(s.roomCleanupInterval)
+	ticker := s.clock.NewTicker(s.roomCleanupInterval)
+	var idle <-chan time.Time
+	if s.connIdleTimeout > 0 {
+		idleTicker := s.clock.NewTicker(s.connIdleTimeout / 2)
+		defer idleTicker.Stop()
+		idle = idleTicker.C()
+	}
+	var expiring <-chan time.Time
+	if s.expiryWarning > 0 {
+		expiryTicker := s.clock.NewTicker(min(expiryCheckInterval, s.expiryWarning))
+		defer expiryTicker.Stop()
+		expiring = expiryTicker.C()
+	}
 	for {
 		select {
-		case <-ticker.C:
+		case <-idle:
+			s.kickIdleConns()
+		case <-expiring:
+			s.warnExpiringRooms()
+		case <-ticker.C():
 			var roomsToDelete []string
+			var deliveries []controlDelivery
+			now := s.clock.Now()
 			s.rooms.Lock()
-			for room := range s.rooms.rooms {
-				if time.Since(s.rooms.rooms[room].opened) > s.roomTTL {
+			for room, r := range s.rooms.rooms {
+				if now.Sub(r.opened) > s.roomTTL {
 					roomsToDelete = append(roomsToDelete, room)
+					s.limitEvents.add(limitRoomExpired)
+					for _, span := range r.spans {
+						span.AddEvent(eventRoomExpired, trace.WithAttributes(attrRoom.String(roomLogName(room))))
+					}
+					if !r.met && len(r.present()) == 1 {
+						deliveries = append(deliveries, s.expiredUnmet(room, r, now)...)
+					}
 				}
 			}
 			s.rooms.Unlock()
+			// the hint goes out before the room is deleted
+			sendWarnings(deliveries)
+			s.tokens.sweep(s.clock.Now())
+			s.controlLimits.sweep(s.clock.Now())
 
 			for _, room := range roomsToDelete {
 				s.deleteRoom(room)
-				log.Debugf("room cleaned up: %s", room)
+				s.debugf("[room=%s] room cleaned up", roomLogName(room))
 			}
 		case <-s.stopRoomCleanup:
 			ticker.Stop()
-			log.Debug("room cleanup stopped")
+			s.debugf("room cleanup stopped")
 			return
 		}
 	}
 }
 
+// kickIdleConns drops connections that have sent nothing for longer than
+// the idle timeout, so one dead connection cannot hold a room open for a
+// live one. Idle time counts from the later of the last frame and the last
+// join, as a connection that waited alone has had nobody to talk to; for
+// the same reason rooms with a single connection are left to the room TTL.
+// Each dropped connection gets the idle timeout frame first.
+func (s *server) kickIdleConns() {
+	now := s.clock.Now()
+	// the idle connections are told and closed once the lock is released,
+	// so one that does not read holds up no room
+	var idle []*comm.Comm
+	defer func() {
+		for _, conn := range idle {
+			_ = conn.Connection().SetWriteDeadline(time.Now().Add(idleFrameWriteTimeout))
+			_ = conn.Send(idleTimeoutFrame)
+			conn.Close()
+		}
+	}()
+	s.rooms.Lock()
+	defer s.rooms.Unlock()
+	for room, r := range s.rooms.rooms {
+		if len(r.conns) < 2 {
+			continue
+		}
+		var lastJoin time.Time
+		for _, joined := range r.joined {
+			if joined.After(lastJoin) {
+				lastJoin = joined
+			}
+		}
+		for conn, last := range r.lastReceive {
+			if lastJoin.After(last) {
+				last = lastJoin
+			}
+			if now.Sub(last) <= s.connIdleTimeout {
+				continue
+			}
+			s.debugf("[room=%s] dropping connection idle for %s", roomLogName(room), now.Sub(last).Round(time.Second))
+			idle = append(idle, conn)
+			delete(r.lastReceive, conn)
+		}
+	}
+}
+
 func (s *server) stopRoomDeletion() {
-	log.Debug("stop room cleanup fired")
+	s.debugf("stop room cleanup fired")
 	s.stopRoomCleanup <- struct{}{}
 }
 
 var weakKey = []byte{1, 2, 3}
 
-func (s *server) clientCommunication(port string, c *comm.Comm) (room string, err error) {
+// relayCapabilities are announced to clients at the end of the handshake.
+var relayCapabilities = []string{comm.CapabilityEOF, CapabilityControlFrames, CapabilityRoomTokens, CapabilityRouting, CapabilityRoomFields, CapabilityControlRPC, CapabilityClusterRedirect, CapabilityLimitWarnings}
+
+// clientCommunication runs the handshake of a new connection and adds it to
+// the room it asks for, returning the room and the logger of the
+// connection in it. The handshake phases are traced as children of the
+// connection span in ctx, which handleRoomConnection ends once the
+// connection is in a room, and timed from accepted, when the connection
+// was accepted, into the handshake histograms. A connection that has not
+// asked for a room within the handshake timeout is closed, and
+// errHandshakeTimeout returned.
+func (s *server) clientCommunication(ctx context.Context, port string, c *comm.Comm, clog *connLogger, accepted time.Time) (room string, roomLog *connLogger, err error) {
+	settings := s.current()
+	deadline := newHandshakeDeadline(c, s.handshakeTimeout)
+	defer func() {
+		if !deadline.stop() {
+			room, roomLog, err = "", nil, fmt.Errorf("%w after %s", errHandshakeTimeout, s.handshakeTimeout)
+		}
+	}()
+	// phase is the span of the handshake phase in progress
+	_, phase := s.startSpan(ctx, spanPAKE)
+	defer func() { endSpan(phase, err) }()
+
 	// establish secure password with PAKE for communication with relay
 	B, err := pake.InitCurve(weakKey, 1, "siec")
 	if err != nil {
@@ -230,15 +659,21 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 	if err != nil {
 		return
 	}
-	log.Debugf("Abytes: %s", Abytes)
+	started := s.handshakes.record(phaseFirstFrame, accepted)
+	clog.Tracef("Abytes: %s", Abytes)
 	if bytes.Equal(Abytes, []byte("ping")) {
 		room = pingRoom
-		log.Debug("sending back pong")
+		clog.Debugf("sending back pong")
 		c.Send([]byte("pong"))
 		return
 	}
 	err = B.Update(Abytes)
 	if err != nil {
+		// the first frame is not something we can use as PAKE bytes, so let
+		// the client know rather than leaving it waiting
+		if errSend := c.Send(append(append([]byte{}, handshakeFailurePrefix...), handshakeFailureReason...)); errSend != nil {
+			clog.Debugf("could not send handshake failure: %v", errSend)
+		}
 		return
 	}
 	err = c.Send(B.Bytes())
@@ -249,7 +684,10 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 	if err != nil {
 		return
 	}
-	log.Debugf("strongkey: %x", strongKey)
+	clog.Tracef("strongkey: %x", strongKey)
+	started = s.handshakes.record(phasePAKE, started)
+	phase.End()
+	_, phase = s.startSpan(ctx, spanAuth)
 
 	// receive salt
 	salt, err := c.Receive()
@@ -261,7 +699,7 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 		return
 	}
 
-	log.Debugf("waiting for password")
+	clog.Debugf("waiting for password")
 	passwordBytesEnc, err := c.Receive()
 	if err != nil {
 		return
@@ -270,22 +708,26 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 	if err != nil {
 		return
 	}
-	if strings.TrimSpace(string(passwordBytes)) != s.password {
+	if strings.TrimSpace(string(passwordBytes)) != settings.password {
 		err = fmt.Errorf("bad password")
+		s.errors.add(s.clock.Now(), errorBadPassword)
+		phase.RecordError(err)
+		phase.SetStatus(codes.Error, err.Error())
 		enc, _ := crypt.Encrypt([]byte(err.Error()), strongKeyForEncryption)
 		if err = c.Send(enc); err != nil {
-			return "", fmt.Errorf("send error: %w", err)
+			return "", nil, fmt.Errorf("send error: %w", err)
 		}
 		return
 	}
 
 	// send ok to tell client they are connected
-	banner := s.banner
+	banner := settings.banner
 	if len(banner) == 0 {
 		banner = "ok"
 	}
-	log.Debugf("sending '%s'", banner)
-	bSend, err := crypt.Encrypt([]byte(banner+"|||"+c.Connection().RemoteAddr().String()), strongKeyForEncryption)
+	clog.Debugf("sending '%s'", banner)
+	// capabilities go after the address, where older clients do not look
+	bSend, err := crypt.Encrypt([]byte(banner+"|||"+c.Connection().RemoteAddr().String()+"|||"+strings.Join(relayCapabilities, ",")), strongKeyForEncryption)
 	if err != nil {
 		return
 	}
@@ -293,9 +735,13 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 	if err != nil {
 		return
 	}
+	started = s.handshakes.record(phaseAuth, started)
+
+	phase.End()
+	_, phase = s.startSpan(ctx, spanRoomJoin)
 
 	// wait for client to tell me which room they want
-	log.Debug("waiting for answer")
+	clog.Debugf("waiting for answer")
 	enc, err := c.Receive()
 	if err != nil {
 		return
@@ -304,46 +750,254 @@ func (s *server) clientCommunication(port string, c *comm.Comm) (room string, er
 	if err != nil {
 		return
 	}
-	room = string(roomBytes)
+	// the client is through; control calls, proxying to the owner of the
+	// room and replaying it take as long as they take
+	if !deadline.stop() {
+		return
+	}
+	if string(roomBytes) == controlRoom {
+		return controlRoom, nil, s.serveControl(c, strongKeyForEncryption, clog)
+	}
+	if reply, ok := s.handleTokenRequest(string(roomBytes), remoteHost(c), clog); ok {
+		bSend, err = crypt.Encrypt([]byte(reply), strongKeyForEncryption)
+		if err != nil {
+			return
+		}
+		return tokenRoom, nil, c.Send(bSend)
+	}
+	if err = checkRoomRequest(string(roomBytes), s.strictRoomNames); err != nil {
+		clog.Infof("rejecting room: %v", err)
+		s.errors.add(s.clock.Now(), errorInvalidRoom)
+		if enc, errEnc := crypt.Encrypt([]byte(invalidRoomResponse), strongKeyForEncryption); errEnc == nil {
+			c.Send(enc)
+		}
+		return
+	}
+	req := parseRoomRequest(string(roomBytes))
+	room = req.Room
+	// EOF frames only go to clients that said they understand them
+	if slices.Contains(req.Capabilities, comm.CapabilityEOF) {
+		c.EnableEOF()
+	}
+	clog = clog.withRoom(room).withApp(req.App)
+	span := trace.SpanFromContext(ctx)
+	roomAttrs := []attribute.KeyValue{attrRoom.String(roomLogName(room)), attrRoomMode.String(string(req.Mode))}
+	if req.App != "" {
+		roomAttrs = append(roomAttrs, attrClientApp.String(req.App))
+	}
+	phase.SetAttributes(roomAttrs...)
+	span.SetAttributes(roomAttrs...)
+	if settings.blockedClients.match(req.App) {
+		clog.Infof("rejecting client: upgrade required")
+		s.errors.add(s.clock.Now(), errorBlockedClient)
+		if enc, errEnc := crypt.Encrypt([]byte(upgradeRequiredResponse), strongKeyForEncryption); errEnc == nil {
+			c.Send(enc)
+		}
+		return "", nil, ErrUpgradeRequired
+	}
+
+	// rooms another instance of the cluster owns are joined there, unless
+	// an instance proxies the client here already; a forwarded request is
+	// never sent on, so instances that disagree about the owner cannot
+	// pass it round
+	host := remoteHost(c)
+	if s.cluster != nil {
+		if req.forwardedFor != "" {
+			if s.cluster.isPeer(host) {
+				host = req.forwardedFor
+			}
+		} else if routed, errRoute := s.routeToOwner(c, strongKeyForEncryption, req, settings, clog); routed {
+			return clusterRoom, nil, errRoute
+		}
+	}
+
+	// clients that route frames learn their session tag with the "ok"
+	joined := "ok"
+	var tag string
+	if slices.Contains(req.Capabilities, CapabilityRouting) {
+		if tag, err = newSessionTag(); err != nil {
+			return
+		}
+		joined += joinTagSeparator + tag
+	}
 
 	s.rooms.Lock()
+	if !s.rooms.join(host, settings.maxRoomsPerIP) {
+		s.rooms.Unlock()
+		clog.Infof("rejecting room: %s is in %d rooms already", host, settings.maxRoomsPerIP)
+		s.errors.add(s.clock.Now(), errorRoomsPerIP)
+		if enc, errEnc := crypt.Encrypt([]byte(tooManyRoomsResponse), strongKeyForEncryption); errEnc == nil {
+			c.Send(enc)
+		}
+		return "", nil, ErrTooManyRooms
+	}
 	if r, ok := s.rooms.rooms[room]; !ok {
 		// Create a new room with this connection.
-		s.rooms.rooms[room] = roomInfo{
-			conns:  []*comm.Comm{c},
-			opened: time.Now(),
+		r = roomInfo{
+			conns:         []*comm.Comm{c},
+			opened:        s.clock.Now(),
+			policy:        req.Policy,
+			mode:          req.Mode,
+			hosts:         make(map[*comm.Comm]string),
+			instances:     make(map[*comm.Comm]string),
+			superseded:    make(map[*comm.Comm]bool),
+			joined:        map[*comm.Comm]time.Time{c: s.clock.Now()},
+			traffic:       new(trafficWindow),
+			lastReceive:   map[*comm.Comm]time.Time{c: s.clock.Now()},
+			spans:         map[*comm.Comm]trace.Span{c: span},
+			apps:          map[*comm.Comm]string{c: req.App},
+			denyObservers: req.DenyObservers,
+			controlKeys:   make(map[*comm.Comm][]byte),
+			routeTags:     make(map[*comm.Comm]string),
+			warningKeys:   make(map[*comm.Comm][]byte),
+			usage:         new(roomUsage),
+		}
+		if slices.Contains(req.Capabilities, CapabilityControlFrames) {
+			r.controlKeys[c] = strongKeyForEncryption
+		}
+		if slices.Contains(req.Capabilities, CapabilityLimitWarnings) {
+			r.warningKeys[c] = strongKeyForEncryption
+		}
+		if tag != "" {
+			r.routeTags[c] = tag
+		}
+		if s.replayMaxFrames > 0 {
+			if r.replay, err = newReplayBuffer(s.replayMaxFrames, s.replayMaxBytes, s.bufferEncryption); err != nil {
+				s.rooms.leave(host)
+				s.rooms.Unlock()
+				return
+			}
 		}
+		r.supersede(c, host, req.Instance)
+		s.rooms.open(&r)
+		s.rooms.rooms[room] = r
 		s.rooms.Unlock()
-		bSend, err1 := crypt.Encrypt([]byte("ok"), strongKeyForEncryption)
+		bSend, err1 := crypt.Encrypt([]byte(joined), strongKeyForEncryption)
 		if err1 != nil {
 			err = fmt.Errorf("encryption error: %w", err1)
-			return
+		} else {
+			err = c.Send(bSend)
 		}
-		if err = c.Send(bSend); err != nil {
+		if err != nil {
+			s.deleteConnFromRoom(room, c)
 			return
 		}
-		log.Debugf("room %s created with 1 connection", room)
+		clog.Debugf("room created with 1 connection")
+	} else if req.Observer && r.denyObservers {
+		s.rooms.leave(host)
+		s.rooms.Unlock()
+		clog.Infof("rejecting observer: the room does not allow observers")
+		s.errors.add(s.clock.Now(), errorObserversDenied)
+		if enc, errEnc := crypt.Encrypt([]byte(observersDeniedResponse), strongKeyForEncryption); errEnc == nil {
+			c.Send(enc)
+		}
+		return "", nil, ErrObserversDenied
 	} else {
 		// Append new connection.
 		r.conns = append(r.conns, c)
+		r.joined[c] = s.clock.Now()
+		r.lastReceive[c] = s.clock.Now()
+		r.spans[c] = span
+		r.apps[c] = req.App
+		if slices.Contains(req.Capabilities, CapabilityControlFrames) {
+			r.controlKeys[c] = strongKeyForEncryption
+		}
+		if slices.Contains(req.Capabilities, CapabilityLimitWarnings) {
+			r.warningKeys[c] = strongKeyForEncryption
+		}
+		if tag != "" {
+			r.routeTags[c] = tag
+		}
+		if r.mode == RoomModeUndeclared {
+			r.mode = req.Mode
+		}
+		old := r.supersede(c, host, req.Instance)
+		r.met = r.met || len(r.present()) >= 2
 		s.rooms.rooms[room] = r
+		var warnings []controlDelivery
+		if r.replay != nil {
+			// live frames for c queue behind the buffered ones until
+			// replayTo has sent them
+			stored, errReplay := r.replay.startReplay(c)
+			if errReplay != nil {
+				s.rooms.Unlock()
+				s.deleteConnFromRoom(room, c)
+				return "", nil, errReplay
+			}
+			var exceeded bool
+			if warnings, exceeded = s.chargeRoom(r, stored, clog); exceeded {
+				s.rooms.Unlock()
+				s.deleteRoom(room)
+				return "", nil, errRoomQuotaExceeded
+			}
+		}
 		s.rooms.Unlock()
-		bSend, err1 := crypt.Encrypt([]byte("ok"), strongKeyForEncryption)
+		s.closeSuperseded(old, clog)
+		bSend, err1 := crypt.Encrypt([]byte(joined), strongKeyForEncryption)
 		if err1 != nil {
-
-			return
+			err = fmt.Errorf("encryption error: %w", err1)
+		} else {
+			err = c.Send(bSend)
+		}
+		if err == nil && r.replay != nil {
+			err = s.replayTo(r.replay, c, clog)
 		}
-		if err = c.Send(bSend); err != nil {
+		sendWarnings(warnings)
+		if err != nil {
 			// On error, remove connection.
 			s.deleteConnFromRoom(room, c)
 			return
 		}
-		log.Debugf("added new connection to room %s; total connections: %d", room, len(r.conns))
+		clog.Debugf("added new connection; total connections: %d", len(r.conns))
+		if len(r.conns) == 2 {
+			clog.Debugf("room ready")
+			s.notifyRoomReady(room, c, clog)
+		}
 	}
 
-	// Start handling incoming messages from this connection.
-	go s.handleRoomConnection(room, c)
-	return
+	s.handshakes.record(phaseRoomJoin, started)
+	return room, clog, nil
+}
+
+// notifyRoomReady tells the connections that were waiting in a room that a
+// peer has arrived. Each gets the form it negotiated: the ready byte, as
+// croc transfer clients expect before starting their own handshake, or a
+// control frame for clients that declared CapabilityControlFrames. The
+// frames are sent once the rooms lock is released.
+func (s *server) notifyRoomReady(room string, joined *comm.Comm, clog *connLogger) {
+	var ready []controlDelivery
+	s.rooms.Lock()
+	if r, ok := s.rooms.rooms[room]; ok {
+		for _, conn := range r.conns {
+			if conn == joined {
+				continue
+			}
+			frame, err := r.readyFrame(conn)
+			if err != nil {
+				clog.Debugf("could not notify room: %v", err)
+				continue
+			}
+			ready = append(ready, controlDelivery{conn: conn, frame: frame})
+		}
+	}
+	s.rooms.Unlock()
+	for _, d := range ready {
+		if err := d.conn.Send(d.frame); err != nil {
+			clog.Debugf("could not notify room: %v", err)
+		}
+	}
+}
+
+// closeSuperseded closes connections replaced by a newer one from the same
+// host once the grace period has passed.
+func (s *server) closeSuperseded(old []*comm.Comm, clog *connLogger) {
+	for _, conn := range old {
+		clog.Debugf("superseding connection from %s", conn.Connection().RemoteAddr())
+		go func() {
+			<-s.clock.After(s.supersededGracePeriod)
+			conn.Close()
+		}()
+	}
 }
 
 func (s *server) deleteConnFromRoom(room string, conn *comm.Comm) {
@@ -356,7 +1010,27 @@ func (s *server) deleteConnFromRoom(room string, conn *comm.Comm) {
 				newConns = append(newConns, c)
 			}
 		}
+		if len(newConns) < len(r.conns) {
+			s.rooms.leave(r.hosts[conn])
+		}
+		delete(r.hosts, conn)
+		delete(r.instances, conn)
+		delete(r.superseded, conn)
+		delete(r.joined, conn)
+		delete(r.lastReceive, conn)
+		delete(r.spans, conn)
+		delete(r.apps, conn)
+		delete(r.controlKeys, conn)
+		delete(r.routeTags, conn)
+		delete(r.warningKeys, conn)
+		if r.replay != nil {
+			delete(r.replay.pending, conn)
+		}
 		if len(newConns) == 0 {
+			if r.replay != nil {
+				r.replay.wipe()
+			}
+			r.close()
 			delete(s.rooms.rooms, room)
 		} else {
 			r.conns = newConns
@@ -365,25 +1039,135 @@ func (s *server) deleteConnFromRoom(room string, conn *comm.Comm) {
 	}
 }
 
-// New helper: read messages from a connection and broadcast them.
-func (s *server) handleRoomConnection(room string, sender *comm.Comm) {
+// New helper: read messages from a connection and broadcast them. It ends
+// the connection span in ctx when the connection is done.
+//
+// The connection reads for the generation of the room it joined: once
+// that room is deleted, its context is done and the connection closed,
+// and frames it had already read go nowhere, even if a room of the same
+// name was created since.
+func (s *server) handleRoomConnection(ctx context.Context, room string, sender *comm.Comm, clog *connLogger) {
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+	var broadcast broadcastCounter
+	defer broadcast.flush(span)
+
+	s.rooms.Lock()
+	r, ok := s.rooms.rooms[room]
+	if !ok || !slices.Contains(r.conns, sender) {
+		// deleted between the handshake and here
+		s.rooms.Unlock()
+		clog.Debugf("room was deleted before the connection could read")
+		sender.Close()
+		return
+	}
+	generation := r.generation
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if r.ctx != nil {
+		defer context.AfterFunc(r.ctx, cancel)()
+	}
+	s.rooms.Unlock()
+	// a deleted room closes its connections itself; this covers one
+	// deleted as the connection was set up
+	defer context.AfterFunc(ctx, func() { sender.Close() })()
+	// current returns the room of the connection while it is the same
+	// generation. The caller holds the lock.
+	current := func() (roomInfo, bool) {
+		r, ok := s.rooms.rooms[room]
+		return r, ok && r.generation == generation
+	}
+
+	// targets are the connections a frame goes to. They are written to
+	// after the rooms lock is released, so a peer that is slow to read
+	// holds up the sender in its own room rather than every room.
+	var targets []*comm.Comm
 	for {
 		data, err := sender.Receive()
+		if ctx.Err() != nil {
+			clog.Debugf("room deleted, done reading")
+			return
+		}
+		if errors.Is(err, comm.ErrPeerDone) {
+			// pass the EOF on and stop reading; the sender has half-closed
+			// but stays in the room to receive replies. Peers that do not
+			// understand EOF frames are told by closing their connection.
+			clog.Debugf("peer finished sending")
+			targets = targets[:0]
+			s.rooms.Lock()
+			if r, ok := current(); ok {
+				delete(r.lastReceive, sender)
+				targets = r.targets(sender, targets)
+				if r.replay != nil {
+					targets = r.replay.queue(targets, nil)
+				}
+			}
+			s.rooms.Unlock()
+			for _, conn := range targets {
+				if !conn.EOFEnabled() {
+					conn.Close()
+					continue
+				}
+				_ = conn.WriteEOF()
+			}
+			return
+		}
 		if err != nil {
-			log.Debugf("connection error in room %s: %v", room, err)
+			clog.Debugf("connection error: %v", err)
 			s.deleteConnFromRoom(room, sender)
 			return
 		}
-		// Broadcast to all other connections.
+		// Broadcast to all other connections the room policy allows, or
+		// deliver a routed frame to the one it is addressed to.
+		targets = targets[:0]
 		s.rooms.Lock()
-		if r, ok := s.rooms.rooms[room]; ok {
-			for _, conn := range r.conns {
-				if conn != sender {
-					_ = conn.Send(data) // errors are ignored per connection
-				}
+		r, ok := current()
+		if !ok {
+			s.rooms.Unlock()
+			clog.Debugf("room deleted, dropping frame")
+			return
+		}
+		if r.lastReceive != nil && (s.keepalivesAreActivity || !bytes.Equal(data, keepaliveFrame)) {
+			r.lastReceive[sender] = s.clock.Now()
+		}
+		var routed bool
+		targets, data, routed = r.route(sender, data, targets)
+		r.traffic.add(s.clock.Now(), len(data)*len(targets))
+		warnings, exceeded := s.chargeRoom(r, len(data)*len(targets), clog)
+		if exceeded {
+			s.rooms.Unlock()
+			s.deleteRoom(room)
+			return
+		}
+		if len(targets) > 0 {
+			broadcast.add(span, len(data), len(targets))
+		}
+		if len(targets) == 0 && r.replay != nil && !r.superseded[sender] && !routed {
+			if err = r.replay.add(data); err != nil {
+				clog.Debugf("not buffering frame: %v", err)
 			}
 		}
+		if r.replay != nil {
+			targets = r.replay.queue(targets, data)
+		}
 		s.rooms.Unlock()
+		for _, conn := range targets {
+			_ = conn.Send(data) // errors are ignored per connection
+		}
+		sendWarnings(warnings)
+	}
+}
+
+// deleteAllRooms closes every room, for shutting down.
+func (s *server) deleteAllRooms() {
+	s.rooms.Lock()
+	rooms := make([]string, 0, len(s.rooms.rooms))
+	for room := range s.rooms.rooms {
+		rooms = append(rooms, room)
+	}
+	s.rooms.Unlock()
+	for _, room := range rooms {
+		s.deleteRoom(room)
 	}
 }
 
@@ -393,12 +1177,17 @@ func (s *server) deleteRoom(room string) {
 	if _, ok := s.rooms.rooms[room]; !ok {
 		return
 	}
-	log.Debugf("deleting room: %s", room)
+	s.debugf("[room=%s] deleting room", roomLogName(room))
+	if r := s.rooms.rooms[room]; r.replay != nil {
+		r.replay.wipe()
+	}
 	for _, conn := range s.rooms.rooms[room].conns {
 		if conn != nil {
+			s.rooms.leave(s.rooms.rooms[room].hosts[conn])
 			conn.Close()
 		}
 	}
+	s.rooms.rooms[room].close()
 	s.rooms.rooms[room] = roomInfo{conns: nil}
 	delete(s.rooms.rooms, room)
 }
@@ -487,6 +1276,30 @@ func PingServer(address string) (err error) {
 // ConnectToTCPServer will initiate a new connection
 // to the specified address, room with optional time limit
 func ConnectToTCPServer(address, password, room string, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
+	return ConnectToTCPServerWithPolicy(address, password, room, RoomPolicyBroadcast, timelimit...)
+}
+
+// ConnectToTCPServerWithPolicy is like ConnectToTCPServer but asks the relay
+// to apply policy to the room if this connection creates it.
+func ConnectToTCPServerWithPolicy(address, password, room string, policy RoomPolicy, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
+	return ConnectToRoom(address, password, RoomRequest{Room: room, Policy: policy}, timelimit...)
+}
+
+// ConnectToRoom is like ConnectToTCPServer but sends a full room request,
+// which can also declare what the room is used for. A relay that does not
+// announce CapabilityRoomFields is only asked for the room, and refuses
+// observers with ErrObserversUnsupported. A connection whose request
+// declared comm.CapabilityEOF to a relay announcing it has EOF frames
+// enabled. A relay that redirects to the
+// instance of its cluster owning the room, see WithCluster, is followed
+// there.
+func ConnectToRoom(address, password string, req RoomRequest, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
+	return connectToRoom(address, password, req, maxRedirects, timelimit...)
+}
+
+// connectToRoom is ConnectToRoom following at most redirects redirects.
+func connectToRoom(address, password string, req RoomRequest, redirects int, timelimit ...time.Duration) (c *comm.Comm, banner string, ipaddr string, err error) {
+	asked := req
 	if len(timelimit) > 0 {
 		c, err = comm.NewConnection(address, timelimit[0])
 	} else {
@@ -496,8 +1309,104 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 		log.Debug(err)
 		return
 	}
-	fmt.Println(address)
+	log.Debugf("connecting to %s", address)
+	strongKeyForEncryption, banner, ipaddr, err := clientHandshake(c, password, nil)
+	if err != nil {
+		return
+	}
+	c.SetRelayKey(strongKeyForEncryption)
+	if !c.RelaySupports(CapabilityRoomFields) {
+		// an observer would join as a peer
+		if req.Observer {
+			c.Close()
+			err = ErrObserversUnsupported
+			return
+		}
+		log.Debugf("relay does not read room fields, asking for the bare room")
+		req = RoomRequest{Room: req.Room}
+	}
+	req.Capabilities = slices.DeleteFunc(slices.Clone(req.Capabilities), func(capability string) bool {
+		return capability == CapabilityClusterRedirect
+	})
+	if req.forwardedFor == "" {
+		req.Capabilities = append(req.Capabilities, CapabilityClusterRedirect)
+	}
+	req.Capabilities = supportedCapabilities(c, req.Capabilities)
+	log.Debugf("sending room; %s", req.Room)
+	bSend, err := crypt.Encrypt([]byte(encodeRoomRequest(req)), strongKeyForEncryption)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	err = c.Send(bSend)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	log.Debug("waiting for room confirmation")
+	enc, err := c.Receive()
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	data, err := crypt.Decrypt(enc, strongKeyForEncryption)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+	if bytes.Equal(data, []byte(invalidRoomResponse)) {
+		err = ErrInvalidRoom
+		log.Debug(err)
+		return
+	}
+	if bytes.Equal(data, []byte(tooManyRoomsResponse)) {
+		err = ErrTooManyRooms
+		log.Debug(err)
+		return
+	}
+	if bytes.Equal(data, []byte(upgradeRequiredResponse)) {
+		err = ErrUpgradeRequired
+		log.Debug(err)
+		return
+	}
+	if bytes.Equal(data, []byte(observersDeniedResponse)) {
+		err = ErrObserversDenied
+		log.Debug(err)
+		return
+	}
+	if owner, ok := bytes.CutPrefix(data, []byte(redirectResponsePrefix)); ok && slices.Contains(req.Capabilities, CapabilityClusterRedirect) {
+		c.Close()
+		if redirects == 0 {
+			err = ErrTooManyRedirects
+			log.Debug(err)
+			return
+		}
+		log.Debugf("redirected to %s", owner)
+		return connectToRoom(string(owner), password, asked, redirects-1, timelimit...)
+	}
+	if status, tag, ok := bytes.Cut(data, []byte(joinTagSeparator)); ok && slices.Contains(req.Capabilities, CapabilityRouting) {
+		data = status
+		c.SetSessionTag(string(tag))
+	}
+	if !bytes.Equal(data, []byte("ok")) {
+		err = fmt.Errorf("got bad response: %s", data)
+		log.Debug(err)
+		return
+	}
+	if slices.Contains(req.Capabilities, comm.CapabilityEOF) {
+		c.EnableEOF()
+	}
+	log.Debug("all set")
+	return
+}
+
+// clientHandshake runs the client side of the relay handshake on c: PAKE,
+// salt and password. It returns the key for the rest of the session along
+// with the relay's banner and our address as the relay sees it. If timing
+// is not nil the PAKE and Auth phases are recorded in it.
+func clientHandshake(c *comm.Comm, password string, timing *RelayTiming) (strongKeyForEncryption []byte, banner string, ipaddr string, err error) {
 	// get PAKE connection with server to establish strong key to transfer info
+	start := time.Now()
 	A, err := pake.InitCurve(weakKey, 0, "siec")
 	if err != nil {
 		log.Debug(err)
@@ -513,6 +1422,11 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 		log.Debug(err)
 		return
 	}
+	if err = parseHandshakeFailure(Bbytes); err != nil {
+		log.Debug(err)
+		c.Close()
+		return
+	}
 	err = A.Update(Bbytes)
 	if err != nil {
 		log.Debug(err)
@@ -524,6 +1438,10 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 		return
 	}
 	log.Debugf("strong key: %x", strongKey)
+	if timing != nil {
+		timing.PAKE = time.Since(start)
+		start = time.Now()
+	}
 
 	strongKeyForEncryption, salt, err := crypt.New(strongKey, nil)
 	if err != nil {
@@ -564,35 +1482,14 @@ func ConnectToTCPServer(address, password, room string, timelimit ...time.Durati
 		log.Debug(err)
 		return
 	}
-	banner = strings.Split(string(data), "|||")[0]
-	ipaddr = strings.Split(string(data), "|||")[1]
-	log.Debugf("sending room; %s", room)
-	bSend, err = crypt.Encrypt([]byte(room), strongKeyForEncryption)
-	if err != nil {
-		log.Debug(err)
-		return
-	}
-	err = c.Send(bSend)
-	if err != nil {
-		log.Debug(err)
-		return
-	}
-	log.Debug("waiting for room confirmation")
-	enc, err = c.Receive()
-	if err != nil {
-		log.Debug(err)
-		return
-	}
-	data, err = crypt.Decrypt(enc, strongKeyForEncryption)
-	if err != nil {
-		log.Debug(err)
-		return
+	if timing != nil {
+		timing.Auth = time.Since(start)
 	}
-	if !bytes.Equal(data, []byte("ok")) {
-		err = fmt.Errorf("got bad response: %s", data)
-		log.Debug(err)
-		return
+	fields := strings.Split(string(data), "|||")
+	banner = fields[0]
+	ipaddr = fields[1]
+	if len(fields) > 2 && fields[2] != "" {
+		c.SetRelayCapabilities(strings.Split(fields[2], ","))
 	}
-	log.Debug("all set")
 	return
 }
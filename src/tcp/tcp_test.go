@@ -2,12 +2,34 @@ package tcp
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	log "github.com/schollz/logger"
+	"github.com/schollz/pake/v3"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+	"github.com/schollz/croc/v10/src/internal/testutil"
 )
 
 func BenchmarkConnection(b *testing.B) {
@@ -16,15 +38,79 @@ func BenchmarkConnection(b *testing.B) {
 	time.Sleep(100 * time.Millisecond)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		c, _, _, _ := ConnectToTCPServer("127.0.0.1:8283", "pass123", fmt.Sprintf("testroom%d", i), 1*time.Minute)
+		c, _, _, _ := ConnectToTCPServer("127.0.0.1:8283", "pass123", fmt.Sprintf("%064x", i), 1*time.Minute)
 		c.Close()
 	}
 }
 
+// BenchmarkBroadcastDebug measures how fast the relay passes frames from
+// one connection of a room to the other at debug level, with every debug
+// line written and with the default sampling.
+func BenchmarkBroadcastDebug(b *testing.B) {
+	// the relay sets the package level to debug too, for the clients
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stdout)
+	frame := bytes.Repeat([]byte{'x'}, 1024)
+	for _, bc := range []struct {
+		name     string
+		sampling int
+	}{{"unsampled", 0}, {"sampled", DEFAULT_LOG_SAMPLING}} {
+		b.Run(bc.name, func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithStrictRoomNames(false),
+					WithLogLevel("debug"), WithLogWriter(io.Discard), WithLogSampling(bc.sampling))
+			}()
+			defer func() {
+				l.Close()
+				<-done
+			}()
+			sender, _, _, err := ConnectToTCPServer(l.Addr().String(), "pass123", "broadcast", time.Minute)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer sender.Close()
+			receiver, _, _, err := ConnectToTCPServer(l.Addr().String(), "pass123", "broadcast", time.Minute)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer receiver.Close()
+			received := make(chan error, 1)
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			go func() {
+				for n := 0; n < b.N; {
+					data, err := receiver.Receive()
+					if err != nil {
+						received <- err
+						return
+					}
+					if len(data) == len(frame) {
+						n++
+					}
+				}
+				received <- nil
+			}()
+			for i := 0; i < b.N; i++ {
+				if err = sender.Send(frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err = <-received; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestTCP(t *testing.T) {
 	log.SetLevel("error")
 	timeToRoomDeletion := 100 * time.Millisecond
-	go RunWithOptionsAsync("127.0.0.1", "8381", "pass123", WithBanner("8382"), WithLogLevel("debug"), WithRoomTTL(timeToRoomDeletion))
+	go RunWithOptionsAsync("127.0.0.1", "8381", "pass123", WithStrictRoomNames(false), WithBanner("8382"), WithLogLevel("debug"), WithRoomTTL(timeToRoomDeletion))
 	time.Sleep(timeToRoomDeletion)
 	err := PingServer("127.0.0.1:8381")
 	assert.Nil(t, err)
@@ -69,3 +155,2662 @@ func TestTCP(t *testing.T) {
 	c1.Close()
 	time.Sleep(300 * time.Millisecond)
 }
+
+func TestRoomReady(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8391", "pass123", WithStrictRoomNames(false), WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8391", "pass123", "readyRoom", 1*time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+
+	ready := make(chan []byte, 1)
+	go func() {
+		data, _ := c1.Receive()
+		ready <- data
+	}()
+
+	// nobody else is here yet
+	select {
+	case data := <-ready:
+		t.Fatalf("got %v before a peer joined", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8391", "pass123", "readyRoom", 1*time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+
+	select {
+	case data := <-ready:
+		assert.Equal(t, []byte{1}, data)
+	case <-time.After(1 * time.Second):
+		t.Fatal("first client was not notified that the room is ready")
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var buf safeBuffer
+	go RunWithOptionsAsync("127.0.0.1", "8392", "pass123", WithLogLevel("debug"), WithLogWriter(&buf))
+	time.Sleep(100 * time.Millisecond)
+
+	room := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8392", "pass123", room, 1*time.Minute)
+	assert.Nil(t, err)
+	c1.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	logs := buf.String()
+	assert.Contains(t, logs, "starting TCP server on")
+	assert.Contains(t, logs, "room=01234567]")
+	assert.NotContains(t, logs, room)
+	assert.Regexp(t, `\[conn=\d+ remote=127\.0\.0\.1:\d+`, logs)
+}
+
+func TestLogSampler(t *testing.T) {
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	ls := newLogSampler(2, fake)
+	var written []string
+	write := func(format string, v ...interface{}) {
+		if format, v, ok := ls.sample(format, v); ok {
+			written = append(written, fmt.Sprintf(format, v...))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		write("frame %d", i)
+	}
+	// each kind has its own bucket
+	write("connected")
+	assert.Equal(t, []string{"frame 0", "frame 1", "connected"}, written)
+
+	// the bucket refills over time, and the next line counts the dropped
+	fake.Advance(500 * time.Millisecond)
+	write("frame %d", 5)
+	write("frame %d", 6)
+	fake.Advance(time.Second)
+	write("frame %d", 7)
+	assert.Equal(t, []string{"frame 0", "frame 1", "connected", "frame 5 (+3 suppressed)", "frame 7 (+1 suppressed)"}, written)
+
+	// no sampler writes every line
+	ls = newLogSampler(0, fake)
+	assert.Nil(t, ls)
+	written = nil
+	for i := 0; i < 5; i++ {
+		write("frame %d", i)
+	}
+	assert.Len(t, written, 5)
+}
+
+func TestLogSamplingKeepsErrors(t *testing.T) {
+	var logs safeBuffer
+	s := newDefaultServer()
+	for _, opt := range []serverOptsFunc{WithLogWriter(&logs), WithLogSampling(1)} {
+		assert.Nil(t, opt(s))
+	}
+	s.logger.SetLevel("debug")
+	s.sampler = newLogSampler(s.logSampling, s.clock)
+	clog := newConnLogger(s.logger, s.sampler, 1, "127.0.0.1:1")
+	for i := 0; i < 3; i++ {
+		clog.Debugf("sampled %d", i)
+		clog.Errorf("kept %d", i)
+	}
+	assert.Equal(t, 1, strings.Count(logs.String(), "sampled"))
+	assert.Equal(t, 3, strings.Count(logs.String(), "kept"))
+	assert.NotNil(t, WithLogSampling(-1)(s))
+}
+
+// safeBuffer is a bytes.Buffer that can be written to by the relay while a
+// test reads it.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestStrictRoomNames(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8397", "pass123", WithLogLevel("error"))
+	go RunWithOptionsAsync("127.0.0.1", "8398", "pass123", WithLogLevel("error"), WithStrictRoomNames(false))
+	time.Sleep(100 * time.Millisecond)
+
+	room := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, name := range []string{room, room + "-1"} {
+		c, _, _, err := ConnectToTCPServer("127.0.0.1:8397", "pass123", name, 1*time.Minute)
+		assert.Nil(t, err, name)
+		c.Close()
+	}
+	for _, name := range []string{"testRoom", strings.ToUpper(room), room + "0"} {
+		_, _, _, err := ConnectToTCPServer("127.0.0.1:8397", "pass123", name, 1*time.Minute)
+		assert.ErrorIs(t, err, ErrInvalidRoom, name)
+	}
+
+	// permissive mode takes any name but still bounds its length
+	c, _, _, err := ConnectToTCPServer("127.0.0.1:8398", "pass123", "testRoom", 1*time.Minute)
+	assert.Nil(t, err)
+	c.Close()
+	_, _, _, err = ConnectToTCPServer("127.0.0.1:8398", "pass123", strings.Repeat("a", MAX_ROOM_REQUEST_LENGTH+1), 1*time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidRoom)
+}
+
+func TestMeasureRelay(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8399", "pass123", WithBanner("8400"), WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	timing, err := MeasureRelay("127.0.0.1:8399", "pass123")
+	assert.Nil(t, err)
+	assert.Equal(t, "8400", timing.Banner)
+	assert.Greater(t, timing.Ping, time.Duration(0))
+	assert.Greater(t, timing.PAKE, time.Duration(0))
+	assert.Greater(t, timing.Auth, time.Duration(0))
+	assert.Equal(t, timing.Dial+timing.PAKE+timing.Auth, timing.Handshake())
+
+	_, err = MeasureRelay("127.0.0.1:8399", "wrong")
+	assert.NotNil(t, err)
+}
+
+func TestRoomCleanup(t *testing.T) {
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	for _, opt := range []serverOptsFunc{WithClock(fake), WithRoomTTL(time.Hour), WithRoomCleanupInterval(10 * time.Minute)} {
+		assert.Nil(t, opt(s))
+	}
+	s.logger.SetLevel("error")
+	s.rooms.rooms = map[string]roomInfo{
+		"old": {opened: fake.Now().Add(-45 * time.Minute)},
+		"new": {opened: fake.Now()},
+	}
+	roomNames := func() []string {
+		s.rooms.Lock()
+		defer s.rooms.Unlock()
+		var names []string
+		for name := range s.rooms.rooms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	// cleanup runs in its own goroutine, so wait for it to catch up
+	waitFor := func(want []string) {
+		deadline := time.Now().Add(time.Second)
+		for !assert.ObjectsAreEqual(want, roomNames()) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, want, roomNames())
+	}
+
+	go s.deleteOldRooms()
+	defer s.stopRoomDeletion()
+	fake.BlockUntil(1)
+
+	// nothing has expired at the first sweep
+	fake.Advance(10 * time.Minute)
+	waitFor([]string{"new", "old"})
+
+	// the next sweep comes after "old" passed its TTL
+	fake.Advance(10 * time.Minute)
+	waitFor([]string{"new"})
+	fake.Advance(40 * time.Minute)
+	waitFor([]string{"new"})
+	fake.Advance(10 * time.Minute)
+	waitFor(nil)
+}
+
+func TestTrafficWindow(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0).Truncate(trafficBucketWidth)
+	w := new(trafficWindow)
+	w.add(start, 100)
+	w.add(start.Add(trafficBucketWidth-time.Nanosecond), 50)
+	w.add(start.Add(time.Minute), 25)
+	assert.Equal(t, int64(175), w.total(start.Add(time.Minute)))
+
+	// the first bucket drops out exactly one window after it started
+	window := trafficBuckets * trafficBucketWidth
+	assert.Equal(t, int64(175), w.total(start.Add(window-time.Nanosecond)))
+	assert.Equal(t, int64(25), w.total(start.Add(window)))
+
+	// a reused slot forgets what it held a full window earlier
+	w.add(start.Add(window), 10)
+	assert.Equal(t, int64(35), w.total(start.Add(window)))
+	assert.Equal(t, int64(0), w.total(start.Add(time.Minute+2*window)))
+
+	var none *trafficWindow
+	none.add(start, 1)
+	assert.Equal(t, int64(0), none.total(start))
+}
+
+func TestStats(t *testing.T) {
+	now := time.Now()
+	s := newDefaultServer()
+	s.rooms.rooms = make(map[string]roomInfo)
+	for i := 0; i < statsTopRooms+2; i++ {
+		c := new(comm.Comm)
+		r := roomInfo{
+			conns:   []*comm.Comm{c},
+			joined:  map[*comm.Comm]time.Time{c: now.Add(-time.Duration(i) * 20 * time.Minute)},
+			traffic: new(trafficWindow),
+		}
+		if i%2 == 0 {
+			r.mode = RoomModeChat
+		}
+		r.traffic.add(now, (i+1)*1000)
+		s.rooms.rooms[fmt.Sprintf("%064x", i)] = r
+	}
+
+	st := s.statsAt(now)
+	assert.Equal(t, statsTopRooms+2, st.Rooms)
+	assert.Equal(t, statsTopRooms+2, st.Connections)
+	assert.Len(t, st.TopRooms, statsTopRooms)
+	assert.Equal(t, RoomTraffic{Room: roomLogName(fmt.Sprintf("%064x", statsTopRooms+1)), Bytes: int64(statsTopRooms+2) * 1000}, st.TopRooms[0])
+	assert.Len(t, st.TopRooms[0].Room, roomLogPrefixLength)
+	assert.Equal(t, map[RoomMode]int{RoomModeChat: 6, RoomModeUndeclared: 6}, st.Modes)
+
+	// ages 0, 20m, 40m, 60m, 80m, ... 220m
+	counts := []int{}
+	for _, b := range st.ConnectionAges {
+		counts = append(counts, b.Count)
+	}
+	assert.Equal(t, []int{1, 0, 3, 6, 2}, counts)
+	assert.Equal(t, "1m0s", st.ConnectionAges[0].UpTo)
+	assert.Empty(t, st.ConnectionAges[len(st.ConnectionAges)-1].UpTo)
+
+	// old traffic no longer ranks
+	assert.Empty(t, s.statsAt(now.Add(time.Hour)).TopRooms)
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8401", "pass123", WithLogLevel("error"), WithStatsAddress("127.0.0.1:8402"))
+	time.Sleep(100 * time.Millisecond)
+
+	room := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	c1, _, _, err := ConnectToRoom("127.0.0.1:8401", "pass123", RoomRequest{Room: room, Mode: RoomModeChat}, time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8401", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Nil(t, c1.Send([]byte("hello")))
+	data, err := c2.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	resp, err := http.Get("http://127.0.0.1:8402/stats")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var st Stats
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&st))
+	assert.Equal(t, 1, st.Rooms)
+	assert.Equal(t, 2, st.Connections)
+	assert.Equal(t, map[RoomMode]int{RoomModeChat: 1}, st.Modes)
+	assert.Equal(t, []RoomTraffic{{Room: "01234567", Bytes: 5}}, st.TopRooms)
+	if assert.Len(t, st.Handshake, 4) {
+		assert.Equal(t, phaseRoomJoin, st.Handshake[3].Phase)
+		assert.Equal(t, uint64(2), st.Handshake[3].Count)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 33, 1000, 123456789, 1 << 63} {
+		i := histogramBucket(v)
+		assert.GreaterOrEqual(t, histogramUpper(i), v, v)
+		if i > 0 {
+			assert.Less(t, histogramUpper(i-1), v, v)
+		}
+	}
+	assert.Less(t, histogramBucket(1<<63), histogramBuckets)
+
+	h := new(histogram)
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	count, q := h.quantiles(0.5, 0.95, 0.99, 1)
+	assert.Equal(t, uint64(1000), count)
+	for i, want := range []time.Duration{500 * time.Millisecond, 950 * time.Millisecond, 990 * time.Millisecond, time.Second} {
+		assert.InEpsilon(t, want, q[i], 0.07, "quantile %d", i)
+	}
+	assert.Equal(t, time.Second, q[3])
+
+	var none *histogram
+	none.record(time.Second)
+	count, q = none.quantiles(0.5)
+	assert.Zero(t, count)
+	assert.Equal(t, []time.Duration{0}, q)
+	var timings *handshakeTimings
+	assert.Nil(t, timings.stats())
+}
+
+func TestHandshakeTimingsClock(t *testing.T) {
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	timings := newHandshakeTimings(fake)
+	accepted := fake.Now()
+	fake.Advance(3 * time.Millisecond)
+	started := timings.record(phaseFirstFrame, accepted)
+	assert.Equal(t, fake.Now(), started)
+	fake.Advance(40 * time.Millisecond)
+	timings.record(phasePAKE, started)
+	phases := timings.stats()
+	assert.Equal(t, PhaseTiming{Phase: phaseFirstFrame, Count: 1, P50: "3ms", P95: "3ms", P99: "3ms"}, phases[0])
+	assert.Equal(t, PhaseTiming{Phase: phasePAKE, Count: 1, P50: "40ms", P95: "40ms", P99: "40ms"}, phases[1])
+}
+
+func TestHandshakeHistograms(t *testing.T) {
+	log.SetLevel("error")
+	s := newDefaultServer()
+	s.settings.password = "pass123"
+	s.strictRoomNames = false
+	s.rooms.rooms = make(map[string]roomInfo)
+	s.handshakes = newHandshakeTimings(s.clock)
+	s.logger.SetLevel("error")
+	t.Cleanup(s.deleteAllRooms)
+
+	const handshakes = 100
+	for i := 0; i < handshakes; i++ {
+		client, relay := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			relay.Close()
+		})
+		done := make(chan error, 1)
+		accepted := time.Now()
+		go func() {
+			c := comm.New(relay)
+			_, _, err := s.clientCommunication(context.Background(), "", c, newConnLogger(s.logger, nil, uint64(i), "pipe"), accepted)
+			done <- err
+		}()
+		c := comm.New(client)
+		key, _, _, err := clientHandshake(c, "pass123", nil)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		enc, err := crypt.Encrypt([]byte(encodeRoomRequest(RoomRequest{Room: fmt.Sprintf("room-%d", i)})), key)
+		assert.Nil(t, err)
+		assert.Nil(t, c.Send(enc))
+		enc, err = c.Receive()
+		assert.Nil(t, err)
+		joined, err := crypt.Decrypt(enc, key)
+		assert.Nil(t, err)
+		assert.Equal(t, "ok", string(joined))
+		assert.Nil(t, <-done)
+	}
+
+	st := s.Stats()
+	if !assert.Len(t, st.Handshake, 4) {
+		return
+	}
+	for i, phase := range []string{phaseFirstFrame, phasePAKE, phaseAuth, phaseRoomJoin} {
+		pt := st.Handshake[i]
+		assert.Equal(t, phase, pt.Phase)
+		assert.Equal(t, uint64(handshakes), pt.Count, phase)
+		var q []time.Duration
+		for _, s := range []string{pt.P50, pt.P95, pt.P99} {
+			d, err := time.ParseDuration(s)
+			assert.Nil(t, err)
+			q = append(q, d)
+		}
+		assert.LessOrEqual(t, q[0], q[1], phase)
+		assert.LessOrEqual(t, q[1], q[2], phase)
+		assert.Less(t, q[2], 10*time.Second, phase)
+	}
+	// the PAKE does the heavy lifting, so it is never free
+	_, q := s.handshakes.pake.quantiles(0.5)
+	assert.Positive(t, q[0])
+}
+
+func TestStatusPage(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8403", "pass123", WithLogLevel("error"),
+		WithStatusPage("127.0.0.1:8404", "admin", "secret"), WithVersion("v1.2.3"))
+	time.Sleep(100 * time.Millisecond)
+
+	room := "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8403", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8403", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Nil(t, c1.Send([]byte("hello")))
+	_, err = c2.Receive()
+	assert.Nil(t, err)
+	_, _, _, err = ConnectToTCPServer("127.0.0.1:8403", "wrong", room, time.Minute)
+	assert.NotNil(t, err)
+
+	resp, err := http.Get("http://127.0.0.1:8404/")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:8404/", nil)
+	assert.Nil(t, err)
+	req.SetBasicAuth("admin", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	page := string(body)
+	assert.Contains(t, page, "croc relay v1.2.3")
+	assert.Contains(t, page, "<tr><th>connections</th><td>2</td></tr>")
+	assert.Contains(t, page, "<tr><th>bad_password</th><td>1</td></tr>")
+	assert.Contains(t, page, roomLogName(room))
+	assert.NotContains(t, page, room)
+	assert.NotContains(t, page, "127.0.0.1")
+	assert.Contains(t, page, `http-equiv="refresh"`)
+	assert.Contains(t, page, "<tr><td>room_join</td><td>2</td>")
+
+	assert.NotNil(t, WithStatusPage("127.0.0.1:8404", "admin", "")(newDefaultServer()))
+}
+
+func TestRelayEOF(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8405", "pass123", WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	room := fmt.Sprintf("%064x", 8405)
+	req := RoomRequest{Room: room, Capabilities: []string{comm.CapabilityEOF}}
+	c1, _, _, err := ConnectToRoom("127.0.0.1:8405", "pass123", req, time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	c2, _, _, err := ConnectToRoom("127.0.0.1:8405", "pass123", req, time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.True(t, c1.RelaySupports(comm.CapabilityEOF))
+	assert.True(t, c1.EOFEnabled(), "declared and announced")
+	assert.True(t, c2.EOFEnabled())
+	// c1 waited for the room, so the relay tells it c2 arrived
+	data, err := c1.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, data)
+
+	assert.Nil(t, c1.Send([]byte("bye")))
+	assert.Nil(t, c1.SendEOF())
+	data, err = c2.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bye"), data)
+	assert.Nil(t, c2.ReceiveEOF())
+
+	// c1 is still in the room and hears back after finishing
+	assert.Nil(t, c2.Send([]byte("see you")))
+	data, err = c1.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("see you"), data)
+}
+
+func TestRelayEOFLegacyPeer(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"))
+	t.Cleanup(func() { l.Close() })
+
+	room := fmt.Sprintf("%064x", 8406)
+	a, _, _, err := ConnectToRoom(l.Addr().String(), "pass123", RoomRequest{Room: room, Capabilities: []string{comm.CapabilityEOF}}, time.Minute)
+	assert.Nil(t, err)
+	defer a.Close()
+	// b is a legacy client, which never heard of EOF frames
+	b, _, _, err := ConnectToTCPServer(l.Addr().String(), "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.False(t, b.EOFEnabled())
+	assert.Equal(t, []byte{1}, receiveWithin(t, a, time.Second))
+
+	assert.Nil(t, a.Send([]byte("bye")))
+	assert.Nil(t, a.SendEOF())
+	assert.Equal(t, []byte("bye"), receiveWithin(t, b, time.Second))
+	// b is not sent a frame it would take for a corrupt stream; its
+	// connection is closed instead
+	_, err = b.Receive()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandshakeFailure(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8393", "pass123", WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := comm.NewConnection("127.0.0.1:8393", 1*time.Second)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Nil(t, c.Send([]byte("definitely not pake bytes")))
+	data, err := c.Receive()
+	assert.Nil(t, err)
+
+	err = parseHandshakeFailure(data)
+	var handshakeErr *HandshakeError
+	assert.True(t, errors.As(err, &handshakeErr))
+	assert.Equal(t, "unsupported client", handshakeErr.Reason)
+
+	// the relay closes the connection afterwards
+	_, err = c.Receive()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, parseHandshakeFailure([]byte(`{"Role":1}`)))
+}
+
+func TestRoomRequest(t *testing.T) {
+	req := RoomRequest{Room: "abc", Policy: RoomPolicyLatestOnly, Mode: RoomModeSignal}
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+
+	assert.Equal(t, "abc", encodeRoomRequest(RoomRequest{Room: "abc"}))
+	assert.Equal(t, RoomRequest{Room: "abc"}, parseRoomRequest("abc"))
+
+	// the policy-only form older clients send still parses
+	assert.Equal(t, RoomRequest{Room: "abc", Policy: RoomPolicyLatestOnly}, parseRoomRequest("abc"+roomPolicySeparator+"latest-only"))
+
+	// unknown policies fall back to broadcast and unknown modes are ignored
+	req = parseRoomRequest("abc" + roomPolicySeparator + "something-new" + roomModeSeparator + "gaming")
+	assert.Equal(t, RoomRequest{Room: "abc"}, req)
+
+	// the application is sanitized on both ends
+	req = RoomRequest{Room: "abc", Mode: RoomModeChat, App: "croc-chat/10.2.1 linux/amd64"}
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+	req = parseRoomRequest("abc" + roomAppSeparator + "evil\x1b[2J\nclient" + strings.Repeat("x", 100))
+	assert.Equal(t, "evil[2Jclient"+strings.Repeat("x", maxClientAppLength-len("evil[2Jclient")), req.App)
+	assert.Equal(t, "abc", encodeRoomRequest(RoomRequest{Room: "abc", App: "\x00\r\n"}))
+
+	req = RoomRequest{Room: "abc", Mode: RoomModeChat, Observer: true, DenyObservers: true}
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+
+	// so is the instance
+	req = RoomRequest{Room: "abc", Policy: RoomPolicyLatestOnly, Instance: NewInstance()}
+	assert.Len(t, req.Instance, 16)
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+	req = parseRoomRequest("abc" + roomInstanceField + "a\x1bb=c-d_é" + strings.Repeat("x", 100))
+	assert.Equal(t, "abc-d_"+strings.Repeat("x", maxInstanceLength-len("abc-d_")), req.Instance)
+
+	req = RoomRequest{Room: "abc", Mode: RoomModeChat, Capabilities: []string{CapabilityControlFrames, "later"}}
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+	req = parseRoomRequest("abc" + roomCapsSeparator + ",x,x," + strings.Repeat("y", 100))
+	assert.Equal(t, []string{"x"}, req.Capabilities)
+}
+
+// receiveWithin returns the next frame c receives, failing the test if
+// none comes within d.
+func receiveWithin(t *testing.T, c *comm.Comm, d time.Duration) []byte {
+	t.Helper()
+	frames := make(chan []byte, 1)
+	go func() {
+		data, _ := c.Receive()
+		frames <- data
+	}()
+	select {
+	case data := <-frames:
+		return data
+	case <-time.After(d):
+		t.Fatal("no frame received")
+		return nil
+	}
+}
+
+func TestMixedRoomReady(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8433", "pass123", WithStrictRoomNames(false), WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	legacy := func(room string) *comm.Comm {
+		c, _, _, err := ConnectToTCPServer("127.0.0.1:8433", "pass123", room, time.Minute)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	capable := func(room string) *comm.Comm {
+		c, _, _, err := ConnectToRoom("127.0.0.1:8433", "pass123", RoomRequest{
+			Room:         room,
+			Mode:         RoomModeChat,
+			Capabilities: []string{CapabilityControlFrames},
+		}, time.Minute)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { c.Close() })
+		assert.True(t, c.RelaySupports(CapabilityControlFrames))
+		return c
+	}
+
+	// a new client waits and a legacy one joins: the new client gets a
+	// control frame, the legacy one nothing it would misread
+	waiting := capable("mixedRoom1")
+	joined := legacy("mixedRoom1")
+	data := receiveWithin(t, waiting, time.Second)
+	assert.NotEqual(t, []byte{1}, data)
+	kind, err := ParseControlFrame(waiting, data)
+	assert.Nil(t, err)
+	assert.Equal(t, ControlRoomReady, kind)
+	// a control frame cannot be read with another connection's key
+	_, err = ParseControlFrame(joined, data)
+	assert.NotNil(t, err)
+	// and the legacy client sees the new one's data first
+	assert.Nil(t, waiting.Send([]byte("hello legacy")))
+	assert.Equal(t, []byte("hello legacy"), receiveWithin(t, joined, time.Second))
+
+	// a legacy client waits and a new one joins: the legacy client gets
+	// the bare ready byte it expects
+	waiting = legacy("mixedRoom2")
+	joined = capable("mixedRoom2")
+	assert.Equal(t, []byte{1}, receiveWithin(t, waiting, time.Second))
+	assert.Nil(t, waiting.Send([]byte("hello new")))
+	assert.Equal(t, []byte("hello new"), receiveWithin(t, joined, time.Second))
+
+	// a frame from a peer that merely looks like a control frame does not
+	// authenticate
+	_, err = ParseControlFrame(joined, append([]byte("croc-relay-control:"), "forged"...))
+	assert.NotNil(t, err)
+}
+
+func TestObserversDenied(t *testing.T) {
+	log.SetLevel("error")
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8416", "pass123"
+	for _, opt := range []serverOptsFunc{WithLogLevel("error"), WithStrictRoomNames(false)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+	join := func(req RoomRequest) error {
+		c, _, _, err := ConnectToRoom("127.0.0.1:8416", "pass123", req, time.Minute)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		return err
+	}
+
+	assert.Nil(t, join(RoomRequest{Room: "private", DenyObservers: true}))
+	assert.ErrorIs(t, join(RoomRequest{Room: "private", Observer: true}), ErrObserversDenied)
+	assert.Equal(t, int64(1), s.Stats().Errors[errorObserversDenied])
+	s.rooms.Lock()
+	assert.Equal(t, 1, s.rooms.members["127.0.0.1"], "the refused observer holds no membership")
+	s.rooms.Unlock()
+	assert.Nil(t, join(RoomRequest{Room: "private"}))
+
+	// later joiners cannot turn observers away from a room that allows them
+	assert.Nil(t, join(RoomRequest{Room: "open"}))
+	assert.Nil(t, join(RoomRequest{Room: "open", DenyObservers: true}))
+	assert.Nil(t, join(RoomRequest{Room: "open", Observer: true}))
+}
+
+func TestClientPatterns(t *testing.T) {
+	p, err := compileClientPatterns([]string{"croc-chat/10.1.* *", "bad.client"})
+	assert.Nil(t, err)
+	assert.True(t, p.match("croc-chat/10.1.3 linux/amd64"))
+	assert.False(t, p.match("croc-chat/10.2.1 linux/amd64"))
+	assert.True(t, p.match("bad.client"))
+	assert.False(t, p.match("badxclient"), "only * is special")
+	assert.False(t, p.match(""))
+	_, err = compileClientPatterns([]string{" "})
+	assert.NotNil(t, err)
+}
+
+func TestBlockedClients(t *testing.T) {
+	log.SetLevel("error")
+	var logs bytes.Buffer
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8415", "pass123"
+	for _, opt := range []serverOptsFunc{WithLogWriter(&logs), WithLogLevel("info"), WithStrictRoomNames(false), WithBlockedClients([]string{"croc-chat/10.1.*"})} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+	join := func(app string) (*comm.Comm, error) {
+		c, _, _, err := ConnectToRoom("127.0.0.1:8415", "pass123", RoomRequest{Room: "blocked", App: app}, time.Minute)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		return c, err
+	}
+
+	_, err := join("croc-chat/10.1.0 linux/amd64")
+	assert.ErrorIs(t, err, ErrUpgradeRequired)
+	assert.Equal(t, int64(1), s.Stats().Errors[errorBlockedClient])
+	assert.Contains(t, logs.String(), `app="croc-chat/10.1.0 linux/amd64"] rejecting client`)
+
+	alice, err := join("croc-chat/10.2.1 linux/amd64")
+	assert.Nil(t, err)
+	bob, err := join("")
+	assert.Nil(t, err)
+	assert.Nil(t, alice.Send([]byte("hello")))
+	_, err = bob.Receive()
+	assert.Nil(t, err)
+	top := s.Stats().TopRooms
+	if assert.Len(t, top, 1) {
+		assert.Equal(t, []string{"croc-chat/10.2.1 linux/amd64"}, top[0].Apps)
+	}
+}
+
+func TestLatestOnlyForwarding(t *testing.T) {
+	newComm := func() *comm.Comm {
+		a, b := net.Pipe()
+		t.Cleanup(func() {
+			a.Close()
+			b.Close()
+		})
+		return comm.New(a)
+	}
+	alice1, alice2, alice3, bob, carol := newComm(), newComm(), newComm(), newComm(), newComm()
+	r := roomInfo{
+		policy:     RoomPolicyLatestOnly,
+		hosts:      make(map[*comm.Comm]string),
+		instances:  make(map[*comm.Comm]string),
+		superseded: make(map[*comm.Comm]bool),
+	}
+	join := func(c *comm.Comm, host, instance string) []*comm.Comm {
+		r.conns = append(r.conns, c)
+		return r.supersede(c, host, instance)
+	}
+	assert.Empty(t, join(alice1, "10.0.0.1", "alice"))
+	// bob shares alice's host, say behind the same NAT
+	assert.Empty(t, join(bob, "10.0.0.1", "bob"))
+	assert.True(t, r.forwardsTo(alice1, bob))
+
+	// alice reconnects twice in a row, once from another address
+	assert.Equal(t, []*comm.Comm{alice1}, join(alice2, "10.0.0.1", "alice"))
+	assert.Equal(t, []*comm.Comm{alice2}, join(alice3, "10.0.0.2", "alice"))
+	assert.False(t, r.forwardsTo(bob, alice1))
+	assert.False(t, r.forwardsTo(bob, alice2))
+	assert.True(t, r.forwardsTo(bob, alice3))
+	assert.False(t, r.forwardsTo(alice1, bob))
+	assert.False(t, r.forwardsTo(alice2, bob))
+	assert.True(t, r.forwardsTo(alice3, bob))
+	assert.False(t, r.forwardsTo(alice3, alice3))
+
+	// connections without an instance are never superseded
+	assert.Empty(t, join(carol, "10.0.0.1", ""))
+	assert.True(t, r.forwardsTo(carol, bob))
+	assert.True(t, r.forwardsTo(alice3, carol))
+
+	// broadcast rooms never supersede
+	r = roomInfo{
+		hosts:      make(map[*comm.Comm]string),
+		instances:  make(map[*comm.Comm]string),
+		superseded: make(map[*comm.Comm]bool),
+	}
+	assert.Empty(t, join(alice1, "10.0.0.1", "alice"))
+	assert.Empty(t, join(alice2, "10.0.0.1", "alice"))
+	assert.True(t, r.forwardsTo(alice1, alice2))
+}
+
+func TestLatestOnlyReconnectStorm(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8394", "pass123", WithStrictRoomNames(false), WithLogLevel("error"), WithSupersededGracePeriod(500*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	// every connection is the same instance, so each one supersedes the
+	// one before it
+	req := RoomRequest{Room: "stormRoom", Policy: RoomPolicyLatestOnly, Instance: NewInstance()}
+	var conns []*comm.Comm
+	for i := 0; i < 4; i++ {
+		c, _, _, err := ConnectToRoom("127.0.0.1:8394", "pass123", req, 1*time.Minute)
+		assert.Nil(t, err)
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	latest := conns[len(conns)-1]
+	// another instance on the same host is not
+	other, _, _, err := ConnectToRoom("127.0.0.1:8394", "pass123", RoomRequest{Room: "stormRoom", Policy: RoomPolicyLatestOnly, Instance: NewInstance()}, 1*time.Minute)
+	assert.Nil(t, err)
+	defer other.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, err := latest.Receive()
+		if err == nil {
+			received <- data
+		}
+	}()
+
+	// a zombie answering during the grace period is not forwarded
+	assert.Nil(t, conns[1].Send([]byte("garbage")))
+	select {
+	case data := <-received:
+		t.Fatalf("latest connection got %q from a superseded one", data)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Nil(t, other.Send([]byte("hello")))
+	select {
+	case data := <-received:
+		assert.Equal(t, []byte("hello"), data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("another instance on the same host was superseded")
+	}
+
+	// superseded connections are closed once the grace period ends
+	for _, c := range conns[:len(conns)-1] {
+		for {
+			data, err := c.Receive()
+			if err != nil {
+				break
+			}
+			assert.Equal(t, []byte{1}, data)
+		}
+	}
+}
+
+func TestReplayBuffer(t *testing.T) {
+	b, err := newReplayBuffer(3, 1024, true)
+	assert.Nil(t, err)
+	assert.Nil(t, b.add([]byte("first secret")))
+	assert.Nil(t, b.add([]byte("second secret")))
+	for _, stored := range b.frames {
+		assert.NotContains(t, string(stored), "secret")
+	}
+	// quota is accounted in ciphertext bytes
+	assert.Equal(t, len(b.frames[0])+len(b.frames[1]), b.size)
+	assert.Greater(t, b.size, len("first secret")+len("second secret"))
+
+	frames, err := b.drain()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("first secret"), []byte("second secret")}, frames)
+	assert.Equal(t, 0, b.size)
+
+	// the oldest frames make room for new ones
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, b.add([]byte(fmt.Sprintf("frame %d", i))))
+	}
+	frames, err = b.drain()
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("frame 2"), []byte("frame 3"), []byte("frame 4")}, frames)
+
+	// a byte limit that fits the plaintext but not the ciphertext
+	small, err := newReplayBuffer(10, 20, true)
+	assert.Nil(t, err)
+	assert.NotNil(t, small.add(make([]byte, 15)))
+	plain, err := newReplayBuffer(10, 20, false)
+	assert.Nil(t, err)
+	assert.Nil(t, plain.add(make([]byte, 15)))
+
+	// wiping zeroes the stored bytes and the key
+	assert.Nil(t, b.add([]byte("wipe me")))
+	stored, key := b.frames[0], b.key
+	b.wipe()
+	assert.Equal(t, make([]byte, len(stored)), stored)
+	assert.Equal(t, make([]byte, len(key)), key)
+	assert.Nil(t, b.key)
+	assert.Empty(t, b.frames)
+}
+
+func TestReplayToLateJoiner(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8395", "pass123", WithStrictRoomNames(false), WithLogLevel("error"), WithReplayBuffer(10, 1<<20))
+	time.Sleep(100 * time.Millisecond)
+
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8395", "pass123", "replayRoom", 1*time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	assert.Nil(t, c1.Send([]byte("are you there?")))
+	assert.Nil(t, c1.Send([]byte("hello?")))
+	time.Sleep(100 * time.Millisecond)
+
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8395", "pass123", "replayRoom", 1*time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	for _, expected := range []string{"are you there?", "hello?"} {
+		data, err := c2.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	// live frames follow the replay
+	assert.Nil(t, c1.Send([]byte("welcome")))
+	data, err := c2.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, "welcome", string(data))
+
+	assert.NotNil(t, RunWithOptionsAsync("127.0.0.1", "8396", "pass123", WithReplayBuffer(10, 0)))
+}
+
+func TestReplayQueue(t *testing.T) {
+	s := newDefaultServer()
+	s.logger.SetLevel("error")
+	clog := newConnLogger(s.logger, nil, 1, "pipe")
+	b, err := newReplayBuffer(10, 1<<20, true)
+	assert.Nil(t, err)
+	assert.Nil(t, b.add([]byte("one")))
+	assert.Nil(t, b.add([]byte("two")))
+	a, peer := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		peer.Close()
+	})
+	joiner, other := comm.New(a), comm.New(peer)
+	stored := b.size
+	n, err := b.startReplay(joiner)
+	assert.Nil(t, err)
+	assert.Equal(t, stored, n, "the stored bytes are drained")
+
+	// a live frame for the joiner waits behind the replay
+	bystander, _ := stalledPeer(t)
+	assert.Equal(t, []*comm.Comm{bystander}, b.queue([]*comm.Comm{joiner, bystander}, []byte("three")))
+	replayed := make(chan error, 1)
+	go func() { replayed <- s.replayTo(b, joiner, clog) }()
+	for _, expected := range []string{"one", "two", "three"} {
+		data, err := other.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	assert.Nil(t, <-replayed)
+	assert.NotContains(t, b.pending, joiner)
+	assert.Equal(t, []*comm.Comm{joiner}, b.queue([]*comm.Comm{joiner}, []byte("live")), "sent directly once replayed")
+
+	// a joiner that stops reading holds up no room
+	stalled, release := stalledPeer(t)
+	assert.Nil(t, b.add([]byte("unread")))
+	_, err = b.startReplay(stalled)
+	assert.Nil(t, err)
+	assertRoomsUnlocked(t, s, func() { assert.NotNil(t, s.replayTo(b, stalled, clog)) }, release)
+	assert.NotContains(t, b.pending, stalled)
+}
+
+func TestReplayByteQuota(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	s := newDefaultServer()
+	s.host, s.settings.password = "127.0.0.1", "pass123"
+	for _, opt := range []serverOptsFunc{WithListener(l), WithReplayBuffer(10, 1<<20), WithRoomByteQuota(1000), WithLogLevel("error"), WithStrictRoomNames(false)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	defer l.Close()
+	usage := func(room string) (relayed int64, stored int) {
+		s.rooms.Lock()
+		defer s.rooms.Unlock()
+		r := s.rooms.rooms[room]
+		return r.usage.relayed, r.replay.size
+	}
+
+	// buffered frames count once they are replayed, at their stored size
+	c1, _, _, err := ConnectToTCPServer(addr, "pass123", "replay-quota", time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	assert.Nil(t, c1.Send(make([]byte, 300)))
+	assert.Eventually(t, func() bool { _, stored := usage("replay-quota"); return stored > 0 }, time.Second, time.Millisecond)
+	relayed, stored := usage("replay-quota")
+	assert.Zero(t, relayed, "nobody received the frame yet")
+	assert.Greater(t, stored, 300, "the frame is stored encrypted")
+	c2, _, _, err := ConnectToTCPServer(addr, "pass123", "replay-quota", time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Len(t, receiveWithin(t, c2, time.Second), 300)
+	relayed, _ = usage("replay-quota")
+	assert.Equal(t, int64(stored), relayed)
+
+	// and take a room past its quota like live frames would
+	c3, _, _, err := ConnectToTCPServer(addr, "pass123", "replay-over-quota", time.Minute)
+	assert.Nil(t, err)
+	defer c3.Close()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, c3.Send(make([]byte, 400)))
+	}
+	assert.Eventually(t, func() bool { _, stored := usage("replay-over-quota"); return stored > 1000 }, time.Second, time.Millisecond)
+	_, _, _, err = ConnectToTCPServer(addr, "pass123", "replay-over-quota", time.Minute)
+	assert.NotNil(t, err, "the room is deleted instead of replayed")
+	_, err = c3.Receive()
+	assert.NotNil(t, err)
+	s.rooms.Lock()
+	assert.NotContains(t, s.rooms.rooms, "replay-over-quota")
+	s.rooms.Unlock()
+	assert.Equal(t, map[string]int64{limitQuotaExceeded: 1}, s.Stats().LimitEvents)
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	log.SetLevel("error")
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8406", "pass123"
+	for _, opt := range []serverOptsFunc{WithClock(fake), WithLogLevel("error"), WithConnIdleTimeout(10 * time.Minute)} {
+		assert.Nil(t, opt(s))
+	}
+	assert.NotNil(t, WithConnIdleTimeout(-time.Second)(s))
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+
+	room := fmt.Sprintf("%064x", 8406)
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8406", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8406", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	data, err := c1.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, data)
+
+	// c1 talks; c2 only sends a keepalive, which does not count
+	fake.Advance(6 * time.Minute)
+	assert.Nil(t, c1.Send([]byte("hi")))
+	data, err = c2.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hi"), data)
+	assert.Nil(t, c2.Send(keepaliveFrame))
+	data, err = c1.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, keepaliveFrame, data)
+	st := s.Stats()
+	assert.Equal(t, 1, st.ConnectionIdle[0].Count)
+	assert.Equal(t, 1, st.ConnectionIdle[1].Count)
+	assert.Equal(t, "10m0s", st.Limits.ConnIdleTimeout)
+
+	fake.Advance(5 * time.Minute)
+	s.kickIdleConns()
+	data, err = c2.Receive()
+	assert.Nil(t, err)
+	assert.True(t, IsIdleTimeout(data))
+	_, err = c2.Receive()
+	assert.NotNil(t, err)
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Connections != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 1, s.Stats().Connections)
+
+	// a connection alone in its room is left to the room TTL
+	fake.Advance(time.Hour)
+	s.kickIdleConns()
+	assert.Equal(t, 1, s.Stats().Connections)
+}
+
+// stalledPeer returns a connection whose peer never reads, so writes to
+// it block, and a func that closes the peer's end.
+func stalledPeer(t *testing.T) (*comm.Comm, func()) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return comm.New(a), func() { b.Close() }
+}
+
+// assertRoomsUnlocked checks that the rooms lock can be taken while
+// blocked, which is writing to a stalled peer, and that blocked returns
+// once release unblocks the peer.
+func assertRoomsUnlocked(t *testing.T, s *server, blocked func(), release func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		blocked()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		s.rooms.Lock()
+		s.rooms.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("the rooms lock is held while writing to a peer")
+	}
+	select {
+	case <-done:
+		t.Error("nothing was written to the stalled peer")
+	default:
+	}
+	release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still blocked after the peer went away")
+	}
+	<-locked
+}
+
+func TestKickIdleConnsStalledPeer(t *testing.T) {
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	assert.Nil(t, WithClock(fake)(s))
+	assert.Nil(t, WithConnIdleTimeout(time.Minute)(s))
+	s.logger.SetLevel("error")
+	a, releaseA := stalledPeer(t)
+	b, releaseB := stalledPeer(t)
+	idle := fake.Now().Add(-time.Hour)
+	s.rooms.rooms = map[string]roomInfo{"room": {
+		conns:       []*comm.Comm{a, b},
+		joined:      map[*comm.Comm]time.Time{a: idle, b: idle},
+		lastReceive: map[*comm.Comm]time.Time{a: idle, b: idle},
+	}}
+	assertRoomsUnlocked(t, s, s.kickIdleConns, func() {
+		releaseA()
+		releaseB()
+	})
+	assert.Empty(t, s.rooms.rooms["room"].lastReceive)
+}
+
+func TestNotifyRoomReadyStalledPeer(t *testing.T) {
+	s := newDefaultServer()
+	s.logger.SetLevel("error")
+	waiting, release := stalledPeer(t)
+	joined, _ := stalledPeer(t)
+	s.rooms.rooms = map[string]roomInfo{"room": {conns: []*comm.Comm{waiting, joined}}}
+	clog := newConnLogger(s.logger, nil, 1, "pipe")
+	assertRoomsUnlocked(t, s, func() { s.notifyRoomReady("room", joined, clog) }, release)
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Validate("127.0.0.1", "8407", "pass123", WithBanner("8408,8409"), WithStatsAddress("127.0.0.1:8408")))
+
+	busy, err := net.Listen("tcp", "127.0.0.1:8409")
+	assert.Nil(t, err)
+	defer busy.Close()
+
+	for _, tc := range []struct {
+		name string
+		port string
+		opts []serverOptsFunc
+		want []string
+	}{
+		{"port", "http", nil, []string{`invalid port "http"`}},
+		{"port range", "70000", nil, []string{`invalid port "70000"`}},
+		{"banner", "8407", []serverOptsFunc{WithBanner("8408,x")}, []string{`banner lists invalid port "x"`}},
+		{"log level", "8407", []serverOptsFunc{WithLogLevel("loud")}, []string{"invalid log level specified: loud"}},
+		{"room ttl", "8407", []serverOptsFunc{WithRoomTTL(0)}, []string{"room TTL must be positive"}},
+		{"cleanup", "8407", []serverOptsFunc{WithRoomCleanupInterval(-time.Second)}, []string{"room cleanup interval must be positive"}},
+		{"grace", "8407", []serverOptsFunc{WithSupersededGracePeriod(-time.Second)}, []string{"superseded grace period cannot be negative"}},
+		{"idle", "8407", []serverOptsFunc{WithConnIdleTimeout(-time.Second)}, []string{"invalid connection idle timeout"}},
+		{"replay", "8407", []serverOptsFunc{WithReplayBuffer(1, 0)}, []string{"invalid replay buffer limits"}},
+		{"quota", "8407", []serverOptsFunc{WithRoomByteQuota(-1)}, []string{"invalid room byte quota"}},
+		{"quota warning", "8407", []serverOptsFunc{WithLimitWarnings(1, time.Minute)}, []string{"invalid quota warning"}},
+		{"expiry warning", "8407", []serverOptsFunc{WithLimitWarnings(0.5, -time.Minute)}, []string{"invalid expiry warning"}},
+		{"status creds", "8407", []serverOptsFunc{WithStatusPage("127.0.0.1:8408", "admin", "")}, []string{"status page needs a user and password"}},
+		{"shared http", "8407", []serverOptsFunc{WithStatsAddress("127.0.0.1:8408"), WithStatusPage("127.0.0.1:8408", "admin", "x")}, []string{"stats and status page cannot share"}},
+		{"relay port in use", "8409", nil, []string{"relay address 0.0.0.0:8409"}},
+		{"stats port in use", "8407", []serverOptsFunc{WithStatsAddress("127.0.0.1:8409")}, []string{"stats address 127.0.0.1:8409"}},
+		{"options first", "http", []serverOptsFunc{WithRoomTTL(0), WithLogLevel("loud")}, []string{"invalid log level specified: loud"}},
+		{"aggregated", "http", []serverOptsFunc{WithRoomTTL(0)}, []string{`invalid port "http"`, "room TTL must be positive"}},
+	} {
+		err := Validate("127.0.0.1", tc.port, "pass123", tc.opts...)
+		if assert.NotNil(t, err, tc.name) {
+			for _, want := range tc.want {
+				assert.Contains(t, err.Error(), want, tc.name)
+			}
+		}
+	}
+
+	// start refuses to listen with a bad configuration
+	assert.NotNil(t, RunWithOptionsAsync("127.0.0.1", "8409", "pass123", WithLogLevel("error")))
+}
+
+func TestDumpConfig(t *testing.T) {
+	dump, err := DumpConfig("127.0.0.1", "8407", "pass123", WithStatusPage("127.0.0.1:8408", "admin", "secret"), WithRoomTTL(time.Hour))
+	assert.Nil(t, err)
+	assert.Contains(t, dump, "password: p***3\n")
+	assert.Contains(t, dump, "status password: s***t\n")
+	assert.Contains(t, dump, "room ttl: 1h0m0s\n")
+	assert.NotContains(t, dump, "pass123")
+	assert.NotContains(t, dump, "secret")
+
+	_, err = DumpConfig("127.0.0.1", "8407", "pass123", WithLogLevel("loud"))
+	assert.NotNil(t, err)
+}
+
+func TestListenAddress(t *testing.T) {
+	for _, tc := range []struct {
+		host    string
+		exact   bool
+		network string
+		addr    string
+		widened bool
+	}{
+		{"", false, "tcp", ":9009", false},
+		{"192.0.2.1", false, "tcp4", "192.0.2.1:9009", false},
+		{"127.0.0.1", false, "tcp4", "0.0.0.0:9009", true},
+		{"127.0.0.1", true, "tcp4", "127.0.0.1:9009", false},
+		{"localhost", false, "tcp4", "0.0.0.0:9009", true},
+		{"localhost", true, "tcp4", "127.0.0.1:9009", false},
+		{"::ffff:192.0.2.1", false, "tcp4", "192.0.2.1:9009", false},
+		{"::ffff:127.0.0.1", false, "tcp4", "0.0.0.0:9009", true},
+		{"2001:db8::1", false, "tcp6", "[2001:db8::1]:9009", false},
+		{"[2001:db8::1]", false, "tcp6", "[2001:db8::1]:9009", false},
+		{"::1", false, "tcp6", "[::]:9009", true},
+		{"::1", true, "tcp6", "[::1]:9009", false},
+		{"fe80::1%eth0", false, "tcp6", "[fe80::1%eth0]:9009", false},
+		{"[fe80::1%eth0]", true, "tcp6", "[fe80::1%eth0]:9009", false},
+	} {
+		network, addr, widened, err := listenAddress(tc.host, "9009", tc.exact)
+		name := fmt.Sprintf("%s exact=%v", tc.host, tc.exact)
+		assert.Nil(t, err, name)
+		assert.Equal(t, tc.network, network, name)
+		assert.Equal(t, tc.addr, addr, name)
+		assert.Equal(t, tc.widened, widened, name)
+	}
+
+	dump, err := DumpConfig("::1", "8435", "pass123", WithBindExactly(true))
+	assert.Nil(t, err)
+	assert.Contains(t, dump, "bind exactly: true\n")
+}
+
+func TestMaxRoomsPerIP(t *testing.T) {
+	log.SetLevel("error")
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8411", "pass123"
+	for _, opt := range []serverOptsFunc{WithLogLevel("error"), WithStrictRoomNames(false), WithMaxRoomsPerIP(3)} {
+		assert.Nil(t, opt(s))
+	}
+	assert.NotNil(t, WithMaxRoomsPerIP(-1)(s))
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+	members := func() int {
+		s.rooms.Lock()
+		defer s.rooms.Unlock()
+		return s.rooms.members["127.0.0.1"]
+	}
+	join := func(room string) (*comm.Comm, error) {
+		c, _, _, err := ConnectToTCPServer("127.0.0.1:8411", "pass123", room, time.Minute)
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		return c, err
+	}
+
+	var conns []*comm.Comm
+	for i := 0; i < 3; i++ {
+		c, err := join(fmt.Sprintf("cap-%d", i))
+		assert.Nil(t, err)
+		conns = append(conns, c)
+	}
+	assert.Equal(t, 3, members())
+	// neither a new room nor one this host is already in can be joined
+	_, err := join("cap-3")
+	assert.ErrorIs(t, err, ErrTooManyRooms)
+	_, err = join("cap-0")
+	assert.ErrorIs(t, err, ErrTooManyRooms)
+	assert.Equal(t, int64(2), s.Stats().Errors[errorRoomsPerIP])
+	assert.Equal(t, 3, s.Stats().Limits.MaxRoomsPerIP)
+	assert.Equal(t, 3, s.Stats().Connections)
+
+	// leaving a room frees a membership
+	conns[1].Close()
+	assert.Eventually(t, func() bool { return members() == 2 }, time.Second, time.Millisecond)
+	_, err = join("cap-3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, members())
+
+	// as does a room being deleted, once and for all of its connections
+	s.deleteRoom("cap-0")
+	assert.Equal(t, 2, members())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, members())
+	s.deleteRoom("cap-2")
+	s.deleteRoom("cap-3")
+	assert.Eventually(t, func() bool { return members() == 0 }, time.Second, time.Millisecond)
+	s.rooms.Lock()
+	assert.Empty(t, s.rooms.members)
+	s.rooms.Unlock()
+}
+
+func TestRoomGenerations(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	s.host, s.settings.password = "127.0.0.1", "pass123"
+	for _, opt := range []serverOptsFunc{WithListener(l), WithClock(fake), WithRoomTTL(time.Hour), WithRoomCleanupInterval(time.Minute),
+		WithLogLevel("error"), WithStrictRoomNames(false)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	defer l.Close()
+	time.Sleep(100 * time.Millisecond)
+	join := func() *comm.Comm {
+		var c *comm.Comm
+		assert.Eventually(t, func() bool {
+			c, _, _, err = ConnectToTCPServer(addr, "pass123", "generations", time.Second)
+			return err == nil
+		}, 2*time.Second, 10*time.Millisecond)
+		return c
+	}
+	generation := func() uint64 {
+		s.rooms.Lock()
+		defer s.rooms.Unlock()
+		return s.rooms.rooms["generations"].generation
+	}
+	// receive returns the next frame that is not the ready byte
+	receive := func(c *comm.Comm) string {
+		for {
+			data, err := c.Receive()
+			if err != nil {
+				return err.Error()
+			}
+			if !bytes.Equal(data, []byte{1}) {
+				return string(data)
+			}
+		}
+	}
+
+	var last uint64
+	for round := 0; round < 5; round++ {
+		sender, receiver := join(), join()
+		current := generation()
+		assert.Greater(t, current, last)
+		last = current
+		// the old room is busy as it expires
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for sender.Send([]byte(fmt.Sprintf("old-%d", round))) == nil {
+			}
+		}()
+		assert.Equal(t, fmt.Sprintf("old-%d", round), receive(receiver))
+		fake.Advance(2 * time.Hour)
+		assert.Eventually(t, func() bool { return generation() == 0 }, time.Second, time.Millisecond)
+
+		// and a room of the same name follows at once
+		newSender, newReceiver := join(), join()
+		assert.Greater(t, generation(), current)
+		for i := 0; i < 20; i++ {
+			assert.Nil(t, newSender.Send([]byte(fmt.Sprintf("new-%d-%d", round, i))))
+			assert.Equal(t, fmt.Sprintf("new-%d-%d", round, i), receive(newReceiver))
+		}
+		assert.Nil(t, newReceiver.Send([]byte("reply")))
+		assert.Equal(t, "reply", receive(newSender))
+		<-stopped
+		for _, c := range []*comm.Comm{sender, receiver, newSender, newReceiver} {
+			c.Close()
+		}
+		assert.Eventually(t, func() bool { return generation() == 0 }, time.Second, time.Millisecond)
+	}
+}
+
+func TestWithListener(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+
+	// the port is already bound, which validation must not trip over, and
+	// an explicit port has to match the listener
+	assert.Nil(t, Validate("127.0.0.1", "", "pass123", WithListener(l)))
+	err = Validate("127.0.0.1", "1", "pass123", WithListener(l))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "listener is on port "+port)
+	}
+	assert.NotNil(t, Validate("127.0.0.1", "", "pass123", WithListener(nil)))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	var c *comm.Comm
+	assert.Eventually(t, func() bool {
+		c, _, _, err = ConnectToTCPServer("127.0.0.1:"+port, "pass123", "listener", time.Second)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	defer c.Close()
+
+	// closing the listener shuts the relay down and closes its rooms
+	assert.Nil(t, l.Close())
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay did not stop after its listener was closed")
+	}
+	_, err = c.Receive()
+	assert.NotNil(t, err)
+}
+
+func TestRoutedFrames(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	join := func(capabilities ...string) *comm.Comm {
+		c, _, _, err := ConnectToRoom(l.Addr().String(), "pass123", RoomRequest{Room: "routed", Capabilities: capabilities}, time.Second)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	a := join(CapabilityRouting)
+	b := join(CapabilityRouting)
+	assert.Equal(t, []byte{1}, receiveWithin(t, a, time.Second))
+	c := join(CapabilityRouting)
+	legacy := join()
+	for _, conn := range []*comm.Comm{a, b, c} {
+		assert.True(t, conn.RelaySupports(CapabilityRouting))
+		assert.Len(t, conn.SessionTag(), sessionTagLen)
+	}
+	assert.NotEqual(t, a.SessionTag(), b.SessionTag())
+	assert.NotEqual(t, b.SessionTag(), c.SessionTag())
+	assert.Empty(t, legacy.SessionTag())
+
+	// a targeted frame reaches exactly one connection, unwrapped; frames
+	// from one sender stay in order, so the broadcast after it is the next
+	// frame everyone else sees
+	assert.Nil(t, a.Send(RouteFrame(b.SessionTag(), []byte("for b"))))
+	assert.Nil(t, a.Send([]byte("for all")))
+	assert.Equal(t, []byte("for b"), receiveWithin(t, b, time.Second))
+	for _, conn := range []*comm.Comm{b, c, legacy} {
+		assert.Equal(t, []byte("for all"), receiveWithin(t, conn, time.Second))
+	}
+
+	// a frame for a tag nobody has goes nowhere
+	assert.Nil(t, c.Send(RouteFrame("0123456789abcdef", []byte("for nobody"))))
+	assert.Nil(t, c.Send([]byte("after nobody")))
+	for _, conn := range []*comm.Comm{a, b, legacy} {
+		assert.Equal(t, []byte("after nobody"), receiveWithin(t, conn, time.Second))
+	}
+
+	// a connection that did not declare routing has its frames broadcast
+	// as they are
+	routed := RouteFrame(a.SessionTag(), []byte("not routed"))
+	assert.Nil(t, legacy.Send(routed))
+	for _, conn := range []*comm.Comm{a, b, c} {
+		assert.Equal(t, routed, receiveWithin(t, conn, time.Second))
+	}
+}
+
+func TestSlowReaderOnlyHoldsUpItsRoom(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	// registered first so it runs after the connections are closed
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	addr := l.Addr().String()
+	join := func(room string) *comm.Comm {
+		c, _, _, err := ConnectToTCPServer(addr, "pass123", room, time.Second)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+
+	// a peer that never reads lets the relay's writes to it back up
+	flooder := join("slow")
+	join("slow")
+	go func() {
+		frame := make([]byte, 1<<16)
+		for flooder.Send(frame) == nil {
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	// which must not stop other rooms from being joined or relaying
+	joined := make(chan [2]*comm.Comm, 1)
+	go func() {
+		joined <- [2]*comm.Comm{join("fast"), join("fast")}
+	}()
+	var fast [2]*comm.Comm
+	select {
+	case fast = <-joined:
+	case <-time.After(3 * time.Second):
+		t.Fatal("could not join a room while another room was backed up")
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			b, err := fast[0].Receive()
+			if err != nil || len(b) > 1 {
+				received <- b
+				return
+			}
+		}
+	}()
+	assert.Nil(t, fast[1].Send([]byte("hello")))
+	select {
+	case b := <-received:
+		assert.Equal(t, []byte("hello"), b)
+	case <-time.After(3 * time.Second):
+		t.Fatal("frame was not relayed while another room was backed up")
+	}
+}
+
+func TestConnectionGoroutines(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	addr := l.Addr().String()
+	assert.Eventually(t, func() bool { return PingServer(addr) == nil }, 2*time.Second, 10*time.Millisecond)
+	// settle waits for the goroutines of closed connections to finish
+	settle := func(limit int) int {
+		deadline := time.Now().Add(5 * time.Second)
+		n := runtime.NumGoroutine()
+		for n > limit && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			n = runtime.NumGoroutine()
+		}
+		return n
+	}
+	base := settle(0)
+
+	// a connection waiting alone in its room has a single goroutine
+	const waiting = 50
+	conns := make([]*comm.Comm, waiting)
+	for i := range conns {
+		conns[i], _, _, err = ConnectToTCPServer(addr, "pass123", fmt.Sprintf("waiting-%d", i), time.Second)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+	}
+	assert.LessOrEqual(t, settle(base+waiting), base+waiting)
+	for _, c := range conns {
+		c.Close()
+	}
+	assert.LessOrEqual(t, settle(base), base)
+
+	// and churn leaves nothing behind; a leak of even one goroutine in
+	// every few connections shows well above the settling slack
+	const cycles, workers = 500, 32
+	var next atomic.Int64
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := next.Add(1); i <= cycles; i = next.Add(1) {
+				c, _, _, err := ConnectToTCPServer(addr, "pass123", fmt.Sprintf("churn-%d", i), 5*time.Second)
+				if err != nil {
+					failed.Add(1)
+					continue
+				}
+				c.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Zero(t, failed.Load())
+	assert.LessOrEqual(t, settle(base), base)
+}
+
+func TestActivationListeners(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no socket activation on windows")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	defer f.Close()
+	pid := fmt.Sprint(os.Getpid())
+
+	listeners, err := activationListeners(pid, "1", int(f.Fd()))
+	assert.Nil(t, err)
+	if assert.Len(t, listeners, 1) {
+		defer listeners[0].Close()
+		port := fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+		assert.Equal(t, listeners[0], ListenerOnPort(listeners, port))
+		assert.Nil(t, ListenerOnPort(listeners, "1"))
+	}
+
+	// sockets meant for another process are left alone
+	listeners, err = activationListeners("1", "1", int(f.Fd()))
+	assert.Nil(t, err)
+	assert.Empty(t, listeners)
+	listeners, err = activationListeners("", "", listenFDsStart)
+	assert.Nil(t, err)
+	assert.Empty(t, listeners)
+	_, err = activationListeners(pid, "two", listenFDsStart)
+	assert.NotNil(t, err)
+}
+
+func TestSetuidValidation(t *testing.T) {
+	err := Validate("127.0.0.1", "8412", "pass123", WithSetuid("no-such-croc-user"))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "cannot switch to user no-such-croc-user")
+	}
+	assert.Nil(t, Validate("127.0.0.1", "8412", "pass123", WithSetuid("")))
+}
+
+func TestSniffJunk(t *testing.T) {
+	log.SetLevel("error")
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8413", "pass123"
+	for _, opt := range []serverOptsFunc{WithLogLevel("error"), WithStrictRoomNames(false), WithSniffTimeout(300 * time.Millisecond)} {
+		assert.Nil(t, opt(s))
+	}
+	assert.NotNil(t, WithSniffTimeout(-time.Second)(s))
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+
+	// closed reports whether the relay hangs up on conn within d
+	closed := func(conn net.Conn, d time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(d))
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		return err != nil && !(errors.As(err, &netErr) && netErr.Timeout())
+	}
+
+	// an HTTP request is turned away as soon as it arrives
+	conn, err := net.Dial("tcp", "127.0.0.1:8413")
+	assert.Nil(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: relay\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, closed(conn, 2*time.Second))
+	assert.Less(t, time.Since(start), 250*time.Millisecond)
+
+	// a connection that says nothing is closed when the deadline passes
+	quiet, err := net.Dial("tcp", "127.0.0.1:8413")
+	assert.Nil(t, err)
+	defer quiet.Close()
+	assert.False(t, closed(quiet, 100*time.Millisecond))
+	assert.True(t, closed(quiet, 2*time.Second))
+
+	assert.Equal(t, int64(2), s.Stats().Errors[errorProtocolJunk])
+	assert.Zero(t, s.Stats().Errors[errorHandshake])
+	assert.Equal(t, "300ms", s.Stats().Limits.SniffTimeout)
+
+	// croc clients are not held up
+	assert.Nil(t, PingServer("127.0.0.1:8413"))
+	c, _, _, err := ConnectToTCPServer("127.0.0.1:8413", "pass123", "sniffed", time.Minute)
+	if assert.Nil(t, err) {
+		c.Close()
+	}
+	assert.Equal(t, int64(2), s.Stats().Errors[errorProtocolJunk])
+}
+
+// spanAttrs returns the attributes of a span or event by key.
+func spanAttrs(attrs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(attrs))
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+// endedSpans returns the spans rec saw end with the given name.
+func endedSpans(rec *tracetest.SpanRecorder, name string) (spans []sdktrace.ReadOnlySpan) {
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			spans = append(spans, s)
+		}
+	}
+	return
+}
+
+// childSpans returns the spans rec saw start under parent, in order.
+func childSpans(rec *tracetest.SpanRecorder, parent sdktrace.ReadOnlySpan) (names []string, spans []sdktrace.ReadOnlySpan) {
+	for _, s := range rec.Started() {
+		if s.Parent().SpanID() == parent.SpanContext().SpanID() {
+			names = append(names, s.Name())
+			spans = append(spans, s)
+		}
+	}
+	return
+}
+
+func TestTracing(t *testing.T) {
+	log.SetLevel("error")
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	assert.NotNil(t, WithTracerProvider(nil)(newDefaultServer()))
+	go RunWithOptionsAsync("127.0.0.1", "8414", "pass123", WithLogLevel("error"), WithStrictRoomNames(false), WithTracerProvider(tp))
+	time.Sleep(100 * time.Millisecond)
+
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8414", "pass123", "tracing", time.Second)
+	assert.Nil(t, err)
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8414", "pass123", "tracing", time.Second)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, c2.Send([]byte("hello")))
+	}
+	for i := 0; i < 3; i++ {
+		for {
+			// skip the room ready byte
+			b, err := c1.Receive()
+			assert.Nil(t, err)
+			if err != nil || !bytes.Equal(b, []byte{1}) {
+				break
+			}
+		}
+	}
+	c1.Close()
+	c2.Close()
+	_, _, _, err = ConnectToTCPServer("127.0.0.1:8414", "wrong", "tracing", time.Second)
+	assert.NotNil(t, err)
+
+	assert.Eventually(t, func() bool { return len(endedSpans(rec, spanConnection)) == 3 }, 2*time.Second, 10*time.Millisecond)
+	var frames int64
+	for _, conn := range endedSpans(rec, spanConnection) {
+		attrs := spanAttrs(conn.Attributes())
+		assert.NotEmpty(t, attrs[attrRemoteAddress].AsString())
+		names, children := childSpans(rec, conn)
+		for _, child := range children {
+			assert.False(t, child.EndTime().IsZero(), child.Name())
+		}
+		if _, ok := attrs[attrRoom]; !ok {
+			// turned away with a bad password
+			if assert.Equal(t, []string{spanPAKE, spanAuth}, names) {
+				assert.Equal(t, codes.Error, children[1].Status().Code)
+				assert.Len(t, children[1].Events(), 1, "the error is recorded")
+			}
+			continue
+		}
+		assert.Equal(t, "tracing", attrs[attrRoom].AsString())
+		assert.Equal(t, []string{spanPAKE, spanAuth, spanRoomJoin}, names)
+		for _, e := range conn.Events() {
+			if e.Name == eventBroadcast {
+				frames += spanAttrs(e.Attributes)[attrFrames].AsInt64()
+			}
+		}
+	}
+	assert.Equal(t, int64(3), frames)
+
+	// connections in a room that expires are told so
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	for _, opt := range []serverOptsFunc{WithClock(fake), WithRoomTTL(time.Hour), WithRoomCleanupInterval(time.Hour), WithLogLevel("error"), WithTracerProvider(tp)} {
+		assert.Nil(t, opt(s))
+	}
+	s.logger.SetLevel("error")
+	_, span := s.tracer.Start(context.Background(), spanConnection)
+	s.rooms.rooms = map[string]roomInfo{"expiring": {opened: fake.Now(), spans: map[*comm.Comm]trace.Span{nil: span}}}
+	go s.deleteOldRooms()
+	defer s.stopRoomDeletion()
+	fake.BlockUntil(1)
+	fake.Advance(2 * time.Hour)
+	assert.Eventually(t, func() bool {
+		events := span.(sdktrace.ReadOnlySpan).Events()
+		return len(events) == 1 && events[0].Name == eventRoomExpired && spanAttrs(events[0].Attributes)[attrRoom].AsString() == "expiring"
+	}, time.Second, time.Millisecond)
+}
+
+func TestHandoffRooms(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr, port := l.Addr().String(), fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+	u := newUpgrader()
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithUpgrader(u), WithLogLevel("error"), WithStrictRoomNames(false))
+	}()
+	join := func(addr string, req RoomRequest) *comm.Comm {
+		var c *comm.Comm
+		assert.Eventually(t, func() bool {
+			c, _, _, err = ConnectToRoom(addr, "pass123", req, time.Second)
+			return err == nil
+		}, 2*time.Second, 10*time.Millisecond)
+		return c
+	}
+	waiting := join(addr, RoomRequest{Room: "waiting", Policy: RoomPolicyLatestOnly, Mode: RoomModeChat, DenyObservers: true})
+	defer waiting.Close()
+	sender := join(addr, RoomRequest{Room: "busy", Mode: RoomModeTransfer})
+	receiver := join(addr, RoomRequest{Room: "busy", Mode: RoomModeTransfer})
+	_, err = sender.Receive()
+	assert.Nil(t, err)
+
+	// the registry survives the trip to the new process
+	u.mu.Lock()
+	_, state := u.state()
+	u.mu.Unlock()
+	var buf bytes.Buffer
+	assert.Nil(t, writeHandoffState(&buf, state))
+	got, err := readHandoffState(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{port}, got.Ports)
+	records := got.Rooms[port]
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, roomRecord{Room: "busy", Opened: records[0].Opened, Mode: RoomModeTransfer}, records[0])
+		assert.Equal(t, roomRecord{Room: "waiting", Opened: records[1].Opened, Policy: RoomPolicyLatestOnly, Mode: RoomModeChat, DenyObservers: true}, records[1])
+		assert.WithinDuration(t, time.Now(), records[1].Opened, time.Minute)
+	}
+	_, err = readHandoffState(strings.NewReader("{"))
+	assert.NotNil(t, err)
+
+	// draining sends the waiting client off to reconnect and lets the
+	// transfer finish
+	u.drain()
+	_, err = waiting.Receive()
+	assert.NotNil(t, err)
+	assert.Nil(t, sender.Send([]byte("still here")))
+	data, err := receiver.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("still here"), data)
+	select {
+	case <-done:
+		t.Fatal("relay stopped before the transfer was done")
+	case <-time.After(100 * time.Millisecond):
+	}
+	sender.Close()
+	receiver.Close()
+	select {
+	case err = <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop after draining")
+	}
+
+	// the relay taking over has the rooms, which peers rejoin
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l2.Close()
+	u2 := newUpgrader()
+	u2.rooms = map[string][]roomRecord{fmt.Sprint(l2.Addr().(*net.TCPAddr).Port): records}
+	s, err := configure("127.0.0.1", "", "pass123", []serverOptsFunc{WithListener(l2), WithUpgrader(u2), WithLogLevel("error"), WithStrictRoomNames(false)})
+	assert.Nil(t, err)
+	go s.start()
+	assert.Eventually(t, func() bool {
+		s.rooms.Lock()
+		defer s.rooms.Unlock()
+		return len(s.rooms.rooms) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	s.rooms.Lock()
+	r := s.rooms.rooms["waiting"]
+	s.rooms.Unlock()
+	assert.Equal(t, RoomPolicyLatestOnly, r.policy)
+	assert.Equal(t, RoomModeChat, r.mode)
+	assert.True(t, r.opened.Equal(records[1].Opened))
+	sender = join(l2.Addr().String(), RoomRequest{Room: "busy"})
+	defer sender.Close()
+	receiver = join(l2.Addr().String(), RoomRequest{Room: "busy"})
+	defer receiver.Close()
+	assert.Nil(t, receiver.Send([]byte("back")))
+	_, err = sender.Receive() // the room is ready
+	assert.Nil(t, err)
+	data, err = sender.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("back"), data)
+}
+
+func TestRoomTokens(t *testing.T) {
+	var tokens roomTokens
+	now := time.Unix(1_700_000_000, 0)
+	room := strings.Repeat("a", 64)
+
+	token, err := tokens.claim(room, now)
+	assert.Nil(t, err)
+	assert.Len(t, token, roomTokenDigits)
+	got, err := tokens.resolve("192.0.2.1", token, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, room, got)
+	// a token is only good once
+	_, err = tokens.resolve("192.0.2.2", token, now.Add(time.Minute))
+	assert.True(t, errors.Is(err, ErrUnknownRoomToken))
+
+	// and only until it expires
+	token, err = tokens.claim(room, now)
+	assert.Nil(t, err)
+	_, err = tokens.resolve("192.0.2.3", token, now.Add(RoomTokenTTL))
+	assert.True(t, errors.Is(err, ErrUnknownRoomToken))
+	token, err = tokens.claim(room, now)
+	assert.Nil(t, err)
+	tokens.sweep(now.Add(RoomTokenTTL))
+	assert.Empty(t, tokens.tokens)
+
+	// a host guessing runs out of attempts, good token or not, until the
+	// window has passed
+	token, err = tokens.claim(room, now)
+	assert.Nil(t, err)
+	for i := 0; i < maxTokenAttempts; i++ {
+		_, err = tokens.resolve("192.0.2.4", "guess", now)
+		assert.True(t, errors.Is(err, ErrUnknownRoomToken))
+	}
+	_, err = tokens.resolve("192.0.2.4", token, now)
+	assert.True(t, errors.Is(err, ErrTooManyTokenAttempts))
+	got, err = tokens.resolve("192.0.2.4", token, now.Add(tokenAttemptWindow))
+	assert.Nil(t, err)
+	assert.Equal(t, room, got)
+}
+
+func TestClaimRoomToken(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8434", "pass123", WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	room := strings.Repeat("b", 64)
+	token, err := ClaimRoomToken("127.0.0.1:8434", "pass123", room)
+	assert.Nil(t, err)
+	got, err := ResolveRoomToken("127.0.0.1:8434", "pass123", token)
+	assert.Nil(t, err)
+	assert.Equal(t, room, got)
+	_, err = ResolveRoomToken("127.0.0.1:8434", "pass123", token)
+	assert.True(t, errors.Is(err, ErrUnknownRoomToken))
+
+	// only room hashes can be claimed
+	_, err = ClaimRoomToken("127.0.0.1:8434", "pass123", "guessable")
+	assert.True(t, errors.Is(err, ErrInvalidRoom))
+	_, err = ClaimRoomToken("127.0.0.1:8434", "wrong", room)
+	assert.NotNil(t, err)
+
+	// both peers then join the room the token stood for
+	c1, _, _, err := ConnectToTCPServer("127.0.0.1:8434", "pass123", got, time.Minute)
+	assert.Nil(t, err)
+	defer c1.Close()
+	c2, _, _, err := ConnectToTCPServer("127.0.0.1:8434", "pass123", room, time.Minute)
+	assert.Nil(t, err)
+	defer c2.Close()
+	// the peer that waited is told the other arrived
+	assert.Equal(t, []byte{1}, receiveWithin(t, c1, time.Second))
+	assert.Nil(t, c2.Send([]byte("hello")))
+	assert.Equal(t, []byte("hello"), receiveWithin(t, c1, time.Second))
+}
+
+func TestReload(t *testing.T) {
+	log.SetLevel("error")
+	reloader := NewReloader()
+	s := newDefaultServer()
+	s.host, s.port, s.settings.password = "127.0.0.1", "8417", "pass123"
+	for _, opt := range []serverOptsFunc{WithLogLevel("error"), WithStrictRoomNames(false), WithBanner("8418"), WithReloader(reloader)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	time.Sleep(100 * time.Millisecond)
+
+	c, banner, _, err := ConnectToTCPServer("127.0.0.1:8417", "pass123", "room-before-reload", time.Minute)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer c.Close()
+	assert.Equal(t, "8418", banner)
+
+	assert.NotNil(t, reloader.Reload("8417", RelayConfig{Password: "new", MaxRoomsPerIP: -1}))
+	assert.NotNil(t, reloader.Reload("8419", RelayConfig{Password: "new"}))
+	assert.Equal(t, "pass123", s.current().password, "a failed reload changes nothing")
+
+	assert.Nil(t, reloader.Reload("8417", RelayConfig{Password: "new", Banner: "8418,8419", MaxRoomsPerIP: 2, BlockedClients: []string{"bad/*"}}))
+	_, _, _, err = ConnectToTCPServer("127.0.0.1:8417", "pass123", "other-room", time.Minute)
+	assert.NotNil(t, err)
+	c2, banner, _, err := ConnectToTCPServer("127.0.0.1:8417", "new", "room-after-reload", time.Minute)
+	if assert.Nil(t, err) {
+		defer c2.Close()
+		assert.Equal(t, "8418,8419", banner)
+	}
+	_, _, _, err = ConnectToRoom("127.0.0.1:8417", "new", RoomRequest{Room: "blocked-room", App: "bad/1.0"}, time.Minute)
+	assert.ErrorIs(t, err, ErrUpgradeRequired)
+	_, _, _, err = ConnectToTCPServer("127.0.0.1:8417", "new", "third-room", time.Minute)
+	assert.ErrorIs(t, err, ErrTooManyRooms)
+	assert.Equal(t, 2, s.Stats().Limits.MaxRoomsPerIP)
+
+	// rooms opened before the reload stay
+	s.rooms.Lock()
+	_, ok := s.rooms.rooms["room-before-reload"]
+	s.rooms.Unlock()
+	assert.True(t, ok)
+}
+
+// callControl answers a control request to s from 192.0.2.1.
+func callControl(t *testing.T, s *server, method string, params any) controlResponse {
+	req := map[string]any{"method": method, "id": 7}
+	if params != nil {
+		req["params"] = params
+	}
+	b, err := json.Marshal(req)
+	assert.Nil(t, err)
+	resp := s.handleControl(b, "192.0.2.1:4000", newConnLogger(s.logger, nil, 1, "192.0.2.1:4000"))
+	if resp.Error == nil {
+		assert.Equal(t, uint64(7), resp.ID)
+	}
+	return resp
+}
+
+func TestControlWhoami(t *testing.T) {
+	s := newDefaultServer()
+	resp := callControl(t, s, "whoami", nil)
+	assert.Nil(t, resp.Error)
+	assert.JSONEq(t, `{"address":"192.0.2.1:4000","host":"192.0.2.1"}`, string(resp.Result))
+}
+
+func TestControlSettings(t *testing.T) {
+	s := newDefaultServer()
+	s.settings = settings{password: "secret", banner: "8445", maxRoomsPerIP: 4}
+	s.version = "v10.9.9"
+	resp := callControl(t, s, "settings", nil)
+	assert.Nil(t, resp.Error)
+	var st RelaySettings
+	assert.Nil(t, json.Unmarshal(resp.Result, &st))
+	assert.Equal(t, "8445", st.Banner)
+	assert.Equal(t, "v10.9.9", st.Version)
+	assert.Equal(t, 4, st.MaxRoomsPerIP)
+	assert.Equal(t, DEFAULT_ROOM_TTL, st.RoomTTL)
+	assert.Contains(t, st.Capabilities, CapabilityControlRPC)
+	assert.NotContains(t, string(resp.Result), "secret")
+}
+
+func TestControlTokens(t *testing.T) {
+	s := newDefaultServer()
+	room := strings.Repeat("c", 64)
+	resp := callControl(t, s, "token.claim", map[string]string{"room": room})
+	assert.Nil(t, resp.Error)
+	var claimed tokenParams
+	assert.Nil(t, json.Unmarshal(resp.Result, &claimed))
+	assert.Len(t, claimed.Token, roomTokenDigits)
+
+	resp = callControl(t, s, "token.resolve", map[string]string{"token": claimed.Token})
+	assert.Nil(t, resp.Error)
+	assert.JSONEq(t, `{"room":"`+room+`"}`, string(resp.Result))
+	resp = callControl(t, s, "token.resolve", map[string]string{"token": claimed.Token})
+	assert.ErrorIs(t, resp.Error, ErrUnknownRoomToken)
+
+	resp = callControl(t, s, "token.claim", map[string]string{"room": "guessable"})
+	assert.ErrorIs(t, resp.Error, ErrInvalidRoom)
+	resp = callControl(t, s, "token.claim", nil)
+	assert.Equal(t, controlErrBadRequest, resp.Error.Code)
+}
+
+func TestControlErrors(t *testing.T) {
+	s := newDefaultServer()
+	resp := callControl(t, s, "rooms.list", nil)
+	assert.ErrorIs(t, resp.Error, ErrUnknownControlMethod)
+	resp = s.handleControl([]byte("not json"), "192.0.2.1:4000", newConnLogger(s.logger, nil, 1, "pipe"))
+	assert.Equal(t, controlErrBadRequest, resp.Error.Code)
+	resp = s.handleControl(make([]byte, maxControlRequest+1), "192.0.2.1:4000", newConnLogger(s.logger, nil, 1, "pipe"))
+	assert.Equal(t, controlErrBadRequest, resp.Error.Code)
+
+	// every method has a limit of its own per host
+	for i := 0; i < controlMethods["whoami"].limit; i++ {
+		assert.Nil(t, callControl(t, s, "whoami", nil).Error)
+	}
+	assert.ErrorIs(t, callControl(t, s, "whoami", nil).Error, ErrControlRateLimited)
+	assert.Nil(t, callControl(t, s, "settings", nil).Error)
+	assert.Equal(t, int64(1), s.errors.totals(s.clock.Now())[errorControlRateLimited])
+	s.controlLimits.sweep(s.clock.Now().Add(controlLimitWindow))
+	assert.Empty(t, s.controlLimits.calls)
+}
+
+func TestDialControl(t *testing.T) {
+	log.SetLevel("error")
+	go RunWithOptionsAsync("127.0.0.1", "8444", "pass123", WithBanner("8445"), WithLogLevel("error"))
+	time.Sleep(100 * time.Millisecond)
+
+	cc, err := DialControl("127.0.0.1:8444", "pass123")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer cc.Close()
+	w, err := cc.Whoami()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", w.Host)
+	st, err := cc.Settings()
+	assert.Nil(t, err)
+	assert.Equal(t, "8445", st.Banner)
+
+	// tokens claimed on the channel resolve as those claimed by room name
+	room := strings.Repeat("d", 64)
+	var claimed tokenParams
+	assert.Nil(t, cc.Call("token.claim", tokenParams{Room: room}, &claimed))
+	got, err := ResolveRoomToken("127.0.0.1:8444", "pass123", claimed.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, room, got)
+	assert.ErrorIs(t, cc.Call("token.resolve", tokenParams{Token: claimed.Token}, nil), ErrUnknownRoomToken)
+	assert.ErrorIs(t, cc.Call("nope", nil, nil), ErrUnknownControlMethod)
+
+	_, err = DialControl("127.0.0.1:8444", "wrong")
+	assert.NotNil(t, err)
+}
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"10.0.0.1:9009", "10.0.0.2:9009", "10.0.0.3:9009"}
+	ring := newHashRing(nodes, ringReplicas)
+	reversed := newHashRing([]string{nodes[2], nodes[1], nodes[0]}, ringReplicas)
+	smaller := newHashRing(nodes[:2], ringReplicas)
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%064x", i)
+		owner := ring.owner(key)
+		owned[owner]++
+		assert.Equal(t, owner, reversed.owner(key), "the order of the peers does not matter")
+		// dropping an instance only moves the rooms it owned
+		if owner != nodes[2] {
+			assert.Equal(t, owner, smaller.owner(key))
+		}
+	}
+	for _, node := range nodes {
+		assert.Greater(t, owned[node], 700, node)
+	}
+	assert.Empty(t, newHashRing(nil, ringReplicas).owner("room"))
+}
+
+func TestWithCluster(t *testing.T) {
+	peers := []string{"10.0.0.1:9009", "10.0.0.2:9009"}
+	for _, opt := range []serverOptsFunc{
+		WithCluster("10.0.0.3:9009", peers, ClusterRedirect),
+		WithCluster(peers[0], peers, "anycast"),
+		WithCluster(peers[0], append(peers, "10.0.0.3"), ClusterProxy),
+		WithCluster(peers[0], append(peers, peers[1]), ClusterProxy),
+	} {
+		assert.NotNil(t, opt(newDefaultServer()))
+	}
+	s := newDefaultServer()
+	assert.Nil(t, WithCluster("", nil, "")(s), "no peers is no cluster")
+	assert.Nil(t, s.cluster)
+	assert.Nil(t, WithCluster(peers[1], peers, ClusterProxy)(s))
+	assert.Contains(t, s.dumpConfig(), "cluster self: 10.0.0.2:9009\ncluster policy: proxy")
+
+	policy, err := ParseClusterPolicy(" Proxy ")
+	assert.Nil(t, err)
+	assert.Equal(t, ClusterProxy, policy)
+
+	// only instances say whom they forward for
+	req := RoomRequest{Room: "room", forwardedFor: "192.0.2.7"}
+	assert.Equal(t, req, parseRoomRequest(encodeRoomRequest(req)))
+	assert.Empty(t, parseRoomRequest("room\x00forwarded=not-a-host").forwardedFor)
+}
+
+// startCluster starts three relays that form a cluster with policy and
+// returns their addresses.
+func startCluster(t *testing.T, policy ClusterPolicy) []string {
+	log.SetLevel("error")
+	listeners := make([]net.Listener, 3)
+	peers := make([]string, len(listeners))
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		listeners[i], peers[i] = l, l.Addr().String()
+	}
+	for i, l := range listeners {
+		done := make(chan error, 1)
+		go func() {
+			done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithCluster(peers[i], peers, policy))
+		}()
+		t.Cleanup(func() {
+			l.Close()
+			<-done
+		})
+	}
+	return peers
+}
+
+// roomOwnedBy returns a room the instance at peers[owner] owns.
+func roomOwnedBy(peers []string, owner int) string {
+	ring := newHashRing(peers, ringReplicas)
+	for i := 0; ; i++ {
+		if room := fmt.Sprintf("%064x", i); ring.owner(room) == peers[owner] {
+			return room
+		}
+	}
+}
+
+// meetInCluster has two peers join room through different instances and
+// checks that they meet, returning their connections.
+func meetInCluster(t *testing.T, peers []string, room string, capabilities ...string) (a, b *comm.Comm) {
+	join := func(address string) *comm.Comm {
+		c, _, _, err := ConnectToRoom(address, "pass123", RoomRequest{Room: room, Capabilities: capabilities}, time.Second)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(c.Close)
+		return c
+	}
+	a = join(peers[0])
+	b = join(peers[1])
+	ready := receiveWithin(t, a, time.Second)
+	if IsControlFrame(ready) {
+		kind, err := ParseControlFrame(a, ready)
+		assert.Nil(t, err)
+		assert.Equal(t, ControlRoomReady, kind)
+	} else {
+		assert.Equal(t, []byte{1}, ready)
+	}
+	assert.Nil(t, a.Send([]byte("hello")))
+	assert.Equal(t, []byte("hello"), receiveWithin(t, b, time.Second))
+	assert.Nil(t, b.Send([]byte("hi")))
+	assert.Equal(t, []byte("hi"), receiveWithin(t, a, time.Second))
+	return
+}
+
+func TestClusterRedirect(t *testing.T) {
+	peers := startCluster(t, ClusterRedirect)
+	a, b := meetInCluster(t, peers, roomOwnedBy(peers, 2))
+	// both followed the redirect to the owner
+	for _, c := range []*comm.Comm{a, b} {
+		assert.Equal(t, peers[2], c.Connection().RemoteAddr().String())
+	}
+	// a room of the first instance is joined there, and through it
+	a, b = meetInCluster(t, peers, roomOwnedBy(peers, 0))
+	assert.Equal(t, peers[0], a.Connection().RemoteAddr().String())
+	assert.Equal(t, peers[0], b.Connection().RemoteAddr().String())
+}
+
+func TestClusterProxy(t *testing.T) {
+	peers := startCluster(t, ClusterProxy)
+	a, b := meetInCluster(t, peers, roomOwnedBy(peers, 2), CapabilityControlFrames, CapabilityRouting, comm.CapabilityEOF)
+	assert.Equal(t, peers[0], a.Connection().RemoteAddr().String())
+	assert.Equal(t, peers[1], b.Connection().RemoteAddr().String())
+
+	// session tags are those of the owner, so routed frames find their way
+	assert.Len(t, a.SessionTag(), sessionTagLen)
+	assert.Nil(t, a.Send(RouteFrame(b.SessionTag(), []byte("for b"))))
+	assert.Equal(t, []byte("for b"), receiveWithin(t, b, time.Second))
+
+	// a peer done sending still gets replies
+	assert.Nil(t, a.SendEOF())
+	_, err := b.Receive()
+	assert.ErrorIs(t, err, comm.ErrPeerDone)
+	assert.Nil(t, b.Send([]byte("bye")))
+	assert.Equal(t, []byte("bye"), receiveWithin(t, a, time.Second))
+
+	// refusals of the owner are passed on
+	_, _, _, err = ConnectToRoom(peers[0], "pass123", RoomRequest{Room: "not a room"}, time.Second)
+	assert.ErrorIs(t, err, ErrInvalidRoom)
+}
+
+func TestClusterOwnerDown(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	// nobody listens at the other address
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+	gone.Close()
+	peers := []string{l.Addr().String(), gone.Addr().String()}
+	done := make(chan error, 1)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", "", "pass123", WithListener(l), WithLogLevel("error"), WithCluster(peers[0], peers, ClusterProxy))
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the room is joined where the client asked rather than not at all
+	c, _, _, err := ConnectToRoom(peers[0], "pass123", RoomRequest{Room: roomOwnedBy(peers, 1)}, time.Second)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	assert.Equal(t, peers[0], c.Connection().RemoteAddr().String())
+}
+
+func TestTooManyRedirects(t *testing.T) {
+	log.SetLevel("error")
+	// two relays that each think the other owns every room
+	var listeners [2]net.Listener
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.Nil(t, err) {
+			return
+		}
+		listeners[i] = l
+	}
+	for i, l := range listeners {
+		other := listeners[1-i].Addr().String()
+		s := newDefaultServer()
+		s.host, s.settings.password, s.listener, s.debugLevel = "127.0.0.1", "pass123", l, "error"
+		s.port = fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+		s.cluster = &cluster{self: l.Addr().String(), peers: []string{l.Addr().String(), other}, policy: ClusterRedirect, ring: newHashRing([]string{other}, ringReplicas)}
+		done := make(chan error, 1)
+		go func() { done <- s.start() }()
+		t.Cleanup(func() {
+			l.Close()
+			<-done
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, _, _, err := ConnectToRoom(listeners[0].Addr().String(), "pass123", RoomRequest{Room: roomOwnedBy([]string{"x"}, 0)}, time.Second)
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+}
+
+func TestControl(t *testing.T) {
+	for _, c := range []Control{
+		{Kind: ControlRoomReady},
+		{Kind: ControlRoomExpiring, Left: 5 * time.Minute},
+		{Kind: ControlQuotaWarning, Used: 80},
+	} {
+		parsed, err := parseControl(c.String())
+		assert.Nil(t, err)
+		assert.Equal(t, c, parsed)
+	}
+	assert.Equal(t, "expiring 299", Control{Kind: ControlRoomExpiring, Left: 299900 * time.Millisecond}.String())
+	// kinds from a newer relay are passed on as they are
+	c, err := parseControl("moved somewhere")
+	assert.Nil(t, err)
+	assert.Equal(t, Control{Kind: "moved"}, c)
+	for _, text := range []string{"expiring", "expiring soon", "expiring -1", "quota", "quota most"} {
+		_, err = parseControl(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestRoomUsage(t *testing.T) {
+	var u roomUsage
+	for _, n := range []int64{500, 299} {
+		warn, exceeded := u.charge(n, 1000, 0.8)
+		assert.False(t, warn)
+		assert.False(t, exceeded)
+	}
+	warn, exceeded := u.charge(1, 1000, 0.8)
+	assert.True(t, warn)
+	assert.False(t, exceeded)
+	// the warning comes once
+	warn, exceeded = u.charge(200, 1000, 0.8)
+	assert.False(t, warn)
+	assert.False(t, exceeded)
+	_, exceeded = u.charge(1, 1000, 0.8)
+	assert.True(t, exceeded)
+
+	// no quota, no warning
+	u = roomUsage{}
+	warn, exceeded = u.charge(1<<40, 0, 0.8)
+	assert.False(t, warn || exceeded)
+	assert.Equal(t, int64(1<<40), u.relayed)
+	u = roomUsage{}
+	warn, exceeded = u.charge(900, 1000, 0)
+	assert.False(t, warn || exceeded)
+}
+
+func TestLimitWarnings(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	s.host, s.settings.password = "127.0.0.1", "pass123"
+	for _, opt := range []serverOptsFunc{WithListener(l), WithClock(fake), WithRoomTTL(time.Hour), WithRoomCleanupInterval(10 * time.Minute),
+		WithRoomByteQuota(1000), WithLimitWarnings(0.8, 5*time.Minute), WithLogLevel("error"), WithStrictRoomNames(false)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	defer l.Close()
+	// the cleanup and expiry tickers
+	fake.BlockUntil(2)
+
+	// warned asks for warnings; legacy is a croc client that does not
+	join := func(room string) (warned, legacy *comm.Comm) {
+		warned, _, _, err := ConnectToRoom(addr, "pass123", RoomRequest{Room: room, Capabilities: []string{CapabilityLimitWarnings}}, time.Minute)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.True(t, warned.RelaySupports(CapabilityLimitWarnings))
+		legacy, _, _, err = ConnectToTCPServer(addr, "pass123", room, time.Minute)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, []byte{1}, receiveWithin(t, warned, time.Second))
+		return
+	}
+	control := func(c *comm.Comm) Control {
+		t.Helper()
+		data := receiveWithin(t, c, time.Second)
+		control, err := ParseControl(c, data)
+		assert.Nil(t, err, "%q", data)
+		return control
+	}
+	events := func(want map[string]int64) {
+		t.Helper()
+		assert.Eventually(t, func() bool { return assert.ObjectsAreEqual(want, s.Stats().LimitEvents) }, time.Second, time.Millisecond)
+	}
+
+	warned, legacy := join("limits")
+	defer warned.Close()
+	defer legacy.Close()
+	assert.Nil(t, legacy.Send(make([]byte, 700)))
+	assert.Len(t, receiveWithin(t, warned, time.Second), 700)
+	// the frame that takes the room to 80% of its quota comes with a
+	// warning
+	assert.Nil(t, legacy.Send(make([]byte, 100)))
+	assert.Len(t, receiveWithin(t, warned, time.Second), 100)
+	assert.Equal(t, Control{Kind: ControlQuotaWarning, Used: 80}, control(warned))
+	events(map[string]int64{limitQuotaWarning: 1})
+	// which the legacy client never sees
+	assert.Nil(t, warned.Send([]byte("more")))
+	assert.Equal(t, []byte("more"), receiveWithin(t, legacy, time.Second))
+
+	// five minutes before its TTL the room is warned of that
+	fake.Advance(54 * time.Minute)
+	fake.Advance(time.Minute)
+	assert.Equal(t, Control{Kind: ControlRoomExpiring, Left: 5 * time.Minute}, control(warned))
+	events(map[string]int64{limitQuotaWarning: 1, limitExpiryWarning: 1})
+
+	// and the quota is enforced as it was: the frame that passes it is
+	// dropped and the room deleted
+	assert.Nil(t, legacy.Send(make([]byte, 200)))
+	_, err = warned.Receive()
+	assert.NotNil(t, err)
+	_, err = legacy.Receive()
+	assert.NotNil(t, err)
+	events(map[string]int64{limitQuotaWarning: 1, limitExpiryWarning: 1, limitQuotaExceeded: 1})
+
+	// a room of the same name starts afresh, and expires at its TTL after
+	// its warning
+	warned, legacy = join("limits")
+	defer warned.Close()
+	defer legacy.Close()
+	fake.Advance(56 * time.Minute)
+	assert.Equal(t, Control{Kind: ControlRoomExpiring, Left: 4 * time.Minute}, control(warned))
+	fake.Advance(10 * time.Minute)
+	_, err = warned.Receive()
+	assert.NotNil(t, err)
+	events(map[string]int64{limitQuotaWarning: 1, limitExpiryWarning: 2, limitQuotaExceeded: 1, limitRoomExpired: 1})
+	st := s.Stats()
+	assert.Equal(t, int64(1000), st.Limits.RoomByteQuota)
+	assert.Equal(t, "5m0s", st.Limits.ExpiryWarning)
+}
+
+func TestNobodyJoinedFrames(t *testing.T) {
+	newComm := func() *comm.Comm {
+		a, b := net.Pipe()
+		t.Cleanup(func() {
+			a.Close()
+			b.Close()
+		})
+		return comm.New(a)
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	alice1, alice2, alice3 := newComm(), newComm(), newComm()
+	r := roomInfo{
+		policy:      RoomPolicyLatestOnly,
+		hosts:       make(map[*comm.Comm]string),
+		instances:   make(map[*comm.Comm]string),
+		superseded:  make(map[*comm.Comm]bool),
+		controlKeys: map[*comm.Comm][]byte{alice1: key},
+		warningKeys: map[*comm.Comm][]byte{alice2: key},
+	}
+	for _, c := range []*comm.Comm{alice1, alice2, alice3} {
+		r.conns = append(r.conns, c)
+		r.supersede(c, "10.0.0.1", "alice")
+	}
+	// alice reconnected twice, so only her last connection is there, and
+	// it cannot be told
+	assert.Equal(t, []*comm.Comm{alice3}, r.present())
+	assert.Empty(t, r.nobodyJoined())
+	// one that declared limit warnings can
+	r.superseded[alice2] = false
+	deliveries := r.nobodyJoined()
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, alice2, deliveries[0].conn)
+		assert.True(t, IsControlFrame(deliveries[0].frame))
+	}
+}
+
+func TestNobodyJoined(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	fake := testutil.NewFakeClock(time.Unix(1_700_000_000, 0))
+	s := newDefaultServer()
+	s.host, s.settings.password = "127.0.0.1", "pass123"
+	for _, opt := range []serverOptsFunc{WithListener(l), WithClock(fake), WithRoomTTL(time.Hour), WithRoomCleanupInterval(10 * time.Minute),
+		WithLogLevel("error"), WithStrictRoomNames(false)} {
+		assert.Nil(t, opt(s))
+	}
+	go s.start()
+	defer l.Close()
+	fake.BlockUntil(1)
+
+	join := func(req RoomRequest) *comm.Comm {
+		t.Helper()
+		c, _, _, err := ConnectToRoom(addr, "pass123", req, time.Minute)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	// frames returns the control frames c gets until the relay closes it.
+	frames := func(c *comm.Comm) (kinds []ControlKind) {
+		t.Helper()
+		for {
+			data, err := c.Receive()
+			if err != nil {
+				return
+			}
+			kind, err := ParseControlFrame(c, data)
+			assert.Nil(t, err, "%q", data)
+			kinds = append(kinds, kind)
+		}
+	}
+
+	// a chat that waits for a peer with a different code, a transfer
+	// that does the same and an old client that cannot be told
+	alone := join(RoomRequest{Room: "alone", Capabilities: []string{CapabilityControlFrames}})
+	transfer := join(RoomRequest{Room: "transfer", Capabilities: []string{CapabilityLimitWarnings}})
+	legacy, _, _, err := ConnectToTCPServer(addr, "pass123", "legacy", time.Minute)
+	assert.Nil(t, err)
+	defer legacy.Close()
+	// peers that met, one of which left again
+	met := join(RoomRequest{Room: "met", Capabilities: []string{CapabilityControlFrames}})
+	left := join(RoomRequest{Room: "met", Capabilities: []string{CapabilityControlFrames}})
+	assert.Equal(t, ControlRoomReady, mustControl(t, met))
+	left.Close()
+	assert.Eventually(t, func() bool { return s.Stats().Connections == 4 }, time.Second, time.Millisecond)
+
+	fake.Advance(70 * time.Minute)
+	assert.Equal(t, []ControlKind{ControlNobodyJoined}, frames(alone))
+	assert.Equal(t, []ControlKind{ControlNobodyJoined}, frames(transfer))
+	_, err = legacy.Receive()
+	assert.NotNil(t, err)
+	assert.Empty(t, frames(met))
+	st := s.Stats()
+	assert.Equal(t, int64(3), st.UnmetRooms)
+	assert.Equal(t, int64(4), st.LimitEvents[limitRoomExpired])
+}
+
+// mustControl returns the kind of the control frame c receives next.
+func mustControl(t *testing.T, c *comm.Comm) ControlKind {
+	t.Helper()
+	kind, err := ParseControlFrame(c, receiveWithin(t, c, time.Second))
+	assert.Nil(t, err)
+	return kind
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	log.SetLevel("error")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := newDefaultServer()
+	s.settings.password = "pass123"
+	for _, opt := range []serverOptsFunc{WithLogLevel("error"), WithStrictRoomNames(false), WithListener(l), WithHandshakeTimeout(300 * time.Millisecond)} {
+		assert.Nil(t, opt(s))
+	}
+	assert.NotNil(t, WithHandshakeTimeout(-time.Second)(s))
+	done := make(chan error, 1)
+	go func() { done <- s.start() }()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	addr := l.Addr().String()
+	assert.Eventually(t, func() bool { return PingServer(addr) == nil }, 2*time.Second, 10*time.Millisecond)
+	settle := func(limit int) int {
+		deadline := time.Now().Add(5 * time.Second)
+		n := runtime.NumGoroutine()
+		for n > limit && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			n = runtime.NumGoroutine()
+		}
+		return n
+	}
+	base := settle(0)
+
+	// stalling clients get through the PAKE and stop, one of them halfway
+	// through its next frame
+	const stalling = 20
+	conns := make([]net.Conn, stalling)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		defer conn.Close()
+		c := comm.New(conn)
+		A, err := pake.InitCurve(weakKey, 0, "siec")
+		assert.Nil(t, err)
+		assert.Nil(t, c.Send(A.Bytes()))
+		_, err = c.Receive()
+		assert.Nil(t, err)
+		conns[i] = conn
+	}
+	_, err = conns[0].Write(comm.MAGIC_BYTES)
+	assert.Nil(t, err)
+	assert.Greater(t, runtime.NumGoroutine(), base)
+
+	start := time.Now()
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		var netErr net.Error
+		assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the relay hangs up")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.LessOrEqual(t, settle(base), base)
+	assert.Equal(t, int64(stalling), s.Stats().Errors[errorHandshakeTimeout])
+	assert.Zero(t, s.Stats().Errors[errorHandshake])
+	assert.Equal(t, "300ms", s.Stats().Limits.HandshakeTimeout)
+
+	// clients that get through stay in their room past the deadline
+	c, _, _, err := ConnectToTCPServer(addr, "pass123", "patient", time.Minute)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	time.Sleep(500 * time.Millisecond)
+	peer, _, _, err := ConnectToTCPServer(addr, "pass123", "patient", time.Minute)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer peer.Close()
+	assert.Nil(t, c.Send([]byte("still here")))
+	b, err := peer.Receive()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("still here"), b)
+	assert.Equal(t, int64(stalling), s.Stats().Errors[errorHandshakeTimeout])
+}
@@ -0,0 +1,286 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/croc/v10/src/comm"
+	"github.com/schollz/croc/v10/src/crypt"
+	log "github.com/schollz/logger"
+)
+
+// CapabilityRoomTokens is announced by relays that hand out room tokens:
+// short numbers standing for a room, for peers that can only pass each
+// other a few digits, say over the phone. A room name that short would be
+// guessed; a token is only good once, for RoomTokenTTL, and the relay
+// limits how many a host may try.
+const CapabilityRoomTokens = "room-tokens"
+
+// RoomTokenTTL is how long a room token can be resolved after it was
+// claimed.
+const RoomTokenTTL = 10 * time.Minute
+
+const (
+	roomTokenDigits = 6
+	// maxRoomTokens bounds the live tokens, keeping the token space sparse
+	// enough that guessing one stays hopeless.
+	maxRoomTokens = 10000
+	// maxTokenAttempts is how many tokens one host may try to resolve per
+	// tokenAttemptWindow.
+	maxTokenAttempts   = 10
+	tokenAttemptWindow = time.Minute
+	// tokenRequestTimeout bounds the connections of ClaimRoomToken and
+	// ResolveRoomToken.
+	tokenRequestTimeout = 30 * time.Second
+)
+
+// Token requests are sent in place of a room request. They start with a
+// NUL byte, which no room name does.
+const (
+	claimRequestPrefix   = "\x00claim="
+	resolveRequestPrefix = "\x00resolve="
+)
+
+// Replies to token requests, sent instead of "ok".
+const (
+	tokenResponsePrefix   = "token="
+	roomResponsePrefix    = "room="
+	unknownTokenResponse  = "unknown token"
+	tokenAttemptsResponse = "too many token attempts"
+	tooManyTokensResponse = "too many tokens"
+)
+
+// tokenRoom is what clientCommunication returns for a connection that
+// only claimed or resolved a token, which is closed instead of joining a
+// room. Control channels, which are done once clientCommunication
+// returns, are closed the same way.
+const tokenRoom = "\x00token"
+
+var (
+	// ErrRoomTokensUnsupported is returned by ClaimRoomToken and
+	// ResolveRoomToken when the relay does not announce
+	// CapabilityRoomTokens.
+	ErrRoomTokensUnsupported = errors.New("relay does not hand out room tokens")
+	// ErrUnknownRoomToken is returned by ResolveRoomToken for a token the
+	// relay never handed out, or that expired or was used already.
+	ErrUnknownRoomToken = errors.New("relay does not know the room token; it may have expired or been used")
+	// ErrTooManyTokenAttempts is returned by ResolveRoomToken when this
+	// address tried too many tokens lately.
+	ErrTooManyTokenAttempts = errors.New("relay refused the token: too many attempts from this address")
+	// ErrTooManyRoomTokens is returned by ClaimRoomToken when the relay
+	// has as many live tokens as it allows.
+	ErrTooManyRoomTokens = errors.New("relay refused the token: too many tokens in use")
+)
+
+type roomToken struct {
+	room    string
+	expires time.Time
+}
+
+type tokenAttempts struct {
+	start time.Time
+	n     int
+}
+
+// roomTokens holds the tokens the relay handed out, in memory only, and
+// the resolution attempts of each host.
+type roomTokens struct {
+	sync.Mutex
+	tokens   map[string]roomToken
+	attempts map[string]tokenAttempts
+}
+
+// claim hands out a new token for room, good until RoomTokenTTL after now.
+func (t *roomTokens) claim(room string, now time.Time) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	t.sweepLocked(now)
+	if len(t.tokens) >= maxRoomTokens {
+		return "", ErrTooManyRoomTokens
+	}
+	if t.tokens == nil {
+		t.tokens = make(map[string]roomToken)
+	}
+	limit := big.NewInt(1)
+	for range roomTokenDigits {
+		limit.Mul(limit, big.NewInt(10))
+	}
+	for {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		token := fmt.Sprintf("%0*d", roomTokenDigits, n)
+		if _, taken := t.tokens[token]; taken {
+			continue
+		}
+		t.tokens[token] = roomToken{room: room, expires: now.Add(RoomTokenTTL)}
+		return token, nil
+	}
+}
+
+// resolve returns the room of token for host and forgets the token. Every
+// attempt counts against the host's limit, whether the token is good or
+// not.
+func (t *roomTokens) resolve(host, token string, now time.Time) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	a := t.attempts[host]
+	if now.Sub(a.start) >= tokenAttemptWindow {
+		a = tokenAttempts{start: now}
+	}
+	if a.n >= maxTokenAttempts {
+		return "", ErrTooManyTokenAttempts
+	}
+	a.n++
+	if t.attempts == nil {
+		t.attempts = make(map[string]tokenAttempts)
+	}
+	t.attempts[host] = a
+
+	rt, ok := t.tokens[token]
+	if !ok {
+		return "", ErrUnknownRoomToken
+	}
+	delete(t.tokens, token)
+	if !now.Before(rt.expires) {
+		return "", ErrUnknownRoomToken
+	}
+	return rt.room, nil
+}
+
+// sweep forgets expired tokens and attempt counts whose window has passed.
+func (t *roomTokens) sweep(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.sweepLocked(now)
+}
+
+func (t *roomTokens) sweepLocked(now time.Time) {
+	for token, rt := range t.tokens {
+		if !now.Before(rt.expires) {
+			delete(t.tokens, token)
+		}
+	}
+	for host, a := range t.attempts {
+		if now.Sub(a.start) >= tokenAttemptWindow {
+			delete(t.attempts, host)
+		}
+	}
+}
+
+// handleTokenRequest answers request if it is a token request, from a
+// client at host, and reports whether it was one.
+func (s *server) handleTokenRequest(request, host string, clog *connLogger) (reply string, ok bool) {
+	now := s.clock.Now()
+	if room, found := strings.CutPrefix(request, claimRequestPrefix); found {
+		if !validRoomName.MatchString(room) {
+			clog.Infof("refusing token: invalid room")
+			s.errors.add(now, errorInvalidRoom)
+			return invalidRoomResponse, true
+		}
+		token, err := s.tokens.claim(room, now)
+		if err != nil {
+			clog.Infof("refusing token: %v", err)
+			return tooManyTokensResponse, true
+		}
+		clog.Debugf("handed out a token for room %s", roomLogName(room))
+		return tokenResponsePrefix + token, true
+	}
+	if token, found := strings.CutPrefix(request, resolveRequestPrefix); found {
+		room, err := s.tokens.resolve(host, token, now)
+		if errors.Is(err, ErrTooManyTokenAttempts) {
+			clog.Infof("refusing token: %s tried too many", host)
+			s.errors.add(now, errorTokenAttempts)
+			return tokenAttemptsResponse, true
+		}
+		if err != nil {
+			clog.Debugf("unknown token")
+			return unknownTokenResponse, true
+		}
+		clog.Debugf("resolved a token for room %s", roomLogName(room))
+		return roomResponsePrefix + room, true
+	}
+	return "", false
+}
+
+// ClaimRoomToken asks the relay at address for a token standing for room,
+// which must be a room hash. A peer that resolves the token with
+// ResolveRoomToken within RoomTokenTTL gets room back; after that, or once
+// it has been resolved, the token is gone.
+func ClaimRoomToken(address, password, room string) (token string, err error) {
+	reply, err := tokenRequest(address, password, claimRequestPrefix+room)
+	if err != nil {
+		return
+	}
+	token, ok := strings.CutPrefix(reply, tokenResponsePrefix)
+	if !ok {
+		return "", fmt.Errorf("got bad response: %s", reply)
+	}
+	return token, nil
+}
+
+// ResolveRoomToken asks the relay at address for the room a peer claimed
+// token for. The token cannot be resolved again.
+func ResolveRoomToken(address, password, token string) (room string, err error) {
+	reply, err := tokenRequest(address, password, resolveRequestPrefix+token)
+	if err != nil {
+		return
+	}
+	room, ok := strings.CutPrefix(reply, roomResponsePrefix)
+	if !ok {
+		return "", fmt.Errorf("got bad response: %s", reply)
+	}
+	return room, nil
+}
+
+// tokenRequest sends a token request to the relay at address on a
+// connection of its own and returns the reply, turning refusals into
+// errors.
+func tokenRequest(address, password, request string) (reply string, err error) {
+	c, err := comm.NewConnection(address, tokenRequestTimeout)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	strongKeyForEncryption, _, _, err := clientHandshake(c, password, nil)
+	if err != nil {
+		return
+	}
+	if !c.RelaySupports(CapabilityRoomTokens) {
+		return "", ErrRoomTokensUnsupported
+	}
+	bSend, err := crypt.Encrypt([]byte(request), strongKeyForEncryption)
+	if err != nil {
+		return
+	}
+	if err = c.Send(bSend); err != nil {
+		return
+	}
+	enc, err := c.Receive()
+	if err != nil {
+		return
+	}
+	data, err := crypt.Decrypt(enc, strongKeyForEncryption)
+	if err != nil {
+		return
+	}
+	for response, errResponse := range map[string]error{
+		invalidRoomResponse:   ErrInvalidRoom,
+		unknownTokenResponse:  ErrUnknownRoomToken,
+		tokenAttemptsResponse: ErrTooManyTokenAttempts,
+		tooManyTokensResponse: ErrTooManyRoomTokens,
+	} {
+		if bytes.Equal(data, []byte(response)) {
+			log.Debug(errResponse)
+			return "", errResponse
+		}
+	}
+	return string(data), nil
+}
@@ -0,0 +1,80 @@
+package tcp
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the relay's spans.
+const tracerName = "github.com/schollz/croc/v10/src/tcp"
+
+// Spans and events the relay emits. A connection span covers a connection
+// from accept to disconnect; the handshake spans are its children.
+const (
+	spanConnection = "relay.connection"
+	spanPAKE       = "relay.pake"
+	spanAuth       = "relay.auth"
+	spanRoomJoin   = "relay.room_join"
+
+	eventBroadcast   = "broadcast"
+	eventRoomExpired = "room_expired"
+)
+
+// Attribute keys. The room is truncated like in the logs.
+const (
+	attrRoom          attribute.Key = "croc.room"
+	attrRoomMode      attribute.Key = "croc.room.mode"
+	attrRemoteAddress attribute.Key = "client.address"
+	attrClientApp     attribute.Key = "client.app"
+	attrFrames        attribute.Key = "croc.frames"
+	attrBytes         attribute.Key = "croc.bytes"
+	attrPeers         attribute.Key = "croc.peers"
+)
+
+// broadcastBatch is how many relayed frames make up one broadcast event, so
+// a busy transfer does not emit an event per frame.
+const broadcastBatch = 256
+
+// broadcastCounter batches relayed frames into broadcast events.
+type broadcastCounter struct {
+	frames, bytes, peers int64
+}
+
+// add counts a frame sent to peers and adds an event to span once a batch
+// is full.
+func (b *broadcastCounter) add(span trace.Span, n, peers int) {
+	b.frames++
+	b.bytes += int64(n)
+	b.peers += int64(peers)
+	if b.frames >= broadcastBatch {
+		b.flush(span)
+	}
+}
+
+// flush adds an event for the frames counted since the last one.
+func (b *broadcastCounter) flush(span trace.Span) {
+	if b.frames == 0 {
+		return
+	}
+	span.AddEvent(eventBroadcast, trace.WithAttributes(attrFrames.Int64(b.frames), attrBytes.Int64(b.bytes), attrPeers.Int64(b.peers)))
+	*b = broadcastCounter{}
+}
+
+// startSpan starts a span with the server's tracer as a child of the span
+// in ctx, if any, and returns a context carrying the new span.
+func (s *server) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err and marking the span as failed if there
+// was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
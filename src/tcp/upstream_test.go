@@ -0,0 +1,196 @@
+//go:build upstream
+
+package tcp
+
+// These tests check the relay protocol against upstream croc, and the croc
+// command built from this tree against its clients. Both binaries have to
+// be installed for them, say with
+//
+//	GOBIN=/tmp/croc go install ./
+//	GOBIN=/tmp/upstream go install github.com/schollz/croc/v10@latest
+//	CROC_BIN=/tmp/croc/croc CROC_UPSTREAM=/tmp/upstream/croc go test -tags upstream ./src/tcp/
+//
+// They fail rather than skip without them, so a CI job that sets the tag
+// cannot pass by not running them.
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/schollz/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// upstreamCroc returns the upstream croc binary the tests run.
+func upstreamCroc(t *testing.T) string {
+	bin := os.Getenv("CROC_UPSTREAM")
+	if bin == "" {
+		t.Fatal("CROC_UPSTREAM must name an upstream croc binary")
+	}
+	return bin
+}
+
+// treeCroc returns the croc binary built from this tree.
+func treeCroc(t *testing.T) string {
+	bin := os.Getenv("CROC_BIN")
+	if bin == "" {
+		t.Fatal("CROC_BIN must name the croc binary built from this tree")
+	}
+	return bin
+}
+
+// freePorts returns n TCP ports nothing listens on right now.
+func freePorts(t *testing.T, n int) []string {
+	ports := make([]string, n)
+	for i := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		_, ports[i], _ = net.SplitHostPort(l.Addr().String())
+	}
+	return ports
+}
+
+// startUpstream runs upstream croc with args until the test ends.
+func startUpstream(t *testing.T, args ...string) *exec.Cmd {
+	return startCroc(t, upstreamCroc(t), nil, args...)
+}
+
+// startCroc runs the croc binary bin with args, and env added to its
+// environment, until the test ends.
+func startCroc(t *testing.T, bin string, env []string, args ...string) *exec.Cmd {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// TestUpstreamRelay joins rooms of an upstream relay with this client.
+func TestUpstreamRelay(t *testing.T) {
+	log.SetLevel("error")
+	ports := freePorts(t, 2)
+	startUpstream(t, "--pass", "pass123", "relay", "--host", "127.0.0.1", "--ports", ports[0]+","+ports[1])
+	address := net.JoinHostPort("127.0.0.1", ports[0])
+	assert.Eventually(t, func() bool { return PingServer(address) == nil }, 10*time.Second, 100*time.Millisecond)
+
+	room := "upstream-compat-test"
+	first, banner, ip, err := ConnectToTCPServer(address, "pass123", room, time.Minute)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer first.Close()
+	// the banner lists the transfer ports
+	assert.Equal(t, ports[1], banner)
+	assert.True(t, strings.HasPrefix(ip, "127.0.0.1:"), ip)
+	for _, capability := range relayCapabilities {
+		assert.False(t, first.RelaySupports(capability), capability)
+	}
+
+	// peers asking for more than the room still meet, as the fields are
+	// left out
+	second, _, _, err := ConnectToRoom(address, "pass123", RoomRequest{
+		Room:         room,
+		Policy:       RoomPolicyLatestOnly,
+		App:          ClientApp("croc-chat", "v10.0.0-test"),
+		Capabilities: []string{CapabilityControlFrames},
+	}, time.Minute)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer second.Close()
+
+	// the waiting peer hears of the other, then gets what it sends
+	assert.Equal(t, []byte{1}, receiveWithin(t, first, 5*time.Second))
+	assert.Nil(t, second.Send([]byte("hello upstream")))
+	assert.Equal(t, []byte("hello upstream"), receiveWithin(t, first, 5*time.Second))
+	assert.Nil(t, first.Send([]byte("hello fork")))
+	assert.Equal(t, []byte("hello fork"), receiveWithin(t, second, 5*time.Second))
+
+	_, _, _, err = ConnectToRoom(address, "pass123", RoomRequest{Room: room, Observer: true}, time.Minute)
+	assert.ErrorIs(t, err, ErrObserversUnsupported)
+}
+
+// TestUpstreamClients sends a file through this relay, set up on two ports
+// as croc relay sets it up, between upstream croc and the croc command of
+// this tree both ways, and between two upstream clients.
+func TestUpstreamClients(t *testing.T) {
+	log.SetLevel("error")
+	ports := freePorts(t, 2)
+	var listeners []net.Listener
+	for _, port := range ports {
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	done := make(chan error, 2)
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", ports[1], "pass123", WithListener(listeners[1]), WithLogLevel("error"))
+	}()
+	go func() {
+		done <- RunWithOptionsAsync("127.0.0.1", ports[0], "pass123", WithListener(listeners[0]), WithBanner(ports[1]), WithLogLevel("error"))
+	}()
+	t.Cleanup(func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		<-done
+		<-done
+	})
+	relay := net.JoinHostPort("127.0.0.1", ports[0])
+
+	upstream, tree := upstreamCroc(t), treeCroc(t)
+	for i, c := range []struct {
+		name             string
+		sender, receiver string
+	}{
+		{"upstream to upstream", upstream, upstream},
+		{"upstream to this tree", upstream, tree},
+		{"this tree to upstream", tree, upstream},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sent := filepath.Join(dir, "sent.txt")
+			content := bytes.Repeat([]byte("croc wire compatibility\n"), 4096)
+			assert.Nil(t, os.WriteFile(sent, content, 0o644))
+			code := "738" + strconv.Itoa(i) + "-upstream-compat-" + strconv.Itoa(os.Getpid())
+			// croc takes a chosen code only from the environment on unix
+			startCroc(t, c.sender, []string{"CROC_SECRET=" + code}, "--relay", relay, "--pass", "pass123", "--yes", "send", "--no-local", sent)
+
+			out := filepath.Join(dir, "received")
+			assert.Nil(t, os.MkdirAll(out, 0o755))
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			receive := exec.CommandContext(ctx, c.receiver, "--relay", relay, "--pass", "pass123", "--yes", "--overwrite", "--out", out)
+			receive.Env = append(os.Environ(), "CROC_SECRET="+code)
+			receive.Stdout = os.Stderr
+			receive.Stderr = os.Stderr
+			assert.Nil(t, receive.Run())
+
+			received, err := os.ReadFile(filepath.Join(out, "sent.txt"))
+			assert.Nil(t, err)
+			assert.Equal(t, content, received)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Validate checks a relay configuration without starting it: every option
+// applies, the limits make sense, and the relay's port and HTTP addresses
+// can be bound. It reports all problems at once. The listeners it opens to
+// check the addresses are closed again before it returns.
+func Validate(host, port, password string, opts ...serverOptsFunc) error {
+	s, err := configure(host, port, password, opts)
+	if err != nil {
+		return err
+	}
+	return s.validate()
+}
+
+// DumpConfig returns the effective configuration of a relay started with
+// the same arguments, one setting per line and with secrets masked.
+func DumpConfig(host, port, password string, opts ...serverOptsFunc) (string, error) {
+	s, err := configure(host, port, password, opts)
+	if err != nil {
+		return "", err
+	}
+	return s.dumpConfig(), nil
+}
+
+// configure builds a server from the arguments of RunWithOptionsAsync,
+// applying every option even after one fails so all errors are reported.
+func configure(host, port, password string, opts []serverOptsFunc) (*server, error) {
+	s := newDefaultServer()
+	s.host = host
+	s.port = port
+	s.settings.password = password
+	var errs []error
+	for _, opt := range opts {
+		errs = append(errs, opt(s))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("could not apply optional configurations: %w", err)
+	}
+	return s, nil
+}
+
+// validate checks the settings options cannot check on their own, which
+// is everything that depends on another setting or on the host.
+func (s *server) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(validPort(s.port), "invalid port %q", s.port)
+	if s.settings.banner != "" {
+		for _, p := range strings.Split(s.settings.banner, ",") {
+			check(validPort(p), "banner lists invalid port %q", p)
+		}
+	}
+	check(containsSlice(availableLogLevels, s.debugLevel), "invalid log level %q", s.debugLevel)
+	check(s.roomTTL > 0, "room TTL must be positive, got %s", s.roomTTL)
+	check(s.roomByteQuota >= 0, "room byte quota cannot be negative, got %d", s.roomByteQuota)
+	check(s.quotaWarning >= 0 && s.quotaWarning < 1, "quota warning must be a fraction below 1, got %v", s.quotaWarning)
+	check(s.expiryWarning >= 0, "expiry warning cannot be negative, got %s", s.expiryWarning)
+	check(s.roomCleanupInterval > 0, "room cleanup interval must be positive, got %s", s.roomCleanupInterval)
+	check(s.supersededGracePeriod >= 0, "superseded grace period cannot be negative, got %s", s.supersededGracePeriod)
+	check(s.connIdleTimeout >= 0, "connection idle timeout cannot be negative, got %s", s.connIdleTimeout)
+	check(s.sniffTimeout >= 0, "sniff timeout cannot be negative, got %s", s.sniffTimeout)
+	check(s.handshakeTimeout >= 0, "handshake timeout cannot be negative, got %s", s.handshakeTimeout)
+	check(s.settings.maxRoomsPerIP >= 0, "maximum rooms per IP cannot be negative, got %d", s.settings.maxRoomsPerIP)
+	check(s.replayMaxFrames >= 0 && s.replayMaxBytes >= 0 && (s.replayMaxFrames > 0) == (s.replayMaxBytes > 0),
+		"invalid replay buffer limits: %d frames, %d bytes", s.replayMaxFrames, s.replayMaxBytes)
+	if s.statusAddress != "" {
+		check(s.statusUser != "" && s.statusPassword != "", "status page needs a user and password")
+		check(s.statusAddress != s.statsAddress, "stats and status page cannot share %s", s.statusAddress)
+	}
+
+	if s.setuid != "" {
+		errs = append(errs, checkSetuid(s.setuid))
+	}
+	if s.listener != nil {
+		if addr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+			check(strconv.Itoa(addr.Port) == s.port, "listener is on port %d, not %s", addr.Port, s.port)
+		}
+	}
+
+	// the addresses are only worth trying once they are well formed; a
+	// listener that was passed in is already bound
+	if len(errs) == 0 {
+		if s.listener == nil {
+			network, addr, _, err := listenAddress(s.host, s.port, s.bindExactly)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot resolve host %q: %w", s.host, err))
+			} else {
+				errs = append(errs, canListen("relay", network, addr))
+			}
+		}
+		for _, a := range []struct{ name, addr string }{{"stats", s.statsAddress}, {"status page", s.statusAddress}} {
+			if a.addr != "" {
+				errs = append(errs, canListen(a.name, "tcp", a.addr))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// canListen binds addr and lets go of it again.
+func canListen(name, network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("%s address %s: %w", name, addr, err)
+	}
+	return l.Close()
+}
+
+// maskSecret shows only the first and last character of a secret longer
+// than two characters.
+func maskSecret(secret string) string {
+	if len(secret) > 2 {
+		return fmt.Sprintf("%c***%c", secret[0], secret[len(secret)-1])
+	}
+	return secret
+}
+
+// dumpConfig lists the effective settings for the startup log.
+func (s *server) dumpConfig() string {
+	var b strings.Builder
+	line := func(key string, value any) {
+		fmt.Fprintf(&b, "%s: %v\n", key, value)
+	}
+	line("host", s.host)
+	line("bind exactly", s.bindExactly)
+	line("port", s.port)
+	if s.listener != nil {
+		line("listener", s.listener.Addr())
+	}
+	line("setuid", s.setuid)
+	line("password", maskSecret(s.settings.password))
+	line("banner", s.settings.banner)
+	line("log level", s.debugLevel)
+	line("log sampling", s.logSampling)
+	line("room ttl", s.roomTTL)
+	line("room cleanup interval", s.roomCleanupInterval)
+	line("room byte quota", s.roomByteQuota)
+	line("quota warning", s.quotaWarning)
+	line("expiry warning", s.expiryWarning)
+	line("superseded grace period", s.supersededGracePeriod)
+	line("connection idle timeout", s.connIdleTimeout)
+	line("keepalives are activity", s.keepalivesAreActivity)
+	line("sniff timeout", s.sniffTimeout)
+	line("handshake timeout", s.handshakeTimeout)
+	line("max rooms per ip", s.settings.maxRoomsPerIP)
+	line("replay buffer", fmt.Sprintf("%d frames, %d bytes", s.replayMaxFrames, s.replayMaxBytes))
+	line("buffer encryption", s.bufferEncryption)
+	line("strict room names", s.strictRoomNames)
+	line("stats address", s.statsAddress)
+	line("status address", s.statusAddress)
+	if s.statusAddress != "" {
+		line("status user", s.statusUser)
+		line("status password", maskSecret(s.statusPassword))
+	}
+	if s.cluster != nil {
+		line("cluster peers", strings.Join(s.cluster.peers, ","))
+		line("cluster self", s.cluster.self)
+		line("cluster policy", s.cluster.policy)
+	}
+	line("version", s.version)
+	return strings.TrimSuffix(b.String(), "\n")
+}